@@ -0,0 +1,108 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"net/http"
+)
+
+// Get3PIDs gets the third-party identifiers bound to the user's account.
+// See https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3account3pid
+func (cli *Client) Get3PIDs() (resp *Resp3PIDs, err error) {
+	_, err = cli.MakeRequest(http.MethodGet, cli.BuildURL("account", "3pid"), nil, &resp)
+	return
+}
+
+// RequestAdd3PIDEmailToken asks the homeserver to send a validation email to an email address that will be added to
+// the account. The returned session ID is used with Add3PID once the user has clicked the link in the email.
+// See https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3account3pidemailrequesttoken
+func (cli *Client) RequestAdd3PIDEmailToken(req *ReqRequestEmailToken) (resp *RespRequestToken, err error) {
+	_, err = cli.MakeRequest(http.MethodPost, cli.BuildURL("account", "3pid", "email", "requestToken"), req, &resp)
+	return
+}
+
+// RequestAdd3PIDMSISDNToken asks the homeserver to send a validation SMS to a phone number that will be added to
+// the account. If the response has a SubmitURL, the code from the SMS must be submitted there.
+// See https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3account3pidmsisdnrequesttoken
+func (cli *Client) RequestAdd3PIDMSISDNToken(req *ReqRequestMSISDNToken) (resp *RespRequestToken, err error) {
+	_, err = cli.MakeRequest(http.MethodPost, cli.BuildURL("account", "3pid", "msisdn", "requestToken"), req, &resp)
+	return
+}
+
+// RequestPasswordResetEmailToken asks the homeserver to send a password reset email to an address bound to an account.
+// See https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3accountpasswordemailrequesttoken
+func (cli *Client) RequestPasswordResetEmailToken(req *ReqRequestEmailToken) (resp *RespRequestToken, err error) {
+	_, err = cli.MakeRequest(http.MethodPost, cli.BuildURL("account", "password", "email", "requestToken"), req, &resp)
+	return
+}
+
+// Add3PID adds a validated 3PID to the user's account, using the handler to complete the user-interactive auth flow.
+// See https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3account3pidadd
+func (cli *Client) Add3PID(req *ReqAdd3PID, handler *UIAHandler) error {
+	_, err := cli.MakeUIARequest(FullRequest{
+		Method:      http.MethodPost,
+		URL:         cli.BuildURL("account", "3pid", "add"),
+		RequestJSON: req,
+	}, handler)
+	return err
+}
+
+// Bind3PID binds a validated 3PID to the user's account on the given identity server. The identity server access
+// token can be obtained with the identityserver package.
+// See https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3account3pidbind
+func (cli *Client) Bind3PID(req *ReqBind3PID) error {
+	_, err := cli.MakeFullRequest(FullRequest{
+		Method:           http.MethodPost,
+		URL:              cli.BuildURL("account", "3pid", "bind"),
+		RequestJSON:      req,
+		SensitiveContent: true,
+	})
+	return err
+}
+
+// Unbind3PID removes the binding of a 3PID from the identity server without removing it from the account.
+// See https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3account3pidunbind
+func (cli *Client) Unbind3PID(req *ReqUnbind3PID) (resp *RespIDServerUnbind, err error) {
+	_, err = cli.MakeRequest(http.MethodPost, cli.BuildURL("account", "3pid", "unbind"), req, &resp)
+	return
+}
+
+// Delete3PID removes a 3PID from the user's account. The homeserver also tries to unbind it from the identity server.
+// See https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3account3piddelete
+func (cli *Client) Delete3PID(req *ReqUnbind3PID) (resp *RespIDServerUnbind, err error) {
+	_, err = cli.MakeRequest(http.MethodPost, cli.BuildURL("account", "3pid", "delete"), req, &resp)
+	return
+}
+
+// DeactivateAccount permanently deactivates the user's account, using the handler to complete the user-interactive
+// auth flow. If the deactivation succeeds, the credentials of the client are cleared, as they're no longer valid.
+// See https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3accountdeactivate
+func (cli *Client) DeactivateAccount(req *ReqDeactivateAccount, handler *UIAHandler) (resp *RespIDServerUnbind, err error) {
+	_, err = cli.MakeUIARequest(FullRequest{
+		Method:       http.MethodPost,
+		URL:          cli.BuildURL("account", "deactivate"),
+		RequestJSON:  req,
+		ResponseJSON: &resp,
+	}, handler)
+	if err == nil {
+		cli.ClearCredentials()
+	}
+	return
+}
+
+// ChangePassword changes the password of the user's account, using the handler to complete the user-interactive auth
+// flow. The handler usually needs the current password in UIAHandler.Password.
+// See https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3accountpassword
+func (cli *Client) ChangePassword(req *ReqChangePassword, handler *UIAHandler) error {
+	_, err := cli.MakeUIARequest(FullRequest{
+		Method:           http.MethodPost,
+		URL:              cli.BuildURL("account", "password"),
+		RequestJSON:      req,
+		SensitiveContent: true,
+	}, handler)
+	return err
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+)
+
+// authOf returns the auth data of a request body.
+func authOf(t *testing.T, body string) map[string]interface{} {
+	var req struct {
+		Auth map[string]interface{} `json:"auth"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &req))
+	return req.Auth
+}
+
+func TestClient_3PIDs(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	srv.Respond("GET /_matrix/client/r0/account/3pid", `{"threepids": [{"medium": "email", "address": "user@example.com", "validated_at": 1, "added_at": 2}]}`)
+	threePIDs, err := cli.Get3PIDs()
+	require.NoError(t, err)
+	assert.Equal(t, []mautrix.ThirdPartyIdentifier{{Medium: "email", Address: "user@example.com", ValidatedAt: 1, AddedAt: 2}}, threePIDs.ThreePIDs)
+	srv.Requests()
+
+	srv.Respond("POST /_matrix/client/r0/account/3pid/email/requestToken", `{"sid": "session1"}`)
+	token, err := cli.RequestAdd3PIDEmailToken(&mautrix.ReqRequestEmailToken{ClientSecret: "secret", Email: "user@example.com", SendAttempt: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "session1", token.SessionID)
+	assert.JSONEq(t, `{"client_secret": "secret", "email": "user@example.com", "send_attempt": 1}`, srv.LastRequest(t).Body)
+
+	srv.Respond("POST /_matrix/client/r0/account/3pid/msisdn/requestToken", `{"sid": "session2", "submit_url": "https://example.com/submit"}`)
+	token, err = cli.RequestAdd3PIDMSISDNToken(&mautrix.ReqRequestMSISDNToken{ClientSecret: "secret", Country: "FI", PhoneNumber: "123", SendAttempt: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/submit", token.SubmitURL)
+	assert.JSONEq(t, `{"client_secret": "secret", "country": "FI", "phone_number": "123", "send_attempt": 1}`, srv.LastRequest(t).Body)
+
+	_, err = cli.RequestPasswordResetEmailToken(&mautrix.ReqRequestEmailToken{ClientSecret: "secret", Email: "user@example.com", SendAttempt: 2})
+	require.NoError(t, err)
+	assert.Equal(t, "/_matrix/client/r0/account/password/email/requestToken", srv.LastRequest(t).Path)
+
+	srv.RequireUIA("POST /_matrix/client/r0/account/3pid/add")
+	err = cli.Add3PID(&mautrix.ReqAdd3PID{ClientSecret: "secret", SessionID: "session1"}, &mautrix.UIAHandler{Password: "hunter2"})
+	require.NoError(t, err)
+	requests := srv.Requests()
+	require.Len(t, requests, 2)
+	assert.JSONEq(t, `{"client_secret": "secret", "sid": "session1"}`, requests[0].Body)
+	assert.Equal(t, "hunter2", authOf(t, requests[1].Body)["password"])
+
+	require.NoError(t, cli.Bind3PID(&mautrix.ReqBind3PID{ClientSecret: "secret", SessionID: "session1", IDServer: "id.example.com", IDAccessToken: "idtoken"}))
+	assert.JSONEq(t, `{"client_secret": "secret", "sid": "session1", "id_server": "id.example.com", "id_access_token": "idtoken"}`, srv.LastRequest(t).Body)
+
+	srv.Respond("POST /_matrix/client/r0/account/3pid/unbind", `{"id_server_unbind_result": "success"}`)
+	unbind, err := cli.Unbind3PID(&mautrix.ReqUnbind3PID{Medium: "email", Address: "user@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "success", unbind.IDServerUnbindResult)
+	assert.JSONEq(t, `{"medium": "email", "address": "user@example.com"}`, srv.LastRequest(t).Body)
+
+	srv.Respond("POST /_matrix/client/r0/account/3pid/delete", `{"id_server_unbind_result": "no-support"}`)
+	unbind, err = cli.Delete3PID(&mautrix.ReqUnbind3PID{Medium: "email", Address: "user@example.com", IDServer: "id.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "no-support", unbind.IDServerUnbindResult)
+	assert.JSONEq(t, `{"medium": "email", "address": "user@example.com", "id_server": "id.example.com"}`, srv.LastRequest(t).Body)
+}
+
+func TestClient_DeactivateAccount(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.RequireUIA("POST /_matrix/client/r0/account/deactivate")
+	srv.Respond("POST /_matrix/client/r0/account/deactivate", `{"id_server_unbind_result": "success"}`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+	cli.DeviceID = "DEVICE"
+
+	// Failed deactivations keep the credentials
+	_, err := cli.DeactivateAccount(&mautrix.ReqDeactivateAccount{}, nil)
+	require.Error(t, err)
+	assert.Equal(t, "token", cli.AccessToken)
+	srv.Requests()
+
+	resp, err := cli.DeactivateAccount(&mautrix.ReqDeactivateAccount{Erase: true}, &mautrix.UIAHandler{Password: "hunter2"})
+	require.NoError(t, err)
+	assert.Equal(t, "success", resp.IDServerUnbindResult)
+	requests := srv.Requests()
+	require.Len(t, requests, 2)
+	assert.JSONEq(t, `{"erase": true}`, requests[0].Body)
+	assert.Equal(t, "xyz", authOf(t, requests[1].Body)["session"])
+	assert.Empty(t, cli.AccessToken)
+	assert.Empty(t, cli.UserID)
+	assert.Empty(t, cli.DeviceID)
+}
+
+func TestClient_ChangePassword(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.RequireUIA("POST /_matrix/client/r0/account/password")
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	logoutDevices := false
+	err := cli.ChangePassword(&mautrix.ReqChangePassword{NewPassword: "hunter3", LogoutDevices: &logoutDevices}, &mautrix.UIAHandler{Password: "hunter2"})
+	require.NoError(t, err)
+	requests := srv.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, http.MethodPost, requests[1].Method)
+	assert.JSONEq(t, `{"new_password": "hunter3", "logout_devices": false}`, requests[0].Body)
+	auth := authOf(t, requests[1].Body)
+	assert.Equal(t, "m.login.password", auth["type"])
+	assert.Equal(t, "hunter2", auth["password"])
+	// The access token stays valid
+	assert.Equal(t, "token", cli.AccessToken)
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// AccountDataManager caches global and per-room account data and serializes updates to it.
+//
+// Account data can only be replaced as a whole, so two read-modify-write updates of the same type running at the same
+// time (e.g. two goroutines adding different rooms to m.direct) will lose one of the changes. Update prevents that
+// by only running one update per type at a time and always starting from the latest content on the server.
+//
+// Register the manager with a syncer to keep the cache up to date with changes made by other clients.
+type AccountDataManager struct {
+	Client *Client
+
+	lock   sync.RWMutex
+	global map[string]json.RawMessage
+	rooms  map[id.RoomID]map[string]json.RawMessage
+
+	updateLocks     map[string]*sync.Mutex
+	updateLocksLock sync.Mutex
+}
+
+// NewAccountDataManager creates an account data manager for the given client.
+func NewAccountDataManager(cli *Client) *AccountDataManager {
+	return &AccountDataManager{
+		Client:      cli,
+		global:      make(map[string]json.RawMessage),
+		rooms:       make(map[id.RoomID]map[string]json.RawMessage),
+		updateLocks: make(map[string]*sync.Mutex),
+	}
+}
+
+// Register adds a sync handler that caches the account data events in sync responses.
+func (adm *AccountDataManager) Register(syncer ExtensibleSyncer) {
+	syncer.OnSync(adm.processSync)
+}
+
+func (adm *AccountDataManager) processSync(resp *RespSync, _ string) bool {
+	adm.lock.Lock()
+	defer adm.lock.Unlock()
+	for _, evt := range resp.AccountData.Events {
+		adm.global[evt.Type.Type] = evt.Content.VeryRaw
+	}
+	for roomID, room := range resp.Rooms.Join {
+		for _, evt := range room.AccountData.Events {
+			adm.cacheRoom(roomID, evt.Type.Type, evt.Content.VeryRaw)
+		}
+	}
+	return true
+}
+
+func (adm *AccountDataManager) cacheRoom(roomID id.RoomID, eventType string, data json.RawMessage) {
+	roomData, ok := adm.rooms[roomID]
+	if !ok {
+		roomData = make(map[string]json.RawMessage)
+		adm.rooms[roomID] = roomData
+	}
+	roomData[eventType] = data
+}
+
+func (adm *AccountDataManager) getCached(roomID id.RoomID, eventType string) (data json.RawMessage, ok bool) {
+	adm.lock.RLock()
+	defer adm.lock.RUnlock()
+	if len(roomID) == 0 {
+		data, ok = adm.global[eventType]
+	} else {
+		data, ok = adm.rooms[roomID][eventType]
+	}
+	return
+}
+
+func (adm *AccountDataManager) putCached(roomID id.RoomID, eventType string, data json.RawMessage) {
+	adm.lock.Lock()
+	if len(roomID) == 0 {
+		adm.global[eventType] = data
+	} else {
+		adm.cacheRoom(roomID, eventType, data)
+	}
+	adm.lock.Unlock()
+}
+
+// fetch gets the account data from the server and caches it. Missing account data is cached as nil.
+func (adm *AccountDataManager) fetch(roomID id.RoomID, eventType string) (json.RawMessage, error) {
+	var data json.RawMessage
+	var err error
+	if len(roomID) == 0 {
+		err = adm.Client.GetAccountData(eventType, &data)
+	} else {
+		err = adm.Client.GetRoomAccountData(roomID, eventType, &data)
+	}
+	if errors.Is(err, MNotFound) {
+		data, err = nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	adm.putCached(roomID, eventType, data)
+	return data, nil
+}
+
+func (adm *AccountDataManager) get(roomID id.RoomID, eventType event.Type, output interface{}) (bool, error) {
+	data, ok := adm.getCached(roomID, eventType.Type)
+	if !ok {
+		var err error
+		data, err = adm.fetch(roomID, eventType.Type)
+		if err != nil {
+			return false, err
+		}
+	}
+	if data == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, output)
+}
+
+// Get parses the global account data of the given type into output, fetching it from the server if it's not cached.
+// It returns false if the account data doesn't exist.
+func (adm *AccountDataManager) Get(eventType event.Type, output interface{}) (bool, error) {
+	return adm.get("", eventType, output)
+}
+
+// GetRoom parses the account data of the given type in the given room into output, like Get.
+func (adm *AccountDataManager) GetRoom(roomID id.RoomID, eventType event.Type, output interface{}) (bool, error) {
+	return adm.get(roomID, eventType, output)
+}
+
+func (adm *AccountDataManager) set(roomID id.RoomID, eventType event.Type, content interface{}) error {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	if len(roomID) == 0 {
+		err = adm.Client.SetAccountData(eventType.Type, json.RawMessage(data))
+	} else {
+		err = adm.Client.SetRoomAccountData(roomID, eventType.Type, json.RawMessage(data))
+	}
+	if err != nil {
+		return err
+	}
+	adm.putCached(roomID, eventType.Type, data)
+	return nil
+}
+
+// Set replaces the global account data of the given type with the given content.
+func (adm *AccountDataManager) Set(eventType event.Type, content interface{}) error {
+	return adm.set("", eventType, content)
+}
+
+// SetRoom replaces the account data of the given type in the given room with the given content.
+func (adm *AccountDataManager) SetRoom(roomID id.RoomID, eventType event.Type, content interface{}) error {
+	return adm.set(roomID, eventType, content)
+}
+
+func (adm *AccountDataManager) updateLock(roomID id.RoomID, eventType string) *sync.Mutex {
+	key := string(roomID) + "|" + eventType
+	adm.updateLocksLock.Lock()
+	defer adm.updateLocksLock.Unlock()
+	lock, ok := adm.updateLocks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		adm.updateLocks[key] = lock
+	}
+	return lock
+}
+
+func (adm *AccountDataManager) update(roomID id.RoomID, eventType event.Type, content interface{}, modify func() (bool, error)) error {
+	lock := adm.updateLock(roomID, eventType.Type)
+	lock.Lock()
+	defer lock.Unlock()
+	// Always start from the content on the server, as the cache may lag behind changes made by other clients
+	data, err := adm.fetch(roomID, eventType.Type)
+	if err != nil {
+		return err
+	} else if data != nil {
+		err = json.Unmarshal(data, content)
+		if err != nil {
+			return err
+		}
+	}
+	changed, err := modify()
+	if err != nil || !changed {
+		return err
+	}
+	return adm.set(roomID, eventType, content)
+}
+
+// Update performs a read-modify-write update of the global account data of the given type. The latest content is
+// parsed into content (which must be a pointer), after which modify is called to change it. If modify returns true,
+// the modified content is saved. Updates to the same type through the same manager never run concurrently.
+//
+//	direct := event.DirectChatsEventContent{}
+//	err := adm.Update(event.AccountDataDirectChats, &direct, func() (bool, error) {
+//		direct[userID] = append(direct[userID], roomID)
+//		return true, nil
+//	})
+func (adm *AccountDataManager) Update(eventType event.Type, content interface{}, modify func() (bool, error)) error {
+	return adm.update("", eventType, content, modify)
+}
+
+// UpdateRoom performs a read-modify-write update of the account data of the given type in the given room, like Update.
+func (adm *AccountDataManager) UpdateRoom(roomID id.RoomID, eventType event.Type, content interface{}, modify func() (bool, error)) error {
+	return adm.update(roomID, eventType, content, modify)
+}
+
+// AddDirectChat marks the given room as a direct chat with the given user in m.direct.
+func (adm *AccountDataManager) AddDirectChat(userID id.UserID, roomID id.RoomID) error {
+	direct := event.DirectChatsEventContent{}
+	return adm.Update(event.AccountDataDirectChats, &direct, func() (bool, error) {
+		for _, existingRoomID := range direct[userID] {
+			if existingRoomID == roomID {
+				return false, nil
+			}
+		}
+		direct[userID] = append(direct[userID], roomID)
+		return true, nil
+	})
+}
+
+// RemoveDirectChat removes the given room from the direct chats of all users in m.direct.
+func (adm *AccountDataManager) RemoveDirectChat(roomID id.RoomID) error {
+	direct := event.DirectChatsEventContent{}
+	return adm.Update(event.AccountDataDirectChats, &direct, func() (changed bool, err error) {
+		for userID, roomIDs := range direct {
+			filtered := roomIDs[:0]
+			for _, existingRoomID := range roomIDs {
+				if existingRoomID != roomID {
+					filtered = append(filtered, existingRoomID)
+				}
+			}
+			if len(filtered) != len(roomIDs) {
+				changed = true
+				if len(filtered) == 0 {
+					delete(direct, userID)
+				} else {
+					direct[userID] = filtered
+				}
+			}
+		}
+		return
+	})
+}
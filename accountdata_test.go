@@ -0,0 +1,212 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// accountDataServer is a homeserver that stores account data in memory.
+type accountDataServer struct {
+	*httptest.Server
+	lock sync.Mutex
+	data map[string][]byte
+	gets int
+	puts int
+}
+
+func newAccountDataServer() *accountDataServer {
+	srv := &accountDataServer{data: make(map[string][]byte)}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.lock.Lock()
+		defer srv.lock.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+			srv.gets++
+			data, ok := srv.data[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Account data not found"}`))
+				return
+			}
+			_, _ = w.Write(data)
+		case http.MethodPut:
+			srv.puts++
+			srv.data[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	return srv
+}
+
+func (srv *accountDataServer) counts() (gets, puts int) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.gets, srv.puts
+}
+
+func (srv *accountDataServer) newManager(t *testing.T) *mautrix.AccountDataManager {
+	cli := mautrix.NewTestClient(t, srv.URL)
+	return mautrix.NewAccountDataManager(cli)
+}
+
+const directPath = "/_matrix/client/r0/user/@user:example.com/account_data/m.direct"
+
+func TestAccountDataManager_GetSet(t *testing.T) {
+	srv := newAccountDataServer()
+	defer srv.Close()
+	adm := srv.newManager(t)
+
+	var direct event.DirectChatsEventContent
+	found, err := adm.Get(event.AccountDataDirectChats, &direct)
+	require.NoError(t, err)
+	assert.False(t, found)
+	// Missing account data is cached too
+	found, err = adm.Get(event.AccountDataDirectChats, &direct)
+	require.NoError(t, err)
+	assert.False(t, found)
+	gets, _ := srv.counts()
+	assert.Equal(t, 1, gets)
+
+	require.NoError(t, adm.Set(event.AccountDataDirectChats, event.DirectChatsEventContent{"@friend:example.com": {"!dm:example.com"}}))
+	assert.JSONEq(t, `{"@friend:example.com": ["!dm:example.com"]}`, string(srv.data[directPath]))
+	found, err = adm.Get(event.AccountDataDirectChats, &direct)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []id.RoomID{"!dm:example.com"}, direct["@friend:example.com"])
+	gets, _ = srv.counts()
+	assert.Equal(t, 1, gets)
+
+	tagType := event.Type{Type: "m.tag", Class: event.AccountDataEventType}
+	require.NoError(t, adm.SetRoom("!room:example.com", tagType, map[string]interface{}{"tags": map[string]interface{}{"u.work": map[string]interface{}{}}}))
+	assert.Contains(t, srv.data, "/_matrix/client/r0/user/@user:example.com/rooms/!room:example.com/account_data/m.tag")
+	var tags map[string]json.RawMessage
+	found, err = adm.GetRoom("!room:example.com", tagType, &tags)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Contains(t, tags, "tags")
+	found, err = adm.GetRoom("!other:example.com", tagType, &tags)
+	require.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestAccountDataManager_Sync(t *testing.T) {
+	srv := newAccountDataServer()
+	defer srv.Close()
+	adm := srv.newManager(t)
+	syncer := mautrix.NewDefaultSyncer()
+	adm.Register(syncer)
+
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"next_batch": "1",
+		"account_data": {"events": [{"type": "m.direct", "content": {"@friend:example.com": ["!dm:example.com"]}}]},
+		"rooms": {"join": {"!room:example.com": {"account_data": {"events": [{"type": "m.fully_read", "content": {"event_id": "$read"}}]}}}}
+	}`), &resp))
+	require.NoError(t, syncer.ProcessResponse(&resp, ""))
+
+	var direct event.DirectChatsEventContent
+	found, err := adm.Get(event.AccountDataDirectChats, &direct)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []id.RoomID{"!dm:example.com"}, direct["@friend:example.com"])
+	var fullyRead event.FullyReadEventContent
+	found, err = adm.GetRoom("!room:example.com", event.AccountDataFullyRead, &fullyRead)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, id.EventID("$read"), fullyRead.EventID)
+	// Everything came from the sync response
+	gets, _ := srv.counts()
+	assert.Zero(t, gets)
+}
+
+func TestAccountDataManager_DirectChats(t *testing.T) {
+	srv := newAccountDataServer()
+	defer srv.Close()
+	srv.data[directPath] = []byte(`{"@a:example.com": ["!a1:example.com", "!shared:example.com"], "@b:example.com": ["!shared:example.com"]}`)
+	adm := srv.newManager(t)
+
+	require.NoError(t, adm.AddDirectChat("@a:example.com", "!a2:example.com"))
+	assert.JSONEq(t, `{"@a:example.com": ["!a1:example.com", "!shared:example.com", "!a2:example.com"], "@b:example.com": ["!shared:example.com"]}`, string(srv.data[directPath]))
+
+	// Updates always start from the content on the server, even if it changed after it was cached
+	srv.lock.Lock()
+	srv.data[directPath] = []byte(`{"@a:example.com": ["!a1:example.com", "!shared:example.com"], "@b:example.com": ["!shared:example.com"], "@c:example.com": ["!c:example.com"]}`)
+	srv.lock.Unlock()
+	require.NoError(t, adm.RemoveDirectChat("!shared:example.com"))
+	assert.JSONEq(t, `{"@a:example.com": ["!a1:example.com"], "@c:example.com": ["!c:example.com"]}`, string(srv.data[directPath]))
+
+	// Nothing is saved if the content didn't change
+	_, putsBefore := srv.counts()
+	require.NoError(t, adm.AddDirectChat("@a:example.com", "!a1:example.com"))
+	require.NoError(t, adm.RemoveDirectChat("!unknown:example.com"))
+	_, putsAfter := srv.counts()
+	assert.Equal(t, putsBefore, putsAfter)
+}
+
+func TestAccountDataManager_ConcurrentUpdates(t *testing.T) {
+	srv := newAccountDataServer()
+	defer srv.Close()
+	adm := srv.newManager(t)
+
+	const count = 20
+	var wg sync.WaitGroup
+	wg.Add(count)
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			defer wg.Done()
+			errs <- adm.AddDirectChat(id.UserID(fmt.Sprintf("@user%d:example.com", i%4)), id.RoomID(fmt.Sprintf("!room%d:example.com", i)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	var direct event.DirectChatsEventContent
+	require.NoError(t, json.Unmarshal(srv.data[directPath], &direct))
+	total := 0
+	for _, roomIDs := range direct {
+		total += len(roomIDs)
+	}
+	// No update was lost
+	assert.Equal(t, count, total)
+	assert.Len(t, direct, 4)
+}
+
+func TestAccountDataManager_UpdateError(t *testing.T) {
+	srv := newAccountDataServer()
+	defer srv.Close()
+	adm := srv.newManager(t)
+
+	var direct event.DirectChatsEventContent
+	err := adm.Update(event.AccountDataDirectChats, &direct, func() (bool, error) {
+		return true, fmt.Errorf("modify failed")
+	})
+	assert.EqualError(t, err, "modify failed")
+	_, puts := srv.counts()
+	assert.Zero(t, puts)
+
+	srv.Close()
+	err = adm.AddDirectChat("@a:example.com", "!a:example.com")
+	assert.Error(t, err)
+}
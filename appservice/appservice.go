@@ -112,6 +112,8 @@ type AppService struct {
 	MessageSendCheckpointEndpoint string
 
 	DefaultHTTPRetries int
+	// The retry policy for clients created by the appservice. If nil, mautrix.DefaultRetryPolicy is used.
+	RetryPolicy *mautrix.RetryPolicy
 
 	Live  bool
 	Ready bool
@@ -245,6 +247,7 @@ func (as *AppService) makeClient(userID id.UserID) *mautrix.Client {
 	client.Logger = as.Log.Sub(string(userID))
 	client.Client = as.HTTPClient
 	client.DefaultHTTPRetries = as.DefaultHTTPRetries
+	client.RetryPolicy = as.RetryPolicy
 	as.clients[userID] = client
 	return client
 }
@@ -0,0 +1,282 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CapBooleanTrue is a capability that is enabled unless the server explicitly disables it.
+type CapBooleanTrue struct {
+	Enabled bool `json:"enabled"`
+}
+
+// IsEnabled returns whether the capability is enabled. Missing capabilities are enabled by default.
+func (cb *CapBooleanTrue) IsEnabled() bool {
+	return cb == nil || cb.Enabled
+}
+
+// CapRoomVersionStability is the stability of a room version in the m.room_versions capability.
+type CapRoomVersionStability string
+
+const (
+	CapRoomVersionStable   CapRoomVersionStability = "stable"
+	CapRoomVersionUnstable CapRoomVersionStability = "unstable"
+)
+
+// CapRoomVersions is the m.room_versions capability.
+type CapRoomVersions struct {
+	Default   string                             `json:"default"`
+	Available map[string]CapRoomVersionStability `json:"available"`
+}
+
+// IsStable returns whether the given room version is available and stable.
+func (vers *CapRoomVersions) IsStable(version string) bool {
+	return vers != nil && vers.Available[version] == CapRoomVersionStable
+}
+
+// IsAvailable returns whether the given room version is available, including unstable versions.
+func (vers *CapRoomVersions) IsAvailable(version string) bool {
+	if vers == nil {
+		return false
+	}
+	_, ok := vers.Available[version]
+	return ok
+}
+
+// RespCapabilities is the JSON response for https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3capabilities
+type RespCapabilities struct {
+	RoomVersions    *CapRoomVersions `json:"m.room_versions,omitempty"`
+	ChangePassword  *CapBooleanTrue  `json:"m.change_password,omitempty"`
+	SetDisplayname  *CapBooleanTrue  `json:"m.set_displayname,omitempty"`
+	SetAvatarURL    *CapBooleanTrue  `json:"m.set_avatar_url,omitempty"`
+	ThreePIDChanges *CapBooleanTrue  `json:"m.3pid_changes,omitempty"`
+
+	// Custom contains all capabilities, including the ones that have typed fields above.
+	Custom map[string]json.RawMessage `json:"-"`
+}
+
+type marshalableRespCapabilities RespCapabilities
+
+func (rc *RespCapabilities) UnmarshalJSON(data []byte) error {
+	var wrapper struct {
+		Capabilities json.RawMessage `json:"capabilities"`
+	}
+	err := json.Unmarshal(data, &wrapper)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(wrapper.Capabilities, &rc.Custom)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(wrapper.Capabilities, (*marshalableRespCapabilities)(rc))
+}
+
+func (rc *RespCapabilities) MarshalJSON() ([]byte, error) {
+	caps := make(map[string]interface{}, len(rc.Custom)+5)
+	for key, value := range rc.Custom {
+		caps[key] = value
+	}
+	typed, err := json.Marshal((*marshalableRespCapabilities)(rc))
+	if err != nil {
+		return nil, err
+	}
+	var typedMap map[string]json.RawMessage
+	err = json.Unmarshal(typed, &typedMap)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range typedMap {
+		caps[key] = value
+	}
+	return json.Marshal(map[string]interface{}{"capabilities": caps})
+}
+
+// GetCustom parses a capability that doesn't have a typed field into the given output.
+// It returns false if the server didn't include the capability.
+func (rc *RespCapabilities) GetCustom(name string, output interface{}) (bool, error) {
+	data, ok := rc.Custom[name]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, output)
+}
+
+// GetCapabilities gets the capabilities of the homeserver. Use CachedCapabilities to avoid refetching them.
+// See https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3capabilities
+func (cli *Client) GetCapabilities() (resp *RespCapabilities, err error) {
+	_, err = cli.MakeRequest(http.MethodGet, cli.BuildURL("capabilities"), nil, &resp)
+	return
+}
+
+// SpecVersion is a version of the Matrix client-server spec, e.g. v1.3 or r0.6.1.
+// Legacy r0.x versions are treated as older than v1.0.
+type SpecVersion struct {
+	Major int
+	Minor int
+}
+
+// ParseSpecVersion parses a version string from the /versions endpoint.
+func ParseSpecVersion(version string) (ver SpecVersion, ok bool) {
+	var parts []string
+	if strings.HasPrefix(version, "v") {
+		parts = strings.Split(version[1:], ".")
+		if len(parts) != 2 {
+			return
+		}
+	} else if strings.HasPrefix(version, "r0.") {
+		// r0.x.y is mapped to 0.x
+		parts = strings.Split(version[1:], ".")[:2]
+	} else {
+		return
+	}
+	var err error
+	if ver.Major, err = strconv.Atoi(parts[0]); err != nil {
+		return
+	} else if ver.Minor, err = strconv.Atoi(parts[1]); err != nil {
+		return
+	}
+	return ver, true
+}
+
+// MustParseSpecVersion parses a spec version and panics if it's invalid.
+func MustParseSpecVersion(version string) SpecVersion {
+	ver, ok := ParseSpecVersion(version)
+	if !ok {
+		panic("invalid spec version " + version)
+	}
+	return ver
+}
+
+// GreaterThanOrEqual returns whether this version is the same as or newer than the other version.
+func (ver SpecVersion) GreaterThanOrEqual(other SpecVersion) bool {
+	return ver.Major > other.Major || (ver.Major == other.Major && ver.Minor >= other.Minor)
+}
+
+func (ver SpecVersion) String() string {
+	if ver.Major == 0 {
+		return "r0." + strconv.Itoa(ver.Minor)
+	}
+	return "v" + strconv.Itoa(ver.Major) + "." + strconv.Itoa(ver.Minor)
+}
+
+// Latest returns the latest spec version that the server supports.
+func (versions *RespVersions) Latest() (latest SpecVersion) {
+	for _, str := range versions.Versions {
+		if ver, ok := ParseSpecVersion(str); ok && ver.GreaterThanOrEqual(latest) {
+			latest = ver
+		}
+	}
+	return
+}
+
+// ContainsGreaterOrEqual returns whether the server supports the given spec version or a newer one.
+func (versions *RespVersions) ContainsGreaterOrEqual(version SpecVersion) bool {
+	for _, str := range versions.Versions {
+		if ver, ok := ParseSpecVersion(str); ok && ver.GreaterThanOrEqual(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// Feature is a feature that may be available in a spec version or as an unstable feature before that.
+type Feature struct {
+	// UnstableFlag is the flag in the unstable_features map of /versions that enables the feature.
+	UnstableFlag string
+	// SpecVersion is the first spec version that includes the feature.
+	SpecVersion SpecVersion
+}
+
+var (
+	FeatureKnocking           = Feature{UnstableFlag: "xyz.amorgan.knock", SpecVersion: MustParseSpecVersion("v1.1")}
+	FeatureRestrictedJoins    = Feature{SpecVersion: MustParseSpecVersion("v1.2")}
+	FeatureRefreshTokens      = Feature{SpecVersion: MustParseSpecVersion("v1.3")}
+	FeatureAuthenticatedMedia = Feature{UnstableFlag: "org.matrix.msc3916.stable", SpecVersion: MustParseSpecVersion("v1.11")}
+	// FeatureSlidingSync is simplified sliding sync (MSC4186), which isn't in any spec version yet.
+	FeatureSlidingSync = Feature{UnstableFlag: "org.matrix.simplified_msc3575"}
+)
+
+// Supports returns whether the server supports the given feature, either through a new enough spec version or
+// the unstable feature flag. Features without a spec version are only supported through the unstable flag.
+func (versions *RespVersions) Supports(feature Feature) bool {
+	if versions == nil {
+		return false
+	}
+	return (len(feature.UnstableFlag) > 0 && versions.UnstableFeatures[feature.UnstableFlag]) ||
+		(feature.SpecVersion != SpecVersion{} && versions.ContainsGreaterOrEqual(feature.SpecVersion))
+}
+
+// CachedVersions returns the /versions response of the homeserver, fetching it on the first call.
+func (cli *Client) CachedVersions() (*RespVersions, error) {
+	cli.serverInfoLock.Lock()
+	defer cli.serverInfoLock.Unlock()
+	if cli.versions == nil {
+		versions, err := cli.Versions()
+		if err != nil {
+			return nil, err
+		}
+		cli.versions = versions
+	}
+	return cli.versions, nil
+}
+
+// CachedCapabilities returns the /capabilities response of the homeserver, fetching it on the first call.
+func (cli *Client) CachedCapabilities() (*RespCapabilities, error) {
+	cli.serverInfoLock.Lock()
+	defer cli.serverInfoLock.Unlock()
+	if cli.capabilities == nil {
+		caps, err := cli.GetCapabilities()
+		if err != nil {
+			return nil, err
+		}
+		cli.capabilities = caps
+	}
+	return cli.capabilities, nil
+}
+
+// ClearServerInfoCache clears the cached versions and capabilities, e.g. after the homeserver has been upgraded.
+func (cli *Client) ClearServerInfoCache() {
+	cli.serverInfoLock.Lock()
+	cli.versions = nil
+	cli.capabilities = nil
+	cli.serverInfoLock.Unlock()
+}
+
+// SupportsFeature checks if the homeserver supports the given feature using the cached /versions response.
+// If the versions can't be fetched, the feature is assumed to be unsupported.
+func (cli *Client) SupportsFeature(feature Feature) bool {
+	versions, err := cli.CachedVersions()
+	if err != nil {
+		cli.logWarning("Failed to fetch supported versions to check feature support: %v", err)
+		return false
+	}
+	return versions.Supports(feature)
+}
+
+// DefaultRoomVersion returns the default room version of the homeserver from the cached capabilities,
+// or an empty string if the server didn't specify one.
+func (cli *Client) DefaultRoomVersion() (string, error) {
+	caps, err := cli.CachedCapabilities()
+	if err != nil || caps.RoomVersions == nil {
+		return "", err
+	}
+	return caps.RoomVersions.Default, nil
+}
+
+// CanChangePassword returns whether the homeserver allows changing the password according to the cached capabilities.
+func (cli *Client) CanChangePassword() (bool, error) {
+	caps, err := cli.CachedCapabilities()
+	if err != nil {
+		return false, err
+	}
+	return caps.ChangePassword.IsEnabled(), nil
+}
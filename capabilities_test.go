@@ -0,0 +1,145 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+)
+
+const testCapabilities = `{"capabilities": {
+	"m.room_versions": {"default": "9", "available": {"1": "stable", "9": "stable", "org.example.v1": "unstable"}},
+	"m.change_password": {"enabled": false},
+	"org.example.custom": {"max": 5}
+}}`
+
+func TestRespCapabilities_JSON(t *testing.T) {
+	var caps mautrix.RespCapabilities
+	require.NoError(t, json.Unmarshal([]byte(testCapabilities), &caps))
+	assert.Equal(t, "9", caps.RoomVersions.Default)
+	assert.True(t, caps.RoomVersions.IsStable("9"))
+	assert.False(t, caps.RoomVersions.IsStable("org.example.v1"))
+	assert.True(t, caps.RoomVersions.IsAvailable("org.example.v1"))
+	assert.False(t, caps.RoomVersions.IsAvailable("10"))
+	assert.False(t, caps.ChangePassword.IsEnabled())
+	// Missing capabilities are enabled by default
+	assert.Nil(t, caps.SetDisplayname)
+	assert.True(t, caps.SetDisplayname.IsEnabled())
+	assert.Contains(t, caps.Custom, "m.room_versions")
+
+	var custom struct {
+		Max int `json:"max"`
+	}
+	found, err := caps.GetCustom("org.example.custom", &custom)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 5, custom.Max)
+	found, err = caps.GetCustom("org.example.missing", &custom)
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	// Custom capabilities survive a round trip, and typed fields override them
+	caps.ChangePassword.Enabled = true
+	data, err := json.Marshal(&caps)
+	require.NoError(t, err)
+	var roundTripped mautrix.RespCapabilities
+	require.NoError(t, json.Unmarshal(data, &roundTripped))
+	assert.True(t, roundTripped.ChangePassword.IsEnabled())
+	assert.JSONEq(t, `{"max": 5}`, string(roundTripped.Custom["org.example.custom"]))
+	assert.Equal(t, caps.RoomVersions, roundTripped.RoomVersions)
+}
+
+func TestParseSpecVersion(t *testing.T) {
+	for input, expected := range map[string]mautrix.SpecVersion{
+		"v1.3":   {Major: 1, Minor: 3},
+		"v1.11":  {Major: 1, Minor: 11},
+		"r0.6.1": {Major: 0, Minor: 6},
+	} {
+		ver, ok := mautrix.ParseSpecVersion(input)
+		assert.True(t, ok, input)
+		assert.Equal(t, expected, ver, input)
+	}
+	for _, input := range []string{"", "1.3", "v1", "v1.2.3", "vX.1", "r0", "r0.x.1"} {
+		_, ok := mautrix.ParseSpecVersion(input)
+		assert.False(t, ok, input)
+	}
+	assert.Equal(t, "v1.11", mautrix.MustParseSpecVersion("v1.11").String())
+	assert.Equal(t, "r0.6", mautrix.MustParseSpecVersion("r0.6.1").String())
+	assert.Panics(t, func() { mautrix.MustParseSpecVersion("invalid") })
+
+	assert.True(t, mautrix.MustParseSpecVersion("v1.0").GreaterThanOrEqual(mautrix.MustParseSpecVersion("r0.6.1")))
+	assert.True(t, mautrix.MustParseSpecVersion("v1.11").GreaterThanOrEqual(mautrix.MustParseSpecVersion("v1.2")))
+	assert.False(t, mautrix.MustParseSpecVersion("v1.2").GreaterThanOrEqual(mautrix.MustParseSpecVersion("v1.11")))
+}
+
+func TestRespVersions_Supports(t *testing.T) {
+	versions := &mautrix.RespVersions{
+		Versions:         []string{"r0.6.1", "v1.1", "v1.2", "unknown"},
+		UnstableFeatures: map[string]bool{"org.matrix.msc3916.stable": true, "org.matrix.simplified_msc3575": false},
+	}
+	assert.Equal(t, mautrix.MustParseSpecVersion("v1.2"), versions.Latest())
+	assert.True(t, versions.ContainsGreaterOrEqual(mautrix.MustParseSpecVersion("v1.1")))
+	assert.False(t, versions.ContainsGreaterOrEqual(mautrix.MustParseSpecVersion("v1.3")))
+	assert.True(t, versions.Supports(mautrix.FeatureKnocking))
+	assert.True(t, versions.Supports(mautrix.FeatureRestrictedJoins))
+	assert.False(t, versions.Supports(mautrix.FeatureRefreshTokens))
+	// Unstable flags enable features before the server supports the spec version
+	assert.True(t, versions.Supports(mautrix.FeatureAuthenticatedMedia))
+	assert.False(t, versions.Supports(mautrix.FeatureSlidingSync))
+	versions.UnstableFeatures["org.matrix.simplified_msc3575"] = true
+	assert.True(t, versions.Supports(mautrix.FeatureSlidingSync))
+
+	var nilVersions *mautrix.RespVersions
+	assert.False(t, nilVersions.Supports(mautrix.FeatureKnocking))
+}
+
+func TestClient_CachedServerInfo(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("GET /_matrix/client/versions", `{"versions": ["v1.1"], "unstable_features": {}}`)
+	srv.Respond("GET /_matrix/client/r0/capabilities", testCapabilities)
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	assert.True(t, cli.SupportsFeature(mautrix.FeatureKnocking))
+	assert.False(t, cli.SupportsFeature(mautrix.FeatureRefreshTokens))
+	defaultVersion, err := cli.DefaultRoomVersion()
+	require.NoError(t, err)
+	assert.Equal(t, "9", defaultVersion)
+	canChange, err := cli.CanChangePassword()
+	require.NoError(t, err)
+	assert.False(t, canChange)
+	// Each endpoint is only requested once
+	requests := srv.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, "/_matrix/client/versions", requests[0].Path)
+	assert.Equal(t, "/_matrix/client/r0/capabilities", requests[1].Path)
+
+	srv.Respond("GET /_matrix/client/versions", `{"versions": ["v1.3"]}`)
+	srv.Respond("GET /_matrix/client/r0/capabilities", `{"capabilities": {}}`)
+	cli.ClearServerInfoCache()
+	assert.True(t, cli.SupportsFeature(mautrix.FeatureRefreshTokens))
+	defaultVersion, err = cli.DefaultRoomVersion()
+	require.NoError(t, err)
+	assert.Empty(t, defaultVersion)
+	canChange, err = cli.CanChangePassword()
+	require.NoError(t, err)
+	assert.True(t, canChange)
+	assert.Len(t, srv.Requests(), 2)
+
+	// Errors aren't cached
+	cli.ClearServerInfoCache()
+	srv.RespondStatus("GET /_matrix/client/versions", http.StatusInternalServerError, `{"errcode": "M_UNKNOWN", "error": "Internal error"}`)
+	assert.False(t, cli.SupportsFeature(mautrix.FeatureKnocking))
+	assert.False(t, cli.SupportsFeature(mautrix.FeatureKnocking))
+	assert.Len(t, srv.Requests(), 2)
+}
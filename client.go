@@ -16,6 +16,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -52,18 +53,55 @@ type Client struct {
 	UserID        id.UserID    // The user ID of the client. Used for forming HTTP paths which use the client's user ID.
 	DeviceID      id.DeviceID  // The device ID of the client.
 	AccessToken   string       // The access_token for the client.
+	RefreshToken  string       // The refresh_token for the client, used to get a new access token after a soft logout.
 	UserAgent     string       // The value for the User-Agent header
 	Client        *http.Client // The underlying HTTP client which will be used to make HTTP requests.
 	Syncer        Syncer       // The thing which can process /sync responses
 	Store         Storer       // The thing which can store rooms/tokens/ids
 	Logger        Logger
 	SyncPresence  event.Presence
+	// If true, presence events are excluded from the sync filter when it's created, which saves a lot of bandwidth
+	// for bots that don't care about presence.
+	DisableSyncPresence bool
 
 	StreamSyncMinAge time.Duration
 
 	// Number of times that mautrix will retry any HTTP request
 	// if the request fails entirely or returns a HTTP gateway error (502-504)
 	DefaultHTTPRetries int
+	// The policy for retrying failed requests. If nil, DefaultRetryPolicy is used.
+	RetryPolicy *RetryPolicy
+	// An optional client-side rate limiter that delays requests before they're sent, including retries.
+	RateLimiter *RateLimiter
+	// Middlewares that wrap every HTTP request made by the client. See Use.
+	Middlewares []Middleware
+	// An optional store for transaction IDs. If set, transaction IDs are generated from a persistent counter, and
+	// requests with an idempotency key reuse their transaction ID when they're retried, even after restarts.
+	TxnIDStore TxnIDStore
+	// Timeouts for each attempt of requests to the given endpoint classes, e.g. a long timeout for /sync and a short
+	// one for sending messages. The timeout of the HTTP client itself still applies, see ConfigureTransport.
+	EndpointTimeouts map[EndpointClass]time.Duration
+	// An optional logger that receives structured details of every HTTP request attempt.
+	RequestLogger RequestLogger
+	// How ValidateSession should recover from an invalidated access token or a device ID mismatch.
+	SessionRecovery *SessionRecovery
+	// An optional store for the sync filter ID and next_batch token, which replaces Store for those in Sync.
+	SyncStore SyncStore
+	// If the next_batch token in SyncStore is older than this, it's discarded and syncing starts over with an
+	// initial sync instead of fetching everything that happened since the token.
+	MaxSyncTokenAge time.Duration
+	// The filter to use for the initial sync after discarding a stale next_batch token, e.g. with a small timeline
+	// limit to avoid processing lots of old events. If nil, the normal filter is used.
+	StaleSyncFilter *Filter
+	// If set, sync responses are parsed incrementally using ParseSyncStream, which keeps memory usage low with large
+	// initial syncs. Rooms that are passed to the callbacks of the handler are not passed to the Syncer, so room
+	// callbacks can't be used with DefaultSyncer or SyncJournal (see ErrSyncStreamRoomCallbacks).
+	SyncStreamHandler *SyncStreamHandler
+	// An optional watchdog that reports sync errors and stalls, see SyncWatchdog.
+	SyncWatchdog *SyncWatchdog
+	// An optional journal for the rooms in sync responses, which are replayed after a restart if they weren't
+	// processed successfully. See SyncJournal.
+	SyncJournal SyncJournal
 
 	txnID int32
 
@@ -73,11 +111,35 @@ type Client struct {
 	AppServiceUserID id.UserID
 
 	syncingID uint32 // Identifies the current Sync. Only one Sync can be active at any given time.
+
+	// OnTokenRefresh is called after the access token has been refreshed using RefreshToken, either automatically
+	// after a soft logout or with RefreshAccessToken. The refresh token may have been rotated too, so the new tokens
+	// in the client should be persisted.
+	OnTokenRefresh func(resp *RespRefresh)
+	// Refresher replaces the /refresh endpoint of the homeserver when refreshing the access token, e.g. when the
+	// tokens were issued by an OpenID Connect provider (see the oidc package).
+	Refresher   func(refreshToken string) (*RespRefresh, error)
+	refreshLock sync.Mutex
+
+	// Cached server information, see CachedVersions and CachedCapabilities.
+	versions       *RespVersions
+	capabilities   *RespCapabilities
+	serverInfoLock sync.Mutex
+
+	// Uploaded filter IDs and the filter to switch to in Sync, see GetOrCreateFilter and SetSyncFilter.
+	filterCache      map[string]string
+	nextSyncFilterID string
+	filterLock       sync.Mutex
+
+	// Background refreshers of typing notifications, see StartTyping.
+	typingRefreshers map[id.RoomID]*typingRefresher
+	typingLock       sync.Mutex
 }
 
 type ClientWellKnown struct {
-	Homeserver     HomeserverInfo     `json:"m.homeserver"`
-	IdentityServer IdentityServerInfo `json:"m.identity_server"`
+	Homeserver     HomeserverInfo      `json:"m.homeserver"`
+	IdentityServer IdentityServerInfo  `json:"m.identity_server"`
+	Authentication *AuthenticationInfo `json:"org.matrix.msc2965.authentication,omitempty"`
 }
 
 type HomeserverInfo struct {
@@ -88,47 +150,10 @@ type IdentityServerInfo struct {
 	BaseURL string `json:"base_url"`
 }
 
-// DiscoverClientAPI resolves the client API URL from a Matrix server name.
-// Use ParseUserID to extract the server name from a user ID.
-// https://matrix.org/docs/spec/client_server/r0.6.0#server-discovery
-func DiscoverClientAPI(serverName string) (*ClientWellKnown, error) {
-	wellKnownURL := url.URL{
-		Scheme: "https",
-		Host:   serverName,
-		Path:   "/.well-known/matrix/client",
-	}
-
-	req, err := http.NewRequest("GET", wellKnownURL.String(), nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("User-Agent", DefaultUserAgent+" .well-known fetcher")
-
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, nil
-	}
-
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var wellKnown ClientWellKnown
-	err = json.Unmarshal(data, &wellKnown)
-	if err != nil {
-		return nil, errors.New(".well-known response not JSON")
-	}
-
-	return &wellKnown, nil
+// AuthenticationInfo contains the OpenID Connect issuer that the homeserver delegates authentication to (MSC2965).
+type AuthenticationInfo struct {
+	Issuer  string `json:"issuer"`
+	Account string `json:"account,omitempty"`
 }
 
 // BuildURL builds a URL with the given path parts
@@ -205,9 +230,10 @@ func (cli *Client) SetCredentials(userID id.UserID, accessToken string) {
 	cli.UserID = userID
 }
 
-// ClearCredentials removes the user ID and access token on this client instance.
+// ClearCredentials removes the user ID, access token and refresh token on this client instance.
 func (cli *Client) ClearCredentials() {
 	cli.AccessToken = ""
+	cli.RefreshToken = ""
 	cli.UserID = ""
 	cli.DeviceID = ""
 }
@@ -230,16 +256,32 @@ func (cli *Client) SyncWithContext(ctx context.Context) error {
 	// We will keep syncing until the syncing state changes. Either because
 	// Sync is called or StopSync is called.
 	syncingID := cli.incrementSyncingID()
-	nextBatch := cli.Store.LoadNextBatch(cli.UserID)
-	filterID := cli.Store.LoadFilterID(cli.UserID)
+	if err := cli.checkSyncStreamHandler(); err != nil {
+		return err
+	}
+	nextBatch, filterID, initialFilter, err := cli.loadSyncTokens()
+	if err != nil {
+		return err
+	}
 	if filterID == "" {
-		filterJSON := cli.Syncer.GetFilterJSON(cli.UserID)
-		resFilter, err := cli.CreateFilter(filterJSON)
+		filterJSON := cli.applySyncFilterOptions(cli.Syncer.GetFilterJSON(cli.UserID))
+		filterID, err = cli.GetOrCreateFilter(filterJSON)
 		if err != nil {
 			return err
 		}
-		filterID = resFilter.FilterID
-		cli.Store.SaveFilterID(cli.UserID, filterID)
+		if err = cli.saveFilterID(filterID); err != nil {
+			return fmt.Errorf("failed to save filter ID: %w", err)
+		}
+	}
+	if cli.SyncJournal != nil {
+		if err = cli.replaySyncJournal(); err != nil {
+			return err
+		}
+	}
+	if cli.SyncWatchdog != nil {
+		watchdogCtx, cancelWatchdog := context.WithCancel(ctx)
+		defer cancelWatchdog()
+		cli.SyncWatchdog.start(watchdogCtx)
 	}
 	lastSuccessfulSync := time.Now().Add(-cli.StreamSyncMinAge - 1*time.Hour)
 	for {
@@ -248,19 +290,31 @@ func (cli *Client) SyncWithContext(ctx context.Context) error {
 			cli.Logger.Debugfln("Last sync is old, will stream next response")
 			streamResp = true
 		}
+		if newFilterID := cli.takeSyncFilterChange(); newFilterID != "" {
+			cli.Logger.Debugfln("Switching sync filter to %s", newFilterID)
+			filterID = newFilterID
+		}
+		reqFilter := filterID
+		if nextBatch == "" && initialFilter != "" {
+			reqFilter = initialFilter
+		}
 		resSync, err := cli.FullSyncRequest(ReqSync{
 			Timeout:        30000,
 			Since:          nextBatch,
-			FilterID:       filterID,
+			FilterID:       reqFilter,
 			FullState:      false,
 			SetPresence:    cli.SyncPresence,
 			Context:        ctx,
 			StreamResponse: streamResp,
+			StreamHandler:  cli.SyncStreamHandler,
 		})
 		if err != nil {
 			if ctx.Err() != nil {
 				return ctx.Err()
 			}
+			if cli.SyncWatchdog != nil {
+				cli.SyncWatchdog.reportFailure(err)
+			}
 			duration, err2 := cli.Syncer.OnFailedSync(resSync, err)
 			if err2 != nil {
 				return err2
@@ -269,6 +323,9 @@ func (cli *Client) SyncWithContext(ctx context.Context) error {
 			continue
 		}
 		lastSuccessfulSync = time.Now()
+		if cli.SyncWatchdog != nil {
+			cli.SyncWatchdog.reportSuccess()
+		}
 
 		// Check that the syncing state hasn't changed
 		// Either because we've stopped syncing or another sync has been started.
@@ -277,13 +334,28 @@ func (cli *Client) SyncWithContext(ctx context.Context) error {
 			return nil
 		}
 
+		var journalIDs []int64
+		if cli.SyncJournal != nil {
+			// Journal the rooms before saving the token, so they can be replayed if processing doesn't finish
+			if journalIDs, err = cli.journalSyncResponse(resSync, nextBatch); err != nil {
+				return fmt.Errorf("failed to journal sync response: %w", err)
+			}
+		}
+
 		// Save the token now *before* processing it. This means it's possible
 		// to not process some events, but it means that we won't get constantly stuck processing
 		// a malformed/buggy event which keeps making us panic.
-		cli.Store.SaveNextBatch(cli.UserID, resSync.NextBatch)
+		if err = cli.saveNextBatch(resSync.NextBatch); err != nil {
+			cli.logWarning("Failed to save next batch token: %v", err)
+		}
 		if err = cli.Syncer.ProcessResponse(resSync, nextBatch); err != nil {
 			return err
 		}
+		if len(journalIDs) > 0 {
+			if err = cli.SyncJournal.MarkProcessed(cli.UserID, journalIDs); err != nil {
+				cli.logWarning("Failed to mark sync journal entries as processed: %v", err)
+			}
+		}
 
 		nextBatch = resSync.NextBatch
 	}
@@ -337,6 +409,8 @@ type FullRequest struct {
 	MaxAttempts      int
 	SensitiveContent bool
 	Handler          ClientResponseHandler
+	// Idempotent marks a request with a non-idempotent method (i.e. POST) as safe to retry after errors.
+	Idempotent bool
 }
 
 var requestID int32
@@ -368,6 +442,9 @@ func (params *FullRequest) compileRequest() (*http.Request, error) {
 	ctx := context.WithValue(params.Context, logBodyContextKey, logBody)
 	reqID := atomic.AddInt32(&requestID, 1)
 	ctx = context.WithValue(ctx, logRequestIDContextKey, int(reqID))
+	if params.Idempotent {
+		ctx = context.WithValue(ctx, retryIdempotentContextKey, true)
+	}
 	req, err := http.NewRequestWithContext(ctx, params.Method, params.URL, reqBody)
 	if err != nil {
 		return nil, HTTPError{
@@ -395,20 +472,126 @@ func (params *FullRequest) compileRequest() (*http.Request, error) {
 // HTTP status code and possibly a RespError as the WrappedError, if the HTTP body could be decoded as a RespError.
 func (cli *Client) MakeFullRequest(params FullRequest) ([]byte, error) {
 	if params.MaxAttempts == 0 {
-		params.MaxAttempts = 1 + cli.DefaultHTTPRetries
+		params.MaxAttempts = cli.maxAttempts()
 	}
 	req, err := params.compileRequest()
 	if err != nil {
 		return nil, err
 	}
+	applyRequestContext(req)
 	if params.Handler == nil {
 		params.Handler = cli.handleNormalResponse
 	}
 	req.Header.Set("User-Agent", cli.UserAgent)
-	if len(cli.AccessToken) > 0 {
-		req.Header.Set("Authorization", "Bearer "+cli.AccessToken)
+	cli.refreshLock.Lock()
+	accessToken := cli.AccessToken
+	canRefresh := len(cli.RefreshToken) > 0
+	cli.refreshLock.Unlock()
+	if len(accessToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
 	}
-	return cli.executeCompiledRequest(req, params.MaxAttempts-1, 4*time.Second, params.ResponseJSON, params.Handler)
+	data, err := cli.executeCompiledRequest(req, params.MaxAttempts-1, 0, params.ResponseJSON, params.Handler)
+	if err != nil && len(accessToken) > 0 && canRefresh && isSoftLogout(err) {
+		return cli.retryAfterRefresh(req, accessToken, err, params)
+	}
+	return data, err
+}
+
+func isSoftLogout(err error) bool {
+	var httpErr HTTPError
+	return errors.As(err, &httpErr) && httpErr.RespError != nil &&
+		httpErr.RespError.ErrCode == MUnknownToken.ErrCode && httpErr.RespError.IsSoftLogout()
+}
+
+// retryAfterRefresh refreshes the access token after a request failed with a soft logout error,
+// and then retries the request with the new access token.
+func (cli *Client) retryAfterRefresh(req *http.Request, failedToken string, cause error, params FullRequest) ([]byte, error) {
+	reqID, _ := req.Context().Value(logRequestIDContextKey).(int)
+	if req.Body != nil {
+		if req.GetBody == nil {
+			cli.logWarning("Can't retry request #%d after refreshing access token: GetBody is nil", reqID)
+			return nil, cause
+		}
+		var err error
+		req.Body, err = req.GetBody()
+		if err != nil {
+			cli.logWarning("Can't retry request #%d after refreshing access token: %v", reqID, err)
+			return nil, cause
+		}
+	}
+	accessToken, err := cli.refreshAfterSoftLogout(failedToken)
+	if err != nil {
+		cli.logWarning("Failed to refresh access token after request #%d was soft logged out: %v", reqID, err)
+		return nil, cause
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	cli.Logger.Debugfln("Retrying request #%d with refreshed access token", reqID)
+	return cli.executeCompiledRequest(req, params.MaxAttempts-1, 0, params.ResponseJSON, params.Handler)
+}
+
+// refreshAfterSoftLogout refreshes the access token, unless another request already refreshed it after it failed,
+// and returns the new access token.
+func (cli *Client) refreshAfterSoftLogout(failedToken string) (string, error) {
+	cli.refreshLock.Lock()
+	defer cli.refreshLock.Unlock()
+	if cli.AccessToken != failedToken {
+		return cli.AccessToken, nil
+	}
+	_, err := cli.refreshAccessToken()
+	return cli.AccessToken, err
+}
+
+// RefreshAccessToken gets a new access token using the refresh token stored in the client, and stores the new
+// tokens in the client. See https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3refresh
+//
+// Requests that fail due to a soft logout are retried with a refreshed token automatically if RefreshToken is set,
+// so this doesn't need to be called manually unless the token should be refreshed before it expires.
+func (cli *Client) RefreshAccessToken() (*RespRefresh, error) {
+	cli.refreshLock.Lock()
+	defer cli.refreshLock.Unlock()
+	return cli.refreshAccessToken()
+}
+
+func (cli *Client) refreshAccessToken() (resp *RespRefresh, err error) {
+	if len(cli.RefreshToken) == 0 {
+		return nil, ErrNoRefreshToken
+	} else if cli.Refresher != nil {
+		resp, err = cli.Refresher(cli.RefreshToken)
+		if err != nil {
+			return nil, err
+		}
+		return cli.storeRefreshedTokens(resp), nil
+	}
+	// The refresh endpoint doesn't require authentication, so the request is executed directly to avoid sending the
+	// expired access token and to avoid recursively refreshing if the refresh token is rejected.
+	params := FullRequest{
+		Method:           http.MethodPost,
+		URL:              cli.BuildBaseURL("_matrix", "client", "v3", "refresh"),
+		RequestJSON:      &ReqRefresh{RefreshToken: cli.RefreshToken},
+		SensitiveContent: true,
+	}
+	req, err := params.compileRequest()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", cli.UserAgent)
+	_, err = cli.executeCompiledRequest(req, cli.maxAttempts()-1, 0, &resp, cli.handleNormalResponse)
+	if err != nil {
+		return nil, err
+	}
+	return cli.storeRefreshedTokens(resp), nil
+}
+
+func (cli *Client) storeRefreshedTokens(resp *RespRefresh) *RespRefresh {
+	cli.AccessToken = resp.AccessToken
+	if len(resp.RefreshToken) > 0 {
+		cli.RefreshToken = resp.RefreshToken
+	}
+	cli.Logger.Debugfln("Refreshed access token for %s/%s", cli.UserID, cli.DeviceID)
+	if cli.OnTokenRefresh != nil {
+		cli.OnTokenRefresh(resp)
+	}
+	return resp
 }
 
 func (cli *Client) logWarning(format string, args ...interface{}) {
@@ -420,7 +603,7 @@ func (cli *Client) logWarning(format string, args ...interface{}) {
 	}
 }
 
-func (cli *Client) doRetry(req *http.Request, cause error, retries int, backoff time.Duration, responseJSON interface{}, handler ClientResponseHandler) ([]byte, error) {
+func (cli *Client) doRetry(req *http.Request, cause error, retryAfter time.Duration, retries, retry int, responseJSON interface{}, handler ClientResponseHandler) ([]byte, error) {
 	reqID, _ := req.Context().Value(logRequestIDContextKey).(int)
 	if req.Body != nil {
 		if req.GetBody == nil {
@@ -434,9 +617,21 @@ func (cli *Client) doRetry(req *http.Request, cause error, retries int, backoff
 			return nil, cause
 		}
 	}
-	cli.logWarning("Request #%d failed: %v, retrying in %d seconds", reqID, cause, int(backoff.Seconds()))
-	time.Sleep(backoff)
-	return cli.executeCompiledRequest(req, retries-1, backoff*2, responseJSON, handler)
+	delay := retryAfter
+	if delay <= 0 {
+		delay = cli.retryPolicy().backoff(retry)
+	}
+	cli.logWarning("Request #%d failed: %v, retrying in %s", reqID, cause, delay.Round(time.Millisecond))
+	select {
+	case <-time.After(delay):
+	case <-req.Context().Done():
+		return nil, HTTPError{
+			Request:      req,
+			Message:      "request cancelled while waiting to retry",
+			WrappedError: req.Context().Err(),
+		}
+	}
+	return cli.executeCompiledRequest(req, retries-1, retry+1, responseJSON, handler)
 }
 
 func (cli *Client) readRequestBody(req *http.Request, res *http.Response) ([]byte, error) {
@@ -511,21 +706,39 @@ func (cli *Client) handleResponseError(req *http.Request, res *http.Response) ([
 	}
 
 	return contents, HTTPError{
-		Request:   req,
-		Response:  res,
-		RespError: respErr,
+		Request:      req,
+		Response:     res,
+		RespError:    respErr,
+		ResponseBody: string(contents),
 	}
 }
 
-func (cli *Client) executeCompiledRequest(req *http.Request, retries int, backoff time.Duration, responseJSON interface{}, handler ClientResponseHandler) ([]byte, error) {
+// executeCompiledRequest executes the request, retrying it up to the given number of times according to the
+// retry policy of the client. retry is the number of retries that have already been done.
+func (cli *Client) executeCompiledRequest(req *http.Request, retries, retry int, responseJSON interface{}, handler ClientResponseHandler) ([]byte, error) {
+	if cli.RateLimiter != nil {
+		err := cli.RateLimiter.Wait(req.Context(), ClassifyEndpoint(req.URL.Path))
+		if err != nil {
+			return nil, HTTPError{
+				Request:      req,
+				Message:      "failed to wait for rate limiter",
+				WrappedError: err,
+			}
+		}
+	}
 	cli.LogRequest(req)
-	res, err := cli.Client.Do(req)
+	attemptReq, cancel := cli.withEndpointTimeout(req)
+	defer cancel()
+	start := time.Now()
+	res, err := cli.roundTrip(attemptReq)
+	cli.logRequestAttempt(req, res, err, retry, time.Since(start))
 	if res != nil {
 		defer res.Body.Close()
 	}
+	policy := cli.retryPolicy()
 	if err != nil {
-		if retries > 0 {
-			return cli.doRetry(req, err, retries, backoff, responseJSON, handler)
+		if retries > 0 && req.Context().Err() == nil && policy.isIdempotent(req) {
+			return cli.doRetry(req, err, 0, retries, retry, responseJSON, handler)
 		}
 		return nil, HTTPError{
 			Request:  req,
@@ -536,8 +749,13 @@ func (cli *Client) executeCompiledRequest(req *http.Request, retries int, backof
 		}
 	}
 
-	if retries > 0 && (res.StatusCode == http.StatusBadGateway || res.StatusCode == http.StatusServiceUnavailable || res.StatusCode == http.StatusGatewayTimeout) {
-		return cli.doRetry(req, fmt.Errorf("HTTP %d", res.StatusCode), retries, backoff, responseJSON, handler)
+	if retries > 0 && policy.retryStatus(req, res.StatusCode) {
+		contents, _ := ioutil.ReadAll(res.Body)
+		retryAfter := parseRetryAfter(res, contents)
+		if policy.MaxRetryAfter <= 0 || retryAfter <= policy.MaxRetryAfter {
+			return cli.doRetry(req, fmt.Errorf("HTTP %d", res.StatusCode), retryAfter, retries, retry, responseJSON, handler)
+		}
+		res.Body = ioutil.NopCloser(bytes.NewReader(contents))
 	}
 
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
@@ -581,6 +799,8 @@ type ReqSync struct {
 
 	Context        context.Context
 	StreamResponse bool
+	// StreamHandler makes the response be parsed incrementally with ParseSyncStream using the given handler.
+	StreamHandler *SyncStreamHandler
 }
 
 func (req *ReqSync) BuildQuery() map[string]string {
@@ -613,7 +833,9 @@ func (cli *Client) FullSyncRequest(req ReqSync) (resp *RespSync, err error) {
 		// We don't want automatic retries for SyncRequest, the Sync() wrapper handles those.
 		MaxAttempts: 1,
 	}
-	if req.StreamResponse {
+	if req.StreamHandler != nil {
+		fullReq.Handler = cli.streamSyncResponse(req.StreamHandler)
+	} else if req.StreamResponse {
 		fullReq.Handler = cli.streamResponse
 	}
 	start := time.Now()
@@ -687,20 +909,7 @@ func (cli *Client) RegisterGuest(req *ReqRegister) (*RespRegister, *RespUserInte
 // 	}
 // 	token := res.AccessToken
 func (cli *Client) RegisterDummy(req *ReqRegister) (*RespRegister, error) {
-	res, uia, err := cli.Register(req)
-	if err != nil && uia == nil {
-		return nil, err
-	} else if uia == nil {
-		return nil, errors.New("server did not return user-interactive auth flows")
-	} else if !uia.HasSingleStageFlow(AuthTypeDummy) {
-		return nil, errors.New("server does not support m.login.dummy")
-	}
-	req.Auth = BaseAuthData{Type: AuthTypeDummy, Session: uia.Session}
-	res, _, err = cli.Register(req)
-	if err != nil {
-		return nil, err
-	}
-	return res, nil
+	return cli.RegisterWithUIA(req, &UIAHandler{})
 }
 
 func (cli *Client) GetLoginFlows() (resp *RespLoginFlows, err error) {
@@ -709,8 +918,25 @@ func (cli *Client) GetLoginFlows() (resp *RespLoginFlows, err error) {
 	return
 }
 
+// GetAuthIssuer gets the OpenID Connect issuer that the homeserver delegates authentication to,
+// as specified in https://github.com/matrix-org/matrix-spec-proposals/pull/2965
+func (cli *Client) GetAuthIssuer() (resp *RespAuthIssuer, err error) {
+	urlPath := cli.BuildBaseURL("_matrix", "client", "unstable", "org.matrix.msc2965", "auth_issuer")
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
 // Login a user to the homeserver according to http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-login
+//
+// If the client was created with only a server name (e.g. "example.com") instead of a homeserver URL, or without a
+// homeserver at all, the homeserver URL is discovered using .well-known before logging in (see ResolveHomeserver).
 func (cli *Client) Login(req *ReqLogin) (resp *RespLogin, err error) {
+	if cli.HomeserverURL == nil || len(cli.HomeserverURL.Host) == 0 {
+		err = cli.discoverHomeserverForLogin(req)
+		if err != nil {
+			return nil, err
+		}
+	}
 	_, err = cli.MakeFullRequest(FullRequest{
 		Method:           http.MethodPost,
 		URL:              cli.BuildURL("login"),
@@ -721,6 +947,7 @@ func (cli *Client) Login(req *ReqLogin) (resp *RespLogin, err error) {
 	if req.StoreCredentials && err == nil {
 		cli.DeviceID = resp.DeviceID
 		cli.AccessToken = resp.AccessToken
+		cli.RefreshToken = resp.RefreshToken
 		cli.UserID = resp.UserID
 		cli.Logger.Debugfln("Stored credentials for %s/%s after login", cli.UserID, cli.DeviceID)
 	}
@@ -878,6 +1105,9 @@ func (cli *Client) SetRoomAccountData(roomID id.RoomID, name string, data interf
 type ReqSendEvent struct {
 	Timestamp     int64
 	TransactionID string
+	// IdempotencyKey identifies the message in the client's TxnIDStore, so that sending it again with the same key
+	// (e.g. after a crash) reuses the transaction ID of the earlier attempt, which prevents duplicate messages.
+	IdempotencyKey string
 
 	ParentID string
 	RelType  event.RelationType
@@ -894,8 +1124,8 @@ func (cli *Client) SendMessageEvent(roomID id.RoomID, eventType event.Type, cont
 	var txnID string
 	if len(req.TransactionID) > 0 {
 		txnID = req.TransactionID
-	} else {
-		txnID = cli.TxnID()
+	} else if txnID, err = cli.reserveTxnID(req.IdempotencyKey); err != nil {
+		return
 	}
 
 	queryParams := map[string]string{}
@@ -910,6 +1140,9 @@ func (cli *Client) SendMessageEvent(roomID id.RoomID, eventType event.Type, cont
 
 	urlPath := cli.BuildURLWithQuery(urlData, queryParams)
 	_, err = cli.MakeRequest("PUT", urlPath, contentJSON, &resp)
+	if len(req.TransactionID) == 0 {
+		cli.finishTxnID(req.IdempotencyKey, err)
+	}
 	return
 }
 
@@ -994,11 +1227,14 @@ func (cli *Client) RedactEvent(roomID id.RoomID, eventID id.EventID, extra ...Re
 	var txnID string
 	if len(req.TxnID) > 0 {
 		txnID = req.TxnID
-	} else {
-		txnID = cli.TxnID()
+	} else if txnID, err = cli.reserveTxnID(req.IdempotencyKey); err != nil {
+		return
 	}
 	urlPath := cli.BuildURL("rooms", roomID, "redact", eventID, txnID)
 	_, err = cli.MakeRequest("PUT", urlPath, req.Extra, &resp)
+	if len(req.TxnID) == 0 {
+		cli.finishTxnID(req.IdempotencyKey, err)
+	}
 	return
 }
 
@@ -1090,7 +1326,12 @@ func (cli *Client) GetOwnPresence() (resp *RespPresence, err error) {
 }
 
 func (cli *Client) SetPresence(status event.Presence) (err error) {
-	req := ReqPresence{Presence: status}
+	return cli.SetPresenceWithStatus(status, "")
+}
+
+// SetPresenceWithStatus sets the user's presence along with a status message. See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3presenceuseridstatus
+func (cli *Client) SetPresenceWithStatus(status event.Presence, statusMsg string) (err error) {
+	req := ReqPresence{Presence: status, StatusMsg: statusMsg}
 	u := cli.BuildURL("presence", cli.UserID, "status")
 	_, err = cli.MakeRequest("PUT", u, req, nil)
 	return
@@ -1171,8 +1412,25 @@ func (cli *Client) GetDownloadURL(mxcURL id.ContentURI) string {
 	return cli.BuildBaseURL("_matrix", "media", "r0", "download", mxcURL.Homeserver, mxcURL.FileID)
 }
 
+// Download downloads the given file. If the homeserver supports authenticated media (MSC3916),
+// the authenticated download endpoint is used.
 func (cli *Client) Download(mxcURL id.ContentURI) (io.ReadCloser, error) {
-	resp, err := cli.Client.Get(cli.GetDownloadURL(mxcURL))
+	downloadURL := cli.GetDownloadURL(mxcURL)
+	authenticated := len(cli.AccessToken) > 0 && cli.SupportsFeature(FeatureAuthenticatedMedia)
+	if authenticated {
+		downloadURL = cli.BuildBaseURL("_matrix", "client", "v1", "media", "download", mxcURL.Homeserver, mxcURL.FileID)
+	}
+	req, err := http.NewRequest(http.MethodGet, downloadURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", cli.UserAgent)
+	if authenticated {
+		req.Header.Set("Authorization", "Bearer "+cli.AccessToken)
+	}
+	start := time.Now()
+	resp, err := cli.roundTrip(req)
+	cli.logRequestAttempt(req, resp, err, 0, time.Since(start))
 	if err != nil {
 		return nil, err
 	}
@@ -1365,6 +1623,14 @@ func (cli *Client) MarkReadWithContent(roomID id.RoomID, eventID id.EventID, con
 	return
 }
 
+// SendReceipt sends a receipt of the given type, optionally limited to a thread.
+// See https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3roomsroomidreceiptreceipttypeeventid
+func (cli *Client) SendReceipt(roomID id.RoomID, eventID id.EventID, receiptType event.ReceiptType, threadID string) (err error) {
+	urlPath := cli.BuildURL("rooms", roomID, "receipt", string(receiptType), eventID)
+	_, err = cli.MakeRequest("POST", urlPath, &ReqSendReceipt{ThreadID: threadID}, nil)
+	return
+}
+
 func (cli *Client) SetReadMarkers(roomID id.RoomID, content interface{}) (err error) {
 	urlPath := cli.BuildURL("rooms", roomID, "read_markers")
 	_, err = cli.MakeRequest("POST", urlPath, &content, nil)
@@ -1486,6 +1752,11 @@ func (cli *Client) SetDeviceInfo(deviceID id.DeviceID, req *ReqDeviceInfo) error
 	return err
 }
 
+// RenameDevice changes the display name of the given device.
+func (cli *Client) RenameDevice(deviceID id.DeviceID, displayName string) error {
+	return cli.SetDeviceInfo(deviceID, &ReqDeviceInfo{DisplayName: displayName})
+}
+
 func (cli *Client) DeleteDevice(deviceID id.DeviceID, req *ReqDeleteDevice) error {
 	urlPath := cli.BuildURL("devices", deviceID)
 	_, err := cli.MakeRequest("DELETE", urlPath, req, nil)
@@ -1494,34 +1765,74 @@ func (cli *Client) DeleteDevice(deviceID id.DeviceID, req *ReqDeleteDevice) erro
 
 func (cli *Client) DeleteDevices(req *ReqDeleteDevices) error {
 	urlPath := cli.BuildURL("delete_devices")
-	_, err := cli.MakeRequest("DELETE", urlPath, req, nil)
+	_, err := cli.MakeRequest("POST", urlPath, req, nil)
 	return err
 }
 
+// PutDehydratedDevice uploads a new dehydrated device, replacing any existing one (MSC3814).
+func (cli *Client) PutDehydratedDevice(req *ReqPutDehydratedDevice) (resp *RespPutDehydratedDevice, err error) {
+	urlPath := cli.BuildBaseURL("_matrix", "client", "unstable", "org.matrix.msc3814.v1", "dehydrated_device")
+	_, err = cli.MakeFullRequest(FullRequest{
+		Method:           http.MethodPut,
+		URL:              urlPath,
+		RequestJSON:      req,
+		ResponseJSON:     &resp,
+		SensitiveContent: true,
+	})
+	return
+}
+
+// GetDehydratedDevice gets the current dehydrated device of the user (MSC3814).
+// If there is no dehydrated device, the server responds with M_NOT_FOUND.
+func (cli *Client) GetDehydratedDevice() (resp *RespGetDehydratedDevice, err error) {
+	urlPath := cli.BuildBaseURL("_matrix", "client", "unstable", "org.matrix.msc3814.v1", "dehydrated_device")
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// DeleteDehydratedDevice deletes the current dehydrated device of the user (MSC3814).
+func (cli *Client) DeleteDehydratedDevice() error {
+	urlPath := cli.BuildBaseURL("_matrix", "client", "unstable", "org.matrix.msc3814.v1", "dehydrated_device")
+	_, err := cli.MakeRequest("DELETE", urlPath, nil, nil)
+	return err
+}
+
+// ClaimDehydratedDevice claims the given dehydrated device for the current login on servers that implement
+// MSC2697 instead of MSC3814. The device data must be fetched with GetDehydratedDevice first.
+func (cli *Client) ClaimDehydratedDevice(deviceID id.DeviceID) (resp *RespClaimDehydratedDevice, err error) {
+	urlPath := cli.BuildBaseURL("_matrix", "client", "unstable", "org.matrix.msc2697.v2", "dehydrated_device", "claim")
+	_, err = cli.MakeRequest("POST", urlPath, &ReqClaimDehydratedDevice{DeviceID: deviceID}, &resp)
+	return
+}
+
+// GetDehydratedDeviceEvents gets a batch of the to-device events that were sent to the given dehydrated device (MSC3814).
+// An empty list of events means that there are no more events.
+func (cli *Client) GetDehydratedDeviceEvents(deviceID id.DeviceID, nextBatch string) (resp *RespDehydratedDeviceEvents, err error) {
+	urlPath := cli.BuildBaseURL("_matrix", "client", "unstable", "org.matrix.msc3814.v1", "dehydrated_device", deviceID, "events")
+	_, err = cli.MakeRequest("POST", urlPath, &ReqDehydratedDeviceEvents{NextBatch: nextBatch}, &resp)
+	return
+}
+
 type UIACallback = func(*RespUserInteractive) interface{}
 
 // UploadCrossSigningKeys uploads the given cross-signing keys to the server.
 // Because the endpoint requires user-interactive authentication a callback must be provided that,
 // given the UI auth parameters, produces the required result (or nil to end the flow).
+//
+// Deprecated: use UploadCrossSigningKeysWithUIA, which can complete the auth stages itself.
 func (cli *Client) UploadCrossSigningKeys(keys *UploadCrossSigningKeysReq, uiaCallback UIACallback) error {
-	content, err := cli.MakeFullRequest(FullRequest{
+	return cli.UploadCrossSigningKeysWithUIA(keys, &UIAHandler{Callback: uiaCallback})
+}
+
+// UploadCrossSigningKeysWithUIA uploads the given cross-signing keys to the server, using the handler to complete
+// the user-interactive auth flow. The server usually requires the user's password, i.e. UIAHandler.Password.
+func (cli *Client) UploadCrossSigningKeysWithUIA(keys *UploadCrossSigningKeysReq, handler *UIAHandler) error {
+	_, err := cli.MakeUIARequest(FullRequest{
 		Method:           http.MethodPost,
 		URL:              cli.BuildBaseURL("_matrix", "client", "unstable", "keys", "device_signing", "upload"),
 		RequestJSON:      keys,
 		SensitiveContent: keys.Auth != nil,
-	})
-	if respErr, ok := err.(HTTPError); ok && respErr.IsStatus(http.StatusUnauthorized) {
-		// try again with UI auth
-		var uiAuthResp RespUserInteractive
-		if err := json.Unmarshal(content, &uiAuthResp); err != nil {
-			return fmt.Errorf("failed to decode UIA response: %w", err)
-		}
-		auth := uiaCallback(&uiAuthResp)
-		if auth != nil {
-			keys.Auth = auth
-			return cli.UploadCrossSigningKeys(keys, uiaCallback)
-		}
-	}
+	}, handler)
 	return err
 }
 
@@ -1531,6 +1842,86 @@ func (cli *Client) UploadSignatures(req *ReqUploadSignatures) (resp *RespUploadS
 	return
 }
 
+// GetKeyBackupLatestVersion returns information about the latest key backup version.
+// If there's no backup, the server responds with M_NOT_FOUND.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3room_keysversion
+func (cli *Client) GetKeyBackupLatestVersion() (resp *RespRoomKeysVersion, err error) {
+	urlPath := cli.BuildURL("room_keys", "version")
+	_, err = cli.MakeRequest(http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// GetKeyBackupVersion returns information about the given key backup version.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3room_keysversionversion
+func (cli *Client) GetKeyBackupVersion(version string) (resp *RespRoomKeysVersion, err error) {
+	urlPath := cli.BuildURL("room_keys", "version", version)
+	_, err = cli.MakeRequest(http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// CreateKeyBackupVersion creates a new key backup version.
+// See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3room_keysversion
+func (cli *Client) CreateKeyBackupVersion(req *ReqRoomKeysVersionCreate) (resp *RespRoomKeysVersionCreate, err error) {
+	urlPath := cli.BuildURL("room_keys", "version")
+	_, err = cli.MakeRequest(http.MethodPost, urlPath, req, &resp)
+	return
+}
+
+// UpdateKeyBackupVersion updates the auth data of the given key backup version.
+// See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3room_keysversionversion
+func (cli *Client) UpdateKeyBackupVersion(version string, req *ReqRoomKeysVersionCreate) error {
+	urlPath := cli.BuildURL("room_keys", "version", version)
+	_, err := cli.MakeRequest(http.MethodPut, urlPath, req, nil)
+	return err
+}
+
+// DeleteKeyBackupVersion deletes the given key backup version along with all the keys stored in it.
+// See https://spec.matrix.org/v1.2/client-server-api/#delete_matrixclientv3room_keysversionversion
+func (cli *Client) DeleteKeyBackupVersion(version string) error {
+	urlPath := cli.BuildURL("room_keys", "version", version)
+	_, err := cli.MakeRequest(http.MethodDelete, urlPath, nil, nil)
+	return err
+}
+
+// PutKeysInBackup stores the given megolm sessions in the given key backup version.
+// See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3room_keyskeys
+func (cli *Client) PutKeysInBackup(version string, req *ReqRoomKeysUpdate) (resp *RespRoomKeysUpdate, err error) {
+	urlPath := cli.BuildURLWithQuery(URLPath{"room_keys", "keys"}, map[string]string{"version": version})
+	_, err = cli.MakeFullRequest(FullRequest{
+		Method:           http.MethodPut,
+		URL:              urlPath,
+		RequestJSON:      req,
+		ResponseJSON:     &resp,
+		SensitiveContent: true,
+	})
+	return
+}
+
+// GetKeyBackup gets all the megolm sessions stored in the given key backup version.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3room_keyskeys
+func (cli *Client) GetKeyBackup(version string) (resp *RespRoomKeys, err error) {
+	urlPath := cli.BuildURLWithQuery(URLPath{"room_keys", "keys"}, map[string]string{"version": version})
+	_, err = cli.MakeRequest(http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// GetKeyBackupForRoom gets the megolm sessions of a single room stored in the given key backup version.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3room_keyskeysroomid
+func (cli *Client) GetKeyBackupForRoom(version string, roomID id.RoomID) (resp *ReqRoomKeysRoom, err error) {
+	urlPath := cli.BuildURLWithQuery(URLPath{"room_keys", "keys", roomID}, map[string]string{"version": version})
+	_, err = cli.MakeRequest(http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// GetKeyBackupForRoomAndSession gets a single megolm session stored in the given key backup version.
+// If the session isn't in the backup, the server responds with M_NOT_FOUND.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3room_keyskeysroomidsessionid
+func (cli *Client) GetKeyBackupForRoomAndSession(version string, roomID id.RoomID, sessionID id.SessionID) (resp *KeyBackupData, err error) {
+	urlPath := cli.BuildURLWithQuery(URLPath{"room_keys", "keys", roomID, sessionID}, map[string]string{"version": version})
+	_, err = cli.MakeRequest(http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
 // GetPushRules returns the push notification rules for the global scope.
 func (cli *Client) GetPushRules() (*pushrules.PushRuleset, error) {
 	return cli.GetScopedPushRules("global")
@@ -1588,8 +1979,15 @@ func (cli *Client) BatchSend(roomID id.RoomID, req *ReqBatchSend) (resp *RespBat
 	return
 }
 
-// TxnID returns the next transaction ID.
+// TxnID returns the next transaction ID. If the client has a TxnIDStore, the ID is based on its persistent counter.
 func (cli *Client) TxnID() string {
+	if cli.TxnIDStore != nil {
+		counter, err := cli.TxnIDStore.NextTxnCounter(cli.UserID, cli.DeviceID)
+		if err == nil {
+			return fmt.Sprintf("mautrix-go_%s_%d", cli.DeviceID, counter)
+		}
+		cli.logWarning("Failed to get next transaction counter, falling back to timestamp-based ID: %v", err)
+	}
 	txnID := atomic.AddInt32(&cli.txnID, 1)
 	return fmt.Sprintf("mautrix-go_%d_%d", time.Now().UnixNano(), txnID)
 }
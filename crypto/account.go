@@ -46,7 +46,7 @@ func (account *OlmAccount) IdentityKey() id.IdentityKey {
 	return account.identityKey
 }
 
-func (account *OlmAccount) getInitialKeys(userID id.UserID, deviceID id.DeviceID) *mautrix.DeviceKeys {
+func (account *OlmAccount) getInitialKeys(userID id.UserID, deviceID id.DeviceID, keys KeyProvider) *mautrix.DeviceKeys {
 	deviceKeys := &mautrix.DeviceKeys{
 		UserID:     userID,
 		DeviceID:   deviceID,
@@ -57,7 +57,7 @@ func (account *OlmAccount) getInitialKeys(userID id.UserID, deviceID id.DeviceID
 		},
 	}
 
-	signature, err := account.Internal.SignJSON(deviceKeys)
+	signature, err := keys.SignJSON(KeyUsageDevice, deviceKeys)
 	if err != nil {
 		panic(err)
 	}
@@ -70,7 +70,7 @@ func (account *OlmAccount) getInitialKeys(userID id.UserID, deviceID id.DeviceID
 	return deviceKeys
 }
 
-func (account *OlmAccount) getOneTimeKeys(userID id.UserID, deviceID id.DeviceID, currentOTKCount int) map[id.KeyID]mautrix.OneTimeKey {
+func (account *OlmAccount) getOneTimeKeys(userID id.UserID, deviceID id.DeviceID, currentOTKCount int, keys KeyProvider) map[id.KeyID]mautrix.OneTimeKey {
 	newCount := int(account.Internal.MaxNumberOfOneTimeKeys()/2) - currentOTKCount
 	if newCount > 0 {
 		account.Internal.GenOneTimeKeys(uint(newCount))
@@ -80,7 +80,7 @@ func (account *OlmAccount) getOneTimeKeys(userID id.UserID, deviceID id.DeviceID
 	//      this just signs all of them
 	for keyID, key := range account.Internal.OneTimeKeys() {
 		key := mautrix.OneTimeKey{Key: key}
-		signature, _ := account.Internal.SignJSON(key)
+		signature, _ := keys.SignJSON(KeyUsageDevice, key)
 		key.Signatures = mautrix.Signatures{
 			userID: {
 				id.NewKeyID(id.KeyAlgorithmEd25519, deviceID.String()): signature,
@@ -92,3 +92,22 @@ func (account *OlmAccount) getOneTimeKeys(userID id.UserID, deviceID id.DeviceID
 	account.Internal.MarkKeysAsPublished()
 	return oneTimeKeys
 }
+
+func (account *OlmAccount) getFallbackKeys(userID id.UserID, deviceID id.DeviceID, generateNew bool, keys KeyProvider) map[id.KeyID]mautrix.OneTimeKey {
+	if generateNew {
+		account.Internal.GenFallbackKey()
+	}
+	fallbackKeys := make(map[id.KeyID]mautrix.OneTimeKey)
+	for keyID, key := range account.Internal.FallbackKey() {
+		key := mautrix.OneTimeKey{Key: key, IsFallback: true}
+		signature, _ := keys.SignJSON(KeyUsageDevice, key)
+		key.Signatures = mautrix.Signatures{
+			userID: {
+				id.NewKeyID(id.KeyAlgorithmEd25519, deviceID.String()): signature,
+			},
+		}
+		key.IsSigned = true
+		fallbackKeys[id.NewKeyID(id.KeyAlgorithmSignedCurve25519, keyID)] = key
+	}
+	return fallbackKeys
+}
@@ -9,8 +9,8 @@ package attachment
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/sha256"
-	"encoding/base64"
 	"errors"
 	"hash"
 	"io"
@@ -27,12 +27,6 @@ var (
 	ReaderClosed         = errors.New("encrypting reader was already closed")
 )
 
-var (
-	keyBase64Length  = base64.RawURLEncoding.EncodedLen(utils.AESCTRKeyLength)
-	ivBase64Length   = base64.RawStdEncoding.EncodedLen(utils.AESCTRIVLength)
-	hashBase64Length = base64.RawStdEncoding.EncodedLen(utils.SHAHashLength)
-)
-
 type JSONWebKey struct {
 	Key         string   `json:"k"`
 	Algorithm   string   `json:"alg"`
@@ -63,13 +57,13 @@ func NewEncryptedFile() *EncryptedFile {
 	key, iv := utils.GenAttachmentA256CTR()
 	return &EncryptedFile{
 		Key: JSONWebKey{
-			Key:         base64.RawURLEncoding.EncodeToString(key[:]),
+			Key:         utils.EncodeUnpaddedURLSafeBase64(key[:]),
 			Algorithm:   "A256CTR",
 			Extractable: true,
 			KeyType:     "oct",
 			KeyOps:      []string{"encrypt", "decrypt"},
 		},
-		InitVector: base64.RawStdEncoding.EncodeToString(iv[:]),
+		InitVector: utils.EncodeUnpaddedBase64(iv[:]),
 		Version:    "v2",
 
 		decoded: &decodedKeys{key, iv},
@@ -79,20 +73,18 @@ func NewEncryptedFile() *EncryptedFile {
 func (ef *EncryptedFile) decodeKeys() error {
 	if ef.decoded != nil {
 		return nil
-	} else if len(ef.Key.Key) != keyBase64Length {
-		return InvalidKey
-	} else if len(ef.InitVector) != ivBase64Length {
-		return InvalidInitVector
 	}
-	ef.decoded = &decodedKeys{}
-	_, err := base64.RawURLEncoding.Decode(ef.decoded.key[:], []byte(ef.Key.Key))
-	if err != nil {
+	key, err := utils.DecodeUnpaddedBase64(ef.Key.Key)
+	if err != nil || len(key) != utils.AESCTRKeyLength {
 		return InvalidKey
 	}
-	_, err = base64.RawStdEncoding.Decode(ef.decoded.iv[:], []byte(ef.InitVector))
-	if err != nil {
+	iv, err := utils.DecodeUnpaddedBase64(ef.InitVector)
+	if err != nil || len(iv) != utils.AESCTRIVLength {
 		return InvalidInitVector
 	}
+	ef.decoded = &decodedKeys{}
+	copy(ef.decoded.key[:], key)
+	copy(ef.decoded.iv[:], iv)
 	return nil
 }
 
@@ -100,7 +92,7 @@ func (ef *EncryptedFile) Encrypt(plaintext []byte) []byte {
 	ef.decodeKeys()
 	ciphertext := utils.XorA256CTR(plaintext, ef.decoded.key, ef.decoded.iv)
 	checksum := sha256.Sum256(ciphertext)
-	ef.Hashes.SHA256 = base64.RawStdEncoding.EncodeToString(checksum[:])
+	ef.Hashes.SHA256 = utils.EncodeUnpaddedBase64(checksum[:])
 	return ciphertext
 }
 
@@ -128,7 +120,7 @@ func (r *encryptingReader) Close() (err error) {
 	if ok {
 		err = closer.Close()
 	}
-	r.file.Hashes.SHA256 = base64.RawStdEncoding.EncodeToString(r.hash.Sum(nil))
+	r.file.Hashes.SHA256 = utils.EncodeUnpaddedBase64(r.hash.Sum(nil))
 	r.closed = true
 	return
 }
@@ -145,15 +137,12 @@ func (ef *EncryptedFile) EncryptStream(reader io.Reader) io.ReadCloser {
 }
 
 func (ef *EncryptedFile) checkHash(ciphertext []byte) bool {
-	if len(ef.Hashes.SHA256) != hashBase64Length {
-		return false
-	}
-	var checksum [utils.SHAHashLength]byte
-	_, err := base64.RawStdEncoding.Decode(checksum[:], []byte(ef.Hashes.SHA256))
-	if err != nil {
+	checksum, err := utils.DecodeUnpaddedBase64(ef.Hashes.SHA256)
+	if err != nil || len(checksum) != utils.SHAHashLength {
 		return false
 	}
-	return checksum == sha256.Sum256(ciphertext)
+	expected := sha256.Sum256(ciphertext)
+	return hmac.Equal(checksum, expected[:])
 }
 
 func (ef *EncryptedFile) Decrypt(ciphertext []byte) ([]byte, error) {
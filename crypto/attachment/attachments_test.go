@@ -96,3 +96,15 @@ func TestTooShortHash(t *testing.T) {
 		t.Errorf("Didn't get expected HashMismatch error: %v", err)
 	}
 }
+
+func TestDecryptPaddedHash(t *testing.T) {
+	file := parseHelloWorld()
+	file.Hashes.SHA256 += "="
+	file.InitVector += "=="
+	plaintext, err := file.Decrypt([]byte(helloWorldCiphertext))
+	if err != nil {
+		t.Errorf("Failed to decrypt file with padded base64: %v", err)
+	} else if string(plaintext) != "hello world" {
+		t.Errorf("Unexpected decrypt output: %v", plaintext)
+	}
+}
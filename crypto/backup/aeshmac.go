@@ -0,0 +1,183 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package backup
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/id"
+)
+
+// AESHMACBackupKey is the symmetric key of a MSC3270 (aes-hmac-sha2) key backup. Unlike the curve25519 algorithm,
+// the key is needed for uploading sessions too, which means that only devices that have the key can back up sessions.
+//
+// Sessions are encrypted the same way as SSSS secrets, using the session ID as the name of the secret.
+type AESHMACBackupKey struct {
+	key [utils.AESCTRKeyLength]byte
+}
+
+// AESHMACAuthData is the auth_data of a MSC3270 key backup version. The IV and MAC are calculated by encrypting
+// 32 zero bytes, like the key check of SSSS keys, which allows checking whether a key is correct.
+type AESHMACAuthData struct {
+	IV         string                            `json:"iv"`
+	MAC        string                            `json:"mac"`
+	Signatures map[id.UserID]map[id.KeyID]string `json:"signatures,omitempty"`
+}
+
+// NewAESHMACBackupKey generates a new random MSC3270 backup key.
+func NewAESHMACBackupKey() (*AESHMACBackupKey, error) {
+	var key AESHMACBackupKey
+	_, err := utils.ReadRandom(key.key[:])
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// AESHMACBackupKeyFromBytes creates a MSC3270 backup key from the raw key bytes.
+func AESHMACBackupKeyFromBytes(data []byte) (*AESHMACBackupKey, error) {
+	if len(data) != utils.AESCTRKeyLength {
+		return nil, ErrInvalidKeyLength
+	}
+	var key AESHMACBackupKey
+	copy(key.key[:], data)
+	return &key, nil
+}
+
+// Algorithm returns id.KeyBackupAlgorithmMegolmBackupAESHMAC.
+func (key *AESHMACBackupKey) Algorithm() id.KeyBackupAlgorithm {
+	return id.KeyBackupAlgorithmMegolmBackupAESHMAC
+}
+
+// Bytes returns a copy of the raw key.
+func (key *AESHMACBackupKey) Bytes() []byte {
+	return append([]byte{}, key.key[:]...)
+}
+
+// RecoveryKey returns the key in the base58 recovery key format.
+func (key *AESHMACBackupKey) RecoveryKey() string {
+	return utils.EncodeBase58RecoveryKey(key.key[:])
+}
+
+// Wipe overwrites the key in memory.
+func (key *AESHMACBackupKey) Wipe() {
+	utils.WipeBytes(key.key[:])
+}
+
+func (key *AESHMACBackupKey) calculateCheck(iv [utils.AESCTRIVLength]byte) string {
+	aesKey, hmacKey := utils.DeriveKeysSHA256(key.key[:], "")
+	defer utils.WipeBytes(aesKey[:])
+	defer utils.WipeBytes(hmacKey[:])
+	var zeroBytes [utils.AESCTRKeyLength]byte
+	return utils.HMACSHA256B64(utils.XorA256CTR(zeroBytes[:], aesKey, iv), hmacKey)
+}
+
+// AuthData returns the unsigned auth_data for a backup version using this key.
+func (key *AESHMACBackupKey) AuthData() (json.RawMessage, error) {
+	iv := utils.GenA256CTRIV()
+	return json.Marshal(&AESHMACAuthData{
+		IV:  base64.StdEncoding.EncodeToString(iv[:]),
+		MAC: key.calculateCheck(iv),
+	})
+}
+
+// VerifyAuthData checks that the MAC in the given auth_data was made with this key.
+func (key *AESHMACBackupKey) VerifyAuthData(authData json.RawMessage) error {
+	var parsed AESHMACAuthData
+	err := json.Unmarshal(authData, &parsed)
+	if err != nil {
+		return fmt.Errorf("failed to parse auth data: %w", err)
+	}
+	var iv [utils.AESCTRIVLength]byte
+	decodedIV, err := base64.StdEncoding.DecodeString(parsed.IV)
+	if err != nil || len(decodedIV) != len(iv) {
+		return fmt.Errorf("%w: invalid IV in auth data", ErrMismatchingKey)
+	}
+	copy(iv[:], decodedIV)
+	if !macEqual(parsed.MAC, key.calculateCheck(iv)) {
+		return ErrMismatchingKey
+	}
+	return nil
+}
+
+// Encrypt encrypts the given session data for the backup.
+func (key *AESHMACBackupKey) Encrypt(sessionID id.SessionID, data *SessionData) (json.RawMessage, error) {
+	plaintext, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal session data: %w", err)
+	}
+	defer utils.WipeBytes(plaintext)
+	aesKey, hmacKey := utils.DeriveKeysSHA256(key.key[:], sessionID.String())
+	defer utils.WipeBytes(aesKey[:])
+	defer utils.WipeBytes(hmacKey[:])
+	iv := utils.GenA256CTRIV()
+	ciphertext := utils.XorA256CTR(plaintext, aesKey, iv)
+	return json.Marshal(&AESHMACSessionData{
+		IV:         base64.StdEncoding.EncodeToString(iv[:]),
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+		MAC:        utils.HMACSHA256B64(ciphertext, hmacKey),
+	})
+}
+
+// Decrypt decrypts the session_data of a backed up session.
+func (key *AESHMACBackupKey) Decrypt(sessionID id.SessionID, sessionData json.RawMessage) (*SessionData, error) {
+	var encrypted AESHMACSessionData
+	err := json.Unmarshal(sessionData, &encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse session data: %w", err)
+	}
+	var iv [utils.AESCTRIVLength]byte
+	decodedIV, err := base64.StdEncoding.DecodeString(encrypted.IV)
+	if err != nil || len(decodedIV) != len(iv) {
+		return nil, fmt.Errorf("%w: invalid IV", ErrMismatchingMAC)
+	}
+	copy(iv[:], decodedIV)
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ciphertext: %w", err)
+	}
+	aesKey, hmacKey := utils.DeriveKeysSHA256(key.key[:], sessionID.String())
+	defer utils.WipeBytes(aesKey[:])
+	defer utils.WipeBytes(hmacKey[:])
+	if !macEqual(encrypted.MAC, utils.HMACSHA256B64(ciphertext, hmacKey)) {
+		return nil, ErrMismatchingMAC
+	}
+	plaintext := utils.XorA256CTR(ciphertext, aesKey, iv)
+	defer utils.WipeBytes(plaintext)
+	var data SessionData
+	err = json.Unmarshal(plaintext, &data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse decrypted session data: %w", err)
+	}
+	return &data, nil
+}
+
+// AESHMACSessionData is the session_data of a single megolm session in a MSC3270 key backup.
+type AESHMACSessionData struct {
+	IV         string `json:"iv"`
+	Ciphertext string `json:"ciphertext"`
+	MAC        string `json:"mac"`
+}
+
+// macEqual compares base64 MACs, ignoring padding.
+func macEqual(a, b string) bool {
+	return hmac.Equal([]byte(strings.TrimRight(a, "=")), []byte(strings.TrimRight(b, "=")))
+}
+
+func newAESHMACBackupEncrypter(authData json.RawMessage, key Key) (Encrypter, error) {
+	if key == nil {
+		return nil, ErrPrivateKeyRequired
+	} else if err := key.VerifyAuthData(authData); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package backup_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/id"
+)
+
+var testSessionData = &backup.SessionData{
+	Algorithm:         id.AlgorithmMegolmV1,
+	ForwardingChains:  []string{},
+	SenderKey:         "sender",
+	SenderClaimedKeys: backup.SenderClaimedKeys{Ed25519: "signing"},
+	SessionKey:        "session key",
+}
+
+func TestAESHMACBackupRoundtrip(t *testing.T) {
+	key, err := backup.NewAESHMACBackupKey()
+	require.NoError(t, err)
+	encrypted, err := key.Encrypt("session1", testSessionData)
+	require.NoError(t, err)
+	decrypted, err := key.Decrypt("session1", encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, testSessionData, decrypted)
+
+	// The session ID is used for deriving the keys, so the data can't be moved to another session.
+	_, err = key.Decrypt("session2", encrypted)
+	assert.ErrorIs(t, err, backup.ErrMismatchingMAC)
+
+	otherKey, err := backup.NewAESHMACBackupKey()
+	require.NoError(t, err)
+	_, err = otherKey.Decrypt("session1", encrypted)
+	assert.ErrorIs(t, err, backup.ErrMismatchingMAC)
+}
+
+func TestAlgorithms(t *testing.T) {
+	for algorithm, alg := range backup.Algorithms {
+		t.Run(string(algorithm), func(t *testing.T) {
+			key, err := alg.GenerateKey()
+			require.NoError(t, err)
+			assert.Equal(t, algorithm, key.Algorithm())
+			authData, err := key.AuthData()
+			require.NoError(t, err)
+			require.NoError(t, key.VerifyAuthData(authData))
+
+			decoded, err := backup.KeyFromRecoveryKey(algorithm, key.RecoveryKey())
+			require.NoError(t, err)
+			assert.Equal(t, key.Bytes(), decoded.Bytes())
+
+			encrypter, err := alg.NewEncrypter(authData, decoded)
+			require.NoError(t, err)
+			encrypted, err := encrypter.Encrypt("session1", testSessionData)
+			require.NoError(t, err)
+			decrypted, err := key.Decrypt("session1", encrypted)
+			require.NoError(t, err)
+			assert.Equal(t, testSessionData, decrypted)
+
+			otherKey, err := alg.GenerateKey()
+			require.NoError(t, err)
+			assert.ErrorIs(t, otherKey.VerifyAuthData(authData), backup.ErrMismatchingKey)
+			_, err = alg.NewEncrypter(authData, otherKey)
+			assert.ErrorIs(t, err, backup.ErrMismatchingKey)
+		})
+	}
+
+	_, err := backup.GetAlgorithm("com.example.unknown")
+	assert.ErrorIs(t, err, backup.ErrUnsupportedAlgorithm)
+}
+
+func TestAESHMACBackupRequiresKey(t *testing.T) {
+	alg, err := backup.GetAlgorithm(id.KeyBackupAlgorithmMegolmBackupAESHMAC)
+	require.NoError(t, err)
+	key, err := alg.GenerateKey()
+	require.NoError(t, err)
+	authData, err := key.AuthData()
+	require.NoError(t, err)
+	_, err = alg.NewEncrypter(authData, nil)
+	assert.ErrorIs(t, err, backup.ErrPrivateKeyRequired)
+}
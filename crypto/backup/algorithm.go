@@ -0,0 +1,131 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package backup implements the algorithms used for encrypting megolm sessions in server-side key backups.
+//
+// The implementations are pure Go, so they work the same way regardless of whether libolm or goolm is used.
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrUnsupportedAlgorithm = errors.New("unsupported key backup algorithm")
+	ErrInvalidKeyLength     = errors.New("invalid key backup key length")
+	ErrMismatchingKey       = errors.New("key doesn't match the auth data of the key backup version")
+	ErrMismatchingMAC       = errors.New("mismatching key backup session data MAC")
+	ErrPrivateKeyRequired   = errors.New("the key backup algorithm requires the private key for encrypting sessions")
+)
+
+// SenderClaimedKeys contains the keys that the sender of a megolm session claimed to own.
+type SenderClaimedKeys struct {
+	Ed25519 id.Ed25519 `json:"ed25519"`
+}
+
+// SessionData is the plaintext of a single megolm session in a key backup.
+type SessionData struct {
+	Algorithm         id.Algorithm      `json:"algorithm"`
+	ForwardingChains  []string          `json:"forwarding_curve25519_key_chain"`
+	SenderKey         id.SenderKey      `json:"sender_key"`
+	SenderClaimedKeys SenderClaimedKeys `json:"sender_claimed_keys"`
+	SessionKey        string            `json:"session_key"`
+}
+
+// Encrypter encrypts megolm sessions for uploading to a key backup version.
+type Encrypter interface {
+	// Encrypt encrypts the given session and returns the session_data to upload.
+	Encrypt(sessionID id.SessionID, data *SessionData) (json.RawMessage, error)
+}
+
+// Key is the private key of a key backup version.
+type Key interface {
+	Encrypter
+
+	// Algorithm returns the key backup algorithm that the key is used with.
+	Algorithm() id.KeyBackupAlgorithm
+	// Bytes returns a copy of the raw key, which is the format used for storing the key in SSSS.
+	Bytes() []byte
+	// RecoveryKey returns the key in the base58 recovery key format.
+	RecoveryKey() string
+	// Wipe overwrites the key in memory.
+	Wipe()
+
+	// AuthData returns the unsigned auth_data for a new backup version using this key.
+	AuthData() (json.RawMessage, error)
+	// VerifyAuthData returns an error wrapping ErrMismatchingKey if the given auth_data doesn't belong to this key.
+	VerifyAuthData(authData json.RawMessage) error
+	// Decrypt decrypts the session_data of a backed up session.
+	Decrypt(sessionID id.SessionID, sessionData json.RawMessage) (*SessionData, error)
+}
+
+var (
+	_ Key = (*MegolmBackupKey)(nil)
+	_ Key = (*AESHMACBackupKey)(nil)
+)
+
+// Algorithm contains the functions needed to use a key backup algorithm.
+type Algorithm struct {
+	// GenerateKey generates a new random key.
+	GenerateKey func() (Key, error)
+	// KeyFromBytes creates a key from the raw key bytes, e.g. after fetching it from SSSS.
+	KeyFromBytes func(data []byte) (Key, error)
+	// NewEncrypter creates an Encrypter for the backup version with the given auth_data. The key is optional,
+	// but if it's given, it must match the auth_data. Algorithms that can't encrypt sessions without the private
+	// key return ErrPrivateKeyRequired if the key is nil.
+	NewEncrypter func(authData json.RawMessage, key Key) (Encrypter, error)
+}
+
+// Algorithms contains the supported key backup algorithms.
+// Additional algorithms can be registered by adding them to this map.
+var Algorithms = map[id.KeyBackupAlgorithm]*Algorithm{
+	id.KeyBackupAlgorithmMegolmBackupV1: {
+		GenerateKey: func() (Key, error) {
+			return NewMegolmBackupKey()
+		},
+		KeyFromBytes: func(data []byte) (Key, error) {
+			return MegolmBackupKeyFromBytes(data)
+		},
+		NewEncrypter: newMegolmBackupEncrypter,
+	},
+	id.KeyBackupAlgorithmMegolmBackupAESHMAC: {
+		GenerateKey: func() (Key, error) {
+			return NewAESHMACBackupKey()
+		},
+		KeyFromBytes: func(data []byte) (Key, error) {
+			return AESHMACBackupKeyFromBytes(data)
+		},
+		NewEncrypter: newAESHMACBackupEncrypter,
+	},
+}
+
+// GetAlgorithm returns the registered implementation of the given key backup algorithm.
+func GetAlgorithm(algorithm id.KeyBackupAlgorithm) (*Algorithm, error) {
+	alg, ok := Algorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnsupportedAlgorithm, algorithm)
+	}
+	return alg, nil
+}
+
+// KeyFromRecoveryKey decodes a base58 recovery key into a key for the given algorithm.
+func KeyFromRecoveryKey(algorithm id.KeyBackupAlgorithm, recoveryKey string) (Key, error) {
+	alg, err := GetAlgorithm(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	data, err := utils.DecodeRecoveryKey(recoveryKey)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.WipeBytes(data)
+	return alg.KeyFromBytes(data)
+}
@@ -0,0 +1,282 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package backup
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrInvalidPublicKey  = errors.New("invalid megolm backup public key")
+	ErrInvalidCiphertext = errors.New("invalid megolm backup session data ciphertext")
+)
+
+// macLength is the length of the truncated HMAC-SHA256 used by libolm's PkEncryption.
+const macLength = 8
+
+// MegolmBackupKey is the private key of a m.megolm_backup.v1.curve25519-aes-sha2 key backup.
+type MegolmBackupKey struct {
+	private [curve25519.ScalarSize]byte
+	public  [curve25519.PointSize]byte
+}
+
+// NewMegolmBackupKey generates a new random megolm backup key.
+func NewMegolmBackupKey() (*MegolmBackupKey, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	_, err := utils.ReadRandom(private)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.WipeBytes(private)
+	return MegolmBackupKeyFromBytes(private)
+}
+
+// MegolmBackupKeyFromBytes creates a megolm backup key from the raw private key bytes.
+func MegolmBackupKeyFromBytes(private []byte) (*MegolmBackupKey, error) {
+	if len(private) != curve25519.ScalarSize {
+		return nil, ErrInvalidKeyLength
+	}
+	var key MegolmBackupKey
+	copy(key.private[:], private)
+	public, err := curve25519.X25519(key.private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(key.public[:], public)
+	return &key, nil
+}
+
+// MegolmBackupKeyFromRecoveryKey decodes a megolm backup key from the base58 recovery key format.
+func MegolmBackupKeyFromRecoveryKey(recoveryKey string) (*MegolmBackupKey, error) {
+	private, err := utils.DecodeRecoveryKey(recoveryKey)
+	if err != nil {
+		return nil, err
+	}
+	return MegolmBackupKeyFromBytes(private)
+}
+
+// Bytes returns a copy of the raw private key.
+func (key *MegolmBackupKey) Bytes() []byte {
+	return append([]byte{}, key.private[:]...)
+}
+
+// RecoveryKey returns the private key in the base58 recovery key format.
+func (key *MegolmBackupKey) RecoveryKey() string {
+	return utils.EncodeBase58RecoveryKey(key.private[:])
+}
+
+// PublicKey returns the public key of the backup in unpadded base64.
+func (key *MegolmBackupKey) PublicKey() id.Curve25519 {
+	return id.Curve25519(utils.EncodeUnpaddedBase64(key.public[:]))
+}
+
+// Wipe overwrites the private key in memory.
+func (key *MegolmBackupKey) Wipe() {
+	utils.WipeBytes(key.private[:])
+}
+
+// Algorithm returns id.KeyBackupAlgorithmMegolmBackupV1.
+func (key *MegolmBackupKey) Algorithm() id.KeyBackupAlgorithm {
+	return id.KeyBackupAlgorithmMegolmBackupV1
+}
+
+// AuthData returns the unsigned auth_data for a backup version using this key.
+func (key *MegolmBackupKey) AuthData() (json.RawMessage, error) {
+	return json.Marshal(&MegolmAuthData{PublicKey: key.PublicKey()})
+}
+
+// VerifyAuthData checks that the public key in the given auth_data matches this key.
+func (key *MegolmBackupKey) VerifyAuthData(authData json.RawMessage) error {
+	var parsed MegolmAuthData
+	err := json.Unmarshal(authData, &parsed)
+	if err != nil {
+		return fmt.Errorf("failed to parse auth data: %w", err)
+	} else if parsed.PublicKey != key.PublicKey() {
+		return fmt.Errorf("%w (backup has %s, key is %s)", ErrMismatchingKey, parsed.PublicKey, key.PublicKey())
+	}
+	return nil
+}
+
+// Encrypt encrypts the given session data for the backup. The session ID is not used by this algorithm.
+func (key *MegolmBackupKey) Encrypt(_ id.SessionID, data *SessionData) (json.RawMessage, error) {
+	return megolmBackupPublicKey(key.PublicKey()).Encrypt("", data)
+}
+
+// Decrypt decrypts the session_data of a backed up session. The session ID is not used by this algorithm.
+func (key *MegolmBackupKey) Decrypt(_ id.SessionID, sessionData json.RawMessage) (*SessionData, error) {
+	var encrypted EncryptedSessionData
+	err := json.Unmarshal(sessionData, &encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse session data: %w", err)
+	}
+	return key.DecryptSessionData(&encrypted)
+}
+
+// megolmBackupPublicKey is an Encrypter that only needs the public key of the backup.
+type megolmBackupPublicKey id.Curve25519
+
+func (pk megolmBackupPublicKey) Encrypt(_ id.SessionID, data *SessionData) (json.RawMessage, error) {
+	encrypted, err := EncryptSessionData(id.Curve25519(pk), data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(encrypted)
+}
+
+func newMegolmBackupEncrypter(authData json.RawMessage, key Key) (Encrypter, error) {
+	if key != nil {
+		if err := key.VerifyAuthData(authData); err != nil {
+			return nil, err
+		}
+	}
+	var parsed MegolmAuthData
+	err := json.Unmarshal(authData, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse auth data: %w", err)
+	}
+	return megolmBackupPublicKey(parsed.PublicKey), nil
+}
+
+// MegolmAuthData is the auth_data of a m.megolm_backup.v1.curve25519-aes-sha2 backup version.
+type MegolmAuthData struct {
+	PublicKey  id.Curve25519                     `json:"public_key"`
+	Signatures map[id.UserID]map[id.KeyID]string `json:"signatures,omitempty"`
+}
+
+// EncryptedSessionData is the session_data of a single megolm session in a key backup.
+type EncryptedSessionData struct {
+	Ephemeral  string `json:"ephemeral"`
+	Ciphertext string `json:"ciphertext"`
+	MAC        string `json:"mac"`
+}
+
+type backupKeys struct {
+	aesKey [32]byte
+	macKey [32]byte
+	iv     [aes.BlockSize]byte
+}
+
+func deriveBackupKeys(sharedSecret []byte) (keys backupKeys) {
+	kdf := hkdf.New(sha256.New, sharedSecret, nil, nil)
+	_, _ = io.ReadFull(kdf, keys.aesKey[:])
+	_, _ = io.ReadFull(kdf, keys.macKey[:])
+	_, _ = io.ReadFull(kdf, keys.iv[:])
+	return
+}
+
+func (keys *backupKeys) wipe() {
+	utils.WipeBytes(keys.aesKey[:])
+	utils.WipeBytes(keys.macKey[:])
+}
+
+func (keys *backupKeys) mac(data []byte) []byte {
+	h := hmac.New(sha256.New, keys.macKey[:])
+	h.Write(data)
+	return h.Sum(nil)[:macLength]
+}
+
+// EncryptSessionData encrypts the given session data for the backup with the given public key.
+//
+// For compatibility with libolm's PkEncryption, the MAC is calculated over an empty input rather than the ciphertext.
+func EncryptSessionData(publicKey id.Curve25519, data *SessionData) (*EncryptedSessionData, error) {
+	plaintext, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal session data: %w", err)
+	}
+	defer utils.WipeBytes(plaintext)
+	theirPublic, err := utils.DecodeUnpaddedBase64(string(publicKey))
+	if err != nil || len(theirPublic) != curve25519.PointSize {
+		return nil, ErrInvalidPublicKey
+	}
+	ephemeral, err := NewMegolmBackupKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	defer ephemeral.Wipe()
+	sharedSecret, err := curve25519.X25519(ephemeral.private[:], theirPublic)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	defer utils.WipeBytes(sharedSecret)
+	keys := deriveBackupKeys(sharedSecret)
+	defer keys.wipe()
+
+	block, _ := aes.NewCipher(keys.aesKey[:])
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	ciphertext := make([]byte, len(plaintext)+padding)
+	copy(ciphertext, plaintext)
+	copy(ciphertext[len(plaintext):], bytes.Repeat([]byte{byte(padding)}, padding))
+	cipher.NewCBCEncrypter(block, keys.iv[:]).CryptBlocks(ciphertext, ciphertext)
+
+	return &EncryptedSessionData{
+		Ephemeral:  string(ephemeral.PublicKey()),
+		Ciphertext: utils.EncodeUnpaddedBase64(ciphertext),
+		MAC:        utils.EncodeUnpaddedBase64(keys.mac(nil)),
+	}, nil
+}
+
+// DecryptSessionData decrypts session data that was encrypted for this backup key.
+//
+// Both the libolm-compatible MAC (calculated over an empty input) and a MAC calculated over the ciphertext are accepted.
+func (key *MegolmBackupKey) DecryptSessionData(encrypted *EncryptedSessionData) (*SessionData, error) {
+	ephemeral, err := utils.DecodeUnpaddedBase64(encrypted.Ephemeral)
+	if err != nil || len(ephemeral) != curve25519.PointSize {
+		return nil, ErrInvalidPublicKey
+	}
+	ciphertext, err := utils.DecodeUnpaddedBase64(encrypted.Ciphertext)
+	if err != nil || len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, ErrInvalidCiphertext
+	}
+	mac, err := utils.DecodeUnpaddedBase64(encrypted.MAC)
+	if err != nil {
+		return nil, ErrMismatchingMAC
+	}
+	sharedSecret, err := curve25519.X25519(key.private[:], ephemeral)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	defer utils.WipeBytes(sharedSecret)
+	keys := deriveBackupKeys(sharedSecret)
+	defer keys.wipe()
+	if !hmac.Equal(keys.mac(nil), mac) && !hmac.Equal(keys.mac(ciphertext), mac) {
+		return nil, ErrMismatchingMAC
+	}
+
+	block, _ := aes.NewCipher(keys.aesKey[:])
+	plaintext := make([]byte, len(ciphertext))
+	defer utils.WipeBytes(plaintext)
+	cipher.NewCBCDecrypter(block, keys.iv[:]).CryptBlocks(plaintext, ciphertext)
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, ErrInvalidCiphertext
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, ErrInvalidCiphertext
+		}
+	}
+	var data SessionData
+	err = json.Unmarshal(plaintext[:len(plaintext)-padding], &data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse decrypted session data: %w", err)
+	}
+	return &data, nil
+}
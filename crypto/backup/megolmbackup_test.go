@@ -0,0 +1,51 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package backup_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestMegolmBackupRoundtrip(t *testing.T) {
+	key, err := backup.NewMegolmBackupKey()
+	require.NoError(t, err)
+	data := &backup.SessionData{
+		Algorithm:         id.AlgorithmMegolmV1,
+		ForwardingChains:  []string{},
+		SenderKey:         "sender",
+		SenderClaimedKeys: backup.SenderClaimedKeys{Ed25519: "signing"},
+		SessionKey:        "session key",
+	}
+	encrypted, err := backup.EncryptSessionData(key.PublicKey(), data)
+	require.NoError(t, err)
+	decrypted, err := key.DecryptSessionData(encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	otherKey, err := backup.NewMegolmBackupKey()
+	require.NoError(t, err)
+	_, err = otherKey.DecryptSessionData(encrypted)
+	assert.ErrorIs(t, err, backup.ErrMismatchingMAC)
+}
+
+func TestMegolmBackupKeyFromRecoveryKey(t *testing.T) {
+	key, err := backup.NewMegolmBackupKey()
+	require.NoError(t, err)
+	decoded, err := backup.MegolmBackupKeyFromRecoveryKey(key.RecoveryKey())
+	require.NoError(t, err)
+	assert.Equal(t, key.Bytes(), decoded.Bytes())
+	assert.Equal(t, key.PublicKey(), decoded.PublicKey())
+
+	_, err = backup.MegolmBackupKeyFromBytes([]byte{1, 2, 3})
+	assert.ErrorIs(t, err, backup.ErrInvalidKeyLength)
+}
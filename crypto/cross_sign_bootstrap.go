@@ -0,0 +1,121 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"fmt"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/ssss"
+)
+
+// BootstrapCrossSigningOpts contains the options for BootstrapCrossSigning.
+type BootstrapCrossSigningOpts struct {
+	// UIAHandler completes the user-interactive authentication that the server requires for uploading the keys.
+	UIAHandler *mautrix.UIAHandler
+	// UIACallback is used if UIAHandler is nil.
+	//
+	// Deprecated: set UIAHandler.Callback instead.
+	UIACallback mautrix.UIACallback
+	// SSSSKey is the key that the private cross-signing keys are stored with. If nil, a new SSSS key is generated
+	// and set as the default key.
+	SSSSKey *ssss.Key
+	// Passphrase is used to generate the new SSSS key if SSSSKey is nil. If empty, a random key is generated.
+	Passphrase string
+	// SkipSSSS disables storing the private cross-signing keys in SSSS.
+	SkipSSSS bool
+}
+
+// BootstrapCrossSigningResult contains the keys created by BootstrapCrossSigning.
+type BootstrapCrossSigningResult struct {
+	// Keys are the new private cross-signing keys. They're also cached in OlmMachine.CrossSigningKeys once
+	// they've been uploaded to the server.
+	Keys *CrossSigningKeysCache
+	// SSSSKey is the key the private keys were stored with, or nil if SkipSSSS was set.
+	SSSSKey *ssss.Key
+	// RecoveryKey is the base58 recovery key of the SSSS key if a new one was generated.
+	RecoveryKey string
+}
+
+// BootstrapCrossSigning sets up cross-signing for the current user. It
+//
+//  1. generates new master, self-signing and user-signing keys,
+//  2. stores the private keys in SSSS, generating a new SSSS key unless one is given,
+//  3. uploads the public keys (signed by the master key) to the server, using opts.UIAHandler if necessary,
+//  4. marks the new SSSS key as the default key,
+//  5. signs the current device with the self-signing key, and
+//  6. signs the master key with the current device key.
+//
+// The private keys are stored before the public keys are uploaded, so that the uploaded keys can't be lost if
+// storing them fails. Any existing cross-signing keys of the user are replaced. If an error is returned after
+// the keys have been generated, the result is still returned so that e.g. the recovery key can be shown to the user.
+func (mach *OlmMachine) BootstrapCrossSigning(ctx context.Context, opts BootstrapCrossSigningOpts) (*BootstrapCrossSigningResult, error) {
+	result, err := mach.setUpCrossSigningKeys(ctx, opts)
+	if err != nil {
+		return result, err
+	} else if err = ctx.Err(); err != nil {
+		return result, err
+	}
+	err = mach.SignOwnDevice(mach.OwnIdentity())
+	if err != nil {
+		return result, fmt.Errorf("failed to sign own device: %w", err)
+	}
+	err = mach.SignOwnMasterKey()
+	if err != nil {
+		return result, fmt.Errorf("failed to sign own master key: %w", err)
+	}
+	mach.Log.Debug("Bootstrapped cross-signing with master key %s", result.Keys.MasterKey.PublicKey)
+	return result, nil
+}
+
+// setUpCrossSigningKeys does the first four steps of BootstrapCrossSigning, i.e. everything except signing the
+// current device and the master key.
+func (mach *OlmMachine) setUpCrossSigningKeys(ctx context.Context, opts BootstrapCrossSigningOpts) (*BootstrapCrossSigningResult, error) {
+	keys, err := mach.GenerateCrossSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	result := &BootstrapCrossSigningResult{Keys: keys}
+	if !opts.SkipSSSS {
+		if err = ctx.Err(); err != nil {
+			return result, err
+		}
+		result.SSSSKey = opts.SSSSKey
+		if result.SSSSKey == nil {
+			result.SSSSKey, err = mach.SSSS.GenerateAndUploadKey(opts.Passphrase)
+			if err != nil {
+				return result, fmt.Errorf("failed to generate and upload SSSS key: %w", err)
+			}
+			result.RecoveryKey = result.SSSSKey.RecoveryKey()
+		}
+		err = mach.UploadCrossSigningKeysToSSSS(result.SSSSKey, keys)
+		if err != nil {
+			return result, fmt.Errorf("failed to upload cross-signing keys to SSSS: %w", err)
+		}
+	}
+
+	if err = ctx.Err(); err != nil {
+		return result, err
+	}
+	uiaHandler := opts.UIAHandler
+	if uiaHandler == nil {
+		uiaHandler = &mautrix.UIAHandler{Callback: opts.UIACallback}
+	}
+	err = mach.PublishCrossSigningKeysWithUIA(keys, uiaHandler)
+	if err != nil {
+		return result, fmt.Errorf("failed to publish cross-signing keys: %w", err)
+	}
+
+	if !opts.SkipSSSS && opts.SSSSKey == nil {
+		err = mach.SSSS.SetDefaultKeyID(result.SSSSKey.ID)
+		if err != nil {
+			return result, fmt.Errorf("failed to mark %s as the default key: %w", result.SSSSKey.ID, err)
+		}
+	}
+	return result, nil
+}
@@ -82,8 +82,22 @@ func (mach *OlmMachine) GenerateCrossSigningKeys() (*CrossSigningKeysCache, erro
 }
 
 // PublishCrossSigningKeys signs and uploads the public keys of the given cross-signing keys to the server.
+//
+// Deprecated: use PublishCrossSigningKeysWithUIA, which can complete the auth stages itself.
 func (mach *OlmMachine) PublishCrossSigningKeys(keys *CrossSigningKeysCache, uiaCallback mautrix.UIACallback) error {
+	return mach.PublishCrossSigningKeysWithUIA(keys, &mautrix.UIAHandler{Callback: uiaCallback})
+}
+
+// PublishCrossSigningKeysWithUIA signs and uploads the public keys of the given cross-signing keys to the server,
+// using the handler to complete the user-interactive auth flow.
+func (mach *OlmMachine) PublishCrossSigningKeysWithUIA(keys *CrossSigningKeysCache, handler *mautrix.UIAHandler) error {
 	userID := mach.Client.UserID
+	// Sign with the machine's key provider if it already has the master key being published, so that custom
+	// providers are used for signing. Otherwise the keys are new, so sign with them directly.
+	var signer KeyProvider = &crossSigningKeyProvider{keys}
+	if currentMasterKey, err := mach.KeyProvider.PublicKey(KeyUsageMaster); err == nil && currentMasterKey == keys.MasterKey.PublicKey {
+		signer = mach.KeyProvider
+	}
 	masterKeyID := id.NewKeyID(id.KeyAlgorithmEd25519, keys.MasterKey.PublicKey.String())
 	masterKey := mautrix.CrossSigningKeys{
 		UserID: userID,
@@ -100,7 +114,7 @@ func (mach *OlmMachine) PublishCrossSigningKeys(keys *CrossSigningKeysCache, uia
 			id.NewKeyID(id.KeyAlgorithmEd25519, keys.SelfSigningKey.PublicKey.String()): keys.SelfSigningKey.PublicKey,
 		},
 	}
-	selfSig, err := keys.MasterKey.SignJSON(selfKey)
+	selfSig, err := signer.SignJSON(KeyUsageMaster, selfKey)
 	if err != nil {
 		return fmt.Errorf("failed to sign self-signing key: %w", err)
 	}
@@ -117,7 +131,7 @@ func (mach *OlmMachine) PublishCrossSigningKeys(keys *CrossSigningKeysCache, uia
 			id.NewKeyID(id.KeyAlgorithmEd25519, keys.UserSigningKey.PublicKey.String()): keys.UserSigningKey.PublicKey,
 		},
 	}
-	userSig, err := keys.MasterKey.SignJSON(userKey)
+	userSig, err := signer.SignJSON(KeyUsageMaster, userKey)
 	if err != nil {
 		return fmt.Errorf("failed to sign user-signing key: %w", err)
 	}
@@ -127,11 +141,11 @@ func (mach *OlmMachine) PublishCrossSigningKeys(keys *CrossSigningKeysCache, uia
 		},
 	}
 
-	err = mach.Client.UploadCrossSigningKeys(&mautrix.UploadCrossSigningKeysReq{
+	err = mach.Client.UploadCrossSigningKeysWithUIA(&mautrix.UploadCrossSigningKeysReq{
 		Master:      masterKey,
 		SelfSigning: selfKey,
 		UserSigning: userKey,
-	}, uiaCallback)
+	}, handler)
 	if err != nil {
 		return err
 	}
@@ -139,5 +153,24 @@ func (mach *OlmMachine) PublishCrossSigningKeys(keys *CrossSigningKeysCache, uia
 	mach.CrossSigningKeys = keys
 	mach.crossSigningPubkeys = keys.PublicKeys()
 
+	// Store the new public keys and their signatures locally too, so they can be used before the next key query.
+	if err = mach.storeOwnCrossSigningKeys(keys, selfSig, userSig); err != nil {
+		mach.Log.Warn("Failed to store own cross-signing keys in crypto store: %v", err)
+	}
+
 	return nil
 }
+
+func (mach *OlmMachine) storeOwnCrossSigningKeys(keys *CrossSigningKeysCache, selfSig, userSig string) error {
+	userID := mach.Client.UserID
+	if err := mach.CryptoStore.PutCrossSigningKey(userID, id.XSUsageMaster, keys.MasterKey.PublicKey); err != nil {
+		return err
+	} else if err = mach.CryptoStore.PutCrossSigningKey(userID, id.XSUsageSelfSigning, keys.SelfSigningKey.PublicKey); err != nil {
+		return err
+	} else if err = mach.CryptoStore.PutCrossSigningKey(userID, id.XSUsageUserSigning, keys.UserSigningKey.PublicKey); err != nil {
+		return err
+	} else if err = mach.CryptoStore.PutSignature(userID, keys.SelfSigningKey.PublicKey, userID, keys.MasterKey.PublicKey, selfSig); err != nil {
+		return err
+	}
+	return mach.CryptoStore.PutSignature(userID, keys.UserSigningKey.PublicKey, userID, keys.MasterKey.PublicKey, userSig)
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/id"
+)
+
+var ErrNoCrossSigningKeysToRotate = errors.New("no existing cross-signing keys to rotate")
+
+// RotateCrossSigningKeysResult contains the outcome of RotateCrossSigningKeys.
+type RotateCrossSigningKeysResult struct {
+	BootstrapCrossSigningResult
+
+	// ResignedDevices are the own devices that were signed with the new self-signing key.
+	ResignedDevices []id.DeviceID
+	// ResignedUsers are the users whose master keys were signed with the new user-signing key.
+	ResignedUsers []id.UserID
+	// TrustLost are the users who were trusted with the old keys, but couldn't be re-signed with the new keys,
+	// either because their master key has changed since it was signed or because signing failed. If any of
+	// the user's own previously trusted devices couldn't be re-signed, the user's own ID is included too.
+	TrustLost []id.UserID
+}
+
+// RotateCrossSigningKeys replaces the user's cross-signing keys with new ones, e.g. after the old private keys
+// were compromised. The new keys are set up with BootstrapCrossSigning using the given options, after which all
+// own devices that were trusted and all other users whose master keys were signed by the old user-signing key
+// are signed again with the new keys. Signatures made by the old keys are removed from the crypto store.
+//
+// To keep the existing recovery key working, opts.SSSSKey should be set to the current SSSS key, as otherwise a
+// new default SSSS key is generated.
+//
+// Users whose trust couldn't be carried over are listed in the result and passed to OnCrossSigningTrustLost.
+func (mach *OlmMachine) RotateCrossSigningKeys(ctx context.Context, opts BootstrapCrossSigningOpts) (*RotateCrossSigningKeysResult, error) {
+	oldKeys := mach.GetOwnCrossSigningPublicKeys()
+	if oldKeys == nil {
+		return nil, ErrNoCrossSigningKeysToRotate
+	}
+	ownUserID := mach.Client.UserID
+
+	devices, err := mach.CryptoStore.GetDevices(ownUserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get own devices: %w", err)
+	}
+	var trustedDevices []*DeviceIdentity
+	for _, device := range devices {
+		if device.DeviceID != mach.Client.DeviceID && mach.IsDeviceTrusted(device) {
+			trustedDevices = append(trustedDevices, device)
+		}
+	}
+
+	signedKeys, err := mach.CryptoStore.GetKeysSignedBy(ownUserID, oldKeys.UserSigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get users signed by old user-signing key: %w", err)
+	}
+	trustedUsers := make(map[id.UserID]id.Ed25519)
+	var trustLost []id.UserID
+	for userID, keys := range signedKeys {
+		if userID == ownUserID {
+			continue
+		}
+		theirKeys, err := mach.CryptoStore.GetCrossSigningKeys(userID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get cross-signing keys of %s: %w", userID, err)
+		}
+		masterKey := theirKeys[id.XSUsageMaster]
+		for _, key := range keys {
+			if key == masterKey {
+				trustedUsers[userID] = masterKey
+				break
+			}
+		}
+		if _, ok := trustedUsers[userID]; !ok {
+			mach.Log.Warn("Not re-signing %s: their master key has changed since it was signed", userID)
+			trustLost = append(trustLost, userID)
+		}
+	}
+
+	bootstrapResult, err := mach.BootstrapCrossSigning(ctx, opts)
+	result := &RotateCrossSigningKeysResult{TrustLost: trustLost}
+	if bootstrapResult != nil {
+		result.BootstrapCrossSigningResult = *bootstrapResult
+	}
+	if err != nil {
+		return result, err
+	}
+	mach.dropOldCrossSigningSignatures(oldKeys)
+
+	ownTrustLost := false
+	for _, device := range trustedDevices {
+		if err = mach.SignOwnDevice(device); err != nil {
+			mach.Log.Warn("Failed to re-sign own device %s after rotating cross-signing keys: %v", device.DeviceID, err)
+			ownTrustLost = true
+		} else {
+			result.ResignedDevices = append(result.ResignedDevices, device.DeviceID)
+		}
+	}
+	if ownTrustLost {
+		result.TrustLost = append(result.TrustLost, ownUserID)
+	}
+	for userID, masterKey := range trustedUsers {
+		if err = mach.SignUser(userID, masterKey); err != nil {
+			mach.Log.Warn("Failed to re-sign %s after rotating cross-signing keys: %v", userID, err)
+			result.TrustLost = append(result.TrustLost, userID)
+		} else {
+			result.ResignedUsers = append(result.ResignedUsers, userID)
+		}
+	}
+
+	mach.Log.Debug("Rotated cross-signing keys, re-signed %d devices and %d users, lost trust in %d users",
+		len(result.ResignedDevices), len(result.ResignedUsers), len(result.TrustLost))
+	if len(result.TrustLost) > 0 && mach.OnCrossSigningTrustLost != nil {
+		mach.OnCrossSigningTrustLost(result.TrustLost)
+	}
+	return result, nil
+}
+
+func (mach *OlmMachine) dropOldCrossSigningSignatures(oldKeys *CrossSigningPublicKeysCache) {
+	for _, key := range []id.Ed25519{oldKeys.MasterKey, oldKeys.SelfSigningKey, oldKeys.UserSigningKey} {
+		if len(key) == 0 {
+			continue
+		} else if count, err := mach.CryptoStore.DropSignaturesByKey(mach.Client.UserID, key); err != nil {
+			mach.Log.Error("Error deleting signatures made by old cross-signing key %s: %v", key, err)
+		} else {
+			mach.Log.Debug("Dropped %d signatures made by old cross-signing key %s", count, key)
+		}
+	}
+}
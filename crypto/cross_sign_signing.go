@@ -11,7 +11,6 @@ import (
 	"fmt"
 
 	"maunium.net/go/mautrix"
-	"maunium.net/go/mautrix/crypto/olm"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
@@ -61,8 +60,10 @@ func (mach *OlmMachine) fetchMasterKey(device *DeviceIdentity, content *event.Ve
 func (mach *OlmMachine) SignUser(userID id.UserID, masterKey id.Ed25519) error {
 	if userID == mach.Client.UserID {
 		return ErrCantSignOwnMasterKey
-	} else if mach.CrossSigningKeys == nil || mach.CrossSigningKeys.UserSigningKey == nil {
-		return ErrUserSigningKeyNotCached
+	}
+	userSigningKey, err := mach.KeyProvider.PublicKey(KeyUsageUserSigning)
+	if err != nil {
+		return err
 	}
 
 	masterKeyObj := mautrix.ReqKeysSignatures{
@@ -73,14 +74,14 @@ func (mach *OlmMachine) SignUser(userID id.UserID, masterKey id.Ed25519) error {
 		},
 	}
 
-	signature, err := mach.signAndUpload(masterKeyObj, userID, masterKey.String(), mach.CrossSigningKeys.UserSigningKey)
+	signature, err := mach.signAndUpload(masterKeyObj, userID, masterKey.String(), KeyUsageUserSigning, userSigningKey)
 	if err != nil {
 		return err
 	}
 
 	mach.Log.Trace("Signed master key of %s with user-signing key: `%v`", userID, signature)
 
-	if err := mach.CryptoStore.PutSignature(userID, masterKey, mach.Client.UserID, mach.CrossSigningKeys.UserSigningKey.PublicKey, signature); err != nil {
+	if err := mach.CryptoStore.PutSignature(userID, masterKey, mach.Client.UserID, userSigningKey, signature); err != nil {
 		return fmt.Errorf("error storing signature in crypto store: %w", err)
 	}
 
@@ -89,15 +90,17 @@ func (mach *OlmMachine) SignUser(userID id.UserID, masterKey id.Ed25519) error {
 
 // SignOwnMasterKey uses the current account for signing the current user's master key and uploads the signature.
 func (mach *OlmMachine) SignOwnMasterKey() error {
-	if mach.CrossSigningKeys == nil {
-		return ErrCrossSigningKeysNotCached
-	} else if mach.account == nil {
-		return ErrOlmAccountNotLoaded
+	masterKey, err := mach.KeyProvider.PublicKey(KeyUsageMaster)
+	if err != nil {
+		return err
+	}
+	deviceSigningKey, err := mach.KeyProvider.PublicKey(KeyUsageDevice)
+	if err != nil {
+		return err
 	}
 
 	userID := mach.Client.UserID
 	deviceID := mach.Client.DeviceID
-	masterKey := mach.CrossSigningKeys.MasterKey.PublicKey
 
 	masterKeyObj := mautrix.ReqKeysSignatures{
 		UserID: userID,
@@ -106,7 +109,7 @@ func (mach *OlmMachine) SignOwnMasterKey() error {
 			id.NewKeyID(id.KeyAlgorithmEd25519, masterKey.String()): masterKey.String(),
 		},
 	}
-	signature, err := mach.account.Internal.SignJSON(masterKeyObj)
+	signature, err := mach.KeyProvider.SignJSON(KeyUsageDevice, masterKeyObj)
 	if err != nil {
 		return fmt.Errorf("failed to sign JSON: %w", err)
 	}
@@ -129,7 +132,7 @@ func (mach *OlmMachine) SignOwnMasterKey() error {
 		return fmt.Errorf("%w: %+v", ErrSignatureUploadFail, resp.Failures)
 	}
 
-	if err := mach.CryptoStore.PutSignature(userID, masterKey, userID, mach.account.SigningKey(), signature); err != nil {
+	if err := mach.CryptoStore.PutSignature(userID, masterKey, userID, deviceSigningKey, signature); err != nil {
 		return fmt.Errorf("error storing signature in crypto store: %w", err)
 	}
 
@@ -140,8 +143,10 @@ func (mach *OlmMachine) SignOwnMasterKey() error {
 func (mach *OlmMachine) SignOwnDevice(device *DeviceIdentity) error {
 	if device.UserID != mach.Client.UserID {
 		return ErrCantSignOtherDevice
-	} else if mach.CrossSigningKeys == nil || mach.CrossSigningKeys.SelfSigningKey == nil {
-		return ErrSelfSigningKeyNotCached
+	}
+	selfSigningKey, err := mach.KeyProvider.PublicKey(KeyUsageSelfSigning)
+	if err != nil {
+		return err
 	}
 
 	deviceKeys, err := mach.getFullDeviceKeys(device)
@@ -159,14 +164,14 @@ func (mach *OlmMachine) SignOwnDevice(device *DeviceIdentity) error {
 		deviceKeyObj.Keys[id.KeyID(keyID)] = key
 	}
 
-	signature, err := mach.signAndUpload(deviceKeyObj, device.UserID, device.DeviceID.String(), mach.CrossSigningKeys.SelfSigningKey)
+	signature, err := mach.signAndUpload(deviceKeyObj, device.UserID, device.DeviceID.String(), KeyUsageSelfSigning, selfSigningKey)
 	if err != nil {
 		return err
 	}
 
 	mach.Log.Trace("Signed own device %s with self-signing key: `%v`", device.UserID, device.DeviceID, signature)
 
-	if err := mach.CryptoStore.PutSignature(device.UserID, device.SigningKey, mach.Client.UserID, mach.CrossSigningKeys.SelfSigningKey.PublicKey, signature); err != nil {
+	if err := mach.CryptoStore.PutSignature(device.UserID, device.SigningKey, mach.Client.UserID, selfSigningKey, signature); err != nil {
 		return fmt.Errorf("error storing signature in crypto store: %w", err)
 	}
 
@@ -197,14 +202,14 @@ func (mach *OlmMachine) getFullDeviceKeys(device *DeviceIdentity) (*mautrix.Devi
 }
 
 // signAndUpload signs the given key signatures object and uploads it to the server.
-func (mach *OlmMachine) signAndUpload(req mautrix.ReqKeysSignatures, userID id.UserID, signedThing string, key *olm.PkSigning) (string, error) {
-	signature, err := key.SignJSON(req)
+func (mach *OlmMachine) signAndUpload(req mautrix.ReqKeysSignatures, userID id.UserID, signedThing string, usage KeyUsage, publicKey id.Ed25519) (string, error) {
+	signature, err := mach.KeyProvider.SignJSON(usage, req)
 	if err != nil {
 		return "", fmt.Errorf("failed to sign JSON: %w", err)
 	}
 	req.Signatures = mautrix.Signatures{
 		mach.Client.UserID: map[id.KeyID]string{
-			id.NewKeyID(id.KeyAlgorithmEd25519, key.PublicKey.String()): signature,
+			id.NewKeyID(id.KeyAlgorithmEd25519, publicKey.String()): signature,
 		},
 	}
 
@@ -7,7 +7,7 @@
 package crypto
 
 import (
-	"fmt"
+	"context"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto/ssss"
@@ -21,39 +21,33 @@ func (mach *OlmMachine) FetchCrossSigningKeysFromSSSS(key *ssss.Key) error {
 	if err != nil {
 		return err
 	}
+	defer masterKey.Wipe()
 	selfSignKey, err := mach.retrieveDecryptXSigningKey(event.AccountDataCrossSigningSelf, key)
 	if err != nil {
 		return err
 	}
+	defer selfSignKey.Wipe()
 	userSignKey, err := mach.retrieveDecryptXSigningKey(event.AccountDataCrossSigningUser, key)
 	if err != nil {
 		return err
 	}
+	defer userSignKey.Wipe()
 
+	// The imported keys keep a reference to their seeds, so they get copies that aren't wiped here.
 	return mach.ImportCrossSigningKeys(CrossSigningSeeds{
-		MasterKey:      masterKey[:],
-		SelfSigningKey: selfSignKey[:],
-		UserSigningKey: userSignKey[:],
+		MasterKey:      append([]byte{}, masterKey.Bytes()...),
+		SelfSigningKey: append([]byte{}, selfSignKey.Bytes()...),
+		UserSigningKey: append([]byte{}, userSignKey.Bytes()...),
 	})
 }
 
 // retrieveDecryptXSigningKey retrieves the requested cross-signing key from SSSS and decrypts it using the given SSSS key.
-func (mach *OlmMachine) retrieveDecryptXSigningKey(keyName event.Type, key *ssss.Key) ([utils.AESCTRKeyLength]byte, error) {
-	var decryptedKey [utils.AESCTRKeyLength]byte
-	var encData ssss.EncryptedAccountDataEventContent
-
-	// retrieve and parse the account data for this key type from SSSS
-	err := mach.Client.GetAccountData(keyName.Type, &encData)
+func (mach *OlmMachine) retrieveDecryptXSigningKey(keyName event.Type, key *ssss.Key) (*utils.SecretBytes, error) {
+	decrypted, err := mach.SSSS.GetDecryptedAccountData(keyName, key)
 	if err != nil {
-		return decryptedKey, err
+		return nil, err
 	}
-
-	decrypted, err := encData.Decrypt(keyName.Type, key)
-	if err != nil {
-		return decryptedKey, err
-	}
-	copy(decryptedKey[:], decrypted)
-	return decryptedKey, nil
+	return utils.NewSecretBytes(decrypted), nil
 }
 
 // GenerateAndUploadCrossSigningKeys generates a new key with all corresponding cross-signing keys.
@@ -62,46 +56,17 @@ func (mach *OlmMachine) retrieveDecryptXSigningKey(keyName event.Type, key *ssss
 // is used. The base58-formatted recovery key is the first return parameter.
 //
 // The account password of the user is required for uploading keys to the server.
+// See BootstrapCrossSigning for a more flexible version of this method.
 func (mach *OlmMachine) GenerateAndUploadCrossSigningKeys(userPassword, passphrase string) (string, error) {
-	key, err := mach.SSSS.GenerateAndUploadKey(passphrase)
-	if err != nil {
-		return "", fmt.Errorf("failed to generate and upload SSSS key: %w", err)
-	}
-
-	// generate the three cross-signing keys
-	keysCache, err := mach.GenerateCrossSigningKeys()
-	if err != nil {
-		return "", err
-	}
-
-	recoveryKey := key.RecoveryKey()
-
-	// Store the private keys in SSSS
-	if err := mach.UploadCrossSigningKeysToSSSS(key, keysCache); err != nil {
-		return recoveryKey, fmt.Errorf("failed to upload cross-signing keys to SSSS: %w", err)
-	}
-
-	// Publish cross-signing keys
-	err = mach.PublishCrossSigningKeys(keysCache, func(uiResp *mautrix.RespUserInteractive) interface{} {
-		return &mautrix.ReqUIAuthLogin{
-			BaseAuthData: mautrix.BaseAuthData{
-				Type:    mautrix.AuthTypePassword,
-				Session: uiResp.Session,
-			},
-			User:     mach.Client.UserID.String(),
-			Password: userPassword,
-		}
+	// Unlike BootstrapCrossSigning, this doesn't sign the current device or the master key.
+	result, err := mach.setUpCrossSigningKeys(context.Background(), BootstrapCrossSigningOpts{
+		UIAHandler: &mautrix.UIAHandler{Password: userPassword},
+		Passphrase: passphrase,
 	})
-	if err != nil {
-		return recoveryKey, fmt.Errorf("failed to publish cross-signing keys: %w", err)
+	if result != nil {
+		return result.RecoveryKey, err
 	}
-
-	err = mach.SSSS.SetDefaultKeyID(key.ID)
-	if err != nil {
-		return recoveryKey, fmt.Errorf("failed to mark %s as the default key: %w", key.ID, err)
-	}
-
-	return recoveryKey, nil
+	return "", err
 }
 
 // UploadCrossSigningKeysToSSSS stores the given cross-signing keys on the server encrypted with the given key.
@@ -7,7 +7,14 @@
 package crypto
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
 	"testing"
 
 	"maunium.net/go/mautrix"
@@ -143,3 +150,308 @@ func TestTrustOtherDevice(t *testing.T) {
 		t.Error("Other device not trusted while it should be")
 	}
 }
+
+// crossSigningTestServer is a fake homeserver that handles the endpoints used when setting up cross-signing.
+type crossSigningTestServer struct {
+	*httptest.Server
+	accountData        map[string]json.RawMessage
+	deviceKeys         map[id.DeviceID]mautrix.DeviceKeys
+	uiaDone            bool
+	signaturesUploaded int
+	// storedBeforeUpload is whether the private master key was in SSSS when the public keys were uploaded.
+	storedBeforeUpload bool
+}
+
+func newCrossSigningTestServer(machine *OlmMachine) *crossSigningTestServer {
+	ownKeys := machine.account.getInitialKeys(machine.Client.UserID, machine.Client.DeviceID, machine.KeyProvider)
+	ts := &crossSigningTestServer{
+		accountData: make(map[string]json.RawMessage),
+		deviceKeys:  map[id.DeviceID]mautrix.DeviceKeys{machine.Client.DeviceID: *ownKeys},
+	}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/keys/device_signing/upload"):
+			var req map[string]json.RawMessage
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			var auth struct {
+				Type     mautrix.AuthType `json:"type"`
+				Session  string           `json:"session"`
+				Password string           `json:"password"`
+			}
+			if authData, ok := req["auth"]; !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = w.Write([]byte(`{"session": "uia", "flows": [{"stages": ["m.login.password"]}]}`))
+				return
+			} else if _ = json.Unmarshal(authData, &auth); auth.Type != mautrix.AuthTypePassword || auth.Session != "uia" || auth.Password != "hunter2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "Invalid password", "session": "uia", "flows": [{"stages": ["m.login.password"]}]}`))
+				return
+			}
+			ts.uiaDone = true
+			_, ts.storedBeforeUpload = ts.accountData["m.cross_signing.master"]
+			_, _ = w.Write([]byte("{}"))
+		case strings.Contains(r.URL.Path, "/account_data/"):
+			evtType := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+			if r.Method == http.MethodGet {
+				data, ok := ts.accountData[evtType]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "not found"}`))
+					return
+				}
+				_, _ = w.Write(data)
+				return
+			}
+			var data json.RawMessage
+			_ = json.NewDecoder(r.Body).Decode(&data)
+			ts.accountData[evtType] = data
+			_, _ = w.Write([]byte("{}"))
+		case strings.HasSuffix(r.URL.Path, "/keys/query"):
+			_ = json.NewEncoder(w).Encode(&mautrix.RespQueryKeys{
+				DeviceKeys: map[id.UserID]map[id.DeviceID]mautrix.DeviceKeys{
+					machine.Client.UserID: ts.deviceKeys,
+				},
+			})
+		case strings.HasSuffix(r.URL.Path, "/keys/signatures/upload"):
+			ts.signaturesUploaded++
+			_, _ = w.Write([]byte(`{"failures": {}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	machine.Client.HomeserverURL, _ = url.Parse(ts.URL)
+	return ts
+}
+
+func passwordUIACallback(userID id.UserID) mautrix.UIACallback {
+	return func(uiResp *mautrix.RespUserInteractive) interface{} {
+		return &mautrix.ReqUIAuthLogin{
+			BaseAuthData: mautrix.BaseAuthData{Type: mautrix.AuthTypePassword, Session: uiResp.Session},
+			User:         userID.String(),
+			Password:     "hunter2",
+		}
+	}
+}
+
+func TestOlmMachineBootstrapCrossSigning(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	server := newCrossSigningTestServer(machine)
+	defer server.Close()
+
+	result, err := machine.BootstrapCrossSigning(context.Background(), BootstrapCrossSigningOpts{
+		UIAHandler: &mautrix.UIAHandler{Password: "hunter2"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to bootstrap cross-signing: %v", err)
+	} else if !server.uiaDone {
+		t.Error("Cross-signing keys weren't uploaded with UIA")
+	} else if server.signaturesUploaded == 0 {
+		t.Error("Signatures weren't uploaded")
+	} else if !server.storedBeforeUpload {
+		t.Error("Cross-signing keys were uploaded before storing them in SSSS")
+	}
+	if result.Keys == nil || machine.CrossSigningKeys != result.Keys {
+		t.Error("Cross-signing keys weren't cached in the machine")
+	}
+	if result.SSSSKey == nil || len(result.RecoveryKey) == 0 {
+		t.Error("No SSSS key was generated")
+	}
+	for _, evtType := range []string{"m.cross_signing.master", "m.cross_signing.self_signing", "m.cross_signing.user_signing", "m.secret_storage.default_key"} {
+		if _, ok := server.accountData[evtType]; !ok {
+			t.Errorf("%s wasn't stored in account data", evtType)
+		}
+	}
+	if storedKeys, err := machine.CryptoStore.GetCrossSigningKeys(machine.Client.UserID); err != nil {
+		t.Fatalf("Failed to get own cross-signing keys from store: %v", err)
+	} else if storedKeys[id.XSUsageMaster] != result.Keys.MasterKey.PublicKey {
+		t.Error("Master key wasn't stored in the crypto store")
+	}
+	if !machine.isDeviceCrossSigned(machine.OwnIdentity()) {
+		t.Error("Own device wasn't cross-signed")
+	}
+}
+
+func TestOlmMachineGenerateAndUploadCrossSigningKeys(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	server := newCrossSigningTestServer(machine)
+	defer server.Close()
+
+	recoveryKey, err := machine.GenerateAndUploadCrossSigningKeys("hunter2", "")
+	if err != nil {
+		t.Fatalf("Failed to generate and upload cross-signing keys: %v", err)
+	} else if len(recoveryKey) == 0 {
+		t.Error("No recovery key was returned")
+	} else if !server.uiaDone || !server.storedBeforeUpload {
+		t.Error("Cross-signing keys weren't stored in SSSS before uploading them")
+	}
+	if _, ok := server.accountData["m.secret_storage.default_key"]; !ok {
+		t.Error("New SSSS key wasn't marked as the default key")
+	}
+	// Unlike BootstrapCrossSigning, the device and master key aren't signed
+	if server.signaturesUploaded != 0 {
+		t.Errorf("Expected no signatures to be uploaded, got %d uploads", server.signaturesUploaded)
+	}
+}
+
+// recordingKeyProvider is a KeyProvider that records the usages it was asked to sign with.
+type recordingKeyProvider struct {
+	KeyProvider
+	signed []KeyUsage
+}
+
+func (rkp *recordingKeyProvider) SignJSON(usage KeyUsage, obj interface{}) (string, error) {
+	rkp.signed = append(rkp.signed, usage)
+	return rkp.KeyProvider.SignJSON(usage, obj)
+}
+
+func TestOlmMachinePublishCrossSigningKeys_KeyProvider(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	server := newCrossSigningTestServer(machine)
+	defer server.Close()
+	provider := &recordingKeyProvider{KeyProvider: machine.KeyProvider}
+	machine.KeyProvider = provider
+
+	// New keys aren't known by the key provider, so they sign themselves
+	keys, err := machine.GenerateCrossSigningKeys()
+	if err != nil {
+		t.Fatalf("Failed to generate cross-signing keys: %v", err)
+	}
+	handler := &mautrix.UIAHandler{Password: "hunter2"}
+	if err = machine.PublishCrossSigningKeysWithUIA(keys, handler); err != nil {
+		t.Fatalf("Failed to publish cross-signing keys: %v", err)
+	} else if len(provider.signed) != 0 {
+		t.Errorf("Key provider was used for signing new keys: %v", provider.signed)
+	}
+
+	// Republishing the current keys signs through the key provider
+	if err = machine.PublishCrossSigningKeysWithUIA(keys, handler); err != nil {
+		t.Fatalf("Failed to republish cross-signing keys: %v", err)
+	} else if len(provider.signed) != 2 || provider.signed[0] != KeyUsageMaster || provider.signed[1] != KeyUsageMaster {
+		t.Errorf("Expected the key provider to sign both subkeys with the master key, got %v", provider.signed)
+	}
+}
+
+func TestOlmMachineRotateCrossSigningKeys(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	server := newCrossSigningTestServer(machine)
+	defer server.Close()
+	ownUserID := machine.Client.UserID
+
+	bootstrapResult, err := machine.BootstrapCrossSigning(context.Background(), BootstrapCrossSigningOpts{
+		UIACallback: passwordUIACallback(ownUserID),
+	})
+	if err != nil {
+		t.Fatalf("Failed to bootstrap cross-signing: %v", err)
+	}
+	oldKeys := bootstrapResult.Keys.PublicKeys()
+
+	// Another own device signed with the old self-signing key
+	otherAccount := NewOlmAccount()
+	otherDeviceKeys := otherAccount.getInitialKeys(ownUserID, "device2", &accountKeyProvider{otherAccount})
+	server.deviceKeys["device2"] = *otherDeviceKeys
+	otherDevice := &DeviceIdentity{
+		UserID:      ownUserID,
+		DeviceID:    "device2",
+		IdentityKey: otherAccount.IdentityKey(),
+		SigningKey:  otherAccount.SigningKey(),
+	}
+	machine.CryptoStore.PutDevice(ownUserID, otherDevice)
+	machine.CryptoStore.PutSignature(ownUserID, otherDevice.SigningKey, ownUserID, oldKeys.SelfSigningKey, "sig")
+
+	// A user whose current master key is signed and one whose master key has changed since it was signed
+	trustedMSK, _ := olm.NewPkSigning()
+	oldMSK, _ := olm.NewPkSigning()
+	changedMSK, _ := olm.NewPkSigning()
+	machine.CryptoStore.PutCrossSigningKey("user2", id.XSUsageMaster, trustedMSK.PublicKey)
+	machine.CryptoStore.PutSignature("user2", trustedMSK.PublicKey, ownUserID, oldKeys.UserSigningKey, "sig")
+	machine.CryptoStore.PutCrossSigningKey("user3", id.XSUsageMaster, changedMSK.PublicKey)
+	machine.CryptoStore.PutSignature("user3", oldMSK.PublicKey, ownUserID, oldKeys.UserSigningKey, "sig")
+
+	var lostTrust []id.UserID
+	machine.OnCrossSigningTrustLost = func(users []id.UserID) {
+		lostTrust = users
+	}
+	result, err := machine.RotateCrossSigningKeys(context.Background(), BootstrapCrossSigningOpts{
+		UIACallback: passwordUIACallback(ownUserID),
+		SSSSKey:     bootstrapResult.SSSSKey,
+	})
+	if err != nil {
+		t.Fatalf("Failed to rotate cross-signing keys: %v", err)
+	}
+	if result.Keys.MasterKey.PublicKey == oldKeys.MasterKey {
+		t.Error("Master key wasn't rotated")
+	} else if len(result.RecoveryKey) != 0 {
+		t.Error("New SSSS key was generated even though the existing one was provided")
+	}
+	if len(result.ResignedDevices) != 1 || result.ResignedDevices[0] != "device2" {
+		t.Errorf("Unexpected re-signed devices %v", result.ResignedDevices)
+	}
+	if len(result.ResignedUsers) != 1 || result.ResignedUsers[0] != "user2" {
+		t.Errorf("Unexpected re-signed users %v", result.ResignedUsers)
+	}
+	if len(lostTrust) != 1 || lostTrust[0] != "user3" {
+		t.Errorf("Unexpected users with lost trust %v", lostTrust)
+	}
+	if !machine.IsUserTrusted("user2") {
+		t.Error("Re-signed user isn't trusted")
+	} else if machine.IsUserTrusted("user3") {
+		t.Error("User with changed master key is still trusted")
+	} else if !machine.IsDeviceTrusted(otherDevice) {
+		t.Error("Re-signed device isn't trusted")
+	}
+	if signed, _ := machine.CryptoStore.GetKeysSignedBy(ownUserID, oldKeys.UserSigningKey); len(signed) != 0 {
+		t.Errorf("Signatures by the old user-signing key weren't dropped: %v", signed)
+	}
+}
+
+func TestTrustChain(t *testing.T) {
+	m := getOlmMachine(t)
+	otherUser := id.UserID("@user")
+	theirDevice := &DeviceIdentity{
+		UserID:     otherUser,
+		DeviceID:   "theirDevice",
+		SigningKey: id.Ed25519("theirDeviceKey"),
+	}
+	m.CryptoStore.PutDevice(otherUser, theirDevice)
+	theirMasterKey, _ := olm.NewPkSigning()
+	m.CryptoStore.PutCrossSigningKey(otherUser, id.XSUsageMaster, theirMasterKey.PublicKey)
+	theirSSK, _ := olm.NewPkSigning()
+	m.CryptoStore.PutCrossSigningKey(otherUser, id.XSUsageSelfSigning, theirSSK.PublicKey)
+	m.CryptoStore.PutSignature(m.Client.UserID, m.CrossSigningKeys.UserSigningKey.PublicKey,
+		m.Client.UserID, m.CrossSigningKeys.MasterKey.PublicKey, "sig1")
+	m.CryptoStore.PutSignature(otherUser, theirSSK.PublicKey, otherUser, theirMasterKey.PublicKey, "sig2")
+	m.CryptoStore.PutSignature(otherUser, theirDevice.SigningKey, otherUser, theirSSK.PublicKey, "sig3")
+
+	chain, err := m.TrustChain(otherUser, theirDevice.DeviceID)
+	if err != nil {
+		t.Fatalf("Failed to get trust chain: %v", err)
+	}
+	expectedSigned := []bool{true, true, false, true}
+	if len(chain.Links) != len(expectedSigned) {
+		t.Fatalf("Expected %d links in trust chain, got %d", len(expectedSigned), len(chain.Links))
+	}
+	for i, link := range chain.Links {
+		if link.Signed != expectedSigned[i] {
+			t.Errorf("Unexpected signed status %t for link %d (%s %s by %s)", link.Signed, i, link.UserID, link.Usage, link.SignerUsage)
+		}
+	}
+	if chain.Links[2].Usage != KeyUsageMaster || chain.Links[2].SignerUsage != KeyUsageUserSigning {
+		t.Errorf("Unexpected third link %+v", chain.Links[2])
+	}
+	if chain.CrossSigned || chain.Trusted {
+		t.Error("Device trusted even though their master key isn't signed")
+	}
+
+	m.CryptoStore.PutSignature(otherUser, theirMasterKey.PublicKey,
+		m.Client.UserID, m.CrossSigningKeys.UserSigningKey.PublicKey, "sig4")
+	chain, err = m.TrustChain(otherUser, theirDevice.DeviceID)
+	if err != nil {
+		t.Fatalf("Failed to get trust chain: %v", err)
+	} else if !chain.CrossSigned || !chain.Trusted {
+		t.Error("Device not trusted even though the whole chain is signed")
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"fmt"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// TrustChainLink is a single hop in a TrustChain: a key that should be signed by another key.
+type TrustChainLink struct {
+	// UserID, Usage and Key identify the key that should be signed. Key is empty if the key isn't known.
+	UserID id.UserID
+	Usage  KeyUsage
+	Key    id.Ed25519
+
+	// SignerUserID, SignerUsage and SignerKey identify the key that should have signed Key.
+	// SignerKey is empty if the signing key isn't known.
+	SignerUserID id.UserID
+	SignerUsage  KeyUsage
+	SignerKey    id.Ed25519
+
+	// Signed is true if a valid signature by SignerKey on Key is stored.
+	Signed bool
+}
+
+// TrustChain describes why a device is or isn't trusted.
+type TrustChain struct {
+	Device *DeviceIdentity
+	// Links contains the signatures that make up the cross-signing chain from the device to our own master key:
+	// device ← self-signing key ← master key ← our user-signing key ← our master key.
+	// For our own devices, the chain ends at our master key.
+	Links []TrustChainLink
+	// CrossSigned is true if every link in the chain is signed.
+	CrossSigned bool
+	// Trusted is the final result of IsDeviceTrusted, which also takes the local trust state of the device into account.
+	Trusted bool
+}
+
+// TrustChain returns the cross-signing signature chain of the given device along with the status of each hop.
+// This can be used to display why a device is or isn't trusted.
+func (mach *OlmMachine) TrustChain(userID id.UserID, deviceID id.DeviceID) (*TrustChain, error) {
+	device, err := mach.GetOrFetchDevice(userID, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device: %w", err)
+	}
+	theirKeys, err := mach.CryptoStore.GetCrossSigningKeys(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cross-signing keys of %s: %w", userID, err)
+	}
+	links := []TrustChainLink{{
+		UserID: userID, Usage: KeyUsageDevice, Key: device.SigningKey,
+		SignerUserID: userID, SignerUsage: KeyUsageSelfSigning, SignerKey: theirKeys[id.XSUsageSelfSigning],
+	}, {
+		UserID: userID, Usage: KeyUsageSelfSigning, Key: theirKeys[id.XSUsageSelfSigning],
+		SignerUserID: userID, SignerUsage: KeyUsageMaster, SignerKey: theirKeys[id.XSUsageMaster],
+	}}
+	if userID != mach.Client.UserID {
+		ownKeys, err := mach.CryptoStore.GetCrossSigningKeys(mach.Client.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get own cross-signing keys: %w", err)
+		}
+		links = append(links, TrustChainLink{
+			UserID: userID, Usage: KeyUsageMaster, Key: theirKeys[id.XSUsageMaster],
+			SignerUserID: mach.Client.UserID, SignerUsage: KeyUsageUserSigning, SignerKey: ownKeys[id.XSUsageUserSigning],
+		}, TrustChainLink{
+			UserID: mach.Client.UserID, Usage: KeyUsageUserSigning, Key: ownKeys[id.XSUsageUserSigning],
+			SignerUserID: mach.Client.UserID, SignerUsage: KeyUsageMaster, SignerKey: ownKeys[id.XSUsageMaster],
+		})
+	}
+	chain := &TrustChain{Device: device, Links: links, CrossSigned: true}
+	for i := range chain.Links {
+		link := &chain.Links[i]
+		if len(link.Key) > 0 && len(link.SignerKey) > 0 {
+			link.Signed, err = mach.CryptoStore.IsKeySignedBy(link.UserID, link.Key, link.SignerUserID, link.SignerKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to check signature of %s by %s: %w", link.Key, link.SignerKey, err)
+			}
+		}
+		chain.CrossSigned = chain.CrossSigned && link.Signed
+	}
+	chain.Trusted = mach.IsDeviceTrusted(device)
+	return chain, nil
+}
@@ -21,7 +21,13 @@ func (mach *OlmMachine) IsDeviceTrusted(device *DeviceIdentity) bool {
 	if !mach.IsUserTrusted(userID) {
 		return false
 	}
+	return mach.isDeviceCrossSigned(device)
+}
 
+// isDeviceCrossSigned returns whether a device has been signed by its owner's self-signing key, which in turn has been
+// signed by the owner's master key. It doesn't check whether the master key itself is trusted.
+func (mach *OlmMachine) isDeviceCrossSigned(device *DeviceIdentity) bool {
+	userID := device.UserID
 	theirKeys, err := mach.CryptoStore.GetCrossSigningKeys(userID)
 	if err != nil {
 		mach.Log.Error("Error retrieving cross-singing key of user %v from database: %v", userID, err)
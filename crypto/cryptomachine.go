@@ -0,0 +1,73 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// CryptoMachine contains the end-to-end encryption methods that clients normally need from OlmMachine.
+//
+// Code that only needs to encrypt and decrypt events and keep track of devices should depend on this interface
+// instead of *OlmMachine, so that the machine can be replaced with a mock in tests or with an alternative
+// implementation.
+type CryptoMachine interface {
+	// Load loads the account from the crypto store. This must be called before using the machine.
+	Load() error
+	// FlushStore flushes any buffered data in the crypto store.
+	FlushStore() error
+	// OwnIdentity returns the device identity of the machine's own device.
+	OwnIdentity() *DeviceIdentity
+	// ShareKeys uploads the device keys and one-time keys of the machine's device to the server if needed.
+	ShareKeys(currentOTKCount int) error
+
+	// ProcessSyncResponse handles the encryption-related parts of a /sync response.
+	ProcessSyncResponse(resp *mautrix.RespSync, since string) bool
+	// HandleMemberEvent handles a membership event in an encrypted room.
+	HandleMemberEvent(evt *event.Event)
+	// HandleToDeviceEvent handles a single to-device event.
+	HandleToDeviceEvent(evt *event.Event)
+	// HandleDeviceLists handles the device list changes in a /sync response.
+	HandleDeviceLists(dl *mautrix.DeviceLists, since string)
+	// HandleOTKCounts uploads new one-time keys if the server is running low.
+	HandleOTKCounts(otkCount *mautrix.OTKCount)
+
+	// EncryptMegolmEvent encrypts an event using the current outbound group session of the room.
+	EncryptMegolmEvent(roomID id.RoomID, evtType event.Type, content interface{}) (*event.EncryptedEventContent, error)
+	// EncryptMegolmEventAutoShare encrypts an event after sharing the outbound group session with the room if needed.
+	EncryptMegolmEventAutoShare(roomID id.RoomID, evtType event.Type, content interface{}) (*event.EncryptedEventContent, error)
+	// DecryptMegolmEvent decrypts a single m.room.encrypted event.
+	DecryptMegolmEvent(evt *event.Event) (*event.Event, error)
+	// DecryptMany decrypts a batch of m.room.encrypted events.
+	DecryptMany(ctx context.Context, events []*event.Event) []DecryptResult
+	// ShareGroupSession shares the outbound group session of a room with all devices of the given users.
+	ShareGroupSession(roomID id.RoomID, users []id.UserID) error
+	// WaitForSession waits for an inbound group session to arrive.
+	WaitForSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, timeout time.Duration) bool
+
+	// LoadDevices fetches the devices of a user from the server.
+	LoadDevices(user id.UserID) map[id.DeviceID]*DeviceIdentity
+	// WaitForDeviceList returns the device list of a user, fetching it first if it's unknown or outdated.
+	WaitForDeviceList(userID id.UserID) (map[id.DeviceID]*DeviceIdentity, error)
+	// GetOrFetchDevice gets a device from the crypto store, or fetches it from the server if it's not known.
+	GetOrFetchDevice(userID id.UserID, deviceID id.DeviceID) (*DeviceIdentity, error)
+	// SendEncryptedToDevice sends an olm-encrypted to-device event to a single device.
+	SendEncryptedToDevice(device *DeviceIdentity, evtType event.Type, content event.Content) error
+	// SendEncryptedToDeviceID sends an olm-encrypted to-device event with arbitrary content to a device by its ID.
+	SendEncryptedToDeviceID(ctx context.Context, userID id.UserID, deviceID id.DeviceID, evtType event.Type, content interface{}) error
+	// IsDeviceTrusted returns whether a device is trusted, either through verification or cross-signing.
+	IsDeviceTrusted(device *DeviceIdentity) bool
+	// SetDeviceTrust sets the trust state of a device.
+	SetDeviceTrust(device *DeviceIdentity, trust TrustState) error
+}
+
+var _ CryptoMachine = (*OlmMachine)(nil)
@@ -0,0 +1,120 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// encryptWith only depends on the interface, like code that accepts a mock machine would.
+func encryptWith(mach CryptoMachine, roomID id.RoomID, text string) (*event.Event, error) {
+	content, err := mach.EncryptMegolmEvent(roomID, event.EventMessage, map[string]string{"body": text})
+	if err != nil {
+		return nil, err
+	}
+	own := mach.OwnIdentity()
+	return &event.Event{
+		Type:    event.EventEncrypted,
+		ID:      id.EventID("$" + text),
+		RoomID:  roomID,
+		Sender:  own.UserID,
+		Content: event.Content{Parsed: content},
+	}, nil
+}
+
+func TestCryptoMachine_OlmMachine(t *testing.T) {
+	machineOut, storeFileNameOut := newMachine(t, "user1")
+	defer os.Remove(storeFileNameOut)
+	machineIn, storeFileNameIn := newMachineWithDevice(t, "user2", "device2")
+	defer os.Remove(storeFileNameIn)
+	var sender, receiver CryptoMachine = machineOut, machineIn
+
+	own := sender.OwnIdentity()
+	if own.UserID != "user1" || own.DeviceID != "device1" || own.IdentityKey != machineOut.account.IdentityKey() {
+		t.Errorf("Unexpected own identity %+v", own)
+	}
+
+	// Share the megolm session directly instead of through olm, the interface is what's being tested here
+	outSession := machineOut.newOutboundGroupSession("room1")
+	outSession.Shared = true
+	if err := machineOut.CryptoStore.AddOutboundGroupSession(outSession); err != nil {
+		t.Fatalf("Error storing outbound session: %v", err)
+	}
+	inSession, err := NewInboundGroupSession(own.IdentityKey, own.SigningKey, "room1", outSession.Internal.Key())
+	if err != nil {
+		t.Fatalf("Error creating inbound session: %v", err)
+	}
+	if err = machineIn.CryptoStore.PutGroupSession("room1", own.IdentityKey, inSession.ID(), inSession); err != nil {
+		t.Fatalf("Error storing inbound session: %v", err)
+	}
+	// The own identity is always verified, the receiver doesn't know the device yet
+	senderDevice := *own
+	senderDevice.Trust = TrustStateUnset
+	if err = machineIn.CryptoStore.PutDevice("user1", &senderDevice); err != nil {
+		t.Fatalf("Error storing sender device: %v", err)
+	}
+
+	first, err := encryptWith(sender, "room1", "first")
+	if err != nil {
+		t.Fatalf("Error encrypting event: %v", err)
+	}
+	decrypted, err := receiver.DecryptMegolmEvent(first)
+	if err != nil {
+		t.Fatalf("Error decrypting event: %v", err)
+	} else if decrypted.Content.Raw["body"] != "first" {
+		t.Errorf("Unexpected decrypted content %v", decrypted.Content.Raw)
+	}
+
+	second, err := encryptWith(sender, "room1", "second")
+	if err != nil {
+		t.Fatalf("Error encrypting event: %v", err)
+	}
+	unknown := &event.Event{
+		Type:   event.EventEncrypted,
+		ID:     "$unknown",
+		RoomID: "room2",
+		Sender: "user1",
+		Content: event.Content{Parsed: &event.EncryptedEventContent{
+			Algorithm:        id.AlgorithmMegolmV1,
+			SenderKey:        own.IdentityKey,
+			SessionID:        "unknown",
+			MegolmCiphertext: first.Content.AsEncrypted().MegolmCiphertext,
+		}},
+	}
+	results := receiver.DecryptMany(context.Background(), []*event.Event{second, unknown})
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+	if results[0].Error != nil || results[0].Event.Content.Raw["body"] != "second" {
+		t.Errorf("Unexpected result for known session: %+v", results[0])
+	}
+	if results[1].Event != nil || !errors.Is(results[1].Error, NoSessionFound) {
+		t.Errorf("Expected NoSessionFound for unknown session, got %+v", results[1])
+	}
+
+	device, err := receiver.GetOrFetchDevice("user1", "device1")
+	if err != nil {
+		t.Fatalf("Error getting stored device: %v", err)
+	}
+	if receiver.IsDeviceTrusted(device) {
+		t.Error("Unverified device is trusted")
+	}
+	if err = receiver.SetDeviceTrust(device, TrustStateVerified); err != nil {
+		t.Fatalf("Error setting device trust: %v", err)
+	}
+	if stored, _ := machineIn.CryptoStore.GetDevice("user1", "device1"); stored == nil || stored.Trust != TrustStateVerified {
+		t.Error("Device trust wasn't stored")
+	} else if !receiver.IsDeviceTrusted(stored) {
+		t.Error("Verified device isn't trusted")
+	}
+}
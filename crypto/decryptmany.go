@@ -0,0 +1,150 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// DecryptResult is the result of decrypting a single event with DecryptMany.
+type DecryptResult struct {
+	// The decrypted event, or nil if decryption failed.
+	Event *event.Event
+	// The error that caused decryption to fail.
+	Error error
+}
+
+type megolmSessionKey struct {
+	roomID    id.RoomID
+	senderKey id.SenderKey
+	sessionID id.SessionID
+}
+
+type deviceCacheKey struct {
+	userID   id.UserID
+	deviceID id.DeviceID
+}
+
+type deviceCacheEntry struct {
+	device *DeviceIdentity
+	err    error
+}
+
+// deviceCache memoizes device lookups for the duration of a single DecryptMany call.
+type deviceCache struct {
+	getDevice deviceGetter
+	cache     map[deviceCacheKey]deviceCacheEntry
+	lock      sync.Mutex
+}
+
+func (dc *deviceCache) get(userID id.UserID, deviceID id.DeviceID) (*DeviceIdentity, error) {
+	key := deviceCacheKey{userID, deviceID}
+	dc.lock.Lock()
+	entry, ok := dc.cache[key]
+	dc.lock.Unlock()
+	if !ok {
+		entry.device, entry.err = dc.getDevice(userID, deviceID)
+		dc.lock.Lock()
+		dc.cache[key] = entry
+		dc.lock.Unlock()
+	}
+	return entry.device, entry.err
+}
+
+// DecryptMany decrypts a batch of megolm events, e.g. from paginating the history of an encrypted room.
+//
+// Events are grouped by megolm session, so that each session and each sender device is only looked up from the
+// crypto store once. Different sessions are decrypted concurrently using up to DecryptionWorkers goroutines, while
+// the events of a single session are decrypted sequentially in the given order.
+//
+// The returned slice contains a result for each given event in the same order. If the context is canceled, the events
+// that haven't been decrypted yet will have the context error as their error.
+func (mach *OlmMachine) DecryptMany(ctx context.Context, events []*event.Event) []DecryptResult {
+	results := make([]DecryptResult, len(events))
+	groups := make(map[megolmSessionKey][]int)
+	var order []megolmSessionKey
+	for i, evt := range events {
+		content, err := getMegolmContent(evt)
+		if err != nil {
+			results[i].Error = err
+			continue
+		}
+		key := megolmSessionKey{evt.RoomID, content.SenderKey, content.SessionID}
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+
+	devices := &deviceCache{getDevice: mach.GetOrFetchDevice, cache: make(map[deviceCacheKey]deviceCacheEntry)}
+	workers := mach.DecryptionWorkers
+	if workers > len(order) {
+		workers = len(order)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan []int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for indices := range jobs {
+				mach.decryptSessionGroup(ctx, events, indices, results, devices.get)
+			}
+		}()
+	}
+Loop:
+	for _, key := range order {
+		select {
+		case jobs <- groups[key]:
+		case <-ctx.Done():
+			break Loop
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		for i := range results {
+			if results[i].Event == nil && results[i].Error == nil {
+				results[i].Error = err
+			}
+		}
+	}
+	return results
+}
+
+// decryptSessionGroup decrypts the events at the given indices, which must all use the same megolm session.
+func (mach *OlmMachine) decryptSessionGroup(ctx context.Context, events []*event.Event, indices []int, results []DecryptResult, getDevice deviceGetter) {
+	first := events[indices[0]]
+	firstContent := first.Content.AsEncrypted()
+	sess, err := mach.getGroupSessionForEvent(first, firstContent)
+	if err != nil {
+		for n, i := range indices {
+			if n > 0 && errors.Is(err, NoSessionFound) {
+				// getGroupSessionForEvent only queued the first event
+				mach.queueForRetry(events[i], firstContent.SessionID)
+			}
+			results[i].Error = err
+		}
+		return
+	}
+	for _, i := range indices {
+		if ctx.Err() != nil {
+			return
+		}
+		evt := events[i]
+		results[i].Event, results[i].Error = mach.decryptMegolmEventWithSession(evt, evt.Content.AsEncrypted(), sess, getDevice)
+	}
+}
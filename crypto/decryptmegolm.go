@@ -23,6 +23,41 @@ var (
 	DeviceKeyMismatch             = errors.New("device keys in event and verified device info do not match")
 )
 
+// GroupSessionWithheldError is returned by DecryptMegolmEvent if the sender of the event has told us that they won't
+// share the session with us. It unwraps to ErrGroupSessionWithheld.
+type GroupSessionWithheldError struct {
+	Content *event.RoomKeyWithheldEventContent
+}
+
+var withheldCodeDescriptions = map[event.RoomKeyWithheldCode]string{
+	event.RoomKeyWithheldBlacklisted:  "the sender has blocked this device",
+	event.RoomKeyWithheldUnverified:   "the sender doesn't share keys with unverified devices",
+	event.RoomKeyWithheldUnauthorized: "the sender isn't allowed to share the keys with this device",
+	event.RoomKeyWithheldUnavailable:  "the keys are not available on the sender's device",
+	event.RoomKeyWithheldNoOlmSession: "the sender couldn't establish an encrypted channel with this device",
+}
+
+// Description returns a human-readable explanation of why the session was withheld,
+// e.g. "the sender doesn't share keys with unverified devices".
+func (err *GroupSessionWithheldError) Description() string {
+	desc, ok := withheldCodeDescriptions[err.Content.Code]
+	if !ok {
+		desc = "the sender withheld the keys"
+	}
+	return desc
+}
+
+func (err *GroupSessionWithheldError) Error() string {
+	if len(err.Content.Reason) > 0 {
+		return fmt.Sprintf("%v: %s (%s: %s)", ErrGroupSessionWithheld, err.Description(), err.Content.Code, err.Content.Reason)
+	}
+	return fmt.Sprintf("%v: %s (%s)", ErrGroupSessionWithheld, err.Description(), err.Content.Code)
+}
+
+func (err *GroupSessionWithheldError) Unwrap() error {
+	return ErrGroupSessionWithheld
+}
+
 type megolmEvent struct {
 	RoomID  id.RoomID     `json:"room_id"`
 	Type    event.Type    `json:"type"`
@@ -31,19 +66,53 @@ type megolmEvent struct {
 
 // DecryptMegolmEvent decrypts an m.room.encrypted event where the algorithm is m.megolm.v1.aes-sha2
 func (mach *OlmMachine) DecryptMegolmEvent(evt *event.Event) (*event.Event, error) {
+	content, err := getMegolmContent(evt)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := mach.getGroupSessionForEvent(evt, content)
+	if err != nil {
+		return nil, err
+	}
+	return mach.decryptMegolmEventWithSession(evt, content, sess, mach.GetOrFetchDevice)
+}
+
+func getMegolmContent(evt *event.Event) (*event.EncryptedEventContent, error) {
 	content, ok := evt.Content.Parsed.(*event.EncryptedEventContent)
 	if !ok {
 		return nil, IncorrectEncryptedContentType
 	} else if content.Algorithm != id.AlgorithmMegolmV1 {
 		return nil, UnsupportedAlgorithm
 	}
-	sess, err := mach.CryptoStore.GetGroupSession(evt.RoomID, content.SenderKey, content.SessionID)
-	if err != nil {
+	return content, nil
+}
+
+// getGroupSessionForEvent gets the inbound group session for the given event from the crypto store. If the session
+// isn't found, the event is queued for retrying and an error wrapping NoSessionFound is returned.
+func (mach *OlmMachine) getGroupSessionForEvent(evt *event.Event, content *event.EncryptedEventContent) (*InboundGroupSession, error) {
+	sess, err := mach.getGroupSession(evt.RoomID, content.SenderKey, content.SessionID)
+	if errors.Is(err, ErrGroupSessionWithheld) {
+		withheld, withheldErr := mach.CryptoStore.GetWithheldGroupSession(evt.RoomID, content.SenderKey, content.SessionID)
+		if withheldErr != nil {
+			mach.Log.Warn("Failed to get withheld info of group session %s: %v", content.SessionID, withheldErr)
+		} else if withheld != nil {
+			return nil, &GroupSessionWithheldError{Content: withheld}
+		}
+		return nil, err
+	} else if err != nil {
 		return nil, fmt.Errorf("failed to get group session: %w", err)
 	} else if sess == nil {
+		mach.queueForRetry(evt, content.SessionID)
+		mach.restoreRoomKeyFromBackupInBackground(evt.RoomID, content.SessionID)
 		return nil, fmt.Errorf("%w (ID %s)", NoSessionFound, content.SessionID)
 	}
-	plaintext, messageIndex, err := sess.Internal.Decrypt(content.MegolmCiphertext)
+	return sess, nil
+}
+
+type deviceGetter func(userID id.UserID, deviceID id.DeviceID) (*DeviceIdentity, error)
+
+func (mach *OlmMachine) decryptMegolmEventWithSession(evt *event.Event, content *event.EncryptedEventContent, sess *InboundGroupSession, getDevice deviceGetter) (*event.Event, error) {
+	plaintext, messageIndex, err := sess.decrypt(content.MegolmCiphertext)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt megolm event: %w", err)
 	} else if !mach.CryptoStore.ValidateMessageIndex(content.SenderKey, content.SessionID, evt.ID, messageIndex, evt.Timestamp) {
@@ -51,20 +120,32 @@ func (mach *OlmMachine) DecryptMegolmEvent(evt *event.Event) (*event.Event, erro
 	}
 
 	var verified bool
-	ownSigningKey, ownIdentityKey := mach.account.Keys()
+	trust := &event.TrustState{
+		ForwardingChainLength: len(sess.ForwardingChains),
+		KeySource:             sess.KeySource,
+	}
+	ownSigningKey, ownIdentityKey := mach.getAccount().Keys()
 	if content.DeviceID == mach.Client.DeviceID && sess.SigningKey == ownSigningKey && content.SenderKey == ownIdentityKey {
 		verified = true
+		trust.DeviceVerified = true
+		trust.CrossSigned = true
+		trust.UserTrusted = true
 	} else {
-		device, err := mach.GetOrFetchDevice(evt.Sender, content.DeviceID)
+		device, err := getDevice(evt.Sender, content.DeviceID)
 		if err != nil {
 			// We don't want to throw these errors as the message can still be decrypted.
 			mach.Log.Debug("Failed to get device %s/%s to verify session %s: %v", evt.Sender, content.DeviceID, sess.ID(), err)
 			// TODO maybe store the info that the device is deleted?
-		} else if mach.IsDeviceTrusted(device) && len(sess.ForwardingChains) == 0 { // For some reason, matrix-nio had a comment saying not to events decrypted using a forwarded key as verified.
-			if device.SigningKey != sess.SigningKey || device.IdentityKey != content.SenderKey {
-				return nil, DeviceKeyMismatch
+		} else {
+			trust.DeviceVerified = device.Trust == TrustStateVerified
+			trust.UserTrusted = mach.IsUserTrusted(evt.Sender)
+			trust.CrossSigned = mach.isDeviceCrossSigned(device)
+			if mach.IsDeviceTrusted(device) && len(sess.ForwardingChains) == 0 { // For some reason, matrix-nio had a comment saying not to events decrypted using a forwarded key as verified.
+				if device.SigningKey != sess.SigningKey || device.IdentityKey != content.SenderKey {
+					return nil, DeviceKeyMismatch
+				}
+				verified = true
 			}
-			verified = true
 		}
 	}
 
@@ -97,7 +178,18 @@ func (mach *OlmMachine) DecryptMegolmEvent(evt *event.Event) (*event.Event, erro
 		}
 	}
 	megolmEvt.Type.Class = evt.Type.Class
+	var stateKey *string
+	if evt.StateKey != nil {
+		// Encrypted state event (MSC3414): the outer state key contains both the real type and state key.
+		packedType, unpackedStateKey, ok := unpackStateKey(*evt.StateKey)
+		if !ok || packedType != megolmEvt.Type.Type {
+			return nil, ErrInvalidEncryptedStateKey
+		}
+		stateKey = &unpackedStateKey
+		megolmEvt.Type.Class = event.StateEventType
+	}
 	return &event.Event{
+		StateKey:  stateKey,
 		Sender:    evt.Sender,
 		Type:      megolmEvt.Type,
 		Timestamp: evt.Timestamp,
@@ -106,7 +198,8 @@ func (mach *OlmMachine) DecryptMegolmEvent(evt *event.Event) (*event.Event, erro
 		Content:   megolmEvt.Content,
 		Unsigned:  evt.Unsigned,
 		Mautrix: event.MautrixInfo{
-			Verified: verified,
+			Verified:   verified,
+			TrustState: trust,
 		},
 	}, nil
 }
@@ -7,6 +7,7 @@
 package crypto
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -50,7 +51,7 @@ func (mach *OlmMachine) decryptOlmEvent(evt *event.Event, traceID string) (*Decr
 	} else if content.Algorithm != id.AlgorithmOlmV1 {
 		return nil, UnsupportedAlgorithm
 	}
-	ownContent, ok := content.OlmCiphertext[mach.account.IdentityKey()]
+	ownContent, ok := content.OlmCiphertext[mach.getAccount().IdentityKey()]
 	if !ok {
 		return nil, NotEncryptedForMe
 	}
@@ -89,7 +90,7 @@ func (mach *OlmMachine) decryptAndParseOlmCiphertext(sender id.UserID, senderKey
 		return nil, SenderMismatch
 	} else if mach.Client.UserID != olmEvt.Recipient {
 		return nil, RecipientMismatch
-	} else if mach.account.SigningKey() != olmEvt.RecipientKeys.Ed25519 {
+	} else if mach.getAccount().SigningKey() != olmEvt.RecipientKeys.Ed25519 {
 		return nil, RecipientKeyMismatch
 	}
 
@@ -201,7 +202,12 @@ func (mach *OlmMachine) tryDecryptOlmCiphertextWithExistingSession(senderKey id.
 }
 
 func (mach *OlmMachine) createInboundSession(senderKey id.SenderKey, ciphertext string) (*OlmSession, error) {
-	session, err := mach.account.NewInboundSessionFrom(senderKey, ciphertext)
+	unlock, err := mach.lockAccount(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	session, err := mach.getAccount().NewInboundSessionFrom(senderKey, ciphertext)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,95 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// maxQueuedEventsPerSession is the maximum number of events queued for retrying per megolm session.
+	maxQueuedEventsPerSession = 100
+	// maxQueuedEventAge is how long events stay in the retry queue if the session never arrives.
+	maxQueuedEventAge = 24 * time.Hour
+)
+
+type queuedEvent struct {
+	evt      *event.Event
+	queuedAt time.Time
+}
+
+// queueForRetry adds an event that couldn't be decrypted due to a missing session to the retry queue.
+// Nothing is queued if OnRetriedDecryption isn't set.
+func (mach *OlmMachine) queueForRetry(evt *event.Event, sessionID id.SessionID) {
+	if mach.OnRetriedDecryption == nil {
+		return
+	}
+	mach.retryQueueLock.Lock()
+	defer mach.retryQueueLock.Unlock()
+	mach.pruneRetryQueue()
+	queue := mach.retryQueue[sessionID]
+	for _, queued := range queue {
+		if queued.evt.ID == evt.ID {
+			return
+		}
+	}
+	if len(queue) >= maxQueuedEventsPerSession {
+		mach.Log.Debug("Dropping oldest event %s from retry queue of %s", queue[0].evt.ID, sessionID)
+		queue = queue[1:]
+	}
+	mach.retryQueue[sessionID] = append(queue, queuedEvent{evt: evt, queuedAt: time.Now()})
+	mach.Log.Trace("Queued %s for retrying decryption once session %s arrives", evt.ID, sessionID)
+}
+
+func (mach *OlmMachine) pruneRetryQueue() {
+	cutoff := time.Now().Add(-maxQueuedEventAge)
+	for sessionID, queue := range mach.retryQueue {
+		i := 0
+		for i < len(queue) && queue[i].queuedAt.Before(cutoff) {
+			i++
+		}
+		if i == len(queue) {
+			delete(mach.retryQueue, sessionID)
+		} else if i > 0 {
+			mach.retryQueue[sessionID] = queue[i:]
+		}
+	}
+}
+
+// retryQueuedEvents tries to decrypt all the events waiting for the given session
+// and passes the successfully decrypted ones to OnRetriedDecryption.
+func (mach *OlmMachine) retryQueuedEvents(sessionID id.SessionID) {
+	mach.retryQueueLock.Lock()
+	queue, ok := mach.retryQueue[sessionID]
+	delete(mach.retryQueue, sessionID)
+	mach.retryQueueLock.Unlock()
+	if !ok {
+		return
+	}
+	mach.Log.Debug("Retrying decryption of %d events after receiving session %s", len(queue), sessionID)
+	for _, queued := range queue {
+		decrypted, err := mach.DecryptMegolmEvent(queued.evt)
+		if err != nil {
+			mach.Log.Warn("Failed to decrypt %s after receiving session %s: %v", queued.evt.ID, sessionID, err)
+		} else if callback := mach.OnRetriedDecryption; callback != nil {
+			callback(queued.evt, decrypted)
+		}
+	}
+}
+
+// RetryQueueLength returns the number of events waiting for their megolm session to arrive.
+func (mach *OlmMachine) RetryQueueLength() (count int) {
+	mach.retryQueueLock.Lock()
+	for _, queue := range mach.retryQueue {
+		count += len(queue)
+	}
+	mach.retryQueueLock.Unlock()
+	return
+}
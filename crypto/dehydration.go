@@ -0,0 +1,257 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// DehydrationAlgorithmOlmV1 is the dehydrated device algorithm where the device data contains a pickled olm account.
+const DehydrationAlgorithmOlmV1 = "org.matrix.msc3814.v1.olm"
+
+var (
+	ErrNoDehydratedDevice              = errors.New("no dehydrated device found on server")
+	ErrUnsupportedDehydrationAlgorithm = errors.New("unsupported dehydrated device algorithm")
+)
+
+// accountKeyProvider is a KeyProvider that only supports signing with the device key of a standalone olm account.
+type accountKeyProvider struct {
+	account *OlmAccount
+}
+
+var _ KeyProvider = (*accountKeyProvider)(nil)
+
+func (akp *accountKeyProvider) PublicKey(usage KeyUsage) (id.Ed25519, error) {
+	if usage != KeyUsageDevice {
+		return "", fmt.Errorf("unsupported key usage %q for dehydrated device", usage)
+	}
+	return akp.account.SigningKey(), nil
+}
+
+func (akp *accountKeyProvider) SignJSON(usage KeyUsage, obj interface{}) (string, error) {
+	if usage != KeyUsageDevice {
+		return "", fmt.Errorf("unsupported key usage %q for dehydrated device", usage)
+	}
+	return akp.account.Internal.SignJSON(obj)
+}
+
+func generateDehydratedDeviceID() (id.DeviceID, error) {
+	data := make([]byte, 10)
+	_, err := utils.ReadRandom(data)
+	if err != nil {
+		return "", err
+	}
+	return id.DeviceID(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(data)), nil
+}
+
+// CreateDehydratedDevice creates a new dehydrated device (MSC3814) and uploads it to the server, replacing any
+// previous dehydrated device. Other devices will encrypt messages for the dehydrated device like for any other
+// device, which means the messages can be decrypted with RehydrateDevice even if the user had no active devices
+// when they were sent.
+//
+// The olm account of the device is pickled with the given key, so the same key must be passed to RehydrateDevice.
+// If the self-signing key is available, the device is also cross-signed so that other users will trust it.
+func (mach *OlmMachine) CreateDehydratedDevice(pickleKey []byte, displayName string) (id.DeviceID, error) {
+	if len(pickleKey) == 0 {
+		return "", olm.NoKeyProvided
+	}
+	deviceID, err := generateDehydratedDeviceID()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate device ID: %w", err)
+	}
+	account := NewOlmAccount()
+	signer := &accountKeyProvider{account}
+	userID := mach.Client.UserID
+	deviceKeys := account.getInitialKeys(userID, deviceID, signer)
+	if selfSigningKey, err := mach.KeyProvider.PublicKey(KeyUsageSelfSigning); err == nil {
+		signature, err := mach.KeyProvider.SignJSON(KeyUsageSelfSigning, deviceKeys)
+		if err != nil {
+			return "", fmt.Errorf("failed to sign dehydrated device with self-signing key: %w", err)
+		}
+		deviceKeys.Signatures[userID][id.NewKeyID(id.KeyAlgorithmEd25519, selfSigningKey.String())] = signature
+	} else {
+		mach.Log.Debug("Not cross-signing dehydrated device %s: %v", deviceID, err)
+	}
+	// A fallback key is especially important for dehydrated devices, as they can't upload more one-time keys.
+	fallbackKeys := account.getFallbackKeys(userID, deviceID, true, signer)
+	oneTimeKeys := account.getOneTimeKeys(userID, deviceID, 0, signer)
+
+	resp, err := mach.Client.PutDehydratedDevice(&mautrix.ReqPutDehydratedDevice{
+		DeviceID: deviceID,
+		DeviceData: mautrix.DehydratedDeviceData{
+			Algorithm:    DehydrationAlgorithmOlmV1,
+			DevicePickle: string(account.Internal.Pickle(pickleKey)),
+		},
+		InitialDisplayName: displayName,
+		DeviceKeys:         deviceKeys,
+		OneTimeKeys:        oneTimeKeys,
+		FallbackKeys:       fallbackKeys,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload dehydrated device: %w", err)
+	} else if len(resp.DeviceID) > 0 && resp.DeviceID != deviceID {
+		mach.Log.Warn("Server returned unexpected device ID %s for dehydrated device %s", resp.DeviceID, deviceID)
+		deviceID = resp.DeviceID
+	}
+	mach.Log.Debug("Created dehydrated device %s with %d one-time keys", deviceID, len(oneTimeKeys))
+	return deviceID, nil
+}
+
+// RehydrateDevice fetches the current dehydrated device from the server, decrypts all the to-device events sent to
+// it using the given pickle key and imports the room keys from them into the crypto store of this machine.
+//
+// After the events have been processed, the dehydrated device is deleted from the server, so that no more messages
+// are encrypted for it. A new dehydrated device should be created with CreateDehydratedDevice afterwards if the
+// user may go offline again.
+//
+// Returns the number of room keys that were imported, or ErrNoDehydratedDevice if the user has no dehydrated device.
+func (mach *OlmMachine) RehydrateDevice(pickleKey []byte) (int, error) {
+	device, err := mach.Client.GetDehydratedDevice()
+	if errors.Is(err, mautrix.MNotFound) {
+		return 0, ErrNoDehydratedDevice
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to get dehydrated device: %w", err)
+	} else if device.DeviceData.Algorithm != DehydrationAlgorithmOlmV1 {
+		return 0, fmt.Errorf("%w %s", ErrUnsupportedDehydrationAlgorithm, device.DeviceData.Algorithm)
+	}
+	internal, err := olm.AccountFromPickled([]byte(device.DeviceData.DevicePickle), pickleKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to unpickle dehydrated device: %w", err)
+	}
+	rehydrated := &rehydratedDevice{
+		mach:     mach,
+		deviceID: device.DeviceID,
+		account:  &OlmAccount{Internal: *internal},
+		sessions: make(map[id.SenderKey][]*OlmSession),
+	}
+	mach.Log.Debug("Rehydrating device %s", device.DeviceID)
+
+	var nextBatch string
+	for {
+		resp, err := mach.Client.GetDehydratedDeviceEvents(device.DeviceID, nextBatch)
+		if err != nil {
+			return rehydrated.roomKeys, fmt.Errorf("failed to get events of dehydrated device: %w", err)
+		} else if len(resp.Events) == 0 {
+			break
+		}
+		for _, evt := range resp.Events {
+			rehydrated.handleToDeviceEvent(evt)
+		}
+		nextBatch = resp.NextBatch
+	}
+
+	err = mach.Client.DeleteDehydratedDevice()
+	if err != nil {
+		return rehydrated.roomKeys, fmt.Errorf("failed to delete dehydrated device: %w", err)
+	}
+	mach.Log.Debug("Imported %d room keys from dehydrated device %s", rehydrated.roomKeys, device.DeviceID)
+	return rehydrated.roomKeys, nil
+}
+
+// rehydratedDevice holds the state needed to decrypt the to-device events of a dehydrated device. The olm sessions
+// are only kept in memory, as the dehydrated device is discarded after the events are processed.
+type rehydratedDevice struct {
+	mach     *OlmMachine
+	deviceID id.DeviceID
+	account  *OlmAccount
+	sessions map[id.SenderKey][]*OlmSession
+	roomKeys int
+}
+
+func (rd *rehydratedDevice) handleToDeviceEvent(evt *event.Event) {
+	evt.Type.Class = event.ToDeviceEventType
+	err := evt.Content.ParseRaw(evt.Type)
+	if err != nil && !event.IsUnsupportedContentType(err) {
+		rd.mach.Log.Warn("Failed to parse %s event from %s sent to dehydrated device: %v", evt.Type.Type, evt.Sender, err)
+		return
+	}
+	switch content := evt.Content.Parsed.(type) {
+	case *event.EncryptedEventContent:
+		decrypted, err := rd.decryptOlmEvent(evt.Sender, content)
+		if err != nil {
+			rd.mach.Log.Warn("Failed to decrypt to-device event from %s/%s sent to dehydrated device: %v", evt.Sender, content.SenderKey, err)
+			return
+		}
+		decrypted.Source = evt
+		if roomKey, ok := decrypted.Content.Parsed.(*event.RoomKeyEventContent); ok {
+			rd.mach.receiveRoomKey(decrypted, roomKey, "rehydrate")
+			rd.roomKeys++
+		} else {
+			rd.mach.Log.Trace("Ignoring %s event from %s sent to dehydrated device", decrypted.Type.Type, decrypted.Sender)
+		}
+	case *event.RoomKeyWithheldEventContent:
+		rd.mach.handleRoomKeyWithheld(content)
+	default:
+		rd.mach.Log.Trace("Ignoring %s event from %s sent to dehydrated device", evt.Type.Type, evt.Sender)
+	}
+}
+
+func (rd *rehydratedDevice) decryptOlmEvent(sender id.UserID, content *event.EncryptedEventContent) (*DecryptedOlmEvent, error) {
+	if content.Algorithm != id.AlgorithmOlmV1 {
+		return nil, UnsupportedAlgorithm
+	}
+	ownContent, ok := content.OlmCiphertext[rd.account.IdentityKey()]
+	if !ok {
+		return nil, NotEncryptedForMe
+	} else if ownContent.Type != id.OlmMsgTypePreKey {
+		// The dehydrated device never sends any messages, so everything sent to it must be a prekey message.
+		return nil, UnsupportedOlmMessageType
+	}
+	plaintext, err := rd.decryptPreKeyMessage(content.SenderKey, ownContent.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var olmEvt DecryptedOlmEvent
+	err = json.Unmarshal(plaintext, &olmEvt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse olm payload: %w", err)
+	}
+	if sender != olmEvt.Sender {
+		return nil, SenderMismatch
+	} else if rd.mach.Client.UserID != olmEvt.Recipient {
+		return nil, RecipientMismatch
+	} else if rd.account.SigningKey() != olmEvt.RecipientKeys.Ed25519 {
+		return nil, RecipientKeyMismatch
+	}
+	err = olmEvt.Content.ParseRaw(olmEvt.Type)
+	if err != nil && !event.IsUnsupportedContentType(err) {
+		return nil, fmt.Errorf("failed to parse content of olm payload event: %w", err)
+	}
+	olmEvt.SenderKey = content.SenderKey
+	return &olmEvt, nil
+}
+
+func (rd *rehydratedDevice) decryptPreKeyMessage(senderKey id.SenderKey, ciphertext string) ([]byte, error) {
+	for _, session := range rd.sessions[senderKey] {
+		matches, err := session.Internal.MatchesInboundSessionFrom(string(senderKey), ciphertext)
+		if err != nil {
+			return nil, err
+		} else if matches {
+			plaintext, err := session.Decrypt(ciphertext, id.OlmMsgTypePreKey)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", DecryptionFailedWithMatchingSession, err)
+			}
+			return plaintext, nil
+		}
+	}
+	session, err := rd.account.NewInboundSessionFrom(senderKey, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inbound session: %w", err)
+	}
+	rd.sessions[senderKey] = append(rd.sessions[senderKey], session)
+	return session.Decrypt(ciphertext, id.OlmMsgTypePreKey)
+}
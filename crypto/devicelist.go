@@ -28,7 +28,17 @@ func (mach *OlmMachine) LoadDevices(user id.UserID) map[id.DeviceID]*DeviceIdent
 	return mach.fetchKeys([]id.UserID{user}, "", true)[user]
 }
 
-func (mach *OlmMachine) fetchKeys(users []id.UserID, sinceToken string, includeUntracked bool) (data map[id.UserID]map[id.DeviceID]*DeviceIdentity) {
+func (mach *OlmMachine) fetchKeys(users []id.UserID, sinceToken string, includeUntracked bool) map[id.UserID]map[id.DeviceID]*DeviceIdentity {
+	data, err := mach.queryKeys(users, sinceToken, includeUntracked)
+	if err != nil {
+		mach.Log.Warn("%v", err)
+	}
+	return data
+}
+
+// queryKeys fetches the device lists of the given users from the server and stores them in the crypto store.
+// An error is only returned if the whole request failed.
+func (mach *OlmMachine) queryKeys(users []id.UserID, sinceToken string, includeUntracked bool) (data map[id.UserID]map[id.DeviceID]*DeviceIdentity, err error) {
 	req := &mautrix.ReqQueryKeys{
 		DeviceKeys: mautrix.DeviceKeysRequest{},
 		Timeout:    10 * 1000,
@@ -46,7 +56,7 @@ func (mach *OlmMachine) fetchKeys(users []id.UserID, sinceToken string, includeU
 	mach.Log.Trace("Querying keys for %v", users)
 	resp, err := mach.Client.QueryKeys(req)
 	if err != nil {
-		mach.Log.Warn("Failed to query keys: %v", err)
+		err = fmt.Errorf("failed to query keys: %w", err)
 		return
 	}
 	for server, err := range resp.Failures {
@@ -59,6 +69,7 @@ func (mach *OlmMachine) fetchKeys(users []id.UserID, sinceToken string, includeU
 
 		newDevices := make(map[id.DeviceID]*DeviceIdentity)
 		existingDevices, err := mach.CryptoStore.GetDevices(userID)
+		firstFetch := existingDevices == nil && err == nil
 		if err != nil {
 			mach.Log.Warn("Failed to get existing devices for %s: %v", userID, err)
 			existingDevices = make(map[id.DeviceID]*DeviceIdentity)
@@ -106,6 +117,14 @@ func (mach *OlmMachine) fetchKeys(users []id.UserID, sinceToken string, includeU
 				}
 			}
 		}
+		if firstFetch && len(newDevices) > 0 && mach.GetUserTrustSettings(userID).TrustOnFirstUse {
+			mach.Log.Debug("Trusting %d devices of %s on first use", len(newDevices), userID)
+			for _, device := range newDevices {
+				if device.Trust == TrustStateUnset {
+					device.Trust = TrustStateVerified
+				}
+			}
+		}
 		mach.Log.Trace("Storing new device list for %s containing %d devices", userID, len(newDevices))
 		err = mach.CryptoStore.PutDevices(userID, newDevices)
 		if err != nil {
@@ -113,9 +132,17 @@ func (mach *OlmMachine) fetchKeys(users []id.UserID, sinceToken string, includeU
 		}
 		data[userID] = newDevices
 
-		changed = changed || len(newDevices) != len(existingDevices)
-		if changed {
+		removed := false
+		for deviceID := range existingDevices {
+			if _, ok := newDevices[deviceID]; !ok {
+				removed = true
+				break
+			}
+		}
+		if removed {
 			mach.OnDevicesChanged(userID)
+		} else if changed {
+			mach.onDevicesAdded(userID)
 		}
 	}
 	for userID := range req.DeviceKeys {
@@ -126,7 +153,7 @@ func (mach *OlmMachine) fetchKeys(users []id.UserID, sinceToken string, includeU
 	mach.storeCrossSigningKeys(resp.SelfSigningKeys, resp.DeviceKeys)
 	mach.storeCrossSigningKeys(resp.UserSigningKeys, resp.DeviceKeys)
 
-	return data
+	return data, nil
 }
 
 // OnDevicesChanged finds all shared rooms with the given user and invalidates outbound sessions in those rooms.
@@ -143,6 +170,19 @@ func (mach *OlmMachine) OnDevicesChanged(userID id.UserID) {
 	}
 }
 
+// onDevicesAdded marks outbound sessions in all rooms shared with the given user as not shared, so that they're
+// shared with the new devices before the next message is sent. If the room's rotation policy has RotateOnNewDevice
+// set, the sessions are discarded instead like in OnDevicesChanged.
+func (mach *OlmMachine) onDevicesAdded(userID id.UserID) {
+	for _, roomID := range mach.StateStore.FindSharedRooms(userID) {
+		mach.Log.Debug("%s has new devices, invalidating group session for %s", userID, roomID)
+		err := mach.invalidateGroupSession(roomID, mach.GetRotationPolicy(roomID).RotateOnNewDevice)
+		if err != nil {
+			mach.Log.Warn("Failed to invalidate outbound group session of %s on new device for %s: %v", roomID, userID, err)
+		}
+	}
+}
+
 func (mach *OlmMachine) validateDevice(userID id.UserID, deviceID id.DeviceID, deviceKeys mautrix.DeviceKeys, existing *DeviceIdentity) (*DeviceIdentity, error) {
 	if deviceID != deviceKeys.DeviceID {
 		return nil, MismatchingDeviceID
@@ -174,12 +214,18 @@ func (mach *OlmMachine) validateDevice(userID id.UserID, deviceID id.DeviceID, d
 		name = string(deviceID)
 	}
 
+	trust := TrustStateUnset
+	if existing != nil {
+		// Keep manually set trust states (e.g. blacklisting) when the device list is refreshed
+		trust = existing.Trust
+	}
+
 	return &DeviceIdentity{
 		UserID:      userID,
 		DeviceID:    deviceID,
 		IdentityKey: identityKey,
 		SigningKey:  signingKey,
-		Trust:       TrustStateUnset,
+		Trust:       trust,
 		Name:        name,
 		Deleted:     false,
 	}, nil
@@ -0,0 +1,151 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	deviceListMinBackoff = 5 * time.Second
+	deviceListMaxBackoff = 5 * time.Minute
+)
+
+// HandleDeviceLists marks the device lists of the users in the changed list as outdated and then re-fetches all
+// outdated device lists in a single /keys/query request. The outdated flags are persisted in the crypto store, so
+// device lists that couldn't be fetched will be fetched later even if the process is restarted in between.
+//
+// If the request fails, further automatic attempts are delayed with exponential backoff. Explicit calls to
+// WaitForDeviceList and sharing group sessions ignore the backoff.
+func (mach *OlmMachine) HandleDeviceLists(dl *mautrix.DeviceLists, since string) {
+	if len(dl.Changed) > 0 {
+		mach.Log.Trace("Device list changes in /sync: %v", dl.Changed)
+		err := mach.CryptoStore.MarkTrackedUsersOutdated(dl.Changed)
+		if err != nil {
+			mach.Log.Warn("Failed to mark device lists as outdated, fetching them directly: %v", err)
+			mach.fetchKeys(dl.Changed, since, false)
+		}
+	}
+	err := mach.resyncOutdatedDeviceLists(false)
+	if err != nil {
+		mach.Log.Warn("Failed to update outdated device lists: %v", err)
+	}
+}
+
+// resyncOutdatedDeviceLists fetches the device lists of all users that have been marked as outdated. If force is
+// false, nothing is done while the backoff after a previous failure hasn't passed.
+func (mach *OlmMachine) resyncOutdatedDeviceLists(force bool) error {
+	mach.deviceListLock.Lock()
+	defer mach.deviceListLock.Unlock()
+	return mach.resyncOutdatedDeviceListsLocked(force, nil)
+}
+
+func (mach *OlmMachine) resyncOutdatedDeviceListsLocked(force bool, extraUsers []id.UserID) error {
+	if !force && time.Now().Before(mach.deviceListRetryAt) {
+		return nil
+	}
+	users, err := mach.CryptoStore.GetOutdatedTrackedUsers()
+	if err != nil {
+		return fmt.Errorf("failed to get outdated users: %w", err)
+	}
+	users = append(users, extraUsers...)
+	if len(users) == 0 {
+		return nil
+	}
+	mach.Log.Debug("Updating device lists of %d outdated users", len(users))
+	_, err = mach.queryKeys(users, "", true)
+	if err != nil {
+		mach.deviceListBackoff *= 2
+		if mach.deviceListBackoff < deviceListMinBackoff {
+			mach.deviceListBackoff = deviceListMinBackoff
+		} else if mach.deviceListBackoff > deviceListMaxBackoff {
+			mach.deviceListBackoff = deviceListMaxBackoff
+		}
+		mach.deviceListRetryAt = time.Now().Add(mach.deviceListBackoff)
+		return err
+	}
+	mach.deviceListBackoff = 0
+	mach.deviceListRetryAt = time.Time{}
+	return nil
+}
+
+func (mach *OlmMachine) getOutdatedUsers(users []id.UserID) (map[id.UserID]bool, error) {
+	outdatedUsers, err := mach.CryptoStore.GetOutdatedTrackedUsers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get outdated users: %w", err)
+	}
+	outdatedMap := make(map[id.UserID]bool, len(outdatedUsers))
+	for _, userID := range outdatedUsers {
+		outdatedMap[userID] = true
+	}
+	result := make(map[id.UserID]bool)
+	for _, userID := range users {
+		if outdatedMap[userID] {
+			result[userID] = true
+		}
+	}
+	return result, nil
+}
+
+// updateOutdatedDeviceLists fetches the device lists of all outdated users if any of the given users are outdated.
+func (mach *OlmMachine) updateOutdatedDeviceLists(users []id.UserID) error {
+	outdated, err := mach.getOutdatedUsers(users)
+	if err != nil || len(outdated) == 0 {
+		return err
+	}
+	return mach.resyncOutdatedDeviceLists(true)
+}
+
+// WaitForDeviceList returns an up-to-date device list of the given user. If the device list hasn't been fetched
+// yet or it has been marked as outdated, it's fetched from the server first (along with any other outdated device
+// lists). If another goroutine is already fetching device lists, this waits for it to finish before checking again.
+func (mach *OlmMachine) WaitForDeviceList(userID id.UserID) (map[id.DeviceID]*DeviceIdentity, error) {
+	isUpToDate := func() (map[id.DeviceID]*DeviceIdentity, bool, error) {
+		devices, err := mach.CryptoStore.GetDevices(userID)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to get devices from store: %w", err)
+		} else if devices == nil {
+			return nil, false, nil
+		}
+		outdated, err := mach.getOutdatedUsers([]id.UserID{userID})
+		if err != nil {
+			return nil, false, err
+		}
+		return devices, !outdated[userID], nil
+	}
+	devices, ok, err := isUpToDate()
+	if err != nil || ok {
+		return devices, err
+	}
+	mach.deviceListLock.Lock()
+	defer mach.deviceListLock.Unlock()
+	// Check again in case another goroutine fetched the device list while we were waiting for the lock.
+	devices, ok, err = isUpToDate()
+	if err != nil || ok {
+		return devices, err
+	}
+	var extraUsers []id.UserID
+	if devices == nil {
+		// Untracked users aren't included in the outdated list, so they have to be added separately.
+		extraUsers = []id.UserID{userID}
+	}
+	err = mach.resyncOutdatedDeviceListsLocked(true, extraUsers)
+	if err != nil {
+		return nil, err
+	}
+	devices, ok, err = isUpToDate()
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("server didn't return device list of %s", userID)
+	}
+	return devices, nil
+}
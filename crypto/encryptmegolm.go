@@ -10,6 +10,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
@@ -17,8 +18,9 @@ import (
 )
 
 var (
-	AlreadyShared  = errors.New("group session already shared")
-	NoGroupSession = errors.New("no group session created")
+	AlreadyShared     = errors.New("group session already shared")
+	NoGroupSession    = errors.New("no group session created")
+	NoRoomMemberStore = errors.New("state store doesn't implement RoomMemberStateStore")
 )
 
 func getRelatesTo(content interface{}) *event.RelatesTo {
@@ -74,7 +76,7 @@ func (mach *OlmMachine) EncryptMegolmEvent(roomID id.RoomID, evtType event.Type,
 	}
 	return &event.EncryptedEventContent{
 		Algorithm:        id.AlgorithmMegolmV1,
-		SenderKey:        mach.account.IdentityKey(),
+		SenderKey:        mach.getAccount().IdentityKey(),
 		DeviceID:         mach.Client.DeviceID,
 		SessionID:        session.ID(),
 		MegolmCiphertext: ciphertext,
@@ -82,9 +84,62 @@ func (mach *OlmMachine) EncryptMegolmEvent(roomID id.RoomID, evtType event.Type,
 	}, nil
 }
 
+// EncryptMegolmEventAutoShare encrypts data like EncryptMegolmEvent, but first shares the outbound group session with
+// the members of the room if needed. This is the case if there's no session yet, if the session has expired, or if
+// the session was invalidated by a membership change or a new device (see RotationPolicy). Unlike with a new
+// session, re-sharing an existing session only sends it to the devices that didn't have it yet.
+//
+// The room members are fetched from the state store, which must implement RoomMemberStateStore.
+func (mach *OlmMachine) EncryptMegolmEventAutoShare(roomID id.RoomID, evtType event.Type, content interface{}) (*event.EncryptedEventContent, error) {
+	err := mach.ensureGroupSessionShared(roomID)
+	if err != nil {
+		return nil, err
+	}
+	return mach.EncryptMegolmEvent(roomID, evtType, content)
+}
+
+func (mach *OlmMachine) getAutoShareLock(roomID id.RoomID) *sync.Mutex {
+	mach.autoShareLocksLock.Lock()
+	defer mach.autoShareLocksLock.Unlock()
+	lock, ok := mach.autoShareLocks[roomID]
+	if !ok {
+		lock = &sync.Mutex{}
+		mach.autoShareLocks[roomID] = lock
+	}
+	return lock
+}
+
+func (mach *OlmMachine) ensureGroupSessionShared(roomID id.RoomID) error {
+	// Lock the room to avoid creating and sharing multiple sessions if several events are sent at the same time.
+	lock := mach.getAutoShareLock(roomID)
+	lock.Lock()
+	defer lock.Unlock()
+	session, err := mach.CryptoStore.GetOutboundGroupSession(roomID)
+	if err != nil {
+		return fmt.Errorf("failed to get outbound group session: %w", err)
+	} else if session != nil && session.Shared && !session.Expired() {
+		return nil
+	}
+	memberStore, ok := mach.StateStore.(RoomMemberStateStore)
+	if !ok {
+		return NoRoomMemberStore
+	}
+	users, err := memberStore.GetRoomJoinedOrInvitedMembers(roomID)
+	if err != nil {
+		return fmt.Errorf("failed to get room members: %w", err)
+	}
+	mach.Log.Debug("Automatically sharing group session for %s before encrypting", roomID)
+	err = mach.ShareGroupSession(roomID, users)
+	if err != nil && !errors.Is(err, AlreadyShared) {
+		return fmt.Errorf("failed to share group session: %w", err)
+	}
+	return nil
+}
+
 func (mach *OlmMachine) newOutboundGroupSession(roomID id.RoomID) *OutboundGroupSession {
-	session := NewOutboundGroupSession(roomID, mach.StateStore.GetEncryptionEvent(roomID))
-	signingKey, idKey := mach.account.Keys()
+	session := NewOutboundGroupSession(roomID, nil)
+	mach.GetRotationPolicy(roomID).Apply(session)
+	signingKey, idKey := mach.getAccount().Keys()
 	mach.createGroupSession(idKey, signingKey, roomID, session.ID(), session.Internal.Key(), "create")
 	return session
 }
@@ -94,11 +149,60 @@ type deviceSessionWrapper struct {
 	identity *DeviceIdentity
 }
 
+// ShareProgress describes how far sharing a group session has progressed. See ShareGroupSessionWithProgress.
+type ShareProgress struct {
+	// The number of devices for which one-time keys were claimed to create new olm sessions.
+	DevicesClaimed int
+	// The number of new olm sessions that were created.
+	SessionsCreated int
+	// The number of to-device batches that were sent successfully and the total number of batches.
+	BatchesSent  int
+	TotalBatches int
+	// The devices that the room key couldn't be sent to, because their to-device batch failed.
+	Failed []UserDevice
+	// Whether sharing has finished. The callback is always called with Done set exactly once.
+	Done bool
+}
+
+// ShareProgressCallback is called by ShareGroupSessionWithProgress whenever sharing progresses.
+type ShareProgressCallback func(progress ShareProgress)
+
+type shareProgressReporter struct {
+	callback ShareProgressCallback
+	progress ShareProgress
+}
+
+func (spr *shareProgressReporter) report() {
+	if spr.callback != nil {
+		progress := spr.progress
+		progress.Failed = append([]UserDevice(nil), spr.progress.Failed...)
+		spr.callback(progress)
+	}
+}
+
 // ShareGroupSession shares a group session for a specific room with all the devices of the given user list.
 //
 // For devices with TrustStateBlacklisted, a m.room_key.withheld event with code=m.blacklisted is sent.
-// If AllowUnverifiedDevices is false, a similar event with code=m.unverified is sent to devices with TrustStateUnset
+// If unverified devices aren't allowed (see AllowUnverifiedDevices and SetUserTrustSettings), a similar event with
+// code=m.unverified is sent to devices with TrustStateUnset
 func (mach *OlmMachine) ShareGroupSession(roomID id.RoomID, users []id.UserID) error {
+	return mach.ShareGroupSessionWithProgress(roomID, users, nil)
+}
+
+// ShareGroupSessionWithProgress shares a group session like ShareGroupSession, but calls the given callback as
+// one-time keys are claimed and to-device batches are sent, which is useful for displaying progress in large rooms.
+//
+// If some to-device batches fail, the remaining batches are still sent and an error is returned after the session is
+// stored. The devices in ShareProgress.Failed are left as not shared in the session, so calling this again for the
+// same room only sends the room key to the devices that didn't get it. Stores that don't keep the per-device sharing
+// state (like SQLCryptoStore) will send it to all devices of the given users again, so the retry should then only
+// include the users in ShareProgress.Failed.
+func (mach *OlmMachine) ShareGroupSessionWithProgress(roomID id.RoomID, users []id.UserID, callback ShareProgressCallback) error {
+	progress := &shareProgressReporter{callback: callback}
+	defer func() {
+		progress.progress.Done = true
+		progress.report()
+	}()
 	mach.Log.Debug("Sharing group session for room %s to %v", roomID, users)
 	session, err := mach.CryptoStore.GetOutboundGroupSession(roomID)
 	if err != nil {
@@ -106,6 +210,10 @@ func (mach *OlmMachine) ShareGroupSession(roomID id.RoomID, users []id.UserID) e
 	} else if session != nil && session.Shared && !session.Expired() {
 		return AlreadyShared
 	}
+	err = mach.updateOutdatedDeviceLists(users)
+	if err != nil {
+		return fmt.Errorf("failed to update outdated device lists: %w", err)
+	}
 	if session == nil || session.Expired() {
 		session = mach.newOutboundGroupSession(roomID)
 	}
@@ -153,10 +261,11 @@ func (mach *OlmMachine) ShareGroupSession(roomID id.RoomID, users []id.UserID) e
 
 	if len(missingSessions) > 0 {
 		mach.Log.Trace("Creating missing outbound sessions")
-		err = mach.createOutboundSessions(missingSessions)
+		progress.progress.DevicesClaimed, progress.progress.SessionsCreated, err = mach.createOutboundSessions(missingSessions)
 		if err != nil {
 			mach.Log.Error("Failed to create missing outbound sessions: %v", err)
 		}
+		progress.report()
 	}
 
 	for userID, devices := range missingSessions {
@@ -183,56 +292,75 @@ func (mach *OlmMachine) ShareGroupSession(roomID id.RoomID, users []id.UserID) e
 		}
 	}
 
-	err = mach.encryptAndSendGroupSession(session, olmSessions)
-	if err != nil {
-		return fmt.Errorf("failed to share group session: %w", err)
-	}
+	shareErr := mach.encryptAndSendGroupSession(session, olmSessions, progress)
 
 	if len(toDeviceWithheld.Messages) > 0 {
 		mach.Log.Trace("Sending to-device messages to %d devices of %d users to report withheld keys in %s", withheldCount, len(toDeviceWithheld.Messages), roomID)
 		// TODO remove the next 4 lines once clients support m.room_key.withheld
-		_, err = mach.Client.SendToDevice(event.ToDeviceOrgMatrixRoomKeyWithheld, toDeviceWithheld)
+		err = mach.sendToDeviceBatched(event.ToDeviceOrgMatrixRoomKeyWithheld, toDeviceWithheld)
 		if err != nil {
 			mach.Log.Warn("Failed to report withheld keys in %s (legacy event type): %v", roomID, err)
 		}
-		_, err = mach.Client.SendToDevice(event.ToDeviceRoomKeyWithheld, toDeviceWithheld)
+		err = mach.sendToDeviceBatched(event.ToDeviceRoomKeyWithheld, toDeviceWithheld)
 		if err != nil {
 			mach.Log.Warn("Failed to report withheld keys in %s: %v", roomID, err)
 		}
 	}
 
+	if shareErr != nil {
+		err = mach.CryptoStore.AddOutboundGroupSession(session)
+		if err != nil {
+			mach.Log.Warn("Failed to store partially shared group session %s: %v", session.ID(), err)
+		}
+		return fmt.Errorf("failed to share group session with %d devices: %w", len(progress.progress.Failed), shareErr)
+	}
 	mach.Log.Debug("Group session %s for %s successfully shared", session.ID(), roomID)
 	session.Shared = true
 	return mach.CryptoStore.AddOutboundGroupSession(session)
 }
 
-func (mach *OlmMachine) encryptAndSendGroupSession(session *OutboundGroupSession, olmSessions map[id.UserID]map[id.DeviceID]deviceSessionWrapper) error {
+func (mach *OlmMachine) encryptAndSendGroupSession(session *OutboundGroupSession, olmSessions map[id.UserID]map[id.DeviceID]deviceSessionWrapper, progress *shareProgressReporter) error {
 	mach.olmLock.Lock()
 	defer mach.olmLock.Unlock()
 	mach.Log.Trace("Encrypting group session %s for all found devices", session.ID())
 	deviceCount := 0
-	toDevice := &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content)}
-	for userID, sessions := range olmSessions {
-		if len(sessions) == 0 {
-			continue
-		}
-		output := make(map[id.DeviceID]*event.Content)
-		toDevice.Messages[userID] = output
-		for deviceID, device := range sessions {
-			mach.Log.Trace("Encrypting group session %s for %s of %s", session.ID(), deviceID, userID)
-			content := mach.encryptOlmEvent(device.session, device.identity, event.ToDeviceRoomKey, session.ShareContent())
-			output[deviceID] = &event.Content{Parsed: content}
-			deviceCount++
-			mach.Log.Trace("Encrypted group session %s for %s of %s", session.ID(), deviceID, userID)
-		}
+	for _, sessions := range olmSessions {
+		deviceCount += len(sessions)
+	}
+	if deviceCount == 0 {
+		mach.Log.Trace("No devices to share group session %s with", session.ID())
+		return nil
 	}
+	toDevice := mach.encryptOlmEventForDevices(olmSessions, event.ToDeviceRoomKey, session.ShareContent())
 
 	mach.Log.Trace("Sending to-device to %d devices of %d users to share group session %s", deviceCount, len(toDevice.Messages), session.ID())
-	_, err := mach.Client.SendToDevice(event.ToDeviceEncrypted, toDevice)
-	return err
+	chunks := splitToDeviceRequest(toDevice, mach.MaxToDeviceMessagesPerRequest)
+	progress.progress.TotalBatches = len(chunks)
+	var firstErr error
+	for i, chunk := range chunks {
+		_, err := mach.Client.SendToDevice(event.ToDeviceEncrypted, chunk)
+		if err != nil {
+			mach.Log.Warn("Failed to send chunk %d/%d of group session %s: %v", i+1, len(chunks), session.ID(), err)
+			for userID, devices := range chunk.Messages {
+				for deviceID := range devices {
+					userKey := UserDevice{UserID: userID, DeviceID: deviceID}
+					session.Users[userKey] = OGSNotShared
+					progress.progress.Failed = append(progress.progress.Failed, userKey)
+				}
+			}
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to send chunk %d/%d: %w", i+1, len(chunks), err)
+			}
+		} else {
+			progress.progress.BatchesSent++
+		}
+		progress.report()
+	}
+	return firstErr
 }
 
 func (mach *OlmMachine) findOlmSessionsForUser(session *OutboundGroupSession, userID id.UserID, devices map[id.DeviceID]*DeviceIdentity, output map[id.DeviceID]deviceSessionWrapper, withheld map[id.DeviceID]*event.Content, missingOutput map[id.DeviceID]*DeviceIdentity) {
+	allowUnverified := *mach.GetUserTrustSettings(userID).AllowUnverifiedDevices
 	for deviceID, device := range devices {
 		userKey := UserDevice{UserID: userID, DeviceID: deviceID}
 		if state := session.Users[userKey]; state != OGSNotShared {
@@ -245,18 +373,18 @@ func (mach *OlmMachine) findOlmSessionsForUser(session *OutboundGroupSession, us
 				RoomID:    session.RoomID,
 				Algorithm: id.AlgorithmMegolmV1,
 				SessionID: session.ID(),
-				SenderKey: mach.account.IdentityKey(),
+				SenderKey: mach.getAccount().IdentityKey(),
 				Code:      event.RoomKeyWithheldBlacklisted,
 				Reason:    "Device is blacklisted",
 			}}
 			session.Users[userKey] = OGSIgnored
-		} else if !mach.AllowUnverifiedDevices && !mach.IsDeviceTrusted(device) {
+		} else if !allowUnverified && !mach.IsDeviceTrusted(device) {
 			mach.Log.Debug("Not encrypting group session %s for %s of %s: device is not verified", session.ID(), deviceID, userID)
 			withheld[deviceID] = &event.Content{Parsed: &event.RoomKeyWithheldEventContent{
 				RoomID:    session.RoomID,
 				Algorithm: id.AlgorithmMegolmV1,
 				SessionID: session.ID(),
-				SenderKey: mach.account.IdentityKey(),
+				SenderKey: mach.getAccount().IdentityKey(),
 				Code:      event.RoomKeyWithheldUnverified,
 				Reason:    "This device does not encrypt messages for unverified devices",
 			}}
@@ -267,6 +395,16 @@ func (mach *OlmMachine) findOlmSessionsForUser(session *OutboundGroupSession, us
 			mach.Log.Warn("Didn't find a session for %s of %s", deviceID, userID)
 			if missingOutput != nil {
 				missingOutput[deviceID] = device
+			} else {
+				// This is the post-fetch retry, so creating a session failed. The device isn't marked as ignored,
+				// so the session will be shared if the session is re-shared after an olm session is established.
+				// m.no_olm is about the device rather than a specific session, so the room and session IDs are omitted.
+				withheld[deviceID] = &event.Content{Parsed: &event.RoomKeyWithheldEventContent{
+					Algorithm: id.AlgorithmMegolmV1,
+					SenderKey: mach.getAccount().IdentityKey(),
+					Code:      event.RoomKeyWithheldNoOlmSession,
+					Reason:    "Unable to establish a secure channel",
+				}}
 			}
 		} else {
 			output[deviceID] = deviceSessionWrapper{
@@ -20,7 +20,7 @@ func (mach *OlmMachine) encryptOlmEvent(session *OlmSession, recipient *DeviceId
 	evt := &DecryptedOlmEvent{
 		Sender:        mach.Client.UserID,
 		SenderDevice:  mach.Client.DeviceID,
-		Keys:          OlmEventKeys{Ed25519: mach.account.SigningKey()},
+		Keys:          OlmEventKeys{Ed25519: mach.getAccount().SigningKey()},
 		Recipient:     recipient.UserID,
 		RecipientKeys: OlmEventKeys{Ed25519: recipient.SigningKey},
 		Type:          evtType,
@@ -38,7 +38,7 @@ func (mach *OlmMachine) encryptOlmEvent(session *OlmSession, recipient *DeviceId
 	}
 	return &event.EncryptedEventContent{
 		Algorithm: id.AlgorithmOlmV1,
-		SenderKey: mach.account.IdentityKey(),
+		SenderKey: mach.getAccount().IdentityKey(),
 		OlmCiphertext: event.OlmCiphertexts{
 			recipient.IdentityKey: {
 				Type: msgType,
@@ -54,14 +54,22 @@ func (mach *OlmMachine) shouldCreateNewSession(identityKey id.IdentityKey) bool
 	}
 	mach.devicesToUnwedgeLock.Lock()
 	_, shouldUnwedge := mach.devicesToUnwedge[identityKey]
-	if shouldUnwedge {
-		delete(mach.devicesToUnwedge, identityKey)
-	}
 	mach.devicesToUnwedgeLock.Unlock()
 	return shouldUnwedge
 }
 
-func (mach *OlmMachine) createOutboundSessions(input map[id.UserID]map[id.DeviceID]*DeviceIdentity) error {
+// markSessionCreated removes the device from the list of devices to unwedge after a new session has been created.
+// This is only done after the session is actually created, so that failing to claim a one-time key doesn't make
+// the next message use the wedged session again.
+func (mach *OlmMachine) markSessionCreated(identityKey id.IdentityKey) {
+	mach.devicesToUnwedgeLock.Lock()
+	delete(mach.devicesToUnwedge, identityKey)
+	mach.devicesToUnwedgeLock.Unlock()
+}
+
+// createOutboundSessions claims one-time keys and creates olm sessions for the given devices.
+// Returns the number of devices for which one-time keys were claimed and the number of sessions created.
+func (mach *OlmMachine) createOutboundSessions(input map[id.UserID]map[id.DeviceID]*DeviceIdentity) (claimed, created int, err error) {
 	request := make(mautrix.OneTimeKeysRequest)
 	for userID, devices := range input {
 		request[userID] = make(map[id.DeviceID]id.KeyAlgorithm)
@@ -75,16 +83,24 @@ func (mach *OlmMachine) createOutboundSessions(input map[id.UserID]map[id.Device
 		}
 	}
 	if len(request) == 0 {
-		return nil
+		return
 	}
 	resp, err := mach.Client.ClaimKeys(&mautrix.ReqClaimKeys{
 		OneTimeKeys: request,
 		Timeout:     10 * 1000,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to claim keys: %w", err)
+		return 0, 0, fmt.Errorf("failed to claim keys: %w", err)
 	}
+	type createdSession struct {
+		userID   id.UserID
+		deviceID id.DeviceID
+		keyIndex string
+	}
+	sessions := make(map[id.SenderKey]*OlmSession)
+	sessionInfo := make(map[id.SenderKey]createdSession)
 	for userID, user := range resp.OneTimeKeys {
+		claimed += len(user)
 		for deviceID, oneTimeKeys := range user {
 			var oneTimeKey mautrix.OneTimeKey
 			var keyID id.KeyID
@@ -101,18 +117,27 @@ func (mach *OlmMachine) createOutboundSessions(input map[id.UserID]map[id.Device
 				mach.Log.Error("Failed to verify signature for %s of %s: %v", deviceID, userID, err)
 			} else if !ok {
 				mach.Log.Warn("Invalid signature for %s of %s", deviceID, userID)
-			} else if sess, err := mach.account.Internal.NewOutboundSession(identity.IdentityKey, oneTimeKey.Key); err != nil {
+			} else if sess, err := mach.getAccount().Internal.NewOutboundSession(identity.IdentityKey, oneTimeKey.Key); err != nil {
 				mach.Log.Error("Failed to create outbound session for %s of %s: %v", deviceID, userID, err)
 			} else {
-				wrapped := wrapSession(sess)
-				err = mach.CryptoStore.AddSession(identity.IdentityKey, wrapped)
-				if err != nil {
-					mach.Log.Error("Failed to store created session for %s of %s: %v", deviceID, userID, err)
-				} else {
-					mach.Log.Debug("Created new Olm session with %s/%s (OTK ID: %d)", userID, deviceID, keyIndex)
-				}
+				sessions[identity.IdentityKey] = wrapSession(sess)
+				sessionInfo[identity.IdentityKey] = createdSession{userID, deviceID, keyIndex}
 			}
 		}
 	}
-	return nil
+	if len(sessions) == 0 {
+		return
+	}
+	// Store all the new sessions at once, as storing them one by one is slow when sharing keys to large rooms.
+	err = mach.CryptoStore.PutSessions(sessions)
+	if err != nil {
+		mach.Log.Error("Failed to store %d created sessions: %v", len(sessions), err)
+		return claimed, 0, nil
+	}
+	for identityKey, info := range sessionInfo {
+		mach.markSessionCreated(identityKey)
+		mach.Log.Debug("Created new Olm session with %s/%s (OTK ID: %s)", info.userID, info.deviceID, info.keyIndex)
+		created++
+	}
+	return
 }
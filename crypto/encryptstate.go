@@ -0,0 +1,99 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrStateEncryptionNotAllowed = errors.New("state event can't be encrypted in this room")
+	ErrInvalidEncryptedStateKey  = errors.New("invalid state key in encrypted state event")
+)
+
+// unencryptableStateEvents contains the state event types that the server needs to be able to read for
+// authorizing events, so they must never be encrypted.
+var unencryptableStateEvents = map[event.Type]struct{}{
+	event.StateCreate:            {},
+	event.StateMember:            {},
+	event.StatePowerLevels:       {},
+	event.StateJoinRules:         {},
+	event.StateHistoryVisibility: {},
+	event.StateGuestAccess:       {},
+	event.StateEncryption:        {},
+	event.StateServerACL:         {},
+	event.StateTombstone:         {},
+	event.StateCanonicalAlias:    {},
+}
+
+// packStateKey combines the type and state key of an encrypted state event into the state key used for
+// the outer m.room.encrypted event, so that encrypted events of different types don't replace each other.
+//
+// The type is prefixed with its length (e.g. "12:m.room.name:" for an m.room.name event with an empty state key),
+// as both the type and the state key may contain colons.
+func packStateKey(evtType event.Type, stateKey string) string {
+	return fmt.Sprintf("%d:%s:%s", len(evtType.Type), evtType.Type, stateKey)
+}
+
+func unpackStateKey(packed string) (evtType string, stateKey string, ok bool) {
+	sep := strings.IndexByte(packed, ':')
+	if sep <= 0 {
+		return "", "", false
+	}
+	typeLength, err := strconv.Atoi(packed[:sep])
+	if err != nil || typeLength < 0 || packed[:sep] != strconv.Itoa(typeLength) {
+		return "", "", false
+	}
+	rest := packed[sep+1:]
+	if len(rest) <= typeLength || rest[typeLength] != ':' {
+		return "", "", false
+	}
+	return rest[:typeLength], rest[typeLength+1:], true
+}
+
+// ShouldEncryptState returns whether a state event of the given type should be encrypted when sending it to the
+// given room.
+//
+// State events are only encrypted if the room's m.room.encryption event has opted into encrypted state, the event
+// type isn't needed by the server for authorization (e.g. members and power levels) and the
+// OlmMachine.ShouldEncryptStateEvent callback allows it.
+func (mach *OlmMachine) ShouldEncryptState(roomID id.RoomID, evtType event.Type, stateKey string) bool {
+	if mach.ShouldEncryptStateEvent == nil {
+		return false
+	}
+	evtType.Class = event.StateEventType
+	if _, unencryptable := unencryptableStateEvents[evtType]; unencryptable {
+		return false
+	}
+	encryptionEvent := mach.StateStore.GetEncryptionEvent(roomID)
+	if encryptionEvent == nil || !encryptionEvent.EncryptStateEvents {
+		return false
+	}
+	return mach.ShouldEncryptStateEvent(roomID, evtType, stateKey)
+}
+
+// EncryptMegolmStateEvent encrypts a state event with the current outbound group session of the room.
+//
+// The returned content must be sent as a m.room.encrypted state event (event.StateEncrypted) with the returned
+// state key, which combines the type and state key of the original event. The group session must be shared
+// beforehand like with EncryptMegolmEvent.
+func (mach *OlmMachine) EncryptMegolmStateEvent(roomID id.RoomID, evtType event.Type, stateKey string, content interface{}) (string, *event.EncryptedEventContent, error) {
+	if !mach.ShouldEncryptState(roomID, evtType, stateKey) {
+		return "", nil, fmt.Errorf("%w (%s)", ErrStateEncryptionNotAllowed, evtType.Type)
+	}
+	encrypted, err := mach.EncryptMegolmEvent(roomID, evtType, content)
+	if err != nil {
+		return "", nil, err
+	}
+	return packStateKey(evtType, stateKey), encrypted, nil
+}
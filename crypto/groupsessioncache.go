@@ -0,0 +1,165 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+type groupSessionCacheKey struct {
+	RoomID    id.RoomID
+	SenderKey id.SenderKey
+	SessionID id.SessionID
+}
+
+type groupSessionCacheEntry struct {
+	key     groupSessionCacheKey
+	session *InboundGroupSession
+	expires time.Time
+}
+
+// groupSessionCache is a least-recently-used cache of inbound Megolm sessions.
+type groupSessionCache struct {
+	lock    sync.Mutex
+	maxSize int
+	ttl     time.Duration
+	entries map[groupSessionCacheKey]*list.Element
+	lru     *list.List
+}
+
+func newGroupSessionCache(maxSize int, ttl time.Duration) *groupSessionCache {
+	return &groupSessionCache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		entries: make(map[groupSessionCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (cache *groupSessionCache) get(key groupSessionCacheKey) *InboundGroupSession {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	elem, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*groupSessionCacheEntry)
+	if cache.ttl > 0 && time.Now().After(entry.expires) {
+		cache.removeElement(elem)
+		return nil
+	}
+	cache.lru.MoveToFront(elem)
+	return entry.session
+}
+
+func (cache *groupSessionCache) put(key groupSessionCacheKey, session *InboundGroupSession) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	expires := time.Now().Add(cache.ttl)
+	if elem, ok := cache.entries[key]; ok {
+		entry := elem.Value.(*groupSessionCacheEntry)
+		entry.session = session
+		entry.expires = expires
+		cache.lru.MoveToFront(elem)
+		return
+	}
+	cache.entries[key] = cache.lru.PushFront(&groupSessionCacheEntry{key: key, session: session, expires: expires})
+	for cache.lru.Len() > cache.maxSize {
+		cache.removeElement(cache.lru.Back())
+	}
+}
+
+func (cache *groupSessionCache) remove(key groupSessionCacheKey) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if elem, ok := cache.entries[key]; ok {
+		cache.removeElement(elem)
+	}
+}
+
+func (cache *groupSessionCache) removeRoom(roomID id.RoomID) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for key, elem := range cache.entries {
+		if key.RoomID == roomID {
+			cache.removeElement(elem)
+		}
+	}
+}
+
+func (cache *groupSessionCache) removeElement(elem *list.Element) {
+	cache.lru.Remove(elem)
+	delete(cache.entries, elem.Value.(*groupSessionCacheEntry).key)
+}
+
+// EnableGroupSessionCache makes the machine keep up to maxSize recently used inbound Megolm sessions in memory,
+// so that decrypting events doesn't require reading the session from the crypto store every time. If ttl is
+// non-zero, cached sessions are read from the store again after they've been in the cache for that long.
+//
+// Sessions stored through the machine are written to the crypto store before the cache is updated. Changes made
+// directly to the crypto store (e.g. by another process) are only noticed after the cached entry expires.
+// This must be called before the machine is used.
+func (mach *OlmMachine) EnableGroupSessionCache(maxSize int, ttl time.Duration) {
+	if maxSize <= 0 {
+		mach.groupSessionCache = nil
+		return
+	}
+	mach.groupSessionCache = newGroupSessionCache(maxSize, ttl)
+}
+
+// getGroupSession gets an inbound Megolm session from the cache, or from the crypto store if it's not cached.
+// Cached sessions are shared, so they must only be decrypted with InboundGroupSession.decrypt.
+func (mach *OlmMachine) getGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) (*InboundGroupSession, error) {
+	if mach.groupSessionCache == nil {
+		return mach.CryptoStore.GetGroupSession(roomID, senderKey, sessionID)
+	}
+	key := groupSessionCacheKey{roomID, senderKey, sessionID}
+	if sess := mach.groupSessionCache.get(key); sess != nil {
+		return sess, nil
+	}
+	sess, err := mach.CryptoStore.GetGroupSession(roomID, senderKey, sessionID)
+	if err == nil && sess != nil {
+		// Cache the ID before the session is shared with other goroutines.
+		sess.ID()
+		mach.groupSessionCache.put(key, sess)
+	}
+	return sess, err
+}
+
+// putGroupSession stores an inbound Megolm session in the crypto store and updates the cache.
+func (mach *OlmMachine) putGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, igs *InboundGroupSession) error {
+	err := mach.CryptoStore.PutGroupSession(roomID, senderKey, sessionID, igs)
+	if mach.groupSessionCache != nil {
+		key := groupSessionCacheKey{roomID, senderKey, sessionID}
+		if err != nil {
+			mach.groupSessionCache.remove(key)
+		} else {
+			mach.groupSessionCache.put(key, igs)
+		}
+	}
+	return err
+}
+
+// putGroupSessions stores multiple inbound Megolm sessions in the crypto store and updates the cache.
+func (mach *OlmMachine) putGroupSessions(sessions []*InboundGroupSession) error {
+	err := mach.CryptoStore.PutGroupSessions(sessions)
+	if mach.groupSessionCache != nil {
+		for _, igs := range sessions {
+			key := groupSessionCacheKey{igs.RoomID, igs.SenderKey, igs.ID()}
+			if err != nil {
+				mach.groupSessionCache.remove(key)
+			} else {
+				mach.groupSessionCache.put(key, igs)
+			}
+		}
+	}
+	return err
+}
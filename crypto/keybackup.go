@@ -0,0 +1,406 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/tidwall/sjson"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/crypto/ssss"
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrKeyBackupNotEnabled             = errors.New("key backup is not enabled")
+	ErrKeyBackupPrivateKeyUnknown      = errors.New("private key of the key backup is not known")
+	ErrKeyBackupNotTrusted             = errors.New("key backup version is not trusted")
+	ErrUnsupportedKeyBackupAlgorithm   = errors.New("unsupported key backup algorithm")
+	ErrMismatchingBackedUpSessionID    = errors.New("session restored from key backup has different ID than expected")
+	ErrInvalidBackedUpSessionAlgorithm = errors.New("session restored from key backup has unknown algorithm")
+)
+
+// DefaultKeyBackupBatchSize is the default maximum number of sessions uploaded to key backup in a single request.
+const DefaultKeyBackupBatchSize = 100
+
+type keyBackupState struct {
+	version   string
+	algorithm id.KeyBackupAlgorithm
+	encrypter backup.Encrypter
+	key       backup.Key
+	// trusted is true if the backup version was created by us, is signed by a trusted key (see VerifyBackupVersion)
+	// or if we have the private key. Sessions are only uploaded to trusted backups.
+	trusted bool
+}
+
+func (mach *OlmMachine) getKeyBackup() *keyBackupState {
+	mach.keyBackupLock.RLock()
+	defer mach.keyBackupLock.RUnlock()
+	return mach.keyBackup
+}
+
+// KeyBackupVersion returns the currently enabled key backup version, or an empty string if key backup isn't enabled.
+func (mach *OlmMachine) KeyBackupVersion() string {
+	kb := mach.getKeyBackup()
+	if kb == nil {
+		return ""
+	}
+	return kb.version
+}
+
+// CreateKeyBackupVersion generates a new key using the algorithm in KeyBackupAlgorithm, creates a new key backup
+// version using it and enables key backup with the new version. The auth data is signed with the device key and
+// the cross-signing master key if it's available.
+//
+// The returned key should be stored somewhere, e.g. in SSSS with StoreKeyBackupKeyInSSSS, as it's needed to
+// restore sessions from the backup.
+func (mach *OlmMachine) CreateKeyBackupVersion(ctx context.Context) (string, backup.Key, error) {
+	algorithm := mach.KeyBackupAlgorithm
+	if len(algorithm) == 0 {
+		algorithm = id.KeyBackupAlgorithmMegolmBackupV1
+	}
+	alg, err := backup.GetAlgorithm(algorithm)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w %s", ErrUnsupportedKeyBackupAlgorithm, algorithm)
+	}
+	key, err := alg.GenerateKey()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate key backup key: %w", err)
+	}
+	authData, err := key.AuthData()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create key backup auth data: %w", err)
+	}
+	signatures, err := mach.signKeyBackupAuthData(authData)
+	if err != nil {
+		return "", nil, err
+	}
+	authData, err = sjson.SetBytes(authData, "signatures", signatures)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to add signatures to key backup auth data: %w", err)
+	}
+	encrypter, err := alg.NewEncrypter(authData, key)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create key backup encrypter: %w", err)
+	}
+	resp, err := mach.Client.CreateKeyBackupVersion(&mautrix.ReqRoomKeysVersionCreate{
+		Algorithm: algorithm,
+		AuthData:  authData,
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create key backup version: %w", err)
+	}
+	mach.Log.Debug("Created key backup version %s using %s", resp.Version, algorithm)
+	mach.setKeyBackup(&keyBackupState{version: resp.Version, algorithm: algorithm, encrypter: encrypter, key: key, trusted: true})
+	return resp.Version, key, nil
+}
+
+func (mach *OlmMachine) signKeyBackupAuthData(authData json.RawMessage) (map[id.UserID]map[id.KeyID]string, error) {
+	signatures := make(map[id.KeyID]string)
+	signature, err := mach.KeyProvider.SignJSON(KeyUsageDevice, authData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign key backup auth data with device key: %w", err)
+	}
+	signatures[id.NewKeyID(id.KeyAlgorithmEd25519, mach.Client.DeviceID.String())] = signature
+	if masterKey, err := mach.KeyProvider.PublicKey(KeyUsageMaster); err == nil {
+		signature, err = mach.KeyProvider.SignJSON(KeyUsageMaster, authData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign key backup auth data with master key: %w", err)
+		}
+		signatures[id.NewKeyID(id.KeyAlgorithmEd25519, masterKey.String())] = signature
+	}
+	return map[id.UserID]map[id.KeyID]string{mach.Client.UserID: signatures}, nil
+}
+
+// EnableKeyBackup enables key backup using the given backup version. If version is empty, the latest version is used.
+// The algorithm of the backup version must be registered in backup.Algorithms.
+//
+// The key is optional for algorithms that can encrypt sessions with only the public auth data, like the default
+// curve25519 algorithm: without it, new sessions are still uploaded to the backup, but sessions can't be restored.
+// Symmetric algorithms like MSC3270 always require the key. If it's given, it must match the auth data of the version.
+//
+// After the backup is enabled, all sessions that haven't been uploaded to the version yet are uploaded
+// in the background, and new sessions are uploaded automatically as they're received. However, sessions are only
+// uploaded if the backup is trusted, i.e. a matching key was given or the auth data is signed by a trusted key
+// (see VerifyBackupVersion). Untrusted backups can still be used for restoring sessions if the key is given.
+func (mach *OlmMachine) EnableKeyBackup(version string, key backup.Key) error {
+	resp, err := mach.getKeyBackupVersionInfo(version)
+	if err != nil {
+		return err
+	}
+	alg, err := backup.GetAlgorithm(resp.Algorithm)
+	if err != nil {
+		return fmt.Errorf("%w %s", ErrUnsupportedKeyBackupAlgorithm, resp.Algorithm)
+	} else if key != nil && key.Algorithm() != resp.Algorithm {
+		return fmt.Errorf("%w: backup uses %s, key is for %s", backup.ErrMismatchingKey, resp.Algorithm, key.Algorithm())
+	}
+	encrypter, err := alg.NewEncrypter(resp.AuthData, key)
+	if err != nil {
+		return fmt.Errorf("failed to use key backup version %s: %w", resp.Version, err)
+	}
+	// A key that matches the auth data is enough to trust the backup, as an attacker couldn't have created it.
+	trusted := key != nil || mach.verifyKeyBackupSignatures(resp).Trusted
+	if !trusted {
+		mach.Log.Warn("Key backup version %s is not signed by a trusted key, sessions won't be uploaded to it", resp.Version)
+	}
+	mach.Log.Debug("Enabled key backup version %s using %s", resp.Version, resp.Algorithm)
+	mach.setKeyBackup(&keyBackupState{version: resp.Version, algorithm: resp.Algorithm, encrypter: encrypter, key: key, trusted: trusted})
+	return nil
+}
+
+// DisableKeyBackup stops uploading new sessions to key backup. The backup itself is not deleted from the server.
+func (mach *OlmMachine) DisableKeyBackup() {
+	mach.setKeyBackup(nil)
+}
+
+func (mach *OlmMachine) setKeyBackup(kb *keyBackupState) {
+	mach.keyBackupLock.Lock()
+	mach.keyBackup = kb
+	mach.keyBackupLock.Unlock()
+	mach.keyBackupRestoreLock.Lock()
+	mach.keyBackupRestoreAttempted = make(map[id.SessionID]struct{})
+	mach.keyBackupRestoreLock.Unlock()
+	if kb != nil && kb.trusted {
+		mach.queueKeyBackupUpload()
+	}
+}
+
+// queueKeyBackupUpload starts uploading pending sessions to key backup in the background. If an upload is already
+// waiting to start, this does nothing, as the waiting upload will include any sessions stored before it starts.
+func (mach *OlmMachine) queueKeyBackupUpload() {
+	if kb := mach.getKeyBackup(); kb == nil || !kb.trusted || !atomic.CompareAndSwapInt32(&mach.keyBackupUploadQueued, 0, 1) {
+		return
+	}
+	go func() {
+		mach.keyBackupUploadLock.Lock()
+		defer mach.keyBackupUploadLock.Unlock()
+		atomic.StoreInt32(&mach.keyBackupUploadQueued, 0)
+		err := mach.uploadPendingKeyBackups(context.Background())
+		if err != nil && !errors.Is(err, ErrKeyBackupNotEnabled) && !errors.Is(err, ErrKeyBackupNotTrusted) {
+			mach.Log.Error("Failed to upload sessions to key backup: %v", err)
+		}
+	}()
+}
+
+// UploadPendingKeyBackups uploads all sessions that haven't been uploaded to the current key backup version.
+// Sessions are normally uploaded automatically, so this only needs to be called to wait for the upload to finish.
+func (mach *OlmMachine) UploadPendingKeyBackups(ctx context.Context) error {
+	mach.keyBackupUploadLock.Lock()
+	defer mach.keyBackupUploadLock.Unlock()
+	return mach.uploadPendingKeyBackups(ctx)
+}
+
+func (mach *OlmMachine) uploadPendingKeyBackups(ctx context.Context) error {
+	kb := mach.getKeyBackup()
+	if kb == nil {
+		return ErrKeyBackupNotEnabled
+	} else if !kb.trusted {
+		return ErrKeyBackupNotTrusted
+	}
+	sessions, err := mach.CryptoStore.GetGroupSessionsWithoutKeyBackupVersion(kb.version)
+	if err != nil {
+		return fmt.Errorf("failed to get sessions to back up: %w", err)
+	} else if len(sessions) == 0 {
+		return nil
+	}
+	batchSize := mach.KeyBackupBatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultKeyBackupBatchSize
+	}
+	mach.Log.Debug("Uploading %d sessions to key backup version %s", len(sessions), kb.version)
+	for start := 0; start < len(sessions); start += batchSize {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		end := start + batchSize
+		if end > len(sessions) {
+			end = len(sessions)
+		}
+		err = mach.uploadKeyBackupBatch(kb, sessions[start:end])
+		if errors.Is(err, mautrix.MWrongRoomKeysVersion) {
+			mach.Log.Warn("Key backup version %s is no longer the current version, disabling key backup", kb.version)
+			mach.keyBackupLock.Lock()
+			if mach.keyBackup == kb {
+				mach.keyBackup = nil
+			}
+			mach.keyBackupLock.Unlock()
+			return err
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mach *OlmMachine) uploadKeyBackupBatch(kb *keyBackupState, sessions []*InboundGroupSession) error {
+	req := &mautrix.ReqRoomKeysUpdate{Rooms: make(map[id.RoomID]mautrix.ReqRoomKeysRoom)}
+	uploaded := make([]*InboundGroupSession, 0, len(sessions))
+	for _, sess := range sessions {
+		data, err := encryptSessionForKeyBackup(kb.encrypter, sess)
+		if err != nil {
+			mach.Log.Warn("Failed to encrypt session %s for key backup: %v", sess.ID(), err)
+			continue
+		}
+		room, ok := req.Rooms[sess.RoomID]
+		if !ok {
+			room = mautrix.ReqRoomKeysRoom{Sessions: make(map[id.SessionID]mautrix.KeyBackupData)}
+			req.Rooms[sess.RoomID] = room
+		}
+		room.Sessions[sess.ID()] = *data
+		uploaded = append(uploaded, sess)
+	}
+	if len(uploaded) == 0 {
+		return nil
+	}
+	_, err := mach.Client.PutKeysInBackup(kb.version, req)
+	if err != nil {
+		return fmt.Errorf("failed to upload sessions to key backup: %w", err)
+	}
+	err = mach.CryptoStore.MarkGroupSessionsBackedUp(kb.version, uploaded)
+	if err != nil {
+		return fmt.Errorf("failed to mark sessions as backed up: %w", err)
+	}
+	mach.Log.Trace("Uploaded %d sessions to key backup version %s", len(uploaded), kb.version)
+	return nil
+}
+
+func encryptSessionForKeyBackup(encrypter backup.Encrypter, sess *InboundGroupSession) (*mautrix.KeyBackupData, error) {
+	firstKnownIndex := sess.Internal.FirstKnownIndex()
+	sessionKey, err := sess.Internal.Export(firstKnownIndex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export session: %w", err)
+	}
+	forwardingChains := sess.ForwardingChains
+	if forwardingChains == nil {
+		forwardingChains = []string{}
+	}
+	encrypted, err := encrypter.Encrypt(sess.ID(), &backup.SessionData{
+		Algorithm:         id.AlgorithmMegolmV1,
+		ForwardingChains:  forwardingChains,
+		SenderKey:         sess.SenderKey,
+		SenderClaimedKeys: backup.SenderClaimedKeys{Ed25519: sess.SigningKey},
+		SessionKey:        sessionKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mautrix.KeyBackupData{
+		FirstMessageIndex: int(firstKnownIndex),
+		ForwardedCount:    len(sess.ForwardingChains),
+		IsVerified:        sess.KeySource == event.KeySourceDirect,
+		SessionData:       encrypted,
+	}, nil
+}
+
+// RestoreRoomKeyFromBackup downloads a single megolm session from the current key backup version and imports it.
+// The private key of the backup must have been given to EnableKeyBackup or CreateKeyBackupVersion.
+//
+// Like other ways of receiving sessions, this will retry decrypting events that were queued for the session.
+// The returned bool is false if the store already had the same or a better version of the session.
+func (mach *OlmMachine) RestoreRoomKeyFromBackup(roomID id.RoomID, sessionID id.SessionID) (bool, error) {
+	kb := mach.getKeyBackup()
+	if kb == nil {
+		return false, ErrKeyBackupNotEnabled
+	} else if kb.key == nil {
+		return false, ErrKeyBackupPrivateKeyUnknown
+	}
+	data, err := mach.Client.GetKeyBackupForRoomAndSession(kb.version, roomID, sessionID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get session from key backup: %w", err)
+	}
+	igs, err := decryptBackedUpRoomKey(kb, roomID, sessionID, data)
+	if err != nil {
+		return false, err
+	}
+	return mach.storeImportedGroupSession(igs)
+}
+
+func decryptBackedUpRoomKey(kb *keyBackupState, roomID id.RoomID, sessionID id.SessionID, data *mautrix.KeyBackupData) (*InboundGroupSession, error) {
+	session, err := kb.key.Decrypt(sessionID, data.SessionData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt backed up session data: %w", err)
+	} else if session.Algorithm != id.AlgorithmMegolmV1 {
+		return nil, ErrInvalidBackedUpSessionAlgorithm
+	}
+	igsInternal, err := olm.InboundGroupSessionImport([]byte(session.SessionKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to import session: %w", err)
+	} else if igsInternal.ID() != sessionID {
+		return nil, ErrMismatchingBackedUpSessionID
+	}
+	return &InboundGroupSession{
+		Internal:         *igsInternal,
+		SigningKey:       session.SenderClaimedKeys.Ed25519,
+		SenderKey:        session.SenderKey,
+		RoomID:           roomID,
+		ForwardingChains: session.ForwardingChains,
+		KeySource:        event.KeySourceBackup,
+		// The session came from the backup, so there's no need to upload it again.
+		KeyBackupVersion: kb.version,
+		id:               sessionID,
+	}, nil
+}
+
+// restoreRoomKeyFromBackupInBackground tries to restore a missing session from key backup if AutoRestoreFromKeyBackup
+// is enabled. Each session is only requested once per enabled backup version.
+func (mach *OlmMachine) restoreRoomKeyFromBackupInBackground(roomID id.RoomID, sessionID id.SessionID) {
+	if !mach.AutoRestoreFromKeyBackup {
+		return
+	} else if kb := mach.getKeyBackup(); kb == nil || kb.key == nil {
+		return
+	}
+	mach.keyBackupRestoreLock.Lock()
+	_, attempted := mach.keyBackupRestoreAttempted[sessionID]
+	mach.keyBackupRestoreAttempted[sessionID] = struct{}{}
+	mach.keyBackupRestoreLock.Unlock()
+	if attempted {
+		return
+	}
+	go func() {
+		imported, err := mach.RestoreRoomKeyFromBackup(roomID, sessionID)
+		if errors.Is(err, mautrix.MNotFound) {
+			mach.Log.Debug("Session %s not found in key backup", sessionID)
+		} else if err != nil {
+			mach.Log.Warn("Failed to restore session %s from key backup: %v", sessionID, err)
+		} else if imported {
+			mach.Log.Debug("Restored session %s from key backup", sessionID)
+		}
+	}()
+}
+
+// StoreKeyBackupKeyInSSSS encrypts the given key backup key with the given SSSS key and stores it in account data.
+func (mach *OlmMachine) StoreKeyBackupKeyInSSSS(key *ssss.Key, backupKey backup.Key) error {
+	data := utils.NewSecretBytes(backupKey.Bytes())
+	defer data.Wipe()
+	return mach.SSSS.SetEncryptedAccountData(event.AccountDataMegolmBackupKey, data.Bytes(), key)
+}
+
+// FetchKeyBackupKeyFromSSSS fetches the key backup key from SSSS and decrypts it with the given SSSS key.
+//
+// SSSS only stores the raw key, so the algorithm of the backup version the key is for must be given.
+func (mach *OlmMachine) FetchKeyBackupKeyFromSSSS(key *ssss.Key, algorithm id.KeyBackupAlgorithm) (backup.Key, error) {
+	alg, err := backup.GetAlgorithm(algorithm)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s", ErrUnsupportedKeyBackupAlgorithm, algorithm)
+	}
+	decrypted, err := mach.SSSS.GetDecryptedAccountData(event.AccountDataMegolmBackupKey, key)
+	if err != nil {
+		return nil, err
+	}
+	data := utils.NewSecretBytes(decrypted)
+	defer data.Wipe()
+	return alg.KeyFromBytes(data.Bytes())
+}
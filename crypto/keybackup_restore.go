@@ -0,0 +1,132 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// RestoreFromBackup downloads megolm sessions from the current key backup version, decrypts them with the backup key
+// and imports them into the crypto store. If roomID is not nil, only the sessions of that room are restored,
+// otherwise the sessions of all rooms the user is currently joined to are restored. Sessions of rooms that the user
+// has left can be restored by passing the room IDs to RestoreRoomsFromBackup.
+// The private key of the backup must have been given to EnableKeyBackup or CreateKeyBackupVersion.
+//
+// See RestoreRoomsFromBackup for details on how the sessions are imported.
+func (mach *OlmMachine) RestoreFromBackup(ctx context.Context, roomID *id.RoomID, progress func(done, total int)) (int, int, error) {
+	if roomID != nil {
+		return mach.RestoreRoomsFromBackup(ctx, []id.RoomID{*roomID}, progress)
+	}
+	if kb := mach.getKeyBackup(); kb == nil {
+		return 0, 0, ErrKeyBackupNotEnabled
+	} else if kb.key == nil {
+		return 0, 0, ErrKeyBackupPrivateKeyUnknown
+	}
+	joinedRooms, err := mach.Client.JoinedRooms()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get joined rooms: %w", err)
+	}
+	return mach.RestoreRoomsFromBackup(ctx, joinedRooms.JoinedRooms, progress)
+}
+
+// RestoreRoomsFromBackup downloads the megolm sessions of the given rooms from the current key backup version,
+// decrypts them with the backup key and imports them into the crypto store.
+//
+// The sessions are downloaded one room at a time rather than requesting the whole backup in a single response.
+// Sessions are only imported if the store doesn't already have the same session with an equal or lower first known
+// index. They're decrypted and stored in batches of KeyBackupBatchSize, with each batch written in one transaction,
+// so only the encrypted sessions of one room and a single batch of decrypted sessions are kept in memory at a time.
+// The progress callback is optional and is called after each batch. The total passed to it only includes the rooms
+// that have been downloaded so far.
+//
+// The returned values are the number of sessions that were imported and the total number of sessions in the
+// downloaded rooms. If the context is cancelled, the sessions processed so far are still stored.
+func (mach *OlmMachine) RestoreRoomsFromBackup(ctx context.Context, roomIDs []id.RoomID, progress func(done, total int)) (int, int, error) {
+	kb := mach.getKeyBackup()
+	if kb == nil {
+		return 0, 0, ErrKeyBackupNotEnabled
+	} else if kb.key == nil {
+		return 0, 0, ErrKeyBackupPrivateKeyUnknown
+	}
+	batchSize := mach.KeyBackupBatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultKeyBackupBatchSize
+	}
+	mach.Log.Debug("Restoring sessions of %d rooms from key backup version %s", len(roomIDs), kb.version)
+
+	batch := make([]*InboundGroupSession, 0, batchSize)
+	done, imported, total := 0, 0, 0
+	flush := func() error {
+		if len(batch) > 0 {
+			err := mach.putGroupSessions(batch)
+			if err != nil {
+				return fmt.Errorf("failed to store sessions restored from key backup: %w", err)
+			}
+			for _, igs := range batch {
+				mach.markSessionReceived(igs.ID())
+			}
+			imported += len(batch)
+			batch = batch[:0]
+		}
+		if progress != nil {
+			progress(done, total)
+		}
+		return nil
+	}
+	for _, roomID := range roomIDs {
+		if ctx.Err() != nil {
+			break
+		}
+		room, err := mach.Client.GetKeyBackupForRoom(kb.version, roomID)
+		if errors.Is(err, mautrix.MNotFound) {
+			continue
+		} else if err != nil {
+			if flushErr := flush(); flushErr != nil {
+				return imported, total, flushErr
+			}
+			return imported, total, fmt.Errorf("failed to get sessions of %s from key backup: %w", roomID, err)
+		}
+		total += len(room.Sessions)
+		for sessionID, data := range room.Sessions {
+			if ctx.Err() != nil {
+				break
+			}
+			// Drop the encrypted data as soon as it's been processed so that it can be garbage collected.
+			delete(room.Sessions, sessionID)
+			done++
+			igs, err := decryptBackedUpRoomKey(kb, roomID, sessionID, &data)
+			if err != nil {
+				mach.Log.Warn("Failed to restore session %s/%s from key backup: %v", roomID, sessionID, err)
+			} else if existing, _ := mach.getGroupSession(roomID, igs.SenderKey, sessionID); existing != nil &&
+				existing.Internal.FirstKnownIndex() <= igs.Internal.FirstKnownIndex() {
+				mach.Log.Trace("Skipped session %s/%s from key backup: already in store", roomID, sessionID)
+			} else {
+				batch = append(batch, igs)
+			}
+			if done%batchSize == 0 {
+				if err = flush(); err != nil {
+					return imported, total, err
+				}
+			}
+		}
+	}
+	if ctx.Err() != nil || done%batchSize != 0 || done == 0 {
+		if err := flush(); err != nil {
+			return imported, total, err
+		}
+	}
+	if ctx.Err() != nil {
+		return imported, total, ctx.Err()
+	}
+	mach.Log.Debug("Restored %d/%d sessions from key backup version %s", imported, total, kb.version)
+	return imported, total, nil
+}
@@ -0,0 +1,455 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidwall/sjson"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// keyBackupTestServer is a fake homeserver that implements the key backup endpoints with a single backup version.
+type keyBackupTestServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	version  *mautrix.RespRoomKeysVersion
+	sessions map[id.RoomID]map[id.SessionID]mautrix.KeyBackupData
+	// The rooms returned by /joined_rooms. If nil, all rooms in the backup are returned.
+	joinedRooms []id.RoomID
+	// The number of requests that fetched the whole backup or a single room.
+	fullRequests int
+	roomRequests int
+}
+
+func newKeyBackupTestServer() *keyBackupTestServer {
+	ts := &keyBackupTestServer{sessions: make(map[id.RoomID]map[id.SessionID]mautrix.KeyBackupData)}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts.lock.Lock()
+		defer ts.lock.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/joined_rooms") {
+			joinedRooms := ts.joinedRooms
+			if joinedRooms == nil {
+				for roomID := range ts.sessions {
+					joinedRooms = append(joinedRooms, roomID)
+				}
+			}
+			_ = json.NewEncoder(w).Encode(&mautrix.RespJoinedRooms{JoinedRooms: joinedRooms})
+			return
+		}
+		// Session IDs may contain slashes, so split the escaped path and unescape each part separately.
+		path := r.URL.EscapedPath()
+		parts := strings.Split(path[strings.Index(path, "/room_keys/")+len("/room_keys/"):], "/")
+		for i, part := range parts {
+			parts[i], _ = url.PathUnescape(part)
+		}
+		switch {
+		case parts[0] == "version" && r.Method == http.MethodPost:
+			var req mautrix.ReqRoomKeysVersionCreate
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			ts.version = &mautrix.RespRoomKeysVersion{Algorithm: req.Algorithm, AuthData: req.AuthData, Version: "1"}
+			_ = json.NewEncoder(w).Encode(&mautrix.RespRoomKeysVersionCreate{Version: "1"})
+		case parts[0] == "version" && r.Method == http.MethodGet && ts.version != nil:
+			_ = json.NewEncoder(w).Encode(ts.version)
+		case parts[0] == "keys" && ts.version != nil && r.URL.Query().Get("version") != ts.version.Version:
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode": "M_WRONG_ROOM_KEYS_VERSION", "error": "wrong version"}`))
+		case parts[0] == "keys" && r.Method == http.MethodPut:
+			var req mautrix.ReqRoomKeysUpdate
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			for roomID, room := range req.Rooms {
+				if ts.sessions[roomID] == nil {
+					ts.sessions[roomID] = make(map[id.SessionID]mautrix.KeyBackupData)
+				}
+				for sessionID, data := range room.Sessions {
+					ts.sessions[roomID][sessionID] = data
+				}
+			}
+			_ = json.NewEncoder(w).Encode(&mautrix.RespRoomKeysUpdate{Count: ts.count()})
+		case parts[0] == "keys" && r.Method == http.MethodGet && len(parts) == 1:
+			ts.fullRequests++
+			_ = json.NewEncoder(w).Encode(&mautrix.RespRoomKeys{Rooms: ts.rooms()})
+		case parts[0] == "keys" && r.Method == http.MethodGet && len(parts) == 2:
+			ts.roomRequests++
+			_ = json.NewEncoder(w).Encode(ts.rooms()[id.RoomID(parts[1])])
+		case parts[0] == "keys" && r.Method == http.MethodGet && len(parts) == 3:
+			data, ok := ts.sessions[id.RoomID(parts[1])][id.SessionID(parts[2])]
+			if ok {
+				_ = json.NewEncoder(w).Encode(&data)
+				return
+			}
+			fallthrough
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "not found"}`))
+		}
+	}))
+	return ts
+}
+
+func (ts *keyBackupTestServer) rooms() map[id.RoomID]mautrix.ReqRoomKeysRoom {
+	rooms := make(map[id.RoomID]mautrix.ReqRoomKeysRoom, len(ts.sessions))
+	for roomID, sessions := range ts.sessions {
+		rooms[roomID] = mautrix.ReqRoomKeysRoom{Sessions: sessions}
+	}
+	return rooms
+}
+
+func (ts *keyBackupTestServer) count() (count int) {
+	for _, room := range ts.sessions {
+		count += len(room)
+	}
+	return
+}
+
+func (ts *keyBackupTestServer) Count() int {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return ts.count()
+}
+
+func TestOlmMachineKeyBackup(t *testing.T) {
+	server := newKeyBackupTestServer()
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	machine.Client.HomeserverURL = serverURL
+
+	session := NewOutboundGroupSession("room1", nil)
+	session.Shared = true
+	machine.CryptoStore.AddOutboundGroupSession(session)
+	signingKey, identityKey := machine.account.Keys()
+	machine.createGroupSession(identityKey, signingKey, "room1", session.ID(), session.Internal.Key(), "test")
+	encrypted, err := machine.EncryptMegolmEvent("room1", event.EventMessage, map[string]string{"hello": "world"})
+	if err != nil {
+		t.Fatalf("Error encrypting megolm event: %v", err)
+	}
+
+	version, backupKey, err := machine.CreateKeyBackupVersion(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to create key backup version: %v", err)
+	} else if machine.KeyBackupVersion() != version {
+		t.Errorf("Key backup wasn't enabled after creating version")
+	}
+	if err = machine.UploadPendingKeyBackups(context.Background()); err != nil {
+		t.Fatalf("Failed to upload pending sessions: %v", err)
+	} else if server.Count() != 1 {
+		t.Fatalf("Expected 1 session in backup, got %d", server.Count())
+	}
+	if pending, _ := machine.CryptoStore.GetGroupSessionsWithoutKeyBackupVersion(version); len(pending) != 0 {
+		t.Errorf("Expected no sessions pending upload, got %d", len(pending))
+	}
+
+	// New sessions should be uploaded automatically.
+	session2 := NewOutboundGroupSession("room2", nil)
+	machine.createGroupSession(identityKey, signingKey, "room2", session2.ID(), session2.Internal.Key(), "test")
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Count() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.Count() != 2 {
+		t.Fatalf("New session wasn't uploaded to backup automatically")
+	}
+
+	machine2, storeFileName2 := newMachineWithDevice(t, "user1", "device2")
+	defer os.Remove(storeFileName2)
+	machine2.Client.HomeserverURL = serverURL
+	machine2.AutoRestoreFromKeyBackup = true
+	retried := make(chan *event.Event, 1)
+	machine2.OnRetriedDecryption = func(original, decrypted *event.Event) {
+		retried <- decrypted
+	}
+	if err = machine2.EnableKeyBackup("", backupKey); err != nil {
+		t.Fatalf("Failed to enable key backup on second device: %v", err)
+	}
+	encryptedEvt := &event.Event{
+		Content: event.Content{Parsed: encrypted},
+		Type:    event.EventEncrypted,
+		ID:      "event1",
+		RoomID:  "room1",
+		Sender:  "user1",
+	}
+	if _, err = machine2.DecryptMegolmEvent(encryptedEvt); !errors.Is(err, NoSessionFound) {
+		t.Fatalf("Expected NoSessionFound, got %v", err)
+	}
+	select {
+	case decrypted := <-retried:
+		if decrypted.Content.Raw["hello"] != "world" {
+			t.Errorf("Unexpected content in event decrypted with restored session: %v", decrypted.Content.Raw)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session wasn't restored from key backup")
+	}
+	restored, err := machine2.CryptoStore.GetGroupSession("room1", identityKey, session.ID())
+	if err != nil || restored == nil {
+		t.Fatalf("Restored session not found in store: %v", err)
+	} else if restored.KeySource != event.KeySourceBackup || restored.KeyBackupVersion != version {
+		t.Errorf("Unexpected restored session metadata: source %q, version %q", restored.KeySource, restored.KeyBackupVersion)
+	}
+
+	if _, err = machine2.RestoreRoomKeyFromBackup("room3", "unknown"); !errors.Is(err, mautrix.MNotFound) {
+		t.Errorf("Expected M_NOT_FOUND for unknown session, got %v", err)
+	}
+}
+
+func TestOlmMachineRestoreFromBackup(t *testing.T) {
+	server := newKeyBackupTestServer()
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	machine.Client.HomeserverURL = serverURL
+	_, backupKey, err := machine.CreateKeyBackupVersion(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to create key backup version: %v", err)
+	}
+	signingKey, identityKey := machine.account.Keys()
+	var sessionKeys []string
+	for _, roomID := range []id.RoomID{"room1", "room1", "room1", "room2", "room2"} {
+		session := NewOutboundGroupSession(roomID, nil)
+		sessionKeys = append(sessionKeys, session.Internal.Key())
+		machine.createGroupSession(identityKey, signingKey, roomID, session.ID(), session.Internal.Key(), "test")
+	}
+	if err = machine.UploadPendingKeyBackups(context.Background()); err != nil {
+		t.Fatalf("Failed to upload pending sessions: %v", err)
+	} else if server.Count() != 5 {
+		t.Fatalf("Expected 5 sessions in backup, got %d", server.Count())
+	}
+
+	machine2, storeFileName2 := newMachineWithDevice(t, "user1", "device2")
+	defer os.Remove(storeFileName2)
+	machine2.Client.HomeserverURL = serverURL
+	machine2.KeyBackupBatchSize = 2
+	if err = machine2.EnableKeyBackup("", backupKey); err != nil {
+		t.Fatalf("Failed to enable key backup on second device: %v", err)
+	}
+	// The second device already has one of the sessions, which shouldn't be imported again.
+	existing, err := NewInboundGroupSession(identityKey, signingKey, "room1", sessionKeys[0])
+	if err != nil {
+		t.Fatalf("Failed to create inbound group session: %v", err)
+	}
+	machine2.CryptoStore.PutGroupSession("room1", identityKey, existing.ID(), existing)
+
+	room2 := id.RoomID("room2")
+	imported, total, err := machine2.RestoreFromBackup(context.Background(), &room2, nil)
+	if err != nil {
+		t.Fatalf("Failed to restore room2 from backup: %v", err)
+	} else if imported != 2 || total != 2 {
+		t.Errorf("Expected 2/2 sessions to be restored for room2, got %d/%d", imported, total)
+	}
+	if sessions, _ := machine2.CryptoStore.GetGroupSessionsForRoom("room1"); len(sessions) != 1 {
+		t.Errorf("Expected room1 to be untouched by room2 restore, got %d sessions", len(sessions))
+	}
+
+	// Only joined rooms are restored by default, so room1 needs to be restored separately
+	server.lock.Lock()
+	server.joinedRooms = []id.RoomID{"room2", "room4"}
+	server.roomRequests = 0
+	server.lock.Unlock()
+	imported, total, err = machine2.RestoreFromBackup(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to restore joined rooms from backup: %v", err)
+	} else if imported != 0 || total != 2 {
+		t.Errorf("Expected 0/2 sessions to be restored for joined rooms, got %d/%d", imported, total)
+	}
+
+	var progress [][2]int
+	imported, total, err = machine2.RestoreRoomsFromBackup(context.Background(), []id.RoomID{"room1", "room3", "room2"}, func(done, total int) {
+		progress = append(progress, [2]int{done, total})
+	})
+	if err != nil {
+		t.Fatalf("Failed to restore from backup: %v", err)
+	} else if imported != 2 || total != 5 {
+		t.Errorf("Expected 2/5 sessions to be restored, got %d/%d", imported, total)
+	}
+	if len(progress) != 3 || progress[0] != [2]int{2, 3} || progress[len(progress)-1] != [2]int{5, 5} {
+		t.Errorf("Unexpected progress callbacks: %v", progress)
+	}
+	if sessions, _ := machine2.CryptoStore.GetAllGroupSessions(); len(sessions) != 5 {
+		t.Errorf("Expected 5 sessions in store after restoring, got %d", len(sessions))
+	}
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.fullRequests != 0 {
+		t.Errorf("Expected the whole backup to never be requested, got %d requests", server.fullRequests)
+	} else if server.roomRequests != 5 {
+		t.Errorf("Expected 5 per-room requests, got %d", server.roomRequests)
+	}
+}
+
+func TestOlmMachineKeyBackupAESHMAC(t *testing.T) {
+	server := newKeyBackupTestServer()
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	machine.Client.HomeserverURL = serverURL
+	machine.KeyBackupAlgorithm = id.KeyBackupAlgorithmMegolmBackupAESHMAC
+	_, backupKey, err := machine.CreateKeyBackupVersion(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to create key backup version: %v", err)
+	} else if backupKey.Algorithm() != id.KeyBackupAlgorithmMegolmBackupAESHMAC {
+		t.Errorf("Unexpected key backup key algorithm %s", backupKey.Algorithm())
+	}
+	signingKey, identityKey := machine.account.Keys()
+	session := NewOutboundGroupSession("room1", nil)
+	machine.createGroupSession(identityKey, signingKey, "room1", session.ID(), session.Internal.Key(), "test")
+	if err = machine.UploadPendingKeyBackups(context.Background()); err != nil {
+		t.Fatalf("Failed to upload pending sessions: %v", err)
+	} else if server.Count() != 1 {
+		t.Fatalf("Expected 1 session in backup, got %d", server.Count())
+	}
+
+	machine2, storeFileName2 := newMachineWithDevice(t, "user1", "device2")
+	defer os.Remove(storeFileName2)
+	machine2.Client.HomeserverURL = serverURL
+	// Symmetric backups can't be used without the key, even for uploading.
+	if err = machine2.EnableKeyBackup("", nil); !errors.Is(err, backup.ErrPrivateKeyRequired) {
+		t.Errorf("Expected ErrPrivateKeyRequired when enabling backup without key, got %v", err)
+	}
+	wrongKey, _ := backup.NewMegolmBackupKey()
+	if err = machine2.EnableKeyBackup("", wrongKey); !errors.Is(err, backup.ErrMismatchingKey) {
+		t.Errorf("Expected ErrMismatchingKey when enabling backup with key of wrong algorithm, got %v", err)
+	}
+	if err = machine2.EnableKeyBackup("", backupKey); err != nil {
+		t.Fatalf("Failed to enable key backup on second device: %v", err)
+	}
+	imported, total, err := machine2.RestoreFromBackup(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to restore from backup: %v", err)
+	} else if imported != 1 || total != 1 {
+		t.Errorf("Expected 1/1 sessions to be restored, got %d/%d", imported, total)
+	}
+	if restored, err := machine2.CryptoStore.GetGroupSession("room1", identityKey, session.ID()); err != nil || restored == nil {
+		t.Errorf("Restored session not found in store: %v", err)
+	}
+}
+
+func TestOlmMachineVerifyBackupVersion(t *testing.T) {
+	server := newKeyBackupTestServer()
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	machine.Client.HomeserverURL = serverURL
+	version, _, err := machine.CreateKeyBackupVersion(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to create key backup version: %v", err)
+	}
+	trust, err := machine.VerifyBackupVersion(context.Background(), version)
+	if err != nil {
+		t.Fatalf("Failed to verify key backup version: %v", err)
+	} else if !trust.Trusted || len(trust.Signatures) != 1 || !trust.Signatures[0].Valid {
+		t.Errorf("Expected backup signed by own device to be trusted, got %+v", trust)
+	}
+
+	machine2, storeFileName2 := newMachineWithDevice(t, "user1", "device2")
+	defer os.Remove(storeFileName2)
+	machine2.Client.HomeserverURL = serverURL
+	// The second device doesn't know the first one, so it can't trust the backup without the key.
+	if trust, err = machine2.VerifyBackupVersion(context.Background(), ""); err != nil {
+		t.Fatalf("Failed to verify key backup version on second device: %v", err)
+	} else if trust.Trusted || len(trust.Signatures) != 1 || trust.Signatures[0].Valid {
+		t.Errorf("Expected backup signed by unknown device to be untrusted, got %+v", trust)
+	}
+	if err = machine2.EnableKeyBackup("", nil); err != nil {
+		t.Fatalf("Failed to enable key backup on second device: %v", err)
+	} else if err = machine2.UploadPendingKeyBackups(context.Background()); !errors.Is(err, ErrKeyBackupNotTrusted) {
+		t.Errorf("Expected ErrKeyBackupNotTrusted when uploading to untrusted backup, got %v", err)
+	}
+
+	device := machine.OwnIdentity()
+	if err = machine2.CryptoStore.PutDevice(device.UserID, device); err != nil {
+		t.Fatalf("Failed to store device: %v", err)
+	}
+	if trust, err = machine2.VerifyBackupVersion(context.Background(), ""); err != nil {
+		t.Fatalf("Failed to verify key backup version on second device: %v", err)
+	} else if !trust.Trusted || trust.Signatures[0].Device == nil || trust.Signatures[0].Device.DeviceID != device.DeviceID {
+		t.Errorf("Expected backup signed by verified device to be trusted, got %+v", trust)
+	}
+
+	// Changing the auth data invalidates the signature.
+	server.lock.Lock()
+	server.version.AuthData, _ = sjson.SetBytes(server.version.AuthData, "public_key", "tampered")
+	server.lock.Unlock()
+	if trust, err = machine2.VerifyBackupVersion(context.Background(), ""); err != nil {
+		t.Fatalf("Failed to verify key backup version on second device: %v", err)
+	} else if trust.Trusted || trust.Signatures[0].Valid {
+		t.Errorf("Expected backup with modified auth data to be untrusted, got %+v", trust)
+	}
+}
+
+func TestOlmMachineVerifyBackupVersionMasterKey(t *testing.T) {
+	server := newKeyBackupTestServer()
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	machine.Client.HomeserverURL = serverURL
+	keys, err := machine.GenerateCrossSigningKeys()
+	if err != nil {
+		t.Fatalf("Failed to generate cross-signing keys: %v", err)
+	}
+	machine.CrossSigningKeys = keys
+	if _, _, err = machine.CreateKeyBackupVersion(context.Background()); err != nil {
+		t.Fatalf("Failed to create key backup version: %v", err)
+	}
+
+	machine2, storeFileName2 := newMachineWithDevice(t, "user1", "device2")
+	defer os.Remove(storeFileName2)
+	machine2.Client.HomeserverURL = serverURL
+	masterKey := keys.MasterKey.PublicKey
+	if err = machine2.CryptoStore.PutCrossSigningKey(machine2.Client.UserID, id.XSUsageMaster, masterKey); err != nil {
+		t.Fatalf("Failed to store master key: %v", err)
+	}
+	findMasterKeySignature := func(trust *KeyBackupTrust) *KeyBackupSignature {
+		for i, sig := range trust.Signatures {
+			if sig.MasterKey {
+				return &trust.Signatures[i]
+			}
+		}
+		t.Fatalf("Master key signature not found in %+v", trust)
+		return nil
+	}
+	// The master key the server returned hasn't been verified by the second device.
+	trust, err := machine2.VerifyBackupVersion(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Failed to verify key backup version: %v", err)
+	} else if sig := findMasterKeySignature(trust); !sig.Valid || sig.Trusted || trust.Trusted {
+		t.Errorf("Expected backup signed by unverified master key to be untrusted, got %+v", trust)
+	}
+
+	ownSigningKey := machine2.OwnIdentity().SigningKey
+	if err = machine2.CryptoStore.PutSignature(machine2.Client.UserID, masterKey, machine2.Client.UserID, ownSigningKey, "sig"); err != nil {
+		t.Fatalf("Failed to store signature: %v", err)
+	}
+	if trust, err = machine2.VerifyBackupVersion(context.Background(), ""); err != nil {
+		t.Fatalf("Failed to verify key backup version: %v", err)
+	} else if sig := findMasterKeySignature(trust); !sig.Valid || !sig.Trusted || !trust.Trusted {
+		t.Errorf("Expected backup signed by master key signed by own device to be trusted, got %+v", trust)
+	}
+}
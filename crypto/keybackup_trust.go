@@ -0,0 +1,134 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/signatures"
+	"maunium.net/go/mautrix/id"
+)
+
+// KeyBackupSignature is a single signature of our own user in the auth data of a key backup version.
+type KeyBackupSignature struct {
+	KeyID id.KeyID
+	// Device is the device that made the signature, or nil if the signature was made by the master key
+	// or by a device that isn't known.
+	Device *DeviceIdentity
+	// MasterKey is true if the signature was made by our cross-signing master key. The signature is only trusted
+	// if the master key itself is trusted, i.e. its private key is available locally or it's been signed by this device.
+	MasterKey bool
+	// Valid is true if the signing key is known and the signature matches it.
+	Valid bool
+	// Trusted is true if the signature is valid and the signing key is trusted.
+	Trusted bool
+}
+
+// KeyBackupTrust is the result of verifying the signatures of a key backup version.
+type KeyBackupTrust struct {
+	Version    string
+	Algorithm  id.KeyBackupAlgorithm
+	Signatures []KeyBackupSignature
+	// Trusted is true if at least one of the signatures is valid and made by a trusted key.
+	Trusted bool
+}
+
+// VerifyBackupVersion fetches the given key backup version (or the latest version if version is empty) and checks
+// the signatures in its auth data. A backup is trusted if it's been signed by our trusted cross-signing master key,
+// by this device, or by another one of our devices that is trusted (see IsDeviceTrusted).
+//
+// Sessions are only uploaded automatically to trusted backups, so this can be used to check whether a backup
+// version should be enabled (or re-signed) before calling EnableKeyBackup.
+func (mach *OlmMachine) VerifyBackupVersion(ctx context.Context, version string) (*KeyBackupTrust, error) {
+	resp, err := mach.getKeyBackupVersionInfo(version)
+	if err != nil {
+		return nil, err
+	} else if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return mach.verifyKeyBackupSignatures(resp), nil
+}
+
+func (mach *OlmMachine) getKeyBackupVersionInfo(version string) (resp *mautrix.RespRoomKeysVersion, err error) {
+	if len(version) == 0 {
+		resp, err = mach.Client.GetKeyBackupLatestVersion()
+	} else {
+		resp, err = mach.Client.GetKeyBackupVersion(version)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to get key backup version info: %w", err)
+	}
+	return
+}
+
+func (mach *OlmMachine) verifyKeyBackupSignatures(resp *mautrix.RespRoomKeysVersion) *KeyBackupTrust {
+	trust := &KeyBackupTrust{Version: resp.Version, Algorithm: resp.Algorithm}
+	userID := mach.Client.UserID
+	var masterKey id.Ed25519
+	if ownKeys := mach.GetOwnCrossSigningPublicKeys(); ownKeys != nil {
+		masterKey = ownKeys.MasterKey
+	}
+	var authData struct {
+		Signatures map[id.UserID]map[id.KeyID]string `json:"signatures"`
+	}
+	if err := json.Unmarshal(resp.AuthData, &authData); err != nil {
+		mach.Log.Warn("Failed to parse auth data of key backup version %s: %v", resp.Version, err)
+		return trust
+	}
+	for keyID := range authData.Signatures[userID] {
+		algorithm, keyName := keyID.Parse()
+		if algorithm != id.KeyAlgorithmEd25519 {
+			continue
+		}
+		sig := KeyBackupSignature{KeyID: keyID}
+		var signingKey id.Ed25519
+		if len(masterKey) > 0 && keyName == masterKey.String() {
+			sig.MasterKey = true
+			signingKey = masterKey
+		} else if keyName == mach.Client.DeviceID.String() {
+			sig.Device = mach.OwnIdentity()
+			signingKey = sig.Device.SigningKey
+		} else if device, err := mach.CryptoStore.GetDevice(userID, id.DeviceID(keyName)); err != nil {
+			mach.Log.Warn("Failed to get device %s to verify key backup signature: %v", keyName, err)
+		} else if device != nil {
+			sig.Device = device
+			signingKey = device.SigningKey
+		}
+		if len(signingKey) > 0 {
+			ok, err := signatures.VerifySignatureJSON(resp.AuthData, userID, keyName, signingKey)
+			if err != nil {
+				mach.Log.Debug("Failed to verify key backup signature %s: %v", keyID, err)
+			}
+			sig.Valid = ok
+			if sig.MasterKey {
+				sig.Trusted = ok && mach.isOwnMasterKeyTrusted(masterKey)
+			} else {
+				sig.Trusted = ok && mach.IsDeviceTrusted(sig.Device)
+			}
+		}
+		trust.Trusted = trust.Trusted || sig.Trusted
+		trust.Signatures = append(trust.Signatures, sig)
+	}
+	return trust
+}
+
+// isOwnMasterKeyTrusted checks whether the given master key of our own user can be trusted. The server can return
+// any master key, so it's only trusted if we have the private key or if this device has signed it.
+func (mach *OlmMachine) isOwnMasterKeyTrusted(masterKey id.Ed25519) bool {
+	if localKey, err := mach.KeyProvider.PublicKey(KeyUsageMaster); err == nil && localKey == masterKey {
+		return true
+	}
+	signed, err := mach.CryptoStore.IsKeySignedBy(mach.Client.UserID, masterKey, mach.Client.UserID, mach.OwnIdentity().SigningKey)
+	if err != nil {
+		mach.Log.Warn("Failed to check if master key %s is signed by this device: %v", masterKey, err)
+		return false
+	}
+	return signed
+}
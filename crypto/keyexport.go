@@ -11,18 +11,18 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
-	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"math"
+	"io"
 
 	"golang.org/x/crypto/pbkdf2"
 
 	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/crypto/utils"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -67,7 +67,7 @@ func computeKey(passphrase string, salt []byte, rounds int) (encryptionKey, hash
 
 func makeExportIV() []byte {
 	iv := make([]byte, 16)
-	_, err := rand.Read(iv)
+	_, err := utils.ReadRandom(iv)
 	if err != nil {
 		panic(olm.NotEnoughGoRandom)
 	}
@@ -78,7 +78,7 @@ func makeExportIV() []byte {
 
 func makeExportKeys(passphrase string) (encryptionKey, hashKey, salt, iv []byte) {
 	salt = make([]byte, 16)
-	_, err := rand.Read(salt)
+	_, err := utils.ReadRandom(salt)
 	if err != nil {
 		panic(olm.NotEnoughGoRandom)
 	}
@@ -89,74 +89,96 @@ func makeExportKeys(passphrase string) (encryptionKey, hashKey, salt, iv []byte)
 	return
 }
 
-func exportSessions(sessions []*InboundGroupSession) ([]ExportedSession, error) {
-	export := make([]ExportedSession, len(sessions))
+func exportSession(session *InboundGroupSession) (*ExportedSession, error) {
+	key, err := session.Internal.Export(session.Internal.FirstKnownIndex())
+	if err != nil {
+		return nil, fmt.Errorf("failed to export session: %w", err)
+	}
+	return &ExportedSession{
+		Algorithm:         id.AlgorithmMegolmV1,
+		ForwardingChains:  session.ForwardingChains,
+		RoomID:            session.RoomID,
+		SenderKey:         session.SenderKey,
+		SenderClaimedKeys: SenderClaimedKeys{Ed25519: session.SigningKey},
+		SessionID:         session.ID(),
+		SessionKey:        key,
+	}, nil
+}
+
+// writeExportedSessionsJSON writes the given sessions into the writer as a JSON array one session at a time,
+// so that the whole array never needs to be in memory at once.
+func writeExportedSessionsJSON(w io.Writer, sessions []*InboundGroupSession) error {
+	if _, err := w.Write([]byte{'['}); err != nil {
+		return err
+	}
 	for i, session := range sessions {
-		key, err := session.Internal.Export(session.Internal.FirstKnownIndex())
+		exported, err := exportSession(session)
 		if err != nil {
-			return nil, fmt.Errorf("failed to export session: %w", err)
+			return err
 		}
-		export[i] = ExportedSession{
-			Algorithm:         id.AlgorithmMegolmV1,
-			ForwardingChains:  session.ForwardingChains,
-			RoomID:            session.RoomID,
-			SenderKey:         session.SenderKey,
-			SenderClaimedKeys: SenderClaimedKeys{},
-			SessionID:         session.ID(),
-			SessionKey:        key,
+		data, err := json.Marshal(exported)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			data = append([]byte{','}, data...)
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
 		}
 	}
-	return export, nil
+	_, err := w.Write([]byte{']'})
+	return err
 }
 
-func exportSessionsJSON(sessions []*InboundGroupSession) ([]byte, error) {
-	exportedSessions, err := exportSessions(sessions)
-	if err != nil {
-		return nil, err
-	}
-	return json.Marshal(exportedSessions)
+// lineWrapWriter inserts a newline after every exportLineLengthLimit bytes written to it.
+type lineWrapWriter struct {
+	target io.Writer
+	column int
 }
 
-func min(a, b int) int {
-	if a > b {
-		return b
+func (lw *lineWrapWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		chunk := exportLineLengthLimit - lw.column
+		if chunk > len(data) {
+			chunk = len(data)
+		}
+		n, err := lw.target.Write(data[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		data = data[chunk:]
+		lw.column += chunk
+		if lw.column == exportLineLengthLimit {
+			if _, err = lw.target.Write([]byte{'\n'}); err != nil {
+				return written, err
+			}
+			lw.column = 0
+		}
 	}
-	return a
+	return written, nil
 }
 
-func formatKeyExportData(data []byte) []byte {
-	base64Data := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
-	base64.StdEncoding.Encode(base64Data, data)
-
-	// Prefix + data and newline for each 76 characters of data + suffix
-	outputLength := len(exportPrefix) +
-		len(base64Data) + int(math.Ceil(float64(len(base64Data))/exportLineLengthLimit)) +
-		len(exportSuffix)
-
-	var buf bytes.Buffer
-	buf.Grow(outputLength)
-	buf.WriteString(exportPrefix)
-	for ptr := 0; ptr < len(base64Data); ptr += exportLineLengthLimit {
-		buf.Write(base64Data[ptr:min(ptr+exportLineLengthLimit, len(base64Data))])
-		buf.WriteRune('\n')
-	}
-	buf.WriteString(exportSuffix)
-	if buf.Len() != buf.Cap() || buf.Len() != outputLength {
-		panic(fmt.Errorf("unexpected length %d / %d / %d", buf.Len(), buf.Cap(), outputLength))
+// Close writes the final newline if the last line is incomplete.
+func (lw *lineWrapWriter) Close() error {
+	if lw.column > 0 {
+		lw.column = 0
+		_, err := lw.target.Write([]byte{'\n'})
+		return err
 	}
-	return buf.Bytes()
+	return nil
 }
 
-// ExportKeys exports the given Megolm sessions with the format specified in the Matrix spec.
+// ExportKeysStream exports the given Megolm sessions into the given writer with the format specified in the Matrix spec.
+// Unlike ExportKeys, the export is encrypted and encoded on the fly, so the whole export never needs to be buffered.
 // See https://matrix.org/docs/spec/client_server/r0.6.1#key-exports
-func ExportKeys(passphrase string, sessions []*InboundGroupSession) ([]byte, error) {
+func ExportKeysStream(w io.Writer, passphrase string, sessions []*InboundGroupSession) error {
 	// Make all the keys necessary for exporting
 	encryptionKey, hashKey, salt, iv := makeExportKeys(passphrase)
-	// Export all the given sessions and put them in JSON
-	unencryptedData, err := exportSessionsJSON(sessions)
-	if err != nil {
-		return nil, err
-	}
+	// encryptionKey and hashKey are slices of the same PBKDF2 output
+	defer utils.WipeBytes(encryptionKey[:cap(encryptionKey)])
 
 	// The export data consists of:
 	// 1 byte of export format version
@@ -166,24 +188,74 @@ func ExportKeys(passphrase string, sessions []*InboundGroupSession) ([]byte, err
 	// the encrypted export data
 	// 32 bytes of the hash of all the data above
 
-	exportData := make([]byte, exportHeaderLength+len(unencryptedData)+exportHashLength)
-	dataWithoutHashLength := len(exportData) - exportHashLength
+	if _, err := io.WriteString(w, exportPrefix); err != nil {
+		return err
+	}
+	lineWriter := &lineWrapWriter{target: w}
+	base64Writer := base64.NewEncoder(base64.StdEncoding, lineWriter)
+	// Everything except the hash itself is included in the HMAC
+	mac := hmac.New(sha256.New, hashKey)
+	dataWriter := io.MultiWriter(base64Writer, mac)
 
 	// Create the header for the export data
-	exportData[0] = exportVersion1
-	copy(exportData[1:17], salt)
-	copy(exportData[17:33], iv)
-	binary.BigEndian.PutUint32(exportData[33:37], defaultPassphraseRounds)
+	header := make([]byte, exportHeaderLength)
+	header[0] = exportVersion1
+	copy(header[1:17], salt)
+	copy(header[17:33], iv)
+	binary.BigEndian.PutUint32(header[33:37], defaultPassphraseRounds)
+	if _, err := dataWriter.Write(header); err != nil {
+		return err
+	}
 
-	// Encrypt data with AES-256-CTR
+	// Encrypt data with AES-256-CTR while it's being written
 	block, _ := aes.NewCipher(encryptionKey)
-	cipher.NewCTR(block, iv).XORKeyStream(exportData[exportHeaderLength:dataWithoutHashLength], unencryptedData)
+	encryptingWriter := &cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: dataWriter}
+	if err := writeExportedSessionsJSON(encryptingWriter, sessions); err != nil {
+		return err
+	}
 
-	// Hash all the data with HMAC-SHA256 and put it at the end
-	mac := hmac.New(sha256.New, hashKey)
-	mac.Write(exportData[:dataWithoutHashLength])
-	mac.Sum(exportData[:dataWithoutHashLength])
+	// Put the hash at the end, then flush the base64 encoder and finish the last line
+	if _, err := base64Writer.Write(mac.Sum(nil)); err != nil {
+		return err
+	} else if err = base64Writer.Close(); err != nil {
+		return err
+	} else if err = lineWriter.Close(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, exportSuffix)
+	return err
+}
+
+// ExportKeys exports the given Megolm sessions with the format specified in the Matrix spec.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#key-exports
+func ExportKeys(passphrase string, sessions []*InboundGroupSession) ([]byte, error) {
+	var buf bytes.Buffer
+	err := ExportKeysStream(&buf, passphrase, sessions)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
-	// Format the export (prefix, base64'd exportData, suffix) and return
-	return formatKeyExportData(exportData), nil
+// ExportKeys exports all Megolm sessions in the crypto store with the format specified in the Matrix spec.
+// If room IDs are given, only sessions in those rooms are exported.
+func (mach *OlmMachine) ExportKeys(w io.Writer, passphrase string, roomIDs ...id.RoomID) error {
+	var sessions []*InboundGroupSession
+	if len(roomIDs) == 0 {
+		var err error
+		sessions, err = mach.CryptoStore.GetAllGroupSessions()
+		if err != nil {
+			return fmt.Errorf("failed to get group sessions from store: %w", err)
+		}
+	} else {
+		for _, roomID := range roomIDs {
+			roomSessions, err := mach.CryptoStore.GetGroupSessionsForRoom(roomID)
+			if err != nil {
+				return fmt.Errorf("failed to get group sessions of %s from store: %w", roomID, err)
+			}
+			sessions = append(sessions, roomSessions...)
+		}
+	}
+	mach.Log.Debug("Exporting %d Megolm sessions", len(sessions))
+	return ExportKeysStream(w, passphrase, sessions)
 }
@@ -0,0 +1,55 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"maunium.net/go/mautrix/crypto/olm"
+)
+
+func TestKeyExportImport(t *testing.T) {
+	machineOut, storeFileNameOut := newMachine(t, "user1")
+	defer os.Remove(storeFileNameOut)
+	machineIn, storeFileNameIn := newMachine(t, "user2")
+	defer os.Remove(storeFileNameIn)
+
+	outbound := olm.NewOutboundGroupSession()
+	igs, err := NewInboundGroupSession(machineOut.account.IdentityKey(), machineOut.account.SigningKey(), "room1", outbound.Key())
+	if err != nil {
+		t.Fatalf("Error creating inbound group session: %v", err)
+	}
+	if err = machineOut.CryptoStore.PutGroupSession("room1", igs.SenderKey, igs.ID(), igs); err != nil {
+		t.Fatalf("Error storing inbound group session: %v", err)
+	}
+
+	var export bytes.Buffer
+	if err = machineOut.ExportKeys(&export, "passphrase"); err != nil {
+		t.Fatalf("Error exporting keys: %v", err)
+	}
+
+	if _, _, err = machineIn.ImportKeysFrom("wrong passphrase", bytes.NewReader(export.Bytes())); !errors.Is(err, ErrMismatchingExportHash) {
+		t.Errorf("Expected hash mismatch with wrong passphrase, got %v", err)
+	}
+	imported, total, err := machineIn.ImportKeysFrom("passphrase", &export)
+	if err != nil {
+		t.Fatalf("Error importing keys: %v", err)
+	} else if imported != 1 || total != 1 {
+		t.Errorf("Expected 1/1 sessions to be imported, got %d/%d", imported, total)
+	}
+
+	importedSession, err := machineIn.CryptoStore.GetGroupSession("room1", igs.SenderKey, igs.ID())
+	if err != nil || importedSession == nil {
+		t.Fatalf("Imported session not found in store: %v", err)
+	}
+	if importedSession.SigningKey != igs.SigningKey {
+		t.Errorf("Expected claimed ed25519 key %s after import, got %s", igs.SigningKey, importedSession.SigningKey)
+	}
+}
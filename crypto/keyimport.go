@@ -17,14 +17,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 
 	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
 var (
 	ErrMissingExportPrefix          = errors.New("invalid Matrix key export: missing prefix")
 	ErrMissingExportSuffix          = errors.New("invalid Matrix key export: missing suffix")
+	ErrExportTooShort               = errors.New("invalid Matrix key export: data too short")
 	ErrUnsupportedExportVersion     = errors.New("unsupported Matrix key export format version")
 	ErrMismatchingExportHash        = errors.New("mismatching hash; incorrect passphrase?")
 	ErrInvalidExportedAlgorithm     = errors.New("session has unknown algorithm")
@@ -54,7 +59,9 @@ func decodeKeyExport(data []byte) ([]byte, error) {
 }
 
 func decryptKeyExport(passphrase string, exportData []byte) ([]ExportedSession, error) {
-	if exportData[0] != exportVersion1 {
+	if len(exportData) < exportHeaderLength+exportHashLength {
+		return nil, ErrExportTooShort
+	} else if exportData[0] != exportVersion1 {
 		return nil, ErrUnsupportedExportVersion
 	}
 
@@ -68,6 +75,8 @@ func decryptKeyExport(passphrase string, exportData []byte) ([]ExportedSession,
 
 	// Compute the encryption and hash keys from the passphrase and salt
 	encryptionKey, hashKey := computeKey(passphrase, salt, int(passphraseRounds))
+	// encryptionKey and hashKey are slices of the same PBKDF2 output
+	defer utils.WipeBytes(encryptionKey[:cap(encryptionKey)])
 
 	// Compute and verify the hash. If it doesn't match, the passphrase is probably wrong
 	mac := hmac.New(sha256.New, hashKey)
@@ -108,13 +117,20 @@ func (mach *OlmMachine) importExportedRoomKey(session ExportedSession) (bool, er
 		RoomID:     session.RoomID,
 		// TODO should we add something here to mark the signing key as unverified like key requests do?
 		ForwardingChains: session.ForwardingChains,
+		KeySource:        event.KeySourceImport,
 	}
-	existingIGS, _ := mach.CryptoStore.GetGroupSession(igs.RoomID, igs.SenderKey, igs.ID())
+	return mach.storeImportedGroupSession(igs)
+}
+
+// storeImportedGroupSession stores an inbound group session that was imported from a key export or a key backup,
+// unless there's already a session with the same or a lower first known index in the store.
+func (mach *OlmMachine) storeImportedGroupSession(igs *InboundGroupSession) (bool, error) {
+	existingIGS, _ := mach.getGroupSession(igs.RoomID, igs.SenderKey, igs.ID())
 	if existingIGS != nil && existingIGS.Internal.FirstKnownIndex() <= igs.Internal.FirstKnownIndex() {
 		// We already have an equivalent or better session in the store, so don't override it.
 		return false, nil
 	}
-	err = mach.CryptoStore.PutGroupSession(igs.RoomID, igs.SenderKey, igs.ID(), igs)
+	err := mach.putGroupSession(igs.RoomID, igs.SenderKey, igs.ID(), igs)
 	if err != nil {
 		return false, fmt.Errorf("failed to store imported session: %w", err)
 	}
@@ -148,3 +164,14 @@ func (mach *OlmMachine) ImportKeys(passphrase string, data []byte) (int, int, er
 	}
 	return count, len(sessions), nil
 }
+
+// ImportKeysFrom reads a key export from the given reader and imports it like ImportKeys.
+//
+// The whole export is read into memory, as the hash at the end needs to be verified before any sessions are imported.
+func (mach *OlmMachine) ImportKeysFrom(passphrase string, r io.Reader) (int, int, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read key export: %w", err)
+	}
+	return mach.ImportKeys(passphrase, data)
+}
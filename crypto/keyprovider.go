@@ -0,0 +1,125 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"fmt"
+
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/id"
+)
+
+// KeyUsage identifies which of the user's signing keys an operation should use.
+type KeyUsage string
+
+const (
+	// KeyUsageDevice is the ed25519 key of the current device.
+	KeyUsageDevice KeyUsage = "device"
+	// KeyUsageMaster is the cross-signing master key.
+	KeyUsageMaster = KeyUsage(id.XSUsageMaster)
+	// KeyUsageSelfSigning is the cross-signing key used for signing the user's own devices.
+	KeyUsageSelfSigning = KeyUsage(id.XSUsageSelfSigning)
+	// KeyUsageUserSigning is the cross-signing key used for signing other users' master keys.
+	KeyUsageUserSigning = KeyUsage(id.XSUsageUserSigning)
+)
+
+// KeyProvider performs signing operations with the user's ed25519 keys.
+//
+// The default implementation uses the pickled olm account and the cached cross-signing keys in the OlmMachine,
+// but it can be replaced to delegate signing to e.g. a PKCS#11 token, a TPM or an OS keychain. Note that the
+// device key is also used by the olm account for the Olm protocol itself, so a custom provider must sign with
+// the same key as the olm account.
+type KeyProvider interface {
+	// PublicKey returns the public key for the given usage, or an error if the key isn't available.
+	PublicKey(usage KeyUsage) (id.Ed25519, error)
+	// SignJSON signs the canonical JSON form of the given object with the key for the given usage
+	// and returns the unpadded base64 signature.
+	SignJSON(usage KeyUsage, obj interface{}) (string, error)
+}
+
+// olmKeyProvider is the default KeyProvider, which uses the keys stored in the OlmMachine.
+type olmKeyProvider struct {
+	mach *OlmMachine
+}
+
+var _ KeyProvider = (*olmKeyProvider)(nil)
+
+func getCrossSigningKey(keys *CrossSigningKeysCache, usage KeyUsage) (*olm.PkSigning, error) {
+	switch usage {
+	case KeyUsageMaster:
+		if keys == nil || keys.MasterKey == nil {
+			return nil, ErrCrossSigningKeysNotCached
+		}
+		return keys.MasterKey, nil
+	case KeyUsageSelfSigning:
+		if keys == nil || keys.SelfSigningKey == nil {
+			return nil, ErrSelfSigningKeyNotCached
+		}
+		return keys.SelfSigningKey, nil
+	case KeyUsageUserSigning:
+		if keys == nil || keys.UserSigningKey == nil {
+			return nil, ErrUserSigningKeyNotCached
+		}
+		return keys.UserSigningKey, nil
+	default:
+		return nil, fmt.Errorf("unknown key usage %q", usage)
+	}
+}
+
+func (okp *olmKeyProvider) PublicKey(usage KeyUsage) (id.Ed25519, error) {
+	if usage == KeyUsageDevice {
+		account := okp.mach.getAccount()
+		if account == nil {
+			return "", ErrOlmAccountNotLoaded
+		}
+		return account.SigningKey(), nil
+	}
+	key, err := getCrossSigningKey(okp.mach.CrossSigningKeys, usage)
+	if err != nil {
+		return "", err
+	}
+	return key.PublicKey, nil
+}
+
+func (okp *olmKeyProvider) SignJSON(usage KeyUsage, obj interface{}) (string, error) {
+	if usage == KeyUsageDevice {
+		account := okp.mach.getAccount()
+		if account == nil {
+			return "", ErrOlmAccountNotLoaded
+		}
+		return account.Internal.SignJSON(obj)
+	}
+	key, err := getCrossSigningKey(okp.mach.CrossSigningKeys, usage)
+	if err != nil {
+		return "", err
+	}
+	return key.SignJSON(obj)
+}
+
+// crossSigningKeyProvider is a KeyProvider that only supports signing with the given cross-signing keys.
+// It's used for signing new cross-signing keys that the machine's KeyProvider doesn't have yet.
+type crossSigningKeyProvider struct {
+	keys *CrossSigningKeysCache
+}
+
+var _ KeyProvider = (*crossSigningKeyProvider)(nil)
+
+func (cskp *crossSigningKeyProvider) PublicKey(usage KeyUsage) (id.Ed25519, error) {
+	key, err := getCrossSigningKey(cskp.keys, usage)
+	if err != nil {
+		return "", err
+	}
+	return key.PublicKey, nil
+}
+
+func (cskp *crossSigningKeyProvider) SignJSON(usage KeyUsage, obj interface{}) (string, error) {
+	key, err := getCrossSigningKey(cskp.keys, usage)
+	if err != nil {
+		return "", err
+	}
+	return key.SignJSON(obj)
+}
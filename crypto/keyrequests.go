@@ -0,0 +1,149 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type outgoingKeyRequest struct {
+	requestID string
+	roomID    id.RoomID
+	senderKey id.SenderKey
+	sessionID id.SessionID
+	users     map[id.UserID][]id.DeviceID
+	cancel    context.CancelFunc
+}
+
+// RequestRoomKeyWithRetry sends a key request for the given session and keeps tracking it in the background.
+//
+// The request is re-sent every KeyRequestRetryInterval until the session is received in any way, the context is
+// cancelled, CancelRoomKeyRequest is called or KeyRequestMaxAttempts requests have been sent. After that, a
+// cancellation is sent to all the devices the request was sent to.
+//
+// If users is nil, the request is sent to all of our own devices. If a request for the same session is already being
+// tracked, this does nothing. This is meant to be called when decrypting an event fails with NoSessionFound.
+func (mach *OlmMachine) RequestRoomKeyWithRetry(ctx context.Context, roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, users map[id.UserID][]id.DeviceID) error {
+	if users == nil {
+		users = map[id.UserID][]id.DeviceID{mach.Client.UserID: {"*"}}
+	}
+	mach.outgoingKeyRequestsLock.Lock()
+	if _, ok := mach.outgoingKeyRequests[sessionID]; ok {
+		mach.outgoingKeyRequestsLock.Unlock()
+		mach.Log.Trace("Not sending key request for %s: a request is already in progress", sessionID)
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	req := &outgoingKeyRequest{
+		requestID: mach.Client.TxnID(),
+		roomID:    roomID,
+		senderKey: senderKey,
+		sessionID: sessionID,
+		users:     users,
+		cancel:    cancel,
+	}
+	mach.outgoingKeyRequests[sessionID] = req
+	mach.outgoingKeyRequestsLock.Unlock()
+
+	err := mach.SendRoomKeyRequest(roomID, senderKey, sessionID, req.requestID, users)
+	if err != nil {
+		mach.removeOutgoingKeyRequest(req)
+		cancel()
+		return err
+	}
+	mach.Log.Debug("Sent key request %s for %s, waiting for response", req.requestID, sessionID)
+	go mach.trackKeyRequest(ctx, req)
+	return nil
+}
+
+// CancelRoomKeyRequest stops retrying the key request for the given session and sends a cancellation for it.
+// It returns false if there was no key request in progress for the session.
+func (mach *OlmMachine) CancelRoomKeyRequest(sessionID id.SessionID) bool {
+	mach.outgoingKeyRequestsLock.Lock()
+	req, ok := mach.outgoingKeyRequests[sessionID]
+	mach.outgoingKeyRequestsLock.Unlock()
+	if ok {
+		req.cancel()
+	}
+	return ok
+}
+
+// HasPendingKeyRequest returns whether there's a key request being tracked for the given session.
+func (mach *OlmMachine) HasPendingKeyRequest(sessionID id.SessionID) bool {
+	mach.outgoingKeyRequestsLock.Lock()
+	_, ok := mach.outgoingKeyRequests[sessionID]
+	mach.outgoingKeyRequestsLock.Unlock()
+	return ok
+}
+
+func (mach *OlmMachine) removeOutgoingKeyRequest(req *outgoingKeyRequest) {
+	mach.outgoingKeyRequestsLock.Lock()
+	if mach.outgoingKeyRequests[req.sessionID] == req {
+		delete(mach.outgoingKeyRequests, req.sessionID)
+	}
+	mach.outgoingKeyRequestsLock.Unlock()
+}
+
+func (mach *OlmMachine) trackKeyRequest(ctx context.Context, req *outgoingKeyRequest) {
+	defer mach.cancelKeyRequest(req)
+	received := mach.getSessionWaiter(req.sessionID)
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-received:
+			mach.Log.Debug("Session %s for key request %s was received", req.sessionID, req.requestID)
+			return
+		case <-ctx.Done():
+			mach.Log.Debug("Key request %s for %s was cancelled: %v", req.requestID, req.sessionID, ctx.Err())
+			return
+		case <-time.After(mach.KeyRequestRetryInterval):
+		}
+		sess, err := mach.CryptoStore.GetGroupSession(req.roomID, req.senderKey, req.sessionID)
+		if sess != nil {
+			mach.Log.Debug("Session %s for key request %s appeared in store", req.sessionID, req.requestID)
+			return
+		} else if err != nil {
+			mach.Log.Debug("Stopping key request %s for %s: %v", req.requestID, req.sessionID, err)
+			return
+		} else if attempt >= mach.KeyRequestMaxAttempts {
+			mach.Log.Debug("Giving up on key request %s for %s after %d attempts", req.requestID, req.sessionID, attempt)
+			return
+		}
+		mach.Log.Trace("Re-sending key request %s for %s (attempt #%d)", req.requestID, req.sessionID, attempt+1)
+		err = mach.SendRoomKeyRequest(req.roomID, req.senderKey, req.sessionID, req.requestID, req.users)
+		if err != nil {
+			mach.Log.Warn("Failed to re-send key request %s for %s: %v", req.requestID, req.sessionID, err)
+		}
+	}
+}
+
+func (mach *OlmMachine) cancelKeyRequest(req *outgoingKeyRequest) {
+	mach.removeOutgoingKeyRequest(req)
+	req.cancel()
+	cancelContent := &event.Content{
+		Parsed: &event.RoomKeyRequestEventContent{
+			Action:             event.KeyRequestActionCancel,
+			RequestID:          req.requestID,
+			RequestingDeviceID: mach.Client.DeviceID,
+		},
+	}
+	toDeviceCancel := &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content, len(req.users))}
+	for userID, devices := range req.users {
+		toDeviceCancel.Messages[userID] = make(map[id.DeviceID]*event.Content, len(devices))
+		for _, deviceID := range devices {
+			toDeviceCancel.Messages[userID][deviceID] = cancelContent
+		}
+	}
+	_, err := mach.Client.SendToDevice(event.ToDeviceRoomKeyRequest, toDeviceCancel)
+	if err != nil {
+		mach.Log.Warn("Failed to send cancellation for key request %s: %v", req.requestID, err)
+	}
+}
@@ -19,6 +19,10 @@ import (
 	"maunium.net/go/mautrix/event"
 )
 
+// KeyRequestHandler decides whether a room key requested by the given device should be shared.
+// It returns nil if the key should be shared, or the rejection to send to the requester otherwise.
+type KeyRequestHandler func(*DeviceIdentity, event.RequestedKeyInfo) *KeyShareRejection
+
 type KeyShareRejection struct {
 	Code   event.RoomKeyWithheldCode
 	Reason string
@@ -31,6 +35,7 @@ var (
 	KeyShareRejectBlacklisted   = KeyShareRejection{event.RoomKeyWithheldBlacklisted, "You have been blacklisted by this device"}
 	KeyShareRejectUnverified    = KeyShareRejection{event.RoomKeyWithheldUnverified, "You have not been verified by this device"}
 	KeyShareRejectOtherUser     = KeyShareRejection{event.RoomKeyWithheldUnauthorized, "This device does not share keys to other users"}
+	KeyShareRejectDisabled      = KeyShareRejection{event.RoomKeyWithheldUnauthorized, "This device does not share keys"}
 	KeyShareRejectUnavailable   = KeyShareRejection{event.RoomKeyWithheldUnavailable, "Requested session ID not found on this device"}
 	KeyShareRejectInternalError = KeyShareRejection{event.RoomKeyWithheldUnavailable, "An internal error occurred while trying to share the requested session"}
 )
@@ -148,9 +153,10 @@ func (mach *OlmMachine) importForwardedRoomKey(evt *DecryptedOlmEvent, content *
 		SenderKey:        content.SenderKey,
 		RoomID:           content.RoomID,
 		ForwardingChains: append(content.ForwardingKeyChain, evt.SenderKey.String()),
+		KeySource:        event.KeySourceForwarded,
 		id:               content.SessionID,
 	}
-	err = mach.CryptoStore.PutGroupSession(content.RoomID, content.SenderKey, content.SessionID, igs)
+	err = mach.putGroupSession(content.RoomID, content.SenderKey, content.SessionID, igs)
 	if err != nil {
 		mach.Log.Error("Failed to store new inbound group session: %v", err)
 		return false
@@ -183,7 +189,14 @@ func (mach *OlmMachine) rejectKeyRequest(rejection KeyShareRejection, device *De
 	}
 }
 
-func (mach *OlmMachine) defaultAllowKeyShare(device *DeviceIdentity, _ event.RequestedKeyInfo) *KeyShareRejection {
+// KeyShareNever is a KeyRequestHandler that rejects all key requests.
+func KeyShareNever(_ *DeviceIdentity, _ event.RequestedKeyInfo) *KeyShareRejection {
+	return &KeyShareRejectDisabled
+}
+
+// KeyShareOwnVerifiedDevices is the default KeyRequestHandler. It only shares keys with the user's own devices that
+// are verified, or with all of the user's own non-blacklisted devices if ShareKeysToUnverifiedDevices is true.
+func (mach *OlmMachine) KeyShareOwnVerifiedDevices(device *DeviceIdentity, _ event.RequestedKeyInfo) *KeyShareRejection {
 	if mach.Client.UserID != device.UserID {
 		mach.Log.Debug("Ignoring key request from a different user (%s)", device.UserID)
 		return &KeyShareRejectOtherUser
@@ -227,7 +240,7 @@ func (mach *OlmMachine) handleRoomKeyRequest(sender id.UserID, content *event.Ro
 		return
 	}
 
-	igs, err := mach.CryptoStore.GetGroupSession(content.Body.RoomID, content.Body.SenderKey, content.Body.SessionID)
+	igs, err := mach.getGroupSession(content.Body.RoomID, content.Body.SenderKey, content.Body.SessionID)
 	if err != nil {
 		mach.Log.Error("Failed to fetch group session to forward to %s/%s: %v", device.UserID, device.DeviceID, err)
 		mach.rejectKeyRequest(KeyShareRejectInternalError, device, content.Body)
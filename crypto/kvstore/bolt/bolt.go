@@ -0,0 +1,106 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package bolt implements crypto.KVBackend with bbolt, which allows using crypto.KVCryptoStore without CGO.
+package bolt
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"maunium.net/go/mautrix/crypto"
+)
+
+// DefaultBucket is the name of the bucket used by Open.
+var DefaultBucket = []byte("mautrix_crypto")
+
+// Backend is a crypto.KVBackend that keeps all keys in a single bucket of a bbolt database.
+type Backend struct {
+	DB     *bbolt.DB
+	Bucket []byte
+}
+
+var _ crypto.KVBackend = (*Backend)(nil)
+
+// New creates a backend that uses the given bucket in the given database. The bucket is created if it doesn't exist.
+// Other buckets in the database aren't touched, so the database can be shared with other data.
+func New(db *bbolt.DB, bucket []byte) (*Backend, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bucket: %w", err)
+	}
+	return &Backend{DB: db, Bucket: bucket}, nil
+}
+
+// Open opens the bbolt database at the given path, creating it if it doesn't exist, and returns a backend that uses
+// DefaultBucket. bbolt only allows one process to open a database at a time, so this fails if the database is still
+// locked by another process after a second.
+func Open(path string) (*Backend, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	backend, err := New(db, DefaultBucket)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return backend, nil
+}
+
+// Close closes the underlying database.
+func (backend *Backend) Close() error {
+	return backend.DB.Close()
+}
+
+func (backend *Backend) View(fn func(tx crypto.KVTx) error) error {
+	return backend.DB.View(func(tx *bbolt.Tx) error {
+		return fn(&boltTx{bucket: tx.Bucket(backend.Bucket)})
+	})
+}
+
+func (backend *Backend) Update(fn func(tx crypto.KVTx) error) error {
+	return backend.DB.Update(func(tx *bbolt.Tx) error {
+		return fn(&boltTx{bucket: tx.Bucket(backend.Bucket)})
+	})
+}
+
+type boltTx struct {
+	bucket *bbolt.Bucket
+}
+
+func (tx *boltTx) Get(key []byte) ([]byte, error) {
+	value := tx.bucket.Get(key)
+	if value == nil {
+		return nil, nil
+	}
+	// Values returned by bbolt are only valid until the transaction ends
+	return append([]byte{}, value...), nil
+}
+
+func (tx *boltTx) Put(key, value []byte) error {
+	return tx.bucket.Put(key, value)
+}
+
+func (tx *boltTx) Delete(key []byte) error {
+	return tx.bucket.Delete(key)
+}
+
+func (tx *boltTx) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	cursor := tx.bucket.Cursor()
+	for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
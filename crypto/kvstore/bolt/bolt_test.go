@@ -0,0 +1,157 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bolt_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/kvstore/bolt"
+	"maunium.net/go/mautrix/id"
+)
+
+func openTestBackend(t *testing.T) (*bolt.Backend, string) {
+	dir, err := ioutil.TempDir("", "mautrix-bolt-test")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	path := filepath.Join(dir, "crypto.db")
+	backend, err := bolt.Open(path)
+	require.NoError(t, err)
+	return backend, path
+}
+
+func TestBackend_Operations(t *testing.T) {
+	backend, _ := openTestBackend(t)
+	defer backend.Close()
+
+	err := backend.Update(func(tx crypto.KVTx) error {
+		for _, key := range []string{"b\x00two", "a\x00one", "b\x00one", "c\x00one", "b"} {
+			if err := tx.Put([]byte(key), []byte("value of "+key)); err != nil {
+				return err
+			}
+		}
+		return tx.Delete([]byte("c\x00one"))
+	})
+	require.NoError(t, err)
+
+	var value []byte
+	err = backend.View(func(tx crypto.KVTx) (err error) {
+		value, err = tx.Get([]byte("a\x00one"))
+		return
+	})
+	require.NoError(t, err)
+	// The value is copied out of the database, so it stays valid after the transaction
+	assert.Equal(t, "value of a\x00one", string(value))
+
+	var keys []string
+	err = backend.View(func(tx crypto.KVTx) error {
+		missing, err := tx.Get([]byte("c\x00one"))
+		assert.Nil(t, missing)
+		if err != nil {
+			return err
+		}
+		return tx.Scan([]byte("b\x00"), func(key, value []byte) error {
+			keys = append(keys, string(key))
+			assert.Equal(t, "value of "+string(key), string(value))
+			return nil
+		})
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b\x00one", "b\x00two"}, keys)
+
+	errStop := errors.New("stop")
+	keys = nil
+	err = backend.View(func(tx crypto.KVTx) error {
+		return tx.Scan(nil, func(key, value []byte) error {
+			keys = append(keys, string(key))
+			return errStop
+		})
+	})
+	assert.ErrorIs(t, err, errStop)
+	assert.Equal(t, []string{"a\x00one"}, keys)
+
+	err = backend.View(func(tx crypto.KVTx) error {
+		return tx.Put([]byte("a"), []byte("b"))
+	})
+	assert.Error(t, err, "writing in a read-only transaction should fail")
+}
+
+func TestBackend_Rollback(t *testing.T) {
+	backend, _ := openTestBackend(t)
+	defer backend.Close()
+
+	require.NoError(t, backend.Update(func(tx crypto.KVTx) error {
+		return tx.Put([]byte("key"), []byte("original"))
+	}))
+	errFailed := errors.New("failed")
+	err := backend.Update(func(tx crypto.KVTx) error {
+		_ = tx.Put([]byte("key"), []byte("changed"))
+		_ = tx.Put([]byte("other"), []byte("added"))
+		return errFailed
+	})
+	assert.ErrorIs(t, err, errFailed)
+	_ = backend.View(func(tx crypto.KVTx) error {
+		value, _ := tx.Get([]byte("key"))
+		assert.Equal(t, "original", string(value))
+		value, _ = tx.Get([]byte("other"))
+		assert.Nil(t, value)
+		return nil
+	})
+}
+
+func TestKVCryptoStore(t *testing.T) {
+	backend, path := openTestBackend(t)
+	store := crypto.NewKVCryptoStore(backend, []byte("test"))
+	require.NoError(t, store.Upgrade())
+
+	account := crypto.NewOlmAccount()
+	require.NoError(t, store.PutAccount(account))
+	require.NoError(t, store.PutDevices("@user:example.com", map[id.DeviceID]*crypto.DeviceIdentity{
+		"dev1": {UserID: "@user:example.com", DeviceID: "dev1", IdentityKey: "key1", SigningKey: "key1"},
+		"dev2": {UserID: "@user:example.com", DeviceID: "dev2", IdentityKey: "key2", SigningKey: "key2"},
+	}))
+	require.NoError(t, backend.Close())
+
+	// Everything is still there after reopening the database
+	backend, err := bolt.Open(path)
+	require.NoError(t, err)
+	defer backend.Close()
+	store = crypto.NewKVCryptoStore(backend, []byte("test"))
+	require.NoError(t, store.Upgrade())
+	retrieved, err := store.GetAccount()
+	require.NoError(t, err)
+	require.NotNil(t, retrieved)
+	assert.Equal(t, account.IdentityKey(), retrieved.IdentityKey())
+	devices, err := store.GetDevices("@user:example.com")
+	require.NoError(t, err)
+	assert.Len(t, devices, 2)
+	device, err := store.FindDeviceByKey("@user:example.com", "key2")
+	require.NoError(t, err)
+	require.NotNil(t, device)
+	assert.Equal(t, id.DeviceID("dev2"), device.DeviceID)
+}
+
+func TestKVCryptoStore_Downgrade(t *testing.T) {
+	backend, _ := openTestBackend(t)
+	defer backend.Close()
+	store := crypto.NewKVCryptoStore(backend, []byte("test"))
+	require.NoError(t, store.Upgrade())
+
+	require.NoError(t, backend.Update(func(tx crypto.KVTx) error {
+		return tx.Put([]byte("version"), []byte("999"))
+	}))
+	assert.ErrorIs(t, store.Upgrade(), crypto.ErrUnsupportedStoreVersion)
+}
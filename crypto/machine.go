@@ -7,8 +7,10 @@
 package crypto
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"runtime"
 	"sync"
 	"time"
 
@@ -41,14 +43,67 @@ type OlmMachine struct {
 	AllowUnverifiedDevices       bool
 	ShareKeysToUnverifiedDevices bool
 
-	AllowKeyShare func(*DeviceIdentity, event.RequestedKeyInfo) *KeyShareRejection
+	// AllowKeyShare decides whether incoming room key requests are accepted.
+	// By default, keys are shared with the user's own verified devices (see KeyShareOwnVerifiedDevices).
+	AllowKeyShare KeyRequestHandler
+
+	// AllowSecretShare decides whether incoming secret requests (m.secret.request) are accepted.
+	// By default, secrets are shared with the user's own trusted devices (see SecretShareOwnVerifiedDevices).
+	AllowSecretShare SecretRequestHandler
+
+	// KeyRequestRetryInterval and KeyRequestMaxAttempts control how outgoing key requests sent with
+	// RequestRoomKeyWithRetry are re-sent if no response is received.
+	KeyRequestRetryInterval time.Duration
+	KeyRequestMaxAttempts   int
+
+	// OlmEncryptionWorkers is the number of goroutines used to encrypt room keys for devices when sharing a group session.
+	OlmEncryptionWorkers int
+	// DecryptionWorkers is the maximum number of goroutines used by DecryptMany.
+	DecryptionWorkers int
+	// MaxToDeviceMessagesPerRequest is the maximum number of messages sent in a single /sendToDevice request.
+	// Larger batches are split into multiple requests. Zero means no limit.
+	MaxToDeviceMessagesPerRequest int
+
+	// KeyBackupBatchSize is the maximum number of megolm sessions uploaded to key backup in a single request.
+	KeyBackupBatchSize int
+	// KeyBackupAlgorithm is the algorithm used for new key backup versions created with CreateKeyBackupVersion.
+	// Existing versions can be enabled with any algorithm registered in backup.Algorithms.
+	KeyBackupAlgorithm id.KeyBackupAlgorithm
+	// AutoRestoreFromKeyBackup makes the machine try to restore missing megolm sessions from key backup when an event
+	// can't be decrypted. This requires key backup to be enabled with the private key (see EnableKeyBackup).
+	AutoRestoreFromKeyBackup bool
+
+	// OnRetriedDecryption is called when an event that previously failed to decrypt with NoSessionFound was
+	// successfully decrypted after the session arrived (e.g. as a room key, a forwarded key or a key import).
+	// Failed events are only queued for retrying if this is set.
+	OnRetriedDecryption func(original, decrypted *event.Event)
+
+	// OnCustomEncryptedToDevice is called for olm-encrypted to-device events whose type isn't handled by the machine
+	// itself. Combined with SendEncryptedToDeviceID, this can be used to implement custom encrypted to-device protocols.
+	OnCustomEncryptedToDevice func(evt *DecryptedOlmEvent)
+
+	// OnCrossSigningTrustLost is called by RotateCrossSigningKeys with the users whose trust couldn't be carried
+	// over to the new cross-signing keys.
+	OnCrossSigningTrustLost func(users []id.UserID)
+
+	// ShouldEncryptStateEvent decides which state events are encrypted in rooms that have opted into encrypted
+	// state (MSC3414). If nil, state events are never encrypted. See OlmMachine.ShouldEncryptState for details.
+	ShouldEncryptStateEvent func(roomID id.RoomID, evtType event.Type, stateKey string) bool
+
+	// DefaultRotationPolicy is the rotation policy for outbound group sessions in rooms that don't have an override
+	// set with SetRotationPolicy. Rotation periods in the room's encryption event take precedence over this.
+	DefaultRotationPolicy RotationPolicy
 
 	DefaultSASTimeout time.Duration
 	// AcceptVerificationFrom determines whether the machine will accept verification requests from this device.
-	AcceptVerificationFrom func(string, *DeviceIdentity, id.RoomID) (VerificationRequestResponse, VerificationHooks)
+	// VerificationPolicy.Handler can be used to build a handler for common cases, like bots that should accept
+	// verification requests from the user's own trusted devices.
+	AcceptVerificationFrom VerificationRequestHandler
 
 	account *OlmAccount
 
+	groupSessionCache *groupSessionCache
+
 	roomKeyRequestFilled            *sync.Map
 	keyVerificationTransactionState *sync.Map
 
@@ -60,10 +115,45 @@ type OlmMachine struct {
 	recentlyUnwedged     map[id.IdentityKey]time.Time
 	recentlyUnwedgedLock sync.Mutex
 
+	retryQueue     map[id.SessionID][]queuedEvent
+	retryQueueLock sync.Mutex
+
+	outgoingKeyRequests     map[id.SessionID]*outgoingKeyRequest
+	outgoingKeyRequestsLock sync.Mutex
+
+	secretRequests     map[string]*outgoingSecretRequest
+	secretRequestsLock sync.Mutex
+
+	keyBackup                 *keyBackupState
+	keyBackupLock             sync.RWMutex
+	keyBackupUploadLock       sync.Mutex
+	keyBackupUploadQueued     int32
+	keyBackupRestoreAttempted map[id.SessionID]struct{}
+	keyBackupRestoreLock      sync.Mutex
+
 	olmLock sync.Mutex
 
+	// accountLock serializes changes to the account within this process, see lockAccount.
+	accountLock sync.Mutex
+	// accountPtrLock guards the account pointer, which lockAccount replaces when it reloads the account.
+	accountPtrLock sync.RWMutex
+
+	rotationPolicies     map[id.RoomID]RotationPolicy
+	rotationPoliciesLock sync.RWMutex
+
+	autoShareLocks     map[id.RoomID]*sync.Mutex
+	autoShareLocksLock sync.Mutex
+
+	deviceListLock    sync.Mutex
+	deviceListBackoff time.Duration
+	deviceListRetryAt time.Time
+
 	CrossSigningKeys    *CrossSigningKeysCache
 	crossSigningPubkeys *CrossSigningPublicKeysCache
+
+	// KeyProvider is used for all signing operations with the device key and cross-signing keys.
+	// By default, it uses the olm account and CrossSigningKeys.
+	KeyProvider KeyProvider
 }
 
 // StateStore is used by OlmMachine to get room state information that's needed for encryption.
@@ -76,6 +166,13 @@ type StateStore interface {
 	FindSharedRooms(id.UserID) []id.RoomID
 }
 
+// RoomMemberStateStore can optionally be implemented by the StateStore to allow OlmMachine to share group sessions
+// automatically when encrypting events (see EncryptMegolmEventAutoShare).
+type RoomMemberStateStore interface {
+	// GetRoomJoinedOrInvitedMembers returns the users who are joined or invited to a room.
+	GetRoomJoinedOrInvitedMembers(id.RoomID) ([]id.UserID, error)
+}
+
 // NewOlmMachine creates an OlmMachine with the given client, logger and stores.
 func NewOlmMachine(client *mautrix.Client, log Logger, cryptoStore Store, stateStore StateStore) *OlmMachine {
 	mach := &OlmMachine{
@@ -88,39 +185,75 @@ func NewOlmMachine(client *mautrix.Client, log Logger, cryptoStore Store, stateS
 		AllowUnverifiedDevices:       true,
 		ShareKeysToUnverifiedDevices: false,
 
+		DefaultRotationPolicy: DefaultRotationPolicy,
+
+		KeyRequestRetryInterval: 2 * time.Minute,
+		KeyRequestMaxAttempts:   5,
+
+		OlmEncryptionWorkers:          runtime.NumCPU(),
+		DecryptionWorkers:             runtime.NumCPU(),
+		MaxToDeviceMessagesPerRequest: 100,
+		KeyBackupBatchSize:            DefaultKeyBackupBatchSize,
+		KeyBackupAlgorithm:            id.KeyBackupAlgorithmMegolmBackupV1,
+
 		DefaultSASTimeout: 10 * time.Minute,
-		AcceptVerificationFrom: func(string, *DeviceIdentity, id.RoomID) (VerificationRequestResponse, VerificationHooks) {
-			// Reject requests by default. Users need to override this to return appropriate verification hooks.
-			return RejectRequest, nil
-		},
+		// Reject requests by default. Users need to override this to return appropriate verification hooks.
+		AcceptVerificationFrom: VerificationRejectAll,
 
 		roomKeyRequestFilled:            &sync.Map{},
 		keyVerificationTransactionState: &sync.Map{},
 
-		keyWaiters: make(map[id.SessionID]chan struct{}),
+		keyWaiters:          make(map[id.SessionID]chan struct{}),
+		outgoingKeyRequests: make(map[id.SessionID]*outgoingKeyRequest),
+		secretRequests:      make(map[string]*outgoingSecretRequest),
+		retryQueue:          make(map[id.SessionID][]queuedEvent),
+
+		keyBackupRestoreAttempted: make(map[id.SessionID]struct{}),
 
 		devicesToUnwedge: make(map[id.IdentityKey]bool),
 		recentlyUnwedged: make(map[id.IdentityKey]time.Time),
+
+		rotationPolicies: make(map[id.RoomID]RotationPolicy),
+		autoShareLocks:   make(map[id.RoomID]*sync.Mutex),
 	}
-	mach.AllowKeyShare = mach.defaultAllowKeyShare
+	mach.AllowKeyShare = mach.KeyShareOwnVerifiedDevices
+	mach.AllowSecretShare = mach.SecretShareOwnVerifiedDevices
+	mach.KeyProvider = &olmKeyProvider{mach}
 	return mach
 }
 
 // Load loads the Olm account information from the crypto store. If there's no olm account, a new one is created.
 // This must be called before using the machine.
-func (mach *OlmMachine) Load() (err error) {
-	mach.account, err = mach.CryptoStore.GetAccount()
+func (mach *OlmMachine) Load() error {
+	account, err := mach.CryptoStore.GetAccount()
 	if err != nil {
-		return
+		return err
 	}
-	if mach.account == nil {
-		mach.account = NewOlmAccount()
+	if account == nil {
+		account = NewOlmAccount()
 	}
+	mach.setAccount(account)
 	return nil
 }
 
+// getAccount returns the current olm account. The account may be replaced with a reloaded copy when the account
+// lock is acquired, so the returned object should only be mutated while holding the lock (see lockAccount).
+func (mach *OlmMachine) getAccount() *OlmAccount {
+	mach.accountPtrLock.RLock()
+	defer mach.accountPtrLock.RUnlock()
+	return mach.account
+}
+
+func (mach *OlmMachine) setAccount(account *OlmAccount) {
+	// Cache the keys before other goroutines can read them.
+	account.Keys()
+	mach.accountPtrLock.Lock()
+	mach.account = account
+	mach.accountPtrLock.Unlock()
+}
+
 func (mach *OlmMachine) saveAccount() {
-	err := mach.CryptoStore.PutAccount(mach.account)
+	err := mach.CryptoStore.PutAccount(mach.getAccount())
 	if err != nil {
 		mach.Log.Error("Failed to save account: %v", err)
 	}
@@ -157,7 +290,7 @@ func Fingerprint(signingKey id.SigningKey) string {
 
 // Fingerprint returns the fingerprint of the Olm account that can be used for non-interactive verification.
 func (mach *OlmMachine) Fingerprint() string {
-	return Fingerprint(mach.account.SigningKey())
+	return Fingerprint(mach.getAccount().SigningKey())
 }
 
 // OwnIdentity returns this device's DeviceIdentity struct
@@ -165,8 +298,8 @@ func (mach *OlmMachine) OwnIdentity() *DeviceIdentity {
 	return &DeviceIdentity{
 		UserID:      mach.Client.UserID,
 		DeviceID:    mach.Client.DeviceID,
-		IdentityKey: mach.account.IdentityKey(),
-		SigningKey:  mach.account.SigningKey(),
+		IdentityKey: mach.getAccount().IdentityKey(),
+		SigningKey:  mach.getAccount().SigningKey(),
 		Trust:       TrustStateVerified,
 		Deleted:     false,
 	}
@@ -176,9 +309,12 @@ func (mach *OlmMachine) AddAppserviceListener(ep *appservice.EventProcessor, az
 	// ToDeviceForwardedRoomKey and ToDeviceRoomKey should only be present inside encrypted to-device events
 	ep.On(event.ToDeviceEncrypted, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceRoomKeyRequest, mach.HandleToDeviceEvent)
+	ep.On(event.ToDeviceSecretRequest, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceRoomKeyWithheld, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceOrgMatrixRoomKeyWithheld, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceVerificationRequest, mach.HandleToDeviceEvent)
+	ep.On(event.ToDeviceVerificationReady, mach.HandleToDeviceEvent)
+	ep.On(event.ToDeviceVerificationDone, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceVerificationStart, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceVerificationAccept, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceVerificationKey, mach.HandleToDeviceEvent)
@@ -189,27 +325,51 @@ func (mach *OlmMachine) AddAppserviceListener(ep *appservice.EventProcessor, az
 	mach.Log.Trace("Added listeners for encryption data coming from appservice transactions")
 }
 
-func (mach *OlmMachine) HandleDeviceLists(dl *mautrix.DeviceLists, since string) {
-	if len(dl.Changed) > 0 {
-		traceID := time.Now().Format("15:04:05.000000")
-		mach.Log.Trace("Device list changes in /sync: %v (trace: %s)", dl.Changed, traceID)
-		mach.fetchKeys(dl.Changed, since, false)
-		mach.Log.Trace("Finished handling device list changes (trace: %s)", traceID)
+func (mach *OlmMachine) HandleOTKCounts(otkCount *mautrix.OTKCount) {
+	mach.handleOTKCounts(otkCount, false)
+}
+
+// HandleUnusedFallbackKeyTypes uploads a new fallback key if the list of unused fallback key types in a sync response
+// says that the previous one has been used. A nil list means the server doesn't support fallback keys.
+func (mach *OlmMachine) HandleUnusedFallbackKeyTypes(unusedTypes []id.KeyAlgorithm) {
+	if !mach.needsNewFallbackKey(unusedTypes) {
+		return
+	}
+	mach.Log.Debug("Sync response said our fallback key has been used, uploading a new one")
+	err := mach.RotateFallbackKey()
+	if err != nil {
+		mach.Log.Error("Failed to upload new fallback key: %v", err)
 	}
 }
 
-func (mach *OlmMachine) HandleOTKCounts(otkCount *mautrix.OTKCount) {
+func (mach *OlmMachine) needsNewFallbackKey(unusedTypes []id.KeyAlgorithm) bool {
+	if unusedTypes == nil {
+		return false
+	}
+	for _, algorithm := range unusedTypes {
+		if algorithm == id.KeyAlgorithmSignedCurve25519 {
+			return false
+		}
+	}
+	return true
+}
+
+func (mach *OlmMachine) handleOTKCounts(otkCount *mautrix.OTKCount, newFallbackKey bool) {
 	if (len(otkCount.UserID) > 0 && otkCount.UserID != mach.Client.UserID) || (len(otkCount.DeviceID) > 0 && otkCount.DeviceID != mach.Client.DeviceID) {
 		// TODO This log probably needs to be silence-able if someone wants to use encrypted appservices with multiple e2ee sessions
 		mach.Log.Debug("Dropping OTK counts targeted to %s/%s (not us)", otkCount.UserID, otkCount.DeviceID)
 		return
 	}
 
-	minCount := mach.account.Internal.MaxNumberOfOneTimeKeys() / 2
-	if otkCount.SignedCurve25519 < int(minCount) {
+	minCount := mach.getAccount().Internal.MaxNumberOfOneTimeKeys() / 2
+	if otkCount.SignedCurve25519 < int(minCount) || newFallbackKey {
 		traceID := time.Now().Format("15:04:05.000000")
-		mach.Log.Debug("Sync response said we have %d signed curve25519 keys left, sharing new ones... (trace: %s)", otkCount.SignedCurve25519, traceID)
-		err := mach.ShareKeys(otkCount.SignedCurve25519)
+		if newFallbackKey {
+			mach.Log.Debug("Sync response said we have %d signed curve25519 keys left and our fallback key has been used, sharing new keys... (trace: %s)", otkCount.SignedCurve25519, traceID)
+		} else {
+			mach.Log.Debug("Sync response said we have %d signed curve25519 keys left, sharing new ones... (trace: %s)", otkCount.SignedCurve25519, traceID)
+		}
+		err := mach.shareKeys(otkCount.SignedCurve25519, newFallbackKey)
 		if err != nil {
 			mach.Log.Error("Failed to share keys: %v (trace: %s)", err, traceID)
 		} else {
@@ -220,11 +380,13 @@ func (mach *OlmMachine) HandleOTKCounts(otkCount *mautrix.OTKCount) {
 
 // ProcessSyncResponse processes a single /sync response.
 //
-// This can be easily registered into a mautrix client using .OnSync():
+// This can be easily registered into a mautrix client using .OnSyncWithPriority(), so that it runs before any other
+// sync handlers:
 //
-//     client.Syncer.(*mautrix.DefaultSyncer).OnSync(c.crypto.ProcessSyncResponse)
+//     client.Syncer.(*mautrix.DefaultSyncer).OnSyncWithPriority(mautrix.PriorityCrypto, c.crypto.ProcessSyncResponse)
 func (mach *OlmMachine) ProcessSyncResponse(resp *mautrix.RespSync, since string) bool {
 	mach.HandleDeviceLists(&resp.DeviceLists, since)
+	mach.SSSS.HandleAccountDataEvents(resp.AccountData.Events)
 
 	for _, evt := range resp.ToDevice.Events {
 		evt.Type.Class = event.ToDeviceEventType
@@ -236,7 +398,7 @@ func (mach *OlmMachine) ProcessSyncResponse(resp *mautrix.RespSync, since string
 		mach.HandleToDeviceEvent(evt)
 	}
 
-	mach.HandleOTKCounts(&resp.DeviceOTKCount)
+	mach.handleOTKCounts(&resp.DeviceOTKCount, mach.needsNewFallbackKey(resp.DeviceUnusedFallbackKeyTypes))
 	return true
 }
 
@@ -268,7 +430,7 @@ func (mach *OlmMachine) HandleMemberEvent(evt *event.Event) {
 		return
 	}
 	mach.Log.Trace("Got membership state event in %s changing %s from %s to %s, invalidating group session", evt.RoomID, evt.GetStateKey(), prevContent.Membership, content.Membership)
-	err := mach.CryptoStore.RemoveOutboundGroupSession(evt.RoomID)
+	err := mach.invalidateGroupSession(evt.RoomID, mach.GetRotationPolicy(evt.RoomID).RotateOnMembershipChange)
 	if err != nil {
 		mach.Log.Warn("Failed to invalidate outbound group session of %s: %v", evt.RoomID, err)
 	}
@@ -308,14 +470,22 @@ func (mach *OlmMachine) HandleToDeviceEvent(evt *event.Event) {
 				}
 			}
 			mach.Log.Trace("Handled forwarded room key event from %s/%s (trace: %s)", decryptedEvt.Sender, decryptedEvt.SenderDevice, traceID)
+		case *event.SecretSendEventContent:
+			mach.receiveSecret(decryptedEvt, decryptedContent)
 		case *event.DummyEventContent:
 			mach.Log.Debug("Received encrypted dummy event from %s/%s (trace: %s)", decryptedEvt.Sender, decryptedEvt.SenderDevice, traceID)
 		default:
-			mach.Log.Debug("Unhandled encrypted to-device event of type %s from %s/%s (trace: %s)", decryptedEvt.Type.String(), decryptedEvt.Sender, decryptedEvt.SenderDevice, traceID)
+			if mach.OnCustomEncryptedToDevice != nil {
+				mach.OnCustomEncryptedToDevice(decryptedEvt)
+			} else {
+				mach.Log.Debug("Unhandled encrypted to-device event of type %s from %s/%s (trace: %s)", decryptedEvt.Type.String(), decryptedEvt.Sender, decryptedEvt.SenderDevice, traceID)
+			}
 		}
 		return
 	case *event.RoomKeyRequestEventContent:
 		mach.handleRoomKeyRequest(evt.Sender, content)
+	case *event.SecretRequestEventContent:
+		mach.handleSecretRequest(evt.Sender, content)
 	// verification cases
 	case *event.VerificationStartEventContent:
 		mach.handleVerificationStart(evt.Sender, content, content.TransactionID, 10*time.Minute, "")
@@ -329,6 +499,10 @@ func (mach *OlmMachine) HandleToDeviceEvent(evt *event.Event) {
 		mach.handleVerificationCancel(evt.Sender, content, content.TransactionID)
 	case *event.VerificationRequestEventContent:
 		mach.handleVerificationRequest(evt.Sender, content, content.TransactionID, "")
+	case *event.VerificationReadyEventContent:
+		mach.handleVerificationReady(evt.Sender, content, content.TransactionID)
+	case *event.VerificationDoneEventContent:
+		mach.handleVerificationDone(evt.Sender, content.TransactionID)
 	case *event.RoomKeyWithheldEventContent:
 		mach.handleRoomKeyWithheld(content)
 	default:
@@ -380,7 +554,7 @@ func (mach *OlmMachine) GetOrFetchDeviceByKey(userID id.UserID, identityKey id.I
 
 // SendEncryptedToDevice sends an Olm-encrypted event to the given user device.
 func (mach *OlmMachine) SendEncryptedToDevice(device *DeviceIdentity, evtType event.Type, content event.Content) error {
-	if err := mach.createOutboundSessions(map[id.UserID]map[id.DeviceID]*DeviceIdentity{
+	if _, _, err := mach.createOutboundSessions(map[id.UserID]map[id.DeviceID]*DeviceIdentity{
 		device.UserID: {
 			device.DeviceID: device,
 		},
@@ -425,7 +599,7 @@ func (mach *OlmMachine) createGroupSession(senderKey id.SenderKey, signingKey id
 		mach.Log.Warn("Mismatched session ID while creating inbound group session")
 		return
 	}
-	err = mach.CryptoStore.PutGroupSession(roomID, senderKey, sessionID, igs)
+	err = mach.putGroupSession(roomID, senderKey, sessionID, igs)
 	if err != nil {
 		mach.Log.Error("Failed to store new inbound group session: %v", err)
 		return
@@ -442,17 +616,24 @@ func (mach *OlmMachine) markSessionReceived(id id.SessionID) {
 		delete(mach.keyWaiters, id)
 	}
 	mach.keyWaitersLock.Unlock()
+	go mach.retryQueuedEvents(id)
+	mach.queueKeyBackupUpload()
 }
 
-// WaitForSession waits for the given Megolm session to arrive.
-func (mach *OlmMachine) WaitForSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, timeout time.Duration) bool {
+func (mach *OlmMachine) getSessionWaiter(sessionID id.SessionID) chan struct{} {
 	mach.keyWaitersLock.Lock()
+	defer mach.keyWaitersLock.Unlock()
 	ch, ok := mach.keyWaiters[sessionID]
 	if !ok {
-		ch := make(chan struct{})
+		ch = make(chan struct{})
 		mach.keyWaiters[sessionID] = ch
 	}
-	mach.keyWaitersLock.Unlock()
+	return ch
+}
+
+// WaitForSession waits for the given Megolm session to arrive.
+func (mach *OlmMachine) WaitForSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, timeout time.Duration) bool {
+	ch := mach.getSessionWaiter(sessionID)
 	select {
 	case <-ch:
 		return true
@@ -478,6 +659,10 @@ func (mach *OlmMachine) handleRoomKeyWithheld(content *event.RoomKeyWithheldEven
 	if content.Algorithm != id.AlgorithmMegolmV1 {
 		mach.Log.Debug("Non-megolm room key withheld event: %+v", content)
 		return
+	} else if content.Code == event.RoomKeyWithheldNoOlmSession || len(content.SessionID) == 0 {
+		// m.no_olm is about the device rather than a specific session, so there's nothing to store.
+		mach.Log.Debug("%s told us that they withheld keys from us with code %s: %s", content.SenderKey, content.Code, content.Reason)
+		return
 	}
 	err := mach.CryptoStore.PutWithheldGroupSession(*content)
 	if err != nil {
@@ -489,28 +674,61 @@ func (mach *OlmMachine) handleRoomKeyWithheld(content *event.RoomKeyWithheldEven
 //
 // If the Olm account hasn't been shared, the account keys will be uploaded.
 // If currentOTKCount is less than half of the limit (100 / 2 = 50), enough one-time keys will be uploaded so exactly
-// half of the limit is filled.
+// half of the limit is filled. A fallback key is also uploaded together with the initial account keys.
 func (mach *OlmMachine) ShareKeys(currentOTKCount int) error {
+	return mach.shareKeys(currentOTKCount, false)
+}
+
+// RotateFallbackKey generates a new fallback key and uploads it to the server.
+//
+// The previous fallback key is kept until the next rotation, so that messages encrypted with it while the new
+// key was being uploaded can still be decrypted. This is called automatically by ProcessSyncResponse when the server
+// says that the fallback key has been used.
+func (mach *OlmMachine) RotateFallbackKey() error {
+	// Pretend there are enough one-time keys so that only the fallback key is uploaded.
+	return mach.shareKeys(int(mach.getAccount().Internal.MaxNumberOfOneTimeKeys()/2), true)
+}
+
+// shareKeys uploads one-time keys and the fallback key. If the account hasn't been shared yet, the device keys
+// and a new fallback key are uploaded too.
+func (mach *OlmMachine) shareKeys(currentOTKCount int, newFallbackKey bool) error {
+	unlock, err := mach.lockAccount(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	account := mach.getAccount()
 	var deviceKeys *mautrix.DeviceKeys
-	if !mach.account.Shared {
-		deviceKeys = mach.account.getInitialKeys(mach.Client.UserID, mach.Client.DeviceID)
+	if !account.Shared {
+		deviceKeys = account.getInitialKeys(mach.Client.UserID, mach.Client.DeviceID, mach.KeyProvider)
+		newFallbackKey = true
 		mach.Log.Trace("Going to upload initial account keys")
 	}
-	oneTimeKeys := mach.account.getOneTimeKeys(mach.Client.UserID, mach.Client.DeviceID, currentOTKCount)
-	if len(oneTimeKeys) == 0 && deviceKeys == nil {
+	// The fallback key must be read before the one-time keys, as getOneTimeKeys marks all keys as published.
+	fallbackKeys := account.getFallbackKeys(mach.Client.UserID, mach.Client.DeviceID, newFallbackKey, mach.KeyProvider)
+	oneTimeKeys := account.getOneTimeKeys(mach.Client.UserID, mach.Client.DeviceID, currentOTKCount, mach.KeyProvider)
+	if len(oneTimeKeys) == 0 && len(fallbackKeys) == 0 && deviceKeys == nil {
 		mach.Log.Trace("No one-time keys nor device keys got when trying to share keys")
 		return nil
 	}
 	req := &mautrix.ReqUploadKeys{
-		DeviceKeys:  deviceKeys,
-		OneTimeKeys: oneTimeKeys,
+		DeviceKeys:   deviceKeys,
+		OneTimeKeys:  oneTimeKeys,
+		FallbackKeys: fallbackKeys,
 	}
-	mach.Log.Trace("Uploading %d one-time keys", len(oneTimeKeys))
-	_, err := mach.Client.UploadKeys(req)
+	mach.Log.Trace("Uploading %d one-time keys and %d fallback keys", len(oneTimeKeys), len(fallbackKeys))
+	_, err = mach.Client.UploadKeys(req)
 	if err != nil {
 		return err
 	}
-	mach.account.Shared = true
+	account.Shared = true
 	mach.saveAccount()
 	return nil
 }
+
+// isAccountShared returns whether the device keys of the account have been uploaded.
+func (mach *OlmMachine) isAccountShared() bool {
+	mach.accountLock.Lock()
+	defer mach.accountLock.Unlock()
+	return mach.getAccount().Shared
+}
@@ -7,10 +7,22 @@
 package crypto
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/olm"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
@@ -31,6 +43,7 @@ func (mockStateStore) IsEncrypted(id.RoomID) bool {
 func (mockStateStore) GetEncryptionEvent(id.RoomID) *event.EncryptionEventContent {
 	return &event.EncryptionEventContent{
 		RotationPeriodMessages: 3,
+		EncryptStateEvents:     true,
 	}
 }
 
@@ -38,14 +51,22 @@ func (mockStateStore) FindSharedRooms(id.UserID) []id.RoomID {
 	return []id.RoomID{"room1"}
 }
 
+func (mockStateStore) GetRoomJoinedOrInvitedMembers(id.RoomID) ([]id.UserID, error) {
+	return []id.UserID{"user1", "user2"}, nil
+}
+
 func newMachine(t *testing.T, userID id.UserID) (*OlmMachine, string) {
+	return newMachineWithDevice(t, userID, "device1")
+}
+
+func newMachineWithDevice(t *testing.T, userID id.UserID, deviceID id.DeviceID) (*OlmMachine, string) {
 	client, err := mautrix.NewClient("http://localhost", userID, "token")
 	if err != nil {
 		t.Fatalf("Error creating client: %v", err)
 	}
-	client.DeviceID = "device1"
+	client.DeviceID = deviceID
 
-	storeFileName := "gob_store_test_" + userID.String() + ".gob"
+	storeFileName := "gob_store_test_" + userID.String() + "_" + deviceID.String() + ".gob"
 	gobStore, err := NewGobStore(storeFileName)
 	if err != nil {
 		os.Remove(storeFileName)
@@ -68,7 +89,7 @@ func TestOlmMachineOlmMegolmSessions(t *testing.T) {
 	defer os.Remove(storeFileNameIn)
 
 	// generate OTKs for receiving machine
-	otks := machineIn.account.getOneTimeKeys("user2", "device2", 0)
+	otks := machineIn.account.getOneTimeKeys("user2", "device2", 0, machineIn.KeyProvider)
 	var otk mautrix.OneTimeKey
 	for _, otkTmp := range otks {
 		// take first OTK
@@ -157,6 +178,11 @@ func TestOlmMachineOlmMegolmSessions(t *testing.T) {
 	if decryptedEvt.Content.Raw["hello"] != "world" {
 		t.Errorf("Expected event content %v, got %v", eventContent, decryptedEvt.Content.Raw)
 	}
+	if trust := decryptedEvt.Mautrix.TrustState; trust == nil {
+		t.Error("Decrypted event has no trust state")
+	} else if trust.KeySource != event.KeySourceDirect || trust.ForwardingChainLength != 0 {
+		t.Errorf("Unexpected trust state %+v", trust)
+	}
 
 	machineOut.EncryptMegolmEvent("room1", event.EventMessage, eventContent)
 	if megolmOutSession.Expired() {
@@ -167,3 +193,906 @@ func TestOlmMachineOlmMegolmSessions(t *testing.T) {
 		t.Error("Megolm outbound session not expired after 3rd message")
 	}
 }
+
+func TestOlmMachineRotationPolicy(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+
+	policy := machine.GetRotationPolicy("room1")
+	if policy.MaxMessages != 3 || policy.MaxAge != DefaultRotationPolicy.MaxAge || !policy.RotateOnMembershipChange {
+		t.Errorf("Encryption event rotation period not applied to default policy: %+v", policy)
+	}
+
+	machine.SetRotationPolicy("room1", &RotationPolicy{MaxMessages: 5})
+	session := machine.newOutboundGroupSession("room1")
+	if session.MaxMessages != 5 || session.MaxAge != 0 {
+		t.Errorf("Rotation policy override not applied to new session: %d messages, %s age", session.MaxMessages, session.MaxAge)
+	}
+	session.Shared = true
+	machine.CryptoStore.AddOutboundGroupSession(session)
+
+	memberEvt := &event.Event{
+		Type:     event.StateMember,
+		RoomID:   "room1",
+		StateKey: new(string),
+		Content:  event.Content{Parsed: &event.MemberEventContent{Membership: event.MembershipJoin}},
+	}
+	machine.HandleMemberEvent(memberEvt)
+	stored, _ := machine.CryptoStore.GetOutboundGroupSession("room1")
+	if stored == nil || stored.ID() != session.ID() {
+		t.Fatal("Session was rotated on membership change despite policy")
+	} else if stored.Shared {
+		t.Error("Session wasn't marked as unshared after membership change")
+	}
+
+	machine.SetRotationPolicy("room1", nil)
+	machine.HandleMemberEvent(memberEvt)
+	if stored, _ = machine.CryptoStore.GetOutboundGroupSession("room1"); stored != nil {
+		t.Error("Session wasn't rotated on membership change after removing override")
+	}
+}
+
+func TestOlmMachineWithheldGroupSession(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+
+	withheld := &event.RoomKeyWithheldEventContent{
+		RoomID:    "room1",
+		Algorithm: id.AlgorithmMegolmV1,
+		SessionID: "session1",
+		SenderKey: "senderkey1",
+		Code:      event.RoomKeyWithheldUnverified,
+		Reason:    "Device not verified",
+	}
+	machine.HandleToDeviceEvent(&event.Event{
+		Type:    event.ToDeviceRoomKeyWithheld,
+		Sender:  "user2",
+		Content: event.Content{Parsed: withheld},
+	})
+
+	_, err := machine.DecryptMegolmEvent(&event.Event{
+		Type:   event.EventEncrypted,
+		ID:     "event1",
+		RoomID: "room1",
+		Content: event.Content{Parsed: &event.EncryptedEventContent{
+			Algorithm: id.AlgorithmMegolmV1,
+			SenderKey: "senderkey1",
+			SessionID: "session1",
+		}},
+	})
+	var withheldErr *GroupSessionWithheldError
+	if !errors.As(err, &withheldErr) {
+		t.Fatalf("Expected GroupSessionWithheldError, got %v", err)
+	} else if !errors.Is(err, ErrGroupSessionWithheld) {
+		t.Errorf("GroupSessionWithheldError doesn't unwrap to ErrGroupSessionWithheld")
+	} else if withheldErr.Content.Code != event.RoomKeyWithheldUnverified || withheldErr.Content.Reason != withheld.Reason {
+		t.Errorf("Unexpected withheld content in error: %+v", withheldErr.Content)
+	} else if withheldErr.Description() != "the sender doesn't share keys with unverified devices" {
+		t.Errorf("Unexpected description: %s", withheldErr.Description())
+	}
+
+	// m.no_olm isn't stored for a session even if the sender includes a session ID
+	machine.HandleToDeviceEvent(&event.Event{
+		Type:   event.ToDeviceRoomKeyWithheld,
+		Sender: "user2",
+		Content: event.Content{Parsed: &event.RoomKeyWithheldEventContent{
+			RoomID:    "room1",
+			Algorithm: id.AlgorithmMegolmV1,
+			SessionID: "session2",
+			SenderKey: "senderkey1",
+			Code:      event.RoomKeyWithheldNoOlmSession,
+		}},
+	})
+	if _, err = machine.CryptoStore.GetGroupSession("room1", "senderkey1", "session2"); errors.Is(err, ErrGroupSessionWithheld) {
+		t.Error("m.no_olm was stored as a withheld session")
+	}
+}
+
+func TestOlmMachineKeyShareHandlers(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+
+	ownDevice := &DeviceIdentity{UserID: "user1", DeviceID: "device2", Trust: TrustStateVerified}
+	otherUser := &DeviceIdentity{UserID: "user2", DeviceID: "device1", Trust: TrustStateVerified}
+	if rejection := machine.AllowKeyShare(ownDevice, event.RequestedKeyInfo{}); rejection != nil {
+		t.Errorf("Default handler rejected own verified device: %+v", rejection)
+	}
+	if rejection := machine.AllowKeyShare(otherUser, event.RequestedKeyInfo{}); rejection == nil || *rejection != KeyShareRejectOtherUser {
+		t.Errorf("Default handler didn't reject other user: %+v", rejection)
+	}
+	ownDevice.Trust = TrustStateUnset
+	if rejection := machine.AllowKeyShare(ownDevice, event.RequestedKeyInfo{}); rejection == nil || *rejection != KeyShareRejectUnverified {
+		t.Errorf("Default handler didn't reject own unverified device: %+v", rejection)
+	}
+	ownDevice.Trust = TrustStateVerified
+	if rejection := KeyShareNever(ownDevice, event.RequestedKeyInfo{}); rejection == nil || *rejection != KeyShareRejectDisabled {
+		t.Errorf("KeyShareNever didn't reject own verified device: %+v", rejection)
+	}
+}
+
+func TestOlmMachineRetryDecryption(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	retried := make(chan *event.Event, 1)
+	machine.OnRetriedDecryption = func(original, decrypted *event.Event) {
+		retried <- decrypted
+	}
+
+	// Create the outbound session without storing the inbound session, so the first decryption attempt fails.
+	session := NewOutboundGroupSession("room1", nil)
+	sessionKey := session.Internal.Key()
+	session.Shared = true
+	machine.CryptoStore.AddOutboundGroupSession(session)
+	encrypted, err := machine.EncryptMegolmEvent("room1", event.EventMessage, map[string]string{"hello": "world"})
+	if err != nil {
+		t.Fatalf("Error encrypting megolm event: %v", err)
+	}
+	encryptedEvt := &event.Event{
+		Content: event.Content{Parsed: encrypted},
+		Type:    event.EventEncrypted,
+		ID:      "event1",
+		RoomID:  "room1",
+		Sender:  "user1",
+	}
+	if _, err = machine.DecryptMegolmEvent(encryptedEvt); !errors.Is(err, NoSessionFound) {
+		t.Fatalf("Expected NoSessionFound, got %v", err)
+	} else if machine.RetryQueueLength() != 1 {
+		t.Fatalf("Expected 1 event in retry queue, got %d", machine.RetryQueueLength())
+	}
+
+	signingKey, identityKey := machine.account.Keys()
+	machine.createGroupSession(identityKey, signingKey, "room1", session.ID(), sessionKey, "test")
+	select {
+	case decrypted := <-retried:
+		if decrypted.ID != "event1" || decrypted.Content.Raw["hello"] != "world" {
+			t.Errorf("Unexpected retried event: %s %v", decrypted.ID, decrypted.Content.Raw)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Queued event wasn't retried after session arrived")
+	}
+	if machine.RetryQueueLength() != 0 {
+		t.Errorf("Retry queue not empty after retrying")
+	}
+}
+
+func TestOlmMachineUnwedgeFlag(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+
+	otherAccount := NewOlmAccount()
+	otherAccount.Internal.GenOneTimeKeys(1)
+	var otk id.Curve25519
+	for _, otkTmp := range otherAccount.Internal.OneTimeKeys() {
+		otk = otkTmp
+		break
+	}
+	sess, err := machine.account.Internal.NewOutboundSession(otherAccount.IdentityKey(), otk)
+	if err != nil {
+		t.Fatalf("Failed to create outbound olm session: %v", err)
+	}
+	_ = machine.CryptoStore.AddSession(otherAccount.IdentityKey(), wrapSession(sess))
+	if machine.shouldCreateNewSession(otherAccount.IdentityKey()) {
+		t.Error("New session requested for device with working session")
+	}
+
+	machine.devicesToUnwedge[otherAccount.IdentityKey()] = true
+	if !machine.shouldCreateNewSession(otherAccount.IdentityKey()) || !machine.shouldCreateNewSession(otherAccount.IdentityKey()) {
+		t.Error("New session not requested for wedged device until the session is created")
+	}
+	machine.markSessionCreated(otherAccount.IdentityKey())
+	if machine.shouldCreateNewSession(otherAccount.IdentityKey()) {
+		t.Error("New session requested for device after unwedging")
+	}
+}
+
+func TestOlmMachineRehydrateDevice(t *testing.T) {
+	machineOut, storeFileNameOut := newMachine(t, "user1")
+	defer os.Remove(storeFileNameOut)
+	machineIn, storeFileNameIn := newMachine(t, "user2")
+	defer os.Remove(storeFileNameIn)
+
+	// create the dehydrated device and pickle it like CreateDehydratedDevice does
+	pickleKey := []byte("dehydration key")
+	dehydrated := NewOlmAccount()
+	otks := dehydrated.getOneTimeKeys("user2", "DEHYDRATED", 0, &accountKeyProvider{dehydrated})
+	var otk mautrix.OneTimeKey
+	for _, otkTmp := range otks {
+		otk = otkTmp
+		break
+	}
+	internal, err := olm.AccountFromPickled(dehydrated.Internal.Pickle(pickleKey), pickleKey)
+	if err != nil {
+		t.Fatalf("Failed to unpickle dehydrated account: %v", err)
+	}
+	rehydrated := &rehydratedDevice{
+		mach:     machineIn,
+		deviceID: "DEHYDRATED",
+		account:  &OlmAccount{Internal: *internal},
+		sessions: make(map[id.SenderKey][]*OlmSession),
+	}
+
+	olmSession, err := machineOut.account.Internal.NewOutboundSession(dehydrated.IdentityKey(), otk.Key)
+	if err != nil {
+		t.Fatalf("Failed to create outbound olm session: %v", err)
+	}
+	megolmOutSession := machineOut.newOutboundGroupSession("room1")
+	deviceIdentity := &DeviceIdentity{
+		UserID:      "user2",
+		DeviceID:    "DEHYDRATED",
+		IdentityKey: dehydrated.IdentityKey(),
+		SigningKey:  dehydrated.SigningKey(),
+	}
+	content := machineOut.encryptOlmEvent(wrapSession(olmSession), deviceIdentity, event.ToDeviceRoomKey, megolmOutSession.ShareContent())
+	raw, err := json.Marshal(content)
+	if err != nil {
+		t.Fatalf("Failed to marshal encrypted content: %v", err)
+	}
+
+	rehydrated.handleToDeviceEvent(&event.Event{
+		Sender:  "user1",
+		Type:    event.ToDeviceEncrypted,
+		Content: event.Content{VeryRaw: raw},
+	})
+	if rehydrated.roomKeys != 1 {
+		t.Errorf("Expected 1 room key to be received, got %d", rehydrated.roomKeys)
+	}
+	igs, err := machineIn.CryptoStore.GetGroupSession("room1", machineOut.account.IdentityKey(), megolmOutSession.ID())
+	if err != nil {
+		t.Errorf("Failed to get group session: %v", err)
+	} else if igs == nil {
+		t.Error("Room key sent to dehydrated device wasn't imported")
+	}
+}
+
+func TestOlmMachineEncryptedState(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+
+	if machine.ShouldEncryptState("room1", event.StateTopic, "") {
+		t.Error("State event encryption allowed without a policy callback")
+	}
+	machine.ShouldEncryptStateEvent = func(id.RoomID, event.Type, string) bool {
+		return true
+	}
+	if machine.ShouldEncryptState("room1", event.StateMember, "user1") {
+		t.Error("Member event encryption allowed")
+	}
+	_, _, err := machine.EncryptMegolmStateEvent("room1", event.StatePowerLevels, "", &event.PowerLevelsEventContent{})
+	if !errors.Is(err, ErrStateEncryptionNotAllowed) {
+		t.Errorf("Expected ErrStateEncryptionNotAllowed when encrypting power levels, got %v", err)
+	}
+
+	session := machine.newOutboundGroupSession("room1")
+	session.Shared = true
+	machine.CryptoStore.AddOutboundGroupSession(session)
+	stateKey, encrypted, err := machine.EncryptMegolmStateEvent("room1", event.StateTopic, "", &event.TopicEventContent{Topic: "secret"})
+	if err != nil {
+		t.Fatalf("Failed to encrypt state event: %v", err)
+	} else if stateKey != "12:m.room.topic:" {
+		t.Errorf("Unexpected packed state key %q", stateKey)
+	}
+
+	evt := &event.Event{
+		Sender:   "user1",
+		Type:     event.StateEncrypted,
+		StateKey: &stateKey,
+		ID:       "$state",
+		RoomID:   "room1",
+		Content:  event.Content{Parsed: encrypted},
+	}
+	decrypted, err := machine.DecryptMegolmEvent(evt)
+	if err != nil {
+		t.Fatalf("Failed to decrypt state event: %v", err)
+	} else if decrypted.Type != event.StateTopic || decrypted.StateKey == nil || *decrypted.StateKey != "" {
+		t.Errorf("Decrypted state event has wrong type or state key: %s %v", decrypted.Type.Repr(), decrypted.StateKey)
+	} else if decrypted.Content.AsTopic().Topic != "secret" {
+		t.Errorf("Decrypted state event has wrong content: %+v", decrypted.Content.Parsed)
+	}
+
+	wrongStateKey := "11:m.room.name:"
+	evt.StateKey = &wrongStateKey
+	if _, err = machine.DecryptMegolmEvent(evt); err != ErrInvalidEncryptedStateKey {
+		t.Errorf("Expected ErrInvalidEncryptedStateKey for mismatched state key, got %v", err)
+	}
+}
+
+func TestPackStateKey(t *testing.T) {
+	for _, evtType := range []event.Type{event.StateTopic, {Type: "com.example:custom"}, {Type: "a:b:c"}} {
+		for _, stateKey := range []string{"", "@user:example.com", ":", "1:x:"} {
+			packed := packStateKey(evtType, stateKey)
+			if unpackedType, unpackedStateKey, ok := unpackStateKey(packed); !ok || unpackedType != evtType.Type || unpackedStateKey != stateKey {
+				t.Errorf("%q unpacked to %q / %q / %t", packed, unpackedType, unpackedStateKey, ok)
+			}
+		}
+	}
+	for _, packed := range []string{"", "m.room.topic:", ":m.room.topic:", "12:m.room.topic", "13:m.room.topic:", "012:m.room.topic:", "-1:x"} {
+		if _, _, ok := unpackStateKey(packed); ok {
+			t.Errorf("Invalid packed state key %q was unpacked", packed)
+		}
+	}
+}
+
+func TestOlmMachineFallbackKeys(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+
+	fallbackKeys := machine.account.getFallbackKeys("user1", "device1", true, machine.KeyProvider)
+	if len(fallbackKeys) != 1 {
+		t.Fatalf("Expected 1 fallback key, got %d", len(fallbackKeys))
+	}
+	for keyID, key := range fallbackKeys {
+		if !key.IsFallback || !key.IsSigned {
+			t.Errorf("Fallback key %s isn't marked as a signed fallback key", keyID)
+		}
+		data, _ := json.Marshal(&key)
+		var parsed map[string]interface{}
+		_ = json.Unmarshal(data, &parsed)
+		if parsed["fallback"] != true {
+			t.Errorf("Serialized fallback key doesn't have the fallback flag: %s", data)
+		}
+	}
+	// Fetching one-time keys marks the fallback key as published too.
+	machine.account.getOneTimeKeys("user1", "device1", 0, machine.KeyProvider)
+	if keys := machine.account.getFallbackKeys("user1", "device1", false, machine.KeyProvider); len(keys) != 0 {
+		t.Errorf("Fallback key wasn't marked as published: %v", keys)
+	}
+
+	if machine.needsNewFallbackKey(nil) {
+		t.Error("New fallback key requested when server doesn't support fallback keys")
+	} else if machine.needsNewFallbackKey([]id.KeyAlgorithm{id.KeyAlgorithmSignedCurve25519}) {
+		t.Error("New fallback key requested when the previous one is unused")
+	} else if !machine.needsNewFallbackKey([]id.KeyAlgorithm{}) {
+		t.Error("New fallback key not requested when the previous one was used")
+	}
+}
+
+func TestOlmMachineGroupSessionCache(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	machine.EnableGroupSessionCache(2, time.Hour)
+
+	signingKey, senderKey := machine.account.Internal.IdentityKeys()
+	sessions := make([]*InboundGroupSession, 3)
+	for i := range sessions {
+		igs, err := NewInboundGroupSession(senderKey, signingKey, "room1", olm.NewOutboundGroupSession().Key())
+		if err != nil {
+			t.Fatalf("Error creating inbound group session: %v", err)
+		}
+		if err = machine.putGroupSession("room1", senderKey, igs.ID(), igs); err != nil {
+			t.Fatalf("Error storing inbound group session: %v", err)
+		}
+		sessions[i] = igs
+	}
+	cacheKey := func(igs *InboundGroupSession) groupSessionCacheKey {
+		return groupSessionCacheKey{igs.RoomID, igs.SenderKey, igs.ID()}
+	}
+	if machine.groupSessionCache.get(cacheKey(sessions[0])) != nil {
+		t.Errorf("Least recently used session wasn't evicted")
+	}
+	if stored, err := machine.CryptoStore.GetGroupSession("room1", senderKey, sessions[0].ID()); err != nil || stored == nil {
+		t.Errorf("Session wasn't written through to the store: %v", err)
+	}
+	if sess, err := machine.getGroupSession("room1", senderKey, sessions[0].ID()); err != nil || sess == nil {
+		t.Errorf("Evicted session wasn't loaded from the store: %v", err)
+	} else if machine.groupSessionCache.get(cacheKey(sessions[0])) == nil {
+		t.Errorf("Session loaded from the store wasn't cached")
+	} else if machine.groupSessionCache.get(cacheKey(sessions[1])) != nil {
+		t.Errorf("Expected second session to be evicted after loading the first one")
+	}
+
+	if _, err := machine.Prune(PruneOptions{KeepGroupSessionsForRoom: func(id.RoomID) bool { return false }}); err != nil {
+		t.Fatalf("Error pruning store: %v", err)
+	} else if sess, _ := machine.getGroupSession("room1", senderKey, sessions[2].ID()); sess != nil {
+		t.Errorf("Pruned session is still cached")
+	}
+
+	machine.EnableGroupSessionCache(2, time.Millisecond)
+	machine.groupSessionCache.put(cacheKey(sessions[0]), sessions[0])
+	time.Sleep(5 * time.Millisecond)
+	if machine.groupSessionCache.get(cacheKey(sessions[0])) != nil {
+		t.Errorf("Expired session was returned from the cache")
+	}
+}
+
+func TestOlmMachineGroupSessionCacheConcurrentDecrypt(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	// The SQL store returns a new session object every time, so the only shared object is the cached one.
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	sqlStore := NewSQLCryptoStore(db, "sqlite3", "accid", "device1", []byte("test"), emptyLogger{})
+	if err = sqlStore.CreateTables(); err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+	machine.CryptoStore = sqlStore
+	machine.saveAccount()
+	machine.EnableGroupSessionCache(10, time.Hour)
+
+	session := machine.newOutboundGroupSession("room1")
+	session.Shared = true
+	session.MaxMessages = 0
+	machine.CryptoStore.AddOutboundGroupSession(session)
+	events := make([]*event.Event, 8)
+	for i := range events {
+		content, err := machine.EncryptMegolmEvent("room1", event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    fmt.Sprintf("message %d", i),
+		})
+		if err != nil {
+			t.Fatalf("Failed to encrypt event: %v", err)
+		}
+		events[i] = &event.Event{
+			Sender:  "user1",
+			Type:    event.EventEncrypted,
+			ID:      id.EventID(fmt.Sprintf("$event%d", i)),
+			RoomID:  "room1",
+			Content: event.Content{Parsed: content},
+		}
+	}
+
+	// All goroutines decrypt with the same cached session object.
+	var wg sync.WaitGroup
+	for i, evt := range events {
+		wg.Add(1)
+		go func(i int, evt *event.Event) {
+			defer wg.Done()
+			decrypted, err := machine.DecryptMegolmEvent(evt)
+			if err != nil {
+				t.Errorf("Failed to decrypt event %d: %v", i, err)
+			} else if body := decrypted.Content.AsMessage().Body; body != fmt.Sprintf("message %d", i) {
+				t.Errorf("Event %d decrypted to wrong body %q", i, body)
+			}
+		}(i, evt)
+	}
+	wg.Wait()
+}
+
+func TestOlmMachineDecryptMany(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+
+	session := machine.newOutboundGroupSession("room1")
+	session.Shared = true
+	machine.CryptoStore.AddOutboundGroupSession(session)
+
+	var events []*event.Event
+	for i := 0; i < 3; i++ {
+		content, err := machine.EncryptMegolmEvent("room1", event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    fmt.Sprintf("message %d", i),
+		})
+		if err != nil {
+			t.Fatalf("Failed to encrypt event: %v", err)
+		}
+		events = append(events, &event.Event{
+			Sender:  "user1",
+			Type:    event.EventEncrypted,
+			ID:      id.EventID(fmt.Sprintf("$event%d", i)),
+			RoomID:  "room1",
+			Content: event.Content{Parsed: content},
+		})
+	}
+	events = append(events, &event.Event{
+		Sender: "user1",
+		Type:   event.EventEncrypted,
+		ID:     "$unknown",
+		RoomID: "room1",
+		Content: event.Content{Parsed: &event.EncryptedEventContent{
+			Algorithm:        id.AlgorithmMegolmV1,
+			SenderKey:        machine.account.IdentityKey(),
+			SessionID:        "unknown",
+			MegolmCiphertext: []byte("invalid"),
+		}},
+	}, &event.Event{
+		Sender:  "user1",
+		Type:    event.EventMessage,
+		ID:      "$plaintext",
+		RoomID:  "room1",
+		Content: event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: "hi"}},
+	})
+
+	results := machine.DecryptMany(context.Background(), events)
+	if len(results) != len(events) {
+		t.Fatalf("Expected %d results, got %d", len(events), len(results))
+	}
+	for i := 0; i < 3; i++ {
+		if results[i].Error != nil {
+			t.Errorf("Failed to decrypt event %d: %v", i, results[i].Error)
+		} else if body := results[i].Event.Content.AsMessage().Body; body != fmt.Sprintf("message %d", i) {
+			t.Errorf("Event %d decrypted to wrong body %q", i, body)
+		}
+	}
+	if !errors.Is(results[3].Error, NoSessionFound) {
+		t.Errorf("Expected NoSessionFound for unknown session, got %v", results[3].Error)
+	}
+	if results[4].Error != IncorrectEncryptedContentType {
+		t.Errorf("Expected IncorrectEncryptedContentType for unencrypted event, got %v", results[4].Error)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results = machine.DecryptMany(ctx, events[:3])
+	for i, result := range results {
+		if result.Event == nil && result.Error == nil {
+			t.Errorf("Event %d has no result after canceling context", i)
+		}
+	}
+}
+
+// newTestDevice creates a device with a new olm account and stores an outbound olm session to it in the machine.
+func newTestDevice(t *testing.T, machine *OlmMachine, userID id.UserID, deviceID id.DeviceID) *DeviceIdentity {
+	otherAccount := NewOlmAccount()
+	otherAccount.Internal.GenOneTimeKeys(1)
+	var otk id.Curve25519
+	for _, otkTmp := range otherAccount.Internal.OneTimeKeys() {
+		otk = otkTmp
+	}
+	sess, err := machine.account.Internal.NewOutboundSession(otherAccount.IdentityKey(), otk)
+	if err != nil {
+		t.Fatalf("Failed to create outbound olm session: %v", err)
+	}
+	_ = machine.CryptoStore.AddSession(otherAccount.IdentityKey(), wrapSession(sess))
+	return &DeviceIdentity{
+		UserID:      userID,
+		DeviceID:    deviceID,
+		IdentityKey: otherAccount.IdentityKey(),
+		SigningKey:  otherAccount.SigningKey(),
+	}
+}
+
+func TestOlmMachineShareGroupSessionProgress(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN", "error": "test failure"}`))
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	machine.Client.HomeserverURL, _ = url.Parse(server.URL)
+	machine.MaxToDeviceMessagesPerRequest = 1
+
+	devices := make(map[id.DeviceID]*DeviceIdentity)
+	for _, deviceID := range []id.DeviceID{"deviceA", "deviceB"} {
+		devices[deviceID] = newTestDevice(t, machine, "user2", deviceID)
+	}
+	_ = machine.CryptoStore.PutDevices("user2", devices)
+
+	var updates []ShareProgress
+	err := machine.ShareGroupSessionWithProgress("room1", []id.UserID{"user2"}, func(progress ShareProgress) {
+		updates = append(updates, progress)
+	})
+	if err == nil {
+		t.Fatal("Expected error when a to-device batch fails")
+	}
+	final := updates[len(updates)-1]
+	if !final.Done || final.TotalBatches != 2 || final.BatchesSent != 1 || len(final.Failed) != 1 {
+		t.Fatalf("Unexpected final progress: %+v", final)
+	}
+	session, _ := machine.CryptoStore.GetOutboundGroupSession("room1")
+	if session.Shared {
+		t.Error("Partially shared session was marked as shared")
+	} else if session.Users[final.Failed[0]] != OGSNotShared {
+		t.Error("Failed device wasn't left as not shared")
+	}
+
+	// Retrying should only send the room key to the device that failed.
+	updates = nil
+	err = machine.ShareGroupSessionWithProgress("room1", []id.UserID{"user2"}, func(progress ShareProgress) {
+		updates = append(updates, progress)
+	})
+	if err != nil {
+		t.Fatalf("Failed to retry sharing group session: %v", err)
+	}
+	final = updates[len(updates)-1]
+	if final.TotalBatches != 1 || final.BatchesSent != 1 || len(final.Failed) != 0 {
+		t.Errorf("Unexpected final progress after retry: %+v", final)
+	}
+}
+
+func TestOlmMachineAutoShareOnNewDevice(t *testing.T) {
+	var sentTo []id.DeviceID
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req mautrix.ReqSendToDevice
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		for deviceID := range req.Messages["user2"] {
+			sentTo = append(sentTo, deviceID)
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	machine.Client.HomeserverURL, _ = url.Parse(server.URL)
+	_ = machine.CryptoStore.PutDevices("user1", map[id.DeviceID]*DeviceIdentity{})
+	devices := map[id.DeviceID]*DeviceIdentity{
+		"deviceA": newTestDevice(t, machine, "user2", "deviceA"),
+	}
+	_ = machine.CryptoStore.PutDevices("user2", devices)
+
+	encrypted, err := machine.EncryptMegolmEventAutoShare("room1", event.EventMessage, map[string]string{"hello": "world"})
+	if err != nil {
+		t.Fatalf("Failed to encrypt event: %v", err)
+	} else if len(sentTo) != 1 || sentTo[0] != "deviceA" {
+		t.Fatalf("Expected session to be shared with deviceA, got %v", sentTo)
+	}
+	sessionID := encrypted.SessionID
+
+	// A new device should get the existing session, without it being re-sent to the old device.
+	sentTo = nil
+	devices["deviceB"] = newTestDevice(t, machine, "user2", "deviceB")
+	_ = machine.CryptoStore.PutDevices("user2", devices)
+	machine.onDevicesAdded("user2")
+	encrypted, err = machine.EncryptMegolmEventAutoShare("room1", event.EventMessage, map[string]string{"hello": "world"})
+	if err != nil {
+		t.Fatalf("Failed to encrypt event after new device: %v", err)
+	} else if encrypted.SessionID != sessionID {
+		t.Error("Session was rotated after new device even though policy doesn't require it")
+	} else if len(sentTo) != 1 || sentTo[0] != "deviceB" {
+		t.Errorf("Expected session to only be shared with deviceB, got %v", sentTo)
+	}
+
+	// With RotateOnNewDevice, the session should be replaced and shared with all devices.
+	sentTo = nil
+	policy := machine.GetRotationPolicy("room1")
+	policy.RotateOnNewDevice = true
+	machine.SetRotationPolicy("room1", &policy)
+	machine.onDevicesAdded("user2")
+	encrypted, err = machine.EncryptMegolmEventAutoShare("room1", event.EventMessage, map[string]string{"hello": "world"})
+	if err != nil {
+		t.Fatalf("Failed to encrypt event after rotation: %v", err)
+	} else if encrypted.SessionID == sessionID {
+		t.Error("Session wasn't rotated after new device with RotateOnNewDevice")
+	} else if len(sentTo) != 2 {
+		t.Errorf("Expected new session to be shared with both devices, got %v", sentTo)
+	}
+}
+
+func TestOlmMachineSendEncryptedToDeviceID(t *testing.T) {
+	var sent *mautrix.ReqSendToDevice
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&sent)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	machineOut, storeFileNameOut := newMachine(t, "user1")
+	defer os.Remove(storeFileNameOut)
+	machineOut.Client.HomeserverURL, _ = url.Parse(server.URL)
+	machineIn, storeFileNameIn := newMachine(t, "user2")
+	defer os.Remove(storeFileNameIn)
+
+	machineIn.account.Internal.GenOneTimeKeys(1)
+	var otk id.Curve25519
+	for _, otkTmp := range machineIn.account.Internal.OneTimeKeys() {
+		otk = otkTmp
+	}
+	olmSession, err := machineOut.account.Internal.NewOutboundSession(machineIn.account.IdentityKey(), otk)
+	if err != nil {
+		t.Fatalf("Failed to create outbound olm session: %v", err)
+	}
+	_ = machineOut.CryptoStore.AddSession(machineIn.account.IdentityKey(), wrapSession(olmSession))
+	_ = machineOut.CryptoStore.PutDevices("user2", map[id.DeviceID]*DeviceIdentity{
+		"device2": {
+			UserID:      "user2",
+			DeviceID:    "device2",
+			IdentityKey: machineIn.account.IdentityKey(),
+			SigningKey:  machineIn.account.SigningKey(),
+		},
+	})
+	_ = machineIn.CryptoStore.PutDevices("user1", map[id.DeviceID]*DeviceIdentity{
+		"device1": {
+			UserID:      "user1",
+			DeviceID:    "device1",
+			IdentityKey: machineOut.account.IdentityKey(),
+			SigningKey:  machineOut.account.SigningKey(),
+		},
+	})
+
+	customType := event.Type{Type: "com.example.ping", Class: event.ToDeviceEventType}
+	err = machineOut.SendEncryptedToDeviceID(context.Background(), "user2", "device2", customType, map[string]string{"ping": "pong"})
+	if err != nil {
+		t.Fatalf("Failed to send encrypted to-device event: %v", err)
+	}
+	content, ok := sent.Messages["user2"]["device2"]
+	if !ok {
+		t.Fatalf("Didn't send event to device2: %+v", sent)
+	}
+
+	var received *DecryptedOlmEvent
+	machineIn.OnCustomEncryptedToDevice = func(evt *DecryptedOlmEvent) {
+		received = evt
+	}
+	evt := &event.Event{Sender: "user1", Type: event.ToDeviceEncrypted, Content: event.Content{VeryRaw: content.VeryRaw}}
+	if err = evt.Content.ParseRaw(evt.Type); err != nil {
+		t.Fatalf("Failed to parse encrypted content: %v", err)
+	}
+	machineIn.HandleToDeviceEvent(evt)
+	if received == nil {
+		t.Fatal("Custom encrypted to-device event wasn't passed to OnCustomEncryptedToDevice")
+	} else if received.Type.Type != customType.Type || received.Content.Raw["ping"] != "pong" {
+		t.Errorf("Unexpected decrypted event: %s %v", received.Type.Type, received.Content.Raw)
+	}
+}
+
+func TestOlmMachineDeviceListTracking(t *testing.T) {
+	var queries int32
+	var fail int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN", "error": "test failure"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"device_keys": {"user2": {}}}`))
+	}))
+	defer server.Close()
+
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	machine.Client.HomeserverURL, _ = url.Parse(server.URL)
+	_ = machine.CryptoStore.PutDevices("user2", map[id.DeviceID]*DeviceIdentity{
+		"deviceA": newTestDevice(t, machine, "user2", "deviceA"),
+	})
+
+	machine.HandleDeviceLists(&mautrix.DeviceLists{Changed: []id.UserID{"user2", "user3"}}, "")
+	if atomic.LoadInt32(&queries) != 1 {
+		t.Fatalf("Expected 1 key query, got %d", queries)
+	}
+	if outdated, _ := machine.CryptoStore.GetOutdatedTrackedUsers(); len(outdated) != 1 || outdated[0] != "user2" {
+		t.Fatalf("Expected user2 to stay outdated after failed query, got %v", outdated)
+	}
+	// The next sync shouldn't retry the query before the backoff has passed.
+	machine.HandleDeviceLists(&mautrix.DeviceLists{}, "")
+	if atomic.LoadInt32(&queries) != 1 {
+		t.Errorf("Key query was retried during backoff")
+	}
+
+	atomic.StoreInt32(&fail, 0)
+	devices, err := machine.WaitForDeviceList("user2")
+	if err != nil {
+		t.Fatalf("Failed to wait for device list: %v", err)
+	} else if len(devices) != 0 {
+		t.Errorf("Expected updated device list to be empty, got %d devices", len(devices))
+	}
+	if outdated, _ := machine.CryptoStore.GetOutdatedTrackedUsers(); len(outdated) != 0 {
+		t.Errorf("Expected no outdated users after update, got %v", outdated)
+	}
+	queriesBefore := atomic.LoadInt32(&queries)
+	if _, err = machine.WaitForDeviceList("user2"); err != nil || atomic.LoadInt32(&queries) != queriesBefore {
+		t.Errorf("Up-to-date device list was fetched again (error: %v)", err)
+	}
+}
+
+func TestOlmMachineSecretSharing(t *testing.T) {
+	newDevice, storeFileNameA := newMachineWithDevice(t, "user1", "device1")
+	defer os.Remove(storeFileNameA)
+	oldDevice, storeFileNameB := newMachineWithDevice(t, "user1", "device2")
+	defer os.Remove(storeFileNameB)
+
+	keys, err := oldDevice.GenerateCrossSigningKeys()
+	if err != nil {
+		t.Fatalf("Failed to generate cross-signing keys: %v", err)
+	}
+	oldDevice.CrossSigningKeys = keys
+	_ = newDevice.CryptoStore.PutCrossSigningKey("user1", id.XSUsageMaster, keys.MasterKey.PublicKey)
+	_ = newDevice.CryptoStore.PutCrossSigningKey("user1", id.XSUsageSelfSigning, keys.SelfSigningKey.PublicKey)
+	_ = newDevice.CryptoStore.PutCrossSigningKey("user1", id.XSUsageUserSigning, keys.UserSigningKey.PublicKey)
+
+	// The devices have verified each other with SAS
+	_ = newDevice.CryptoStore.PutDevice("user1", oldDevice.OwnIdentity())
+	newDeviceIdentity := newDevice.OwnIdentity()
+	newDeviceIdentity.Trust = TrustStateUnset
+	_ = oldDevice.CryptoStore.PutDevice("user1", newDeviceIdentity)
+	establishOlmSession(t, oldDevice, newDevice)
+
+	sentByNew := make(chan string, 64)
+	sentByOld := make(chan string, 64)
+	serverNew := newToDeviceRelay(t, "user1", oldDevice, sentByNew)
+	defer serverNew.Close()
+	serverOld := newToDeviceRelay(t, "user1", newDevice, sentByOld)
+	defer serverOld.Close()
+	newDevice.Client.HomeserverURL, _ = url.Parse(serverNew.URL)
+	oldDevice.Client.HomeserverURL, _ = url.Parse(serverOld.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	_, err = newDevice.RequestSecret(ctx, id.SecretXSMaster)
+	cancel()
+	if !errors.Is(err, ErrSecretRequestCancelled) {
+		t.Errorf("Expected secret request from unverified device to time out, got %v", err)
+	}
+
+	_ = oldDevice.CryptoStore.PutDevice("user1", newDevice.OwnIdentity())
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = newDevice.RequestCrossSigningKeys(ctx)
+	if err != nil {
+		t.Fatalf("Failed to request cross-signing keys: %v", err)
+	} else if newDevice.CrossSigningKeys == nil || newDevice.CrossSigningKeys.MasterKey.PublicKey != keys.MasterKey.PublicKey ||
+		newDevice.CrossSigningKeys.UserSigningKey.PublicKey != keys.UserSigningKey.PublicKey {
+		t.Error("Received cross-signing keys don't match")
+	}
+}
+
+// reloadingStore simulates a store that supports cross-process account locking, which returns a new account object
+// every time the account is reloaded.
+type reloadingStore struct {
+	Store
+}
+
+func (store reloadingStore) LockAccount(context.Context) (func(), error) {
+	return func() {}, nil
+}
+
+func (store reloadingStore) GetAccount() (*OlmAccount, error) {
+	account, err := store.Store.GetAccount()
+	if err != nil || account == nil {
+		return account, err
+	}
+	internal, err := olm.AccountFromPickled(account.Internal.Pickle([]byte("test")), []byte("test"))
+	if err != nil {
+		return nil, err
+	}
+	return &OlmAccount{Internal: *internal, Shared: account.Shared}, nil
+}
+
+func TestOlmMachineShareKeysConcurrent(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	machine.CryptoStore = reloadingStore{machine.CryptoStore}
+	machine.saveAccount()
+	var uploads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&uploads, 1)
+		_ = json.NewEncoder(w).Encode(&mautrix.RespUploadKeys{})
+	}))
+	defer server.Close()
+	machine.Client.HomeserverURL, _ = url.Parse(server.URL)
+
+	identityKey := machine.OwnIdentity().IdentityKey
+	done := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if machine.OwnIdentity().IdentityKey != identityKey {
+				t.Error("Identity key changed while sharing keys")
+				return
+			}
+			_, _ = machine.KeyProvider.SignJSON(KeyUsageDevice, map[string]string{"foo": "bar"})
+		}
+	}()
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			errs <- machine.ShareKeys(0)
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Failed to share keys: %v", err)
+		}
+	}
+	close(done)
+	<-readerDone
+	if !machine.isAccountShared() {
+		t.Error("Account wasn't marked as shared")
+	} else if atomic.LoadInt32(&uploads) == 0 {
+		t.Error("No keys were uploaded")
+	}
+}
@@ -1,3 +1,6 @@
+//go:build !goolm
+// +build !goolm
+
 package olm
 
 // #cgo LDFLAGS: -lolm -lstdc++
@@ -5,7 +8,6 @@ package olm
 import "C"
 
 import (
-	"crypto/rand"
 	"encoding/json"
 	"unsafe"
 
@@ -13,6 +15,7 @@ import (
 	"github.com/tidwall/sjson"
 
 	"maunium.net/go/mautrix/crypto/canonicaljson"
+	"maunium.net/go/mautrix/crypto/utils"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -47,7 +50,7 @@ func NewBlankAccount() *Account {
 func NewAccount() *Account {
 	a := NewBlankAccount()
 	random := make([]byte, a.createRandomLen()+1)
-	_, err := rand.Read(random)
+	_, err := utils.ReadRandom(random)
 	if err != nil {
 		panic(NotEnoughGoRandom)
 	}
@@ -292,7 +295,7 @@ func (a *Account) MaxNumberOfOneTimeKeys() uint {
 // keys are discarded.
 func (a *Account) GenOneTimeKeys(num uint) {
 	random := make([]byte, a.genOneTimeKeysRandomLen(num)+1)
-	_, err := rand.Read(random)
+	_, err := utils.ReadRandom(random)
 	if err != nil {
 		panic(NotEnoughGoRandom)
 	}
@@ -306,6 +309,60 @@ func (a *Account) GenOneTimeKeys(num uint) {
 	}
 }
 
+func (a *Account) genFallbackKeyRandomLen() uint {
+	return uint(C.olm_account_generate_fallback_key_random_length((*C.OlmAccount)(a.int)))
+}
+
+func (a *Account) fallbackKeyLen() uint {
+	return uint(C.olm_account_unpublished_fallback_key_length((*C.OlmAccount)(a.int)))
+}
+
+// GenFallbackKey generates a new fallback key. The previous fallback key is
+// kept until ForgetOldFallbackKey is called or another fallback key is
+// generated, so that messages encrypted with it can still be decrypted.
+func (a *Account) GenFallbackKey() {
+	random := make([]byte, a.genFallbackKeyRandomLen()+1)
+	_, err := utils.ReadRandom(random)
+	if err != nil {
+		panic(NotEnoughGoRandom)
+	}
+	r := C.olm_account_generate_fallback_key(
+		(*C.OlmAccount)(a.int),
+		unsafe.Pointer(&random[0]),
+		C.size_t(len(random)))
+	if r == errorVal() {
+		panic(a.lastError())
+	}
+}
+
+// FallbackKey returns the public part of the current fallback key for the
+// Account if it hasn't been published yet, as a map from key ID to
+// base64-encoded Curve25519 key. Fallback keys are marked as published by
+// MarkKeysAsPublished.
+func (a *Account) FallbackKey() map[string]id.Curve25519 {
+	fallbackKeyJSON := make([]byte, a.fallbackKeyLen())
+	r := C.olm_account_unpublished_fallback_key(
+		(*C.OlmAccount)(a.int),
+		unsafe.Pointer(&fallbackKeyJSON[0]),
+		C.size_t(len(fallbackKeyJSON)))
+	if r == errorVal() {
+		panic(a.lastError())
+	}
+	var fallbackKey struct {
+		Curve25519 map[string]id.Curve25519 `json:"curve25519"`
+	}
+	err := json.Unmarshal(fallbackKeyJSON[:r], &fallbackKey)
+	if err != nil {
+		panic(err)
+	}
+	return fallbackKey.Curve25519
+}
+
+// ForgetOldFallbackKey removes the previous fallback key from the Account.
+func (a *Account) ForgetOldFallbackKey() {
+	C.olm_account_forget_old_fallback_key((*C.OlmAccount)(a.int))
+}
+
 // NewOutboundSession creates a new out-bound session for sending messages to a
 // given curve25519 identityKey and oneTimeKey.  Returns error on failure.  If the
 // keys couldn't be decoded as base64 then the error will be "INVALID_BASE64"
@@ -315,7 +372,7 @@ func (a *Account) NewOutboundSession(theirIdentityKey, theirOneTimeKey id.Curve2
 	}
 	s := NewBlankSession()
 	random := make([]byte, s.createOutboundRandomLen()+1)
-	_, err := rand.Read(random)
+	_, err := utils.ReadRandom(random)
 	if err != nil {
 		panic(NotEnoughGoRandom)
 	}
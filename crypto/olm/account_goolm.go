@@ -0,0 +1,510 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/tidwall/sjson"
+
+	"maunium.net/go/mautrix/crypto/canonicaljson"
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/id"
+)
+
+// maxOneTimeKeys is the maximum number of one-time keys an account stores, same as in libolm.
+const maxOneTimeKeys = 100
+
+type oneTimeKey struct {
+	ID        uint32            `json:"id"`
+	Published bool              `json:"published"`
+	Key       curve25519KeyPair `json:"key"`
+}
+
+func (otk *oneTimeKey) keyID() string {
+	var rawID [4]byte
+	binary.BigEndian.PutUint32(rawID[:], otk.ID)
+	return string(encodeBase64(rawID[:]))
+}
+
+func (otk *oneTimeKey) pickle(pw *pickleWriter) {
+	pw.writeUint32(otk.ID)
+	pw.writeBool(otk.Published)
+	otk.Key.pickle(pw)
+}
+
+func (otk *oneTimeKey) unpickle(pr *pickleReader) {
+	otk.ID = pr.readUint32()
+	otk.Published = pr.readBool()
+	otk.Key.unpickle(pr)
+}
+
+// accountState is the pickled state of an Account.
+type accountState struct {
+	Ed25519Key       ed25519KeyPair
+	Curve25519Key    curve25519KeyPair
+	OneTimeKeys      []oneTimeKey
+	NextOneTimeKeyID uint32
+
+	CurrentFallbackKey *oneTimeKey
+	PrevFallbackKey    *oneTimeKey
+}
+
+// legacyAccountState is the JSON state in the pickles that goolm made before accounts were pickled in the libolm format.
+type legacyAccountState struct {
+	Ed25519Key       ed25519.PrivateKey `json:"ed25519_key"`
+	Curve25519Key    curve25519KeyPair  `json:"curve25519_key"`
+	OneTimeKeys      []oneTimeKey       `json:"one_time_keys"`
+	NextOneTimeKeyID uint32             `json:"next_one_time_key_id"`
+
+	CurrentFallbackKey *oneTimeKey `json:"current_fallback_key,omitempty"`
+	PrevFallbackKey    *oneTimeKey `json:"prev_fallback_key,omitempty"`
+}
+
+// Account stores a device account for end to end encrypted messaging.
+type Account struct {
+	state accountState
+}
+
+// AccountFromPickled loads an Account from a pickled base64 string.  Decrypts
+// the Account using the supplied key.  Returns error on failure.  If the key
+// doesn't match the one used to encrypt the Account then the error will be
+// "BAD_ACCOUNT_KEY".  If the base64 couldn't be decoded then the error will be
+// "INVALID_BASE64".
+func AccountFromPickled(pickled, key []byte) (*Account, error) {
+	if len(pickled) == 0 {
+		return nil, EmptyInput
+	}
+	a := NewBlankAccount()
+	return a, a.Unpickle(pickled, key)
+}
+
+func NewBlankAccount() *Account {
+	return &Account{}
+}
+
+// NewAccount creates a new Account.
+func NewAccount() *Account {
+	return &Account{state: accountState{
+		Ed25519Key:    newEd25519KeyPair(),
+		Curve25519Key: newCurve25519KeyPair(),
+	}}
+}
+
+// Clear clears the memory used to back this Account.
+func (a *Account) Clear() error {
+	a.state.Ed25519Key.wipe()
+	a.state.Curve25519Key.wipe()
+	for _, otk := range a.state.OneTimeKeys {
+		otk.Key.wipe()
+	}
+	a.ForgetOldFallbackKey()
+	if a.state.CurrentFallbackKey != nil {
+		a.state.CurrentFallbackKey.Key.wipe()
+	}
+	a.state = accountState{}
+	return nil
+}
+
+// accountPickleVersion is the libolm account pickle version. Accounts use the same pickle format as libolm,
+// so they can be shared between the implementations.
+const accountPickleVersion = 4
+
+// Pickle returns an Account as a base64 string. Encrypts the Account using the
+// supplied key.
+func (a *Account) Pickle(key []byte) []byte {
+	var pw pickleWriter
+	pw.writeUint32(accountPickleVersion)
+	a.state.Ed25519Key.pickle(&pw)
+	a.state.Curve25519Key.pickle(&pw)
+	pw.writeUint32(uint32(len(a.state.OneTimeKeys)))
+	for i := range a.state.OneTimeKeys {
+		a.state.OneTimeKeys[i].pickle(&pw)
+	}
+	if a.state.CurrentFallbackKey == nil {
+		pw.WriteByte(0)
+	} else if a.state.PrevFallbackKey == nil {
+		pw.WriteByte(1)
+		a.state.CurrentFallbackKey.pickle(&pw)
+	} else {
+		pw.WriteByte(2)
+		a.state.CurrentFallbackKey.pickle(&pw)
+		a.state.PrevFallbackKey.pickle(&pw)
+	}
+	pw.writeUint32(a.state.NextOneTimeKeyID)
+	defer utils.WipeBytes(pw.Bytes())
+	return encryptPickle(key, pw.Bytes())
+}
+
+func (a *Account) Unpickle(pickled, key []byte) error {
+	plaintext, err := decryptPickle(pickled, key)
+	if err != nil {
+		return err
+	}
+	defer utils.WipeBytes(plaintext)
+	pr := pickleReader{data: plaintext}
+	version := pr.readUint32()
+	if pr.err != nil {
+		return pr.err
+	}
+	var state accountState
+	switch version {
+	case legacyGoolmPickleVersion:
+		err = state.unmarshalLegacyJSON(pr.data)
+	case 2, 3, accountPickleVersion:
+		state.unpickle(&pr, version)
+		err = pr.err
+	case 1:
+		err = BadLegacyAccountPickle
+	default:
+		err = UnknownPickleVersion
+	}
+	if err != nil {
+		return err
+	}
+	a.state = state
+	return nil
+}
+
+func (state *accountState) unpickle(pr *pickleReader, version uint32) {
+	state.Ed25519Key.unpickle(pr)
+	state.Curve25519Key.unpickle(pr)
+	state.OneTimeKeys = make([]oneTimeKey, pr.readCount(maxOneTimeKeys))
+	for i := range state.OneTimeKeys {
+		state.OneTimeKeys[i].unpickle(pr)
+	}
+	var currentFallbackKey, prevFallbackKey oneTimeKey
+	var fallbackKeyCount uint8
+	switch version {
+	case 2:
+		// Version 2 didn't have fallback keys.
+	case 3:
+		// Version 3 always contained both fallback keys and used the published flag to tell whether they exist.
+		currentFallbackKey.unpickle(pr)
+		prevFallbackKey.unpickle(pr)
+		if currentFallbackKey.Published && prevFallbackKey.Published {
+			fallbackKeyCount = 2
+		} else if currentFallbackKey.Published {
+			fallbackKeyCount = 1
+		}
+	default:
+		fallbackKeyCount = pr.readUint8()
+		if fallbackKeyCount > 2 {
+			pr.err = CorruptedPickle
+		}
+		if fallbackKeyCount >= 1 {
+			currentFallbackKey.unpickle(pr)
+		}
+		if fallbackKeyCount >= 2 {
+			prevFallbackKey.unpickle(pr)
+		}
+	}
+	if fallbackKeyCount >= 1 {
+		state.CurrentFallbackKey = &currentFallbackKey
+	}
+	if fallbackKeyCount >= 2 {
+		state.PrevFallbackKey = &prevFallbackKey
+	}
+	state.NextOneTimeKeyID = pr.readUint32()
+}
+
+func (state *accountState) unmarshalLegacyJSON(data []byte) error {
+	var legacyState legacyAccountState
+	if json.Unmarshal(data, &legacyState) != nil || len(legacyState.Ed25519Key) != ed25519.PrivateKeySize {
+		return CorruptedPickle
+	}
+	*state = accountState{
+		Ed25519Key:         ed25519KeyPairFromPrivateKey(legacyState.Ed25519Key),
+		Curve25519Key:      legacyState.Curve25519Key,
+		OneTimeKeys:        legacyState.OneTimeKeys,
+		NextOneTimeKeyID:   legacyState.NextOneTimeKeyID,
+		CurrentFallbackKey: legacyState.CurrentFallbackKey,
+		PrevFallbackKey:    legacyState.PrevFallbackKey,
+	}
+	utils.WipeBytes(legacyState.Ed25519Key)
+	return nil
+}
+
+func (a *Account) GobEncode() ([]byte, error) {
+	pickled := a.Pickle(pickleKey)
+	length := unpaddedBase64.DecodedLen(len(pickled))
+	rawPickled := make([]byte, length)
+	_, err := unpaddedBase64.Decode(rawPickled, pickled)
+	return rawPickled, err
+}
+
+func (a *Account) GobDecode(rawPickled []byte) error {
+	length := unpaddedBase64.EncodedLen(len(rawPickled))
+	pickled := make([]byte, length)
+	unpaddedBase64.Encode(pickled, rawPickled)
+	return a.Unpickle(pickled, pickleKey)
+}
+
+func (a *Account) MarshalJSON() ([]byte, error) {
+	pickled := a.Pickle(pickleKey)
+	quotes := make([]byte, len(pickled)+2)
+	quotes[0] = '"'
+	quotes[len(quotes)-1] = '"'
+	copy(quotes[1:len(quotes)-1], pickled)
+	return quotes, nil
+}
+
+func (a *Account) UnmarshalJSON(data []byte) error {
+	if len(data) == 0 || data[0] != '"' || data[len(data)-1] != '"' {
+		return InputNotJSONString
+	}
+	return a.Unpickle(data[1:len(data)-1], pickleKey)
+}
+
+// IdentityKeysJSON returns the public parts of the identity keys for the Account.
+func (a *Account) IdentityKeysJSON() []byte {
+	signingKey, identityKey := a.IdentityKeys()
+	data, _ := json.Marshal(map[string]string{
+		"curve25519": string(identityKey),
+		"ed25519":    string(signingKey),
+	})
+	return data
+}
+
+// IdentityKeys returns the public parts of the Ed25519 and Curve25519 identity
+// keys for the Account.
+func (a *Account) IdentityKeys() (id.Ed25519, id.Curve25519) {
+	return id.Ed25519(encodeBase64(a.state.Ed25519Key.Public)), id.Curve25519(encodeBase64(a.state.Curve25519Key.Public))
+}
+
+// Sign returns the signature of a message using the ed25519 key for this
+// Account.
+func (a *Account) Sign(message []byte) []byte {
+	if len(message) == 0 {
+		panic(EmptyInput)
+	}
+	return encodeBase64(a.state.Ed25519Key.sign(message))
+}
+
+// SignJSON signs the given JSON object following the Matrix specification:
+// https://matrix.org/docs/spec/appendices#signing-json
+func (a *Account) SignJSON(obj interface{}) (string, error) {
+	objJSON, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	objJSON, _ = sjson.DeleteBytes(objJSON, "unsigned")
+	objJSON, _ = sjson.DeleteBytes(objJSON, "signatures")
+	return string(a.Sign(canonicaljson.CanonicalJSONAssumeValid(objJSON))), nil
+}
+
+// OneTimeKeys returns the public parts of the unpublished one time keys for
+// the Account, as a map from key ID to base64-encoded Curve25519 key.
+func (a *Account) OneTimeKeys() map[string]id.Curve25519 {
+	keys := make(map[string]id.Curve25519)
+	for _, otk := range a.state.OneTimeKeys {
+		if !otk.Published {
+			keys[otk.keyID()] = id.Curve25519(encodeBase64(otk.Key.Public))
+		}
+	}
+	return keys
+}
+
+// MarkKeysAsPublished marks the current set of one time keys and the current
+// fallback key as being published.
+func (a *Account) MarkKeysAsPublished() {
+	for i := range a.state.OneTimeKeys {
+		a.state.OneTimeKeys[i].Published = true
+	}
+	if a.state.CurrentFallbackKey != nil {
+		a.state.CurrentFallbackKey.Published = true
+	}
+}
+
+// MaxNumberOfOneTimeKeys returns the largest number of one time keys this
+// Account can store.
+func (a *Account) MaxNumberOfOneTimeKeys() uint {
+	return maxOneTimeKeys
+}
+
+// GenOneTimeKeys generates a number of new one time keys.  If the total number
+// of keys stored by this Account exceeds MaxNumberOfOneTimeKeys then the old
+// keys are discarded.
+func (a *Account) GenOneTimeKeys(num uint) {
+	for i := uint(0); i < num; i++ {
+		a.state.NextOneTimeKeyID++
+		otk := oneTimeKey{ID: a.state.NextOneTimeKeyID, Key: newCurve25519KeyPair()}
+		a.state.OneTimeKeys = append([]oneTimeKey{otk}, a.state.OneTimeKeys...)
+	}
+	if len(a.state.OneTimeKeys) > maxOneTimeKeys {
+		for _, otk := range a.state.OneTimeKeys[maxOneTimeKeys:] {
+			otk.Key.wipe()
+		}
+		a.state.OneTimeKeys = a.state.OneTimeKeys[:maxOneTimeKeys]
+	}
+}
+
+// GenFallbackKey generates a new fallback key. The previous fallback key is
+// kept until ForgetOldFallbackKey is called or another fallback key is
+// generated, so that messages encrypted with it can still be decrypted.
+func (a *Account) GenFallbackKey() {
+	a.ForgetOldFallbackKey()
+	a.state.PrevFallbackKey = a.state.CurrentFallbackKey
+	a.state.NextOneTimeKeyID++
+	a.state.CurrentFallbackKey = &oneTimeKey{ID: a.state.NextOneTimeKeyID, Key: newCurve25519KeyPair()}
+}
+
+// FallbackKey returns the public part of the current fallback key for the
+// Account if it hasn't been published yet, as a map from key ID to
+// base64-encoded Curve25519 key. Fallback keys are marked as published by
+// MarkKeysAsPublished.
+func (a *Account) FallbackKey() map[string]id.Curve25519 {
+	keys := make(map[string]id.Curve25519)
+	if fallbackKey := a.state.CurrentFallbackKey; fallbackKey != nil && !fallbackKey.Published {
+		keys[fallbackKey.keyID()] = id.Curve25519(encodeBase64(fallbackKey.Key.Public))
+	}
+	return keys
+}
+
+// ForgetOldFallbackKey removes the previous fallback key from the Account.
+func (a *Account) ForgetOldFallbackKey() {
+	if a.state.PrevFallbackKey != nil {
+		a.state.PrevFallbackKey.Key.wipe()
+		a.state.PrevFallbackKey = nil
+	}
+}
+
+// findFallbackKey returns the current or previous fallback key with the given public key, or nil if neither matches.
+func (a *Account) findFallbackKey(public []byte) *oneTimeKey {
+	for _, fallbackKey := range []*oneTimeKey{a.state.CurrentFallbackKey, a.state.PrevFallbackKey} {
+		if fallbackKey != nil && bytes.Equal(fallbackKey.Key.Public, public) {
+			return fallbackKey
+		}
+	}
+	return nil
+}
+
+func (a *Account) findOneTimeKey(public []byte) int {
+	for i, otk := range a.state.OneTimeKeys {
+		if bytes.Equal(otk.Key.Public, public) {
+			return i
+		}
+	}
+	return -1
+}
+
+// NewOutboundSession creates a new out-bound session for sending messages to a
+// given curve25519 identityKey and oneTimeKey.  Returns error on failure.  If the
+// keys couldn't be decoded as base64 then the error will be "INVALID_BASE64"
+func (a *Account) NewOutboundSession(theirIdentityKey, theirOneTimeKey id.Curve25519) (*Session, error) {
+	if len(theirIdentityKey) == 0 || len(theirOneTimeKey) == 0 {
+		return nil, EmptyInput
+	}
+	identityKey, err := decodeCurve25519Key(string(theirIdentityKey))
+	if err != nil {
+		return nil, err
+	}
+	oneTimeKey, err := decodeCurve25519Key(string(theirOneTimeKey))
+	if err != nil {
+		return nil, err
+	}
+	baseKey := newCurve25519KeyPair()
+	ratchetKey := newCurve25519KeyPair()
+
+	secret := make([]byte, 0, 3*curve25519KeyLength)
+	secret = append(secret, a.state.Curve25519Key.sharedSecret(oneTimeKey)...)
+	secret = append(secret, baseKey.sharedSecret(identityKey)...)
+	secret = append(secret, baseKey.sharedSecret(oneTimeKey)...)
+	defer utils.WipeBytes(secret)
+
+	s := NewBlankSession()
+	s.state.AliceIdentityKey = a.state.Curve25519Key.Public
+	s.state.AliceBaseKey = baseKey.Public
+	s.state.BobOneTimeKey = oneTimeKey
+	s.initializeAsAlice(secret, ratchetKey)
+	baseKey.wipe()
+	return s, nil
+}
+
+func (a *Account) newInboundSession(theirIdentityKey []byte, oneTimeKeyMsg string) (*Session, error) {
+	raw, err := decodeBase64([]byte(oneTimeKeyMsg))
+	if err != nil {
+		return nil, err
+	}
+	msg, err := decodeOlmPreKeyMessage(raw)
+	if err != nil {
+		return nil, err
+	} else if theirIdentityKey != nil && !bytes.Equal(theirIdentityKey, msg.IdentityKey) {
+		return nil, BadMessageKeyID
+	}
+	innerMsg, _, _, err := decodeOlmMessage(msg.Message)
+	if err != nil {
+		return nil, err
+	}
+	var ourOneTimeKey curve25519KeyPair
+	if otkIndex := a.findOneTimeKey(msg.OneTimeKey); otkIndex != -1 {
+		ourOneTimeKey = a.state.OneTimeKeys[otkIndex].Key
+	} else if fallbackKey := a.findFallbackKey(msg.OneTimeKey); fallbackKey != nil {
+		ourOneTimeKey = fallbackKey.Key
+	} else {
+		return nil, BadMessageKeyID
+	}
+
+	secret := make([]byte, 0, 3*curve25519KeyLength)
+	secret = append(secret, ourOneTimeKey.sharedSecret(msg.IdentityKey)...)
+	secret = append(secret, a.state.Curve25519Key.sharedSecret(msg.BaseKey)...)
+	secret = append(secret, ourOneTimeKey.sharedSecret(msg.BaseKey)...)
+	defer utils.WipeBytes(secret)
+
+	s := NewBlankSession()
+	s.state.AliceIdentityKey = msg.IdentityKey
+	s.state.AliceBaseKey = msg.BaseKey
+	s.state.BobOneTimeKey = msg.OneTimeKey
+	s.initializeAsBob(secret, innerMsg.RatchetKey)
+	return s, nil
+}
+
+// NewInboundSession creates a new in-bound session for sending/receiving
+// messages from an incoming PRE_KEY message.  Returns error on failure.  If
+// the base64 couldn't be decoded then the error will be "INVALID_BASE64".  If
+// the message was for an unsupported protocol version then the error will be
+// "BAD_MESSAGE_VERSION".  If the message couldn't be decoded then then the
+// error will be "BAD_MESSAGE_FORMAT".  If the message refers to an unknown one
+// time key then the error will be "BAD_MESSAGE_KEY_ID".
+func (a *Account) NewInboundSession(oneTimeKeyMsg string) (*Session, error) {
+	if len(oneTimeKeyMsg) == 0 {
+		return nil, EmptyInput
+	}
+	return a.newInboundSession(nil, oneTimeKeyMsg)
+}
+
+// NewInboundSessionFrom creates a new in-bound session for sending/receiving
+// messages from an incoming PRE_KEY message.  Returns error on failure.  If
+// the base64 couldn't be decoded then the error will be "INVALID_BASE64".  If
+// the message was for an unsupported protocol version then the error will be
+// "BAD_MESSAGE_VERSION".  If the message couldn't be decoded then then the
+// error will be "BAD_MESSAGE_FORMAT".  If the message refers to an unknown one
+// time key then the error will be "BAD_MESSAGE_KEY_ID".
+func (a *Account) NewInboundSessionFrom(theirIdentityKey id.Curve25519, oneTimeKeyMsg string) (*Session, error) {
+	if len(theirIdentityKey) == 0 || len(oneTimeKeyMsg) == 0 {
+		return nil, EmptyInput
+	}
+	identityKey, err := decodeCurve25519Key(string(theirIdentityKey))
+	if err != nil {
+		return nil, err
+	}
+	return a.newInboundSession(identityKey, oneTimeKeyMsg)
+}
+
+// RemoveOneTimeKeys removes the one time keys that the session used from the
+// Account.  Returns error on failure.  If the Account doesn't have any
+// matching one time keys then the error will be "BAD_MESSAGE_KEY_ID".
+// Fallback keys are never removed, like in libolm.
+func (a *Account) RemoveOneTimeKeys(s *Session) error {
+	index := a.findOneTimeKey(s.state.BobOneTimeKey)
+	if index == -1 {
+		return BadMessageKeyID
+	}
+	a.state.OneTimeKeys[index].Key.wipe()
+	a.state.OneTimeKeys = append(a.state.OneTimeKeys[:index], a.state.OneTimeKeys[index+1:]...)
+	return nil
+}
@@ -0,0 +1,330 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"maunium.net/go/mautrix/crypto/utils"
+)
+
+const (
+	curve25519KeyLength = curve25519.ScalarSize
+	// macLength is the length of the truncated HMAC-SHA256 appended to messages and pickles.
+	macLength = 8
+)
+
+// aesSHA256Keys are the keys used by the AES-256-CBC + HMAC-SHA256 cipher that olm uses for messages and pickles.
+type aesSHA256Keys struct {
+	aesKey [32]byte
+	macKey [32]byte
+	iv     [aes.BlockSize]byte
+}
+
+func deriveAESSHA256Keys(secret, info []byte) (keys aesSHA256Keys) {
+	kdf := hkdf.New(sha256.New, secret, nil, info)
+	_, _ = io.ReadFull(kdf, keys.aesKey[:])
+	_, _ = io.ReadFull(kdf, keys.macKey[:])
+	_, _ = io.ReadFull(kdf, keys.iv[:])
+	return
+}
+
+func (keys *aesSHA256Keys) wipe() {
+	utils.WipeBytes(keys.aesKey[:])
+	utils.WipeBytes(keys.macKey[:])
+}
+
+func (keys *aesSHA256Keys) encrypt(plaintext []byte) []byte {
+	block, _ := aes.NewCipher(keys.aesKey[:])
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	ciphertext := make([]byte, len(plaintext)+padding)
+	copy(ciphertext, plaintext)
+	copy(ciphertext[len(plaintext):], bytes.Repeat([]byte{byte(padding)}, padding))
+	cipher.NewCBCEncrypter(block, keys.iv[:]).CryptBlocks(ciphertext, ciphertext)
+	return ciphertext
+}
+
+func (keys *aesSHA256Keys) decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, BadMessageFormat
+	}
+	block, _ := aes.NewCipher(keys.aesKey[:])
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, keys.iv[:]).CryptBlocks(plaintext, ciphertext)
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, BadMessageMAC
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, BadMessageMAC
+		}
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+func (keys *aesSHA256Keys) mac(data []byte) []byte {
+	h := hmac.New(sha256.New, keys.macKey[:])
+	h.Write(data)
+	return h.Sum(nil)[:macLength]
+}
+
+func (keys *aesSHA256Keys) verifyMAC(data, mac []byte) bool {
+	return hmac.Equal(keys.mac(data), mac)
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func decodeBase64(input []byte) ([]byte, error) {
+	output := make([]byte, unpaddedBase64.DecodedLen(len(input)))
+	n, err := unpaddedBase64.Decode(output, input)
+	if err != nil {
+		return nil, InvalidBase64
+	}
+	return output[:n], nil
+}
+
+func encodeBase64(input []byte) []byte {
+	output := make([]byte, unpaddedBase64.EncodedLen(len(input)))
+	unpaddedBase64.Encode(output, input)
+	return output
+}
+
+func decodeCurve25519Key(key string) ([]byte, error) {
+	decoded, err := decodeBase64([]byte(key))
+	if err != nil {
+		return nil, err
+	} else if len(decoded) != curve25519KeyLength {
+		return nil, InvalidBase64
+	}
+	return decoded, nil
+}
+
+// curve25519KeyPair is a curve25519 key pair stored in pickles.
+type curve25519KeyPair struct {
+	Private []byte `json:"private"`
+	Public  []byte `json:"public"`
+}
+
+func newCurve25519KeyPair() curve25519KeyPair {
+	private := make([]byte, curve25519KeyLength)
+	if _, err := utils.ReadRandom(private); err != nil {
+		panic(NotEnoughGoRandom)
+	}
+	public, _ := curve25519.X25519(private, curve25519.Basepoint)
+	return curve25519KeyPair{Private: private, Public: public}
+}
+
+func (kp curve25519KeyPair) sharedSecret(theirPublic []byte) []byte {
+	// X25519 only fails for low-order points, in which case libolm would produce an all-zero secret.
+	secret, err := curve25519.X25519(kp.Private, theirPublic)
+	if err != nil {
+		return make([]byte, curve25519KeyLength)
+	}
+	return secret
+}
+
+func (kp curve25519KeyPair) pickle(pw *pickleWriter) {
+	pw.Write(kp.Public)
+	pw.Write(kp.Private)
+}
+
+func (kp *curve25519KeyPair) unpickle(pr *pickleReader) {
+	kp.Public = pr.readBytes(curve25519KeyLength)
+	kp.Private = pr.readBytes(curve25519KeyLength)
+}
+
+func (kp curve25519KeyPair) wipe() {
+	utils.WipeBytes(kp.Private)
+}
+
+// legacyGoolmPickleVersion is the version of the JSON pickles that goolm made of accounts and outbound group sessions
+// before they were pickled in the libolm format. It's outside the range libolm uses, so such pickles can still be
+// recognized and loaded.
+const legacyGoolmPickleVersion = 0x676F0001
+
+var pickleInfo = []byte("Pickle")
+
+// encryptPickle encrypts the given data with the same cipher that libolm uses for pickles.
+func encryptPickle(key, plaintext []byte) []byte {
+	if len(key) == 0 {
+		panic(NoKeyProvided)
+	}
+	keys := deriveAESSHA256Keys(key, pickleInfo)
+	defer keys.wipe()
+	ciphertext := keys.encrypt(plaintext)
+	return encodeBase64(append(ciphertext, keys.mac(ciphertext)...))
+}
+
+// decryptPickle decrypts a pickle made with encryptPickle or libolm.
+func decryptPickle(pickled, key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, NoKeyProvided
+	}
+	raw, err := decodeBase64(pickled)
+	if err != nil {
+		return nil, err
+	} else if len(raw) < macLength {
+		return nil, CorruptedPickle
+	}
+	ciphertext, mac := raw[:len(raw)-macLength], raw[len(raw)-macLength:]
+	keys := deriveAESSHA256Keys(key, pickleInfo)
+	defer keys.wipe()
+	if !keys.verifyMAC(ciphertext, mac) {
+		return nil, BadAccountKey
+	}
+	plaintext, err := keys.decrypt(ciphertext)
+	if err != nil {
+		return nil, CorruptedPickle
+	}
+	return plaintext, nil
+}
+
+// pickleWriter writes the binary pickle format used by libolm.
+type pickleWriter struct {
+	bytes.Buffer
+}
+
+func (pw *pickleWriter) writeUint32(value uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], value)
+	pw.Write(buf[:])
+}
+
+func (pw *pickleWriter) writeBool(value bool) {
+	if value {
+		pw.WriteByte(1)
+	} else {
+		pw.WriteByte(0)
+	}
+}
+
+// pickleReader reads the binary pickle format used by libolm. After the first error,
+// all reads return zero values and err is set to CorruptedPickle.
+type pickleReader struct {
+	data []byte
+	err  error
+}
+
+func (pr *pickleReader) readBytes(length int) []byte {
+	if pr.err != nil || len(pr.data) < length {
+		pr.err = CorruptedPickle
+		return make([]byte, length)
+	}
+	value := make([]byte, length)
+	copy(value, pr.data)
+	pr.data = pr.data[length:]
+	return value
+}
+
+func (pr *pickleReader) readUint32() uint32 {
+	return binary.BigEndian.Uint32(pr.readBytes(4))
+}
+
+func (pr *pickleReader) readBool() bool {
+	return pr.readBytes(1)[0] != 0
+}
+
+func (pr *pickleReader) readUint8() uint8 {
+	return pr.readBytes(1)[0]
+}
+
+// readCount reads a list length, making sure it's not larger than the given maximum.
+func (pr *pickleReader) readCount(max int) int {
+	count := pr.readUint32()
+	if count > uint32(max) {
+		pr.err = CorruptedPickle
+		return 0
+	}
+	return int(count)
+}
+
+// protoWriter writes the protobuf-like encoding used in olm messages.
+type protoWriter struct {
+	bytes.Buffer
+}
+
+func (pw *protoWriter) writeVarint(value uint64) {
+	for value >= 0x80 {
+		pw.WriteByte(byte(value) | 0x80)
+		value >>= 7
+	}
+	pw.WriteByte(byte(value))
+}
+
+func (pw *protoWriter) writeIntField(tag byte, value uint32) {
+	pw.WriteByte(tag)
+	pw.writeVarint(uint64(value))
+}
+
+func (pw *protoWriter) writeBytesField(tag byte, value []byte) {
+	pw.WriteByte(tag)
+	pw.writeVarint(uint64(len(value)))
+	pw.Write(value)
+}
+
+// protoFields is a parsed set of fields from an olm message. Varint fields are
+// stored in ints and length-delimited fields in bytes, both keyed by the full tag byte.
+type protoFields struct {
+	ints  map[byte]uint64
+	bytes map[byte][]byte
+}
+
+func readVarint(data []byte) (value uint64, n int, err error) {
+	for shift := uint(0); n < len(data); shift += 7 {
+		b := data[n]
+		n++
+		if shift >= 64 {
+			return 0, 0, BadMessageFormat
+		}
+		value |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, n, nil
+		}
+	}
+	return 0, 0, BadMessageFormat
+}
+
+// parseProtoFields parses the fields of an olm message. Unknown fields are kept but ignored by callers.
+func parseProtoFields(data []byte) (*protoFields, error) {
+	fields := &protoFields{ints: make(map[byte]uint64), bytes: make(map[byte][]byte)}
+	for len(data) > 0 {
+		tag := data[0]
+		data = data[1:]
+		switch tag & 0x7 {
+		case 0:
+			value, n, err := readVarint(data)
+			if err != nil {
+				return nil, err
+			}
+			fields.ints[tag] = value
+			data = data[n:]
+		case 2:
+			length, n, err := readVarint(data)
+			if err != nil {
+				return nil, err
+			} else if length > uint64(len(data)-n) {
+				return nil, BadMessageFormat
+			}
+			fields.bytes[tag] = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return nil, BadMessageFormat
+		}
+	}
+	return fields, nil
+}
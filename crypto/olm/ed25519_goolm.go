@@ -0,0 +1,134 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"math/big"
+
+	"golang.org/x/crypto/curve25519"
+
+	"maunium.net/go/mautrix/crypto/utils"
+)
+
+// ed25519ExpandedKeyLength is the length of the expanded ed25519 private keys that libolm stores: the clamped
+// secret scalar followed by the prefix used for deriving nonces.
+const ed25519ExpandedKeyLength = 64
+
+var (
+	curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	ed25519L, _ = new(big.Int).SetString("7237005577332262213973186563042994240857116359379907606001950938285454250989", 10)
+)
+
+// ed25519KeyPair is an ed25519 key pair in the same form as in libolm, which only stores the expanded private key.
+// The seed the key was generated from isn't available in libolm pickles, so crypto/ed25519 can't be used for signing.
+type ed25519KeyPair struct {
+	Public  ed25519.PublicKey
+	Private []byte
+}
+
+func newEd25519KeyPair() ed25519KeyPair {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := utils.ReadRandom(seed); err != nil {
+		panic(NotEnoughGoRandom)
+	}
+	defer utils.WipeBytes(seed)
+	return ed25519KeyPairFromPrivateKey(ed25519.NewKeyFromSeed(seed))
+}
+
+// ed25519KeyPairFromPrivateKey expands the given crypto/ed25519 private key the same way as libolm.
+func ed25519KeyPairFromPrivateKey(key ed25519.PrivateKey) ed25519KeyPair {
+	expanded := sha512.Sum512(key.Seed())
+	expanded[0] &= 248
+	expanded[31] &= 127
+	expanded[31] |= 64
+	private := make([]byte, ed25519ExpandedKeyLength)
+	copy(private, expanded[:])
+	utils.WipeBytes(expanded[:])
+	return ed25519KeyPair{Public: key.Public().(ed25519.PublicKey), Private: private}
+}
+
+func (kp ed25519KeyPair) pickle(pw *pickleWriter) {
+	pw.Write(kp.Public)
+	pw.Write(kp.Private)
+}
+
+func (kp *ed25519KeyPair) unpickle(pr *pickleReader) {
+	kp.Public = pr.readBytes(ed25519.PublicKeySize)
+	kp.Private = pr.readBytes(ed25519ExpandedKeyLength)
+}
+
+func (kp ed25519KeyPair) wipe() {
+	utils.WipeBytes(kp.Private)
+}
+
+func littleEndianToInt(data []byte) *big.Int {
+	reversed := make([]byte, len(data))
+	for i, b := range data {
+		reversed[len(data)-1-i] = b
+	}
+	return new(big.Int).SetBytes(reversed)
+}
+
+func intToLittleEndian(dst []byte, n *big.Int) {
+	bigEndian := n.Bytes()
+	for i := range dst {
+		dst[i] = 0
+	}
+	for i, b := range bigEndian {
+		dst[len(bigEndian)-1-i] = b
+	}
+}
+
+// sign creates an ed25519 signature of the message with the expanded private key.
+//
+// The nonce point R is calculated with X25519, which only returns the u coordinate of the corresponding
+// Montgomery point. The nonce is clamped so that X25519 uses it as-is, and as the sign of the Edwards x
+// coordinate is lost in the conversion, the signature is made with both signs and the one that verifies is
+// returned. The nonce differs from the one libolm would use, but any nonce produces a valid signature.
+// The scalar arithmetic uses math/big, so it isn't constant-time like crypto/ed25519.
+func (kp ed25519KeyPair) sign(message []byte) []byte {
+	h := sha512.New()
+	h.Write(kp.Private[32:])
+	h.Write(message)
+	nonce := h.Sum(nil)[:32]
+	defer utils.WipeBytes(nonce)
+	nonce[0] &= 248
+	nonce[31] &= 127
+	nonce[31] |= 64
+	u, err := curve25519.X25519(nonce, curve25519.Basepoint)
+	if err != nil {
+		panic(err)
+	}
+
+	// y = (u - 1) / (u + 1)
+	uInt := littleEndianToInt(u)
+	y := new(big.Int).Sub(uInt, big.NewInt(1))
+	y.Mul(y, new(big.Int).ModInverse(new(big.Int).Add(uInt, big.NewInt(1)), curve25519P))
+	y.Mod(y, curve25519P)
+
+	secret := littleEndianToInt(kp.Private[:32])
+	r := littleEndianToInt(nonce)
+	signature := make([]byte, ed25519.SignatureSize)
+	for _, sign := range []byte{0, 0x80} {
+		intToLittleEndian(signature[:32], y)
+		signature[31] |= sign
+		h.Reset()
+		h.Write(signature[:32])
+		h.Write(kp.Public)
+		h.Write(message)
+		// s = r + H(R || A || M) * a
+		s := littleEndianToInt(h.Sum(nil))
+		s.Mul(s, secret)
+		s.Add(s, r)
+		s.Mod(s, ed25519L)
+		intToLittleEndian(signature[32:], s)
+		if ed25519.Verify(kp.Public, message, signature) {
+			return signature
+		}
+	}
+	// This is only possible if the public key doesn't match the private key.
+	panic(CorruptedPickle)
+}
@@ -12,6 +12,7 @@ var (
 	NotEnoughGoRandom  = errors.New("couldn't get enough randomness from crypto/rand")
 	SignatureNotFound  = errors.New("input JSON doesn't contain signature from specified device")
 	InputNotJSONString = errors.New("input doesn't look like a JSON string")
+	SASTheirKeyNotSet  = errors.New("the other side's SAS public key has not been set")
 )
 
 // Error codes from olm code
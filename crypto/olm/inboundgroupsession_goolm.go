@@ -0,0 +1,294 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+import (
+	"crypto/ed25519"
+
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/id"
+)
+
+// inboundGroupSessionState is the pickled state of an InboundGroupSession.
+type inboundGroupSessionState struct {
+	InitialRatchet     megolmRatchet
+	LatestRatchet      megolmRatchet
+	SigningKey         ed25519.PublicKey
+	SigningKeyVerified bool
+}
+
+// InboundGroupSession stores an inbound encrypted messaging session for a
+// group.
+type InboundGroupSession struct {
+	state inboundGroupSessionState
+}
+
+// InboundGroupSessionFromPickled loads an InboundGroupSession from a pickled
+// base64 string.  Decrypts the InboundGroupSession using the supplied key.
+// Returns error on failure.  If the key doesn't match the one used to encrypt
+// the InboundGroupSession then the error will be "BAD_ACCOUNT_KEY".  If the
+// base64 couldn't be decoded then the error will be "INVALID_BASE64".
+func InboundGroupSessionFromPickled(pickled, key []byte) (*InboundGroupSession, error) {
+	if len(pickled) == 0 {
+		return nil, EmptyInput
+	}
+	lenKey := len(key)
+	if lenKey == 0 {
+		key = []byte(" ")
+	}
+	s := NewBlankInboundGroupSession()
+	return s, s.Unpickle(pickled, key)
+}
+
+// NewInboundGroupSession creates a new inbound group session from a key
+// exported from OutboundGroupSession.Key().  Returns error on failure.
+// If the sessionKey is not valid base64 the error will be
+// "OLM_INVALID_BASE64".  If the session_key is invalid the error will be
+// "OLM_BAD_SESSION_KEY".
+func NewInboundGroupSession(sessionKey []byte) (*InboundGroupSession, error) {
+	if len(sessionKey) == 0 {
+		return nil, EmptyInput
+	}
+	data, err := decodeBase64(sessionKey)
+	if err != nil {
+		return nil, err
+	} else if len(data) != megolmSessionKeyLength || data[0] != megolmSessionKeyVersion {
+		return nil, BadSessionKey
+	}
+	ratchet, signingKey := decodeMegolmSessionData(data)
+	if !ed25519.Verify(signingKey, data[:megolmSessionExportLength], data[megolmSessionExportLength:]) {
+		return nil, BadSignature
+	}
+	return newInboundGroupSession(ratchet, signingKey, true), nil
+}
+
+// InboundGroupSessionImport imports an inbound group session from a previous
+// export.  Returns error on failure.  If the sessionKey is not valid base64
+// the error will be "OLM_INVALID_BASE64".  If the session_key is invalid the
+// error will be "OLM_BAD_SESSION_KEY".
+func InboundGroupSessionImport(sessionKey []byte) (*InboundGroupSession, error) {
+	if len(sessionKey) == 0 {
+		return nil, EmptyInput
+	}
+	data, err := decodeBase64(sessionKey)
+	if err != nil {
+		return nil, err
+	} else if len(data) != megolmSessionExportLength || data[0] != megolmSessionExportVersion {
+		return nil, BadSessionKey
+	}
+	ratchet, signingKey := decodeMegolmSessionData(data)
+	return newInboundGroupSession(ratchet, signingKey, false), nil
+}
+
+func newInboundGroupSession(ratchet megolmRatchet, signingKey ed25519.PublicKey, verified bool) *InboundGroupSession {
+	return &InboundGroupSession{state: inboundGroupSessionState{
+		InitialRatchet:     ratchet,
+		LatestRatchet:      ratchet.copy(),
+		SigningKey:         signingKey,
+		SigningKeyVerified: verified,
+	}}
+}
+
+// NewBlankInboundGroupSession initialises an empty InboundGroupSession.
+func NewBlankInboundGroupSession() *InboundGroupSession {
+	return &InboundGroupSession{}
+}
+
+// Clear clears the memory used to back this InboundGroupSession.
+func (s *InboundGroupSession) Clear() error {
+	s.state.InitialRatchet.wipe()
+	s.state.LatestRatchet.wipe()
+	s.state = inboundGroupSessionState{}
+	return nil
+}
+
+// inboundGroupSessionPickleVersion is the libolm inbound group session pickle version. Inbound group
+// sessions use the same pickle format as libolm, so they can be shared between the implementations.
+const inboundGroupSessionPickleVersion = 2
+
+// Pickle returns an InboundGroupSession as a base64 string.  Encrypts the
+// InboundGroupSession using the supplied key.
+func (s *InboundGroupSession) Pickle(key []byte) []byte {
+	var pw pickleWriter
+	pw.writeUint32(inboundGroupSessionPickleVersion)
+	s.state.InitialRatchet.pickle(&pw)
+	s.state.LatestRatchet.pickle(&pw)
+	pw.Write(s.state.SigningKey)
+	pw.writeBool(s.state.SigningKeyVerified)
+	defer utils.WipeBytes(pw.Bytes())
+	return encryptPickle(key, pw.Bytes())
+}
+
+func (s *InboundGroupSession) Unpickle(pickled, key []byte) error {
+	plaintext, err := decryptPickle(pickled, key)
+	if err != nil {
+		return err
+	}
+	defer utils.WipeBytes(plaintext)
+	pr := pickleReader{data: plaintext}
+	version := pr.readUint32()
+	if pr.err == nil && version != 1 && version != inboundGroupSessionPickleVersion {
+		return UnknownPickleVersion
+	}
+	var state inboundGroupSessionState
+	state.InitialRatchet.unpickle(&pr)
+	state.LatestRatchet.unpickle(&pr)
+	state.SigningKey = pr.readBytes(ed25519.PublicKeySize)
+	if version == 1 {
+		// Version 1 pickles didn't store whether the signing key was verified, and only signed session keys could be imported.
+		state.SigningKeyVerified = true
+	} else {
+		state.SigningKeyVerified = pr.readBool()
+	}
+	if pr.err != nil {
+		return pr.err
+	}
+	s.state = state
+	return nil
+}
+
+func (s *InboundGroupSession) GobEncode() ([]byte, error) {
+	pickled := s.Pickle(pickleKey)
+	length := unpaddedBase64.DecodedLen(len(pickled))
+	rawPickled := make([]byte, length)
+	_, err := unpaddedBase64.Decode(rawPickled, pickled)
+	return rawPickled, err
+}
+
+func (s *InboundGroupSession) GobDecode(rawPickled []byte) error {
+	length := unpaddedBase64.EncodedLen(len(rawPickled))
+	pickled := make([]byte, length)
+	unpaddedBase64.Encode(pickled, rawPickled)
+	return s.Unpickle(pickled, pickleKey)
+}
+
+func (s *InboundGroupSession) MarshalJSON() ([]byte, error) {
+	pickled := s.Pickle(pickleKey)
+	quotes := make([]byte, len(pickled)+2)
+	quotes[0] = '"'
+	quotes[len(quotes)-1] = '"'
+	copy(quotes[1:len(quotes)-1], pickled)
+	return quotes, nil
+}
+
+func (s *InboundGroupSession) UnmarshalJSON(data []byte) error {
+	if len(data) == 0 || data[0] != '"' || data[len(data)-1] != '"' {
+		return InputNotJSONString
+	}
+	return s.Unpickle(data[1:len(data)-1], pickleKey)
+}
+
+// ratchetAt returns a copy of the ratchet advanced to the given message index.
+func (s *InboundGroupSession) ratchetAt(index uint32) (megolmRatchet, error) {
+	if index < s.state.InitialRatchet.Counter {
+		return megolmRatchet{}, UnknownMessageIndex
+	}
+	var ratchet megolmRatchet
+	if index >= s.state.LatestRatchet.Counter {
+		ratchet = s.state.LatestRatchet.copy()
+	} else {
+		ratchet = s.state.InitialRatchet.copy()
+	}
+	ratchet.advanceTo(index)
+	return ratchet, nil
+}
+
+// Decrypt decrypts a message using the InboundGroupSession.  Returns the the
+// plain-text and message index on success.  Returns error on failure.  If the
+// base64 couldn't be decoded then the error will be "INVALID_BASE64".  If the
+// message is for an unsupported version of the protocol then the error will be
+// "BAD_MESSAGE_VERSION".  If the message couldn't be decoded then the error
+// will be BAD_MESSAGE_FORMAT".  If the MAC on the message was invalid then the
+// error will be "BAD_MESSAGE_MAC".  If we do not have a session key
+// corresponding to the message's index (ie, it was sent before the session key
+// was shared with us) the error will be "OLM_UNKNOWN_MESSAGE_INDEX".
+func (s *InboundGroupSession) Decrypt(message []byte) ([]byte, uint, error) {
+	if len(message) == 0 {
+		return nil, 0, EmptyInput
+	}
+	data, err := decodeBase64(message)
+	if err != nil {
+		return nil, 0, err
+	} else if len(data) == 0 {
+		return nil, 0, BadMessageFormat
+	} else if data[0] != megolmProtocolVersion {
+		return nil, 0, BadMessageVersion
+	} else if len(data) < megolmMessageMinLength {
+		return nil, 0, BadMessageFormat
+	}
+	signed, signature := data[:len(data)-ed25519.SignatureSize], data[len(data)-ed25519.SignatureSize:]
+	body, mac := signed[:len(signed)-macLength], signed[len(signed)-macLength:]
+	fields, err := parseProtoFields(body[1:])
+	if err != nil {
+		return nil, 0, err
+	}
+	index, hasIndex := fields.ints[megolmMessageTagIndex]
+	ciphertext, hasCiphertext := fields.bytes[megolmMessageTagCiphertext]
+	if !hasIndex || !hasCiphertext {
+		return nil, 0, BadMessageFormat
+	} else if !ed25519.Verify(s.state.SigningKey, signed, signature) {
+		return nil, 0, BadSignature
+	}
+
+	ratchet, err := s.ratchetAt(uint32(index))
+	if err != nil {
+		return nil, 0, err
+	}
+	keys := deriveAESSHA256Keys(ratchet.Data, megolmKeysInfo)
+	defer keys.wipe()
+	if !keys.verifyMAC(body, mac) {
+		ratchet.wipe()
+		return nil, 0, BadMessageMAC
+	}
+	plaintext, err := keys.decrypt(ciphertext)
+	if err != nil {
+		ratchet.wipe()
+		return nil, 0, err
+	}
+	if ratchet.Counter >= s.state.LatestRatchet.Counter {
+		s.state.LatestRatchet.wipe()
+		s.state.LatestRatchet = ratchet
+	} else {
+		ratchet.wipe()
+	}
+	s.state.SigningKeyVerified = true
+	return plaintext, uint(index), nil
+}
+
+// ID returns a base64-encoded identifier for this session.
+func (s *InboundGroupSession) ID() id.SessionID {
+	return id.SessionID(encodeBase64(s.state.SigningKey))
+}
+
+// FirstKnownIndex returns the first message index we know how to decrypt.
+func (s *InboundGroupSession) FirstKnownIndex() uint32 {
+	return s.state.InitialRatchet.Counter
+}
+
+// IsVerified check if the session has been verified as a valid session.  (A
+// session is verified either because the original session share was signed, or
+// because we have subsequently successfully decrypted a message.)
+func (s *InboundGroupSession) IsVerified() uint {
+	if s.state.SigningKeyVerified {
+		return 1
+	}
+	return 0
+}
+
+// Export returns the base64-encoded ratchet key for this session, at the given
+// index, in a format which can be used by
+// InboundGroupSession.InboundGroupSessionImport().  Returns error on failure.
+// if we do not have a session key corresponding to the given index (ie, it was
+// sent before the session key was shared with us) the error will be
+// "OLM_UNKNOWN_MESSAGE_INDEX".
+func (s *InboundGroupSession) Export(messageIndex uint32) (string, error) {
+	ratchet, err := s.ratchetAt(messageIndex)
+	if err != nil {
+		return "", err
+	}
+	defer ratchet.wipe()
+	data := encodeMegolmSessionData(megolmSessionExportVersion, &ratchet, s.state.SigningKey, megolmSessionExportLength)
+	defer utils.WipeBytes(data)
+	return string(encodeBase64(data)), nil
+}
@@ -0,0 +1,136 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+
+	"maunium.net/go/mautrix/crypto/utils"
+)
+
+const (
+	megolmRatchetParts      = 4
+	megolmRatchetPartLength = 32
+	megolmRatchetLength     = megolmRatchetParts * megolmRatchetPartLength
+
+	megolmProtocolVersion = 3
+
+	megolmMessageTagIndex      = 0x08
+	megolmMessageTagCiphertext = 0x12
+
+	// Session keys contain a version byte, the ratchet counter, the ratchet data and the signing key.
+	// Session keys from OutboundGroupSession.Key are additionally signed, while exports aren't.
+	megolmSessionKeyVersion      = 2
+	megolmSessionExportVersion   = 1
+	megolmSessionDataOffset      = 1 + 4
+	megolmSessionPublicKeyOffset = megolmSessionDataOffset + megolmRatchetLength
+	megolmSessionExportLength    = megolmSessionPublicKeyOffset + ed25519.PublicKeySize
+	megolmSessionKeyLength       = megolmSessionExportLength + ed25519.SignatureSize
+
+	megolmMessageMinLength = 1 + macLength + ed25519.SignatureSize
+)
+
+var megolmKeysInfo = []byte("MEGOLM_KEYS")
+
+// megolmRatchet is the hash ratchet used by megolm sessions, as described in
+// https://gitlab.matrix.org/matrix-org/olm/-/blob/master/docs/megolm.md
+type megolmRatchet struct {
+	Data    []byte `json:"data"`
+	Counter uint32 `json:"counter"`
+}
+
+func (r *megolmRatchet) part(i int) []byte {
+	return r.Data[i*megolmRatchetPartLength : (i+1)*megolmRatchetPartLength]
+}
+
+// rehashPart sets R(to) = HMAC(R(from), to).
+func (r *megolmRatchet) rehashPart(from, to int) {
+	copy(r.part(to), hmacSHA256(r.part(from), []byte{byte(to)}))
+}
+
+func (r *megolmRatchet) copy() megolmRatchet {
+	data := make([]byte, len(r.Data))
+	copy(data, r.Data)
+	return megolmRatchet{Data: data, Counter: r.Counter}
+}
+
+// advance advances the ratchet by one step.
+func (r *megolmRatchet) advance() {
+	mask := uint32(0x00FFFFFF)
+	h := 0
+	r.Counter++
+	// Figure out how much we need to rekey
+	for h < megolmRatchetParts {
+		if r.Counter&mask == 0 {
+			break
+		}
+		h++
+		mask >>= 8
+	}
+	// Now update R(h)...R(3) based on R(h)
+	for i := megolmRatchetParts - 1; i >= h; i-- {
+		r.rehashPart(h, i)
+	}
+}
+
+// advanceTo advances the ratchet to the given index. Going backwards wraps around, like in libolm.
+func (r *megolmRatchet) advanceTo(advanceTo uint32) {
+	for j := 0; j < megolmRatchetParts; j++ {
+		shift := uint((megolmRatchetParts - j - 1) * 8)
+		mask := ^uint32(0) << shift
+		// How many times do we need to rehash this part?
+		steps := ((advanceTo >> shift) - (r.Counter >> shift)) & 0xff
+		if steps == 0 {
+			// Deal with the edge case where the counter is slightly larger than advanceTo
+			if advanceTo < r.Counter {
+				steps = 0x100
+			} else {
+				continue
+			}
+		}
+		// For all but the last step, we can just bump R(j) without regard to R(j+1)...R(3).
+		for ; steps > 1; steps-- {
+			r.rehashPart(j, j)
+		}
+		// On the last step we also need to bump R(j+1)...R(3).
+		for k := megolmRatchetParts - 1; k >= j; k-- {
+			r.rehashPart(j, k)
+		}
+		r.Counter = advanceTo & mask
+	}
+}
+
+func (r *megolmRatchet) pickle(pw *pickleWriter) {
+	pw.Write(r.Data)
+	pw.writeUint32(r.Counter)
+}
+
+func (r *megolmRatchet) unpickle(pr *pickleReader) {
+	r.Data = pr.readBytes(megolmRatchetLength)
+	r.Counter = pr.readUint32()
+}
+
+func (r *megolmRatchet) wipe() {
+	utils.WipeBytes(r.Data)
+}
+
+// encodeMegolmSessionData encodes the given ratchet and public key in the session key and session export formats.
+func encodeMegolmSessionData(version byte, ratchet *megolmRatchet, publicKey ed25519.PublicKey, length int) []byte {
+	data := make([]byte, megolmSessionExportLength, length)
+	data[0] = version
+	binary.BigEndian.PutUint32(data[1:], ratchet.Counter)
+	copy(data[megolmSessionDataOffset:], ratchet.Data)
+	copy(data[megolmSessionPublicKeyOffset:], publicKey)
+	return data
+}
+
+// decodeMegolmSessionData decodes the ratchet and public key from a session key or session export.
+func decodeMegolmSessionData(data []byte) (megolmRatchet, ed25519.PublicKey) {
+	ratchetData := make([]byte, megolmRatchetLength)
+	copy(ratchetData, data[megolmSessionDataOffset:megolmSessionPublicKeyOffset])
+	publicKey := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	copy(publicKey, data[megolmSessionPublicKeyOffset:megolmSessionExportLength])
+	return megolmRatchet{Data: ratchetData, Counter: binary.BigEndian.Uint32(data[1:])}, publicKey
+}
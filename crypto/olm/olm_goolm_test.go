@@ -0,0 +1,373 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func createSessionPair(t *testing.T) (alice, bob *Session) {
+	aliceAccount := NewAccount()
+	bobAccount := NewAccount()
+	bobAccount.GenOneTimeKeys(1)
+	var bobOneTimeKey id.Curve25519
+	for _, key := range bobAccount.OneTimeKeys() {
+		bobOneTimeKey = key
+	}
+	_, bobIdentityKey := bobAccount.IdentityKeys()
+	_, aliceIdentityKey := aliceAccount.IdentityKeys()
+
+	alice, err := aliceAccount.NewOutboundSession(bobIdentityKey, bobOneTimeKey)
+	if err != nil {
+		t.Fatalf("Failed to create outbound session: %v", err)
+	}
+	msgType, ciphertext := alice.Encrypt([]byte("first message"))
+	if msgType != id.OlmMsgTypePreKey {
+		t.Fatalf("Expected first message to be a pre-key message, got %d", msgType)
+	}
+	bob, err = bobAccount.NewInboundSessionFrom(aliceIdentityKey, string(ciphertext))
+	if err != nil {
+		t.Fatalf("Failed to create inbound session: %v", err)
+	}
+	if matches, err := bob.MatchesInboundSession(string(ciphertext)); err != nil || !matches {
+		t.Errorf("Expected inbound session to match pre-key message, got %t / %v", matches, err)
+	}
+	if err = bobAccount.RemoveOneTimeKeys(bob); err != nil {
+		t.Errorf("Failed to remove one-time key: %v", err)
+	}
+	plaintext, err := bob.Decrypt(string(ciphertext), msgType)
+	if err != nil {
+		t.Fatalf("Failed to decrypt pre-key message: %v", err)
+	} else if string(plaintext) != "first message" {
+		t.Errorf("Expected %q, got %q", "first message", plaintext)
+	}
+	if alice.ID() != bob.ID() {
+		t.Errorf("Session IDs don't match: %s != %s", alice.ID(), bob.ID())
+	}
+	return
+}
+
+func TestOlmSession(t *testing.T) {
+	alice, bob := createSessionPair(t)
+
+	// Bob replies, which switches Alice to normal messages once she has received it.
+	msgType, ciphertext := bob.Encrypt([]byte("reply"))
+	if msgType != id.OlmMsgTypeMsg {
+		t.Errorf("Expected reply to be a normal message, got %d", msgType)
+	}
+	if plaintext, err := alice.Decrypt(string(ciphertext), msgType); err != nil || string(plaintext) != "reply" {
+		t.Fatalf("Failed to decrypt reply: %q / %v", plaintext, err)
+	}
+	if alice.EncryptMsgType() != id.OlmMsgTypeMsg {
+		t.Errorf("Expected Alice to send normal messages after receiving a reply")
+	}
+
+	// Messages on the same chain delivered out of order must use the skipped message keys.
+	messages := make([][]byte, 3)
+	for i := range messages {
+		_, messages[i] = alice.Encrypt([]byte{'a' + byte(i)})
+	}
+	for _, i := range []int{2, 0, 1} {
+		plaintext, err := bob.Decrypt(string(messages[i]), id.OlmMsgTypeMsg)
+		if err != nil {
+			t.Fatalf("Failed to decrypt message #%d: %v", i, err)
+		} else if !bytes.Equal(plaintext, []byte{'a' + byte(i)}) {
+			t.Errorf("Unexpected plaintext for message #%d: %q", i, plaintext)
+		}
+	}
+	if _, err := bob.Decrypt(string(messages[0]), id.OlmMsgTypeMsg); err != BadMessageKeyID {
+		t.Errorf("Expected replayed message to fail with BadMessageKeyID, got %v", err)
+	}
+
+	pickled := bob.Pickle([]byte("test"))
+	unpickled, err := SessionFromPickled(pickled, []byte("test"))
+	if err != nil {
+		t.Fatalf("Failed to unpickle session: %v", err)
+	}
+	_, ciphertext = alice.Encrypt([]byte("after pickling"))
+	if plaintext, err := unpickled.Decrypt(string(ciphertext), id.OlmMsgTypeMsg); err != nil || string(plaintext) != "after pickling" {
+		t.Errorf("Failed to decrypt with unpickled session: %q / %v", plaintext, err)
+	}
+	if _, err = SessionFromPickled(pickled, []byte("wrong")); err != BadAccountKey {
+		t.Errorf("Expected BadAccountKey when unpickling with wrong key, got %v", err)
+	}
+}
+
+func TestOlmSessionTamperedMessage(t *testing.T) {
+	alice, bob := createSessionPair(t)
+	_, ciphertext := alice.Encrypt([]byte("hello"))
+	raw, _ := decodeBase64(ciphertext)
+	raw[len(raw)-1] ^= 1
+	if _, err := bob.Decrypt(string(encodeBase64(raw)), id.OlmMsgTypePreKey); err != BadMessageMAC {
+		t.Errorf("Expected BadMessageMAC, got %v", err)
+	}
+	if plaintext, err := bob.Decrypt(string(ciphertext), id.OlmMsgTypePreKey); err != nil || string(plaintext) != "hello" {
+		t.Errorf("Failed to decrypt untampered message after failure: %q / %v", plaintext, err)
+	}
+}
+
+func TestMegolmRatchetAdvanceTo(t *testing.T) {
+	initial := megolmRatchet{Data: bytes.Repeat([]byte{0x42}, megolmRatchetLength)}
+	stepwise := initial.copy()
+	for _, target := range []uint32{1, 5, 255, 256, 257, 1000, 70000} {
+		for stepwise.Counter < target {
+			stepwise.advance()
+		}
+		jumped := initial.copy()
+		jumped.advanceTo(target)
+		if jumped.Counter != target || !bytes.Equal(jumped.Data, stepwise.Data) {
+			t.Errorf("advanceTo(%d) doesn't match advancing step by step", target)
+		}
+	}
+}
+
+func TestMegolmSession(t *testing.T) {
+	outbound := NewOutboundGroupSession()
+	first := outbound.Encrypt([]byte("first"))
+	inbound, err := NewInboundGroupSession([]byte(outbound.Key()))
+	if err != nil {
+		t.Fatalf("Failed to create inbound group session: %v", err)
+	} else if inbound.ID() != outbound.ID() {
+		t.Errorf("Session IDs don't match: %s != %s", inbound.ID(), outbound.ID())
+	} else if inbound.FirstKnownIndex() != 1 {
+		t.Errorf("Expected first known index to be 1, got %d", inbound.FirstKnownIndex())
+	}
+	if _, _, err = inbound.Decrypt(first); err != UnknownMessageIndex {
+		t.Errorf("Expected UnknownMessageIndex for message sent before the key was shared, got %v", err)
+	}
+
+	messages := make([][]byte, 5)
+	for i := range messages {
+		messages[i] = outbound.Encrypt([]byte{'a' + byte(i)})
+	}
+	for _, i := range []int{3, 0, 4, 1, 2} {
+		plaintext, index, err := inbound.Decrypt(messages[i])
+		if err != nil {
+			t.Fatalf("Failed to decrypt message #%d: %v", i, err)
+		} else if index != uint(i+1) || !bytes.Equal(plaintext, []byte{'a' + byte(i)}) {
+			t.Errorf("Unexpected result for message #%d: %q at index %d", i, plaintext, index)
+		}
+	}
+
+	exported, err := inbound.Export(3)
+	if err != nil {
+		t.Fatalf("Failed to export session: %v", err)
+	}
+	imported, err := InboundGroupSessionImport([]byte(exported))
+	if err != nil {
+		t.Fatalf("Failed to import session: %v", err)
+	} else if imported.IsVerified() != 0 {
+		t.Errorf("Imported session shouldn't be verified before decrypting a message")
+	}
+	if _, _, err = imported.Decrypt(messages[1]); err != UnknownMessageIndex {
+		t.Errorf("Expected UnknownMessageIndex for message before export index, got %v", err)
+	}
+	if plaintext, _, err := imported.Decrypt(messages[2]); err != nil || string(plaintext) != "c" {
+		t.Errorf("Failed to decrypt with imported session: %q / %v", plaintext, err)
+	} else if imported.IsVerified() != 1 {
+		t.Errorf("Imported session should be verified after decrypting a message")
+	}
+
+	unpickled, err := InboundGroupSessionFromPickled(imported.Pickle([]byte("test")), []byte("test"))
+	if err != nil {
+		t.Fatalf("Failed to unpickle inbound group session: %v", err)
+	} else if plaintext, _, err := unpickled.Decrypt(messages[4]); err != nil || string(plaintext) != "e" {
+		t.Errorf("Failed to decrypt with unpickled session: %q / %v", plaintext, err)
+	}
+}
+
+func TestAccountPickle(t *testing.T) {
+	account := NewAccount()
+	account.GenOneTimeKeys(5)
+	account.MarkKeysAsPublished()
+	account.GenOneTimeKeys(2)
+	if len(account.OneTimeKeys()) != 2 {
+		t.Errorf("Expected 2 unpublished one-time keys, got %d", len(account.OneTimeKeys()))
+	}
+	unpickled, err := AccountFromPickled(account.Pickle([]byte("test")), []byte("test"))
+	if err != nil {
+		t.Fatalf("Failed to unpickle account: %v", err)
+	}
+	signingKey, identityKey := account.IdentityKeys()
+	unpickledSigningKey, unpickledIdentityKey := unpickled.IdentityKeys()
+	if signingKey != unpickledSigningKey || identityKey != unpickledIdentityKey {
+		t.Errorf("Identity keys changed after unpickling")
+	}
+	obj := map[string]interface{}{"key": "value"}
+	signature, _ := unpickled.SignJSON(obj)
+	obj["signatures"] = map[id.UserID]map[string]string{"@user:example.com": {"ed25519:DEVICE": signature}}
+	if ok, err := VerifySignatureJSON(obj, "@user:example.com", "DEVICE", signingKey); err != nil || !ok {
+		t.Errorf("Signature from unpickled account not valid: %t / %v", ok, err)
+	}
+}
+
+func TestLegacyGoolmPickles(t *testing.T) {
+	// Accounts and outbound group sessions used to be pickled as JSON, and those pickles must still load
+	_, signingKey, _ := ed25519.GenerateKey(nil)
+	legacyAccount := legacyAccountState{
+		Ed25519Key:    signingKey,
+		Curve25519Key: newCurve25519KeyPair(),
+		OneTimeKeys:   []oneTimeKey{{ID: 1, Key: newCurve25519KeyPair()}},
+	}
+	data, _ := json.Marshal(&legacyAccount)
+	var pw pickleWriter
+	pw.writeUint32(legacyGoolmPickleVersion)
+	pw.Write(data)
+	account, err := AccountFromPickled(encryptPickle([]byte("test"), pw.Bytes()), []byte("test"))
+	if err != nil {
+		t.Fatalf("Failed to unpickle legacy account: %v", err)
+	}
+	edKey, _ := account.IdentityKeys()
+	if edKey != id.Ed25519(encodeBase64(signingKey.Public().(ed25519.PublicKey))) {
+		t.Errorf("Identity key changed after unpickling legacy account")
+	} else if !ed25519.Verify(signingKey.Public().(ed25519.PublicKey), []byte("test"), decodeVectorKey(t, string(account.Sign([]byte("test"))))) {
+		t.Error("Signature from legacy account isn't valid")
+	}
+	if len(account.OneTimeKeys()) != 1 {
+		t.Errorf("Expected 1 one-time key in legacy account, got %d", len(account.OneTimeKeys()))
+	}
+
+	legacySession := legacyOutboundGroupSessionState{
+		Ratchet:    megolmRatchet{Data: make([]byte, megolmRatchetLength), Counter: 3},
+		SigningKey: signingKey,
+	}
+	data, _ = json.Marshal(&legacySession)
+	pw.Reset()
+	pw.writeUint32(legacyGoolmPickleVersion)
+	pw.Write(data)
+	session, err := OutboundGroupSessionFromPickled(encryptPickle([]byte("test"), pw.Bytes()), []byte("test"))
+	if err != nil {
+		t.Fatalf("Failed to unpickle legacy outbound group session: %v", err)
+	} else if session.MessageIndex() != 3 || session.ID() != id.SessionID(edKey) {
+		t.Errorf("Unexpected legacy outbound group session %s at index %d", session.ID(), session.MessageIndex())
+	}
+}
+
+func TestAccountPickleFallbackKeys(t *testing.T) {
+	account := NewAccount()
+	account.GenFallbackKey()
+	account.MarkKeysAsPublished()
+	account.GenFallbackKey()
+	unpickled, err := AccountFromPickled(account.Pickle([]byte("test")), []byte("test"))
+	if err != nil {
+		t.Fatalf("Failed to unpickle account: %v", err)
+	}
+	if unpickled.state.CurrentFallbackKey == nil || unpickled.state.PrevFallbackKey == nil {
+		t.Fatal("Fallback keys weren't unpickled")
+	} else if unpickled.state.CurrentFallbackKey.ID != 2 || !unpickled.state.PrevFallbackKey.Published {
+		t.Errorf("Unexpected fallback keys after unpickling")
+	} else if unpickled.state.NextOneTimeKeyID != 2 {
+		t.Errorf("Expected next one-time key ID 2, got %d", unpickled.state.NextOneTimeKeyID)
+	}
+
+	// Version 3 pickles always contain both fallback keys and use the published flag to tell if they exist
+	var pw pickleWriter
+	pw.writeUint32(3)
+	account.state.Ed25519Key.pickle(&pw)
+	account.state.Curve25519Key.pickle(&pw)
+	pw.writeUint32(0)
+	account.state.PrevFallbackKey.pickle(&pw)
+	(&oneTimeKey{Key: newCurve25519KeyPair()}).pickle(&pw)
+	pw.writeUint32(2)
+	unpickled, err = AccountFromPickled(encryptPickle([]byte("test"), pw.Bytes()), []byte("test"))
+	if err != nil {
+		t.Fatalf("Failed to unpickle version 3 account: %v", err)
+	} else if unpickled.state.CurrentFallbackKey == nil || unpickled.state.CurrentFallbackKey.ID != 1 || unpickled.state.PrevFallbackKey != nil {
+		t.Errorf("Unexpected fallback keys in version 3 account")
+	}
+}
+
+func TestSAS(t *testing.T) {
+	alice := NewSAS()
+	bob := NewSAS()
+	if _, err := alice.GenerateBytes([]byte("info"), 6); err != SASTheirKeyNotSet {
+		t.Errorf("Expected SASTheirKeyNotSet, got %v", err)
+	}
+	if err := alice.SetTheirKey(bob.GetPubkey()); err != nil {
+		t.Fatalf("Failed to set Bob's key: %v", err)
+	}
+	if err := bob.SetTheirKey(alice.GetPubkey()); err != nil {
+		t.Fatalf("Failed to set Alice's key: %v", err)
+	}
+	aliceBytes, _ := alice.GenerateBytes([]byte("info"), 6)
+	bobBytes, _ := bob.GenerateBytes([]byte("info"), 6)
+	if !bytes.Equal(aliceBytes, bobBytes) {
+		t.Errorf("SAS bytes don't match")
+	}
+	aliceMAC, _ := alice.CalculateMAC([]byte("input"), []byte("info"))
+	bobMAC, _ := bob.CalculateMAC([]byte("input"), []byte("info"))
+	if !bytes.Equal(aliceMAC, bobMAC) {
+		t.Errorf("SAS MACs don't match")
+	} else if len(aliceMAC) != 43 {
+		t.Errorf("Expected 43 byte MAC, got %d", len(aliceMAC))
+	}
+}
+
+func TestEncodeBase64InPlace(t *testing.T) {
+	// The first group is encoded before any input is overwritten, but the rest is corrupted like in libolm.
+	input := []byte("any carnal pleasure")
+	inPlace := make([]byte, unpaddedBase64.EncodedLen(len(input)))
+	copy(inPlace, input)
+	encodeBase64InPlace(inPlace, len(input))
+	normal := encodeBase64(input)
+	if !bytes.Equal(inPlace[:4], normal[:4]) {
+		t.Errorf("First base64 group should be unaffected by in-place encoding: %q != %q", inPlace[:4], normal[:4])
+	} else if bytes.Equal(inPlace, normal) {
+		t.Errorf("In-place encoding should differ from normal base64")
+	}
+}
+
+func TestFallbackKey(t *testing.T) {
+	bobAccount := NewAccount()
+	_, bobIdentityKey := bobAccount.IdentityKeys()
+	if len(bobAccount.FallbackKey()) != 0 {
+		t.Error("New account has a fallback key")
+	}
+	bobAccount.GenFallbackKey()
+	var fallbackKey id.Curve25519
+	for _, key := range bobAccount.FallbackKey() {
+		fallbackKey = key
+	}
+	bobAccount.MarkKeysAsPublished()
+	if len(bobAccount.FallbackKey()) != 0 {
+		t.Error("Fallback key is still unpublished after marking keys as published")
+	}
+
+	// The fallback key can be used by multiple senders and isn't removed when a session is created with it.
+	for i := 0; i < 2; i++ {
+		aliceAccount := NewAccount()
+		_, aliceIdentityKey := aliceAccount.IdentityKeys()
+		alice, err := aliceAccount.NewOutboundSession(bobIdentityKey, fallbackKey)
+		if err != nil {
+			t.Fatalf("Failed to create outbound session: %v", err)
+		}
+		msgType, ciphertext := alice.Encrypt([]byte("hello"))
+		bob, err := bobAccount.NewInboundSessionFrom(aliceIdentityKey, string(ciphertext))
+		if err != nil {
+			t.Fatalf("Failed to create inbound session with fallback key: %v", err)
+		}
+		_ = bobAccount.RemoveOneTimeKeys(bob)
+		if plaintext, err := bob.Decrypt(string(ciphertext), msgType); err != nil || string(plaintext) != "hello" {
+			t.Errorf("Failed to decrypt message sent with fallback key: %q / %v", plaintext, err)
+		}
+		if i == 0 {
+			// The previous fallback key should still work after rotating.
+			bobAccount.GenFallbackKey()
+		}
+	}
+
+	bobAccount.ForgetOldFallbackKey()
+	aliceAccount := NewAccount()
+	_, aliceIdentityKey := aliceAccount.IdentityKeys()
+	alice, _ := aliceAccount.NewOutboundSession(bobIdentityKey, fallbackKey)
+	_, ciphertext := alice.Encrypt([]byte("hello"))
+	if _, err := bobAccount.NewInboundSessionFrom(aliceIdentityKey, string(ciphertext)); err != BadMessageKeyID {
+		t.Errorf("Expected BadMessageKeyID after forgetting old fallback key, got %v", err)
+	}
+}
@@ -1,3 +1,6 @@
+//go:build !goolm
+// +build !goolm
+
 package olm
 
 // #cgo LDFLAGS: -lolm -lstdc++
@@ -5,9 +8,9 @@ package olm
 import "C"
 
 import (
-	"crypto/rand"
 	"unsafe"
 
+	"maunium.net/go/mautrix/crypto/utils"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -35,7 +38,7 @@ func OutboundGroupSessionFromPickled(pickled, key []byte) (*OutboundGroupSession
 func NewOutboundGroupSession() *OutboundGroupSession {
 	s := NewBlankOutboundGroupSession()
 	random := make([]byte, s.createRandomLen()+1)
-	_, err := rand.Read(random)
+	_, err := utils.ReadRandom(random)
 	if err != nil {
 		panic(NotEnoughGoRandom)
 	}
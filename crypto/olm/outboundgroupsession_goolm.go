@@ -0,0 +1,190 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/id"
+)
+
+// outboundGroupSessionState is the pickled state of an OutboundGroupSession.
+type outboundGroupSessionState struct {
+	Ratchet    megolmRatchet
+	SigningKey ed25519KeyPair
+}
+
+// legacyOutboundGroupSessionState is the JSON state in the pickles that goolm made before outbound group sessions
+// were pickled in the libolm format.
+type legacyOutboundGroupSessionState struct {
+	Ratchet    megolmRatchet      `json:"ratchet"`
+	SigningKey ed25519.PrivateKey `json:"signing_key"`
+}
+
+// OutboundGroupSession stores an outbound encrypted messaging session for a
+// group.
+type OutboundGroupSession struct {
+	state outboundGroupSessionState
+}
+
+// OutboundGroupSessionFromPickled loads an OutboundGroupSession from a pickled
+// base64 string.  Decrypts the OutboundGroupSession using the supplied key.
+// Returns error on failure.  If the key doesn't match the one used to encrypt
+// the OutboundGroupSession then the error will be "BAD_ACCOUNT_KEY".  If the
+// base64 couldn't be decoded then the error will be "INVALID_BASE64".
+func OutboundGroupSessionFromPickled(pickled, key []byte) (*OutboundGroupSession, error) {
+	if len(pickled) == 0 {
+		return nil, EmptyInput
+	}
+	s := NewBlankOutboundGroupSession()
+	return s, s.Unpickle(pickled, key)
+}
+
+// NewOutboundGroupSession creates a new outbound group session.
+func NewOutboundGroupSession() *OutboundGroupSession {
+	ratchetData := make([]byte, megolmRatchetLength)
+	if _, err := utils.ReadRandom(ratchetData); err != nil {
+		panic(NotEnoughGoRandom)
+	}
+	return &OutboundGroupSession{state: outboundGroupSessionState{
+		Ratchet:    megolmRatchet{Data: ratchetData},
+		SigningKey: newEd25519KeyPair(),
+	}}
+}
+
+// NewBlankOutboundGroupSession initialises an empty OutboundGroupSession.
+func NewBlankOutboundGroupSession() *OutboundGroupSession {
+	return &OutboundGroupSession{}
+}
+
+// Clear clears the memory used to back this OutboundGroupSession.
+func (s *OutboundGroupSession) Clear() error {
+	s.state.Ratchet.wipe()
+	s.state.SigningKey.wipe()
+	s.state = outboundGroupSessionState{}
+	return nil
+}
+
+// outboundGroupSessionPickleVersion is the libolm outbound group session pickle version. Outbound group sessions
+// use the same pickle format as libolm, so they can be shared between the implementations.
+const outboundGroupSessionPickleVersion = 1
+
+// Pickle returns an OutboundGroupSession as a base64 string.  Encrypts the
+// OutboundGroupSession using the supplied key.
+func (s *OutboundGroupSession) Pickle(key []byte) []byte {
+	var pw pickleWriter
+	pw.writeUint32(outboundGroupSessionPickleVersion)
+	s.state.Ratchet.pickle(&pw)
+	s.state.SigningKey.pickle(&pw)
+	defer utils.WipeBytes(pw.Bytes())
+	return encryptPickle(key, pw.Bytes())
+}
+
+func (s *OutboundGroupSession) Unpickle(pickled, key []byte) error {
+	plaintext, err := decryptPickle(pickled, key)
+	if err != nil {
+		return err
+	}
+	defer utils.WipeBytes(plaintext)
+	pr := pickleReader{data: plaintext}
+	version := pr.readUint32()
+	if pr.err != nil {
+		return pr.err
+	}
+	var state outboundGroupSessionState
+	switch version {
+	case legacyGoolmPickleVersion:
+		var legacyState legacyOutboundGroupSessionState
+		if json.Unmarshal(pr.data, &legacyState) != nil || len(legacyState.Ratchet.Data) != megolmRatchetLength || len(legacyState.SigningKey) != ed25519.PrivateKeySize {
+			return CorruptedPickle
+		}
+		state.Ratchet = legacyState.Ratchet
+		state.SigningKey = ed25519KeyPairFromPrivateKey(legacyState.SigningKey)
+		utils.WipeBytes(legacyState.SigningKey)
+	case outboundGroupSessionPickleVersion:
+		state.Ratchet.unpickle(&pr)
+		state.SigningKey.unpickle(&pr)
+		if pr.err != nil {
+			return pr.err
+		}
+	default:
+		return UnknownPickleVersion
+	}
+	s.state = state
+	return nil
+}
+
+func (s *OutboundGroupSession) GobEncode() ([]byte, error) {
+	pickled := s.Pickle(pickleKey)
+	length := unpaddedBase64.DecodedLen(len(pickled))
+	rawPickled := make([]byte, length)
+	_, err := unpaddedBase64.Decode(rawPickled, pickled)
+	return rawPickled, err
+}
+
+func (s *OutboundGroupSession) GobDecode(rawPickled []byte) error {
+	length := unpaddedBase64.EncodedLen(len(rawPickled))
+	pickled := make([]byte, length)
+	unpaddedBase64.Encode(pickled, rawPickled)
+	return s.Unpickle(pickled, pickleKey)
+}
+
+func (s *OutboundGroupSession) MarshalJSON() ([]byte, error) {
+	pickled := s.Pickle(pickleKey)
+	quotes := make([]byte, len(pickled)+2)
+	quotes[0] = '"'
+	quotes[len(quotes)-1] = '"'
+	copy(quotes[1:len(quotes)-1], pickled)
+	return quotes, nil
+}
+
+func (s *OutboundGroupSession) UnmarshalJSON(data []byte) error {
+	if len(data) == 0 || data[0] != '"' || data[len(data)-1] != '"' {
+		return InputNotJSONString
+	}
+	return s.Unpickle(data[1:len(data)-1], pickleKey)
+}
+
+func (s *OutboundGroupSession) publicKey() ed25519.PublicKey {
+	return s.state.SigningKey.Public
+}
+
+// Encrypt encrypts a message using the Session.  Returns the encrypted message
+// as base64.
+func (s *OutboundGroupSession) Encrypt(plaintext []byte) []byte {
+	if len(plaintext) == 0 {
+		panic(EmptyInput)
+	}
+	keys := deriveAESSHA256Keys(s.state.Ratchet.Data, megolmKeysInfo)
+	defer keys.wipe()
+	var pw protoWriter
+	pw.WriteByte(megolmProtocolVersion)
+	pw.writeIntField(megolmMessageTagIndex, s.state.Ratchet.Counter)
+	pw.writeBytesField(megolmMessageTagCiphertext, keys.encrypt(plaintext))
+	pw.Write(keys.mac(pw.Bytes()))
+	pw.Write(s.state.SigningKey.sign(pw.Bytes()))
+	s.state.Ratchet.advance()
+	return encodeBase64(pw.Bytes())
+}
+
+// ID returns a base64-encoded identifier for this session.
+func (s *OutboundGroupSession) ID() id.SessionID {
+	return id.SessionID(encodeBase64(s.publicKey()))
+}
+
+// MessageIndex returns the message index for this session.  Each message is
+// sent with an increasing index; this returns the index for the next message.
+func (s *OutboundGroupSession) MessageIndex() uint {
+	return uint(s.state.Ratchet.Counter)
+}
+
+// Key returns the base64-encoded current ratchet key for this session.
+func (s *OutboundGroupSession) Key() string {
+	data := encodeMegolmSessionData(megolmSessionKeyVersion, &s.state.Ratchet, s.publicKey(), megolmSessionKeyLength)
+	data = append(data, s.state.SigningKey.sign(data)...)
+	defer utils.WipeBytes(data)
+	return string(encodeBase64(data))
+}
@@ -0,0 +1,105 @@
+package olm
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// The pickles below are in the libolm format and encrypted with vectorPickleKey. They were made from fixed keys
+// outside of both backends, and the tests run with libolm and goolm to make sure the pickles can be shared.
+var vectorPickleKey = []byte("pickle key")
+
+// vectorAccountPickle is a version 4 account pickle with two one-time keys (2 unpublished and 1 published),
+// one unpublished fallback key with ID 3 and the next one-time key ID 3.
+const vectorAccountPickle = "K/cq7vv5VejmpNIxF6dTshtUOm7umxiQ5WkADlU0mz+x+OILDYmqsQY/XPQczvWljlik/LEgj9LLEsNq+q2WuEvw2dPiX+iYJlM/cS9JHTCZmBJ8vF/8f8c4f3wcxx1rVPbZc4Pr9MIl8WOKdQms0z1XxkfcRJv8CQBFOXLZe4FgtUepaMIrqn6mnenCvpdY6l6zBVm/3WvnrYCIq92OSqgXM8GZ/wY9AoHVHxmA0GdMcv1aDbp0bvDB7mahBjmRz8u/qAx0c+gFx9Wuzo8HR82ZTyGLCDUT29FCViZL4xNOMx8yIyOUuA/+Wg6rLXTP9xSqJpbhpGhpEm1kmYgU3MGMH7pPC/NCv7zivlG3GyvwHw2IgWkripq1Y8/bHDjp/0uTTg0X1/UZP2kMLSitFQ8s+KDbXr4jCedCbzeW0bV9d3Raol4/HBZDril1EiIJhdfwgeHIdkT2mgY8vRtL7/40/WOGBvIl+WIttYYmPJ7I9Reo068JcoZ1uasLCfEWhC1CYRvspdc"
+
+const (
+	vectorAccountEd25519    = id.Ed25519("ebVWLo/mVPlAeLES6KmLp5AfhTrmlb7X4OORC60ElmQ")
+	vectorAccountCurve25519 = id.Curve25519("WGmv9FBUlzLLqu1eXfmzCm2jHLDldCutWtShp2jxpns")
+	vectorAccountOneTimeKey = id.Curve25519("ZLEBsdC+WocEvQePmJUAH8A+jp+VIvGI3RKNmEbUhGY")
+)
+
+// vectorOutboundPickle is a version 1 outbound group session pickle with the ratchet bytes 0x80 to 0xff and counter 5.
+const vectorOutboundPickle = "W6/9gPGbHZk9a9ylWEHciTFhG4SJcANDcKfhWmlJCJnTCq7zanmtaQq3zFDWMwX+vTfCRxPRU51e4/AHO43hBVQxDdeHMAy8UxauMyAwssbbxhOGn7p+4h1KLtReroMLUmQtB0DTcL8lQZUoYYBsolpoxRljylXdrkwWKlaMDy4C181+MtsOyFwXVEP3MeaUZHWE5BHpxbDqt4xExMjhqRjjxlg79+WBQ0ji/rUrJM9jAjDqohcvhKOcNbyaSvONtFqKPRIPuDpazA989CEYoaRm0zR01deaFlRtof6V2DNHBbGRPhGTVo8LpL0skzQLrvJy2Ymh6bk"
+
+const vectorOutboundID = id.SessionID("C0eCPnEJXdWb54rCccV27zifh7ZFYasHz5pOvNAtIEE")
+
+func decodeVectorKey(t *testing.T, key string) []byte {
+	decoded, err := base64.RawStdEncoding.DecodeString(key)
+	if err != nil {
+		t.Fatalf("Failed to decode %s: %v", key, err)
+	}
+	return decoded
+}
+
+func TestAccountPickleVector(t *testing.T) {
+	account, err := AccountFromPickled([]byte(vectorAccountPickle), vectorPickleKey)
+	if err != nil {
+		t.Fatalf("Failed to unpickle account: %v", err)
+	}
+	signingKey, identityKey := account.IdentityKeys()
+	if signingKey != vectorAccountEd25519 || identityKey != vectorAccountCurve25519 {
+		t.Errorf("Unexpected identity keys %s / %s", signingKey, identityKey)
+	}
+	otks := account.OneTimeKeys()
+	if len(otks) != 1 || otks["AAAAAg"] != vectorAccountOneTimeKey {
+		t.Errorf("Unexpected one-time keys %v", otks)
+	}
+	message := []byte("test message")
+	signature := decodeVectorKey(t, string(account.Sign(message)))
+	if !ed25519.Verify(decodeVectorKey(t, string(vectorAccountEd25519)), message, signature) {
+		t.Error("Signature made with unpickled account isn't valid")
+	}
+	// Pickling is deterministic, so the same state produces the same pickle
+	if pickled := account.Pickle(vectorPickleKey); string(pickled) != vectorAccountPickle {
+		t.Errorf("Pickling the account again produced a different pickle: %s", pickled)
+	}
+	if _, err = AccountFromPickled([]byte(vectorAccountPickle), []byte("wrong key")); err != BadAccountKey {
+		t.Errorf("Expected BadAccountKey with wrong pickle key, got %v", err)
+	}
+}
+
+func TestOutboundGroupSessionPickleVector(t *testing.T) {
+	session, err := OutboundGroupSessionFromPickled([]byte(vectorOutboundPickle), vectorPickleKey)
+	if err != nil {
+		t.Fatalf("Failed to unpickle outbound group session: %v", err)
+	}
+	if session.ID() != vectorOutboundID {
+		t.Errorf("Unexpected session ID %s", session.ID())
+	} else if session.MessageIndex() != 5 {
+		t.Errorf("Unexpected message index %d", session.MessageIndex())
+	}
+	if pickled := session.Pickle(vectorPickleKey); string(pickled) != vectorOutboundPickle {
+		t.Errorf("Pickling the outbound group session again produced a different pickle: %s", pickled)
+	}
+
+	// The session key contains the version, the counter, the ratchet and the public key, signed with the signing key
+	sessionKey := decodeVectorKey(t, session.Key())
+	ratchet := make([]byte, 128)
+	for i := range ratchet {
+		ratchet[i] = 0x80 + byte(i)
+	}
+	publicKey := decodeVectorKey(t, string(vectorOutboundID))
+	if len(sessionKey) != 229 || sessionKey[0] != 2 || binary.BigEndian.Uint32(sessionKey[1:5]) != 5 ||
+		!bytes.Equal(sessionKey[5:133], ratchet) || !bytes.Equal(sessionKey[133:165], publicKey) {
+		t.Fatalf("Unexpected session key %s", session.Key())
+	} else if !ed25519.Verify(publicKey, sessionKey[:165], sessionKey[165:]) {
+		t.Error("Session key signature isn't valid")
+	}
+
+	inbound, err := NewInboundGroupSession([]byte(session.Key()))
+	if err != nil {
+		t.Fatalf("Failed to create inbound group session: %v", err)
+	}
+	plaintext, index, err := inbound.Decrypt(session.Encrypt([]byte("hello")))
+	if err != nil {
+		t.Fatalf("Failed to decrypt message: %v", err)
+	} else if string(plaintext) != "hello" || index != 5 {
+		t.Errorf("Unexpected plaintext %q at index %d", plaintext, index)
+	}
+}
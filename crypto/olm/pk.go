@@ -1,3 +1,6 @@
+//go:build !goolm
+// +build !goolm
+
 package olm
 
 // #cgo LDFLAGS: -lolm -lstdc++
@@ -6,13 +9,13 @@ package olm
 import "C"
 
 import (
-	"crypto/rand"
 	"encoding/json"
 	"unsafe"
 
 	"github.com/tidwall/sjson"
 
 	"maunium.net/go/mautrix/crypto/canonicaljson"
+	"maunium.net/go/mautrix/crypto/utils"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -72,7 +75,7 @@ func NewPkSigningFromSeed(seed []byte) (*PkSigning, error) {
 func NewPkSigning() (*PkSigning, error) {
 	// Generate the seed
 	seed := make([]byte, pkSigningSeedLength())
-	_, err := rand.Read(seed)
+	_, err := utils.ReadRandom(seed)
 	if err != nil {
 		panic(NotEnoughGoRandom)
 	}
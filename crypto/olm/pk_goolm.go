@@ -0,0 +1,79 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+
+	"github.com/tidwall/sjson"
+
+	"maunium.net/go/mautrix/crypto/canonicaljson"
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/id"
+)
+
+// PkSigning stores a key pair for signing messages.
+type PkSigning struct {
+	key       ed25519.PrivateKey
+	PublicKey id.Ed25519
+	Seed      []byte
+}
+
+func NewBlankPkSigning() *PkSigning {
+	return &PkSigning{}
+}
+
+// Clear clears the underlying memory of a PkSigning object.
+func (p *PkSigning) Clear() {
+	utils.WipeBytes(p.key)
+	p.key = nil
+}
+
+// NewPkSigningFromSeed creates a new PkSigning object using the given seed.
+func NewPkSigningFromSeed(seed []byte) (*PkSigning, error) {
+	if len(seed) < ed25519.SeedSize {
+		return nil, InputBufferTooSmall
+	}
+	p := NewBlankPkSigning()
+	p.key = ed25519.NewKeyFromSeed(seed[:ed25519.SeedSize])
+	p.PublicKey = id.Ed25519(encodeBase64(p.key.Public().(ed25519.PublicKey)))
+	p.Seed = seed
+	return p, nil
+}
+
+// NewPkSigning creates a new PkSigning object, containing a key pair for signing messages.
+func NewPkSigning() (*PkSigning, error) {
+	// Generate the seed
+	seed := make([]byte, ed25519.SeedSize)
+	_, err := utils.ReadRandom(seed)
+	if err != nil {
+		panic(NotEnoughGoRandom)
+	}
+	pk, err := NewPkSigningFromSeed(seed)
+	return pk, err
+}
+
+// Sign creates a signature for the given message using this key.
+func (p *PkSigning) Sign(message []byte) ([]byte, error) {
+	if p.key == nil {
+		return nil, NoKeyProvided
+	}
+	return encodeBase64(ed25519.Sign(p.key, message)), nil
+}
+
+// SignJSON creates a signature for the given object after encoding it to canonical JSON.
+func (p *PkSigning) SignJSON(obj interface{}) (string, error) {
+	objJSON, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	objJSON, _ = sjson.DeleteBytes(objJSON, "unsigned")
+	objJSON, _ = sjson.DeleteBytes(objJSON, "signatures")
+	signature, err := p.Sign(canonicaljson.CanonicalJSONAssumeValid(objJSON))
+	if err != nil {
+		return "", err
+	}
+	return string(signature), nil
+}
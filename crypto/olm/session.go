@@ -1,3 +1,6 @@
+//go:build !goolm
+// +build !goolm
+
 package olm
 
 // #cgo LDFLAGS: -lolm -lstdc++
@@ -15,9 +18,9 @@ package olm
 import "C"
 
 import (
-	"crypto/rand"
 	"unsafe"
 
+	"maunium.net/go/mautrix/crypto/utils"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -290,7 +293,7 @@ func (s *Session) Encrypt(plaintext []byte) (id.OlmMsgType, []byte) {
 	}
 	// Make the slice be at least length 1
 	random := make([]byte, s.encryptRandomLen()+1)
-	_, err := rand.Read(random)
+	_, err := utils.ReadRandom(random)
 	if err != nil {
 		panic(NotEnoughGoRandom)
 	}
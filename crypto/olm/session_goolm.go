@@ -0,0 +1,608 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	olmProtocolVersion = 3
+
+	maxReceiverChains     = 5
+	maxSkippedMessageKeys = 40
+	maxMessageGap         = 2000
+
+	olmMessageTagRatchetKey = 0x0A
+	olmMessageTagCounter    = 0x10
+	olmMessageTagCiphertext = 0x22
+
+	olmPreKeyTagOneTimeKey  = 0x0A
+	olmPreKeyTagBaseKey     = 0x12
+	olmPreKeyTagIdentityKey = 0x1A
+	olmPreKeyTagMessage     = 0x22
+)
+
+var (
+	olmRootInfo    = []byte("OLM_ROOT")
+	olmRatchetInfo = []byte("OLM_RATCHET")
+	olmKeysInfo    = []byte("OLM_KEYS")
+
+	chainKeySeed   = []byte{0x02}
+	messageKeySeed = []byte{0x01}
+)
+
+type chainKey struct {
+	Key   []byte
+	Index uint32
+}
+
+func (ck chainKey) advance() chainKey {
+	return chainKey{Key: hmacSHA256(ck.Key, chainKeySeed), Index: ck.Index + 1}
+}
+
+func (ck chainKey) messageKey() messageKey {
+	return messageKey{Key: hmacSHA256(ck.Key, messageKeySeed), Index: ck.Index}
+}
+
+type messageKey struct {
+	Key   []byte
+	Index uint32
+}
+
+type senderChain struct {
+	RatchetKey curve25519KeyPair
+	ChainKey   chainKey
+}
+
+type receiverChain struct {
+	RatchetKey []byte
+	ChainKey   chainKey
+}
+
+type skippedMessageKey struct {
+	RatchetKey []byte
+	MessageKey messageKey
+}
+
+// olmMessage is a decoded normal (non-pre-key) olm message.
+type olmMessage struct {
+	RatchetKey []byte
+	Counter    uint32
+	Ciphertext []byte
+}
+
+func (msg *olmMessage) encode(keys *aesSHA256Keys) []byte {
+	var pw protoWriter
+	pw.WriteByte(olmProtocolVersion)
+	pw.writeBytesField(olmMessageTagRatchetKey, msg.RatchetKey)
+	pw.writeIntField(olmMessageTagCounter, msg.Counter)
+	pw.writeBytesField(olmMessageTagCiphertext, msg.Ciphertext)
+	pw.Write(keys.mac(pw.Bytes()))
+	return pw.Bytes()
+}
+
+// decodeOlmMessage decodes a normal olm message. The returned slice is the part of the message that the MAC covers.
+func decodeOlmMessage(data []byte) (msg *olmMessage, signed, mac []byte, err error) {
+	if len(data) == 0 {
+		return nil, nil, nil, BadMessageFormat
+	} else if data[0] != olmProtocolVersion {
+		return nil, nil, nil, BadMessageVersion
+	} else if len(data) < 1+macLength {
+		return nil, nil, nil, BadMessageFormat
+	}
+	signed, mac = data[:len(data)-macLength], data[len(data)-macLength:]
+	fields, err := parseProtoFields(signed[1:])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	counter, hasCounter := fields.ints[olmMessageTagCounter]
+	ratchetKey, hasRatchetKey := fields.bytes[olmMessageTagRatchetKey]
+	ciphertext, hasCiphertext := fields.bytes[olmMessageTagCiphertext]
+	if !hasCounter || !hasRatchetKey || !hasCiphertext || len(ratchetKey) != curve25519KeyLength {
+		return nil, nil, nil, BadMessageFormat
+	}
+	return &olmMessage{RatchetKey: ratchetKey, Counter: uint32(counter), Ciphertext: ciphertext}, signed, mac, nil
+}
+
+// olmPreKeyMessage is a decoded pre-key olm message.
+type olmPreKeyMessage struct {
+	OneTimeKey  []byte
+	BaseKey     []byte
+	IdentityKey []byte
+	Message     []byte
+}
+
+func (msg *olmPreKeyMessage) encode() []byte {
+	var pw protoWriter
+	pw.WriteByte(olmProtocolVersion)
+	pw.writeBytesField(olmPreKeyTagOneTimeKey, msg.OneTimeKey)
+	pw.writeBytesField(olmPreKeyTagBaseKey, msg.BaseKey)
+	pw.writeBytesField(olmPreKeyTagIdentityKey, msg.IdentityKey)
+	pw.writeBytesField(olmPreKeyTagMessage, msg.Message)
+	return pw.Bytes()
+}
+
+func decodeOlmPreKeyMessage(data []byte) (*olmPreKeyMessage, error) {
+	if len(data) == 0 {
+		return nil, BadMessageFormat
+	} else if data[0] != olmProtocolVersion {
+		return nil, BadMessageVersion
+	}
+	fields, err := parseProtoFields(data[1:])
+	if err != nil {
+		return nil, err
+	}
+	var msg olmPreKeyMessage
+	var ok [4]bool
+	msg.OneTimeKey, ok[0] = fields.bytes[olmPreKeyTagOneTimeKey]
+	msg.BaseKey, ok[1] = fields.bytes[olmPreKeyTagBaseKey]
+	msg.IdentityKey, ok[2] = fields.bytes[olmPreKeyTagIdentityKey]
+	msg.Message, ok[3] = fields.bytes[olmPreKeyTagMessage]
+	if !ok[0] || !ok[1] || !ok[2] || !ok[3] ||
+		len(msg.OneTimeKey) != curve25519KeyLength ||
+		len(msg.BaseKey) != curve25519KeyLength ||
+		len(msg.IdentityKey) != curve25519KeyLength {
+		return nil, BadMessageFormat
+	}
+	return &msg, nil
+}
+
+// sessionState is the pickled state of a Session.
+type sessionState struct {
+	ReceivedMessage  bool
+	AliceIdentityKey []byte
+	AliceBaseKey     []byte
+	BobOneTimeKey    []byte
+
+	RootKey            []byte
+	SenderChains       []senderChain
+	ReceiverChains     []receiverChain
+	SkippedMessageKeys []skippedMessageKey
+}
+
+// Session stores an end to end encrypted messaging session.
+type Session struct {
+	state sessionState
+}
+
+// SessionFromPickled loads a Session from a pickled base64 string.  Decrypts
+// the Session using the supplied key.  Returns error on failure.  If the key
+// doesn't match the one used to encrypt the Session then the error will be
+// "BAD_ACCOUNT_KEY".  If the base64 couldn't be decoded then the error will be
+// "INVALID_BASE64".
+func SessionFromPickled(pickled, key []byte) (*Session, error) {
+	if len(pickled) == 0 {
+		return nil, EmptyInput
+	}
+	s := NewBlankSession()
+	return s, s.Unpickle(pickled, key)
+}
+
+func NewBlankSession() *Session {
+	return &Session{}
+}
+
+// Clear clears the memory used to back this Session.
+func (s *Session) Clear() error {
+	utils.WipeBytes(s.state.RootKey)
+	for _, chain := range s.state.SenderChains {
+		chain.RatchetKey.wipe()
+		utils.WipeBytes(chain.ChainKey.Key)
+	}
+	for _, chain := range s.state.ReceiverChains {
+		utils.WipeBytes(chain.ChainKey.Key)
+	}
+	for _, key := range s.state.SkippedMessageKeys {
+		utils.WipeBytes(key.MessageKey.Key)
+	}
+	s.state = sessionState{}
+	return nil
+}
+
+// sessionPickleVersion is the libolm session pickle version. Sessions use the same pickle format as
+// libolm, so existing sessions keep working when switching between the cgo and pure-Go implementations.
+const sessionPickleVersion = 1
+
+func (ck *chainKey) pickle(pw *pickleWriter) {
+	pw.Write(ck.Key)
+	pw.writeUint32(ck.Index)
+}
+
+func (ck *chainKey) unpickle(pr *pickleReader) {
+	ck.Key = pr.readBytes(32)
+	ck.Index = pr.readUint32()
+}
+
+// Pickle returns a Session as a base64 string.  Encrypts the Session using the
+// supplied key.
+func (s *Session) Pickle(key []byte) []byte {
+	var pw pickleWriter
+	pw.writeUint32(sessionPickleVersion)
+	pw.writeBool(s.state.ReceivedMessage)
+	pw.Write(s.state.AliceIdentityKey)
+	pw.Write(s.state.AliceBaseKey)
+	pw.Write(s.state.BobOneTimeKey)
+	pw.Write(s.state.RootKey)
+	pw.writeUint32(uint32(len(s.state.SenderChains)))
+	for _, chain := range s.state.SenderChains {
+		pw.Write(chain.RatchetKey.Public)
+		pw.Write(chain.RatchetKey.Private)
+		chain.ChainKey.pickle(&pw)
+	}
+	pw.writeUint32(uint32(len(s.state.ReceiverChains)))
+	for _, chain := range s.state.ReceiverChains {
+		pw.Write(chain.RatchetKey)
+		chain.ChainKey.pickle(&pw)
+	}
+	pw.writeUint32(uint32(len(s.state.SkippedMessageKeys)))
+	for _, key := range s.state.SkippedMessageKeys {
+		pw.Write(key.RatchetKey)
+		pw.Write(key.MessageKey.Key)
+		pw.writeUint32(key.MessageKey.Index)
+	}
+	defer utils.WipeBytes(pw.Bytes())
+	return encryptPickle(key, pw.Bytes())
+}
+
+func (s *Session) Unpickle(pickled, key []byte) error {
+	plaintext, err := decryptPickle(pickled, key)
+	if err != nil {
+		return err
+	}
+	defer utils.WipeBytes(plaintext)
+	pr := pickleReader{data: plaintext}
+	if version := pr.readUint32(); pr.err == nil && version != sessionPickleVersion {
+		return UnknownPickleVersion
+	}
+	var state sessionState
+	state.ReceivedMessage = pr.readBool()
+	state.AliceIdentityKey = pr.readBytes(curve25519KeyLength)
+	state.AliceBaseKey = pr.readBytes(curve25519KeyLength)
+	state.BobOneTimeKey = pr.readBytes(curve25519KeyLength)
+	state.RootKey = pr.readBytes(32)
+	state.SenderChains = make([]senderChain, pr.readCount(1))
+	for i := range state.SenderChains {
+		chain := &state.SenderChains[i]
+		chain.RatchetKey.Public = pr.readBytes(curve25519KeyLength)
+		chain.RatchetKey.Private = pr.readBytes(curve25519KeyLength)
+		chain.ChainKey.unpickle(&pr)
+	}
+	state.ReceiverChains = make([]receiverChain, pr.readCount(maxReceiverChains))
+	for i := range state.ReceiverChains {
+		chain := &state.ReceiverChains[i]
+		chain.RatchetKey = pr.readBytes(curve25519KeyLength)
+		chain.ChainKey.unpickle(&pr)
+	}
+	state.SkippedMessageKeys = make([]skippedMessageKey, pr.readCount(maxSkippedMessageKeys))
+	for i := range state.SkippedMessageKeys {
+		key := &state.SkippedMessageKeys[i]
+		key.RatchetKey = pr.readBytes(curve25519KeyLength)
+		key.MessageKey.Key = pr.readBytes(32)
+		key.MessageKey.Index = pr.readUint32()
+	}
+	if pr.err != nil {
+		return pr.err
+	}
+	s.state = state
+	return nil
+}
+
+func (s *Session) GobEncode() ([]byte, error) {
+	pickled := s.Pickle(pickleKey)
+	length := unpaddedBase64.DecodedLen(len(pickled))
+	rawPickled := make([]byte, length)
+	_, err := unpaddedBase64.Decode(rawPickled, pickled)
+	return rawPickled, err
+}
+
+func (s *Session) GobDecode(rawPickled []byte) error {
+	length := unpaddedBase64.EncodedLen(len(rawPickled))
+	pickled := make([]byte, length)
+	unpaddedBase64.Encode(pickled, rawPickled)
+	return s.Unpickle(pickled, pickleKey)
+}
+
+func (s *Session) MarshalJSON() ([]byte, error) {
+	pickled := s.Pickle(pickleKey)
+	quotes := make([]byte, len(pickled)+2)
+	quotes[0] = '"'
+	quotes[len(quotes)-1] = '"'
+	copy(quotes[1:len(quotes)-1], pickled)
+	return quotes, nil
+}
+
+func (s *Session) UnmarshalJSON(data []byte) error {
+	if len(data) == 0 || data[0] != '"' || data[len(data)-1] != '"' {
+		return InputNotJSONString
+	}
+	return s.Unpickle(data[1:len(data)-1], pickleKey)
+}
+
+// initializeAsAlice sets up the ratchet for an outbound session from the result of the triple Diffie-Hellman.
+func (s *Session) initializeAsAlice(sharedSecret []byte, ourRatchetKey curve25519KeyPair) {
+	rootKey, chain := deriveRootKeys(sharedSecret)
+	s.state.RootKey = rootKey
+	s.state.SenderChains = []senderChain{{RatchetKey: ourRatchetKey, ChainKey: chain}}
+}
+
+// initializeAsBob sets up the ratchet for an inbound session from the result of the triple Diffie-Hellman.
+func (s *Session) initializeAsBob(sharedSecret, theirRatchetKey []byte) {
+	rootKey, chain := deriveRootKeys(sharedSecret)
+	s.state.RootKey = rootKey
+	s.state.ReceiverChains = []receiverChain{{RatchetKey: theirRatchetKey, ChainKey: chain}}
+}
+
+func deriveRootKeys(sharedSecret []byte) ([]byte, chainKey) {
+	derived := make([]byte, 64)
+	_, _ = hkdf.New(sha256.New, sharedSecret, nil, olmRootInfo).Read(derived)
+	return derived[:32], chainKey{Key: derived[32:]}
+}
+
+// advanceRootKey performs a Diffie-Hellman ratchet step, returning the new root key and chain key.
+func advanceRootKey(rootKey []byte, ourKey curve25519KeyPair, theirKey []byte) ([]byte, chainKey) {
+	derived := make([]byte, 64)
+	_, _ = hkdf.New(sha256.New, ourKey.sharedSecret(theirKey), rootKey, olmRatchetInfo).Read(derived)
+	return derived[:32], chainKey{Key: derived[32:]}
+}
+
+// ID returns an identifier for this Session.  Will be the same for both ends
+// of the conversation.
+func (s *Session) ID() id.SessionID {
+	hash := sha256.New()
+	hash.Write(s.state.AliceIdentityKey)
+	hash.Write(s.state.AliceBaseKey)
+	hash.Write(s.state.BobOneTimeKey)
+	return id.SessionID(encodeBase64(hash.Sum(nil)))
+}
+
+// HasReceivedMessage returns true if this session has received any message.
+func (s *Session) HasReceivedMessage() bool {
+	return s.state.ReceivedMessage
+}
+
+func (s *Session) matchesInbound(theirIdentityKey []byte, oneTimeKeyMsg string) (bool, error) {
+	raw, err := decodeBase64([]byte(oneTimeKeyMsg))
+	if err != nil {
+		return false, err
+	}
+	msg, err := decodeOlmPreKeyMessage(raw)
+	if err != nil {
+		return false, err
+	}
+	if theirIdentityKey != nil && !bytes.Equal(theirIdentityKey, msg.IdentityKey) {
+		return false, nil
+	}
+	return bytes.Equal(msg.OneTimeKey, s.state.BobOneTimeKey) && bytes.Equal(msg.BaseKey, s.state.AliceBaseKey), nil
+}
+
+// MatchesInboundSession checks if the PRE_KEY message is for this in-bound
+// Session.  This can happen if multiple messages are sent to this Account
+// before this Account sends a message in reply.  Returns true if the session
+// matches.  Returns false if the session does not match.  Returns error on
+// failure.  If the base64 couldn't be decoded then the error will be
+// "INVALID_BASE64".  If the message was for an unsupported protocol version
+// then the error will be "BAD_MESSAGE_VERSION".  If the message couldn't be
+// decoded then then the error will be "BAD_MESSAGE_FORMAT".
+func (s *Session) MatchesInboundSession(oneTimeKeyMsg string) (bool, error) {
+	if len(oneTimeKeyMsg) == 0 {
+		return false, EmptyInput
+	}
+	return s.matchesInbound(nil, oneTimeKeyMsg)
+}
+
+// MatchesInboundSessionFrom checks if the PRE_KEY message is for this in-bound
+// Session.  This can happen if multiple messages are sent to this Account
+// before this Account sends a message in reply.  Returns true if the session
+// matches.  Returns false if the session does not match.  Returns error on
+// failure.  If the base64 couldn't be decoded then the error will be
+// "INVALID_BASE64".  If the message was for an unsupported protocol version
+// then the error will be "BAD_MESSAGE_VERSION".  If the message couldn't be
+// decoded then then the error will be "BAD_MESSAGE_FORMAT".
+func (s *Session) MatchesInboundSessionFrom(theirIdentityKey, oneTimeKeyMsg string) (bool, error) {
+	if len(theirIdentityKey) == 0 || len(oneTimeKeyMsg) == 0 {
+		return false, EmptyInput
+	}
+	identityKey, err := decodeCurve25519Key(theirIdentityKey)
+	if err != nil {
+		return false, err
+	}
+	return s.matchesInbound(identityKey, oneTimeKeyMsg)
+}
+
+// EncryptMsgType returns the type of the next message that Encrypt will
+// return.  Returns MsgTypePreKey if the message will be a PRE_KEY message.
+// Returns MsgTypeMsg if the message will be a normal message.
+func (s *Session) EncryptMsgType() id.OlmMsgType {
+	if s.state.ReceivedMessage {
+		return id.OlmMsgTypeMsg
+	}
+	return id.OlmMsgTypePreKey
+}
+
+// Encrypt encrypts a message using the Session.  Returns the encrypted message
+// as base64.
+func (s *Session) Encrypt(plaintext []byte) (id.OlmMsgType, []byte) {
+	if len(plaintext) == 0 {
+		panic(EmptyInput)
+	}
+	messageType := s.EncryptMsgType()
+	if len(s.state.SenderChains) == 0 {
+		ratchetKey := newCurve25519KeyPair()
+		rootKey, chain := advanceRootKey(s.state.RootKey, ratchetKey, s.state.ReceiverChains[0].RatchetKey)
+		utils.WipeBytes(s.state.RootKey)
+		s.state.RootKey = rootKey
+		s.state.SenderChains = []senderChain{{RatchetKey: ratchetKey, ChainKey: chain}}
+	}
+	sender := &s.state.SenderChains[0]
+	msgKey := sender.ChainKey.messageKey()
+	sender.ChainKey = sender.ChainKey.advance()
+
+	keys := deriveAESSHA256Keys(msgKey.Key, olmKeysInfo)
+	defer keys.wipe()
+	msg := olmMessage{
+		RatchetKey: sender.RatchetKey.Public,
+		Counter:    msgKey.Index,
+		Ciphertext: keys.encrypt(plaintext),
+	}
+	encoded := msg.encode(&keys)
+	if messageType == id.OlmMsgTypePreKey {
+		preKeyMsg := olmPreKeyMessage{
+			OneTimeKey:  s.state.BobOneTimeKey,
+			BaseKey:     s.state.AliceBaseKey,
+			IdentityKey: s.state.AliceIdentityKey,
+			Message:     encoded,
+		}
+		encoded = preKeyMsg.encode()
+	}
+	return messageType, encodeBase64(encoded)
+}
+
+func decryptWithMessageKey(msgKey messageKey, msg *olmMessage, signed, mac []byte) ([]byte, error) {
+	keys := deriveAESSHA256Keys(msgKey.Key, olmKeysInfo)
+	defer keys.wipe()
+	if !keys.verifyMAC(signed, mac) {
+		return nil, BadMessageMAC
+	}
+	return keys.decrypt(msg.Ciphertext)
+}
+
+// decryptMessage decrypts a raw normal olm message and advances the ratchet. The session state is only
+// modified if the message is decrypted successfully.
+func (s *Session) decryptMessage(raw []byte) ([]byte, error) {
+	msg, signed, mac, err := decodeOlmMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	chainIndex := -1
+	for i, chain := range s.state.ReceiverChains {
+		if bytes.Equal(chain.RatchetKey, msg.RatchetKey) {
+			chainIndex = i
+			break
+		}
+	}
+
+	var chain receiverChain
+	var newRootKey []byte
+	if chainIndex == -1 {
+		// They have started using a new ratchet key, so this message is on a new chain.
+		if len(s.state.SenderChains) == 0 || msg.Counter > maxMessageGap {
+			return nil, BadMessageMAC
+		}
+		var ck chainKey
+		newRootKey, ck = advanceRootKey(s.state.RootKey, s.state.SenderChains[0].RatchetKey, msg.RatchetKey)
+		chain = receiverChain{RatchetKey: msg.RatchetKey, ChainKey: ck}
+	} else {
+		chain = s.state.ReceiverChains[chainIndex]
+		if chain.ChainKey.Index > msg.Counter {
+			// The chain has already advanced past this message, so the key must be in the skipped keys.
+			for i, skipped := range s.state.SkippedMessageKeys {
+				if skipped.MessageKey.Index == msg.Counter && bytes.Equal(skipped.RatchetKey, msg.RatchetKey) {
+					plaintext, err := decryptWithMessageKey(skipped.MessageKey, msg, signed, mac)
+					if err != nil {
+						return nil, err
+					}
+					utils.WipeBytes(skipped.MessageKey.Key)
+					s.state.SkippedMessageKeys = append(s.state.SkippedMessageKeys[:i], s.state.SkippedMessageKeys[i+1:]...)
+					return plaintext, nil
+				}
+			}
+			return nil, BadMessageKeyID
+		} else if msg.Counter-chain.ChainKey.Index > maxMessageGap {
+			return nil, BadMessageMAC
+		}
+	}
+
+	var skipped []skippedMessageKey
+	for chain.ChainKey.Index < msg.Counter {
+		skipped = append(skipped, skippedMessageKey{RatchetKey: chain.RatchetKey, MessageKey: chain.ChainKey.messageKey()})
+		chain.ChainKey = chain.ChainKey.advance()
+	}
+	plaintext, err := decryptWithMessageKey(chain.ChainKey.messageKey(), msg, signed, mac)
+	if err != nil {
+		return nil, err
+	}
+	chain.ChainKey = chain.ChainKey.advance()
+
+	if chainIndex == -1 {
+		utils.WipeBytes(s.state.RootKey)
+		s.state.RootKey = newRootKey
+		// Our current ratchet key is no longer needed, a new one will be generated for the next message we send.
+		s.state.SenderChains[0].RatchetKey.wipe()
+		s.state.SenderChains = nil
+		s.state.ReceiverChains = append([]receiverChain{chain}, s.state.ReceiverChains...)
+		if len(s.state.ReceiverChains) > maxReceiverChains {
+			s.state.ReceiverChains = s.state.ReceiverChains[:maxReceiverChains]
+		}
+	} else {
+		s.state.ReceiverChains[chainIndex] = chain
+	}
+	// Newest skipped keys go first, and the oldest are dropped when there are too many.
+	for _, key := range skipped {
+		s.state.SkippedMessageKeys = append([]skippedMessageKey{key}, s.state.SkippedMessageKeys...)
+	}
+	if len(s.state.SkippedMessageKeys) > maxSkippedMessageKeys {
+		s.state.SkippedMessageKeys = s.state.SkippedMessageKeys[:maxSkippedMessageKeys]
+	}
+	return plaintext, nil
+}
+
+// Decrypt decrypts a message using the Session.  Returns the the plain-text on
+// success.  Returns error on failure.  If the base64 couldn't be decoded then
+// the error will be "INVALID_BASE64".  If the message is for an unsupported
+// version of the protocol then the error will be "BAD_MESSAGE_VERSION".  If
+// the message couldn't be decoded then the error will be BAD_MESSAGE_FORMAT".
+// If the MAC on the message was invalid then the error will be
+// "BAD_MESSAGE_MAC".
+func (s *Session) Decrypt(message string, msgType id.OlmMsgType) ([]byte, error) {
+	if len(message) == 0 {
+		return nil, EmptyInput
+	}
+	raw, err := decodeBase64([]byte(message))
+	if err != nil {
+		return nil, err
+	}
+	switch msgType {
+	case id.OlmMsgTypePreKey:
+		preKeyMsg, err := decodeOlmPreKeyMessage(raw)
+		if err != nil {
+			return nil, err
+		}
+		raw = preKeyMsg.Message
+	case id.OlmMsgTypeMsg:
+	default:
+		return nil, BadMessageFormat
+	}
+	plaintext, err := s.decryptMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	s.state.ReceivedMessage = true
+	return plaintext, nil
+}
+
+// Describe generates a string describing the internal state of an olm session for debugging and logging purposes.
+func (s *Session) Describe() string {
+	var desc strings.Builder
+	if len(s.state.SenderChains) > 0 {
+		_, _ = fmt.Fprintf(&desc, "sender chain index: %d ", s.state.SenderChains[0].ChainKey.Index)
+	}
+	desc.WriteString("receiver chain indices:")
+	for _, chain := range s.state.ReceiverChains {
+		_, _ = fmt.Fprintf(&desc, " %d", chain.ChainKey.Index)
+	}
+	desc.WriteString(" skipped message keys:")
+	for _, key := range s.state.SkippedMessageKeys {
+		_, _ = fmt.Fprintf(&desc, " %d", key.MessageKey.Index)
+	}
+	return desc.String()
+}
@@ -1,3 +1,6 @@
+//go:build !goolm
+// +build !goolm
+
 package olm
 
 // #cgo LDFLAGS: -lolm -lstdc++
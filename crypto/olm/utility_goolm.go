@@ -0,0 +1,76 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+import (
+	"crypto/sha256"
+	"errors"
+
+	"maunium.net/go/mautrix/crypto/signatures"
+	"maunium.net/go/mautrix/id"
+)
+
+// Utility stores the necessary state to perform hash and signature
+// verification operations. The pure-Go implementation is stateless.
+type Utility struct{}
+
+// Clear clears the memory used to back this utility.
+func (u *Utility) Clear() error {
+	return nil
+}
+
+// NewUtility creates a new utility.
+func NewUtility() *Utility {
+	return &Utility{}
+}
+
+// Sha256 calculates the SHA-256 hash of the input and encodes it as base64.
+func (u *Utility) Sha256(input string) string {
+	if len(input) == 0 {
+		panic(EmptyInput)
+	}
+	hash := sha256.Sum256([]byte(input))
+	return string(encodeBase64(hash[:]))
+}
+
+// convertSignatureError converts errors from the signatures package into the errors that libolm would return.
+func convertSignatureError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, signatures.ErrEmptyInput):
+		return EmptyInput
+	case errors.Is(err, signatures.ErrSignatureNotFound):
+		return SignatureNotFound
+	case errors.Is(err, signatures.ErrInvalidKeyLength):
+		return InvalidBase64
+	default:
+		return err
+	}
+}
+
+// VerifySignature verifies an ed25519 signature.  Returns true if the verification
+// suceeds or false otherwise.  Returns error on failure.  If the key was too
+// small then the error will be "INVALID_BASE64".
+func (u *Utility) VerifySignature(message string, key id.Ed25519, signature string) (ok bool, err error) {
+	ok, err = signatures.VerifySignature([]byte(message), key, signature)
+	return ok, convertSignatureError(err)
+}
+
+// VerifySignatureJSON verifies the signature in the JSON object _obj following
+// the Matrix specification:
+// https://matrix.org/speculator/spec/drafts%2Fe2e/appendices.html#signing-json
+// If the _obj is a struct, the `json` tags will be honored.
+func (u *Utility) VerifySignatureJSON(obj interface{}, userID id.UserID, keyName string, key id.Ed25519) (bool, error) {
+	ok, err := signatures.VerifySignatureJSON(obj, userID, keyName, key)
+	return ok, convertSignatureError(err)
+}
+
+// VerifySignatureJSON verifies the signature in the JSON object _obj following
+// the Matrix specification:
+// https://matrix.org/speculator/spec/drafts%2Fe2e/appendices.html#signing-json
+// If the _obj is a struct, the `json` tags will be honored.
+func VerifySignatureJSON(obj interface{}, userID id.UserID, keyName string, key id.Ed25519) (bool, error) {
+	return NewUtility().VerifySignatureJSON(obj, userID, keyName, key)
+}
@@ -1,5 +1,5 @@
-//go:build !nosas
-// +build !nosas
+//go:build !nosas && !goolm
+// +build !nosas,!goolm
 
 package olm
 
@@ -9,8 +9,9 @@ package olm
 import "C"
 
 import (
-	"crypto/rand"
 	"unsafe"
+
+	"maunium.net/go/mautrix/crypto/utils"
 )
 
 // SAS stores an Olm Short Authentication String (SAS) object.
@@ -42,7 +43,7 @@ func (sas *SAS) sasRandomLength() uint {
 func NewSAS() *SAS {
 	sas := NewBlankSAS()
 	random := make([]byte, sas.sasRandomLength()+1)
-	_, err := rand.Read(random)
+	_, err := utils.ReadRandom(random)
 	if err != nil {
 		panic(NotEnoughGoRandom)
 	}
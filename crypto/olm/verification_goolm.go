@@ -0,0 +1,122 @@
+//go:build !nosas && goolm
+// +build !nosas,goolm
+
+package olm
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+
+	"maunium.net/go/mautrix/crypto/utils"
+)
+
+// SAS stores an Olm Short Authentication String (SAS) object.
+type SAS struct {
+	keyPair     curve25519KeyPair
+	secret      []byte
+	theirKeySet bool
+}
+
+// NewBlankSAS initializes an empty SAS object.
+func NewBlankSAS() *SAS {
+	return &SAS{}
+}
+
+// NewSAS creates a new SAS object.
+func NewSAS() *SAS {
+	return &SAS{keyPair: newCurve25519KeyPair()}
+}
+
+// clear clears the memory used to back an SAS object.
+func (sas *SAS) clear() uint {
+	sas.keyPair.wipe()
+	utils.WipeBytes(sas.secret)
+	*sas = SAS{}
+	return 0
+}
+
+// GetPubkey gets the public key for the SAS object.
+func (sas *SAS) GetPubkey() []byte {
+	return encodeBase64(sas.keyPair.Public)
+}
+
+// SetTheirKey sets the public key of the other user.
+func (sas *SAS) SetTheirKey(theirKey []byte) error {
+	decoded, err := decodeCurve25519Key(string(theirKey))
+	if err != nil {
+		return err
+	}
+	sas.secret = sas.keyPair.sharedSecret(decoded)
+	sas.theirKeySet = true
+	return nil
+}
+
+// GenerateBytes generates bytes to use for the short authentication string.
+func (sas *SAS) GenerateBytes(info []byte, count uint) ([]byte, error) {
+	if !sas.theirKeySet {
+		return nil, SASTheirKeyNotSet
+	}
+	output := make([]byte, count)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, sas.secret, nil, info), output); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// CalculateMAC generates a message authentication code (MAC) based on the shared secret.
+//
+// Like olm_sas_calculate_mac in libolm, this encodes the MAC with the buggy in-place base64 encoding
+// that the hkdf-hmac-sha256 MAC method requires.
+func (sas *SAS) CalculateMAC(input []byte, info []byte) ([]byte, error) {
+	key, err := sas.GenerateBytes(info, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.WipeBytes(key)
+	h := hmac.New(sha256.New, key)
+	h.Write(input)
+	mac := make([]byte, unpaddedBase64.EncodedLen(sha256.Size))
+	copy(mac, h.Sum(nil))
+	encodeBase64InPlace(mac, sha256.Size)
+	return mac, nil
+}
+
+const base64Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// encodeBase64InPlace is a port of libolm's base64 encoder, which produces different output
+// when the input and output buffers overlap, as they do in olm_sas_calculate_mac.
+func encodeBase64InPlace(buf []byte, inputLength int) {
+	end := (inputLength / 3) * 3
+	pos, out := 0, 0
+	for pos != end {
+		value := uint(buf[pos])<<16 | uint(buf[pos+1])<<8 | uint(buf[pos+2])
+		pos += 3
+		buf[out+3] = base64Alphabet[value&0x3F]
+		value >>= 6
+		buf[out+2] = base64Alphabet[value&0x3F]
+		value >>= 6
+		buf[out+1] = base64Alphabet[value&0x3F]
+		value >>= 6
+		buf[out] = base64Alphabet[value]
+		out += 4
+	}
+	remainder := inputLength - pos
+	if remainder > 0 {
+		value := uint(buf[pos])
+		if remainder == 2 {
+			value <<= 8
+			value |= uint(buf[pos+1])
+			value <<= 2
+			buf[out+2] = base64Alphabet[value&0x3F]
+			value >>= 6
+		} else {
+			value <<= 4
+		}
+		buf[out+1] = base64Alphabet[value&0x3F]
+		value >>= 6
+		buf[out] = base64Alphabet[value]
+	}
+}
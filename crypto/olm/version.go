@@ -0,0 +1,22 @@
+//go:build !goolm
+// +build !goolm
+
+package olm
+
+// #cgo LDFLAGS: -lolm -lstdc++
+// #include <olm/olm.h>
+import "C"
+
+// Version returns the version number of the olm library.
+func Version() (major, minor, patch uint8) {
+	C.olm_get_library_version(
+		(*C.uint8_t)(&major),
+		(*C.uint8_t)(&minor),
+		(*C.uint8_t)(&patch))
+	return
+}
+
+// errorVal returns the value that olm functions return if there was an error.
+func errorVal() C.size_t {
+	return C.olm_error()
+}
@@ -0,0 +1,9 @@
+//go:build goolm
+// +build goolm
+
+package olm
+
+// Version returns the version number of the libolm release that the pure-Go implementation is compatible with.
+func Version() (major, minor, patch uint8) {
+	return 3, 2, 8
+}
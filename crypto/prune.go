@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"fmt"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// PruneOptions specifies what OlmMachine.Prune should remove from the crypto store.
+type PruneOptions struct {
+	// MaxOlmSessionsPerDevice is the number of most recently used Olm sessions to keep for each device.
+	// Zero means Olm sessions are not pruned.
+	MaxOlmSessionsPerDevice int
+	// RemoveExpiredOutboundGroupSessions specifies whether outbound group sessions that have expired according
+	// to their rotation policy should be removed.
+	RemoveExpiredOutboundGroupSessions bool
+	// KeepGroupSessionsForRoom is called for each room that has inbound group sessions. If it returns false, all
+	// inbound group sessions of the room are removed. If nil, inbound group sessions are not pruned.
+	KeepGroupSessionsForRoom func(id.RoomID) bool
+}
+
+// DefaultPruneOptions are reasonable defaults for OlmMachine.Prune, which don't remove any inbound group sessions.
+var DefaultPruneOptions = PruneOptions{
+	MaxOlmSessionsPerDevice:            5,
+	RemoveExpiredOutboundGroupSessions: true,
+}
+
+// PruneResult contains the number of items removed by OlmMachine.Prune.
+type PruneResult struct {
+	OlmSessions           int64
+	OutboundGroupSessions int64
+	InboundGroupSessions  int64
+}
+
+// Prune removes stale sessions from the crypto store according to the given options.
+//
+// This should be called periodically by long-running clients, as otherwise the store will grow indefinitely.
+func (mach *OlmMachine) Prune(opts PruneOptions) (result PruneResult, err error) {
+	if opts.MaxOlmSessionsPerDevice > 0 {
+		mach.olmLock.Lock()
+		result.OlmSessions, err = mach.CryptoStore.PruneOlmSessions(opts.MaxOlmSessionsPerDevice)
+		mach.olmLock.Unlock()
+		if err != nil {
+			return result, fmt.Errorf("failed to prune olm sessions: %w", err)
+		}
+	}
+	if opts.RemoveExpiredOutboundGroupSessions {
+		result.OutboundGroupSessions, err = mach.CryptoStore.RemoveExpiredOutboundGroupSessions()
+		if err != nil {
+			return result, fmt.Errorf("failed to remove expired outbound group sessions: %w", err)
+		}
+	}
+	if opts.KeepGroupSessionsForRoom != nil {
+		var rooms []id.RoomID
+		rooms, err = mach.CryptoStore.GetGroupSessionRooms()
+		if err != nil {
+			return result, fmt.Errorf("failed to get rooms with inbound group sessions: %w", err)
+		}
+		for _, roomID := range rooms {
+			if opts.KeepGroupSessionsForRoom(roomID) {
+				continue
+			}
+			var count int64
+			count, err = mach.CryptoStore.RemoveGroupSessionsForRoom(roomID)
+			if mach.groupSessionCache != nil {
+				mach.groupSessionCache.removeRoom(roomID)
+			}
+			if err != nil {
+				return result, fmt.Errorf("failed to remove inbound group sessions in %s: %w", roomID, err)
+			}
+			result.InboundGroupSessions += count
+		}
+	}
+	mach.Log.Debug("Pruned %d olm sessions, %d outbound group sessions and %d inbound group sessions",
+		result.OlmSessions, result.OutboundGroupSessions, result.InboundGroupSessions)
+	return
+}
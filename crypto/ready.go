@@ -0,0 +1,160 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// WaitUntilReady prepares the machine for sending and receiving encrypted messages right after logging in, so that
+// the first encrypted send doesn't race against the initial key upload. It blocks until:
+//
+//   - the device keys have been uploaded,
+//   - the one-time keys on the server have been replenished,
+//   - the device lists of the members of all joined encrypted rooms (and our own devices) have been loaded,
+//   - our own cross-signing public keys have been fetched (if the account has cross-signing set up).
+//
+// The state store is usually empty right after logging in, so rooms that it doesn't know to be encrypted are checked
+// on the server. The room members are fetched from the state store if it implements RoomMemberStateStore and has
+// the members of the room, or from the server otherwise. Calling this again later is cheap, as only missing or
+// outdated device lists are fetched.
+func (mach *OlmMachine) WaitUntilReady(ctx context.Context) error {
+	err := mach.ensureKeysUploaded()
+	if err != nil {
+		return fmt.Errorf("failed to upload keys: %w", err)
+	} else if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	users, err := mach.getEncryptedRoomMembers(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get members of encrypted rooms: %w", err)
+	}
+	err = mach.loadMissingDeviceLists(append(users, mach.Client.UserID))
+	if err != nil {
+		return fmt.Errorf("failed to load device lists: %w", err)
+	}
+	if mach.GetOwnCrossSigningPublicKeys() == nil {
+		// Our own device list may have been in the store already, so the cross-signing keys might not have been
+		// fetched above.
+		if _, err = mach.queryKeys([]id.UserID{mach.Client.UserID}, "", true); err != nil {
+			return fmt.Errorf("failed to fetch own cross-signing keys: %w", err)
+		} else if mach.GetOwnCrossSigningPublicKeys() == nil {
+			mach.Log.Debug("Own cross-signing keys not found, cross-signing is probably not set up")
+		}
+	}
+	mach.Log.Debug("End-to-end encryption is ready")
+	return nil
+}
+
+// ensureKeysUploaded uploads the device keys if they haven't been uploaded yet and tops up the one-time keys
+// if the server has less than half of the maximum number.
+func (mach *OlmMachine) ensureKeysUploaded() error {
+	if !mach.isAccountShared() {
+		mach.Log.Debug("Uploading initial device keys and one-time keys")
+		return mach.ShareKeys(0)
+	}
+	// An upload without any keys can be used to get the current one-time key count.
+	resp, err := mach.Client.UploadKeys(&mautrix.ReqUploadKeys{OneTimeKeys: map[id.KeyID]mautrix.OneTimeKey{}})
+	if err != nil {
+		return err
+	}
+	currentCount := resp.OneTimeKeyCounts.SignedCurve25519
+	if currentCount >= int(mach.getAccount().Internal.MaxNumberOfOneTimeKeys()/2) {
+		return nil
+	}
+	mach.Log.Debug("Server has %d signed curve25519 keys left, uploading more", currentCount)
+	return mach.ShareKeys(currentCount)
+}
+
+func (mach *OlmMachine) getEncryptedRoomMembers(ctx context.Context) ([]id.UserID, error) {
+	rooms, err := mach.Client.JoinedRooms()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get joined rooms: %w", err)
+	}
+	memberStore, hasMemberStore := mach.StateStore.(RoomMemberStateStore)
+	userMap := make(map[id.UserID]struct{})
+	for _, roomID := range rooms.JoinedRooms {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		knownEncrypted := mach.StateStore.IsEncrypted(roomID)
+		if !knownEncrypted {
+			encrypted, err := mach.isEncryptedOnServer(roomID)
+			if err != nil {
+				return nil, err
+			} else if !encrypted {
+				continue
+			}
+		}
+		var members []id.UserID
+		if hasMemberStore && knownEncrypted {
+			members, err = memberStore.GetRoomJoinedOrInvitedMembers(roomID)
+		}
+		if err == nil && len(members) == 0 {
+			members, err = mach.getJoinedMembersFromServer(roomID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get members of %s: %w", roomID, err)
+		}
+		for _, userID := range members {
+			userMap[userID] = struct{}{}
+		}
+	}
+	users := make([]id.UserID, 0, len(userMap))
+	for userID := range userMap {
+		users = append(users, userID)
+	}
+	return users, nil
+}
+
+// isEncryptedOnServer checks whether a room has an encryption event on the server. It's used for rooms that the state
+// store doesn't know to be encrypted, as the state store may not have received the state of the room yet.
+func (mach *OlmMachine) isEncryptedOnServer(roomID id.RoomID) (bool, error) {
+	var content event.EncryptionEventContent
+	err := mach.Client.StateEvent(roomID, event.StateEncryption, "", &content)
+	if errors.Is(err, mautrix.MNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to get encryption event of %s: %w", roomID, err)
+	}
+	return len(content.Algorithm) > 0, nil
+}
+
+func (mach *OlmMachine) getJoinedMembersFromServer(roomID id.RoomID) ([]id.UserID, error) {
+	resp, err := mach.Client.JoinedMembers(roomID)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]id.UserID, 0, len(resp.Joined))
+	for userID := range resp.Joined {
+		members = append(members, userID)
+	}
+	return members, nil
+}
+
+// loadMissingDeviceLists fetches the device lists of the given users that haven't been fetched yet, as well as all
+// outdated device lists, in a single request.
+func (mach *OlmMachine) loadMissingDeviceLists(users []id.UserID) error {
+	mach.deviceListLock.Lock()
+	defer mach.deviceListLock.Unlock()
+	var missing []id.UserID
+	for _, userID := range users {
+		devices, err := mach.CryptoStore.GetDevices(userID)
+		if err != nil {
+			return fmt.Errorf("failed to get devices of %s from store: %w", userID, err)
+		} else if devices == nil {
+			missing = append(missing, userID)
+		}
+	}
+	return mach.resyncOutdatedDeviceListsLocked(true, missing)
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestOlmMachineWaitUntilReady(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	otherMachine, otherStoreFileName := newMachine(t, "user2")
+	defer os.Remove(otherStoreFileName)
+	otherKeys := otherMachine.account.getInitialKeys("user2", "device1", otherMachine.KeyProvider)
+
+	var lock sync.Mutex
+	var ownKeys *mautrix.DeviceKeys
+	otkCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/keys/upload"):
+			var req mautrix.ReqUploadKeys
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			if req.DeviceKeys != nil {
+				ownKeys = req.DeviceKeys
+			}
+			otkCount += len(req.OneTimeKeys)
+			_ = json.NewEncoder(w).Encode(&mautrix.RespUploadKeys{OneTimeKeyCounts: mautrix.OTKCount{SignedCurve25519: otkCount}})
+		case strings.HasSuffix(r.URL.Path, "/joined_rooms"):
+			_ = json.NewEncoder(w).Encode(&mautrix.RespJoinedRooms{JoinedRooms: []id.RoomID{"room1"}})
+		case strings.HasSuffix(r.URL.Path, "/keys/query"):
+			resp := &mautrix.RespQueryKeys{DeviceKeys: map[id.UserID]map[id.DeviceID]mautrix.DeviceKeys{
+				"user2": {"device1": *otherKeys},
+			}}
+			if ownKeys != nil {
+				resp.DeviceKeys["user1"] = map[id.DeviceID]mautrix.DeviceKeys{"device1": *ownKeys}
+			}
+			_ = json.NewEncoder(w).Encode(resp)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "not found"}`))
+		}
+	}))
+	defer server.Close()
+	machine.Client.HomeserverURL, _ = url.Parse(server.URL)
+
+	if err := machine.WaitUntilReady(context.Background()); err != nil {
+		t.Fatalf("Failed to wait until ready: %v", err)
+	}
+	maxOTKs := int(machine.account.Internal.MaxNumberOfOneTimeKeys())
+	lock.Lock()
+	if ownKeys == nil || otkCount != maxOTKs/2 {
+		t.Errorf("Expected device keys and %d one-time keys to be uploaded, got %v and %d", maxOTKs/2, ownKeys != nil, otkCount)
+	}
+	lock.Unlock()
+	if devices, _ := machine.CryptoStore.GetDevices("user2"); len(devices) != 1 {
+		t.Errorf("Expected device list of room member to be loaded, got %d devices", len(devices))
+	}
+	if devices, _ := machine.CryptoStore.GetDevices("user1"); len(devices) != 1 {
+		t.Errorf("Expected own device list to be loaded, got %d devices", len(devices))
+	}
+
+	// One-time keys are replenished if the server is running low.
+	lock.Lock()
+	otkCount = 0
+	lock.Unlock()
+	if err := machine.WaitUntilReady(context.Background()); err != nil {
+		t.Fatalf("Failed to wait until ready: %v", err)
+	}
+	lock.Lock()
+	if otkCount != maxOTKs/2 {
+		t.Errorf("Expected one-time keys to be replenished to %d, got %d", maxOTKs/2, otkCount)
+	}
+	lock.Unlock()
+}
+
+type emptyStateStore struct {
+	mockStateStore
+}
+
+func (emptyStateStore) IsEncrypted(id.RoomID) bool {
+	return false
+}
+
+func (emptyStateStore) GetRoomJoinedOrInvitedMembers(id.RoomID) ([]id.UserID, error) {
+	return nil, nil
+}
+
+func TestOlmMachineWaitUntilReadyEmptyStateStore(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	machine.StateStore = emptyStateStore{}
+	otherMachine, otherStoreFileName := newMachine(t, "user2")
+	defer os.Remove(otherStoreFileName)
+	otherKeys := otherMachine.account.getInitialKeys("user2", "device1", otherMachine.KeyProvider)
+	// Our own device list is already known, so the cross-signing keys have to be fetched separately.
+	if err := machine.CryptoStore.PutDevices("user1", map[id.DeviceID]*DeviceIdentity{"device1": machine.OwnIdentity()}); err != nil {
+		t.Fatalf("Failed to store own device: %v", err)
+	}
+	masterKey := id.Ed25519("ed25519masterkey")
+
+	var lock sync.Mutex
+	var memberRequests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/keys/upload"):
+			_ = json.NewEncoder(w).Encode(&mautrix.RespUploadKeys{OneTimeKeyCounts: mautrix.OTKCount{SignedCurve25519: 50}})
+		case strings.HasSuffix(r.URL.Path, "/joined_rooms"):
+			_ = json.NewEncoder(w).Encode(&mautrix.RespJoinedRooms{JoinedRooms: []id.RoomID{"room1", "room2"}})
+		case strings.Contains(r.URL.Path, "/rooms/room1/state/m.room.encryption"):
+			_, _ = w.Write([]byte(`{"algorithm": "m.megolm.v1.aes-sha2"}`))
+		case strings.HasSuffix(r.URL.Path, "/joined_members"):
+			memberRequests = append(memberRequests, r.URL.Path)
+			_, _ = w.Write([]byte(`{"joined": {"user1": {}, "user2": {}}}`))
+		case strings.HasSuffix(r.URL.Path, "/keys/query"):
+			var req mautrix.ReqQueryKeys
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			resp := &mautrix.RespQueryKeys{DeviceKeys: map[id.UserID]map[id.DeviceID]mautrix.DeviceKeys{}}
+			if _, ok := req.DeviceKeys["user2"]; ok {
+				resp.DeviceKeys["user2"] = map[id.DeviceID]mautrix.DeviceKeys{"device1": *otherKeys}
+			}
+			if _, ok := req.DeviceKeys["user1"]; ok {
+				resp.MasterKeys = map[id.UserID]mautrix.CrossSigningKeys{"user1": {
+					UserID: "user1",
+					Usage:  []id.CrossSigningUsage{id.XSUsageMaster},
+					Keys:   map[id.KeyID]id.Ed25519{id.NewKeyID(id.KeyAlgorithmEd25519, masterKey.String()): masterKey},
+				}}
+			}
+			_ = json.NewEncoder(w).Encode(resp)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "not found"}`))
+		}
+	}))
+	defer server.Close()
+	machine.Client.HomeserverURL, _ = url.Parse(server.URL)
+	machine.account.Shared = true
+
+	if err := machine.WaitUntilReady(context.Background()); err != nil {
+		t.Fatalf("Failed to wait until ready: %v", err)
+	}
+	lock.Lock()
+	if len(memberRequests) != 1 || !strings.Contains(memberRequests[0], "/rooms/room1/") {
+		t.Errorf("Expected members of only the encrypted room to be fetched, got %v", memberRequests)
+	}
+	lock.Unlock()
+	if devices, _ := machine.CryptoStore.GetDevices("user2"); len(devices) != 1 {
+		t.Errorf("Expected device list of room member to be loaded, got %d devices", len(devices))
+	}
+	if keys := machine.GetOwnCrossSigningPublicKeys(); keys == nil || keys.MasterKey != masterKey {
+		t.Errorf("Expected own cross-signing keys to be fetched, got %+v", keys)
+	}
+}
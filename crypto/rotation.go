@@ -0,0 +1,100 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// RotationPolicy determines when outbound megolm sessions are rotated.
+type RotationPolicy struct {
+	// MaxMessages is the number of messages after which the session is rotated. Zero means no limit.
+	MaxMessages int
+	// MaxAge is the time after which the session is rotated. Zero means no limit.
+	MaxAge time.Duration
+	// RotateOnMembershipChange specifies whether the session should be discarded when the membership of the room
+	// changes. If false, the existing session is reused and only shared with the devices that don't have it yet.
+	RotateOnMembershipChange bool
+	// RotateOnNewDevice specifies whether the session should be discarded when a user in the room adds a new device.
+	// If false, the existing session is shared with the new device from its current message index, which means the
+	// new device can't decrypt any messages that were sent before it appeared. Removed devices always cause rotation.
+	RotateOnNewDevice bool
+}
+
+// DefaultRotationPolicy is the rotation policy used by default for rooms that don't specify any rotation period in
+// their m.room.encryption event.
+var DefaultRotationPolicy = RotationPolicy{
+	MaxMessages:              100,
+	MaxAge:                   7 * 24 * time.Hour,
+	RotateOnMembershipChange: true,
+}
+
+// WithEncryptionEvent returns a copy of the policy with the rotation periods from the given encryption event applied.
+func (policy RotationPolicy) WithEncryptionEvent(content *event.EncryptionEventContent) RotationPolicy {
+	if content != nil {
+		if content.RotationPeriodMillis != 0 {
+			policy.MaxAge = time.Duration(content.RotationPeriodMillis) * time.Millisecond
+		}
+		if content.RotationPeriodMessages != 0 {
+			policy.MaxMessages = content.RotationPeriodMessages
+		}
+	}
+	return policy
+}
+
+// Apply sets the expiration parameters of the given outbound group session according to this policy.
+func (policy RotationPolicy) Apply(ogs *OutboundGroupSession) {
+	ogs.MaxMessages = policy.MaxMessages
+	ogs.MaxAge = policy.MaxAge
+}
+
+// SetRotationPolicy overrides the rotation policy for the given room. The override takes precedence over both
+// OlmMachine.DefaultRotationPolicy and the rotation periods in the room's encryption event.
+// Passing nil removes the override.
+//
+// The policy is applied to sessions created after the call, so the current outbound session should be discarded
+// with CryptoStore.RemoveOutboundGroupSession if it should follow the new policy immediately.
+func (mach *OlmMachine) SetRotationPolicy(roomID id.RoomID, policy *RotationPolicy) {
+	mach.rotationPoliciesLock.Lock()
+	if policy == nil {
+		delete(mach.rotationPolicies, roomID)
+	} else {
+		mach.rotationPolicies[roomID] = *policy
+	}
+	mach.rotationPoliciesLock.Unlock()
+}
+
+// GetRotationPolicy returns the rotation policy that applies to the given room.
+//
+// If an override has been set with SetRotationPolicy, it's returned as-is. Otherwise the rotation periods in the
+// room's encryption event are applied on top of OlmMachine.DefaultRotationPolicy.
+func (mach *OlmMachine) GetRotationPolicy(roomID id.RoomID) RotationPolicy {
+	mach.rotationPoliciesLock.RLock()
+	policy, ok := mach.rotationPolicies[roomID]
+	mach.rotationPoliciesLock.RUnlock()
+	if ok {
+		return policy
+	}
+	return mach.DefaultRotationPolicy.WithEncryptionEvent(mach.StateStore.GetEncryptionEvent(roomID))
+}
+
+// invalidateGroupSession discards the outbound group session in the given room if rotate is true. Otherwise the
+// session is just marked as not shared so that it's shared with any new devices before the next message is sent.
+func (mach *OlmMachine) invalidateGroupSession(roomID id.RoomID, rotate bool) error {
+	if rotate {
+		return mach.CryptoStore.RemoveOutboundGroupSession(roomID)
+	}
+	session, err := mach.CryptoStore.GetOutboundGroupSession(roomID)
+	if err != nil || session == nil || !session.Shared {
+		return err
+	}
+	session.Shared = false
+	return mach.CryptoStore.AddOutboundGroupSession(session)
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrSecretRequestCancelled = errors.New("secret request was cancelled")
+	ErrMismatchingSecretKey   = errors.New("received secret doesn't match the published public key")
+)
+
+// SecretRequestHandler decides whether a secret requested by the given device should be shared with it.
+type SecretRequestHandler func(device *DeviceIdentity, secret id.Secret) bool
+
+// SecretShareNever is a SecretRequestHandler that rejects all secret requests.
+func SecretShareNever(_ *DeviceIdentity, _ id.Secret) bool {
+	return false
+}
+
+// SecretShareOwnVerifiedDevices is the default SecretRequestHandler. It only shares secrets with the user's own
+// devices that are trusted, i.e. verified or cross-signed. Unlike room keys, secrets are never shared with unverified
+// devices, even if ShareKeysToUnverifiedDevices is true.
+func (mach *OlmMachine) SecretShareOwnVerifiedDevices(device *DeviceIdentity, secret id.Secret) bool {
+	if mach.Client.UserID != device.UserID {
+		mach.Log.Debug("Ignoring %s secret request from a different user (%s)", secret, device.UserID)
+		return false
+	} else if mach.Client.DeviceID == device.DeviceID {
+		mach.Log.Debug("Ignoring %s secret request from ourselves", secret)
+		return false
+	} else if !mach.IsDeviceTrusted(device) {
+		mach.Log.Debug("Ignoring %s secret request from untrusted device %s", secret, device.DeviceID)
+		return false
+	}
+	mach.Log.Debug("Accepting %s secret request from verified device %s", secret, device.DeviceID)
+	return true
+}
+
+type outgoingSecretRequest struct {
+	name     id.Secret
+	response chan string
+}
+
+// getSecret returns the value of a secret that this device knows in the format used by m.secret.send,
+// or an empty string if the secret isn't known.
+func (mach *OlmMachine) getSecret(name id.Secret) string {
+	if name == id.SecretMegolmBackupV1 {
+		if kb := mach.getKeyBackup(); kb != nil && kb.key != nil {
+			return utils.EncodeUnpaddedBase64(kb.key.Bytes())
+		}
+		return ""
+	}
+	keys := mach.CrossSigningKeys
+	if keys == nil {
+		return ""
+	}
+	switch name {
+	case id.SecretXSMaster:
+		return utils.EncodeUnpaddedBase64(keys.MasterKey.Seed)
+	case id.SecretXSSelfSigning:
+		return utils.EncodeUnpaddedBase64(keys.SelfSigningKey.Seed)
+	case id.SecretXSUserSigning:
+		return utils.EncodeUnpaddedBase64(keys.UserSigningKey.Seed)
+	default:
+		return ""
+	}
+}
+
+// RequestSecret requests the given secret from all of the user's other devices and waits for one of them to
+// respond. Only responses from trusted devices are accepted. After a response is received or the context is
+// cancelled, a cancellation is sent to the other devices.
+func (mach *OlmMachine) RequestSecret(ctx context.Context, name id.Secret) (string, error) {
+	requestID := mach.Client.TxnID()
+	req := &outgoingSecretRequest{
+		name:     name,
+		response: make(chan string, 1),
+	}
+	mach.secretRequestsLock.Lock()
+	mach.secretRequests[requestID] = req
+	mach.secretRequestsLock.Unlock()
+	defer func() {
+		mach.secretRequestsLock.Lock()
+		delete(mach.secretRequests, requestID)
+		mach.secretRequestsLock.Unlock()
+		err := mach.sendSecretRequest(event.SecretRequestCancellation, "", requestID)
+		if err != nil {
+			mach.Log.Warn("Failed to send cancellation for secret request %s: %v", requestID, err)
+		}
+	}()
+
+	err := mach.sendSecretRequest(event.SecretRequestRequest, name, requestID)
+	if err != nil {
+		return "", fmt.Errorf("failed to send secret request: %w", err)
+	}
+	mach.Log.Debug("Sent secret request %s for %s, waiting for response", requestID, name)
+	select {
+	case secret := <-req.response:
+		return secret, nil
+	case <-ctx.Done():
+		return "", fmt.Errorf("%w: %v", ErrSecretRequestCancelled, ctx.Err())
+	}
+}
+
+func (mach *OlmMachine) sendSecretRequest(action event.SecretRequestAction, name id.Secret, requestID string) error {
+	_, err := mach.Client.SendToDevice(event.ToDeviceSecretRequest, &mautrix.ReqSendToDevice{
+		Messages: map[id.UserID]map[id.DeviceID]*event.Content{
+			mach.Client.UserID: {
+				"*": {Parsed: &event.SecretRequestEventContent{
+					Name:               name,
+					Action:             action,
+					RequestingDeviceID: mach.Client.DeviceID,
+					RequestID:          requestID,
+				}},
+			},
+		},
+	})
+	return err
+}
+
+// RequestCrossSigningKeys requests the private cross-signing keys from the user's other devices, checks that they
+// match the published public keys and stores them in the olm machine.
+func (mach *OlmMachine) RequestCrossSigningKeys(ctx context.Context) error {
+	publicKeys, err := mach.CryptoStore.GetCrossSigningKeys(mach.Client.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to get own cross-signing public keys: %w", err)
+	}
+	var seeds CrossSigningSeeds
+	for _, secret := range []struct {
+		name  id.Secret
+		usage id.CrossSigningUsage
+		seed  *[]byte
+	}{
+		{id.SecretXSMaster, id.XSUsageMaster, &seeds.MasterKey},
+		{id.SecretXSSelfSigning, id.XSUsageSelfSigning, &seeds.SelfSigningKey},
+		{id.SecretXSUserSigning, id.XSUsageUserSigning, &seeds.UserSigningKey},
+	} {
+		value, err := mach.RequestSecret(ctx, secret.name)
+		if err != nil {
+			return fmt.Errorf("failed to request %s: %w", secret.name, err)
+		}
+		*secret.seed, err = utils.DecodeUnpaddedBase64(value)
+		if err != nil {
+			return fmt.Errorf("failed to decode %s: %w", secret.name, err)
+		}
+		if expected, ok := publicKeys[secret.usage]; ok {
+			key, err := olm.NewPkSigningFromSeed(*secret.seed)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", secret.name, err)
+			} else if key.PublicKey != expected {
+				return fmt.Errorf("%w: %s key is %s, expected %s", ErrMismatchingSecretKey, secret.usage, key.PublicKey, expected)
+			}
+		}
+	}
+	return mach.ImportCrossSigningKeys(seeds)
+}
+
+func (mach *OlmMachine) handleSecretRequest(sender id.UserID, content *event.SecretRequestEventContent) {
+	if content.Action != event.SecretRequestRequest {
+		return
+	} else if sender != mach.Client.UserID {
+		mach.Log.Debug("Ignoring secret request %s from a different user (%s)", content.RequestID, sender)
+		return
+	} else if content.RequestingDeviceID == mach.Client.DeviceID {
+		return
+	}
+	mach.Log.Debug("Received secret request %s for %s from %s/%s", content.RequestID, content.Name, sender, content.RequestingDeviceID)
+
+	device, err := mach.GetOrFetchDevice(sender, content.RequestingDeviceID)
+	if err != nil {
+		mach.Log.Error("Failed to fetch device %s/%s that requested secret: %v", sender, content.RequestingDeviceID, err)
+		return
+	} else if !mach.AllowSecretShare(device, content.Name) {
+		return
+	}
+	secret := mach.getSecret(content.Name)
+	if len(secret) == 0 {
+		mach.Log.Debug("Can't respond to secret request %s: %s is not known", content.RequestID, content.Name)
+		return
+	}
+	err = mach.SendEncryptedToDevice(device, event.ToDeviceSecretSend, event.Content{
+		Parsed: &event.SecretSendEventContent{
+			RequestID: content.RequestID,
+			Secret:    secret,
+		},
+	})
+	if err != nil {
+		mach.Log.Error("Failed to send secret %s to %s/%s: %v", content.Name, device.UserID, device.DeviceID, err)
+	} else {
+		mach.Log.Debug("Sent secret %s to %s/%s", content.Name, device.UserID, device.DeviceID)
+	}
+}
+
+func (mach *OlmMachine) receiveSecret(evt *DecryptedOlmEvent, content *event.SecretSendEventContent) {
+	mach.secretRequestsLock.Lock()
+	req, ok := mach.secretRequests[content.RequestID]
+	mach.secretRequestsLock.Unlock()
+	if !ok {
+		mach.Log.Debug("Ignoring secret from %s/%s for unknown request %s", evt.Sender, evt.SenderDevice, content.RequestID)
+		return
+	} else if evt.Sender != mach.Client.UserID {
+		mach.Log.Warn("Ignoring secret %s from a different user (%s)", req.name, evt.Sender)
+		return
+	}
+	device, err := mach.CryptoStore.FindDeviceByKey(evt.Sender, evt.SenderKey)
+	if err != nil {
+		mach.Log.Error("Failed to find device that sent secret %s: %v", req.name, err)
+		return
+	} else if device == nil || !mach.IsDeviceTrusted(device) {
+		mach.Log.Warn("Ignoring secret %s from untrusted device %s/%s", req.name, evt.Sender, evt.SenderDevice)
+		return
+	}
+	mach.Log.Debug("Received secret %s from %s/%s", req.name, evt.Sender, device.DeviceID)
+	select {
+	case req.response <- content.Secret:
+	default:
+	}
+}
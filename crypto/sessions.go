@@ -8,6 +8,7 @@ package crypto
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	"maunium.net/go/mautrix/crypto/olm"
@@ -97,8 +98,15 @@ type InboundGroupSession struct {
 	RoomID     id.RoomID
 
 	ForwardingChains []string
+	KeySource        event.KeySource
+	// KeyBackupVersion is the server-side key backup version that the session has been uploaded to,
+	// or an empty string if it hasn't been backed up.
+	KeyBackupVersion string
 
 	id id.SessionID
+	// decryptLock is held while decrypting, as decryption advances the ratchet stored in the session and the same
+	// session object may be used from multiple goroutines (e.g. when it's in the group session cache).
+	decryptLock sync.Mutex
 }
 
 func NewInboundGroupSession(senderKey id.SenderKey, signingKey id.Ed25519, roomID id.RoomID, sessionKey string) (*InboundGroupSession, error) {
@@ -112,6 +120,7 @@ func NewInboundGroupSession(senderKey id.SenderKey, signingKey id.Ed25519, roomI
 		SenderKey:        senderKey,
 		RoomID:           roomID,
 		ForwardingChains: nil,
+		KeySource:        event.KeySourceDirect,
 	}, nil
 }
 
@@ -122,6 +131,12 @@ func (igs *InboundGroupSession) ID() id.SessionID {
 	return igs.id
 }
 
+func (igs *InboundGroupSession) decrypt(ciphertext []byte) ([]byte, uint, error) {
+	igs.decryptLock.Lock()
+	defer igs.decryptLock.Unlock()
+	return igs.Internal.Decrypt(ciphertext)
+}
+
 type OGSState int
 
 const (
@@ -150,6 +165,8 @@ type OutboundGroupSession struct {
 	content *event.RoomKeyEventContent
 }
 
+// NewOutboundGroupSession creates a new outbound group session for the given room.
+// The expiration parameters are set based on DefaultRotationPolicy and the given encryption event.
 func NewOutboundGroupSession(roomID id.RoomID, encryptionContent *event.EncryptionEventContent) *OutboundGroupSession {
 	ogs := &OutboundGroupSession{
 		Internal: *olm.NewOutboundGroupSession(),
@@ -158,21 +175,12 @@ func NewOutboundGroupSession(roomID id.RoomID, encryptionContent *event.Encrypti
 				CreationTime:      time.Now(),
 				LastEncryptedTime: time.Now(),
 			},
-			MaxAge: 7 * 24 * time.Hour,
 		},
-		MaxMessages: 100,
-		Shared:      false,
-		Users:       make(map[UserDevice]OGSState),
-		RoomID:      roomID,
-	}
-	if encryptionContent != nil {
-		if encryptionContent.RotationPeriodMillis != 0 {
-			ogs.MaxAge = time.Duration(encryptionContent.RotationPeriodMillis) * time.Millisecond
-		}
-		if encryptionContent.RotationPeriodMessages != 0 {
-			ogs.MaxMessages = encryptionContent.RotationPeriodMessages
-		}
+		Shared: false,
+		Users:  make(map[UserDevice]OGSState),
+		RoomID: roomID,
 	}
+	DefaultRotationPolicy.WithEncryptionEvent(encryptionContent).Apply(ogs)
 	return ogs
 }
 
@@ -196,7 +204,7 @@ func (ogs *OutboundGroupSession) ID() id.SessionID {
 }
 
 func (ogs *OutboundGroupSession) Expired() bool {
-	return ogs.MessageCount >= ogs.MaxMessages || ogs.ExpirationMixin.Expired()
+	return (ogs.MaxMessages > 0 && ogs.MessageCount >= ogs.MaxMessages) || ogs.ExpirationMixin.Expired()
 }
 
 func (ogs *OutboundGroupSession) Encrypt(plaintext []byte) ([]byte, error) {
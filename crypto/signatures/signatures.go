@@ -0,0 +1,165 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package signatures contains pure-Go implementations of the ed25519 and curve25519 operations used in Matrix,
+// so that e.g. tooling can verify device signatures and key descriptions without linking against libolm.
+package signatures
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"golang.org/x/crypto/curve25519"
+
+	"maunium.net/go/mautrix/crypto/canonicaljson"
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrEmptyInput        = errors.New("empty input")
+	ErrSignatureNotFound = errors.New("input JSON doesn't contain signature from specified device")
+	ErrInvalidKeyLength  = errors.New("invalid key length")
+)
+
+// Curve25519KeyLength is the length of curve25519 public and private keys as well as shared secrets.
+const Curve25519KeyLength = curve25519.ScalarSize
+
+var gjsonEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	".", `\.`,
+	"|", `\|`,
+	"#", `\#`,
+	"@", `\@`,
+	"*", `\*`,
+	"?", `\?`)
+
+func gjsonPath(path ...string) string {
+	var result strings.Builder
+	for i, part := range path {
+		_, _ = gjsonEscaper.WriteString(&result, part)
+		if i < len(path)-1 {
+			result.WriteRune('.')
+		}
+	}
+	return result.String()
+}
+
+// canonicalJSONForSigning marshals the given object and returns the canonical JSON form without
+// the unsigned and signatures fields, which is what gets signed according to the Matrix spec.
+func canonicalJSONForSigning(objJSON []byte) ([]byte, error) {
+	objJSON, err := sjson.DeleteBytes(objJSON, "unsigned")
+	if err != nil {
+		return nil, err
+	}
+	objJSON, err = sjson.DeleteBytes(objJSON, "signatures")
+	if err != nil {
+		return nil, err
+	}
+	return canonicaljson.CanonicalJSONAssumeValid(objJSON), nil
+}
+
+// SignJSON signs the canonical JSON form of the given object with the given ed25519 private key
+// and returns the unpadded base64 signature. If the object is a struct, the `json` tags will be honored.
+//
+// This produces the same signatures as olm.Account.SignJSON and olm.PkSigning.SignJSON.
+func SignJSON(key ed25519.PrivateKey, obj interface{}) (string, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return "", ErrInvalidKeyLength
+	}
+	objJSON, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	canonical, err := canonicalJSONForSigning(objJSON)
+	if err != nil {
+		return "", err
+	}
+	return utils.EncodeUnpaddedBase64(ed25519.Sign(key, canonical)), nil
+}
+
+// VerifySignature verifies an unpadded base64 ed25519 signature of the given message.
+//
+// A signature that doesn't match returns false with no error, while malformed input returns an error.
+func VerifySignature(message []byte, key id.Ed25519, signature string) (bool, error) {
+	if len(message) == 0 || len(key) == 0 || len(signature) == 0 {
+		return false, ErrEmptyInput
+	}
+	keyBytes, err := utils.DecodeUnpaddedBase64(string(key))
+	if err != nil {
+		return false, fmt.Errorf("failed to decode key: %w", err)
+	} else if len(keyBytes) != ed25519.PublicKeySize {
+		return false, ErrInvalidKeyLength
+	}
+	sigBytes, err := utils.DecodeUnpaddedBase64(signature)
+	if err != nil {
+		return false, fmt.Errorf("failed to decode signature: %w", err)
+	}
+	return ed25519.Verify(keyBytes, message, sigBytes), nil
+}
+
+// VerifySignatureJSON verifies the signature in the JSON object _obj following
+// the Matrix specification:
+// https://spec.matrix.org/v1.2/appendices/#signing-json
+// If the _obj is a struct, the `json` tags will be honored.
+//
+// This is a pure-Go equivalent of olm.VerifySignatureJSON.
+func VerifySignatureJSON(obj interface{}, userID id.UserID, keyName string, key id.Ed25519) (bool, error) {
+	objJSON, err := json.Marshal(obj)
+	if err != nil {
+		return false, err
+	}
+	sig := gjson.GetBytes(objJSON, gjsonPath("signatures", string(userID), fmt.Sprintf("ed25519:%s", keyName)))
+	if !sig.Exists() || sig.Type != gjson.String {
+		return false, ErrSignatureNotFound
+	}
+	canonical, err := canonicalJSONForSigning(objJSON)
+	if err != nil {
+		return false, err
+	}
+	return VerifySignature(canonical, key, sig.Str)
+}
+
+// GenerateEd25519Key generates a new ed25519 key pair using utils.Random as the source of randomness.
+func GenerateEd25519Key() (id.Ed25519, ed25519.PrivateKey, error) {
+	pub, priv, err := ed25519.GenerateKey(utils.Random)
+	if err != nil {
+		return "", nil, err
+	}
+	return id.Ed25519(utils.EncodeUnpaddedBase64(pub)), priv, nil
+}
+
+// GenerateCurve25519Key generates a new curve25519 key pair using utils.Random as the source of randomness.
+func GenerateCurve25519Key() (id.Curve25519, []byte, error) {
+	private := make([]byte, Curve25519KeyLength)
+	if _, err := utils.ReadRandom(private); err != nil {
+		return "", nil, err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return "", nil, err
+	}
+	return id.Curve25519(utils.EncodeUnpaddedBase64(public)), private, nil
+}
+
+// SharedSecret performs curve25519 ECDH between the given private key and unpadded base64 public key.
+func SharedSecret(private []byte, public id.Curve25519) ([]byte, error) {
+	if len(private) != Curve25519KeyLength {
+		return nil, ErrInvalidKeyLength
+	}
+	publicBytes, err := utils.DecodeUnpaddedBase64(string(public))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public key: %w", err)
+	} else if len(publicBytes) != Curve25519KeyLength {
+		return nil, ErrInvalidKeyLength
+	}
+	return curve25519.X25519(private, publicBytes)
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signatures
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestSignAndVerifyJSON(t *testing.T) {
+	pub, priv, err := GenerateEd25519Key()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	obj := map[string]interface{}{
+		"user_id":   "@user:example.com",
+		"device_id": "DEVICE",
+		"unsigned":  map[string]interface{}{"device_display_name": "ignored"},
+	}
+	sig, err := SignJSON(priv, obj)
+	if err != nil {
+		t.Fatalf("Failed to sign JSON: %v", err)
+	}
+	obj["signatures"] = map[string]map[string]string{"@user:example.com": {"ed25519:DEVICE": sig}}
+	obj["unsigned"] = map[string]interface{}{"device_display_name": "changed"}
+	if ok, err := VerifySignatureJSON(obj, "@user:example.com", "DEVICE", pub); err != nil || !ok {
+		t.Errorf("Expected signature to be valid, got %t / %v", ok, err)
+	}
+	obj["device_id"] = "OTHER"
+	if ok, err := VerifySignatureJSON(obj, "@user:example.com", "DEVICE", pub); err != nil || ok {
+		t.Errorf("Expected signature of modified object to be invalid, got %t / %v", ok, err)
+	}
+	if _, err = VerifySignatureJSON(obj, "@other:example.com", "DEVICE", pub); !errors.Is(err, ErrSignatureNotFound) {
+		t.Errorf("Expected ErrSignatureNotFound, got %v", err)
+	}
+}
+
+func TestSharedSecret(t *testing.T) {
+	alicePub, alicePriv, err := GenerateCurve25519Key()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	bobPub, bobPriv, err := GenerateCurve25519Key()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	aliceSecret, err := SharedSecret(alicePriv, bobPub)
+	if err != nil {
+		t.Fatalf("Failed to compute shared secret: %v", err)
+	}
+	bobSecret, err := SharedSecret(bobPriv, alicePub)
+	if err != nil {
+		t.Fatalf("Failed to compute shared secret: %v", err)
+	}
+	if !bytes.Equal(aliceSecret, bobSecret) {
+		t.Errorf("Shared secrets don't match")
+	}
+	if _, err = SharedSecret(alicePriv, id.Curve25519("AAAA")); !errors.Is(err, ErrInvalidKeyLength) {
+		t.Errorf("Expected ErrInvalidKeyLength, got %v", err)
+	}
+}
@@ -7,6 +7,7 @@
 package crypto
 
 import (
+	"bytes"
 	"database/sql"
 	"database/sql/driver"
 	"fmt"
@@ -15,6 +16,7 @@ import (
 
 	"maunium.net/go/mautrix/crypto/olm"
 	"maunium.net/go/mautrix/crypto/sql_store_upgrade"
+	"maunium.net/go/mautrix/crypto/utils"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
@@ -33,23 +35,51 @@ type SQLCryptoStore struct {
 	AccountID string
 	DeviceID  id.DeviceID
 	SyncToken string
-	PickleKey []byte
+	// PickleKey is the key that olm objects are pickled with. It's wiped when the store is closed.
+	PickleKey *utils.SecretBytes
 	Account   *OlmAccount
 
+	// EncryptPickles enables wrapping all stored pickles in an additional layer of AES-256-GCM encryption
+	// with a key derived from PickleKey. Existing plain pickles can still be read when this is enabled.
+	// It's ignored for new pickles if PickleEncrypter is set.
+	EncryptPickles bool
+
+	// PickleEncrypter is used to encrypt pickles with a key other than PickleKey, e.g. one from a key management
+	// service. Only one layer of encryption is applied, so pickles that were stored with EncryptPickles are
+	// re-encrypted with the encrypter the next time they're written.
+	PickleEncrypter PickleEncrypter
+
+	// PrepareStatements makes the store prepare each query the first time it's used and reuse the prepared
+	// statement afterwards. Prepared statements are closed by Close.
+	PrepareStatements bool
+
+	// SQLiteLockFile is the path of the file that is locked with flock by LockAccount when using SQLite.
+	// NewSQLiteCryptoStore sets it to the database path with a .lock suffix.
+	SQLiteLockFile string
+
 	olmSessionCache     map[id.SenderKey]map[id.SessionID]*OlmSession
 	olmSessionCacheLock sync.Mutex
+
+	stmtCache     map[string]*sql.Stmt
+	stmtCacheLock sync.Mutex
+
+	writeBatcher *sqlWriteBatcher
+	ownsDB       bool
+	// root is the store that this store is an account view of, see ForAccount.
+	root *SQLCryptoStore
 }
 
 var _ Store = (*SQLCryptoStore)(nil)
 
 // NewSQLCryptoStore initializes a new crypto Store using the given database, for a device's crypto material.
-// The stored material will be encrypted with the given key.
+// The stored material will be encrypted with the given key. The store keeps a copy of the key, so the caller
+// may wipe the given slice afterwards.
 func NewSQLCryptoStore(db *sql.DB, dialect string, accountID string, deviceID id.DeviceID, pickleKey []byte, log Logger) *SQLCryptoStore {
 	return &SQLCryptoStore{
 		DB:        db,
 		Dialect:   dialect,
 		Log:       log,
-		PickleKey: pickleKey,
+		PickleKey: utils.NewSecretBytes(append([]byte{}, pickleKey...)),
 		AccountID: accountID,
 		DeviceID:  deviceID,
 
@@ -57,6 +87,137 @@ func NewSQLCryptoStore(db *sql.DB, dialect string, accountID string, deviceID id
 	}
 }
 
+type pickleable interface {
+	Pickle(key []byte) []byte
+}
+
+type unpickleable interface {
+	Unpickle(pickled, key []byte) error
+}
+
+var encryptedPicklePrefix = []byte("aesgcm:")
+
+const picklesEncryptionInfo = "mautrix-go pickle encryption"
+
+// pickleEncrypter returns the encrypter for new pickles and the prefix that marks them. EncryptPickles uses an
+// AES-GCM encrypter with a key derived from PickleKey.
+func (store *SQLCryptoStore) pickleEncrypter() (PickleEncrypter, []byte) {
+	if store.PickleEncrypter != nil {
+		return store.PickleEncrypter, atRestPicklePrefix
+	} else if store.EncryptPickles {
+		return store.pickleKeyEncrypter(), encryptedPicklePrefix
+	}
+	return nil, nil
+}
+
+func (store *SQLCryptoStore) pickleKeyEncrypter() PickleEncrypter {
+	return &aesGCMPickleEncrypter{key: utils.DeriveAESGCMKey(store.PickleKey.Bytes(), picklesEncryptionInfo)}
+}
+
+func (store *SQLCryptoStore) pickle(obj pickleable) ([]byte, error) {
+	encrypter, prefix := store.pickleEncrypter()
+	return encryptPickle(encrypter, prefix, obj.Pickle(store.PickleKey.Bytes()))
+}
+
+func (store *SQLCryptoStore) unpickle(data []byte, obj unpickleable) (err error) {
+	if bytes.HasPrefix(data, encryptedPicklePrefix) {
+		data, err = decryptPickle(store.pickleKeyEncrypter(), encryptedPicklePrefix, data)
+	} else {
+		data, err = decryptPickle(store.PickleEncrypter, atRestPicklePrefix, data)
+	}
+	if err != nil {
+		return err
+	}
+	return obj.Unpickle(data, store.PickleKey.Bytes())
+}
+
+// getStatement returns a prepared statement for the given query, preparing it if it hasn't been used before.
+func (store *SQLCryptoStore) getStatement(query string) (*sql.Stmt, error) {
+	if store.root != nil {
+		return store.root.getStatement(query)
+	}
+	store.stmtCacheLock.Lock()
+	defer store.stmtCacheLock.Unlock()
+	stmt, ok := store.stmtCache[query]
+	if ok {
+		return stmt, nil
+	}
+	stmt, err := store.DB.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	if store.stmtCache == nil {
+		store.stmtCache = make(map[string]*sql.Stmt)
+	}
+	store.stmtCache[query] = stmt
+	return stmt, nil
+}
+
+func (store *SQLCryptoStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	if store.writeBatcher != nil {
+		return store.writeBatcher.exec(query, args...)
+	} else if store.PrepareStatements {
+		stmt, err := store.getStatement(query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare statement: %w", err)
+		}
+		return stmt.Exec(args...)
+	}
+	return store.DB.Exec(query, args...)
+}
+
+func (store *SQLCryptoStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	if store.PrepareStatements {
+		stmt, err := store.getStatement(query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare statement: %w", err)
+		}
+		return stmt.Query(args...)
+	}
+	return store.DB.Query(query, args...)
+}
+
+func (store *SQLCryptoStore) queryRow(query string, args ...interface{}) *sql.Row {
+	if store.PrepareStatements {
+		stmt, err := store.getStatement(query)
+		if err == nil {
+			return stmt.QueryRow(args...)
+		}
+		// sql.Row can't be created with an error, so just let the unprepared query return the error.
+		store.Log.Warn("Failed to prepare statement: %v", err)
+	}
+	return store.DB.QueryRow(query, args...)
+}
+
+// Close stops write batching, closes all prepared statements and wipes the pickle key. The database itself is only closed if it was
+// opened by the store (i.e. the store was created with NewSQLiteCryptoStore).
+//
+// Closing an account view created with ForAccount does nothing, as the view shares everything with the original store.
+func (store *SQLCryptoStore) Close() error {
+	if store.root != nil {
+		return nil
+	}
+	if store.writeBatcher != nil {
+		store.writeBatcher.close()
+	}
+	store.PickleKey.Wipe()
+	store.stmtCacheLock.Lock()
+	defer store.stmtCacheLock.Unlock()
+	var firstErr error
+	for query, stmt := range store.stmtCache {
+		if err := stmt.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(store.stmtCache, query)
+	}
+	if store.ownsDB {
+		if err := store.DB.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 // CreateTables applies all the pending database migrations.
 func (store *SQLCryptoStore) CreateTables() error {
 	return sql_store_upgrade.Upgrade(store.DB, store.Dialect)
@@ -70,7 +231,7 @@ func (store *SQLCryptoStore) Flush() error {
 // PutNextBatch stores the next sync batch token for the current account.
 func (store *SQLCryptoStore) PutNextBatch(nextBatch string) {
 	store.SyncToken = nextBatch
-	_, err := store.DB.Exec(`UPDATE crypto_account SET sync_token=$1 WHERE account_id=$2`, store.SyncToken, store.AccountID)
+	_, err := store.exec(`UPDATE crypto_account SET sync_token=$1 WHERE account_id=$2`, store.SyncToken, store.AccountID)
 	if err != nil {
 		store.Log.Warn("Failed to store sync token: %v", err)
 	}
@@ -79,8 +240,8 @@ func (store *SQLCryptoStore) PutNextBatch(nextBatch string) {
 // GetNextBatch retrieves the next sync batch token for the current account.
 func (store *SQLCryptoStore) GetNextBatch() string {
 	if store.SyncToken == "" {
-		err := store.DB.
-			QueryRow("SELECT sync_token FROM crypto_account WHERE account_id=$1", store.AccountID).
+		err := store.
+			queryRow("SELECT sync_token FROM crypto_account WHERE account_id=$1", store.AccountID).
 			Scan(&store.SyncToken)
 		if err != nil && err != sql.ErrNoRows {
 			store.Log.Warn("Failed to scan sync token: %v", err)
@@ -92,8 +253,11 @@ func (store *SQLCryptoStore) GetNextBatch() string {
 // PutAccount stores an OlmAccount in the database.
 func (store *SQLCryptoStore) PutAccount(account *OlmAccount) error {
 	store.Account = account
-	bytes := account.Internal.Pickle(store.PickleKey)
-	_, err := store.DB.Exec(`
+	bytes, err := store.pickle(&account.Internal)
+	if err != nil {
+		return err
+	}
+	_, err = store.exec(`
 		INSERT INTO crypto_account (device_id, shared, sync_token, account, account_id) VALUES ($1, $2, $3, $4, $5)
 		ON CONFLICT (account_id) DO UPDATE SET shared=excluded.shared, sync_token=excluded.sync_token,
 											   account=excluded.account, account_id=excluded.account_id
@@ -107,7 +271,7 @@ func (store *SQLCryptoStore) PutAccount(account *OlmAccount) error {
 // GetAccount retrieves an OlmAccount from the database.
 func (store *SQLCryptoStore) GetAccount() (*OlmAccount, error) {
 	if store.Account == nil {
-		row := store.DB.QueryRow("SELECT shared, sync_token, account FROM crypto_account WHERE account_id=$1", store.AccountID)
+		row := store.queryRow("SELECT shared, sync_token, account FROM crypto_account WHERE account_id=$1", store.AccountID)
 		acc := &OlmAccount{Internal: *olm.NewBlankAccount()}
 		var accountBytes []byte
 		err := row.Scan(&acc.Shared, &store.SyncToken, &accountBytes)
@@ -116,7 +280,7 @@ func (store *SQLCryptoStore) GetAccount() (*OlmAccount, error) {
 		} else if err != nil {
 			return nil, err
 		}
-		err = acc.Internal.Unpickle(accountBytes, store.PickleKey)
+		err = store.unpickle(accountBytes, &acc.Internal)
 		if err != nil {
 			return nil, err
 		}
@@ -134,7 +298,7 @@ func (store *SQLCryptoStore) HasSession(key id.SenderKey) bool {
 		return true
 	}
 	var sessionID id.SessionID
-	err := store.DB.QueryRow("SELECT session_id FROM crypto_olm_session WHERE sender_key=$1 AND account_id=$2 LIMIT 1",
+	err := store.queryRow("SELECT session_id FROM crypto_olm_session WHERE sender_key=$1 AND account_id=$2 LIMIT 1",
 		key, store.AccountID).Scan(&sessionID)
 	if err == sql.ErrNoRows {
 		return false
@@ -144,7 +308,7 @@ func (store *SQLCryptoStore) HasSession(key id.SenderKey) bool {
 
 // GetSessions returns all the known Olm sessions for a sender key.
 func (store *SQLCryptoStore) GetSessions(key id.SenderKey) (OlmSessionList, error) {
-	rows, err := store.DB.Query("SELECT session_id, session, created_at, last_encrypted, last_decrypted FROM crypto_olm_session WHERE sender_key=$1 AND account_id=$2 ORDER BY last_decrypted DESC",
+	rows, err := store.query("SELECT session_id, session, created_at, last_encrypted, last_decrypted FROM crypto_olm_session WHERE sender_key=$1 AND account_id=$2 ORDER BY last_decrypted DESC",
 		key, store.AccountID)
 	if err != nil {
 		return nil, err
@@ -163,7 +327,7 @@ func (store *SQLCryptoStore) GetSessions(key id.SenderKey) (OlmSessionList, erro
 		} else if existing, ok := cache[sessionID]; ok {
 			list = append(list, existing)
 		} else {
-			err = sess.Internal.Unpickle(sessionBytes, store.PickleKey)
+			err = store.unpickle(sessionBytes, &sess.Internal)
 			if err != nil {
 				return nil, err
 			}
@@ -188,7 +352,7 @@ func (store *SQLCryptoStore) GetLatestSession(key id.SenderKey) (*OlmSession, er
 	store.olmSessionCacheLock.Lock()
 	defer store.olmSessionCacheLock.Unlock()
 
-	row := store.DB.QueryRow("SELECT session_id, session, created_at, last_encrypted, last_decrypted FROM crypto_olm_session WHERE sender_key=$1 AND account_id=$2 ORDER BY last_decrypted DESC LIMIT 1",
+	row := store.queryRow("SELECT session_id, session, created_at, last_encrypted, last_decrypted FROM crypto_olm_session WHERE sender_key=$1 AND account_id=$2 ORDER BY last_decrypted DESC LIMIT 1",
 		key, store.AccountID)
 
 	sess := OlmSession{Internal: *olm.NewBlankSession()}
@@ -205,7 +369,7 @@ func (store *SQLCryptoStore) GetLatestSession(key id.SenderKey) (*OlmSession, er
 	cache := store.getOlmSessionCache(key)
 	if oldSess, ok := cache[sessionID]; ok {
 		return oldSess, nil
-	} else if err = sess.Internal.Unpickle(sessionBytes, store.PickleKey); err != nil {
+	} else if err = store.unpickle(sessionBytes, &sess.Internal); err != nil {
 		return nil, err
 	} else {
 		cache[sessionID] = &sess
@@ -217,46 +381,147 @@ func (store *SQLCryptoStore) GetLatestSession(key id.SenderKey) (*OlmSession, er
 func (store *SQLCryptoStore) AddSession(key id.SenderKey, session *OlmSession) error {
 	store.olmSessionCacheLock.Lock()
 	defer store.olmSessionCacheLock.Unlock()
-	sessionBytes := session.Internal.Pickle(store.PickleKey)
-	_, err := store.DB.Exec("INSERT INTO crypto_olm_session (session_id, sender_key, session, created_at, last_encrypted, last_decrypted, account_id) VALUES ($1, $2, $3, $4, $5, $6, $7)",
-		session.ID(), key, sessionBytes, session.CreationTime, session.LastEncryptedTime, session.LastDecryptedTime, store.AccountID)
+	err := store.addSession(sqlExecFunc(store.exec), key, session)
 	store.getOlmSessionCache(key)[session.ID()] = session
 	return err
 }
 
+// PutSessions persists multiple Olm sessions in a single transaction.
+func (store *SQLCryptoStore) PutSessions(sessions map[id.SenderKey]*OlmSession) error {
+	store.olmSessionCacheLock.Lock()
+	defer store.olmSessionCacheLock.Unlock()
+	tx, err := store.DB.Begin()
+	if err != nil {
+		return err
+	}
+	for key, session := range sessions {
+		err = store.addSession(tx, key, session)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	for key, session := range sessions {
+		store.getOlmSessionCache(key)[session.ID()] = session
+	}
+	return nil
+}
+
+func (store *SQLCryptoStore) addSession(db sqlExecer, key id.SenderKey, session *OlmSession) error {
+	sessionBytes, err := store.pickle(&session.Internal)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO crypto_olm_session (session_id, sender_key, session, created_at, last_encrypted, last_decrypted, account_id) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		session.ID(), key, sessionBytes, session.CreationTime, session.LastEncryptedTime, session.LastDecryptedTime, store.AccountID)
+	return err
+}
+
 // UpdateSession replaces the Olm session for a sender in the database.
 func (store *SQLCryptoStore) UpdateSession(_ id.SenderKey, session *OlmSession) error {
-	sessionBytes := session.Internal.Pickle(store.PickleKey)
-	_, err := store.DB.Exec("UPDATE crypto_olm_session SET session=$1, last_encrypted=$2, last_decrypted=$3 WHERE session_id=$4 AND account_id=$5",
+	sessionBytes, err := store.pickle(&session.Internal)
+	if err != nil {
+		return err
+	}
+	_, err = store.exec("UPDATE crypto_olm_session SET session=$1, last_encrypted=$2, last_decrypted=$3 WHERE session_id=$4 AND account_id=$5",
 		sessionBytes, session.LastEncryptedTime, session.LastDecryptedTime, session.ID(), store.AccountID)
 	return err
 }
 
+// PruneOlmSessions removes all but the given number of most recently used Olm sessions for each sender key.
+func (store *SQLCryptoStore) PruneOlmSessions(keepPerSender int) (int64, error) {
+	store.olmSessionCacheLock.Lock()
+	defer store.olmSessionCacheLock.Unlock()
+	res, err := store.exec(`
+		DELETE FROM crypto_olm_session WHERE account_id=$1 AND session_id IN (
+			SELECT session_id FROM (
+				SELECT session_id, ROW_NUMBER() OVER (PARTITION BY sender_key ORDER BY last_decrypted DESC) AS session_rank
+				FROM crypto_olm_session WHERE account_id=$1
+			) ranked_sessions WHERE session_rank > $2
+		)
+	`, store.AccountID, keepPerSender)
+	if err != nil {
+		return 0, err
+	}
+	// The cache may contain removed sessions, so just reset it instead of figuring out which ones were removed.
+	store.olmSessionCache = make(map[id.SenderKey]map[id.SessionID]*OlmSession)
+	return res.RowsAffected()
+}
+
 // PutGroupSession stores an inbound Megolm group session for a room, sender and session.
 func (store *SQLCryptoStore) PutGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, session *InboundGroupSession) error {
-	sessionBytes := session.Internal.Pickle(store.PickleKey)
+	return store.putGroupSession(sqlExecFunc(store.exec), roomID, senderKey, sessionID, session)
+}
+
+// PutGroupSessions stores multiple inbound Megolm group sessions in a single transaction.
+func (store *SQLCryptoStore) PutGroupSessions(sessions []*InboundGroupSession) error {
+	tx, err := store.DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		err = store.putGroupSession(tx, session.RoomID, session.SenderKey, session.ID(), session)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// sqlExecFunc allows using SQLCryptoStore.exec as an sqlExecer, so that writes go through write batching.
+type sqlExecFunc func(query string, args ...interface{}) (sql.Result, error)
+
+func (fn sqlExecFunc) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return fn(query, args...)
+}
+
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (store *SQLCryptoStore) putGroupSession(db sqlExecer, roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, session *InboundGroupSession) error {
+	sessionBytes, err := store.pickle(&session.Internal)
+	if err != nil {
+		return err
+	}
 	forwardingChains := strings.Join(session.ForwardingChains, ",")
-	_, err := store.DB.Exec(`
+	_, err = db.Exec(`
 		INSERT INTO crypto_megolm_inbound_session
-			(session_id, sender_key, signing_key, room_id, session, forwarding_chains, account_id)
-			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			(session_id, sender_key, signing_key, room_id, session, forwarding_chains, key_source, key_backup_version, account_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 		ON CONFLICT (session_id, account_id) DO UPDATE
 		    SET withheld_code=NULL, withheld_reason=NULL, sender_key=excluded.sender_key, signing_key=excluded.signing_key,
-		        room_id=excluded.room_id, session=excluded.session, forwarding_chains=excluded.forwarding_chains
-	`, sessionID, senderKey, session.SigningKey, roomID, sessionBytes, forwardingChains, store.AccountID)
+		        room_id=excluded.room_id, session=excluded.session, forwarding_chains=excluded.forwarding_chains,
+		        key_source=excluded.key_source, key_backup_version=excluded.key_backup_version
+	`, sessionID, senderKey, session.SigningKey, roomID, sessionBytes, forwardingChains, session.KeySource, session.KeyBackupVersion, store.AccountID)
 	return err
 }
 
+// splitForwardingChains splits the comma-separated forwarding chain list, returning nil for an empty chain.
+func splitForwardingChains(chains string) []string {
+	if len(chains) == 0 {
+		return nil
+	}
+	return strings.Split(chains, ",")
+}
+
 // GetGroupSession retrieves an inbound Megolm group session for a room, sender and session.
 func (store *SQLCryptoStore) GetGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) (*InboundGroupSession, error) {
 	var signingKey, forwardingChains, withheldCode sql.NullString
+	var keySource event.KeySource
+	var keyBackupVersion string
 	var sessionBytes []byte
-	err := store.DB.QueryRow(`
-		SELECT signing_key, session, forwarding_chains, withheld_code
+	err := store.queryRow(`
+		SELECT signing_key, session, forwarding_chains, key_source, key_backup_version, withheld_code
 		FROM crypto_megolm_inbound_session
 		WHERE room_id=$1 AND sender_key=$2 AND session_id=$3 AND account_id=$4`,
 		roomID, senderKey, sessionID, store.AccountID,
-	).Scan(&signingKey, &sessionBytes, &forwardingChains, &withheldCode)
+	).Scan(&signingKey, &sessionBytes, &forwardingChains, &keySource, &keyBackupVersion, &withheldCode)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
@@ -265,7 +530,7 @@ func (store *SQLCryptoStore) GetGroupSession(roomID id.RoomID, senderKey id.Send
 		return nil, fmt.Errorf("%w (%s)", ErrGroupSessionWithheld, withheldCode.String)
 	}
 	igs := olm.NewBlankInboundGroupSession()
-	err = igs.Unpickle(sessionBytes, store.PickleKey)
+	err = store.unpickle(sessionBytes, igs)
 	if err != nil {
 		return nil, err
 	}
@@ -274,19 +539,24 @@ func (store *SQLCryptoStore) GetGroupSession(roomID id.RoomID, senderKey id.Send
 		SigningKey:       id.Ed25519(signingKey.String),
 		SenderKey:        senderKey,
 		RoomID:           roomID,
-		ForwardingChains: strings.Split(forwardingChains.String, ","),
+		ForwardingChains: splitForwardingChains(forwardingChains.String),
+		KeySource:        keySource,
+		KeyBackupVersion: keyBackupVersion,
 	}, nil
 }
 
 func (store *SQLCryptoStore) PutWithheldGroupSession(content event.RoomKeyWithheldEventContent) error {
-	_, err := store.DB.Exec("INSERT INTO crypto_megolm_inbound_session (session_id, sender_key, room_id, withheld_code, withheld_reason, account_id) VALUES ($1, $2, $3, $4, $5, $6)",
-		content.SessionID, content.SenderKey, content.RoomID, content.Code, content.Reason, store.AccountID)
+	_, err := store.exec(`
+		INSERT INTO crypto_megolm_inbound_session (session_id, sender_key, room_id, withheld_code, withheld_reason, account_id)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (session_id, account_id) DO NOTHING
+	`, content.SessionID, content.SenderKey, content.RoomID, content.Code, content.Reason, store.AccountID)
 	return err
 }
 
 func (store *SQLCryptoStore) GetWithheldGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) (*event.RoomKeyWithheldEventContent, error) {
 	var code, reason sql.NullString
-	err := store.DB.QueryRow(`
+	err := store.queryRow(`
 		SELECT withheld_code, withheld_reason FROM crypto_megolm_inbound_session
 		WHERE room_id=$1 AND sender_key=$2 AND session_id=$3 AND account_id=$4`,
 		roomID, senderKey, sessionID, store.AccountID,
@@ -306,36 +576,47 @@ func (store *SQLCryptoStore) GetWithheldGroupSession(roomID id.RoomID, senderKey
 	}, nil
 }
 
+func (store *SQLCryptoStore) scanGroupSession(rows *sql.Rows) (*InboundGroupSession, error) {
+	var roomID id.RoomID
+	var signingKey, senderKey, forwardingChains sql.NullString
+	var keySource event.KeySource
+	var keyBackupVersion string
+	var sessionBytes []byte
+	err := rows.Scan(&roomID, &signingKey, &senderKey, &sessionBytes, &forwardingChains, &keySource, &keyBackupVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan row: %w", err)
+	}
+	igs := olm.NewBlankInboundGroupSession()
+	err = store.unpickle(sessionBytes, igs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unpickle session: %w", err)
+	}
+	return &InboundGroupSession{
+		Internal:         *igs,
+		SigningKey:       id.Ed25519(signingKey.String),
+		SenderKey:        id.Curve25519(senderKey.String),
+		RoomID:           roomID,
+		ForwardingChains: splitForwardingChains(forwardingChains.String),
+		KeySource:        keySource,
+		KeyBackupVersion: keyBackupVersion,
+	}, nil
+}
+
 func (store *SQLCryptoStore) scanGroupSessionList(rows *sql.Rows) (result []*InboundGroupSession) {
 	for rows.Next() {
-		var roomID id.RoomID
-		var signingKey, senderKey, forwardingChains sql.NullString
-		var sessionBytes []byte
-		err := rows.Scan(&roomID, &signingKey, &senderKey, &sessionBytes, &forwardingChains)
+		igs, err := store.scanGroupSession(rows)
 		if err != nil {
-			store.Log.Warn("Failed to scan row: %v", err)
+			store.Log.Warn("%v", err)
 			continue
 		}
-		igs := olm.NewBlankInboundGroupSession()
-		err = igs.Unpickle(sessionBytes, store.PickleKey)
-		if err != nil {
-			store.Log.Warn("Failed to unpickle session: %v", err)
-			continue
-		}
-		result = append(result, &InboundGroupSession{
-			Internal:         *igs,
-			SigningKey:       id.Ed25519(signingKey.String),
-			SenderKey:        id.Curve25519(senderKey.String),
-			RoomID:           roomID,
-			ForwardingChains: strings.Split(forwardingChains.String, ","),
-		})
+		result = append(result, igs)
 	}
 	return
 }
 
 func (store *SQLCryptoStore) GetGroupSessionsForRoom(roomID id.RoomID) ([]*InboundGroupSession, error) {
-	rows, err := store.DB.Query(`
-		SELECT room_id, signing_key, sender_key, session, forwarding_chains
+	rows, err := store.query(`
+		SELECT room_id, signing_key, sender_key, session, forwarding_chains, key_source, key_backup_version
 		FROM crypto_megolm_inbound_session WHERE room_id=$1 AND account_id=$2`,
 		roomID, store.AccountID,
 	)
@@ -348,9 +629,9 @@ func (store *SQLCryptoStore) GetGroupSessionsForRoom(roomID id.RoomID) ([]*Inbou
 }
 
 func (store *SQLCryptoStore) GetAllGroupSessions() ([]*InboundGroupSession, error) {
-	rows, err := store.DB.Query(`
-		SELECT room_id, signing_key, sender_key, session, forwarding_chains
-		FROM crypto_megolm_inbound_session WHERE account_id=$2`,
+	rows, err := store.query(`
+		SELECT room_id, signing_key, sender_key, session, forwarding_chains, key_source, key_backup_version
+		FROM crypto_megolm_inbound_session WHERE account_id=$1`,
 		store.AccountID,
 	)
 	if err == sql.ErrNoRows {
@@ -361,10 +642,74 @@ func (store *SQLCryptoStore) GetAllGroupSessions() ([]*InboundGroupSession, erro
 	return store.scanGroupSessionList(rows), nil
 }
 
+// GetGroupSessionRooms returns the IDs of all rooms that have inbound Megolm sessions or withheld session entries.
+func (store *SQLCryptoStore) GetGroupSessionRooms() ([]id.RoomID, error) {
+	rows, err := store.query("SELECT DISTINCT room_id FROM crypto_megolm_inbound_session WHERE account_id=$1", store.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rooms []id.RoomID
+	for rows.Next() {
+		var roomID id.RoomID
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, roomID)
+	}
+	return rooms, rows.Err()
+}
+
+// RemoveGroupSessionsForRoom removes all inbound Megolm sessions and withheld session entries for the given room.
+func (store *SQLCryptoStore) RemoveGroupSessionsForRoom(roomID id.RoomID) (int64, error) {
+	res, err := store.exec("DELETE FROM crypto_megolm_inbound_session WHERE room_id=$1 AND account_id=$2", roomID, store.AccountID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 // AddOutboundGroupSession stores an outbound Megolm session, along with the information about the room and involved devices.
+// GetGroupSessionsWithoutKeyBackupVersion gets the inbound Megolm sessions that haven't been uploaded to the given key backup version.
+func (store *SQLCryptoStore) GetGroupSessionsWithoutKeyBackupVersion(version string) ([]*InboundGroupSession, error) {
+	rows, err := store.query(`
+		SELECT room_id, signing_key, sender_key, session, forwarding_chains, key_source, key_backup_version
+		FROM crypto_megolm_inbound_session WHERE account_id=$1 AND session IS NOT NULL AND key_backup_version<>$2`,
+		store.AccountID, version,
+	)
+	if err == sql.ErrNoRows {
+		return []*InboundGroupSession{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return store.scanGroupSessionList(rows), nil
+}
+
+// MarkGroupSessionsBackedUp sets the key backup version of the given inbound Megolm sessions.
+func (store *SQLCryptoStore) MarkGroupSessionsBackedUp(version string, sessions []*InboundGroupSession) error {
+	tx, err := store.DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		_, err = tx.Exec(
+			"UPDATE crypto_megolm_inbound_session SET key_backup_version=$1 WHERE session_id=$2 AND account_id=$3",
+			version, session.ID(), store.AccountID,
+		)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func (store *SQLCryptoStore) AddOutboundGroupSession(session *OutboundGroupSession) error {
-	sessionBytes := session.Internal.Pickle(store.PickleKey)
-	_, err := store.DB.Exec(`
+	sessionBytes, err := store.pickle(&session.Internal)
+	if err != nil {
+		return err
+	}
+	_, err = store.exec(`
 		INSERT INTO crypto_megolm_outbound_session
 			(room_id, session_id, session, shared, max_messages, message_count, max_age, created_at, last_used, account_id)
 			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
@@ -379,8 +724,11 @@ func (store *SQLCryptoStore) AddOutboundGroupSession(session *OutboundGroupSessi
 
 // UpdateOutboundGroupSession replaces an outbound Megolm session with for same room and session ID.
 func (store *SQLCryptoStore) UpdateOutboundGroupSession(session *OutboundGroupSession) error {
-	sessionBytes := session.Internal.Pickle(store.PickleKey)
-	_, err := store.DB.Exec("UPDATE crypto_megolm_outbound_session SET session=$1, message_count=$2, last_used=$3 WHERE room_id=$4 AND session_id=$5 AND account_id=$6",
+	sessionBytes, err := store.pickle(&session.Internal)
+	if err != nil {
+		return err
+	}
+	_, err = store.exec("UPDATE crypto_megolm_outbound_session SET session=$1, message_count=$2, last_used=$3 WHERE room_id=$4 AND session_id=$5 AND account_id=$6",
 		sessionBytes, session.MessageCount, session.LastEncryptedTime, session.RoomID, session.ID(), store.AccountID)
 	return err
 }
@@ -389,7 +737,7 @@ func (store *SQLCryptoStore) UpdateOutboundGroupSession(session *OutboundGroupSe
 func (store *SQLCryptoStore) GetOutboundGroupSession(roomID id.RoomID) (*OutboundGroupSession, error) {
 	var ogs OutboundGroupSession
 	var sessionBytes []byte
-	err := store.DB.QueryRow(`
+	err := store.queryRow(`
 		SELECT session, shared, max_messages, message_count, max_age, created_at, last_used
 		FROM crypto_megolm_outbound_session WHERE room_id=$1 AND account_id=$2`,
 		roomID, store.AccountID,
@@ -400,34 +748,68 @@ func (store *SQLCryptoStore) GetOutboundGroupSession(roomID id.RoomID) (*Outboun
 		return nil, err
 	}
 	intOGS := olm.NewBlankOutboundGroupSession()
-	err = intOGS.Unpickle(sessionBytes, store.PickleKey)
+	err = store.unpickle(sessionBytes, intOGS)
 	if err != nil {
 		return nil, err
 	}
 	ogs.Internal = *intOGS
 	ogs.RoomID = roomID
+	// The per-device sharing state isn't stored, so re-sharing will send the key to all devices again.
+	ogs.Users = make(map[UserDevice]OGSState)
 	return &ogs, nil
 }
 
 // RemoveOutboundGroupSession removes the outbound Megolm session for the given room ID.
 func (store *SQLCryptoStore) RemoveOutboundGroupSession(roomID id.RoomID) error {
-	_, err := store.DB.Exec("DELETE FROM crypto_megolm_outbound_session WHERE room_id=$1 AND account_id=$2",
+	_, err := store.exec("DELETE FROM crypto_megolm_outbound_session WHERE room_id=$1 AND account_id=$2",
 		roomID, store.AccountID)
 	return err
 }
 
+// RemoveExpiredOutboundGroupSessions removes all outbound Megolm sessions that have expired.
+func (store *SQLCryptoStore) RemoveExpiredOutboundGroupSessions() (int64, error) {
+	rows, err := store.query(`
+		SELECT room_id, max_messages, message_count, max_age, created_at
+		FROM crypto_megolm_outbound_session WHERE account_id=$1`,
+		store.AccountID)
+	if err != nil {
+		return 0, err
+	}
+	var expired []id.RoomID
+	for rows.Next() {
+		var ogs OutboundGroupSession
+		err = rows.Scan(&ogs.RoomID, &ogs.MaxMessages, &ogs.MessageCount, &ogs.MaxAge, &ogs.CreationTime)
+		if err != nil {
+			_ = rows.Close()
+			return 0, err
+		} else if ogs.Expired() {
+			expired = append(expired, ogs.RoomID)
+		}
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, roomID := range expired {
+		if err = store.RemoveOutboundGroupSession(roomID); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(expired)), nil
+}
+
 // ValidateMessageIndex returns whether the given event information match the ones stored in the database
 // for the given sender key, session ID and index.
 // If the event information was not yet stored, it's stored now.
 func (store *SQLCryptoStore) ValidateMessageIndex(senderKey id.SenderKey, sessionID id.SessionID, eventID id.EventID, index uint, timestamp int64) bool {
 	var resultEventID id.EventID
 	var resultTimestamp int64
-	err := store.DB.QueryRow(
+	err := store.queryRow(
 		`SELECT event_id, timestamp FROM crypto_message_index WHERE sender_key=$1 AND session_id=$2 AND "index"=$3`,
 		senderKey, sessionID, index,
 	).Scan(&resultEventID, &resultTimestamp)
 	if err == sql.ErrNoRows {
-		_, err := store.DB.Exec(`INSERT INTO crypto_message_index (sender_key, session_id, "index", event_id, timestamp) VALUES ($1, $2, $3, $4, $5)`,
+		_, err := store.exec(`INSERT INTO crypto_message_index (sender_key, session_id, "index", event_id, timestamp) VALUES ($1, $2, $3, $4, $5)`,
 			senderKey, sessionID, index, eventID, timestamp)
 		if err != nil {
 			store.Log.Warn("Failed to store message index: %v", err)
@@ -446,14 +828,14 @@ func (store *SQLCryptoStore) ValidateMessageIndex(senderKey id.SenderKey, sessio
 // GetDevices returns a map of device IDs to device identities, including the identity and signing keys, for a given user ID.
 func (store *SQLCryptoStore) GetDevices(userID id.UserID) (map[id.DeviceID]*DeviceIdentity, error) {
 	var ignore id.UserID
-	err := store.DB.QueryRow("SELECT user_id FROM crypto_tracked_user WHERE user_id=$1", userID).Scan(&ignore)
+	err := store.queryRow("SELECT user_id FROM crypto_tracked_user WHERE user_id=$1", userID).Scan(&ignore)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
 
-	rows, err := store.DB.Query("SELECT device_id, identity_key, signing_key, trust, deleted, name FROM crypto_device WHERE user_id=$1", userID)
+	rows, err := store.query("SELECT device_id, identity_key, signing_key, trust, deleted, name FROM crypto_device WHERE user_id=$1", userID)
 	if err != nil {
 		return nil, err
 	}
@@ -473,7 +855,7 @@ func (store *SQLCryptoStore) GetDevices(userID id.UserID) (map[id.DeviceID]*Devi
 // GetDevice returns the device dentity for a given user and device ID.
 func (store *SQLCryptoStore) GetDevice(userID id.UserID, deviceID id.DeviceID) (*DeviceIdentity, error) {
 	var identity DeviceIdentity
-	err := store.DB.QueryRow(`
+	err := store.queryRow(`
 		SELECT identity_key, signing_key, trust, deleted, name
 		FROM crypto_device WHERE user_id=$1 AND device_id=$2`,
 		userID, deviceID,
@@ -492,8 +874,8 @@ func (store *SQLCryptoStore) GetDevice(userID id.UserID, deviceID id.DeviceID) (
 // FindDeviceByKey finds a specific device by its sender key.
 func (store *SQLCryptoStore) FindDeviceByKey(userID id.UserID, identityKey id.IdentityKey) (*DeviceIdentity, error) {
 	var identity DeviceIdentity
-	err := store.DB.QueryRow(`
-		SELECT device_id, identity_key, signing_key, trust, deleted, name
+	err := store.queryRow(`
+		SELECT device_id, signing_key, trust, deleted, name
 		FROM crypto_device WHERE user_id=$1 AND identity_key=$2`,
 		userID, identityKey,
 	).Scan(&identity.DeviceID, &identity.SigningKey, &identity.Trust, &identity.Deleted, &identity.Name)
@@ -510,7 +892,7 @@ func (store *SQLCryptoStore) FindDeviceByKey(userID id.UserID, identityKey id.Id
 
 // PutDevice stores a single device for a user, replacing it if it exists already.
 func (store *SQLCryptoStore) PutDevice(userID id.UserID, device *DeviceIdentity) error {
-	_, err := store.DB.Exec(`
+	_, err := store.exec(`
 			INSERT INTO crypto_device (user_id, device_id, identity_key, signing_key, trust, deleted, name) VALUES ($1, $2, $3, $4, $5, $6, $7)
 			ON CONFLICT (user_id, device_id) DO UPDATE SET identity_key=excluded.identity_key, signing_key=excluded.signing_key, trust=excluded.trust, deleted=excluded.deleted, name=excluded.name`,
 		userID, device.DeviceID, device.IdentityKey, device.SigningKey, device.Trust, device.Deleted, device.Name)
@@ -524,8 +906,12 @@ func (store *SQLCryptoStore) PutDevices(userID id.UserID, devices map[id.DeviceI
 		return err
 	}
 
-	_, err = tx.Exec("INSERT INTO crypto_tracked_user (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING", userID)
+	_, err = tx.Exec(`
+		INSERT INTO crypto_tracked_user (user_id, devices_outdated) VALUES ($1, false)
+		ON CONFLICT (user_id) DO UPDATE SET devices_outdated=false
+	`, userID)
 	if err != nil {
+		_ = tx.Rollback()
 		return fmt.Errorf("failed to add user to tracked users list: %w", err)
 	}
 
@@ -577,12 +963,46 @@ func (store *SQLCryptoStore) PutDevices(userID id.UserID, devices map[id.DeviceI
 	return nil
 }
 
+// PutUserTrustSettings stores the trust settings for the given user.
+func (store *SQLCryptoStore) PutUserTrustSettings(userID id.UserID, settings UserTrustSettings) error {
+	var allowUnverified sql.NullBool
+	if settings.AllowUnverifiedDevices != nil {
+		allowUnverified = sql.NullBool{Bool: *settings.AllowUnverifiedDevices, Valid: true}
+	}
+	_, err := store.exec(`
+		INSERT INTO crypto_user_trust_settings (account_id, user_id, allow_unverified_devices, trust_on_first_use)
+			VALUES ($1, $2, $3, $4)
+		ON CONFLICT (account_id, user_id) DO UPDATE
+			SET allow_unverified_devices=excluded.allow_unverified_devices, trust_on_first_use=excluded.trust_on_first_use
+	`, store.AccountID, userID, allowUnverified, settings.TrustOnFirstUse)
+	return err
+}
+
+// GetUserTrustSettings returns the trust settings for the given user, or nil if none have been stored.
+func (store *SQLCryptoStore) GetUserTrustSettings(userID id.UserID) (*UserTrustSettings, error) {
+	var settings UserTrustSettings
+	var allowUnverified sql.NullBool
+	err := store.queryRow(
+		"SELECT allow_unverified_devices, trust_on_first_use FROM crypto_user_trust_settings WHERE account_id=$1 AND user_id=$2",
+		store.AccountID, userID,
+	).Scan(&allowUnverified, &settings.TrustOnFirstUse)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if allowUnverified.Valid {
+		settings.AllowUnverifiedDevices = &allowUnverified.Bool
+	}
+	return &settings, nil
+}
+
 // FilterTrackedUsers finds all of the user IDs out of the given ones for which the database contains identity information.
 func (store *SQLCryptoStore) FilterTrackedUsers(users []id.UserID) []id.UserID {
 	var rows *sql.Rows
 	var err error
 	if store.Dialect == "postgres" && PostgresArrayWrapper != nil {
-		rows, err = store.DB.Query("SELECT user_id FROM crypto_tracked_user WHERE user_id = ANY($1)", PostgresArrayWrapper(users))
+		rows, err = store.query("SELECT user_id FROM crypto_tracked_user WHERE user_id = ANY($1)", PostgresArrayWrapper(users))
 	} else {
 		queryString := make([]string, len(users))
 		params := make([]interface{}, len(users))
@@ -608,9 +1028,48 @@ func (store *SQLCryptoStore) FilterTrackedUsers(users []id.UserID) []id.UserID {
 	return users[:ptr]
 }
 
+// MarkTrackedUsersOutdated flags the device lists of the given users as outdated. Untracked users are ignored.
+func (store *SQLCryptoStore) MarkTrackedUsersOutdated(users []id.UserID) error {
+	if len(users) == 0 {
+		return nil
+	}
+	var err error
+	if store.Dialect == "postgres" && PostgresArrayWrapper != nil {
+		_, err = store.exec("UPDATE crypto_tracked_user SET devices_outdated=true WHERE user_id = ANY($1)", PostgresArrayWrapper(users))
+	} else {
+		queryString := make([]string, len(users))
+		params := make([]interface{}, len(users))
+		for i, user := range users {
+			queryString[i] = fmt.Sprintf("$%d", i+1)
+			params[i] = user
+		}
+		_, err = store.DB.Exec("UPDATE crypto_tracked_user SET devices_outdated=true WHERE user_id IN ("+strings.Join(queryString, ",")+")", params...)
+	}
+	return err
+}
+
+// GetOutdatedTrackedUsers returns the users whose device lists have been flagged as outdated.
+func (store *SQLCryptoStore) GetOutdatedTrackedUsers() ([]id.UserID, error) {
+	rows, err := store.query("SELECT user_id FROM crypto_tracked_user WHERE devices_outdated=true")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []id.UserID
+	for rows.Next() {
+		var userID id.UserID
+		err = rows.Scan(&userID)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, userID)
+	}
+	return users, rows.Err()
+}
+
 // PutCrossSigningKey stores a cross-signing key of some user along with its usage.
 func (store *SQLCryptoStore) PutCrossSigningKey(userID id.UserID, usage id.CrossSigningUsage, key id.Ed25519) error {
-	_, err := store.DB.Exec(`
+	_, err := store.exec(`
 		INSERT INTO crypto_cross_signing_keys (user_id, usage, key) VALUES ($1, $2, $3)
 		ON CONFLICT (user_id, usage) DO UPDATE SET key=excluded.key
 	`, userID, usage, key)
@@ -619,7 +1078,7 @@ func (store *SQLCryptoStore) PutCrossSigningKey(userID id.UserID, usage id.Cross
 
 // GetCrossSigningKeys retrieves a user's stored cross-signing keys.
 func (store *SQLCryptoStore) GetCrossSigningKeys(userID id.UserID) (map[id.CrossSigningUsage]id.Ed25519, error) {
-	rows, err := store.DB.Query("SELECT usage, key FROM crypto_cross_signing_keys WHERE user_id=$1", userID)
+	rows, err := store.query("SELECT usage, key FROM crypto_cross_signing_keys WHERE user_id=$1", userID)
 	if err != nil {
 		return nil, err
 	}
@@ -639,7 +1098,7 @@ func (store *SQLCryptoStore) GetCrossSigningKeys(userID id.UserID) (map[id.Cross
 
 // PutSignature stores a signature of a cross-signing or device key along with the signer's user ID and key.
 func (store *SQLCryptoStore) PutSignature(signedUserID id.UserID, signedKey id.Ed25519, signerUserID id.UserID, signerKey id.Ed25519, signature string) error {
-	_, err := store.DB.Exec(`
+	_, err := store.exec(`
 		INSERT INTO crypto_cross_signing_signatures (signed_user_id, signed_key, signer_user_id, signer_key, signature) VALUES ($1, $2, $3, $4, $5)
 		ON CONFLICT (signed_user_id, signed_key, signer_user_id, signer_key) DO UPDATE SET signature=excluded.signature
 	`, signedUserID, signedKey, signerUserID, signerKey, signature)
@@ -648,7 +1107,7 @@ func (store *SQLCryptoStore) PutSignature(signedUserID id.UserID, signedKey id.E
 
 // GetSignaturesForKeyBy retrieves the stored signatures for a given cross-signing or device key, by the given signer.
 func (store *SQLCryptoStore) GetSignaturesForKeyBy(userID id.UserID, key id.Ed25519, signerID id.UserID) (map[id.Ed25519]string, error) {
-	rows, err := store.DB.Query("SELECT signer_key, signature FROM crypto_cross_signing_signatures WHERE signed_user_id=$1 AND signed_key=$2 AND signer_user_id=$3", userID, key, signerID)
+	rows, err := store.query("SELECT signer_key, signature FROM crypto_cross_signing_signatures WHERE signed_user_id=$1 AND signed_key=$2 AND signer_user_id=$3", userID, key, signerID)
 	if err != nil {
 		return nil, err
 	}
@@ -676,9 +1135,29 @@ func (store *SQLCryptoStore) IsKeySignedBy(userID id.UserID, key id.Ed25519, sig
 	return ok, nil
 }
 
+// GetKeysSignedBy retrieves the cross-signing and device keys signed by the given signer, grouped by the owner of the signed key.
+func (store *SQLCryptoStore) GetKeysSignedBy(signerID id.UserID, signerKey id.Ed25519) (map[id.UserID][]id.Ed25519, error) {
+	rows, err := store.query("SELECT signed_user_id, signed_key FROM crypto_cross_signing_signatures WHERE signer_user_id=$1 AND signer_key=$2", signerID, signerKey)
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[id.UserID][]id.Ed25519)
+	for rows.Next() {
+		var userID id.UserID
+		var key id.Ed25519
+		err := rows.Scan(&userID, &key)
+		if err != nil {
+			return nil, err
+		}
+		data[userID] = append(data[userID], key)
+	}
+
+	return data, nil
+}
+
 // DropSignaturesByKey deletes the signatures made by the given user and key from the store. It returns the number of signatures deleted.
 func (store *SQLCryptoStore) DropSignaturesByKey(userID id.UserID, key id.Ed25519) (int64, error) {
-	res, err := store.DB.Exec("DELETE FROM crypto_cross_signing_signatures WHERE signer_user_id=$1 AND signer_key=$2", userID, key)
+	res, err := store.exec("DELETE FROM crypto_cross_signing_signatures WHERE signer_user_id=$1 AND signer_key=$2", userID, key)
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// PostgresPoolConfig contains the connection pool settings applied to the database by NewPostgresCryptoStore.
+// Zero values leave the corresponding database/sql setting unchanged.
+type PostgresPoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// DefaultPostgresPoolConfig is a reasonable pool configuration for a process that serves many users.
+var DefaultPostgresPoolConfig = PostgresPoolConfig{
+	MaxOpenConns:    25,
+	MaxIdleConns:    10,
+	ConnMaxLifetime: 30 * time.Minute,
+}
+
+// Apply applies the pool settings to the given database.
+func (cfg PostgresPoolConfig) Apply(db *sql.DB) {
+	if cfg.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	}
+}
+
+// NewPostgresCryptoStore creates a crypto store backed by PostgreSQL. The database must be opened by the caller
+// with a PostgreSQL driver (e.g. lib/pq or pgx), which allows the same *sql.DB to be shared by several stores:
+// each store only accesses the rows of its own account ID.
+//
+// The given pool settings are applied to the database, statements are prepared once and reused, and all pending
+// migrations are applied before returning. PostgresArrayWrapper should be set (e.g. to pq.Array) so that
+// queries with lists of users can be done with a single array parameter.
+func NewPostgresCryptoStore(db *sql.DB, pool PostgresPoolConfig, accountID string, deviceID id.DeviceID, pickleKey []byte, log Logger) (*SQLCryptoStore, error) {
+	pool.Apply(db)
+	store := NewSQLCryptoStore(db, "postgres", accountID, deviceID, pickleKey, log)
+	store.PrepareStatements = true
+	err := store.CreateTables()
+	if err != nil {
+		return nil, fmt.Errorf("failed to upgrade database: %w", err)
+	}
+	if PostgresArrayWrapper == nil {
+		log.Warn("PostgresArrayWrapper is not set, device list queries will use one parameter per user")
+	}
+	return store, nil
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+var ErrStoreClosed = errors.New("crypto store is closed")
+
+// SQLiteConfig contains the settings used by NewSQLiteCryptoStore.
+type SQLiteConfig struct {
+	// BusyTimeout is how long a connection waits for a lock held by another connection before failing.
+	BusyTimeout time.Duration
+	// WriteBatchSize is the maximum number of writes committed in a single transaction. Values below 2 disable
+	// batching, which means that every write is committed separately.
+	WriteBatchSize int
+	// WriteBatchDelay is how long the first write of a batch waits for more writes before committing. Even with
+	// no delay, writes that arrive while the previous batch is being committed are grouped into the next batch.
+	WriteBatchDelay time.Duration
+}
+
+// DefaultSQLiteConfig is the default configuration for NewSQLiteCryptoStore.
+var DefaultSQLiteConfig = SQLiteConfig{
+	BusyTimeout:    5 * time.Second,
+	WriteBatchSize: 100,
+}
+
+// DSN returns a data source name for the github.com/mattn/go-sqlite3 driver that opens the database at the given
+// path in WAL mode with the configured busy timeout. Transactions use BEGIN IMMEDIATE, so that concurrent writers
+// wait for the busy timeout instead of failing when upgrading a read lock to a write lock.
+func (cfg SQLiteConfig) DSN(path string) string {
+	params := url.Values{}
+	params.Set("_journal_mode", "WAL")
+	params.Set("_synchronous", "NORMAL")
+	params.Set("_busy_timeout", fmt.Sprintf("%d", cfg.BusyTimeout.Milliseconds()))
+	params.Set("_txlock", "immediate")
+	separator := "?"
+	if strings.ContainsRune(path, '?') {
+		separator = "&"
+	}
+	return "file:" + path + separator + params.Encode()
+}
+
+// NewSQLiteCryptoStore opens the SQLite database at the given path, applies pending migrations and returns a crypto
+// store using it. The github.com/mattn/go-sqlite3 driver must be registered by importing it.
+//
+// The database uses WAL mode, so reads don't block on writes. Unless disabled in the config, writes are batched
+// so that concurrent writes (e.g. one-time keys and sessions being stored while handling a sync) are committed in
+// a single transaction instead of each waiting for the database lock separately. Writes still block until they've
+// been committed. The database is closed when the store is closed.
+func NewSQLiteCryptoStore(path string, cfg SQLiteConfig, accountID string, deviceID id.DeviceID, pickleKey []byte, log Logger) (*SQLCryptoStore, error) {
+	db, err := sql.Open("sqlite3", cfg.DSN(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	store := NewSQLCryptoStore(db, "sqlite3", accountID, deviceID, pickleKey, log)
+	store.ownsDB = true
+	store.SQLiteLockFile = sqliteLockFilePath(path)
+	var journalMode string
+	err = db.QueryRow("PRAGMA journal_mode").Scan(&journalMode)
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to check journal mode: %w", err)
+	} else if !strings.EqualFold(journalMode, "wal") {
+		log.Warn("SQLite database at %s is using journal mode %s instead of WAL", path, journalMode)
+	}
+	err = store.CreateTables()
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to upgrade database: %w", err)
+	}
+	if cfg.WriteBatchSize > 1 {
+		store.EnableWriteBatching(cfg.WriteBatchSize, cfg.WriteBatchDelay)
+	}
+	return store, nil
+}
+
+// EnableWriteBatching makes the store commit writes in batches of up to maxSize statements. See SQLiteConfig for
+// the meaning of the parameters. Batching is stopped by Close.
+//
+// Statements in a batch don't affect each other if they fail, which is only true for SQLite: in PostgreSQL,
+// a failed statement aborts the whole transaction, so batching should not be used there.
+func (store *SQLCryptoStore) EnableWriteBatching(maxSize int, maxDelay time.Duration) {
+	batcher := &sqlWriteBatcher{
+		db:       store.DB,
+		maxSize:  maxSize,
+		maxDelay: maxDelay,
+		queue:    make(chan *batchedWrite, maxSize),
+		done:     make(chan struct{}),
+	}
+	go batcher.run()
+	store.writeBatcher = batcher
+}
+
+type batchedWrite struct {
+	query  string
+	args   []interface{}
+	result sql.Result
+	err    error
+	done   chan struct{}
+}
+
+type sqlWriteBatcher struct {
+	db       *sql.DB
+	maxSize  int
+	maxDelay time.Duration
+	queue    chan *batchedWrite
+	done     chan struct{}
+
+	closed     bool
+	closedLock sync.RWMutex
+}
+
+func (b *sqlWriteBatcher) exec(query string, args ...interface{}) (sql.Result, error) {
+	write := &batchedWrite{query: query, args: args, done: make(chan struct{})}
+	b.closedLock.RLock()
+	if b.closed {
+		b.closedLock.RUnlock()
+		return nil, ErrStoreClosed
+	}
+	b.queue <- write
+	b.closedLock.RUnlock()
+	<-write.done
+	return write.result, write.err
+}
+
+func (b *sqlWriteBatcher) close() {
+	b.closedLock.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.closedLock.Unlock()
+	<-b.done
+}
+
+func (b *sqlWriteBatcher) run() {
+	defer close(b.done)
+	batch := make([]*batchedWrite, 0, b.maxSize)
+	for first := range b.queue {
+		batch = append(batch[:0], first)
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if b.maxDelay > 0 {
+			timer = time.NewTimer(b.maxDelay)
+			timeout = timer.C
+		}
+		for len(batch) < b.maxSize {
+			write, ok := b.next(timeout)
+			if !ok {
+				break
+			}
+			batch = append(batch, write)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		b.commit(batch)
+	}
+}
+
+// next returns the next queued write, waiting until the timeout for one to arrive. If the timeout is nil,
+// only writes that are already queued are returned.
+func (b *sqlWriteBatcher) next(timeout <-chan time.Time) (*batchedWrite, bool) {
+	if timeout == nil {
+		select {
+		case write, ok := <-b.queue:
+			return write, ok
+		default:
+			return nil, false
+		}
+	}
+	select {
+	case write, ok := <-b.queue:
+		return write, ok
+	case <-timeout:
+		return nil, false
+	}
+}
+
+func (b *sqlWriteBatcher) commit(batch []*batchedWrite) {
+	defer func() {
+		for _, write := range batch {
+			close(write.done)
+		}
+	}()
+	tx, err := b.db.Begin()
+	if err != nil {
+		for _, write := range batch {
+			write.err = fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		return
+	}
+	for _, write := range batch {
+		write.result, write.err = tx.Exec(write.query, write.args...)
+	}
+	if err = tx.Commit(); err != nil {
+		for _, write := range batch {
+			if write.err == nil {
+				write.result, write.err = nil, fmt.Errorf("failed to commit transaction: %w", err)
+			}
+		}
+	}
+}
@@ -11,6 +11,9 @@ type upgradeFunc func(*sql.Tx, string) error
 
 var ErrUnknownDialect = errors.New("unknown dialect")
 
+// ErrUnsupportedVersion is returned by Upgrade if the database was created by a newer version of mautrix-go.
+var ErrUnsupportedVersion = errors.New("unsupported crypto store schema version")
+
 var Upgrades = [...]upgradeFunc{
 	func(tx *sql.Tx, _ string) error {
 		for _, query := range []string{
@@ -298,6 +301,28 @@ var Upgrades = [...]upgradeFunc{
 		}
 		return nil
 	},
+	func(tx *sql.Tx, dialect string) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS crypto_user_trust_settings (
+			account_id               TEXT    NOT NULL,
+			user_id                  TEXT    NOT NULL,
+			allow_unverified_devices BOOLEAN,
+			trust_on_first_use       BOOLEAN NOT NULL,
+			PRIMARY KEY (account_id, user_id)
+		)`)
+		return err
+	},
+	func(tx *sql.Tx, dialect string) error {
+		_, err := tx.Exec("ALTER TABLE crypto_megolm_inbound_session ADD COLUMN key_source TEXT NOT NULL DEFAULT ''")
+		return err
+	},
+	func(tx *sql.Tx, dialect string) error {
+		_, err := tx.Exec("ALTER TABLE crypto_tracked_user ADD COLUMN devices_outdated BOOLEAN NOT NULL DEFAULT false")
+		return err
+	},
+	func(tx *sql.Tx, dialect string) error {
+		_, err := tx.Exec("ALTER TABLE crypto_megolm_inbound_session ADD COLUMN key_backup_version TEXT NOT NULL DEFAULT ''")
+		return err
+	},
 }
 
 // GetVersion returns the current version of the DB schema.
@@ -325,11 +350,19 @@ func SetVersion(tx *sql.Tx, version int) error {
 	return err
 }
 
+// LatestVersion is the schema version that Upgrade brings databases to.
+const LatestVersion = len(Upgrades)
+
 // Upgrade upgrades the database from the current to the latest version available.
+//
+// If the database has a newer schema version than this version of mautrix-go knows about, Upgrade doesn't touch
+// the database and returns an error wrapping ErrUnsupportedVersion.
 func Upgrade(db *sql.DB, dialect string) error {
 	version, err := GetVersion(db)
 	if err != nil {
 		return err
+	} else if version > LatestVersion {
+		return fmt.Errorf("%w: database is at v%d, but only up to v%d is supported", ErrUnsupportedVersion, version, LatestVersion)
 	}
 
 	// perform migrations starting with #version
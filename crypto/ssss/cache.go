@@ -0,0 +1,91 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ssss
+
+import (
+	"crypto/sha256"
+	"sync"
+
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/event"
+)
+
+// secretCacheKey identifies a cached secret. It includes a hash of the key material rather than just the key ID,
+// so that a cached secret is only returned for the same key that decrypted it.
+type secretCacheKey struct {
+	eventType string
+	keyID     string
+	keyHash   [sha256.Size]byte
+}
+
+func newSecretCacheKey(eventType event.Type, key *Key) secretCacheKey {
+	return secretCacheKey{eventType: eventType.Type, keyID: key.ID, keyHash: sha256.Sum256(key.Key.Bytes())}
+}
+
+// secretCache stores decrypted secrets in memory, so that they don't need to be fetched and decrypted again on every use.
+type secretCache struct {
+	lock    sync.Mutex
+	secrets map[secretCacheKey][]byte
+}
+
+func (cache *secretCache) get(eventType event.Type, key *Key) ([]byte, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	data, ok := cache.secrets[newSecretCacheKey(eventType, key)]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, data...), true
+}
+
+func (cache *secretCache) put(eventType event.Type, key *Key, data []byte) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.secrets == nil {
+		cache.secrets = make(map[secretCacheKey][]byte)
+	}
+	cacheKey := newSecretCacheKey(eventType, key)
+	if old, ok := cache.secrets[cacheKey]; ok {
+		utils.WipeBytes(old)
+	}
+	cache.secrets[cacheKey] = append([]byte{}, data...)
+}
+
+func (cache *secretCache) invalidate(eventType string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for key, data := range cache.secrets {
+		if key.eventType == eventType {
+			utils.WipeBytes(data)
+			delete(cache.secrets, key)
+		}
+	}
+}
+
+func (cache *secretCache) clear() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for key, data := range cache.secrets {
+		utils.WipeBytes(data)
+		delete(cache.secrets, key)
+	}
+}
+
+// HandleAccountDataEvents invalidates cached secrets whose account data changed. This should be called with the
+// global account data events of every sync response, which OlmMachine.ProcessSyncResponse does automatically.
+func (mach *Machine) HandleAccountDataEvents(events []*event.Event) {
+	for _, evt := range events {
+		if evt != nil {
+			mach.cache.invalidate(evt.Type.Type)
+		}
+	}
+}
+
+// ClearSecretCache wipes all decrypted secrets cached in memory. This should be called when logging out.
+func (mach *Machine) ClearSecretCache() {
+	mach.cache.clear()
+}
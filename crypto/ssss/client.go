@@ -7,15 +7,22 @@
 package ssss
 
 import (
+	"errors"
 	"fmt"
 
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/utils"
 	"maunium.net/go/mautrix/event"
 )
 
 // Machine contains utility methods for interacting with SSSS data on the server.
+//
+// Decrypted secrets are cached in memory. The cache is invalidated when the account data of a secret is changed
+// through the Machine or in a sync (see HandleAccountDataEvents), and can be cleared with ClearSecretCache.
 type Machine struct {
 	Client *mautrix.Client
+
+	cache secretCache
 }
 
 func NewSSSSMachine(client *mautrix.Client) *Machine {
@@ -33,7 +40,7 @@ func (mach *Machine) GetDefaultKeyID() (string, error) {
 	var data DefaultSecretStorageKeyContent
 	err := mach.Client.GetAccountData(event.AccountDataSecretStorageDefaultKey.Type, &data)
 	if err != nil {
-		if httpErr, ok := err.(mautrix.HTTPError); ok && httpErr.RespError != nil && httpErr.RespError.ErrCode == "M_NOT_FOUND" {
+		if errors.Is(err, mautrix.MNotFound) {
 			return "", ErrNoDefaultKeyAccountDataEvent
 		}
 		return "", fmt.Errorf("failed to get default key account data from server: %w", err)
@@ -71,14 +78,40 @@ func (mach *Machine) GetDefaultKeyData() (keyID string, keyData *KeyMetadata, er
 	return
 }
 
+// DeleteKeyData removes the metadata of the given key from the server. Account data can't be deleted entirely,
+// so the event content is replaced with an empty object, which clients treat as a nonexistent key.
+func (mach *Machine) DeleteKeyData(keyID string) error {
+	return mach.Client.SetAccountData(fmt.Sprintf("%s.%s", event.AccountDataSecretStorageKey.Type, keyID), struct{}{})
+}
+
+// GetEncryptedAccountData gets the account data event with the given event type without decrypting it.
+// The Encrypted map of the returned content has an entry for each key ID that the data is encrypted with.
+func (mach *Machine) GetEncryptedAccountData(eventType event.Type) (*EncryptedAccountDataEventContent, error) {
+	var encData EncryptedAccountDataEventContent
+	err := mach.Client.GetAccountData(eventType.Type, &encData)
+	if err != nil {
+		return nil, err
+	}
+	return &encData, nil
+}
+
 // GetDecryptedAccountData gets the account data event with the given event type and decrypts it using the given key.
+// The returned slice is a copy that the caller may wipe after use.
 func (mach *Machine) GetDecryptedAccountData(eventType event.Type, key *Key) ([]byte, error) {
+	if data, ok := mach.cache.get(eventType, key); ok {
+		return data, nil
+	}
 	var encData EncryptedAccountDataEventContent
 	err := mach.Client.GetAccountData(eventType.Type, &encData)
 	if err != nil {
 		return nil, err
 	}
-	return encData.Decrypt(eventType.Type, key)
+	data, err := encData.Decrypt(eventType.Type, key)
+	if err != nil {
+		return nil, err
+	}
+	mach.cache.put(eventType, key, data)
+	return data, nil
 }
 
 // SetEncryptedAccountData encrypts the given data with the given keys and stores it on the server.
@@ -90,7 +123,9 @@ func (mach *Machine) SetEncryptedAccountData(eventType event.Type, data []byte,
 	for _, key := range keys {
 		encrypted[key.ID] = key.Encrypt(eventType.Type, data)
 	}
-	return mach.Client.SetAccountData(eventType.Type, &EncryptedAccountDataEventContent{Encrypted: encrypted})
+	err := mach.Client.SetAccountData(eventType.Type, &EncryptedAccountDataEventContent{Encrypted: encrypted})
+	mach.cache.invalidate(eventType.Type)
+	return err
 }
 
 // GenerateAndUploadKey generates a new SSSS key and stores the metadata on the server.
@@ -106,3 +141,68 @@ func (mach *Machine) GenerateAndUploadKey(passphrase string) (key *Key, err erro
 	}
 	return key, err
 }
+
+// SecretEventTypes are the account data event types of secrets known to be stored in SSSS. This is the default
+// list of secrets that are re-encrypted by MigrateDefaultKey.
+var SecretEventTypes = []event.Type{
+	event.AccountDataCrossSigningMaster,
+	event.AccountDataCrossSigningSelf,
+	event.AccountDataCrossSigningUser,
+	event.AccountDataMegolmBackupKey,
+}
+
+// ReEncryptAccountData decrypts the given account data event with oldKey and encrypts it with newKey. Encryptions
+// for other keys are kept as-is, which means the data can be encrypted with multiple keys at the same time.
+// If removeOld is true, the encryption for oldKey is removed.
+func (mach *Machine) ReEncryptAccountData(eventType event.Type, oldKey, newKey *Key, removeOld bool) error {
+	if oldKey.ID == newKey.ID {
+		return ErrSameKey
+	}
+	encData, err := mach.GetEncryptedAccountData(eventType)
+	if err != nil {
+		return err
+	}
+	data, err := encData.Decrypt(eventType.Type, oldKey)
+	if err != nil {
+		return err
+	}
+	defer utils.WipeBytes(data)
+	encData.Encrypted[newKey.ID] = newKey.Encrypt(eventType.Type, data)
+	if removeOld {
+		delete(encData.Encrypted, oldKey.ID)
+	}
+	err = mach.Client.SetAccountData(eventType.Type, encData)
+	mach.cache.invalidate(eventType.Type)
+	return err
+}
+
+// MigrateDefaultKey moves secrets from oldKey to newKey, e.g. when the user changes their recovery passphrase.
+//
+// Each of the given account data event types (or SecretEventTypes if none are given) that is encrypted with
+// oldKey is re-encrypted with newKey and the old encryption is removed. Secrets that don't exist or aren't
+// encrypted with oldKey are skipped. After that, newKey is made the default key and the metadata of oldKey is
+// deleted. The metadata of newKey must already be on the server (e.g. by creating it with GenerateAndUploadKey).
+func (mach *Machine) MigrateDefaultKey(oldKey, newKey *Key, eventTypes ...event.Type) error {
+	if oldKey.ID == newKey.ID {
+		return ErrSameKey
+	} else if len(eventTypes) == 0 {
+		eventTypes = SecretEventTypes
+	}
+	for _, eventType := range eventTypes {
+		err := mach.ReEncryptAccountData(eventType, oldKey, newKey, true)
+		if errors.Is(err, mautrix.MNotFound) || errors.Is(err, ErrNotEncryptedForKey) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to re-encrypt %s: %w", eventType.Type, err)
+		}
+	}
+	err := mach.SetDefaultKeyID(newKey.ID)
+	if err != nil {
+		return fmt.Errorf("failed to set default key: %w", err)
+	}
+	err = mach.DeleteKeyData(oldKey.ID)
+	if err != nil {
+		return fmt.Errorf("failed to delete old key: %w", err)
+	}
+	return nil
+}
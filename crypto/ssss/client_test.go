@@ -0,0 +1,137 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ssss_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/ssss"
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/event"
+)
+
+func newAccountDataServer(t *testing.T) (*ssss.Machine, map[string]json.RawMessage) {
+	accountData := make(map[string]json.RawMessage)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		evtType := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		if r.Method == http.MethodGet {
+			data, ok := accountData[evtType]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "not found"}`))
+				return
+			}
+			_, _ = w.Write(data)
+			return
+		}
+		var data json.RawMessage
+		_ = json.NewDecoder(r.Body).Decode(&data)
+		accountData[evtType] = data
+		_, _ = w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+	client, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	return ssss.NewSSSSMachine(client), accountData
+}
+
+func TestMachine_MigrateDefaultKey(t *testing.T) {
+	mach, accountData := newAccountDataServer(t)
+	oldKey := getKey1()
+	otherKey := getKey2()
+	newKey, err := mach.GenerateAndUploadKey("")
+	require.NoError(t, err)
+	require.NoError(t, mach.SetKeyData(oldKey.ID, oldKey.Metadata))
+	require.NoError(t, mach.SetDefaultKeyID(oldKey.ID))
+	require.NoError(t, mach.SetEncryptedAccountData(event.AccountDataCrossSigningMaster, []byte("master"), oldKey, otherKey))
+	require.NoError(t, mach.SetEncryptedAccountData(event.AccountDataCrossSigningSelf, []byte("self"), otherKey))
+
+	require.NoError(t, mach.MigrateDefaultKey(oldKey, newKey))
+
+	defaultKeyID, err := mach.GetDefaultKeyID()
+	require.NoError(t, err)
+	assert.Equal(t, newKey.ID, defaultKeyID)
+	assert.JSONEq(t, "{}", string(accountData[event.AccountDataSecretStorageKey.Type+"."+oldKey.ID]))
+
+	master, err := mach.GetEncryptedAccountData(event.AccountDataCrossSigningMaster)
+	require.NoError(t, err)
+	assert.Len(t, master.Encrypted, 2)
+	_, err = master.Decrypt(event.AccountDataCrossSigningMaster.Type, oldKey)
+	assert.ErrorIs(t, err, ssss.ErrNotEncryptedForKey)
+	for _, key := range []*ssss.Key{newKey, otherKey} {
+		data, err := master.Decrypt(event.AccountDataCrossSigningMaster.Type, key)
+		require.NoError(t, err)
+		assert.Equal(t, "master", string(data))
+	}
+
+	// Secrets that weren't encrypted with the old key are left alone
+	self, err := mach.GetEncryptedAccountData(event.AccountDataCrossSigningSelf)
+	require.NoError(t, err)
+	assert.Len(t, self.Encrypted, 1)
+	_, err = self.Decrypt(event.AccountDataCrossSigningSelf.Type, newKey)
+	assert.ErrorIs(t, err, ssss.ErrNotEncryptedForKey)
+}
+
+func TestMachine_MigrateDefaultKey_SameKey(t *testing.T) {
+	mach, _ := newAccountDataServer(t)
+	key := getKey1()
+	assert.ErrorIs(t, mach.MigrateDefaultKey(key, key), ssss.ErrSameKey)
+}
+
+func TestMachine_SecretCache(t *testing.T) {
+	mach, accountData := newAccountDataServer(t)
+	key := getKey1()
+	require.NoError(t, mach.SetEncryptedAccountData(event.AccountDataMegolmBackupKey, []byte("backup key"), key))
+
+	data, err := mach.GetDecryptedAccountData(event.AccountDataMegolmBackupKey, key)
+	require.NoError(t, err)
+	assert.Equal(t, "backup key", string(data))
+	// Wiping the returned data must not affect the cache
+	copy(data, make([]byte, len(data)))
+
+	// The cached value is used even if the data on the server changes without the machine knowing about it
+	delete(accountData, event.AccountDataMegolmBackupKey.Type)
+	data, err = mach.GetDecryptedAccountData(event.AccountDataMegolmBackupKey, key)
+	require.NoError(t, err)
+	assert.Equal(t, "backup key", string(data))
+
+	// Cached secrets aren't returned for a different key with the same ID
+	wrongKey := &ssss.Key{ID: key.ID, Key: utils.NewSecretBytes(make([]byte, 32)), Metadata: key.Metadata}
+	_, err = mach.GetDecryptedAccountData(event.AccountDataMegolmBackupKey, wrongKey)
+	assert.ErrorIs(t, err, mautrix.MNotFound)
+	require.NoError(t, mach.SetEncryptedAccountData(event.AccountDataMegolmBackupKey, []byte("backup key"), key))
+	_, err = mach.GetDecryptedAccountData(event.AccountDataMegolmBackupKey, wrongKey)
+	assert.Error(t, err)
+	data, err = mach.GetDecryptedAccountData(event.AccountDataMegolmBackupKey, key)
+	require.NoError(t, err)
+	assert.Equal(t, "backup key", string(data))
+	delete(accountData, event.AccountDataMegolmBackupKey.Type)
+
+	// Account data from sync invalidates the cache
+	mach.HandleAccountDataEvents([]*event.Event{{Type: event.AccountDataMegolmBackupKey}})
+	_, err = mach.GetDecryptedAccountData(event.AccountDataMegolmBackupKey, key)
+	assert.ErrorIs(t, err, mautrix.MNotFound)
+
+	// Setting the data through the machine invalidates the cache
+	require.NoError(t, mach.SetEncryptedAccountData(event.AccountDataMegolmBackupKey, []byte("new key"), key))
+	data, err = mach.GetDecryptedAccountData(event.AccountDataMegolmBackupKey, key)
+	require.NoError(t, err)
+	assert.Equal(t, "new key", string(data))
+
+	mach.ClearSecretCache()
+	delete(accountData, event.AccountDataMegolmBackupKey.Type)
+	_, err = mach.GetDecryptedAccountData(event.AccountDataMegolmBackupKey, key)
+	assert.ErrorIs(t, err, mautrix.MNotFound)
+}
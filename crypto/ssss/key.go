@@ -7,7 +7,6 @@
 package ssss
 
 import (
-	"crypto/rand"
 	"encoding/base64"
 	"fmt"
 	"strings"
@@ -17,15 +16,25 @@ import (
 
 // Key represents a SSSS private key and related metadata.
 type Key struct {
-	ID       string       `json:"-"`
-	Key      []byte       `json:"-"`
-	Metadata *KeyMetadata `json:"-"`
+	ID       string             `json:"-"`
+	Key      *utils.SecretBytes `json:"-"`
+	Metadata *KeyMetadata       `json:"-"`
 }
 
+// DefaultPBKDF2Iterations is the number of PBKDF2 iterations used for new passphrase-based keys.
+// utils.CalibratePBKDF2 can be used to choose a value based on the speed of the current host.
+var DefaultPBKDF2Iterations = 500000
+
 // NewKey generates a new SSSS key, optionally based on the given passphrase.
 //
 // Errors are only returned if crypto/rand runs out of randomness.
 func NewKey(passphrase string) (*Key, error) {
+	return NewKeyWithPassphraseAlgorithm(passphrase, PassphraseAlgorithmPBKDF2)
+}
+
+// NewKeyWithPassphraseAlgorithm generates a new SSSS key like NewKey, but allows choosing the KDF algorithm
+// that is used to derive the key from the passphrase. The algorithm is ignored if the passphrase is empty.
+func NewKeyWithPassphraseAlgorithm(passphrase string, algorithm PassphraseAlgorithm) (*Key, error) {
 	// We don't support any other algorithms currently.
 	keyData := KeyMetadata{Algorithm: AlgorithmAESHMACSHA2}
 
@@ -34,14 +43,21 @@ func NewKey(passphrase string) (*Key, error) {
 		// There's a passphrase. We need to generate a salt for it, set the metadata
 		// and then compute the key using the passphrase and the metadata.
 		saltBytes := make([]byte, 24)
-		if _, err := rand.Read(saltBytes); err != nil {
+		if _, err := utils.ReadRandom(saltBytes); err != nil {
 			return nil, fmt.Errorf("failed to get random bytes for salt: %w", err)
 		}
 		keyData.Passphrase = &PassphraseMetadata{
-			Algorithm:  PassphraseAlgorithmPBKDF2,
-			Iterations: 500000,
-			Salt:       base64.StdEncoding.EncodeToString(saltBytes),
-			Bits:       256,
+			Algorithm: algorithm,
+			Salt:      base64.StdEncoding.EncodeToString(saltBytes),
+			Bits:      256,
+		}
+		switch algorithm {
+		case PassphraseAlgorithmPBKDF2:
+			keyData.Passphrase.Iterations = DefaultPBKDF2Iterations
+		case PassphraseAlgorithmArgon2id:
+			keyData.Passphrase.Iterations = utils.DefaultArgon2idTime
+			keyData.Passphrase.Memory = utils.DefaultArgon2idMemory
+			keyData.Passphrase.Parallelism = utils.DefaultArgon2idThreads
 		}
 		var err error
 		ssssKey, err = keyData.Passphrase.GetKey(passphrase)
@@ -51,40 +67,52 @@ func NewKey(passphrase string) (*Key, error) {
 	} else {
 		// No passphrase, just generate a random key
 		ssssKey = make([]byte, 32)
-		if _, err := rand.Read(ssssKey); err != nil {
+		if _, err := utils.ReadRandom(ssssKey); err != nil {
 			return nil, fmt.Errorf("failed to get random bytes for key: %w", err)
 		}
 	}
 
 	// Generate a random ID for the key. It's what identifies the key in account data.
 	keyIDBytes := make([]byte, 24)
-	if _, err := rand.Read(keyIDBytes); err != nil {
+	if _, err := utils.ReadRandom(keyIDBytes); err != nil {
 		return nil, fmt.Errorf("failed to get random bytes for key ID: %w", err)
 	}
 
 	// We store a certain hash in the key metadata so that clients can check if the user entered the correct key.
 	var ivBytes [utils.AESCTRIVLength]byte
-	if _, err := rand.Read(ivBytes[:]); err != nil {
+	if _, err := utils.ReadRandom(ivBytes[:]); err != nil {
 		return nil, fmt.Errorf("failed to get random bytes for IV: %w", err)
 	}
 	keyData.IV = base64.StdEncoding.EncodeToString(ivBytes[:])
 	keyData.MAC = keyData.calculateHash(ssssKey)
 
 	return &Key{
-		Key:      ssssKey,
+		Key:      utils.NewSecretBytes(ssssKey),
 		ID:       base64.StdEncoding.EncodeToString(keyIDBytes),
 		Metadata: &keyData,
 	}, nil
 }
 
+// Wipe zeroes the private key. The key can't be used for encrypting or decrypting after this.
+func (key *Key) Wipe() {
+	key.Key.Wipe()
+}
+
 // RecoveryKey gets the recovery key for this SSSS key.
 func (key *Key) RecoveryKey() string {
-	return utils.EncodeBase58RecoveryKey(key.Key)
+	return utils.EncodeBase58RecoveryKey(key.Key.Bytes())
+}
+
+// MnemonicRecoveryKey gets the recovery key for this SSSS key as a 24-word mnemonic.
+func (key *Key) MnemonicRecoveryKey() (string, error) {
+	return utils.EncodeMnemonicRecoveryKey(key.Key.Bytes())
 }
 
 // Encrypt encrypts the given data with this key.
 func (key *Key) Encrypt(eventType string, data []byte) EncryptedKeyData {
-	aesKey, hmacKey := utils.DeriveKeysSHA256(key.Key, eventType)
+	aesKey, hmacKey := utils.DeriveKeysSHA256(key.Key.Bytes(), eventType)
+	defer utils.WipeBytes(aesKey[:])
+	defer utils.WipeBytes(hmacKey[:])
 
 	iv := utils.GenA256CTRIV()
 	payload := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
@@ -110,7 +138,9 @@ func (key *Key) Decrypt(eventType string, data EncryptedKeyData) ([]byte, error)
 	}
 
 	// derive the AES and HMAC keys for the requested event type using the SSSS key
-	aesKey, hmacKey := utils.DeriveKeysSHA256(key.Key, eventType)
+	aesKey, hmacKey := utils.DeriveKeysSHA256(key.Key.Bytes(), eventType)
+	defer utils.WipeBytes(aesKey[:])
+	defer utils.WipeBytes(hmacKey[:])
 
 	// compare the stored MAC with the one we calculated from the ciphertext
 	calcMac := utils.HMACSHA256B64(ciphertextBytes, hmacKey)
@@ -119,6 +149,8 @@ func (key *Key) Decrypt(eventType string, data EncryptedKeyData) ([]byte, error)
 	}
 
 	decrypted := utils.XorA256CTR(ciphertextBytes, aesKey, ivBytes)
-	decryptedDecoded, err := base64.StdEncoding.DecodeString(string(decrypted))
-	return decryptedDecoded, err
+	defer utils.WipeBytes(decrypted)
+	decryptedDecoded := make([]byte, base64.StdEncoding.DecodedLen(len(decrypted)))
+	n, err := base64.StdEncoding.Decode(decryptedDecoded, decrypted)
+	return decryptedDecoded[:n], err
 }
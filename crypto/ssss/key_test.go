@@ -87,3 +87,15 @@ func TestKey_Encrypt(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, data, decrypted)
 }
+
+func TestKey_Wipe(t *testing.T) {
+	key := getKey1()
+	data := key.Key.Bytes()
+	assert.NotEmpty(t, key.RecoveryKey())
+	key.Wipe()
+	assert.Equal(t, make([]byte, len(data)), data)
+	assert.Nil(t, key.Key.Bytes())
+	assert.Equal(t, "<secret>", key.Key.String())
+	// Wiping twice is fine
+	key.Wipe()
+}
@@ -36,23 +36,23 @@ func (kd *KeyMetadata) VerifyPassphrase(passphrase string) (*Key, error) {
 
 	return &Key{
 		ID:       kd.id,
-		Key:      ssssKey,
+		Key:      utils.NewSecretBytes(ssssKey),
 		Metadata: kd,
 	}, nil
 }
 
 // VerifyRecoveryKey verifies that the given recovery key is valid and returns the decoded SSSS key.
 func (kd *KeyMetadata) VerifyRecoveryKey(recoverKey string) (*Key, error) {
-	ssssKey := utils.DecodeBase58RecoveryKey(recoverKey)
-	if ssssKey == nil {
-		return nil, ErrInvalidRecoveryKey
+	ssssKey, err := utils.DecodeRecoveryKey(recoverKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRecoveryKey, err)
 	} else if !kd.VerifyKey(ssssKey) {
 		return nil, ErrIncorrectSSSSKey
 	}
 
 	return &Key{
 		ID:       kd.id,
-		Key:      ssssKey,
+		Key:      utils.NewSecretBytes(ssssKey),
 		Metadata: kd,
 	}, nil
 }
@@ -82,6 +82,21 @@ type PassphraseMetadata struct {
 	Iterations int                 `json:"iterations"`
 	Salt       string              `json:"salt"`
 	Bits       int                 `json:"bits"`
+
+	// Memory (in KiB) and Parallelism are only used by the Argon2id algorithm.
+	Memory      uint32 `json:"memory,omitempty"`
+	Parallelism uint8  `json:"parallelism,omitempty"`
+}
+
+// PassphraseKDFs contains the functions used to create a KDF for each supported passphrase algorithm.
+// Additional algorithms can be registered by adding them to this map.
+var PassphraseKDFs = map[PassphraseAlgorithm]func(pd *PassphraseMetadata) utils.KDF{
+	PassphraseAlgorithmPBKDF2: func(pd *PassphraseMetadata) utils.KDF {
+		return utils.PBKDF2{Iterations: pd.Iterations}
+	},
+	PassphraseAlgorithmArgon2id: func(pd *PassphraseMetadata) utils.KDF {
+		return utils.Argon2id{Time: uint32(pd.Iterations), Memory: pd.Memory, Threads: pd.Parallelism}
+	},
 }
 
 // GetKey gets the SSSS key from the passphrase.
@@ -90,7 +105,8 @@ func (pd *PassphraseMetadata) GetKey(passphrase string) ([]byte, error) {
 		return nil, ErrNoPassphrase
 	}
 
-	if pd.Algorithm != PassphraseAlgorithmPBKDF2 {
+	makeKDF, ok := PassphraseKDFs[pd.Algorithm]
+	if !ok {
 		return nil, fmt.Errorf("%w: %s", ErrUnsupportedPassphraseAlgorithm, pd.Algorithm)
 	}
 
@@ -99,5 +115,5 @@ func (pd *PassphraseMetadata) GetKey(passphrase string) ([]byte, error) {
 		bits = pd.Bits
 	}
 
-	return utils.PBKDF2SHA512([]byte(passphrase), []byte(pd.Salt), pd.Iterations, bits), nil
+	return makeKDF(pd).DeriveKey([]byte(passphrase), []byte(pd.Salt), bits), nil
 }
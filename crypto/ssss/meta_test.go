@@ -133,3 +133,14 @@ func TestKeyMetadata_VerifyPassphrase_NotSet(t *testing.T) {
 	assert.True(t, errors.Is(err, ssss.ErrNoPassphrase), "unexpected error %v", err)
 	assert.Nil(t, key)
 }
+
+func TestKeyMetadata_VerifyPassphrase_Argon2id(t *testing.T) {
+	key, err := ssss.NewKeyWithPassphraseAlgorithm(key1Passphrase, ssss.PassphraseAlgorithmArgon2id)
+	assert.NoError(t, err)
+	assert.Equal(t, ssss.PassphraseAlgorithmArgon2id, key.Metadata.Passphrase.Algorithm)
+	verifiedKey, err := key.Metadata.VerifyPassphrase(key1Passphrase)
+	assert.NoError(t, err)
+	assert.Equal(t, key.Key.Bytes(), verifiedKey.Key.Bytes())
+	_, err = key.Metadata.VerifyPassphrase("incorrect horse battery staple")
+	assert.True(t, errors.Is(err, ssss.ErrIncorrectSSSSKey), "unexpected error %v", err)
+}
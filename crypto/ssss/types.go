@@ -19,6 +19,7 @@ var (
 	ErrNoDefaultKeyAccountDataEvent = fmt.Errorf("%w: no %s event in account data", ErrNoDefaultKeyID, event.AccountDataSecretStorageDefaultKey.Type)
 	ErrNoKeyFieldInAccountDataEvent = fmt.Errorf("%w: missing key field in account data event", ErrNoDefaultKeyID)
 	ErrNoKeyGiven                   = errors.New("must provide at least one key to encrypt for")
+	ErrSameKey                      = errors.New("old and new key are the same")
 
 	ErrNotEncryptedForKey             = errors.New("data is not encrypted for given key ID")
 	ErrKeyDataMACMismatch             = errors.New("key data MAC mismatch")
@@ -44,6 +45,9 @@ type PassphraseAlgorithm string
 const (
 	// PassphraseAlgorithmPBKDF2 is the current main algorithm
 	PassphraseAlgorithmPBKDF2 PassphraseAlgorithm = "m.pbkdf2"
+	// PassphraseAlgorithmArgon2id is an unstable, opt-in algorithm using Argon2id instead of PBKDF2.
+	// Other clients won't be able to use passphrases with this algorithm unless they also support it.
+	PassphraseAlgorithmArgon2id PassphraseAlgorithm = "net.maunium.argon2id"
 )
 
 type EncryptedKeyData struct {
@@ -70,6 +74,7 @@ func init() {
 	event.TypeMap[event.AccountDataCrossSigningMaster] = encryptedContent
 	event.TypeMap[event.AccountDataCrossSigningSelf] = encryptedContent
 	event.TypeMap[event.AccountDataCrossSigningUser] = encryptedContent
+	event.TypeMap[event.AccountDataMegolmBackupKey] = encryptedContent
 	event.TypeMap[event.AccountDataSecretStorageDefaultKey] = reflect.TypeOf(&DefaultSecretStorageKeyContent{})
 	event.TypeMap[event.AccountDataSecretStorageKey] = reflect.TypeOf(&KeyMetadata{})
 }
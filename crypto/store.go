@@ -7,9 +7,12 @@
 package crypto
 
 import (
+	"bytes"
+	"context"
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"sort"
 	"sync"
@@ -43,6 +46,14 @@ func (ts TrustState) String() string {
 	}
 }
 
+// UserTrustSettings contains per-user settings that affect which devices of the user group sessions are shared with.
+type UserTrustSettings struct {
+	// AllowUnverifiedDevices overrides OlmMachine.AllowUnverifiedDevices for this user if set.
+	AllowUnverifiedDevices *bool
+	// TrustOnFirstUse marks all devices of the user as verified when the device list is fetched for the first time.
+	TrustOnFirstUse bool
+}
+
 // DeviceIdentity contains the identity details of a device and some additional info.
 type DeviceIdentity struct {
 	UserID      id.UserID
@@ -61,6 +72,9 @@ func (device *DeviceIdentity) Fingerprint() string {
 
 var ErrGroupSessionWithheld = errors.New("group session has been withheld")
 
+// ErrUnsupportedStoreVersion is returned when opening a store that was written by a newer version of mautrix-go.
+var ErrUnsupportedStoreVersion = errors.New("unsupported crypto store version")
+
 // Store is used by OlmMachine to store Olm and Megolm sessions, user device lists and message indices.
 //
 // General implementation details:
@@ -70,6 +84,9 @@ type Store interface {
 	// Flush ensures that everything in the store is persisted to disk.
 	// This doesn't have to do anything, e.g. for database-backed implementations that persist everything immediately.
 	Flush() error
+	// Stats returns the number of entries of different types in the store, as well as the creation times
+	// of the oldest sessions. The PendingKeyRequests field is filled by OlmMachine.GetStoreStats instead.
+	Stats(ctx context.Context) (*StoreStats, error)
 
 	// PutAccount updates the OlmAccount in the store.
 	PutAccount(*OlmAccount) error
@@ -78,6 +95,9 @@ type Store interface {
 
 	// AddSession inserts an Olm session into the store.
 	AddSession(id.SenderKey, *OlmSession) error
+	// PutSessions inserts multiple Olm sessions into the store at once, like calling AddSession for each session,
+	// but in a single transaction if the store supports them. This is used after claiming one-time keys.
+	PutSessions(map[id.SenderKey]*OlmSession) error
 	// HasSession returns whether or not the store has an Olm session with the given sender key.
 	HasSession(id.SenderKey) bool
 	// GetSessions returns all Olm sessions in the store with the given sender key.
@@ -87,11 +107,17 @@ type Store interface {
 	GetLatestSession(id.SenderKey) (*OlmSession, error)
 	// UpdateSession updates a session that has previously been inserted with AddSession.
 	UpdateSession(id.SenderKey, *OlmSession) error
+	// PruneOlmSessions removes all but the given number of most recently used Olm sessions for each sender key.
+	// It returns the number of sessions removed.
+	PruneOlmSessions(keepPerSender int) (int64, error)
 
 	// PutGroupSession inserts an inbound Megolm session into the store. If an earlier withhold event has been inserted
 	// with PutWithheldGroupSession, this call should replace that. However, PutWithheldGroupSession must not replace
 	// sessions inserted with this call.
 	PutGroupSession(id.RoomID, id.SenderKey, id.SessionID, *InboundGroupSession) error
+	// PutGroupSessions inserts multiple inbound Megolm sessions into the store at once, like calling PutGroupSession
+	// for each session, but in a single transaction if the store supports them. This is used for bulk imports.
+	PutGroupSessions([]*InboundGroupSession) error
 	// GetGroupSession gets an inbound Megolm session from the store. If the group session has been withheld
 	// (i.e. a room key withheld event has been saved with PutWithheldGroupSession), this should return the
 	// ErrGroupSessionWithheld error. The caller may use GetWithheldGroupSession to find more details.
@@ -107,6 +133,16 @@ type Store interface {
 	// GetGroupSessionsForRoom gets all the inbound Megolm sessions in the store. This is used for creating key export
 	// files. Unlike GetGroupSession, this should not return any errors about withheld keys.
 	GetAllGroupSessions() ([]*InboundGroupSession, error)
+	// GetGroupSessionRooms returns the IDs of all rooms that have inbound Megolm sessions or withheld session entries.
+	GetGroupSessionRooms() ([]id.RoomID, error)
+	// RemoveGroupSessionsForRoom removes all inbound Megolm sessions and withheld session entries for the given room.
+	// It returns the number of entries removed.
+	RemoveGroupSessionsForRoom(id.RoomID) (int64, error)
+	// GetGroupSessionsWithoutKeyBackupVersion gets the inbound Megolm sessions that haven't been uploaded to the given
+	// key backup version. Sessions that were uploaded to a different version are included.
+	GetGroupSessionsWithoutKeyBackupVersion(version string) ([]*InboundGroupSession, error)
+	// MarkGroupSessionsBackedUp sets the key backup version of the given inbound Megolm sessions.
+	MarkGroupSessionsBackedUp(version string, sessions []*InboundGroupSession) error
 
 	// AddOutboundGroupSession inserts the given outbound Megolm session into the store.
 	//
@@ -119,6 +155,9 @@ type Store interface {
 	GetOutboundGroupSession(id.RoomID) (*OutboundGroupSession, error)
 	// RemoveOutboundGroupSession removes the stored outbound Megolm session for the given room ID.
 	RemoveOutboundGroupSession(id.RoomID) error
+	// RemoveExpiredOutboundGroupSessions removes all outbound Megolm sessions that have expired according to
+	// OutboundGroupSession.Expired. It returns the number of sessions removed.
+	RemoveExpiredOutboundGroupSessions() (int64, error)
 
 	// ValidateMessageIndex validates that the given message details aren't from a replay attack.
 	//
@@ -140,9 +179,18 @@ type Store interface {
 	PutDevices(id.UserID, map[id.DeviceID]*DeviceIdentity) error
 	// FindDeviceByKey finds a specific device by its identity key.
 	FindDeviceByKey(id.UserID, id.IdentityKey) (*DeviceIdentity, error)
+	// PutUserTrustSettings stores the trust settings for the given user, replacing any previous settings.
+	PutUserTrustSettings(id.UserID, UserTrustSettings) error
+	// GetUserTrustSettings returns the trust settings for the given user, or nil if none have been stored.
+	GetUserTrustSettings(id.UserID) (*UserTrustSettings, error)
 	// FilterTrackedUsers returns a filtered version of the given list that only includes user IDs whose device lists
 	// have been stored with PutDevices. A user is considered tracked even if the PutDevices list was empty.
 	FilterTrackedUsers([]id.UserID) []id.UserID
+	// MarkTrackedUsersOutdated marks the device lists of the given users as outdated. Users whose device lists aren't
+	// tracked should be ignored. The outdated flag of a user must be cleared when their devices are stored with PutDevices.
+	MarkTrackedUsersOutdated([]id.UserID) error
+	// GetOutdatedTrackedUsers returns the user IDs whose device lists have been marked as outdated.
+	GetOutdatedTrackedUsers() ([]id.UserID, error)
 
 	// PutCrossSigningKey stores a cross-signing key of some user along with its usage.
 	PutCrossSigningKey(id.UserID, id.CrossSigningUsage, id.Ed25519) error
@@ -154,6 +202,9 @@ type Store interface {
 	GetSignaturesForKeyBy(id.UserID, id.Ed25519, id.UserID) (map[id.Ed25519]string, error)
 	// IsKeySignedBy returns whether a cross-signing or device key is signed by the given signer.
 	IsKeySignedBy(id.UserID, id.Ed25519, id.UserID, id.Ed25519) (bool, error)
+	// GetKeysSignedBy returns the cross-signing and device keys that have been signed by the given signer's key,
+	// grouped by the user who owns the signed key.
+	GetKeysSignedBy(id.UserID, id.Ed25519) (map[id.UserID][]id.Ed25519, error)
 	// DropSignaturesByKey deletes the signatures made by the given user and key from the store. It returns the number of signatures deleted.
 	DropSignaturesByKey(id.UserID, id.Ed25519) (int64, error)
 }
@@ -176,6 +227,9 @@ type GobStore struct {
 	lock sync.RWMutex
 	path string
 
+	// Version is the format version of the store. Loading a store with a newer version than GobStoreVersion fails.
+	Version int
+
 	Account               *OlmAccount
 	Sessions              map[id.SenderKey]OlmSessionList
 	GroupSessions         map[id.RoomID]map[id.SenderKey]map[id.SessionID]*InboundGroupSession
@@ -185,16 +239,41 @@ type GobStore struct {
 	Devices               map[id.UserID]map[id.DeviceID]*DeviceIdentity
 	CrossSigningKeys      map[id.UserID]map[id.CrossSigningUsage]id.Ed25519
 	KeySignatures         map[id.UserID]map[id.Ed25519]map[id.UserID]map[id.Ed25519]string
+	UserTrustSettings     map[id.UserID]UserTrustSettings
+	OutdatedUsers         map[id.UserID]bool
+
+	pickleEncrypter PickleEncrypter
 }
 
 var _ Store = (*GobStore)(nil)
 
+// GobStoreVersion is the latest GobStore format version.
+const GobStoreVersion = 1
+
 // NewGobStore creates a new GobStore that saves everything to the given file.
 //
+// If the file was encrypted with NewEncryptedGobStore, ErrPickleEncrypterRequired is returned.
+//
 // Deprecated: this is not atomic and can lose data. Using SQLCryptoStore or a custom implementation is recommended.
 func NewGobStore(path string) (*GobStore, error) {
-	gs := &GobStore{
+	gs := newGobStore(path)
+	return gs, gs.load()
+}
+
+// NewEncryptedGobStore creates a new GobStore that encrypts the whole file with the given PickleEncrypter.
+// An existing unencrypted file is still readable, and it's encrypted the next time the store is saved.
+//
+// Deprecated: this is not atomic and can lose data. Using SQLCryptoStore or a custom implementation is recommended.
+func NewEncryptedGobStore(path string, encrypter PickleEncrypter) (*GobStore, error) {
+	gs := newGobStore(path)
+	gs.pickleEncrypter = encrypter
+	return gs, gs.load()
+}
+
+func newGobStore(path string) *GobStore {
+	return &GobStore{
 		path:                  path,
+		Version:               GobStoreVersion,
 		Sessions:              make(map[id.SenderKey]OlmSessionList),
 		GroupSessions:         make(map[id.RoomID]map[id.SenderKey]map[id.SessionID]*InboundGroupSession),
 		WithheldGroupSessions: make(map[id.RoomID]map[id.SenderKey]map[id.SessionID]*event.RoomKeyWithheldEventContent),
@@ -203,31 +282,56 @@ func NewGobStore(path string) (*GobStore, error) {
 		Devices:               make(map[id.UserID]map[id.DeviceID]*DeviceIdentity),
 		CrossSigningKeys:      make(map[id.UserID]map[id.CrossSigningUsage]id.Ed25519),
 		KeySignatures:         make(map[id.UserID]map[id.Ed25519]map[id.UserID]map[id.Ed25519]string),
+		UserTrustSettings:     make(map[id.UserID]UserTrustSettings),
+		OutdatedUsers:         make(map[id.UserID]bool),
 	}
-	return gs, gs.load()
 }
 
 func (gs *GobStore) save() error {
-	file, err := os.OpenFile(gs.path, os.O_CREATE|os.O_WRONLY, 0600)
+	if len(gs.path) == 0 {
+		// In-memory store (see NewMemoryStore)
+		return nil
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(gs)
 	if err != nil {
 		return err
 	}
-	err = gob.NewEncoder(file).Encode(gs)
-	_ = file.Close()
-	return err
+	// The whole file is encrypted rather than each pickle, as it's all loaded into memory at once anyway.
+	data, err := encryptPickle(gs.pickleEncrypter, atRestPicklePrefix, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(gs.path, data, 0600)
 }
 
 func (gs *GobStore) load() error {
-	file, err := os.OpenFile(gs.path, os.O_RDONLY, 0600)
+	data, err := ioutil.ReadFile(gs.path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
 		}
 		return err
 	}
-	err = gob.NewDecoder(file).Decode(gs)
-	_ = file.Close()
-	return err
+	data, err = decryptPickle(gs.pickleEncrypter, atRestPicklePrefix, data)
+	if err != nil {
+		return err
+	}
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(gs)
+	if err != nil {
+		return err
+	}
+	return gs.checkVersion()
+}
+
+// checkVersion ensures the store isn't from a newer version and upgrades it to the latest version otherwise.
+// There have been no format changes that need data migrations yet, so upgrading just means bumping the version.
+func (gs *GobStore) checkVersion() error {
+	if gs.Version > GobStoreVersion {
+		return fmt.Errorf("%w: store is at v%d, but only up to v%d is supported", ErrUnsupportedStoreVersion, gs.Version, GobStoreVersion)
+	}
+	gs.Version = GobStoreVersion
+	return nil
 }
 
 func (gs *GobStore) Flush() error {
@@ -270,11 +374,38 @@ func (gs *GobStore) AddSession(senderKey id.SenderKey, session *OlmSession) erro
 	return err
 }
 
+func (gs *GobStore) PutSessions(sessions map[id.SenderKey]*OlmSession) error {
+	gs.lock.Lock()
+	for senderKey, session := range sessions {
+		gs.Sessions[senderKey] = append(gs.Sessions[senderKey], session)
+		sort.Sort(gs.Sessions[senderKey])
+	}
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
 func (gs *GobStore) UpdateSession(_ id.SenderKey, _ *OlmSession) error {
 	// we don't need to do anything here because the session is a pointer and already stored in our map
 	return gs.save()
 }
 
+func (gs *GobStore) PruneOlmSessions(keepPerSender int) (int64, error) {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	var count int64
+	for senderKey, sessions := range gs.Sessions {
+		if len(sessions) > keepPerSender {
+			count += int64(len(sessions) - keepPerSender)
+			gs.Sessions[senderKey] = sessions[:keepPerSender]
+		}
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	return count, gs.save()
+}
+
 func (gs *GobStore) HasSession(senderKey id.SenderKey) bool {
 	gs.lock.RLock()
 	sessions, ok := gs.Sessions[senderKey]
@@ -314,6 +445,16 @@ func (gs *GobStore) PutGroupSession(roomID id.RoomID, senderKey id.SenderKey, se
 	return err
 }
 
+func (gs *GobStore) PutGroupSessions(sessions []*InboundGroupSession) error {
+	gs.lock.Lock()
+	for _, igs := range sessions {
+		gs.getGroupSessions(igs.RoomID, igs.SenderKey)[igs.ID()] = igs
+	}
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
 func (gs *GobStore) GetGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) (*InboundGroupSession, error) {
 	gs.lock.Lock()
 	session, ok := gs.getGroupSessions(roomID, senderKey)[sessionID]
@@ -391,6 +532,66 @@ func (gs *GobStore) GetAllGroupSessions() ([]*InboundGroupSession, error) {
 	return result, nil
 }
 
+func (gs *GobStore) GetGroupSessionRooms() ([]id.RoomID, error) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	rooms := make(map[id.RoomID]struct{}, len(gs.GroupSessions))
+	for roomID := range gs.GroupSessions {
+		rooms[roomID] = struct{}{}
+	}
+	for roomID := range gs.WithheldGroupSessions {
+		rooms[roomID] = struct{}{}
+	}
+	result := make([]id.RoomID, 0, len(rooms))
+	for roomID := range rooms {
+		result = append(result, roomID)
+	}
+	return result, nil
+}
+
+func (gs *GobStore) RemoveGroupSessionsForRoom(roomID id.RoomID) (int64, error) {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	var count int64
+	for _, sessions := range gs.GroupSessions[roomID] {
+		count += int64(len(sessions))
+	}
+	for _, sessions := range gs.WithheldGroupSessions[roomID] {
+		count += int64(len(sessions))
+	}
+	delete(gs.GroupSessions, roomID)
+	delete(gs.WithheldGroupSessions, roomID)
+	return count, gs.save()
+}
+
+func (gs *GobStore) GetGroupSessionsWithoutKeyBackupVersion(version string) ([]*InboundGroupSession, error) {
+	gs.lock.Lock()
+	var result []*InboundGroupSession
+	for _, room := range gs.GroupSessions {
+		for _, sessions := range room {
+			for _, session := range sessions {
+				if session.KeyBackupVersion != version {
+					result = append(result, session)
+				}
+			}
+		}
+	}
+	gs.lock.Unlock()
+	return result, nil
+}
+
+func (gs *GobStore) MarkGroupSessionsBackedUp(version string, sessions []*InboundGroupSession) error {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	for _, session := range sessions {
+		stored, ok := gs.getGroupSessions(session.RoomID, session.SenderKey)[session.ID()]
+		if ok {
+			stored.KeyBackupVersion = version
+		}
+	}
+	return gs.save()
+}
+
 func (gs *GobStore) AddOutboundGroupSession(session *OutboundGroupSession) error {
 	gs.lock.Lock()
 	gs.OutGroupSessions[session.RoomID] = session
@@ -426,6 +627,22 @@ func (gs *GobStore) RemoveOutboundGroupSession(roomID id.RoomID) error {
 	return nil
 }
 
+func (gs *GobStore) RemoveExpiredOutboundGroupSessions() (int64, error) {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	var count int64
+	for roomID, session := range gs.OutGroupSessions {
+		if session.Expired() {
+			delete(gs.OutGroupSessions, roomID)
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	return count, gs.save()
+}
+
 func (gs *GobStore) ValidateMessageIndex(senderKey id.SenderKey, sessionID id.SessionID, eventID id.EventID, index uint, timestamp int64) bool {
 	gs.lock.Lock()
 	defer gs.lock.Unlock()
@@ -504,11 +721,30 @@ func (gs *GobStore) PutDevice(userID id.UserID, device *DeviceIdentity) error {
 func (gs *GobStore) PutDevices(userID id.UserID, devices map[id.DeviceID]*DeviceIdentity) error {
 	gs.lock.Lock()
 	gs.Devices[userID] = devices
+	delete(gs.OutdatedUsers, userID)
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
+func (gs *GobStore) PutUserTrustSettings(userID id.UserID, settings UserTrustSettings) error {
+	gs.lock.Lock()
+	gs.UserTrustSettings[userID] = settings
 	err := gs.save()
 	gs.lock.Unlock()
 	return err
 }
 
+func (gs *GobStore) GetUserTrustSettings(userID id.UserID) (*UserTrustSettings, error) {
+	gs.lock.RLock()
+	settings, ok := gs.UserTrustSettings[userID]
+	gs.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	return &settings, nil
+}
+
 func (gs *GobStore) FilterTrackedUsers(users []id.UserID) []id.UserID {
 	gs.lock.RLock()
 	var ptr int
@@ -523,6 +759,28 @@ func (gs *GobStore) FilterTrackedUsers(users []id.UserID) []id.UserID {
 	return users[:ptr]
 }
 
+func (gs *GobStore) MarkTrackedUsersOutdated(users []id.UserID) error {
+	gs.lock.Lock()
+	for _, userID := range users {
+		if _, ok := gs.Devices[userID]; ok {
+			gs.OutdatedUsers[userID] = true
+		}
+	}
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
+func (gs *GobStore) GetOutdatedTrackedUsers() ([]id.UserID, error) {
+	gs.lock.RLock()
+	users := make([]id.UserID, 0, len(gs.OutdatedUsers))
+	for userID := range gs.OutdatedUsers {
+		users = append(users, userID)
+	}
+	gs.lock.RUnlock()
+	return users, nil
+}
+
 func (gs *GobStore) PutCrossSigningKey(userID id.UserID, usage id.CrossSigningUsage, key id.Ed25519) error {
 	gs.lock.RLock()
 	userKeys, ok := gs.CrossSigningKeys[userID]
@@ -596,6 +854,20 @@ func (gs *GobStore) IsKeySignedBy(userID id.UserID, key id.Ed25519, signerID id.
 	return ok, nil
 }
 
+func (gs *GobStore) GetKeysSignedBy(signerID id.UserID, signerKey id.Ed25519) (map[id.UserID][]id.Ed25519, error) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	signedKeys := make(map[id.UserID][]id.Ed25519)
+	for userID, userSigs := range gs.KeySignatures {
+		for key, keySigs := range userSigs {
+			if _, ok := keySigs[signerID][signerKey]; ok {
+				signedKeys[userID] = append(signedKeys[userID], key)
+			}
+		}
+	}
+	return signedKeys, nil
+}
+
 func (gs *GobStore) DropSignaturesByKey(userID id.UserID, key id.Ed25519) (int64, error) {
 	var count int64
 	gs.lock.RLock()
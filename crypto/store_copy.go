@@ -0,0 +1,368 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrTargetStoreNotEmpty    = errors.New("target crypto store already has an account")
+	ErrStoreExportUnsupported = errors.New("crypto store doesn't support exporting")
+)
+
+// StoreExporter is implemented by crypto stores whose contents can be copied to another store with CopyStore.
+type StoreExporter interface {
+	// ExportTo inserts everything in the store into the target store using the normal Store methods.
+	// Inbound Megolm sessions must be inserted before withheld entries, and devices before outdated users.
+	ExportTo(ctx context.Context, target Store) error
+}
+
+var (
+	_ StoreExporter = (*SQLCryptoStore)(nil)
+	_ StoreExporter = (*GobStore)(nil)
+	_ StoreExporter = (*KVCryptoStore)(nil)
+)
+
+// exportGroupSessionBatchSize is the number of inbound Megolm sessions that are inserted with one PutGroupSessions
+// call when exporting a store that streams its sessions.
+const exportGroupSessionBatchSize = 100
+
+// CopyStore copies the account, Olm and Megolm sessions, device lists, trust settings and cross-signing data from
+// one crypto store to another, e.g. to migrate from SQLite to PostgreSQL. The target store must not have an account.
+//
+// The source store must implement StoreExporter, which all stores in this package do. Pickles are decrypted with
+// the PickleEncrypter of the source store and re-encrypted with the one of the target store.
+func CopyStore(ctx context.Context, from, to Store) error {
+	exporter, ok := from.(StoreExporter)
+	if !ok {
+		return fmt.Errorf("%w (%T)", ErrStoreExportUnsupported, from)
+	}
+	if existing, err := to.GetAccount(); err != nil {
+		return fmt.Errorf("failed to check target store: %w", err)
+	} else if existing != nil {
+		return ErrTargetStoreNotEmpty
+	}
+	err := exporter.ExportTo(ctx, to)
+	if err != nil {
+		return err
+	}
+	err = to.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to flush target store: %w", err)
+	}
+	return nil
+}
+
+// ExportTo inserts all data in the GobStore into the target store.
+func (gs *GobStore) ExportTo(ctx context.Context, target Store) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	if gs.Account != nil {
+		if err := target.PutAccount(gs.Account); err != nil {
+			return fmt.Errorf("failed to copy account: %w", err)
+		}
+	}
+	for senderKey, sessions := range gs.Sessions {
+		for _, session := range sessions {
+			if err := target.AddSession(senderKey, session); err != nil {
+				return fmt.Errorf("failed to copy olm session with %s: %w", senderKey, err)
+			}
+		}
+	}
+	var groupSessions []*InboundGroupSession
+	for _, senders := range gs.GroupSessions {
+		for _, sessions := range senders {
+			for _, session := range sessions {
+				groupSessions = append(groupSessions, session)
+			}
+		}
+	}
+	if err := target.PutGroupSessions(groupSessions); err != nil {
+		return fmt.Errorf("failed to copy megolm sessions: %w", err)
+	}
+	for _, senders := range gs.WithheldGroupSessions {
+		for _, sessions := range senders {
+			for _, content := range sessions {
+				if err := target.PutWithheldGroupSession(*content); err != nil {
+					return fmt.Errorf("failed to copy withheld megolm session %s: %w", content.SessionID, err)
+				}
+			}
+		}
+	}
+	for roomID, session := range gs.OutGroupSessions {
+		if err := target.AddOutboundGroupSession(session); err != nil {
+			return fmt.Errorf("failed to copy outbound megolm session of %s: %w", roomID, err)
+		}
+	}
+	for key, value := range gs.MessageIndices {
+		target.ValidateMessageIndex(key.SenderKey, key.SessionID, value.EventID, key.Index, value.Timestamp)
+	}
+	for userID, devices := range gs.Devices {
+		if err := target.PutDevices(userID, devices); err != nil {
+			return fmt.Errorf("failed to copy devices of %s: %w", userID, err)
+		}
+	}
+	outdatedUsers := make([]id.UserID, 0, len(gs.OutdatedUsers))
+	for userID, outdated := range gs.OutdatedUsers {
+		if outdated {
+			outdatedUsers = append(outdatedUsers, userID)
+		}
+	}
+	if err := target.MarkTrackedUsersOutdated(outdatedUsers); err != nil {
+		return fmt.Errorf("failed to copy outdated users: %w", err)
+	}
+	for userID, settings := range gs.UserTrustSettings {
+		if err := target.PutUserTrustSettings(userID, settings); err != nil {
+			return fmt.Errorf("failed to copy trust settings of %s: %w", userID, err)
+		}
+	}
+	for userID, keys := range gs.CrossSigningKeys {
+		for usage, key := range keys {
+			if err := target.PutCrossSigningKey(userID, usage, key); err != nil {
+				return fmt.Errorf("failed to copy %s cross-signing key of %s: %w", usage, userID, err)
+			}
+		}
+	}
+	for signedUserID, signedKeys := range gs.KeySignatures {
+		for signedKey, signers := range signedKeys {
+			for signerUserID, signerKeys := range signers {
+				for signerKey, signature := range signerKeys {
+					err := target.PutSignature(signedUserID, signedKey, signerUserID, signerKey, signature)
+					if err != nil {
+						return fmt.Errorf("failed to copy signature of %s by %s: %w", signedKey, signerKey, err)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ExportTo inserts all data in the SQL store into the target store. Rows are streamed from the database,
+// so the whole store doesn't need to fit in memory.
+func (store *SQLCryptoStore) ExportTo(ctx context.Context, target Store) error {
+	if account, err := store.GetAccount(); err != nil {
+		return fmt.Errorf("failed to get account: %w", err)
+	} else if account != nil {
+		if err = target.PutAccount(account); err != nil {
+			return fmt.Errorf("failed to copy account: %w", err)
+		}
+	}
+	steps := []struct {
+		name string
+		fn   func(ctx context.Context, target Store) error
+	}{
+		{"olm sessions", store.exportOlmSessions},
+		{"megolm sessions", store.exportGroupSessions},
+		{"withheld megolm sessions", store.exportWithheldGroupSessions},
+		{"outbound megolm sessions", store.exportOutboundGroupSessions},
+		{"message indices", store.exportMessageIndices},
+		{"devices", store.exportDevices},
+		{"trust settings", store.exportUserTrustSettings},
+		{"cross-signing keys", store.exportCrossSigningKeys},
+		{"signatures", store.exportSignatures},
+	}
+	for _, step := range steps {
+		if err := step.fn(ctx, target); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", step.name, err)
+		}
+	}
+	return nil
+}
+
+// exportRows calls the given function for every row returned by the query.
+func (store *SQLCryptoStore) exportRows(ctx context.Context, fn func(rows *sql.Rows) error, query string, args ...interface{}) error {
+	rows, err := store.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (store *SQLCryptoStore) exportOlmSessions(ctx context.Context, target Store) error {
+	return store.exportRows(ctx, func(rows *sql.Rows) error {
+		var senderKey id.SenderKey
+		var sessionBytes []byte
+		sess := &OlmSession{Internal: *olm.NewBlankSession()}
+		err := rows.Scan(&senderKey, &sessionBytes, &sess.CreationTime, &sess.LastEncryptedTime, &sess.LastDecryptedTime)
+		if err != nil {
+			return err
+		} else if err = store.unpickle(sessionBytes, &sess.Internal); err != nil {
+			return err
+		}
+		return target.AddSession(senderKey, sess)
+	}, "SELECT sender_key, session, created_at, last_encrypted, last_decrypted FROM crypto_olm_session WHERE account_id=$1", store.AccountID)
+}
+
+func (store *SQLCryptoStore) exportGroupSessions(ctx context.Context, target Store) error {
+	batch := make([]*InboundGroupSession, 0, exportGroupSessionBatchSize)
+	err := store.exportRows(ctx, func(rows *sql.Rows) error {
+		igs, err := store.scanGroupSession(rows)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, igs)
+		if len(batch) >= exportGroupSessionBatchSize {
+			err = target.PutGroupSessions(batch)
+			batch = batch[:0]
+		}
+		return err
+	}, `
+		SELECT room_id, signing_key, sender_key, session, forwarding_chains, key_source, key_backup_version
+		FROM crypto_megolm_inbound_session WHERE account_id=$1 AND session IS NOT NULL`,
+		store.AccountID,
+	)
+	if err != nil || len(batch) == 0 {
+		return err
+	}
+	return target.PutGroupSessions(batch)
+}
+
+func (store *SQLCryptoStore) exportWithheldGroupSessions(ctx context.Context, target Store) error {
+	return store.exportRows(ctx, func(rows *sql.Rows) error {
+		content := event.RoomKeyWithheldEventContent{Algorithm: id.AlgorithmMegolmV1}
+		var reason sql.NullString
+		err := rows.Scan(&content.RoomID, &content.SenderKey, &content.SessionID, &content.Code, &reason)
+		if err != nil {
+			return err
+		}
+		content.Reason = reason.String
+		return target.PutWithheldGroupSession(content)
+	}, `
+		SELECT room_id, sender_key, session_id, withheld_code, withheld_reason
+		FROM crypto_megolm_inbound_session WHERE account_id=$1 AND session IS NULL`,
+		store.AccountID,
+	)
+}
+
+func (store *SQLCryptoStore) exportOutboundGroupSessions(ctx context.Context, target Store) error {
+	return store.exportRows(ctx, func(rows *sql.Rows) error {
+		var ogs OutboundGroupSession
+		var sessionBytes []byte
+		err := rows.Scan(&ogs.RoomID, &sessionBytes, &ogs.Shared, &ogs.MaxMessages, &ogs.MessageCount, &ogs.MaxAge, &ogs.CreationTime, &ogs.LastEncryptedTime)
+		if err != nil {
+			return err
+		}
+		intOGS := olm.NewBlankOutboundGroupSession()
+		if err = store.unpickle(sessionBytes, intOGS); err != nil {
+			return err
+		}
+		ogs.Internal = *intOGS
+		ogs.Users = make(map[UserDevice]OGSState)
+		return target.AddOutboundGroupSession(&ogs)
+	}, `
+		SELECT room_id, session, shared, max_messages, message_count, max_age, created_at, last_used
+		FROM crypto_megolm_outbound_session WHERE account_id=$1`,
+		store.AccountID,
+	)
+}
+
+func (store *SQLCryptoStore) exportMessageIndices(ctx context.Context, target Store) error {
+	return store.exportRows(ctx, func(rows *sql.Rows) error {
+		var senderKey id.SenderKey
+		var sessionID id.SessionID
+		var index uint
+		var eventID id.EventID
+		var timestamp int64
+		err := rows.Scan(&senderKey, &sessionID, &index, &eventID, &timestamp)
+		if err != nil {
+			return err
+		}
+		target.ValidateMessageIndex(senderKey, sessionID, eventID, index, timestamp)
+		return nil
+	}, `SELECT sender_key, session_id, "index", event_id, timestamp FROM crypto_message_index`)
+}
+
+func (store *SQLCryptoStore) exportDevices(ctx context.Context, target Store) error {
+	// The tracked users are collected first, as the devices of each user are fetched with a separate query.
+	var users, outdatedUsers []id.UserID
+	err := store.exportRows(ctx, func(rows *sql.Rows) error {
+		var userID id.UserID
+		var outdated bool
+		err := rows.Scan(&userID, &outdated)
+		users = append(users, userID)
+		if outdated {
+			outdatedUsers = append(outdatedUsers, userID)
+		}
+		return err
+	}, "SELECT user_id, devices_outdated FROM crypto_tracked_user")
+	if err != nil {
+		return err
+	}
+	for _, userID := range users {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		devices, err := store.GetDevices(userID)
+		if err != nil {
+			return err
+		} else if devices == nil {
+			devices = make(map[id.DeviceID]*DeviceIdentity)
+		}
+		if err = target.PutDevices(userID, devices); err != nil {
+			return err
+		}
+	}
+	return target.MarkTrackedUsersOutdated(outdatedUsers)
+}
+
+func (store *SQLCryptoStore) exportUserTrustSettings(ctx context.Context, target Store) error {
+	return store.exportRows(ctx, func(rows *sql.Rows) error {
+		var userID id.UserID
+		var settings UserTrustSettings
+		var allowUnverified sql.NullBool
+		err := rows.Scan(&userID, &allowUnverified, &settings.TrustOnFirstUse)
+		if err != nil {
+			return err
+		} else if allowUnverified.Valid {
+			settings.AllowUnverifiedDevices = &allowUnverified.Bool
+		}
+		return target.PutUserTrustSettings(userID, settings)
+	}, "SELECT user_id, allow_unverified_devices, trust_on_first_use FROM crypto_user_trust_settings WHERE account_id=$1", store.AccountID)
+}
+
+func (store *SQLCryptoStore) exportCrossSigningKeys(ctx context.Context, target Store) error {
+	return store.exportRows(ctx, func(rows *sql.Rows) error {
+		var userID id.UserID
+		var usage id.CrossSigningUsage
+		var key id.Ed25519
+		if err := rows.Scan(&userID, &usage, &key); err != nil {
+			return err
+		}
+		return target.PutCrossSigningKey(userID, usage, key)
+	}, "SELECT user_id, usage, key FROM crypto_cross_signing_keys")
+}
+
+func (store *SQLCryptoStore) exportSignatures(ctx context.Context, target Store) error {
+	return store.exportRows(ctx, func(rows *sql.Rows) error {
+		var signedUserID, signerUserID id.UserID
+		var signedKey, signerKey id.Ed25519
+		var signature string
+		if err := rows.Scan(&signedUserID, &signedKey, &signerUserID, &signerKey, &signature); err != nil {
+			return err
+		}
+		return target.PutSignature(signedUserID, signedKey, signerUserID, signerKey, signature)
+	}, "SELECT signed_user_id, signed_key, signer_user_id, signer_key, signature FROM crypto_cross_signing_signatures")
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/crypto/utils"
+)
+
+// ErrPickleEncrypterRequired is returned when reading a pickle that was encrypted with a PickleEncrypter from a
+// store that doesn't have one configured.
+var ErrPickleEncrypterRequired = errors.New("pickle is encrypted at rest, but no pickle encrypter is configured")
+
+// atRestPicklePrefix marks pickles that have been encrypted with a PickleEncrypter.
+var atRestPicklePrefix = []byte("atrest:")
+
+const atRestEncryptionInfo = "mautrix-go crypto store encryption at rest"
+
+// PickleEncrypter encrypts pickled olm objects (accounts, olm sessions and megolm sessions) before they're written
+// to a crypto store, and decrypts them after they're read. It can be set with the PickleEncrypter field of
+// SQLCryptoStore and KVCryptoStore, or with NewEncryptedGobStore, which encrypts the whole file.
+//
+// Stores that already contain unencrypted pickles can start using an encrypter: old pickles are still readable,
+// and they're encrypted the next time they're written.
+type PickleEncrypter interface {
+	EncryptPickle(pickled []byte) ([]byte, error)
+	DecryptPickle(encrypted []byte) ([]byte, error)
+}
+
+type aesGCMPickleEncrypter struct {
+	key [utils.AESCTRKeyLength]byte
+	ad  []byte
+}
+
+// NewAESGCMPickleEncrypter creates a PickleEncrypter that uses AES-256-GCM with a key derived from the given secret.
+// The secret must be the same every time the store is opened.
+func NewAESGCMPickleEncrypter(secret []byte) PickleEncrypter {
+	return &aesGCMPickleEncrypter{key: utils.DeriveAESGCMKey(secret, atRestEncryptionInfo), ad: atRestPicklePrefix}
+}
+
+func (enc *aesGCMPickleEncrypter) EncryptPickle(pickled []byte) ([]byte, error) {
+	return utils.EncryptAESGCM(enc.key, pickled, enc.ad)
+}
+
+func (enc *aesGCMPickleEncrypter) DecryptPickle(encrypted []byte) ([]byte, error) {
+	return utils.DecryptAESGCM(enc.key, encrypted, enc.ad)
+}
+
+// encryptPickle encrypts the pickle with the given encrypter and marks it with the given prefix. The pickle is
+// returned as-is if there's no encrypter.
+func encryptPickle(encrypter PickleEncrypter, prefix, pickled []byte) ([]byte, error) {
+	if encrypter == nil {
+		return pickled, nil
+	}
+	encrypted, err := encrypter.EncryptPickle(pickled)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt pickle: %w", err)
+	}
+	return append(prefix[:len(prefix):len(prefix)], encrypted...), nil
+}
+
+// decryptPickle reverses encryptPickle. Pickles without the given prefix are returned as-is.
+func decryptPickle(encrypter PickleEncrypter, prefix, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, prefix) {
+		return data, nil
+	} else if encrypter == nil {
+		return nil, ErrPickleEncrypterRequired
+	}
+	decrypted, err := encrypter.DecryptPickle(data[len(prefix):])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt pickle: %w", err)
+	}
+	return decrypted, nil
+}
@@ -0,0 +1,1215 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// KVBackend is an embedded key-value database that KVCryptoStore keeps its data in. It's meant to be implemented
+// with a small adapter around a pure-Go database like bbolt or badger, which allows using the crypto store without
+// CGO. The crypto/kvstore/bolt package contains an implementation for bbolt.
+type KVBackend interface {
+	// View runs the given function in a read-only transaction.
+	View(fn func(tx KVTx) error) error
+	// Update runs the given function in a read-write transaction. The transaction must be committed if the function
+	// returns nil and rolled back if it returns an error.
+	Update(fn func(tx KVTx) error) error
+}
+
+// KVTx is a transaction in a KVBackend.
+type KVTx interface {
+	// Get returns the value of the given key, or nil if the key doesn't exist.
+	Get(key []byte) ([]byte, error)
+	// Put sets the value of the given key.
+	Put(key, value []byte) error
+	// Delete removes the given key. Deleting a key that doesn't exist is not an error.
+	Delete(key []byte) error
+	// Scan calls the given function for every key that starts with the given prefix, in ascending key order.
+	// The key and value slices are only valid until the function returns. Keys must not be modified during a scan.
+	Scan(prefix []byte, fn func(key, value []byte) error) error
+}
+
+// kvSeparator separates the parts of keys. Null bytes can't appear in any of the identifiers used in keys,
+// unlike e.g. slashes, which are used in both base64 and user IDs.
+const kvSeparator = "\x00"
+
+const (
+	kvPrefixAccount       = "account"
+	kvPrefixOlmSession    = "olm"
+	kvPrefixGroupSession  = "igs"
+	kvPrefixOutbound      = "ogs"
+	kvPrefixMessageIndex  = "msgidx"
+	kvPrefixDevice        = "device"
+	kvPrefixTrackedUser   = "tracked"
+	kvPrefixTrustSettings = "trust"
+	kvPrefixCrossSigning  = "xsign"
+	kvPrefixSignature     = "sig"
+
+	// kvPrefixNamespace is the prefix of account-specific keys in stores that have an AccountNamespace.
+	kvPrefixNamespace = "ns"
+
+	// kvKeyVersion is the key of the format version of the database. It's shared by all account namespaces.
+	kvKeyVersion = "version"
+)
+
+// KVCryptoStoreVersion is the latest KVCryptoStore format version.
+const KVCryptoStoreVersion = 1
+
+func kvKey(parts ...string) []byte {
+	return []byte(strings.Join(parts, kvSeparator))
+}
+
+// kvPrefix returns the key prefix for scanning all keys that start with the given parts.
+func kvPrefix(parts ...string) []byte {
+	return append(kvKey(parts...), kvSeparator...)
+}
+
+type kvAccount struct {
+	Shared bool   `json:"shared"`
+	Pickle []byte `json:"pickle"`
+}
+
+type kvOlmSession struct {
+	Pickle []byte `json:"pickle"`
+	TimeMixin
+}
+
+type kvGroupSession struct {
+	Pickle           []byte                    `json:"pickle,omitempty"`
+	SigningKey       id.Ed25519                `json:"signing_key,omitempty"`
+	ForwardingChains []string                  `json:"forwarding_chains,omitempty"`
+	KeySource        event.KeySource           `json:"key_source,omitempty"`
+	KeyBackupVersion string                    `json:"key_backup_version,omitempty"`
+	WithheldCode     event.RoomKeyWithheldCode `json:"withheld_code,omitempty"`
+	WithheldReason   string                    `json:"withheld_reason,omitempty"`
+}
+
+type kvOutboundGroupSession struct {
+	Pickle       []byte        `json:"pickle"`
+	Shared       bool          `json:"shared"`
+	MaxMessages  int           `json:"max_messages"`
+	MessageCount int           `json:"message_count"`
+	MaxAge       time.Duration `json:"max_age"`
+	CreationTime time.Time     `json:"created_at"`
+	LastUsed     time.Time     `json:"last_used"`
+}
+
+type kvTrackedUser struct {
+	Outdated bool `json:"outdated"`
+}
+
+// KVCryptoStore is a Store implementation that keeps everything in an embedded key-value database.
+//
+// Values are JSON-encoded and olm objects are pickled with PickleKey. Each method runs in a single KVBackend
+// transaction, so multi-row updates like PutDevices and PutGroupSessions are atomic.
+type KVCryptoStore struct {
+	DB        KVBackend
+	PickleKey *utils.SecretBytes
+
+	// AccountNamespace is added to the keys of account-specific data (the account, Olm and Megolm sessions and
+	// trust settings), which allows multiple accounts to share one database. Device lists and cross-signing keys
+	// are shared by all accounts. See ForAccount.
+	AccountNamespace string
+
+	// PickleEncrypter adds another layer of encryption to the stored pickles, see PickleEncrypter.
+	PickleEncrypter PickleEncrypter
+
+	olmSessionCache     map[id.SenderKey]map[id.SessionID]*OlmSession
+	olmSessionCacheLock sync.Mutex
+}
+
+var _ Store = (*KVCryptoStore)(nil)
+
+// NewKVCryptoStore creates a new crypto store that uses the given key-value database. Call Upgrade before using it.
+// The store keeps a copy of the pickle key, so the caller may wipe the given slice afterwards.
+func NewKVCryptoStore(db KVBackend, pickleKey []byte) *KVCryptoStore {
+	return &KVCryptoStore{
+		DB:        db,
+		PickleKey: utils.NewSecretBytes(append([]byte{}, pickleKey...)),
+
+		olmSessionCache: make(map[id.SenderKey]map[id.SessionID]*OlmSession),
+	}
+}
+
+// Upgrade checks the format version of the database and updates it to the latest version. It should be called
+// before the store is used, like SQLCryptoStore.CreateTables. If the database was written by a newer version of
+// mautrix-go, ErrUnsupportedStoreVersion is returned. There have been no format changes that need data migrations
+// yet, so upgrading just means storing the version.
+func (store *KVCryptoStore) Upgrade() error {
+	return store.DB.Update(func(tx KVTx) error {
+		var version int
+		found, err := kvGet(tx, kvKey(kvKeyVersion), &version)
+		if err != nil {
+			return fmt.Errorf("failed to get store version: %w", err)
+		} else if version > KVCryptoStoreVersion {
+			return fmt.Errorf("%w: store is at v%d, but only up to v%d is supported", ErrUnsupportedStoreVersion, version, KVCryptoStoreVersion)
+		} else if found && version == KVCryptoStoreVersion {
+			return nil
+		}
+		return kvPut(tx, kvKey(kvKeyVersion), KVCryptoStoreVersion)
+	})
+}
+
+func (store *KVCryptoStore) pickle(obj pickleable) ([]byte, error) {
+	return encryptPickle(store.PickleEncrypter, atRestPicklePrefix, obj.Pickle(store.PickleKey.Bytes()))
+}
+
+func (store *KVCryptoStore) unpickle(data []byte, obj unpickleable) error {
+	data, err := decryptPickle(store.PickleEncrypter, atRestPicklePrefix, data)
+	if err != nil {
+		return err
+	}
+	return obj.Unpickle(data, store.PickleKey.Bytes())
+}
+
+func kvGet(tx KVTx, key []byte, into interface{}) (bool, error) {
+	data, err := tx.Get(key)
+	if err != nil || data == nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, into)
+}
+
+func kvPut(tx KVTx, key []byte, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return tx.Put(key, data)
+}
+
+// kvDeleteKeys deletes the given keys. Keys are collected before deleting, as deleting during a scan isn't safe.
+func kvDeleteKeys(tx KVTx, keys [][]byte) error {
+	for _, key := range keys {
+		if err := tx.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// accountPrefix returns the given key prefix in the namespace of the store's account.
+func (store *KVCryptoStore) accountPrefix(prefix string) string {
+	if store.AccountNamespace == "" {
+		return prefix
+	}
+	return strings.Join([]string{kvPrefixNamespace, store.AccountNamespace, prefix}, kvSeparator)
+}
+
+// kvKeySuffix returns the part of the key after the given prefix, split by the separator.
+func kvKeySuffix(key, prefix []byte) []string {
+	return strings.Split(string(key[len(prefix):]), kvSeparator)
+}
+
+// Flush does nothing, as all changes are committed immediately.
+func (store *KVCryptoStore) Flush() error {
+	return nil
+}
+
+// PutAccount stores the OlmAccount.
+func (store *KVCryptoStore) PutAccount(account *OlmAccount) error {
+	pickled, err := store.pickle(&account.Internal)
+	if err != nil {
+		return err
+	}
+	return store.DB.Update(func(tx KVTx) error {
+		return kvPut(tx, kvKey(store.accountPrefix(kvPrefixAccount)), &kvAccount{Shared: account.Shared, Pickle: pickled})
+	})
+}
+
+// GetAccount returns the stored OlmAccount, or nil if there isn't one.
+func (store *KVCryptoStore) GetAccount() (*OlmAccount, error) {
+	var stored kvAccount
+	var found bool
+	err := store.DB.View(func(tx KVTx) (err error) {
+		found, err = kvGet(tx, kvKey(store.accountPrefix(kvPrefixAccount)), &stored)
+		return
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	acc := &OlmAccount{Internal: *olm.NewBlankAccount(), Shared: stored.Shared}
+	err = store.unpickle(stored.Pickle, &acc.Internal)
+	if err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+func (store *KVCryptoStore) putOlmSession(tx KVTx, senderKey id.SenderKey, session *OlmSession) error {
+	pickled, err := store.pickle(&session.Internal)
+	if err != nil {
+		return err
+	}
+	return kvPut(tx, kvKey(store.accountPrefix(kvPrefixOlmSession), senderKey.String(), session.ID().String()), &kvOlmSession{
+		Pickle:    pickled,
+		TimeMixin: session.TimeMixin,
+	})
+}
+
+func (store *KVCryptoStore) getOlmSessionCache(senderKey id.SenderKey) map[id.SessionID]*OlmSession {
+	data, ok := store.olmSessionCache[senderKey]
+	if !ok {
+		data = make(map[id.SessionID]*OlmSession)
+		store.olmSessionCache[senderKey] = data
+	}
+	return data
+}
+
+// AddSession stores an Olm session.
+func (store *KVCryptoStore) AddSession(senderKey id.SenderKey, session *OlmSession) error {
+	return store.PutSessions(map[id.SenderKey]*OlmSession{senderKey: session})
+}
+
+// PutSessions stores multiple Olm sessions in a single transaction.
+func (store *KVCryptoStore) PutSessions(sessions map[id.SenderKey]*OlmSession) error {
+	store.olmSessionCacheLock.Lock()
+	defer store.olmSessionCacheLock.Unlock()
+	err := store.DB.Update(func(tx KVTx) error {
+		for senderKey, session := range sessions {
+			if err := store.putOlmSession(tx, senderKey, session); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for senderKey, session := range sessions {
+		store.getOlmSessionCache(senderKey)[session.ID()] = session
+	}
+	return nil
+}
+
+// UpdateSession replaces a stored Olm session.
+func (store *KVCryptoStore) UpdateSession(senderKey id.SenderKey, session *OlmSession) error {
+	return store.DB.Update(func(tx KVTx) error {
+		return store.putOlmSession(tx, senderKey, session)
+	})
+}
+
+// scanOlmSessions returns the stored Olm sessions with the given sender key, most recently used first.
+// If unpickle is false, the returned sessions only contain the ID and timestamps.
+func (store *KVCryptoStore) scanOlmSessions(tx KVTx, senderKey id.SenderKey, unpickle bool) (OlmSessionList, error) {
+	list := OlmSessionList{}
+	prefix := kvPrefix(store.accountPrefix(kvPrefixOlmSession), senderKey.String())
+	var cache map[id.SessionID]*OlmSession
+	if unpickle {
+		cache = store.getOlmSessionCache(senderKey)
+	}
+	err := tx.Scan(prefix, func(key, value []byte) error {
+		sessionID := id.SessionID(kvKeySuffix(key, prefix)[0])
+		if cached, ok := cache[sessionID]; ok {
+			list = append(list, cached)
+			return nil
+		}
+		var stored kvOlmSession
+		if err := json.Unmarshal(value, &stored); err != nil {
+			return err
+		}
+		sess := &OlmSession{id: sessionID}
+		sess.TimeMixin = stored.TimeMixin
+		if unpickle {
+			sess.Internal = *olm.NewBlankSession()
+			if err := store.unpickle(stored.Pickle, &sess.Internal); err != nil {
+				return err
+			}
+			cache[sessionID] = sess
+		}
+		list = append(list, sess)
+		return nil
+	})
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].LastDecryptedTime.After(list[j].LastDecryptedTime)
+	})
+	return list, err
+}
+
+// GetSessions returns all Olm sessions with the given sender key, most recently used first.
+func (store *KVCryptoStore) GetSessions(senderKey id.SenderKey) (list OlmSessionList, err error) {
+	store.olmSessionCacheLock.Lock()
+	defer store.olmSessionCacheLock.Unlock()
+	err = store.DB.View(func(tx KVTx) error {
+		list, err = store.scanOlmSessions(tx, senderKey, true)
+		return err
+	})
+	return
+}
+
+// GetLatestSession returns the most recently used Olm session with the given sender key.
+func (store *KVCryptoStore) GetLatestSession(senderKey id.SenderKey) (*OlmSession, error) {
+	sessions, err := store.GetSessions(senderKey)
+	if err != nil || len(sessions) == 0 {
+		return nil, err
+	}
+	return sessions[0], nil
+}
+
+// HasSession returns whether there are any Olm sessions with the given sender key.
+func (store *KVCryptoStore) HasSession(senderKey id.SenderKey) bool {
+	found := false
+	_ = store.DB.View(func(tx KVTx) error {
+		return tx.Scan(kvPrefix(store.accountPrefix(kvPrefixOlmSession), senderKey.String()), func(_, _ []byte) error {
+			found = true
+			return nil
+		})
+	})
+	return found
+}
+
+// PruneOlmSessions removes all but the given number of most recently used Olm sessions for each sender key.
+func (store *KVCryptoStore) PruneOlmSessions(keepPerSender int) (count int64, err error) {
+	err = store.DB.Update(func(tx KVTx) error {
+		senderKeys := make(map[id.SenderKey]struct{})
+		prefix := kvPrefix(store.accountPrefix(kvPrefixOlmSession))
+		err := tx.Scan(prefix, func(key, _ []byte) error {
+			senderKeys[id.SenderKey(kvKeySuffix(key, prefix)[0])] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		var toDelete [][]byte
+		for senderKey := range senderKeys {
+			sessions, err := store.scanOlmSessions(tx, senderKey, false)
+			if err != nil {
+				return err
+			}
+			for i := keepPerSender; i < len(sessions); i++ {
+				toDelete = append(toDelete, kvKey(store.accountPrefix(kvPrefixOlmSession), senderKey.String(), sessions[i].id.String()))
+			}
+		}
+		count = int64(len(toDelete))
+		return kvDeleteKeys(tx, toDelete)
+	})
+	// The cache may contain removed sessions, so just reset it instead of figuring out which ones were removed.
+	store.olmSessionCacheLock.Lock()
+	store.olmSessionCache = make(map[id.SenderKey]map[id.SessionID]*OlmSession)
+	store.olmSessionCacheLock.Unlock()
+	return
+}
+
+func (store *KVCryptoStore) groupSessionKey(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) []byte {
+	return kvKey(store.accountPrefix(kvPrefixGroupSession), roomID.String(), senderKey.String(), sessionID.String())
+}
+
+func (store *KVCryptoStore) putGroupSession(tx KVTx, roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, session *InboundGroupSession) error {
+	pickled, err := store.pickle(&session.Internal)
+	if err != nil {
+		return err
+	}
+	return kvPut(tx, store.groupSessionKey(roomID, senderKey, sessionID), &kvGroupSession{
+		Pickle:           pickled,
+		SigningKey:       session.SigningKey,
+		ForwardingChains: session.ForwardingChains,
+		KeySource:        session.KeySource,
+		KeyBackupVersion: session.KeyBackupVersion,
+	})
+}
+
+// PutGroupSession stores an inbound Megolm session, replacing any withheld entry for the same session.
+func (store *KVCryptoStore) PutGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, session *InboundGroupSession) error {
+	return store.DB.Update(func(tx KVTx) error {
+		return store.putGroupSession(tx, roomID, senderKey, sessionID, session)
+	})
+}
+
+// PutGroupSessions stores multiple inbound Megolm sessions in a single transaction.
+func (store *KVCryptoStore) PutGroupSessions(sessions []*InboundGroupSession) error {
+	return store.DB.Update(func(tx KVTx) error {
+		for _, session := range sessions {
+			if err := store.putGroupSession(tx, session.RoomID, session.SenderKey, session.ID(), session); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (store *KVCryptoStore) unpickleGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, stored *kvGroupSession) (*InboundGroupSession, error) {
+	igs := olm.NewBlankInboundGroupSession()
+	err := store.unpickle(stored.Pickle, igs)
+	if err != nil {
+		return nil, err
+	}
+	return &InboundGroupSession{
+		Internal:         *igs,
+		SigningKey:       stored.SigningKey,
+		SenderKey:        senderKey,
+		RoomID:           roomID,
+		ForwardingChains: stored.ForwardingChains,
+		KeySource:        stored.KeySource,
+		KeyBackupVersion: stored.KeyBackupVersion,
+		id:               sessionID,
+	}, nil
+}
+
+// GetGroupSession returns an inbound Megolm session, or an error wrapping ErrGroupSessionWithheld if the session
+// has been withheld.
+func (store *KVCryptoStore) GetGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) (*InboundGroupSession, error) {
+	var stored kvGroupSession
+	var found bool
+	err := store.DB.View(func(tx KVTx) (err error) {
+		found, err = kvGet(tx, store.groupSessionKey(roomID, senderKey, sessionID), &stored)
+		return
+	})
+	if err != nil || !found {
+		return nil, err
+	} else if stored.Pickle == nil {
+		return nil, fmt.Errorf("%w (%s)", ErrGroupSessionWithheld, stored.WithheldCode)
+	}
+	return store.unpickleGroupSession(roomID, senderKey, sessionID, &stored)
+}
+
+// PutWithheldGroupSession stores a withheld entry for a Megolm session, unless the session itself is already stored.
+func (store *KVCryptoStore) PutWithheldGroupSession(content event.RoomKeyWithheldEventContent) error {
+	return store.DB.Update(func(tx KVTx) error {
+		key := store.groupSessionKey(content.RoomID, content.SenderKey, content.SessionID)
+		existing, err := tx.Get(key)
+		if err != nil || existing != nil {
+			return err
+		}
+		return kvPut(tx, key, &kvGroupSession{WithheldCode: content.Code, WithheldReason: content.Reason})
+	})
+}
+
+// GetWithheldGroupSession returns the withheld entry of a Megolm session, or nil if the session isn't withheld.
+func (store *KVCryptoStore) GetWithheldGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) (*event.RoomKeyWithheldEventContent, error) {
+	var stored kvGroupSession
+	var found bool
+	err := store.DB.View(func(tx KVTx) (err error) {
+		found, err = kvGet(tx, store.groupSessionKey(roomID, senderKey, sessionID), &stored)
+		return
+	})
+	if err != nil || !found || stored.Pickle != nil {
+		return nil, err
+	}
+	return &event.RoomKeyWithheldEventContent{
+		RoomID:    roomID,
+		Algorithm: id.AlgorithmMegolmV1,
+		SessionID: sessionID,
+		SenderKey: senderKey,
+		Code:      stored.WithheldCode,
+		Reason:    stored.WithheldReason,
+	}, nil
+}
+
+// scanGroupSessions returns the inbound Megolm sessions whose keys start with the given prefix,
+// optionally filtered with the given function. Withheld entries are skipped.
+func (store *KVCryptoStore) scanGroupSessions(prefix []byte, filter func(*kvGroupSession) bool) ([]*InboundGroupSession, error) {
+	result := []*InboundGroupSession{}
+	err := store.DB.View(func(tx KVTx) error {
+		return tx.Scan(prefix, func(key, value []byte) error {
+			var stored kvGroupSession
+			if err := json.Unmarshal(value, &stored); err != nil {
+				return err
+			} else if stored.Pickle == nil || (filter != nil && !filter(&stored)) {
+				return nil
+			}
+			parts := kvKeySuffix(key, kvPrefix(store.accountPrefix(kvPrefixGroupSession)))
+			igs, err := store.unpickleGroupSession(id.RoomID(parts[0]), id.SenderKey(parts[1]), id.SessionID(parts[2]), &stored)
+			if err != nil {
+				return err
+			}
+			result = append(result, igs)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetGroupSessionsForRoom returns all inbound Megolm sessions of the given room.
+func (store *KVCryptoStore) GetGroupSessionsForRoom(roomID id.RoomID) ([]*InboundGroupSession, error) {
+	return store.scanGroupSessions(kvPrefix(store.accountPrefix(kvPrefixGroupSession), roomID.String()), nil)
+}
+
+// GetAllGroupSessions returns all inbound Megolm sessions in the store.
+func (store *KVCryptoStore) GetAllGroupSessions() ([]*InboundGroupSession, error) {
+	return store.scanGroupSessions(kvPrefix(store.accountPrefix(kvPrefixGroupSession)), nil)
+}
+
+// GetGroupSessionRooms returns the IDs of all rooms that have inbound Megolm sessions or withheld entries.
+func (store *KVCryptoStore) GetGroupSessionRooms() ([]id.RoomID, error) {
+	rooms := []id.RoomID{}
+	prefix := kvPrefix(store.accountPrefix(kvPrefixGroupSession))
+	err := store.DB.View(func(tx KVTx) error {
+		return tx.Scan(prefix, func(key, _ []byte) error {
+			// Keys are sorted, so all sessions of a room are next to each other.
+			roomID := id.RoomID(kvKeySuffix(key, prefix)[0])
+			if len(rooms) == 0 || rooms[len(rooms)-1] != roomID {
+				rooms = append(rooms, roomID)
+			}
+			return nil
+		})
+	})
+	return rooms, err
+}
+
+// RemoveGroupSessionsForRoom removes all inbound Megolm sessions and withheld entries of the given room.
+func (store *KVCryptoStore) RemoveGroupSessionsForRoom(roomID id.RoomID) (count int64, err error) {
+	err = store.DB.Update(func(tx KVTx) error {
+		var toDelete [][]byte
+		err := tx.Scan(kvPrefix(store.accountPrefix(kvPrefixGroupSession), roomID.String()), func(key, _ []byte) error {
+			toDelete = append(toDelete, append([]byte{}, key...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		count = int64(len(toDelete))
+		return kvDeleteKeys(tx, toDelete)
+	})
+	return
+}
+
+// GetGroupSessionsWithoutKeyBackupVersion returns the inbound Megolm sessions that haven't been uploaded to the
+// given key backup version.
+func (store *KVCryptoStore) GetGroupSessionsWithoutKeyBackupVersion(version string) ([]*InboundGroupSession, error) {
+	return store.scanGroupSessions(kvPrefix(store.accountPrefix(kvPrefixGroupSession)), func(stored *kvGroupSession) bool {
+		return stored.KeyBackupVersion != version
+	})
+}
+
+// MarkGroupSessionsBackedUp sets the key backup version of the given inbound Megolm sessions.
+func (store *KVCryptoStore) MarkGroupSessionsBackedUp(version string, sessions []*InboundGroupSession) error {
+	return store.DB.Update(func(tx KVTx) error {
+		for _, session := range sessions {
+			key := store.groupSessionKey(session.RoomID, session.SenderKey, session.ID())
+			var stored kvGroupSession
+			if found, err := kvGet(tx, key, &stored); err != nil {
+				return err
+			} else if !found || stored.Pickle == nil {
+				continue
+			}
+			stored.KeyBackupVersion = version
+			if err := kvPut(tx, key, &stored); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AddOutboundGroupSession stores an outbound Megolm session, replacing any previous session in the same room.
+func (store *KVCryptoStore) AddOutboundGroupSession(session *OutboundGroupSession) error {
+	pickled, err := store.pickle(&session.Internal)
+	if err != nil {
+		return err
+	}
+	return store.DB.Update(func(tx KVTx) error {
+		return kvPut(tx, kvKey(store.accountPrefix(kvPrefixOutbound), session.RoomID.String()), &kvOutboundGroupSession{
+			Pickle:       pickled,
+			Shared:       session.Shared,
+			MaxMessages:  session.MaxMessages,
+			MessageCount: session.MessageCount,
+			MaxAge:       session.MaxAge,
+			CreationTime: session.CreationTime,
+			LastUsed:     session.LastEncryptedTime,
+		})
+	})
+}
+
+// UpdateOutboundGroupSession replaces a stored outbound Megolm session.
+func (store *KVCryptoStore) UpdateOutboundGroupSession(session *OutboundGroupSession) error {
+	return store.AddOutboundGroupSession(session)
+}
+
+// GetOutboundGroupSession returns the outbound Megolm session of the given room, or nil if there isn't one.
+func (store *KVCryptoStore) GetOutboundGroupSession(roomID id.RoomID) (*OutboundGroupSession, error) {
+	var stored kvOutboundGroupSession
+	var found bool
+	err := store.DB.View(func(tx KVTx) (err error) {
+		found, err = kvGet(tx, kvKey(store.accountPrefix(kvPrefixOutbound), roomID.String()), &stored)
+		return
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return store.unpickleOutboundGroupSession(roomID, &stored)
+}
+
+func (store *KVCryptoStore) unpickleOutboundGroupSession(roomID id.RoomID, stored *kvOutboundGroupSession) (*OutboundGroupSession, error) {
+	intOGS := olm.NewBlankOutboundGroupSession()
+	err := store.unpickle(stored.Pickle, intOGS)
+	if err != nil {
+		return nil, err
+	}
+	ogs := &OutboundGroupSession{
+		Internal:     *intOGS,
+		MaxMessages:  stored.MaxMessages,
+		MessageCount: stored.MessageCount,
+		RoomID:       roomID,
+		Shared:       stored.Shared,
+		// The per-device sharing state isn't stored, so re-sharing will send the key to all devices again.
+		Users: make(map[UserDevice]OGSState),
+	}
+	ogs.MaxAge = stored.MaxAge
+	ogs.CreationTime = stored.CreationTime
+	ogs.LastEncryptedTime = stored.LastUsed
+	return ogs, nil
+}
+
+// RemoveOutboundGroupSession removes the outbound Megolm session of the given room.
+func (store *KVCryptoStore) RemoveOutboundGroupSession(roomID id.RoomID) error {
+	return store.DB.Update(func(tx KVTx) error {
+		return tx.Delete(kvKey(store.accountPrefix(kvPrefixOutbound), roomID.String()))
+	})
+}
+
+// RemoveExpiredOutboundGroupSessions removes all outbound Megolm sessions that have expired.
+func (store *KVCryptoStore) RemoveExpiredOutboundGroupSessions() (count int64, err error) {
+	err = store.DB.Update(func(tx KVTx) error {
+		var toDelete [][]byte
+		err := tx.Scan(kvPrefix(store.accountPrefix(kvPrefixOutbound)), func(key, value []byte) error {
+			var stored kvOutboundGroupSession
+			if err := json.Unmarshal(value, &stored); err != nil {
+				return err
+			}
+			ogs := OutboundGroupSession{MaxMessages: stored.MaxMessages, MessageCount: stored.MessageCount}
+			ogs.MaxAge = stored.MaxAge
+			ogs.CreationTime = stored.CreationTime
+			if ogs.Expired() {
+				toDelete = append(toDelete, append([]byte{}, key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		count = int64(len(toDelete))
+		return kvDeleteKeys(tx, toDelete)
+	})
+	return
+}
+
+// ValidateMessageIndex returns whether the given event information matches the stored information for the given
+// sender key, session ID and index. If there's no stored information, it's stored now.
+func (store *KVCryptoStore) ValidateMessageIndex(senderKey id.SenderKey, sessionID id.SessionID, eventID id.EventID, index uint, timestamp int64) bool {
+	valid := true
+	_ = store.DB.Update(func(tx KVTx) error {
+		key := kvKey(kvPrefixMessageIndex, senderKey.String(), sessionID.String(), strconv.FormatUint(uint64(index), 10))
+		var stored messageIndexValue
+		if found, err := kvGet(tx, key, &stored); err != nil {
+			return err
+		} else if found {
+			valid = stored.EventID == eventID && stored.Timestamp == timestamp
+			return nil
+		}
+		return kvPut(tx, key, &messageIndexValue{EventID: eventID, Timestamp: timestamp})
+	})
+	return valid
+}
+
+func (store *KVCryptoStore) scanDevices(tx KVTx, userID id.UserID, fn func(device *DeviceIdentity)) error {
+	return tx.Scan(kvPrefix(kvPrefixDevice, userID.String()), func(_, value []byte) error {
+		var device DeviceIdentity
+		if err := json.Unmarshal(value, &device); err != nil {
+			return err
+		}
+		fn(&device)
+		return nil
+	})
+}
+
+// GetDevices returns all devices of the given user, or nil if the user's device list isn't tracked.
+func (store *KVCryptoStore) GetDevices(userID id.UserID) (devices map[id.DeviceID]*DeviceIdentity, err error) {
+	err = store.DB.View(func(tx KVTx) error {
+		if tracked, err := tx.Get(kvKey(kvPrefixTrackedUser, userID.String())); err != nil || tracked == nil {
+			return err
+		}
+		devices = make(map[id.DeviceID]*DeviceIdentity)
+		return store.scanDevices(tx, userID, func(device *DeviceIdentity) {
+			devices[device.DeviceID] = device
+		})
+	})
+	return
+}
+
+// GetDevice returns a specific device of the given user.
+func (store *KVCryptoStore) GetDevice(userID id.UserID, deviceID id.DeviceID) (device *DeviceIdentity, err error) {
+	err = store.DB.View(func(tx KVTx) error {
+		var stored DeviceIdentity
+		found, err := kvGet(tx, kvKey(kvPrefixDevice, userID.String(), deviceID.String()), &stored)
+		if found {
+			device = &stored
+		}
+		return err
+	})
+	return
+}
+
+// FindDeviceByKey finds a device of the given user by its identity key.
+func (store *KVCryptoStore) FindDeviceByKey(userID id.UserID, identityKey id.IdentityKey) (device *DeviceIdentity, err error) {
+	err = store.DB.View(func(tx KVTx) error {
+		return store.scanDevices(tx, userID, func(candidate *DeviceIdentity) {
+			if candidate.IdentityKey == identityKey {
+				device = candidate
+			}
+		})
+	})
+	return
+}
+
+// PutDevice stores a single device, replacing it if it already exists.
+func (store *KVCryptoStore) PutDevice(userID id.UserID, device *DeviceIdentity) error {
+	return store.DB.Update(func(tx KVTx) error {
+		return kvPut(tx, kvKey(kvPrefixDevice, userID.String(), device.DeviceID.String()), device)
+	})
+}
+
+// PutDevices replaces the device list of the given user and marks the user as tracked and up to date.
+func (store *KVCryptoStore) PutDevices(userID id.UserID, devices map[id.DeviceID]*DeviceIdentity) error {
+	return store.DB.Update(func(tx KVTx) error {
+		if err := kvPut(tx, kvKey(kvPrefixTrackedUser, userID.String()), &kvTrackedUser{}); err != nil {
+			return err
+		}
+		var toDelete [][]byte
+		err := tx.Scan(kvPrefix(kvPrefixDevice, userID.String()), func(key, _ []byte) error {
+			toDelete = append(toDelete, append([]byte{}, key...))
+			return nil
+		})
+		if err != nil {
+			return err
+		} else if err = kvDeleteKeys(tx, toDelete); err != nil {
+			return err
+		}
+		for deviceID, device := range devices {
+			if err = kvPut(tx, kvKey(kvPrefixDevice, userID.String(), deviceID.String()), device); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PutUserTrustSettings stores the trust settings of the given user.
+func (store *KVCryptoStore) PutUserTrustSettings(userID id.UserID, settings UserTrustSettings) error {
+	return store.DB.Update(func(tx KVTx) error {
+		return kvPut(tx, kvKey(store.accountPrefix(kvPrefixTrustSettings), userID.String()), &settings)
+	})
+}
+
+// GetUserTrustSettings returns the trust settings of the given user, or nil if there are none.
+func (store *KVCryptoStore) GetUserTrustSettings(userID id.UserID) (settings *UserTrustSettings, err error) {
+	err = store.DB.View(func(tx KVTx) error {
+		var stored UserTrustSettings
+		found, err := kvGet(tx, kvKey(store.accountPrefix(kvPrefixTrustSettings), userID.String()), &stored)
+		if found {
+			settings = &stored
+		}
+		return err
+	})
+	return
+}
+
+// FilterTrackedUsers returns the users from the given list whose device lists are tracked.
+func (store *KVCryptoStore) FilterTrackedUsers(users []id.UserID) []id.UserID {
+	var ptr int
+	_ = store.DB.View(func(tx KVTx) error {
+		for _, userID := range users {
+			if tracked, err := tx.Get(kvKey(kvPrefixTrackedUser, userID.String())); err == nil && tracked != nil {
+				users[ptr] = userID
+				ptr++
+			}
+		}
+		return nil
+	})
+	return users[:ptr]
+}
+
+// MarkTrackedUsersOutdated marks the device lists of the given users as outdated. Untracked users are ignored.
+func (store *KVCryptoStore) MarkTrackedUsersOutdated(users []id.UserID) error {
+	return store.DB.Update(func(tx KVTx) error {
+		for _, userID := range users {
+			key := kvKey(kvPrefixTrackedUser, userID.String())
+			var stored kvTrackedUser
+			if found, err := kvGet(tx, key, &stored); err != nil {
+				return err
+			} else if found {
+				stored.Outdated = true
+				if err = kvPut(tx, key, &stored); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// GetOutdatedTrackedUsers returns the users whose device lists are marked as outdated.
+func (store *KVCryptoStore) GetOutdatedTrackedUsers() ([]id.UserID, error) {
+	users := []id.UserID{}
+	prefix := kvPrefix(kvPrefixTrackedUser)
+	err := store.DB.View(func(tx KVTx) error {
+		return tx.Scan(prefix, func(key, value []byte) error {
+			var stored kvTrackedUser
+			if err := json.Unmarshal(value, &stored); err != nil {
+				return err
+			} else if stored.Outdated {
+				users = append(users, id.UserID(key[len(prefix):]))
+			}
+			return nil
+		})
+	})
+	return users, err
+}
+
+// PutCrossSigningKey stores a cross-signing key of the given user.
+func (store *KVCryptoStore) PutCrossSigningKey(userID id.UserID, usage id.CrossSigningUsage, key id.Ed25519) error {
+	return store.DB.Update(func(tx KVTx) error {
+		return tx.Put(kvKey(kvPrefixCrossSigning, userID.String(), string(usage)), []byte(key))
+	})
+}
+
+// GetCrossSigningKeys returns the stored cross-signing keys of the given user.
+func (store *KVCryptoStore) GetCrossSigningKeys(userID id.UserID) (map[id.CrossSigningUsage]id.Ed25519, error) {
+	keys := make(map[id.CrossSigningUsage]id.Ed25519)
+	prefix := kvPrefix(kvPrefixCrossSigning, userID.String())
+	err := store.DB.View(func(tx KVTx) error {
+		return tx.Scan(prefix, func(key, value []byte) error {
+			keys[id.CrossSigningUsage(key[len(prefix):])] = id.Ed25519(value)
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// PutSignature stores a signature of a cross-signing or device key.
+func (store *KVCryptoStore) PutSignature(signedUserID id.UserID, signedKey id.Ed25519, signerUserID id.UserID, signerKey id.Ed25519, signature string) error {
+	return store.DB.Update(func(tx KVTx) error {
+		return tx.Put(kvKey(kvPrefixSignature, signedUserID.String(), signedKey.String(), signerUserID.String(), signerKey.String()), []byte(signature))
+	})
+}
+
+// GetSignaturesForKeyBy returns the signatures of a cross-signing or device key made by the given signer.
+func (store *KVCryptoStore) GetSignaturesForKeyBy(userID id.UserID, key id.Ed25519, signerID id.UserID) (map[id.Ed25519]string, error) {
+	signatures := make(map[id.Ed25519]string)
+	prefix := kvPrefix(kvPrefixSignature, userID.String(), key.String(), signerID.String())
+	err := store.DB.View(func(tx KVTx) error {
+		return tx.Scan(prefix, func(key, value []byte) error {
+			signatures[id.Ed25519(key[len(prefix):])] = string(value)
+			return nil
+		})
+	})
+	return signatures, err
+}
+
+// IsKeySignedBy returns whether a cross-signing or device key is signed by the given signer.
+func (store *KVCryptoStore) IsKeySignedBy(userID id.UserID, key id.Ed25519, signerID id.UserID, signerKey id.Ed25519) (signed bool, err error) {
+	err = store.DB.View(func(tx KVTx) error {
+		signature, err := tx.Get(kvKey(kvPrefixSignature, userID.String(), key.String(), signerID.String(), signerKey.String()))
+		signed = signature != nil
+		return err
+	})
+	return
+}
+
+// scanSignaturesBy calls the given function for every signature made by the given signer. This has to scan all
+// signatures, as they're keyed by the signed key.
+func (store *KVCryptoStore) scanSignaturesBy(tx KVTx, signerID id.UserID, signerKey id.Ed25519, fn func(key []byte, signedUserID id.UserID, signedKey id.Ed25519)) error {
+	prefix := kvPrefix(kvPrefixSignature)
+	suffix := []byte(kvSeparator + signerID.String() + kvSeparator + signerKey.String())
+	return tx.Scan(prefix, func(key, _ []byte) error {
+		if bytes.HasSuffix(key, suffix) {
+			parts := kvKeySuffix(key, prefix)
+			fn(key, id.UserID(parts[0]), id.Ed25519(parts[1]))
+		}
+		return nil
+	})
+}
+
+// GetKeysSignedBy returns the keys that have been signed by the given signer, grouped by the owner of the key.
+func (store *KVCryptoStore) GetKeysSignedBy(signerID id.UserID, signerKey id.Ed25519) (map[id.UserID][]id.Ed25519, error) {
+	signedKeys := make(map[id.UserID][]id.Ed25519)
+	err := store.DB.View(func(tx KVTx) error {
+		return store.scanSignaturesBy(tx, signerID, signerKey, func(_ []byte, signedUserID id.UserID, signedKey id.Ed25519) {
+			signedKeys[signedUserID] = append(signedKeys[signedUserID], signedKey)
+		})
+	})
+	return signedKeys, err
+}
+
+// DropSignaturesByKey deletes the signatures made by the given user and key.
+func (store *KVCryptoStore) DropSignaturesByKey(userID id.UserID, key id.Ed25519) (count int64, err error) {
+	err = store.DB.Update(func(tx KVTx) error {
+		var toDelete [][]byte
+		err := store.scanSignaturesBy(tx, userID, key, func(key []byte, _ id.UserID, _ id.Ed25519) {
+			toDelete = append(toDelete, append([]byte{}, key...))
+		})
+		if err != nil {
+			return err
+		}
+		count = int64(len(toDelete))
+		return kvDeleteKeys(tx, toDelete)
+	})
+	return
+}
+
+// Stats counts the entries in the store.
+func (store *KVCryptoStore) Stats(_ context.Context) (*StoreStats, error) {
+	var stats StoreStats
+	err := store.DB.View(func(tx KVTx) error {
+		err := tx.Scan(kvPrefix(store.accountPrefix(kvPrefixOlmSession)), func(_, value []byte) error {
+			var stored kvOlmSession
+			if err := json.Unmarshal(value, &stored); err != nil {
+				return err
+			}
+			stats.OlmSessions++
+			if stats.OldestOlmSession.IsZero() || stored.CreationTime.Before(stats.OldestOlmSession) {
+				stats.OldestOlmSession = stored.CreationTime
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Scan(kvPrefix(store.accountPrefix(kvPrefixGroupSession)), func(_, value []byte) error {
+			var stored kvGroupSession
+			if err := json.Unmarshal(value, &stored); err != nil {
+				return err
+			} else if stored.Pickle == nil {
+				stats.WithheldGroupSessions++
+			} else {
+				stats.InboundGroupSessions++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Scan(kvPrefix(store.accountPrefix(kvPrefixOutbound)), func(_, value []byte) error {
+			var stored kvOutboundGroupSession
+			if err := json.Unmarshal(value, &stored); err != nil {
+				return err
+			}
+			stats.OutboundGroupSessions++
+			if stats.OldestOutboundGroupSession.IsZero() || stored.CreationTime.Before(stats.OldestOutboundGroupSession) {
+				stats.OldestOutboundGroupSession = stored.CreationTime
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Scan(kvPrefix(kvPrefixTrackedUser), func(_, _ []byte) error {
+			stats.TrackedUsers++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Scan(kvPrefix(kvPrefixDevice), func(_, _ []byte) error {
+			stats.Devices++
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// ExportTo inserts all data in the store into the target store. Everything except the account is read in a single
+// read-only transaction, so the target gets a consistent snapshot of the store.
+func (store *KVCryptoStore) ExportTo(ctx context.Context, target Store) error {
+	if account, err := store.GetAccount(); err != nil {
+		return fmt.Errorf("failed to get account: %w", err)
+	} else if account != nil {
+		if err = target.PutAccount(account); err != nil {
+			return fmt.Errorf("failed to copy account: %w", err)
+		}
+	}
+	steps := []struct {
+		name string
+		fn   func(ctx context.Context, tx KVTx, target Store) error
+	}{
+		{"olm sessions", store.exportOlmSessions},
+		{"megolm sessions", store.exportGroupSessions},
+		{"outbound megolm sessions", store.exportOutboundGroupSessions},
+		{"message indices", store.exportMessageIndices},
+		{"devices", store.exportDevices},
+		{"trust settings", store.exportUserTrustSettings},
+		{"cross-signing keys", store.exportCrossSigningKeys},
+		{"signatures", store.exportSignatures},
+	}
+	return store.DB.View(func(tx KVTx) error {
+		for _, step := range steps {
+			if err := step.fn(ctx, tx, target); err != nil {
+				return fmt.Errorf("failed to copy %s: %w", step.name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// kvScanContext is like KVTx.Scan, but stops when the context is cancelled. The key is passed to the function
+// already split into parts after the prefix.
+func kvScanContext(ctx context.Context, tx KVTx, prefix []byte, fn func(parts []string, value []byte) error) error {
+	return tx.Scan(prefix, func(key, value []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(kvKeySuffix(key, prefix), value)
+	})
+}
+
+func (store *KVCryptoStore) exportOlmSessions(ctx context.Context, tx KVTx, target Store) error {
+	return kvScanContext(ctx, tx, kvPrefix(store.accountPrefix(kvPrefixOlmSession)), func(parts []string, value []byte) error {
+		var stored kvOlmSession
+		if err := json.Unmarshal(value, &stored); err != nil {
+			return err
+		}
+		sess := &OlmSession{Internal: *olm.NewBlankSession(), id: id.SessionID(parts[1])}
+		sess.TimeMixin = stored.TimeMixin
+		if err := store.unpickle(stored.Pickle, &sess.Internal); err != nil {
+			return err
+		}
+		return target.AddSession(id.SenderKey(parts[0]), sess)
+	})
+}
+
+func (store *KVCryptoStore) exportGroupSessions(ctx context.Context, tx KVTx, target Store) error {
+	batch := make([]*InboundGroupSession, 0, exportGroupSessionBatchSize)
+	var withheld []event.RoomKeyWithheldEventContent
+	err := kvScanContext(ctx, tx, kvPrefix(store.accountPrefix(kvPrefixGroupSession)), func(parts []string, value []byte) error {
+		var stored kvGroupSession
+		if err := json.Unmarshal(value, &stored); err != nil {
+			return err
+		}
+		roomID, senderKey, sessionID := id.RoomID(parts[0]), id.SenderKey(parts[1]), id.SessionID(parts[2])
+		if stored.Pickle == nil {
+			withheld = append(withheld, event.RoomKeyWithheldEventContent{
+				RoomID:    roomID,
+				Algorithm: id.AlgorithmMegolmV1,
+				SessionID: sessionID,
+				SenderKey: senderKey,
+				Code:      stored.WithheldCode,
+				Reason:    stored.WithheldReason,
+			})
+			return nil
+		}
+		igs, err := store.unpickleGroupSession(roomID, senderKey, sessionID, &stored)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, igs)
+		if len(batch) >= exportGroupSessionBatchSize {
+			err = target.PutGroupSessions(batch)
+			batch = batch[:0]
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	} else if len(batch) > 0 {
+		if err = target.PutGroupSessions(batch); err != nil {
+			return err
+		}
+	}
+	// Withheld entries are inserted last, as PutWithheldGroupSession doesn't replace real sessions.
+	for _, content := range withheld {
+		if err = target.PutWithheldGroupSession(content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *KVCryptoStore) exportOutboundGroupSessions(ctx context.Context, tx KVTx, target Store) error {
+	return kvScanContext(ctx, tx, kvPrefix(store.accountPrefix(kvPrefixOutbound)), func(parts []string, value []byte) error {
+		var stored kvOutboundGroupSession
+		if err := json.Unmarshal(value, &stored); err != nil {
+			return err
+		}
+		ogs, err := store.unpickleOutboundGroupSession(id.RoomID(parts[0]), &stored)
+		if err != nil {
+			return err
+		}
+		return target.AddOutboundGroupSession(ogs)
+	})
+}
+
+func (store *KVCryptoStore) exportMessageIndices(ctx context.Context, tx KVTx, target Store) error {
+	return kvScanContext(ctx, tx, kvPrefix(kvPrefixMessageIndex), func(parts []string, value []byte) error {
+		var stored messageIndexValue
+		if err := json.Unmarshal(value, &stored); err != nil {
+			return err
+		}
+		index, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			return err
+		}
+		target.ValidateMessageIndex(id.SenderKey(parts[0]), id.SessionID(parts[1]), stored.EventID, uint(index), stored.Timestamp)
+		return nil
+	})
+}
+
+func (store *KVCryptoStore) exportDevices(ctx context.Context, tx KVTx, target Store) error {
+	var outdatedUsers []id.UserID
+	err := kvScanContext(ctx, tx, kvPrefix(kvPrefixTrackedUser), func(parts []string, value []byte) error {
+		var stored kvTrackedUser
+		if err := json.Unmarshal(value, &stored); err != nil {
+			return err
+		}
+		userID := id.UserID(parts[0])
+		if stored.Outdated {
+			outdatedUsers = append(outdatedUsers, userID)
+		}
+		devices := make(map[id.DeviceID]*DeviceIdentity)
+		err := store.scanDevices(tx, userID, func(device *DeviceIdentity) {
+			devices[device.DeviceID] = device
+		})
+		if err != nil {
+			return err
+		}
+		return target.PutDevices(userID, devices)
+	})
+	if err != nil {
+		return err
+	}
+	return target.MarkTrackedUsersOutdated(outdatedUsers)
+}
+
+func (store *KVCryptoStore) exportUserTrustSettings(ctx context.Context, tx KVTx, target Store) error {
+	return kvScanContext(ctx, tx, kvPrefix(store.accountPrefix(kvPrefixTrustSettings)), func(parts []string, value []byte) error {
+		var settings UserTrustSettings
+		if err := json.Unmarshal(value, &settings); err != nil {
+			return err
+		}
+		return target.PutUserTrustSettings(id.UserID(parts[0]), settings)
+	})
+}
+
+func (store *KVCryptoStore) exportCrossSigningKeys(ctx context.Context, tx KVTx, target Store) error {
+	return kvScanContext(ctx, tx, kvPrefix(kvPrefixCrossSigning), func(parts []string, value []byte) error {
+		return target.PutCrossSigningKey(id.UserID(parts[0]), id.CrossSigningUsage(parts[1]), id.Ed25519(value))
+	})
+}
+
+func (store *KVCryptoStore) exportSignatures(ctx context.Context, tx KVTx, target Store) error {
+	return kvScanContext(ctx, tx, kvPrefix(kvPrefixSignature), func(parts []string, value []byte) error {
+		return target.PutSignature(id.UserID(parts[0]), id.Ed25519(parts[1]), id.UserID(parts[2]), id.Ed25519(parts[3]), string(value))
+	})
+}
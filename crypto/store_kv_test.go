@@ -0,0 +1,161 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// memoryKV is a KVBackend for tests. Update transactions work on a copy of the data, which replaces the data
+// only if the transaction function succeeds.
+type memoryKV struct {
+	lock sync.RWMutex
+	data map[string][]byte
+}
+
+type memoryKVTx struct {
+	data     map[string][]byte
+	readOnly bool
+}
+
+func newMemoryKV() *memoryKV {
+	return &memoryKV{data: make(map[string][]byte)}
+}
+
+func (kv *memoryKV) View(fn func(tx KVTx) error) error {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	return fn(&memoryKVTx{data: kv.data, readOnly: true})
+}
+
+func (kv *memoryKV) Update(fn func(tx KVTx) error) error {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	tx := &memoryKVTx{data: make(map[string][]byte, len(kv.data))}
+	for key, value := range kv.data {
+		tx.data[key] = value
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	kv.data = tx.data
+	return nil
+}
+
+var errReadOnlyTx = errors.New("transaction is read-only")
+
+func (tx *memoryKVTx) Get(key []byte) ([]byte, error) {
+	return tx.data[string(key)], nil
+}
+
+func (tx *memoryKVTx) Put(key, value []byte) error {
+	if tx.readOnly {
+		return errReadOnlyTx
+	}
+	tx.data[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (tx *memoryKVTx) Delete(key []byte) error {
+	if tx.readOnly {
+		return errReadOnlyTx
+	}
+	delete(tx.data, string(key))
+	return nil
+}
+
+func (tx *memoryKVTx) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	var keys []string
+	for key := range tx.data {
+		if strings.HasPrefix(key, string(prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn([]byte(key), tx.data[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestKVStoreTransactions(t *testing.T) {
+	kv := newMemoryKV()
+	store := NewKVCryptoStore(kv, []byte("test"))
+	devices := map[id.DeviceID]*DeviceIdentity{
+		"dev1": {UserID: "@user:example.com", DeviceID: "dev1", IdentityKey: "key1", SigningKey: "key1"},
+		"dev2": {UserID: "@user:example.com", DeviceID: "dev2", IdentityKey: "key2", SigningKey: "key2"},
+	}
+	if err := store.PutDevices("@user:example.com", devices); err != nil {
+		t.Fatalf("Error storing devices: %v", err)
+	}
+	// A user whose ID has the other user's ID as a prefix must not show up in prefix scans.
+	if err := store.PutDevices("@user:example.com2", map[id.DeviceID]*DeviceIdentity{
+		"dev3": {UserID: "@user:example.com2", DeviceID: "dev3", IdentityKey: "key3", SigningKey: "key3"},
+	}); err != nil {
+		t.Fatalf("Error storing devices: %v", err)
+	}
+	if retrieved, err := store.GetDevices("@user:example.com"); err != nil || len(retrieved) != 2 {
+		t.Errorf("Expected 2 devices, got %d (%v)", len(retrieved), err)
+	}
+	if device, _ := store.FindDeviceByKey("@user:example.com", "key2"); device == nil || device.DeviceID != "dev2" {
+		t.Errorf("Didn't find device by identity key")
+	}
+
+	if err := store.PutDevices("@user:example.com", map[id.DeviceID]*DeviceIdentity{
+		"dev1": devices["dev1"],
+	}); err != nil {
+		t.Fatalf("Error replacing devices: %v", err)
+	}
+	if retrieved, _ := store.GetDevices("@user:example.com"); len(retrieved) != 1 {
+		t.Errorf("Expected 1 device after replacing device list, got %d", len(retrieved))
+	}
+
+	errFailed := errors.New("failed")
+	err := kv.Update(func(tx KVTx) error {
+		_ = tx.Delete(kvKey(kvPrefixDevice, "@user:example.com", "dev1"))
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Errorf("Expected transaction error, got %v", err)
+	} else if device, _ := store.GetDevice("@user:example.com", "dev1"); device == nil {
+		t.Errorf("Failed transaction wasn't rolled back")
+	}
+}
+
+func TestKVStoreUpgrade(t *testing.T) {
+	kv := newMemoryKV()
+	store := NewKVCryptoStore(kv, []byte("test"))
+	if err := store.Upgrade(); err != nil {
+		t.Fatalf("Error upgrading empty store: %v", err)
+	}
+	var version int
+	_ = kv.View(func(tx KVTx) error {
+		_, err := kvGet(tx, kvKey(kvKeyVersion), &version)
+		return err
+	})
+	if version != KVCryptoStoreVersion {
+		t.Errorf("Expected version %d to be stored, got %d", KVCryptoStoreVersion, version)
+	}
+	if err := store.ForAccount("@user:example.com", "dev").Upgrade(); err != nil {
+		t.Errorf("Error upgrading already upgraded store: %v", err)
+	}
+
+	_ = kv.Update(func(tx KVTx) error {
+		return kvPut(tx, kvKey(kvKeyVersion), KVCryptoStoreVersion+1)
+	})
+	if err := store.Upgrade(); !errors.Is(err, ErrUnsupportedStoreVersion) {
+		t.Errorf("Expected ErrUnsupportedStoreVersion from newer store, got %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+)
+
+// AccountLocker is implemented by crypto stores that can be shared by multiple processes, e.g. a bridge and its
+// provisioning API. OlmMachine holds the lock while it mutates the olm account (uploading keys and creating inbound
+// sessions), so that one-time keys generated or used by one process aren't overwritten by another.
+type AccountLocker interface {
+	// LockAccount blocks until the account lock is acquired or the context is cancelled. After the lock is
+	// acquired, GetAccount must return the latest account state, even if another process has changed it.
+	LockAccount(ctx context.Context) (unlock func(), err error)
+}
+
+var _ AccountLocker = (*SQLCryptoStore)(nil)
+
+// accountLockPollInterval is how often a non-blocking lock is retried while waiting for another process.
+const accountLockPollInterval = 50 * time.Millisecond
+
+// LockAccount acquires a cross-process lock for the account of this store. With PostgreSQL, this uses a session-level
+// advisory lock. With SQLite, the lock file next to the database (see SQLiteLockFile) is locked with flock.
+// Stores using SQLite without a lock file and other dialects only get a no-op lock.
+func (store *SQLCryptoStore) LockAccount(ctx context.Context) (func(), error) {
+	var unlock func() error
+	var err error
+	switch {
+	case store.Dialect == "postgres":
+		unlock, err = store.lockPostgresAccount(ctx)
+	case store.Dialect == "sqlite3" && store.SQLiteLockFile != "":
+		unlock, err = lockFile(ctx, store.SQLiteLockFile, accountLockPollInterval)
+	default:
+		return func() {}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Another process may have changed the account while we weren't holding the lock.
+	store.Account = nil
+	return func() {
+		if err := store.Flush(); err != nil {
+			store.Log.Warn("Failed to flush store before releasing account lock: %v", err)
+		}
+		if err := unlock(); err != nil {
+			store.Log.Warn("Failed to release account lock: %v", err)
+		}
+	}, nil
+}
+
+// advisoryLockKey returns the key used for the PostgreSQL advisory lock of this store's account.
+func (store *SQLCryptoStore) advisoryLockKey() int64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte("mautrix-go crypto account " + store.AccountID))
+	return int64(hash.Sum64())
+}
+
+func (store *SQLCryptoStore) lockPostgresAccount(ctx context.Context) (func() error, error) {
+	// Advisory locks belong to the database session, so the same connection must be used for unlocking.
+	conn, err := store.DB.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection for advisory lock: %w", err)
+	}
+	key := store.advisoryLockKey()
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", key)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to acquire advisory lock: %w", err)
+	}
+	return func() error {
+		_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+		closeErr := conn.Close()
+		if err != nil {
+			return err
+		}
+		return closeErr
+	}, nil
+}
+
+// sqliteLockFilePath returns the path of the lock file for the SQLite database at the given path,
+// or an empty string for in-memory databases.
+func sqliteLockFilePath(path string) string {
+	if idx := strings.IndexRune(path, '?'); idx >= 0 {
+		path = path[:idx]
+	}
+	if path == "" || path == ":memory:" {
+		return ""
+	}
+	return path + ".lock"
+}
+
+// lockAccount acquires the in-process account lock and the cross-process account lock if the store supports it,
+// and reloads the account from the store, as another process may have changed it since it was last loaded.
+// The account must only be mutated while holding the lock.
+func (mach *OlmMachine) lockAccount(ctx context.Context) (func(), error) {
+	mach.accountLock.Lock()
+	locker, ok := mach.CryptoStore.(AccountLocker)
+	if !ok {
+		return mach.accountLock.Unlock, nil
+	}
+	unlockStore, err := locker.LockAccount(ctx)
+	if err != nil {
+		mach.accountLock.Unlock()
+		return nil, fmt.Errorf("failed to lock account: %w", err)
+	}
+	unlock := func() {
+		unlockStore()
+		mach.accountLock.Unlock()
+	}
+	account, err := mach.CryptoStore.GetAccount()
+	if err != nil {
+		unlock()
+		return nil, fmt.Errorf("failed to reload account: %w", err)
+	} else if account != nil {
+		mach.setAccount(account)
+	}
+	return unlock, nil
+}
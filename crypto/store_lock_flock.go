@@ -0,0 +1,50 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package crypto
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockFile takes an exclusive flock on the file at the given path, creating it if necessary.
+// The lock is retried every pollInterval until it's acquired or the context is cancelled.
+func lockFile(ctx context.Context, path string, pollInterval time.Duration) (func() error, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fd := int(file.Fd())
+	for {
+		err = syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		} else if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			_ = file.Close()
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			_ = file.Close()
+			return nil, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+	return func() error {
+		err := syscall.Flock(fd, syscall.LOCK_UN)
+		closeErr := file.Close()
+		if err != nil {
+			return err
+		}
+		return closeErr
+	}, nil
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package crypto
+
+import (
+	"context"
+	"time"
+)
+
+// lockFile is a no-op on platforms without flock, so SQLite stores can't be safely shared between processes there.
+func lockFile(_ context.Context, _ string, _ time.Duration) (func() error, error) {
+	return func() error { return nil }, nil
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/crypto/utils"
+)
+
+var ErrInvalidSnapshot = errors.New("invalid crypto store snapshot")
+
+var snapshotHeader = []byte("mautrix-go crypto snapshot v1:")
+
+const snapshotEncryptionInfo = "mautrix-go crypto store snapshot"
+
+// MemoryStore is a Store that only keeps data in memory. It's meant for ephemeral deployments (e.g. serverless
+// functions), which can persist the state between invocations by exporting an encrypted snapshot with ExportSnapshot
+// and restoring it with NewMemoryStoreFromSnapshot.
+type MemoryStore struct {
+	*GobStore
+}
+
+// NewMemoryStore creates a new empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{newGobStore("")}
+}
+
+// NewMemoryStoreFromSnapshot creates a MemoryStore and fills it with the given snapshot.
+func NewMemoryStoreFromSnapshot(snapshot, key []byte) (*MemoryStore, error) {
+	store := NewMemoryStore()
+	return store, store.ImportSnapshot(snapshot, key)
+}
+
+// ExportSnapshot serializes the full state of the store and encrypts it with AES-256-GCM using a key derived from
+// the given secret. The secret should be stored separately from the snapshot, as anyone with both can read the
+// account keys and decrypt messages.
+func (gs *GobStore) ExportSnapshot(key []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gs.lock.Lock()
+	err := gob.NewEncoder(&buf).Encode(gs)
+	gs.lock.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode store: %w", err)
+	}
+	plaintext := buf.Bytes()
+	defer utils.WipeBytes(plaintext)
+	encryptionKey := utils.DeriveAESGCMKey(key, snapshotEncryptionInfo)
+	defer utils.WipeBytes(encryptionKey[:])
+	encrypted, err := utils.EncryptAESGCM(encryptionKey, plaintext, snapshotHeader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt snapshot: %w", err)
+	}
+	return append(snapshotHeader[:len(snapshotHeader):len(snapshotHeader)], encrypted...), nil
+}
+
+// ImportSnapshot decrypts a snapshot created with ExportSnapshot and replaces all data in the store with it.
+// If the snapshot can't be decrypted or decoded, the store is left unchanged.
+func (gs *GobStore) ImportSnapshot(snapshot, key []byte) error {
+	if !bytes.HasPrefix(snapshot, snapshotHeader) {
+		return ErrInvalidSnapshot
+	}
+	encryptionKey := utils.DeriveAESGCMKey(key, snapshotEncryptionInfo)
+	defer utils.WipeBytes(encryptionKey[:])
+	plaintext, err := utils.DecryptAESGCM(encryptionKey, snapshot[len(snapshotHeader):], snapshotHeader)
+	if err != nil {
+		return fmt.Errorf("%w: failed to decrypt: %v", ErrInvalidSnapshot, err)
+	}
+	defer utils.WipeBytes(plaintext)
+	decoded := newGobStore("")
+	err = gob.NewDecoder(bytes.NewReader(plaintext)).Decode(decoded)
+	if err != nil {
+		return fmt.Errorf("%w: failed to decode: %v", ErrInvalidSnapshot, err)
+	} else if err = decoded.checkVersion(); err != nil {
+		return err
+	}
+	gs.lock.Lock()
+	gs.Account = decoded.Account
+	gs.Sessions = decoded.Sessions
+	gs.GroupSessions = decoded.GroupSessions
+	gs.WithheldGroupSessions = decoded.WithheldGroupSessions
+	gs.OutGroupSessions = decoded.OutGroupSessions
+	gs.MessageIndices = decoded.MessageIndices
+	gs.Devices = decoded.Devices
+	gs.CrossSigningKeys = decoded.CrossSigningKeys
+	gs.KeySignatures = decoded.KeySignatures
+	gs.UserTrustSettings = decoded.UserTrustSettings
+	gs.OutdatedUsers = decoded.OutdatedUsers
+	err = gs.save()
+	gs.lock.Unlock()
+	return err
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// MigratedGobStoreSuffix is appended to the path of a GobStore file after it has been migrated with MigrateGobStoreToSQL.
+const MigratedGobStoreSuffix = ".migrated"
+
+// MigrateGobStoreToSQL copies everything in the GobStore file at the given path into the given SQL store.
+// The SQL store must already be upgraded (see SQLCryptoStore.CreateTables) and must not have an account yet.
+//
+// After everything has been copied, the gob file is renamed by appending MigratedGobStoreSuffix, so the migration
+// won't be attempted again. If the file doesn't exist, this does nothing and returns nil, which means it's safe to
+// call this on every startup before using the SQL store.
+func MigrateGobStoreToSQL(path string, store *SQLCryptoStore) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	gs, err := NewGobStore(path)
+	if err != nil {
+		return fmt.Errorf("failed to load gob store: %w", err)
+	}
+	store.Log.Debug("Migrating crypto store from %s to SQL", path)
+	err = CopyStore(context.Background(), gs, store)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path, path+MigratedGobStoreSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to rename migrated gob store: %w", err)
+	}
+	store.Log.Debug("Finished migrating crypto store from %s to SQL", path)
+	return nil
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"fmt"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// AccountNamespace returns the account ID used for the given user and device when several accounts share one crypto
+// store database, e.g. the double puppets of an appservice bridge.
+func AccountNamespace(userID id.UserID, deviceID id.DeviceID) string {
+	return fmt.Sprintf("%s/%s", userID, deviceID)
+}
+
+// ForAccount returns a view of the store for the given user and device. The view uses the same database, prepared
+// statements and write batcher as this store, but only accesses the rows of its own account, so a single database
+// can hold the crypto state of any number of accounts. Device lists and cross-signing keys are shared by all accounts.
+//
+// Views don't need to be closed separately. When using SQLite, all views share the same account lock file,
+// so LockAccount calls of different accounts will wait for each other.
+func (store *SQLCryptoStore) ForAccount(userID id.UserID, deviceID id.DeviceID) *SQLCryptoStore {
+	root := store
+	if store.root != nil {
+		root = store.root
+	}
+	view := NewSQLCryptoStore(root.DB, root.Dialect, AccountNamespace(userID, deviceID), deviceID, nil, root.Log)
+	view.PickleKey = root.PickleKey
+	view.EncryptPickles = root.EncryptPickles
+	view.PickleEncrypter = root.PickleEncrypter
+	view.PrepareStatements = root.PrepareStatements
+	view.SQLiteLockFile = root.SQLiteLockFile
+	view.writeBatcher = root.writeBatcher
+	view.root = root
+	return view
+}
+
+// ForAccount returns a view of the store for the given user and device, which keeps its account-specific data in a
+// separate namespace of the same database. Device lists and cross-signing keys are shared by all accounts.
+func (store *KVCryptoStore) ForAccount(userID id.UserID, deviceID id.DeviceID) *KVCryptoStore {
+	view := NewKVCryptoStore(store.DB, nil)
+	view.PickleKey = store.PickleKey
+	view.AccountNamespace = AccountNamespace(userID, deviceID)
+	view.PickleEncrypter = store.PickleEncrypter
+	return view
+}
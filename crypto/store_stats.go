@@ -0,0 +1,126 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// StoreStats contains the number of entries of different types in a crypto store, which can be used for monitoring
+// that the store isn't growing without bounds.
+type StoreStats struct {
+	OlmSessions           int
+	InboundGroupSessions  int
+	WithheldGroupSessions int
+	OutboundGroupSessions int
+	TrackedUsers          int
+	Devices               int
+	// PendingKeyRequests is the number of outgoing key requests that are still being retried. Key requests aren't
+	// persisted, so this is only filled by OlmMachine.GetStoreStats.
+	PendingKeyRequests int
+
+	// OldestOlmSession is the creation time of the oldest Olm session, or the zero time if there are no sessions.
+	OldestOlmSession time.Time
+	// OldestOutboundGroupSession is the creation time of the oldest outbound Megolm session,
+	// or the zero time if there are no sessions.
+	OldestOutboundGroupSession time.Time
+}
+
+// GetStoreStats returns the statistics of the crypto store, including the number of pending key requests.
+func (mach *OlmMachine) GetStoreStats(ctx context.Context) (*StoreStats, error) {
+	stats, err := mach.CryptoStore.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mach.outgoingKeyRequestsLock.Lock()
+	stats.PendingKeyRequests = len(mach.outgoingKeyRequests)
+	mach.outgoingKeyRequestsLock.Unlock()
+	return stats, nil
+}
+
+// Stats counts the entries in the store.
+func (store *SQLCryptoStore) Stats(ctx context.Context) (*StoreStats, error) {
+	var stats StoreStats
+	counts := []struct {
+		name   string
+		target *int
+		query  string
+	}{
+		{"olm sessions", &stats.OlmSessions, "SELECT COUNT(*) FROM crypto_olm_session WHERE account_id=$1"},
+		{"inbound group sessions", &stats.InboundGroupSessions, "SELECT COUNT(*) FROM crypto_megolm_inbound_session WHERE account_id=$1 AND session IS NOT NULL"},
+		{"withheld group sessions", &stats.WithheldGroupSessions, "SELECT COUNT(*) FROM crypto_megolm_inbound_session WHERE account_id=$1 AND session IS NULL"},
+		{"outbound group sessions", &stats.OutboundGroupSessions, "SELECT COUNT(*) FROM crypto_megolm_outbound_session WHERE account_id=$1"},
+		// Device lists aren't scoped to an account.
+		{"tracked users", &stats.TrackedUsers, "SELECT COUNT(*) FROM crypto_tracked_user"},
+		{"devices", &stats.Devices, "SELECT COUNT(*) FROM crypto_device"},
+	}
+	for _, count := range counts {
+		var args []interface{}
+		if strings.Contains(count.query, "$1") {
+			args = append(args, store.AccountID)
+		}
+		err := store.DB.QueryRowContext(ctx, count.query, args...).Scan(count.target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count %s: %w", count.name, err)
+		}
+	}
+	oldest := []struct {
+		name   string
+		target *time.Time
+		query  string
+	}{
+		{"olm session", &stats.OldestOlmSession, "SELECT created_at FROM crypto_olm_session WHERE account_id=$1 ORDER BY created_at ASC LIMIT 1"},
+		{"outbound group session", &stats.OldestOutboundGroupSession, "SELECT created_at FROM crypto_megolm_outbound_session WHERE account_id=$1 ORDER BY created_at ASC LIMIT 1"},
+	}
+	for _, item := range oldest {
+		err := store.DB.QueryRowContext(ctx, item.query, store.AccountID).Scan(item.target)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to get oldest %s: %w", item.name, err)
+		}
+	}
+	return &stats, nil
+}
+
+// Stats counts the entries in the store.
+func (gs *GobStore) Stats(_ context.Context) (*StoreStats, error) {
+	var stats StoreStats
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	for _, sessions := range gs.Sessions {
+		stats.OlmSessions += len(sessions)
+		for _, session := range sessions {
+			if stats.OldestOlmSession.IsZero() || session.CreationTime.Before(stats.OldestOlmSession) {
+				stats.OldestOlmSession = session.CreationTime
+			}
+		}
+	}
+	for _, senders := range gs.GroupSessions {
+		for _, sessions := range senders {
+			stats.InboundGroupSessions += len(sessions)
+		}
+	}
+	for _, senders := range gs.WithheldGroupSessions {
+		for _, sessions := range senders {
+			stats.WithheldGroupSessions += len(sessions)
+		}
+	}
+	stats.OutboundGroupSessions = len(gs.OutGroupSessions)
+	for _, session := range gs.OutGroupSessions {
+		if stats.OldestOutboundGroupSession.IsZero() || session.CreationTime.Before(stats.OldestOutboundGroupSession) {
+			stats.OldestOutboundGroupSession = session.CreationTime
+		}
+	}
+	stats.TrackedUsers = len(gs.Devices)
+	for _, devices := range gs.Devices {
+		stats.Devices += len(devices)
+	}
+	return &stats, nil
+}
@@ -7,14 +7,22 @@
 package crypto
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"errors"
+	"io/ioutil"
 	"os"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 
 	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/crypto/sql_store_upgrade"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -35,6 +43,42 @@ func getCryptoStores(t *testing.T) (map[string]Store, func()) {
 		t.Fatalf("Error creating tables: %v", err)
 	}
 
+	encryptedDB, err := sql.Open("sqlite3", ":memory:?_busy_timeout=5000")
+	if err != nil {
+		t.Fatalf("Error opening db: %v", err)
+	}
+	encryptedSQLStore := NewSQLCryptoStore(encryptedDB, "sqlite3", "accid", id.DeviceID("dev"), []byte("test"), emptyLogger{})
+	encryptedSQLStore.EncryptPickles = true
+	if err = encryptedSQLStore.CreateTables(); err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+
+	preparedDB, err := sql.Open("sqlite3", ":memory:?_busy_timeout=5000")
+	if err != nil {
+		t.Fatalf("Error opening db: %v", err)
+	}
+	preparedSQLStore := NewSQLCryptoStore(preparedDB, "sqlite3", "accid", id.DeviceID("dev"), []byte("test"), emptyLogger{})
+	preparedSQLStore.PrepareStatements = true
+	if err = preparedSQLStore.CreateTables(); err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+
+	atRestDB, err := sql.Open("sqlite3", ":memory:?_busy_timeout=5000")
+	if err != nil {
+		t.Fatalf("Error opening db: %v", err)
+	}
+	atRestSQLStore := NewSQLCryptoStore(atRestDB, "sqlite3", "accid", id.DeviceID("dev"), []byte("test"), emptyLogger{})
+	atRestSQLStore.PickleEncrypter = NewAESGCMPickleEncrypter([]byte("at rest key"))
+	if err = atRestSQLStore.CreateTables(); err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+
+	removeSQLiteFiles("sqlite_store_test.db")
+	sqliteStore, err := NewSQLiteCryptoStore("sqlite_store_test.db", DefaultSQLiteConfig, "accid", id.DeviceID("dev"), []byte("test"), emptyLogger{})
+	if err != nil {
+		t.Fatalf("Error creating SQLite store: %v", err)
+	}
+
 	os.Remove("gob_store_test.gob")
 	gobStore, err := NewGobStore("gob_store_test.gob")
 	if err != nil {
@@ -42,13 +86,594 @@ func getCryptoStores(t *testing.T) (map[string]Store, func()) {
 	}
 
 	return map[string]Store{
-			"sql": sqlStore,
-			"gob": gobStore,
+			"sql":           sqlStore,
+			"sql-encrypted": encryptedSQLStore,
+			"sql-prepared":  preparedSQLStore,
+			"sql-batched":   sqliteStore,
+			"sql-at-rest":   atRestSQLStore,
+			"memory":        NewMemoryStore(),
+			"kv":            NewKVCryptoStore(newMemoryKV(), []byte("test")),
+			"gob":           gobStore,
 		}, func() {
+			_ = preparedSQLStore.Close()
+			_ = sqliteStore.Close()
+			removeSQLiteFiles("sqlite_store_test.db")
 			os.Remove("gob_store_test.gob")
 		}
 }
 
+func removeSQLiteFiles(path string) {
+	for _, suffix := range []string{"", "-wal", "-shm", ".lock"} {
+		os.Remove(path + suffix)
+	}
+}
+
+func TestSQLiteStoreConcurrentWrites(t *testing.T) {
+	removeSQLiteFiles("sqlite_concurrent_test.db")
+	defer removeSQLiteFiles("sqlite_concurrent_test.db")
+	store, err := NewSQLiteCryptoStore("sqlite_concurrent_test.db", SQLiteConfig{
+		BusyTimeout:     5 * time.Second,
+		WriteBatchSize:  10,
+		WriteBatchDelay: 10 * time.Millisecond,
+	}, "accid", id.DeviceID("dev"), []byte("test"), emptyLogger{})
+	if err != nil {
+		t.Fatalf("Error creating SQLite store: %v", err)
+	}
+	var journalMode string
+	if err = store.DB.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil || journalMode != "wal" {
+		t.Errorf("Expected WAL journal mode, got %q (%v)", journalMode, err)
+	}
+
+	acc := NewOlmAccount()
+	signingKey, identityKey := acc.Internal.IdentityKeys()
+	const count = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outbound := olm.NewOutboundGroupSession()
+			igs, err := NewInboundGroupSession(identityKey, signingKey, "room1", outbound.Key())
+			if err == nil {
+				err = store.PutGroupSession("room1", identityKey, igs.ID(), igs)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err = range errs {
+		if err != nil {
+			t.Errorf("Error storing group session: %v", err)
+		}
+	}
+	if sessions, err := store.GetGroupSessionsForRoom("room1"); err != nil || len(sessions) != count {
+		t.Errorf("Expected %d stored sessions, got %d (%v)", count, len(sessions), err)
+	}
+
+	if err = store.Close(); err != nil {
+		t.Errorf("Error closing store: %v", err)
+	}
+	if _, err = store.exec("DELETE FROM crypto_megolm_inbound_session"); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("Expected ErrStoreClosed after closing store, got %v", err)
+	}
+}
+
+func TestSQLiteAccountLock(t *testing.T) {
+	removeSQLiteFiles("sqlite_lock_test.db")
+	defer removeSQLiteFiles("sqlite_lock_test.db")
+	stores := make([]*SQLCryptoStore, 2)
+	for i := range stores {
+		store, err := NewSQLiteCryptoStore("sqlite_lock_test.db", DefaultSQLiteConfig, "accid", id.DeviceID("dev"), []byte("test"), emptyLogger{})
+		if err != nil {
+			t.Fatalf("Error creating SQLite store: %v", err)
+		}
+		defer store.Close()
+		stores[i] = store
+	}
+	if _, err := stores[1].GetAccount(); err != nil {
+		t.Fatalf("Error getting account: %v", err)
+	}
+
+	unlock, err := stores[0].LockAccount(context.Background())
+	if err != nil {
+		t.Fatalf("Error locking account: %v", err)
+	}
+	acc := NewOlmAccount()
+	if err = stores[0].PutAccount(acc); err != nil {
+		t.Fatalf("Error storing account: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err = stores[1].LockAccount(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected second lock to time out while the first one is held, got %v", err)
+	}
+	unlock()
+
+	unlock, err = stores[1].LockAccount(context.Background())
+	if err != nil {
+		t.Fatalf("Error locking account after it was released: %v", err)
+	}
+	defer unlock()
+	if reloaded, err := stores[1].GetAccount(); err != nil || reloaded == nil {
+		t.Errorf("Account stored by the other store wasn't reloaded after locking (%v)", err)
+	} else if reloaded.IdentityKey() != acc.IdentityKey() {
+		t.Errorf("Reloaded account has identity key %s, expected %s", reloaded.IdentityKey(), acc.IdentityKey())
+	}
+}
+
+func TestMemoryStoreSnapshot(t *testing.T) {
+	store := NewMemoryStore()
+	acc := NewOlmAccount()
+	if err := store.PutAccount(acc); err != nil {
+		t.Fatalf("Error storing account: %v", err)
+	}
+	internal, err := olm.InboundGroupSessionFromPickled([]byte(groupSession), []byte("test"))
+	if err != nil {
+		t.Fatalf("Error creating internal inbound group session: %v", err)
+	}
+	igs := &InboundGroupSession{Internal: *internal, SigningKey: acc.SigningKey(), SenderKey: acc.IdentityKey(), RoomID: "room1"}
+	if err = store.PutGroupSession("room1", acc.IdentityKey(), igs.ID(), igs); err != nil {
+		t.Fatalf("Error storing inbound group session: %v", err)
+	}
+	device := &DeviceIdentity{UserID: "user1", DeviceID: "dev1", IdentityKey: acc.IdentityKey(), SigningKey: acc.SigningKey()}
+	if err = store.PutDevice("user1", device); err != nil {
+		t.Fatalf("Error storing device: %v", err)
+	}
+
+	snapshot, err := store.ExportSnapshot([]byte("snapshot key"))
+	if err != nil {
+		t.Fatalf("Error exporting snapshot: %v", err)
+	} else if bytes.Contains(snapshot, []byte(acc.IdentityKey())) {
+		t.Errorf("Snapshot contains plaintext identity key")
+	}
+
+	restored, err := NewMemoryStoreFromSnapshot(snapshot, []byte("snapshot key"))
+	if err != nil {
+		t.Fatalf("Error importing snapshot: %v", err)
+	}
+	if restoredAcc, _ := restored.GetAccount(); restoredAcc == nil || restoredAcc.IdentityKey() != acc.IdentityKey() {
+		t.Errorf("Account wasn't restored from snapshot")
+	}
+	if retrieved, err := restored.GetGroupSession("room1", acc.IdentityKey(), igs.ID()); err != nil || retrieved == nil {
+		t.Errorf("Inbound group session wasn't restored from snapshot: %v", err)
+	} else if pickled := string(retrieved.Internal.Pickle([]byte("test"))); pickled != groupSession {
+		t.Error("Restored inbound group session does not match original")
+	}
+	if retrieved, _ := restored.GetDevice("user1", "dev1"); retrieved == nil || retrieved.SigningKey != device.SigningKey {
+		t.Errorf("Device wasn't restored from snapshot")
+	}
+
+	if err = restored.ImportSnapshot(snapshot, []byte("wrong key")); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Errorf("Expected ErrInvalidSnapshot when importing with wrong key, got %v", err)
+	} else if retrieved, _ := restored.GetDevice("user1", "dev1"); retrieved == nil {
+		t.Errorf("Store was modified by failed import")
+	}
+	if err = restored.ImportSnapshot([]byte("garbage"), []byte("snapshot key")); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Errorf("Expected ErrInvalidSnapshot when importing garbage, got %v", err)
+	}
+}
+
+func TestStoreRejectsNewerVersion(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening db: %v", err)
+	}
+	sqlStore := NewSQLCryptoStore(db, "sqlite3", "accid", id.DeviceID("dev"), []byte("test"), emptyLogger{})
+	if err = sqlStore.CreateTables(); err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+	if _, err = db.Exec("UPDATE crypto_version SET version=version+1"); err != nil {
+		t.Fatalf("Error updating version: %v", err)
+	}
+	if err = sqlStore.CreateTables(); !errors.Is(err, sql_store_upgrade.ErrUnsupportedVersion) {
+		t.Errorf("Expected ErrUnsupportedVersion from SQL store, got %v", err)
+	}
+
+	os.Remove("gob_version_test.gob")
+	defer os.Remove("gob_version_test.gob")
+	gobStore, err := NewGobStore("gob_version_test.gob")
+	if err != nil {
+		t.Fatalf("Error creating Gob store: %v", err)
+	}
+	gobStore.Version = GobStoreVersion + 1
+	if err = gobStore.Flush(); err != nil {
+		t.Fatalf("Error saving Gob store: %v", err)
+	}
+	if _, err = NewGobStore("gob_version_test.gob"); !errors.Is(err, ErrUnsupportedStoreVersion) {
+		t.Errorf("Expected ErrUnsupportedStoreVersion from Gob store, got %v", err)
+	}
+
+	snapshot, err := gobStore.ExportSnapshot([]byte("snapshot key"))
+	if err != nil {
+		t.Fatalf("Error exporting snapshot: %v", err)
+	}
+	if _, err = NewMemoryStoreFromSnapshot(snapshot, []byte("snapshot key")); !errors.Is(err, ErrUnsupportedStoreVersion) {
+		t.Errorf("Expected ErrUnsupportedStoreVersion from snapshot, got %v", err)
+	}
+}
+
+func TestMigrateGobStoreToSQL(t *testing.T) {
+	const path = "gob_migrate_test.gob"
+	os.Remove(path)
+	defer os.Remove(path)
+	defer os.Remove(path + MigratedGobStoreSuffix)
+	gobStore, err := NewGobStore(path)
+	if err != nil {
+		t.Fatalf("Error creating Gob store: %v", err)
+	}
+	acc := NewOlmAccount()
+	if err = gobStore.PutAccount(acc); err != nil {
+		t.Fatalf("Error storing account: %v", err)
+	}
+	internal, err := olm.InboundGroupSessionFromPickled([]byte(groupSession), []byte("test"))
+	if err != nil {
+		t.Fatalf("Error creating internal inbound group session: %v", err)
+	}
+	igs := &InboundGroupSession{Internal: *internal, SigningKey: acc.SigningKey(), SenderKey: acc.IdentityKey(), RoomID: "room1"}
+	if err = gobStore.PutGroupSession("room1", acc.IdentityKey(), igs.ID(), igs); err != nil {
+		t.Fatalf("Error storing inbound group session: %v", err)
+	}
+	device := &DeviceIdentity{UserID: "user1", DeviceID: "dev1", IdentityKey: acc.IdentityKey(), SigningKey: acc.SigningKey()}
+	if err = gobStore.PutDevice("user1", device); err != nil {
+		t.Fatalf("Error storing device: %v", err)
+	}
+	if err = gobStore.MarkTrackedUsersOutdated([]id.UserID{"user1"}); err != nil {
+		t.Fatalf("Error marking user outdated: %v", err)
+	}
+	if err = gobStore.PutCrossSigningKey("user1", id.XSUsageMaster, acc.SigningKey()); err != nil {
+		t.Fatalf("Error storing cross-signing key: %v", err)
+	}
+	gobStore.ValidateMessageIndex(acc.IdentityKey(), igs.ID(), "$event", 0, 1000)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	sqlStore := NewSQLCryptoStore(db, "sqlite3", "accid", id.DeviceID("dev"), []byte("test"), emptyLogger{})
+	if err = sqlStore.CreateTables(); err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+	if err = MigrateGobStoreToSQL(path, sqlStore); err != nil {
+		t.Fatalf("Error migrating store: %v", err)
+	}
+
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Gob store file wasn't renamed after migration")
+	}
+	if migratedAcc, _ := sqlStore.GetAccount(); migratedAcc == nil || migratedAcc.IdentityKey() != acc.IdentityKey() {
+		t.Errorf("Account wasn't migrated")
+	}
+	if retrieved, err := sqlStore.GetGroupSession("room1", acc.IdentityKey(), igs.ID()); err != nil || retrieved == nil {
+		t.Errorf("Inbound group session wasn't migrated: %v", err)
+	}
+	if retrieved, _ := sqlStore.GetDevice("user1", "dev1"); retrieved == nil || retrieved.SigningKey != device.SigningKey {
+		t.Errorf("Device wasn't migrated")
+	}
+	if outdated, _ := sqlStore.GetOutdatedTrackedUsers(); len(outdated) != 1 || outdated[0] != "user1" {
+		t.Errorf("Expected user1 to be outdated after migration, got %v", outdated)
+	}
+	if keys, _ := sqlStore.GetCrossSigningKeys("user1"); keys[id.XSUsageMaster] != acc.SigningKey() {
+		t.Errorf("Cross-signing key wasn't migrated")
+	}
+	if sqlStore.ValidateMessageIndex(acc.IdentityKey(), igs.ID(), "$other", 0, 1000) {
+		t.Errorf("Message index wasn't migrated")
+	}
+
+	if err = MigrateGobStoreToSQL(path, sqlStore); err != nil {
+		t.Errorf("Expected no error when gob store doesn't exist, got %v", err)
+	}
+	if err = os.Rename(path+MigratedGobStoreSuffix, path); err != nil {
+		t.Fatalf("Error restoring gob store file: %v", err)
+	}
+	if err = MigrateGobStoreToSQL(path, sqlStore); !errors.Is(err, ErrTargetStoreNotEmpty) {
+		t.Errorf("Expected ErrTargetStoreNotEmpty when migrating twice, got %v", err)
+	}
+}
+
+func TestCopyStore(t *testing.T) {
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			acc := NewOlmAccount()
+			if err := store.PutAccount(acc); err != nil {
+				t.Fatalf("Error storing account: %v", err)
+			}
+			olmInternal, err := olm.SessionFromPickled([]byte(olmPickled), []byte("test"))
+			if err != nil {
+				t.Fatalf("Error creating internal Olm session: %v", err)
+			}
+			if err = store.AddSession(olmSessID, &OlmSession{id: olmSessID, Internal: *olmInternal}); err != nil {
+				t.Fatalf("Error storing Olm session: %v", err)
+			}
+			internal, err := olm.InboundGroupSessionFromPickled([]byte(groupSession), []byte("test"))
+			if err != nil {
+				t.Fatalf("Error creating internal inbound group session: %v", err)
+			}
+			igs := &InboundGroupSession{Internal: *internal, SigningKey: acc.SigningKey(), SenderKey: acc.IdentityKey(), RoomID: "room1"}
+			if err = store.PutGroupSession("room1", acc.IdentityKey(), igs.ID(), igs); err != nil {
+				t.Fatalf("Error storing inbound group session: %v", err)
+			}
+			withheld := event.RoomKeyWithheldEventContent{
+				RoomID:    "room1",
+				Algorithm: id.AlgorithmMegolmV1,
+				SessionID: "withheld",
+				SenderKey: acc.IdentityKey(),
+				Code:      event.RoomKeyWithheldUnverified,
+			}
+			if err = store.PutWithheldGroupSession(withheld); err != nil {
+				t.Fatalf("Error storing withheld group session: %v", err)
+			}
+			ogs := NewOutboundGroupSession("room2", nil)
+			if err = store.AddOutboundGroupSession(ogs); err != nil {
+				t.Fatalf("Error storing outbound group session: %v", err)
+			}
+			store.ValidateMessageIndex(acc.IdentityKey(), igs.ID(), "$event", 0, 1000)
+			device := &DeviceIdentity{UserID: "user1", DeviceID: "dev1", IdentityKey: acc.IdentityKey(), SigningKey: acc.SigningKey()}
+			if err = store.PutDevices("user1", map[id.DeviceID]*DeviceIdentity{"dev1": device}); err != nil {
+				t.Fatalf("Error storing device: %v", err)
+			}
+			if err = store.MarkTrackedUsersOutdated([]id.UserID{"user1"}); err != nil {
+				t.Fatalf("Error marking user outdated: %v", err)
+			}
+			if err = store.PutUserTrustSettings("user1", UserTrustSettings{TrustOnFirstUse: true}); err != nil {
+				t.Fatalf("Error storing trust settings: %v", err)
+			}
+			if err = store.PutCrossSigningKey("user1", id.XSUsageMaster, acc.SigningKey()); err != nil {
+				t.Fatalf("Error storing cross-signing key: %v", err)
+			}
+			if err = store.PutSignature("user1", acc.SigningKey(), "user2", "signer", "sig"); err != nil {
+				t.Fatalf("Error storing signature: %v", err)
+			}
+
+			db, err := sql.Open("sqlite3", ":memory:")
+			if err != nil {
+				t.Fatalf("Error opening db: %v", err)
+			}
+			db.SetMaxOpenConns(1)
+			sqlTarget := NewSQLCryptoStore(db, "sqlite3", "accid", id.DeviceID("dev"), []byte("other key"), emptyLogger{})
+			if err = sqlTarget.CreateTables(); err != nil {
+				t.Fatalf("Error creating tables: %v", err)
+			}
+			targets := map[string]Store{
+				"sql": sqlTarget,
+				"kv":  NewKVCryptoStore(newMemoryKV(), []byte("other key")),
+			}
+			for targetName, target := range targets {
+				if err = CopyStore(context.Background(), store, target); err != nil {
+					t.Fatalf("Error copying store to %s: %v", targetName, err)
+				}
+				if copied, _ := target.GetAccount(); copied == nil || copied.IdentityKey() != acc.IdentityKey() {
+					t.Errorf("Account wasn't copied to %s", targetName)
+				}
+				if sess, _ := target.GetLatestSession(olmSessID); sess == nil || sess.ID() != olmSessID {
+					t.Errorf("Olm session wasn't copied to %s", targetName)
+				}
+				if retrieved, err := target.GetGroupSession("room1", acc.IdentityKey(), igs.ID()); err != nil || retrieved == nil {
+					t.Errorf("Inbound group session wasn't copied to %s: %v", targetName, err)
+				}
+				if retrieved, _ := target.GetWithheldGroupSession("room1", acc.IdentityKey(), "withheld"); retrieved == nil || retrieved.Code != withheld.Code {
+					t.Errorf("Withheld group session wasn't copied to %s", targetName)
+				}
+				if retrieved, _ := target.GetOutboundGroupSession("room2"); retrieved == nil || retrieved.ID() != ogs.ID() {
+					t.Errorf("Outbound group session wasn't copied to %s", targetName)
+				}
+				if target.ValidateMessageIndex(acc.IdentityKey(), igs.ID(), "$other", 0, 1000) {
+					t.Errorf("Message index wasn't copied to %s", targetName)
+				}
+				if retrieved, _ := target.GetDevice("user1", "dev1"); retrieved == nil || retrieved.SigningKey != device.SigningKey {
+					t.Errorf("Device wasn't copied to %s", targetName)
+				}
+				if outdated, _ := target.GetOutdatedTrackedUsers(); len(outdated) != 1 || outdated[0] != "user1" {
+					t.Errorf("Expected user1 to be outdated in %s, got %v", targetName, outdated)
+				}
+				if settings, _ := target.GetUserTrustSettings("user1"); settings == nil || !settings.TrustOnFirstUse {
+					t.Errorf("Trust settings weren't copied to %s", targetName)
+				}
+				if keys, _ := target.GetCrossSigningKeys("user1"); keys[id.XSUsageMaster] != acc.SigningKey() {
+					t.Errorf("Cross-signing key wasn't copied to %s", targetName)
+				}
+				if signed, _ := target.IsKeySignedBy("user1", acc.SigningKey(), "user2", "signer"); !signed {
+					t.Errorf("Signature wasn't copied to %s", targetName)
+				}
+				if err = CopyStore(context.Background(), store, target); !errors.Is(err, ErrTargetStoreNotEmpty) {
+					t.Errorf("Expected ErrTargetStoreNotEmpty when copying to %s twice, got %v", targetName, err)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreAccountNamespaces(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	sqlStore := NewSQLCryptoStore(db, "sqlite3", "accid", id.DeviceID("dev"), []byte("test"), emptyLogger{})
+	if err = sqlStore.CreateTables(); err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+	kvStore := NewKVCryptoStore(newMemoryKV(), []byte("test"))
+	views := map[string][3]Store{
+		"sql": {sqlStore, sqlStore.ForAccount("@alice:example.com", "ALICE"), sqlStore.ForAccount("@bob:example.com", "BOB")},
+		"kv":  {kvStore, kvStore.ForAccount("@alice:example.com", "ALICE"), kvStore.ForAccount("@bob:example.com", "BOB")},
+	}
+	for storeName, stores := range views {
+		t.Run(storeName, func(t *testing.T) {
+			root, alice, bob := stores[0], stores[1], stores[2]
+			acc := NewOlmAccount()
+			if err := alice.PutAccount(acc); err != nil {
+				t.Fatalf("Error storing account: %v", err)
+			}
+			internal, err := olm.InboundGroupSessionFromPickled([]byte(groupSession), []byte("test"))
+			if err != nil {
+				t.Fatalf("Error creating internal inbound group session: %v", err)
+			}
+			igs := &InboundGroupSession{Internal: *internal, SigningKey: acc.SigningKey(), SenderKey: acc.IdentityKey(), RoomID: "room1"}
+			if err = alice.PutGroupSession("room1", acc.IdentityKey(), igs.ID(), igs); err != nil {
+				t.Fatalf("Error storing inbound group session: %v", err)
+			}
+			device := &DeviceIdentity{UserID: "user1", DeviceID: "dev1", IdentityKey: "key1", SigningKey: "key1"}
+			if err = alice.PutDevices("user1", map[id.DeviceID]*DeviceIdentity{"dev1": device}); err != nil {
+				t.Fatalf("Error storing devices: %v", err)
+			}
+
+			if retrieved, _ := alice.GetAccount(); retrieved == nil || retrieved.IdentityKey() != acc.IdentityKey() {
+				t.Errorf("Account not found in its own namespace")
+			}
+			for name, other := range map[string]Store{"root": root, "bob": bob} {
+				if retrieved, _ := other.GetAccount(); retrieved != nil {
+					t.Errorf("Account of alice is visible to %s", name)
+				}
+				if retrieved, _ := other.GetGroupSession("room1", acc.IdentityKey(), igs.ID()); retrieved != nil {
+					t.Errorf("Group session of alice is visible to %s", name)
+				}
+				if retrieved, _ := other.GetDevice("user1", "dev1"); retrieved == nil {
+					t.Errorf("Device list isn't shared with %s", name)
+				}
+			}
+			if retrieved, err := alice.GetGroupSession("room1", acc.IdentityKey(), igs.ID()); err != nil || retrieved == nil {
+				t.Errorf("Group session not found in its own namespace: %v", err)
+			}
+		})
+	}
+	if err = sqlStore.ForAccount("@alice:example.com", "ALICE").Close(); err != nil {
+		t.Errorf("Error closing account view: %v", err)
+	} else if _, err = sqlStore.GetAccount(); err != nil {
+		t.Errorf("Closing an account view closed the original store: %v", err)
+	}
+}
+
+func TestPickleEncrypter(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	plainStore := NewSQLCryptoStore(db, "sqlite3", "accid", id.DeviceID("dev"), []byte("test"), emptyLogger{})
+	plainStore.EncryptPickles = true
+	if err = plainStore.CreateTables(); err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+	acc := NewOlmAccount()
+	if err = plainStore.PutAccount(acc); err != nil {
+		t.Fatalf("Error storing account: %v", err)
+	}
+	internal, err := olm.InboundGroupSessionFromPickled([]byte(groupSession), []byte("test"))
+	if err != nil {
+		t.Fatalf("Error creating internal inbound group session: %v", err)
+	}
+	igs := &InboundGroupSession{Internal: *internal, SigningKey: acc.SigningKey(), SenderKey: acc.IdentityKey(), RoomID: "room1"}
+
+	// Pickles stored with EncryptPickles are still readable, and new ones are only encrypted with the encrypter
+	store := NewSQLCryptoStore(db, "sqlite3", "accid", id.DeviceID("dev"), []byte("test"), emptyLogger{})
+	store.EncryptPickles = true
+	store.PickleEncrypter = NewAESGCMPickleEncrypter([]byte("at rest key"))
+	if existing, err := store.GetAccount(); err != nil || existing == nil || existing.IdentityKey() != acc.IdentityKey() {
+		t.Errorf("Account stored with EncryptPickles wasn't readable with encrypter: %v", err)
+	}
+	if err = store.PutGroupSession("room1", acc.IdentityKey(), igs.ID(), igs); err != nil {
+		t.Fatalf("Error storing inbound group session: %v", err)
+	}
+	var rawSession []byte
+	err = db.QueryRow("SELECT session FROM crypto_megolm_inbound_session WHERE session_id=$1", igs.ID()).Scan(&rawSession)
+	if err != nil {
+		t.Fatalf("Error reading raw session: %v", err)
+	} else if !bytes.HasPrefix(rawSession, atRestPicklePrefix) {
+		t.Errorf("Stored session isn't encrypted at rest")
+	} else if decrypted, err := store.PickleEncrypter.DecryptPickle(rawSession[len(atRestPicklePrefix):]); err != nil {
+		t.Errorf("Error decrypting raw session: %v", err)
+	} else if string(decrypted) != groupSession {
+		t.Errorf("Stored session was encrypted more than once")
+	}
+	if retrieved, err := store.GetGroupSession("room1", acc.IdentityKey(), igs.ID()); err != nil || retrieved == nil {
+		t.Errorf("Error retrieving inbound group session: %v", err)
+	} else if pickled := string(retrieved.Internal.Pickle([]byte("test"))); pickled != groupSession {
+		t.Error("Retrieved inbound group session does not match original")
+	}
+	view := store.ForAccount("@user:example.com", "dev")
+	if view.PickleEncrypter != store.PickleEncrypter {
+		t.Errorf("Account view doesn't use the encrypter of the original store")
+	}
+
+	unencrypted := NewSQLCryptoStore(db, "sqlite3", "accid", id.DeviceID("dev"), []byte("test"), emptyLogger{})
+	if _, err = unencrypted.GetGroupSession("room1", acc.IdentityKey(), igs.ID()); !errors.Is(err, ErrPickleEncrypterRequired) {
+		t.Errorf("Expected ErrPickleEncrypterRequired without encrypter, got %v", err)
+	}
+	wrongKey := NewSQLCryptoStore(db, "sqlite3", "accid", id.DeviceID("dev"), []byte("test"), emptyLogger{})
+	wrongKey.PickleEncrypter = NewAESGCMPickleEncrypter([]byte("wrong key"))
+	if _, err = wrongKey.GetGroupSession("room1", acc.IdentityKey(), igs.ID()); err == nil {
+		t.Errorf("Expected error when reading with wrong key")
+	}
+}
+
+func TestEncryptedGobStore(t *testing.T) {
+	const path = "gob_encrypted_test.gob"
+	os.Remove(path)
+	defer os.Remove(path)
+	plainStore, err := NewGobStore(path)
+	if err != nil {
+		t.Fatalf("Error creating Gob store: %v", err)
+	}
+	acc := NewOlmAccount()
+	if err = plainStore.PutAccount(acc); err != nil {
+		t.Fatalf("Error storing account: %v", err)
+	}
+	internal, err := olm.InboundGroupSessionFromPickled([]byte(groupSession), []byte("test"))
+	if err != nil {
+		t.Fatalf("Error creating internal inbound group session: %v", err)
+	}
+	igs := &InboundGroupSession{Internal: *internal, SigningKey: acc.SigningKey(), SenderKey: acc.IdentityKey(), RoomID: "room1"}
+
+	// An existing unencrypted file is readable and gets encrypted on the next write
+	store, err := NewEncryptedGobStore(path, NewAESGCMPickleEncrypter([]byte("at rest key")))
+	if err != nil {
+		t.Fatalf("Error opening unencrypted file as encrypted Gob store: %v", err)
+	}
+	if existing, err := store.GetAccount(); err != nil || existing == nil || existing.IdentityKey() != acc.IdentityKey() {
+		t.Errorf("Unencrypted account wasn't readable through encrypted store: %v", err)
+	}
+	if err = store.PutGroupSession("room1", acc.IdentityKey(), igs.ID(), igs); err != nil {
+		t.Fatalf("Error storing inbound group session: %v", err)
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading store file: %v", err)
+	} else if !bytes.HasPrefix(raw, atRestPicklePrefix) {
+		t.Errorf("Store file isn't encrypted at rest")
+	}
+
+	if _, err = NewGobStore(path); !errors.Is(err, ErrPickleEncrypterRequired) {
+		t.Errorf("Expected ErrPickleEncrypterRequired when opening without encrypter, got %v", err)
+	}
+	if _, err = NewEncryptedGobStore(path, NewAESGCMPickleEncrypter([]byte("wrong key"))); err == nil {
+		t.Errorf("Expected error when opening with wrong key")
+	}
+
+	store, err = NewEncryptedGobStore(path, NewAESGCMPickleEncrypter([]byte("at rest key")))
+	if err != nil {
+		t.Fatalf("Error reopening encrypted store: %v", err)
+	}
+	if existing, err := store.GetAccount(); err != nil || existing == nil || existing.IdentityKey() != acc.IdentityKey() {
+		t.Errorf("Account wasn't readable after reopening encrypted store: %v", err)
+	}
+	if retrieved, err := store.GetGroupSession("room1", acc.IdentityKey(), igs.ID()); err != nil || retrieved == nil {
+		t.Errorf("Error retrieving inbound group session: %v", err)
+	} else if pickled := string(retrieved.Internal.Pickle([]byte("test"))); pickled != groupSession {
+		t.Error("Retrieved inbound group session does not match original")
+	}
+	target := NewMemoryStore()
+	if err = CopyStore(context.Background(), store, target); err != nil {
+		t.Fatalf("Error copying encrypted store: %v", err)
+	} else if copied, _ := target.GetAccount(); copied == nil || copied.IdentityKey() != acc.IdentityKey() {
+		t.Errorf("Account wasn't copied from encrypted store")
+	}
+}
+
 func TestPutNextBatch(t *testing.T) {
 	stores, cleanup := getCryptoStores(t)
 	defer cleanup()
@@ -142,6 +767,42 @@ func TestStoreOlmSession(t *testing.T) {
 	}
 }
 
+func TestStorePutSessions(t *testing.T) {
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			ownAccount := NewOlmAccount()
+			sessions := make(map[id.SenderKey]*OlmSession)
+			for i := 0; i < 3; i++ {
+				otherAccount := NewOlmAccount()
+				otherAccount.Internal.GenOneTimeKeys(1)
+				var otk id.Curve25519
+				for _, otk = range otherAccount.Internal.OneTimeKeys() {
+					break
+				}
+				sess, err := ownAccount.Internal.NewOutboundSession(otherAccount.IdentityKey(), otk)
+				if err != nil {
+					t.Fatalf("Failed to create outbound olm session: %v", err)
+				}
+				sessions[otherAccount.IdentityKey()] = wrapSession(sess)
+			}
+			if err := store.PutSessions(sessions); err != nil {
+				t.Fatalf("Error storing Olm sessions: %v", err)
+			}
+			for senderKey, session := range sessions {
+				if !store.HasSession(senderKey) {
+					t.Errorf("Not found Olm session of %s after inserting it", senderKey)
+				} else if retrieved, err := store.GetLatestSession(senderKey); err != nil || retrieved == nil {
+					t.Errorf("Failed retrieving Olm session of %s: %v", senderKey, err)
+				} else if retrieved.ID() != session.ID() {
+					t.Errorf("Expected session ID of %s to be %v, got %v", senderKey, session.ID(), retrieved.ID())
+				}
+			}
+		})
+	}
+}
+
 func TestStoreMegolmSession(t *testing.T) {
 	stores, cleanup := getCryptoStores(t)
 	defer cleanup()
@@ -159,6 +820,7 @@ func TestStoreMegolmSession(t *testing.T) {
 				SigningKey: acc.SigningKey(),
 				SenderKey:  acc.IdentityKey(),
 				RoomID:     "room1",
+				KeySource:  event.KeySourceImport,
 			}
 
 			err = store.PutGroupSession("room1", acc.IdentityKey(), igs.ID(), igs)
@@ -174,6 +836,71 @@ func TestStoreMegolmSession(t *testing.T) {
 			if pickled := string(retrieved.Internal.Pickle([]byte("test"))); pickled != groupSession {
 				t.Error("Pickled inbound group session does not match original")
 			}
+			if retrieved.KeySource != event.KeySourceImport {
+				t.Errorf("Expected key source %q, got %q", event.KeySourceImport, retrieved.KeySource)
+			}
+			if len(retrieved.ForwardingChains) != 0 {
+				t.Errorf("Expected empty forwarding chain, got %v", retrieved.ForwardingChains)
+			}
+		})
+	}
+}
+
+func TestStoreStats(t *testing.T) {
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			stats, err := store.Stats(context.Background())
+			if err != nil {
+				t.Fatalf("Error getting stats of empty store: %v", err)
+			} else if *stats != (StoreStats{}) {
+				t.Errorf("Expected empty stats for empty store, got %+v", stats)
+			}
+
+			olmInternal, err := olm.SessionFromPickled([]byte(olmPickled), []byte("test"))
+			if err != nil {
+				t.Fatalf("Error creating internal Olm session: %v", err)
+			}
+			olmSess := &OlmSession{id: olmSessID, Internal: *olmInternal}
+			olmSess.CreationTime = time.Now().Add(-time.Hour)
+			if err = store.AddSession(olmSessID, olmSess); err != nil {
+				t.Fatalf("Error storing Olm session: %v", err)
+			}
+			acc := NewOlmAccount()
+			internal, err := olm.InboundGroupSessionFromPickled([]byte(groupSession), []byte("test"))
+			if err != nil {
+				t.Fatalf("Error creating internal inbound group session: %v", err)
+			}
+			igs := &InboundGroupSession{Internal: *internal, SigningKey: acc.SigningKey(), SenderKey: acc.IdentityKey(), RoomID: "room1"}
+			if err = store.PutGroupSession("room1", acc.IdentityKey(), igs.ID(), igs); err != nil {
+				t.Fatalf("Error storing inbound group session: %v", err)
+			}
+			if err = store.AddOutboundGroupSession(NewOutboundGroupSession("room1", nil)); err != nil {
+				t.Fatalf("Error storing outbound group session: %v", err)
+			}
+			devices := map[id.DeviceID]*DeviceIdentity{
+				"dev1": {UserID: "user1", DeviceID: "dev1", IdentityKey: "key1", SigningKey: "key1"},
+				"dev2": {UserID: "user1", DeviceID: "dev2", IdentityKey: "key2", SigningKey: "key2"},
+			}
+			if err = store.PutDevices("user1", devices); err != nil {
+				t.Fatalf("Error storing devices: %v", err)
+			}
+
+			stats, err = store.Stats(context.Background())
+			if err != nil {
+				t.Fatalf("Error getting stats: %v", err)
+			}
+			if stats.OlmSessions != 1 || stats.InboundGroupSessions != 1 || stats.OutboundGroupSessions != 1 ||
+				stats.TrackedUsers != 1 || stats.Devices != 2 {
+				t.Errorf("Unexpected stats: %+v", stats)
+			}
+			if diff := stats.OldestOlmSession.Sub(olmSess.CreationTime); diff > time.Second || diff < -time.Second {
+				t.Errorf("Expected oldest olm session to be from %v, got %v", olmSess.CreationTime, stats.OldestOlmSession)
+			}
+			if stats.OldestOutboundGroupSession.IsZero() {
+				t.Errorf("Oldest outbound group session time not set")
+			}
 		})
 	}
 }
@@ -221,6 +948,104 @@ func TestStoreOutboundMegolmSession(t *testing.T) {
 	}
 }
 
+func TestStorePruneSessions(t *testing.T) {
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			alice := NewOlmAccount()
+			bob := NewOlmAccount()
+			bob.Internal.GenOneTimeKeys(3)
+			var newest id.SessionID
+			i := 0
+			for _, otk := range bob.Internal.OneTimeKeys() {
+				sess, err := alice.Internal.NewOutboundSession(bob.IdentityKey(), otk)
+				if err != nil {
+					t.Fatalf("Error creating Olm session: %v", err)
+				}
+				wrapped := wrapSession(sess)
+				wrapped.LastDecryptedTime = time.Now().Add(time.Duration(i) * time.Minute)
+				newest = wrapped.ID()
+				if err = store.AddSession(bob.IdentityKey(), wrapped); err != nil {
+					t.Fatalf("Error storing Olm session: %v", err)
+				}
+				i++
+			}
+			if count, err := store.PruneOlmSessions(1); err != nil {
+				t.Errorf("Error pruning Olm sessions: %v", err)
+			} else if count != 2 {
+				t.Errorf("Expected 2 Olm sessions to be pruned, got %d", count)
+			}
+			if sessions, _ := store.GetSessions(bob.IdentityKey()); len(sessions) != 1 || sessions[0].ID() != newest {
+				t.Errorf("Expected only the most recently used Olm session to be kept, got %d sessions", len(sessions))
+			}
+
+			expired := NewOutboundGroupSession("room1", nil)
+			expired.MessageCount = expired.MaxMessages
+			active := NewOutboundGroupSession("room2", nil)
+			_ = store.AddOutboundGroupSession(expired)
+			_ = store.AddOutboundGroupSession(active)
+			if count, err := store.RemoveExpiredOutboundGroupSessions(); err != nil || count != 1 {
+				t.Errorf("Expected 1 outbound session to be removed, got %d / %v", count, err)
+			}
+			if sess, _ := store.GetOutboundGroupSession("room1"); sess != nil {
+				t.Error("Expired outbound session wasn't removed")
+			} else if sess, _ = store.GetOutboundGroupSession("room2"); sess == nil {
+				t.Error("Active outbound session was removed")
+			}
+
+			internal, err := olm.InboundGroupSessionFromPickled([]byte(groupSession), []byte("test"))
+			if err != nil {
+				t.Fatalf("Error creating internal inbound group session: %v", err)
+			}
+			igs := &InboundGroupSession{Internal: *internal, SigningKey: alice.SigningKey(), SenderKey: alice.IdentityKey(), RoomID: "room1"}
+			_ = store.PutGroupSession("room1", alice.IdentityKey(), igs.ID(), igs)
+			_ = store.PutWithheldGroupSession(event.RoomKeyWithheldEventContent{
+				RoomID: "room2", Algorithm: id.AlgorithmMegolmV1, SessionID: "session2", SenderKey: alice.IdentityKey(), Code: event.RoomKeyWithheldUnavailable,
+			})
+			if rooms, err := store.GetGroupSessionRooms(); err != nil || len(rooms) != 2 {
+				t.Errorf("Expected 2 rooms with inbound sessions, got %v / %v", rooms, err)
+			}
+			if count, err := store.RemoveGroupSessionsForRoom("room1"); err != nil || count != 1 {
+				t.Errorf("Expected 1 inbound session to be removed, got %d / %v", count, err)
+			}
+			if sess, _ := store.GetGroupSession("room1", alice.IdentityKey(), igs.ID()); sess != nil {
+				t.Error("Inbound session wasn't removed")
+			}
+		})
+	}
+}
+
+func TestStoreUserTrustSettings(t *testing.T) {
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			if settings, err := store.GetUserTrustSettings("user1"); err != nil || settings != nil {
+				t.Errorf("Expected no trust settings before inserting, got %+v / %v", settings, err)
+			}
+			allowUnverified := false
+			err := store.PutUserTrustSettings("user1", UserTrustSettings{AllowUnverifiedDevices: &allowUnverified, TrustOnFirstUse: true})
+			if err != nil {
+				t.Fatalf("Error storing trust settings: %v", err)
+			}
+			settings, err := store.GetUserTrustSettings("user1")
+			if err != nil || settings == nil {
+				t.Fatalf("Error retrieving trust settings: %v", err)
+			} else if settings.AllowUnverifiedDevices == nil || *settings.AllowUnverifiedDevices || !settings.TrustOnFirstUse {
+				t.Errorf("Retrieved trust settings don't match: %+v", settings)
+			}
+			err = store.PutUserTrustSettings("user1", UserTrustSettings{})
+			if err != nil {
+				t.Fatalf("Error replacing trust settings: %v", err)
+			}
+			if settings, _ = store.GetUserTrustSettings("user1"); settings == nil || settings.AllowUnverifiedDevices != nil || settings.TrustOnFirstUse {
+				t.Errorf("Trust settings weren't replaced: %+v", settings)
+			}
+		})
+	}
+}
+
 func TestStoreDevices(t *testing.T) {
 	stores, cleanup := getCryptoStores(t)
 	defer cleanup()
@@ -259,6 +1084,24 @@ func TestStoreDevices(t *testing.T) {
 			if len(filtered) != 1 || filtered[0] != "user1" {
 				t.Errorf("Expected to get 'user1' from filter, got %v", filtered)
 			}
+
+			if found, err := store.FindDeviceByKey("user1", deviceMap["dev3"].IdentityKey); err != nil || found == nil {
+				t.Errorf("Error finding device by key: %v", err)
+			} else if found.DeviceID != "dev3" || found.SigningKey != deviceMap["dev3"].SigningKey {
+				t.Errorf("Found wrong device by key: %+v", found)
+			}
+
+			err = store.MarkTrackedUsersOutdated([]id.UserID{"user0", "user1"})
+			if err != nil {
+				t.Errorf("Error marking users as outdated: %v", err)
+			}
+			if outdated, err := store.GetOutdatedTrackedUsers(); err != nil || len(outdated) != 1 || outdated[0] != "user1" {
+				t.Errorf("Expected only 'user1' to be outdated, got %v / %v", outdated, err)
+			}
+			_ = store.PutDevices("user1", deviceMap)
+			if outdated, err := store.GetOutdatedTrackedUsers(); err != nil || len(outdated) != 0 {
+				t.Errorf("Expected no outdated users after storing devices, got %v / %v", outdated, err)
+			}
 		})
 	}
 }
@@ -0,0 +1,140 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type olmEncryptJob struct {
+	userID   id.UserID
+	deviceID id.DeviceID
+	device   deviceSessionWrapper
+}
+
+// encryptOlmEventForDevices encrypts the given content for all the given devices using a pool of
+// OlmEncryptionWorkers goroutines. The caller must hold olmLock.
+func (mach *OlmMachine) encryptOlmEventForDevices(olmSessions map[id.UserID]map[id.DeviceID]deviceSessionWrapper, evtType event.Type, content event.Content) *mautrix.ReqSendToDevice {
+	// Make sure the account keys are cached before they're read from multiple goroutines.
+	mach.getAccount().Keys()
+
+	jobs := make(chan olmEncryptJob)
+	output := &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content)}
+	var outputLock sync.Mutex
+	var wg sync.WaitGroup
+	workers := mach.OlmEncryptionWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				encrypted := mach.encryptOlmEvent(job.device.session, job.device.identity, evtType, content)
+				outputLock.Lock()
+				userMessages, ok := output.Messages[job.userID]
+				if !ok {
+					userMessages = make(map[id.DeviceID]*event.Content)
+					output.Messages[job.userID] = userMessages
+				}
+				userMessages[job.deviceID] = &event.Content{Parsed: encrypted}
+				outputLock.Unlock()
+			}
+		}()
+	}
+	for userID, sessions := range olmSessions {
+		for deviceID, device := range sessions {
+			jobs <- olmEncryptJob{userID: userID, deviceID: deviceID, device: device}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return output
+}
+
+// splitToDeviceRequest splits the messages in the given request into chunks of at most maxMessages messages.
+func splitToDeviceRequest(req *mautrix.ReqSendToDevice, maxMessages int) []*mautrix.ReqSendToDevice {
+	if maxMessages <= 0 {
+		return []*mautrix.ReqSendToDevice{req}
+	}
+	var chunks []*mautrix.ReqSendToDevice
+	var current *mautrix.ReqSendToDevice
+	count := 0
+	for userID, devices := range req.Messages {
+		for deviceID, content := range devices {
+			if current == nil || count >= maxMessages {
+				current = &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content)}
+				chunks = append(chunks, current)
+				count = 0
+			}
+			userMessages, ok := current.Messages[userID]
+			if !ok {
+				userMessages = make(map[id.DeviceID]*event.Content)
+				current.Messages[userID] = userMessages
+			}
+			userMessages[deviceID] = content
+			count++
+		}
+	}
+	return chunks
+}
+
+// sendToDeviceBatched sends the given to-device messages, splitting them into multiple requests
+// so that each request contains at most MaxToDeviceMessagesPerRequest messages.
+func (mach *OlmMachine) sendToDeviceBatched(evtType event.Type, req *mautrix.ReqSendToDevice) error {
+	chunks := splitToDeviceRequest(req, mach.MaxToDeviceMessagesPerRequest)
+	for i, chunk := range chunks {
+		if len(chunks) > 1 {
+			mach.Log.Trace("Sending %s to-device chunk %d/%d", evtType.Type, i+1, len(chunks))
+		}
+		_, err := mach.Client.SendToDevice(evtType, chunk)
+		if err != nil {
+			return fmt.Errorf("failed to send chunk %d/%d: %w", i+1, len(chunks), err)
+		}
+	}
+	return nil
+}
+
+// SendEncryptedToDeviceID sends an olm-encrypted to-device event with arbitrary content to the given device. The
+// device is fetched from the server if it's not known yet, and a new olm session is established if there isn't one.
+//
+// The content can be anything that can be marshaled to JSON. Encrypted events with types that the machine doesn't
+// handle itself are passed to OnCustomEncryptedToDevice on the receiving side.
+func (mach *OlmMachine) SendEncryptedToDeviceID(ctx context.Context, userID id.UserID, deviceID id.DeviceID, evtType event.Type, content interface{}) error {
+	var wrapped event.Content
+	switch typedContent := content.(type) {
+	case event.Content:
+		wrapped = typedContent
+	case *event.Content:
+		wrapped = *typedContent
+	default:
+		data, err := json.Marshal(content)
+		if err != nil {
+			return fmt.Errorf("failed to marshal content: %w", err)
+		}
+		wrapped = event.Content{VeryRaw: data}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	device, err := mach.GetOrFetchDevice(userID, deviceID)
+	if err != nil {
+		return err
+	} else if err = ctx.Err(); err != nil {
+		return err
+	}
+	evtType.Class = event.ToDeviceEventType
+	return mach.SendEncryptedToDevice(device, evtType, wrapped)
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"fmt"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestSplitToDeviceRequest(t *testing.T) {
+	req := &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content)}
+	for i := 0; i < 5; i++ {
+		userID := id.UserID(fmt.Sprintf("@user%d:example.com", i))
+		req.Messages[userID] = make(map[id.DeviceID]*event.Content)
+		for j := 0; j < 5; j++ {
+			req.Messages[userID][id.DeviceID(fmt.Sprintf("DEVICE%d", j))] = &event.Content{}
+		}
+	}
+	chunks := splitToDeviceRequest(req, 10)
+	if len(chunks) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d", len(chunks))
+	}
+	seen := make(map[string]bool)
+	for i, chunk := range chunks {
+		count := 0
+		for userID, devices := range chunk.Messages {
+			for deviceID := range devices {
+				seen[fmt.Sprintf("%s/%s", userID, deviceID)] = true
+				count++
+			}
+		}
+		if count > 10 {
+			t.Errorf("Chunk #%d has %d messages", i, count)
+		}
+	}
+	if len(seen) != 25 {
+		t.Errorf("Expected all 25 messages to be in chunks, got %d", len(seen))
+	}
+	if chunks = splitToDeviceRequest(req, 0); len(chunks) != 1 || chunks[0] != req {
+		t.Errorf("Request shouldn't be split without a limit")
+	}
+}
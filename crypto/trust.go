@@ -0,0 +1,68 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"fmt"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// SetDeviceTrust changes the trust state of a device, e.g. to blacklist it, and saves it in the crypto store.
+//
+// Outbound group sessions in rooms shared with the user are invalidated, so that future messages are (or aren't)
+// encrypted for the device according to the new trust state.
+func (mach *OlmMachine) SetDeviceTrust(device *DeviceIdentity, trust TrustState) error {
+	if device.Trust == trust {
+		return nil
+	}
+	mach.Log.Debug("Changing trust state of %s/%s from %s to %s", device.UserID, device.DeviceID, device.Trust, trust)
+	device.Trust = trust
+	err := mach.CryptoStore.PutDevice(device.UserID, device)
+	if err != nil {
+		return fmt.Errorf("failed to save device: %w", err)
+	}
+	mach.OnDevicesChanged(device.UserID)
+	return nil
+}
+
+// BlacklistDevice marks the given device as blacklisted, which means group sessions will never be shared with it.
+func (mach *OlmMachine) BlacklistDevice(userID id.UserID, deviceID id.DeviceID) error {
+	device, err := mach.GetOrFetchDevice(userID, deviceID)
+	if err != nil {
+		return err
+	}
+	return mach.SetDeviceTrust(device, TrustStateBlacklisted)
+}
+
+// SetUserTrustSettings stores the trust settings for the given user and invalidates outbound group sessions in
+// rooms shared with the user, so that the new settings are applied to the next message.
+func (mach *OlmMachine) SetUserTrustSettings(userID id.UserID, settings UserTrustSettings) error {
+	err := mach.CryptoStore.PutUserTrustSettings(userID, settings)
+	if err != nil {
+		return fmt.Errorf("failed to save trust settings: %w", err)
+	}
+	mach.OnDevicesChanged(userID)
+	return nil
+}
+
+// GetUserTrustSettings returns the trust settings for the given user. If no settings have been stored for the user,
+// the settings are filled based on the global defaults (i.e. AllowUnverifiedDevices).
+func (mach *OlmMachine) GetUserTrustSettings(userID id.UserID) UserTrustSettings {
+	settings, err := mach.CryptoStore.GetUserTrustSettings(userID)
+	if err != nil {
+		mach.Log.Warn("Failed to get trust settings of %s: %v", userID, err)
+	}
+	if settings == nil {
+		settings = &UserTrustSettings{}
+	}
+	if settings.AllowUnverifiedDevices == nil {
+		allowUnverified := mach.AllowUnverifiedDevices
+		settings.AllowUnverifiedDevices = &allowUnverified
+	}
+	return *settings
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"io"
+	"strings"
+)
+
+// EncodeUnpaddedBase64 encodes the given data as unpadded base64 with the standard alphabet, as used in most of Matrix.
+func EncodeUnpaddedBase64(data []byte) string {
+	return base64.RawStdEncoding.EncodeToString(data)
+}
+
+// EncodeUnpaddedURLSafeBase64 encodes the given data as unpadded base64 with the URL-safe alphabet,
+// as used in e.g. the JSON web keys of encrypted attachments.
+func EncodeUnpaddedURLSafeBase64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeUnpaddedBase64 decodes base64 data leniently, as recommended by the Matrix spec: both padded and
+// unpadded input is accepted, as well as both the standard and the URL-safe alphabet.
+func DecodeUnpaddedBase64(data string) ([]byte, error) {
+	data = strings.TrimRight(data, "=")
+	if strings.ContainsAny(data, "-_") {
+		return base64.RawURLEncoding.DecodeString(data)
+	}
+	return base64.RawStdEncoding.DecodeString(data)
+}
+
+// HashingReader is an io.Reader that calculates the SHA-256 hash of everything read through it.
+type HashingReader struct {
+	source io.Reader
+	hash   hash.Hash
+}
+
+// HashAndEncode wraps the given reader in a HashingReader. After the reader has been read to the end,
+// EncodedHash can be used to get the unpadded base64 SHA-256 hash, e.g. for the hashes field of encrypted files.
+func HashAndEncode(source io.Reader) *HashingReader {
+	return &HashingReader{source: source, hash: sha256.New()}
+}
+
+func (hr *HashingReader) Read(dst []byte) (n int, err error) {
+	n, err = hr.source.Read(dst)
+	hr.hash.Write(dst[:n])
+	return
+}
+
+// Sum returns the raw SHA-256 hash of the data read so far.
+func (hr *HashingReader) Sum() []byte {
+	return hr.hash.Sum(nil)
+}
+
+// EncodedHash returns the SHA-256 hash of the data read so far as unpadded base64.
+func (hr *HashingReader) EncodedHash() string {
+	return EncodeUnpaddedBase64(hr.hash.Sum(nil))
+}
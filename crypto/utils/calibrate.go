@@ -0,0 +1,68 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package utils
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	calibrationMinIterations  = 1000
+	calibrationMinSampleTime  = 50 * time.Millisecond
+	calibrationMaxParallelism = 4
+)
+
+// measurePBKDF2 returns the number of PBKDF2-SHA512 iterations per second measured on the current goroutine.
+func measurePBKDF2() float64 {
+	password := []byte("calibration passphrase")
+	salt := make([]byte, 32)
+	for iterations := calibrationMinIterations; ; iterations *= 2 {
+		start := time.Now()
+		PBKDF2SHA512(password, salt, iterations, 256)
+		elapsed := time.Since(start)
+		if elapsed >= calibrationMinSampleTime {
+			return float64(iterations) / elapsed.Seconds()
+		}
+	}
+}
+
+// CalibratePBKDF2 measures how fast PBKDF2-SHA512 is on this host and returns the iteration count that takes
+// approximately the given amount of wall time to derive a 256-bit key.
+//
+// The measurement is done on several goroutines in parallel and the slowest result is used, so the returned
+// count stays close to the target even when other key derivations are running at the same time.
+// This takes at least 50 milliseconds.
+func CalibratePBKDF2(targetDuration time.Duration) int {
+	parallelism := runtime.GOMAXPROCS(0)
+	if parallelism > calibrationMaxParallelism {
+		parallelism = calibrationMaxParallelism
+	}
+	rates := make([]float64, parallelism)
+	var wg sync.WaitGroup
+	wg.Add(parallelism)
+	for i := range rates {
+		go func(i int) {
+			defer wg.Done()
+			rates[i] = measurePBKDF2()
+		}(i)
+	}
+	wg.Wait()
+
+	slowest := rates[0]
+	for _, rate := range rates[1:] {
+		if rate < slowest {
+			slowest = rate
+		}
+	}
+	iterations := int(slowest * targetDuration.Seconds())
+	if iterations < 1 {
+		return 1
+	}
+	return iterations
+}
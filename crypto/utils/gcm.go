@@ -0,0 +1,55 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// AESGCMNonceLength is the length of the nonce prepended to data encrypted with EncryptAESGCM.
+const AESGCMNonceLength = 12
+
+var ErrAESGCMCiphertextTooShort = errors.New("AES-GCM ciphertext too short")
+
+// DeriveAESGCMKey derives an AES-256 key for EncryptAESGCM from the given secret (e.g. a pickle key) with HKDF-SHA256.
+// The info string should be unique to the purpose the key is used for.
+func DeriveAESGCMKey(secret []byte, info string) (key [AESCTRKeyLength]byte) {
+	_, _ = hkdf.New(sha256.New, secret, nil, []byte(info)).Read(key[:])
+	return
+}
+
+// EncryptAESGCM encrypts the given data with AES-256-GCM. The random nonce is prepended to the returned ciphertext.
+func EncryptAESGCM(key [AESCTRKeyLength]byte, plaintext, additionalData []byte) ([]byte, error) {
+	block, _ := aes.NewCipher(key[:])
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, AESGCMNonceLength, AESGCMNonceLength+len(plaintext)+gcm.Overhead())
+	if _, err = ReadRandom(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// DecryptAESGCM decrypts data that was encrypted with EncryptAESGCM.
+func DecryptAESGCM(key [AESCTRKeyLength]byte, ciphertext, additionalData []byte) ([]byte, error) {
+	block, _ := aes.NewCipher(key[:])
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	} else if len(ciphertext) < AESGCMNonceLength+gcm.Overhead() {
+		return nil, ErrAESGCMCiphertextTooShort
+	}
+	return gcm.Open(nil, ciphertext[:AESGCMNonceLength], ciphertext[AESGCMNonceLength:], additionalData)
+}
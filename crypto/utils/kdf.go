@@ -0,0 +1,66 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package utils
+
+import (
+	"golang.org/x/crypto/argon2"
+)
+
+// KDF is a key derivation function that turns a passphrase and salt into a key of the given bit-length.
+type KDF interface {
+	DeriveKey(password []byte, salt []byte, keyLenBits int) []byte
+}
+
+// PBKDF2 is a KDF that uses PBKDF2 with SHA-512 and the given iteration count.
+type PBKDF2 struct {
+	Iterations int
+}
+
+var _ KDF = PBKDF2{}
+
+func (kdf PBKDF2) DeriveKey(password []byte, salt []byte, keyLenBits int) []byte {
+	return PBKDF2SHA512(password, salt, kdf.Iterations, keyLenBits)
+}
+
+const (
+	// DefaultArgon2idTime is the default number of passes over memory for Argon2id (RFC 9106 second recommended option).
+	DefaultArgon2idTime = 3
+	// DefaultArgon2idMemory is the default amount of memory in KiB used by Argon2id (64 MiB).
+	DefaultArgon2idMemory = 64 * 1024
+	// DefaultArgon2idThreads is the default degree of parallelism for Argon2id.
+	DefaultArgon2idThreads = 4
+)
+
+// Argon2id is a KDF that uses Argon2id with the given parameters.
+// Zero values are replaced with the DefaultArgon2id* constants.
+type Argon2id struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+var _ KDF = Argon2id{}
+
+func (kdf Argon2id) DeriveKey(password []byte, salt []byte, keyLenBits int) []byte {
+	time, memory, threads := kdf.Time, kdf.Memory, kdf.Threads
+	if time == 0 {
+		time = DefaultArgon2idTime
+	}
+	if memory == 0 {
+		memory = DefaultArgon2idMemory
+	}
+	if threads == 0 {
+		threads = DefaultArgon2idThreads
+	}
+	return Argon2idKey(password, salt, time, memory, threads, keyLenBits)
+}
+
+// Argon2idKey generates a key of the given bit-length using the given passphrase, salt and Argon2id parameters.
+// The memory parameter is in kibibytes.
+func Argon2idKey(password []byte, salt []byte, time, memory uint32, threads uint8, keyLenBits int) []byte {
+	return argon2.IDKey(password, salt, time, memory, threads, uint32(keyLenBits/8))
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package utils
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MnemonicRecoveryKeyWords is the number of words in a mnemonic recovery key.
+const MnemonicRecoveryKeyWords = 24
+
+var (
+	ErrBadMnemonicWord     = errors.New("recovery key contains an unknown word")
+	ErrBadMnemonicChecksum = errors.New("recovery key has wrong checksum")
+)
+
+var mnemonicWordIndex map[string]int
+
+func init() {
+	mnemonicWordIndex = make(map[string]int, len(mnemonicWordlist))
+	for i, word := range mnemonicWordlist {
+		mnemonicWordIndex[word] = i
+	}
+}
+
+// EncodeMnemonicRecoveryKey encodes a 32-byte secret storage key as a 24-word BIP-39 style mnemonic.
+//
+// The last 8 bits of the mnemonic are the first byte of the SHA-256 hash of the key, which is used as a checksum.
+func EncodeMnemonicRecoveryKey(key []byte) (string, error) {
+	if len(key) != AESCTRKeyLength {
+		return "", ErrBadLength
+	}
+	checksum := sha256.Sum256(key)
+	data := make([]byte, AESCTRKeyLength+1)
+	copy(data, key)
+	data[AESCTRKeyLength] = checksum[0]
+
+	words := make([]string, MnemonicRecoveryKeyWords)
+	for i := range words {
+		words[i] = mnemonicWordlist[readBits(data, i*11, 11)]
+	}
+	WipeBytes(data)
+	return strings.Join(words, " "), nil
+}
+
+// DecodeMnemonicRecoveryKey decodes a secret storage key from a mnemonic made with EncodeMnemonicRecoveryKey.
+//
+// The input is normalized: it's case-insensitive, any whitespace is accepted between words, and words may be
+// abbreviated to their first four letters, as all words in the wordlist are unique by their first four letters.
+func DecodeMnemonicRecoveryKey(mnemonic string) ([]byte, error) {
+	words := strings.Fields(strings.ToLower(mnemonic))
+	if len(words) != MnemonicRecoveryKeyWords {
+		return nil, ErrBadLength
+	}
+	data := make([]byte, AESCTRKeyLength+1)
+	for i, word := range words {
+		index, ok := lookupMnemonicWord(word)
+		if !ok {
+			return nil, fmt.Errorf("%w: word #%d (%s)", ErrBadMnemonicWord, i+1, word)
+		}
+		writeBits(data, i*11, 11, index)
+	}
+	key := data[:AESCTRKeyLength]
+	checksum := sha256.Sum256(key)
+	if data[AESCTRKeyLength] != checksum[0] {
+		WipeBytes(data)
+		return nil, ErrBadMnemonicChecksum
+	}
+	return key, nil
+}
+
+// ValidateMnemonicRecoveryKey checks whether the given mnemonic is well-formed.
+// It returns the same errors as DecodeMnemonicRecoveryKey.
+func ValidateMnemonicRecoveryKey(mnemonic string) error {
+	key, err := DecodeMnemonicRecoveryKey(mnemonic)
+	WipeBytes(key)
+	return err
+}
+
+func lookupMnemonicWord(word string) (int, bool) {
+	if index, ok := mnemonicWordIndex[word]; ok {
+		return index, true
+	} else if len(word) != 4 {
+		return 0, false
+	}
+	for i, fullWord := range mnemonicWordlist {
+		if strings.HasPrefix(fullWord, word) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func readBits(data []byte, offset, count int) (value int) {
+	for i := offset; i < offset+count; i++ {
+		value <<= 1
+		if data[i/8]&(0x80>>(i%8)) != 0 {
+			value |= 1
+		}
+	}
+	return
+}
+
+func writeBits(data []byte, offset, count, value int) {
+	for i := 0; i < count; i++ {
+		if value&(1<<(count-1-i)) != 0 {
+			bit := offset + i
+			data[bit/8] |= 0x80 >> (bit % 8)
+		}
+	}
+}
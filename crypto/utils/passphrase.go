@@ -0,0 +1,158 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var ErrWeakPassphrase = errors.New("passphrase is too weak")
+
+// PassphraseScore is a rough zxcvbn-style score for how hard a passphrase is to guess.
+type PassphraseScore int
+
+const (
+	PassphraseTooGuessable PassphraseScore = iota
+	PassphraseVeryGuessable
+	PassphraseSomewhatGuessable
+	PassphraseSafelyUnguessable
+	PassphraseVeryUnguessable
+)
+
+// PassphraseStrength contains the result of EstimatePassphraseStrength.
+type PassphraseStrength struct {
+	// Entropy is the estimated entropy of the passphrase in bits.
+	Entropy float64
+	Score   PassphraseScore
+	// Warnings contains human-readable reasons for why the passphrase is weaker than it could be.
+	Warnings []string
+}
+
+// commonPassphrases is a short list of the most common passwords, which are always considered too guessable.
+var commonPassphrases = map[string]struct{}{
+	"password": {}, "password1": {}, "password123": {}, "passw0rd": {}, "123456": {}, "12345678": {}, "123456789": {},
+	"1234567890": {}, "qwerty": {}, "qwertyuiop": {}, "asdfghjkl": {}, "iloveyou": {}, "letmein": {}, "welcome": {},
+	"monkey": {}, "dragon": {}, "football": {}, "baseball": {}, "sunshine": {}, "princess": {}, "admin": {},
+	"trustno1": {}, "abc123": {}, "111111": {}, "000000": {}, "correct horse battery staple": {}, "matrix": {},
+}
+
+func charsetSize(passphrase string) (size int) {
+	var lower, upper, digit, symbol, other bool
+	for _, char := range passphrase {
+		switch {
+		case char >= 'a' && char <= 'z':
+			lower = true
+		case char >= 'A' && char <= 'Z':
+			upper = true
+		case char >= '0' && char <= '9':
+			digit = true
+		case char < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if symbol {
+		size += 33
+	}
+	if other {
+		size += 100
+	}
+	return
+}
+
+// EstimatePassphraseStrength estimates how hard the given passphrase is to guess.
+//
+// The estimate is based on the character classes used, with penalties for repeated characters, sequences
+// (like "abc" or "321") and very common passwords. It's intentionally conservative and much simpler than
+// the real zxcvbn, but good enough to reject obviously weak passphrases programmatically.
+func EstimatePassphraseStrength(passphrase string) (strength PassphraseStrength) {
+	if _, isCommon := commonPassphrases[strings.ToLower(strings.TrimSpace(passphrase))]; isCommon {
+		strength.Warnings = append(strength.Warnings, "this is a very common passphrase")
+		return
+	}
+	runes := []rune(passphrase)
+	if len(runes) == 0 {
+		return
+	}
+	charEntropy := math.Log2(float64(charsetSize(passphrase)))
+	var repeats, sequences int
+	for i, char := range runes {
+		if i > 0 && char == runes[i-1] {
+			repeats++
+			strength.Entropy += 1
+		} else if i > 1 && char-runes[i-1] == runes[i-1]-runes[i-2] && (char-runes[i-1] == 1 || char-runes[i-1] == -1) {
+			sequences++
+			strength.Entropy += 1
+		} else {
+			strength.Entropy += charEntropy
+		}
+	}
+
+	if len(runes) < 10 {
+		strength.Warnings = append(strength.Warnings, "passphrase is short")
+	}
+	if repeats*4 >= len(runes) {
+		strength.Warnings = append(strength.Warnings, "passphrase contains many repeated characters")
+	}
+	if sequences*4 >= len(runes) {
+		strength.Warnings = append(strength.Warnings, "passphrase contains predictable sequences")
+	}
+
+	switch {
+	case strength.Entropy < 25:
+		strength.Score = PassphraseTooGuessable
+	case strength.Entropy < 40:
+		strength.Score = PassphraseVeryGuessable
+	case strength.Entropy < 60:
+		strength.Score = PassphraseSomewhatGuessable
+	case strength.Entropy < 80:
+		strength.Score = PassphraseSafelyUnguessable
+	default:
+		strength.Score = PassphraseVeryUnguessable
+	}
+	return
+}
+
+// CheckPassphraseStrength returns ErrWeakPassphrase if the estimated score of the passphrase is below the given minimum.
+func CheckPassphraseStrength(passphrase string, minScore PassphraseScore) error {
+	strength := EstimatePassphraseStrength(passphrase)
+	if strength.Score < minScore {
+		if len(strength.Warnings) > 0 {
+			return fmt.Errorf("%w: %s", ErrWeakPassphrase, strings.Join(strength.Warnings, ", "))
+		}
+		return ErrWeakPassphrase
+	}
+	return nil
+}
+
+// MinPBKDF2Iterations is the lowest iteration count SuggestPBKDF2Iterations will return.
+const MinPBKDF2Iterations = 100000
+
+// SuggestPBKDF2Iterations measures how fast PBKDF2-SHA512 is on this host and returns an iteration count
+// that should take roughly the given amount of time. The result is never lower than MinPBKDF2Iterations.
+func SuggestPBKDF2Iterations(targetDuration time.Duration) int {
+	iterations := CalibratePBKDF2(targetDuration)
+	if iterations < MinPBKDF2Iterations {
+		return MinPBKDF2Iterations
+	}
+	return iterations
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package utils
+
+import (
+	"crypto/rand"
+	"io"
+)
+
+// RandomSource is a source of cryptographically secure random bytes.
+type RandomSource interface {
+	io.Reader
+}
+
+// Random is the RandomSource used for all key, IV and salt generation in mautrix's crypto packages.
+//
+// It defaults to crypto/rand.Reader, but can be replaced, e.g. with a DRBG in FIPS environments or with a
+// deterministic source in tests. It must not be changed while other goroutines may be generating keys.
+var Random RandomSource = rand.Reader
+
+// ReadRandom fills the given slice with bytes from Random. It is a drop-in replacement for crypto/rand.Read.
+func ReadRandom(b []byte) (n int, err error) {
+	return io.ReadFull(Random, b)
+}
+
+const randomStringCharset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// RandomString returns a string of the given length consisting of random letters and digits read from Random.
+func RandomString(length int) (string, error) {
+	output := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(output) < length {
+		if _, err := ReadRandom(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			// Bytes above the largest multiple of the charset length are skipped to avoid bias.
+			if int(b) < 256-256%len(randomStringCharset) && len(output) < length {
+				output = append(output, randomStringCharset[int(b)%len(randomStringCharset)])
+			}
+		}
+	}
+	return string(output), nil
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package utils
+
+import (
+	"runtime"
+	"sync"
+)
+
+// WipeBytes overwrites the given slice with zeroes.
+func WipeBytes(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+// SecretBytes wraps secret key material (e.g. recovery keys, derived keys or pickle keys) so that it can be
+// explicitly zeroed with Wipe after use. If Wipe isn't called, the data is zeroed when the SecretBytes is
+// garbage collected.
+//
+// Note that Go may still have copied the data elsewhere (e.g. when growing slices or in strings derived from it),
+// so this only minimizes how long the secret stays resident rather than guaranteeing it's gone.
+type SecretBytes struct {
+	lock sync.Mutex
+	data []byte
+}
+
+// NewSecretBytes creates a new SecretBytes that takes ownership of the given slice.
+// The caller should not use the slice directly after passing it here.
+func NewSecretBytes(data []byte) *SecretBytes {
+	sb := &SecretBytes{data: data}
+	runtime.SetFinalizer(sb, (*SecretBytes).Wipe)
+	return sb
+}
+
+// Bytes returns the wrapped secret, or nil if it has already been wiped.
+// The returned slice is only valid until Wipe is called.
+func (sb *SecretBytes) Bytes() []byte {
+	if sb == nil {
+		return nil
+	}
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	return sb.data
+}
+
+// Len returns the length of the secret, or zero if it has been wiped.
+func (sb *SecretBytes) Len() int {
+	return len(sb.Bytes())
+}
+
+// Wipe zeroes the secret and releases it. It's safe to call Wipe multiple times.
+func (sb *SecretBytes) Wipe() {
+	if sb == nil {
+		return
+	}
+	sb.lock.Lock()
+	WipeBytes(sb.data)
+	sb.data = nil
+	sb.lock.Unlock()
+	runtime.SetFinalizer(sb, nil)
+}
+
+// String returns a placeholder so that secrets aren't accidentally logged.
+func (sb *SecretBytes) String() string {
+	return "<secret>"
+}
+
+// GoString returns a placeholder so that secrets aren't accidentally logged with %#v.
+func (sb *SecretBytes) GoString() string {
+	return "<secret>"
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"hash"
+	"io"
+)
+
+// A256CTRWriter encrypts everything written to it with AES256-CTR and writes the ciphertext to the wrapped writer.
+// The SHA-256 hash of the ciphertext is calculated incrementally and can be retrieved with Sum after all data has been written.
+type A256CTRWriter struct {
+	stream cipher.Stream
+	hash   hash.Hash
+	target io.Writer
+	buf    []byte
+}
+
+// NewA256CTRWriter creates a new streaming AES256-CTR encryptor that writes the ciphertext into the given writer.
+func NewA256CTRWriter(target io.Writer, key [AESCTRKeyLength]byte, iv [AESCTRIVLength]byte) *A256CTRWriter {
+	block, _ := aes.NewCipher(key[:])
+	return &A256CTRWriter{
+		stream: cipher.NewCTR(block, iv[:]),
+		hash:   sha256.New(),
+		target: target,
+	}
+}
+
+// Write encrypts the given plaintext and writes it to the underlying writer.
+func (w *A256CTRWriter) Write(plaintext []byte) (int, error) {
+	if cap(w.buf) < len(plaintext) {
+		w.buf = make([]byte, len(plaintext))
+	}
+	ciphertext := w.buf[:len(plaintext)]
+	w.stream.XORKeyStream(ciphertext, plaintext)
+	n, err := w.target.Write(ciphertext)
+	w.hash.Write(ciphertext[:n])
+	if err == nil && n < len(plaintext) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// Sum returns the SHA-256 hash of the ciphertext written so far.
+func (w *A256CTRWriter) Sum() []byte {
+	return w.hash.Sum(nil)
+}
+
+// A256CTRReader decrypts AES256-CTR ciphertext read from the wrapped reader.
+// The SHA-256 hash of the ciphertext is calculated incrementally and can be retrieved with Sum after the reader has
+// been read to the end, which allows verifying the hash of an attachment without buffering it in memory.
+type A256CTRReader struct {
+	stream cipher.Stream
+	hash   hash.Hash
+	source io.Reader
+}
+
+// NewA256CTRReader creates a new streaming AES256-CTR decryptor that reads the ciphertext from the given reader.
+func NewA256CTRReader(source io.Reader, key [AESCTRKeyLength]byte, iv [AESCTRIVLength]byte) *A256CTRReader {
+	block, _ := aes.NewCipher(key[:])
+	return &A256CTRReader{
+		stream: cipher.NewCTR(block, iv[:]),
+		hash:   sha256.New(),
+		source: source,
+	}
+}
+
+// Read reads ciphertext from the underlying reader and decrypts it into the given buffer.
+func (r *A256CTRReader) Read(dst []byte) (n int, err error) {
+	n, err = r.source.Read(dst)
+	if n > 0 {
+		r.hash.Write(dst[:n])
+		r.stream.XORKeyStream(dst[:n], dst[:n])
+	}
+	return
+}
+
+// Sum returns the SHA-256 hash of the ciphertext read so far.
+func (r *A256CTRReader) Sum() []byte {
+	return r.hash.Sum(nil)
+}
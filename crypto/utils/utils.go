@@ -13,7 +13,10 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
-	"math/rand"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
 	"strings"
 
 	"golang.org/x/crypto/hkdf"
@@ -43,13 +46,13 @@ func XorA256CTR(source []byte, key [AESCTRKeyLength]byte, iv [AESCTRIVLength]byt
 
 // GenAttachmentA256CTR generates a new random AES256-CTR key and IV suitable for encrypting attachments.
 func GenAttachmentA256CTR() (key [AESCTRKeyLength]byte, iv [AESCTRIVLength]byte) {
-	_, err := rand.Read(key[:])
+	_, err := ReadRandom(key[:])
 	if err != nil {
 		panic(err)
 	}
 
 	// The last 8 bytes of the IV act as the counter in AES-CTR, which means they're left empty here
-	_, err = rand.Read(iv[:8])
+	_, err = ReadRandom(iv[:8])
 	if err != nil {
 		panic(err)
 	}
@@ -58,7 +61,7 @@ func GenAttachmentA256CTR() (key [AESCTRKeyLength]byte, iv [AESCTRIVLength]byte)
 
 // GenA256CTRIV generates a random IV for AES256-CTR with the last bit set to zero.
 func GenA256CTRIV() (iv [AESCTRIVLength]byte) {
-	_, err := rand.Read(iv[:])
+	_, err := ReadRandom(iv[:])
 	if err != nil {
 		panic(err)
 	}
@@ -70,36 +73,82 @@ func GenA256CTRIV() (iv [AESCTRIVLength]byte) {
 func DeriveKeysSHA256(key []byte, name string) ([AESCTRKeyLength]byte, [HMACKeyLength]byte) {
 	var zeroBytes [32]byte
 
-	derivedHkdf := hkdf.New(sha256.New, key[:], zeroBytes[:], []byte(name))
-
 	var aesKey [AESCTRKeyLength]byte
 	var hmacKey [HMACKeyLength]byte
-	derivedHkdf.Read(aesKey[:])
-	derivedHkdf.Read(hmacKey[:])
+	keys, _ := DeriveKeys(sha256.New, key, zeroBytes[:], []byte(name), AESCTRKeyLength, HMACKeyLength)
+	copy(aesKey[:], keys[0])
+	copy(hmacKey[:], keys[1])
+	WipeBytes(keys[0])
+	WipeBytes(keys[1])
 
 	return aesKey, hmacKey
 }
 
+// DeriveKeys derives keys of the given byte lengths from the given key with HKDF using the given hash function.
+// The keys are read sequentially from the same HKDF output stream.
+//
+// An error is only returned if the total length exceeds the maximum output size of HKDF (255 times the hash size).
+func DeriveKeys(hash func() hash.Hash, key, salt, info []byte, lengths ...int) ([][]byte, error) {
+	derived := hkdf.New(hash, key, salt, info)
+	keys := make([][]byte, len(lengths))
+	for i, length := range lengths {
+		keys[i] = make([]byte, length)
+		if _, err := io.ReadFull(derived, keys[i]); err != nil {
+			return nil, fmt.Errorf("failed to derive key #%d: %w", i+1, err)
+		}
+	}
+	return keys, nil
+}
+
+// DeriveKeysSHA512 derives keys of the given byte lengths from the given key with HKDF-SHA512.
+func DeriveKeysSHA512(key, salt, info []byte, lengths ...int) ([][]byte, error) {
+	return DeriveKeys(sha512.New, key, salt, info, lengths...)
+}
+
 // PBKDF2SHA512 generates a key of the given bit-length using the given passphrase, salt and iteration count.
 func PBKDF2SHA512(password []byte, salt []byte, iters int, keyLenBits int) []byte {
 	return pbkdf2.Key(password, salt, iters, keyLenBits/8, sha512.New)
 }
 
-// DecodeBase58RecoveryKey recovers the secret storage from a recovery key.
-func DecodeBase58RecoveryKey(recoveryKey string) []byte {
+var (
+	ErrBadLength = errors.New("recovery key has wrong length")
+	ErrBadParity = errors.New("recovery key has wrong parity byte")
+	ErrBadPrefix = errors.New("recovery key has wrong prefix")
+)
+
+// DecodeRecoveryKey decodes the secret storage key from a recovery key.
+//
+// Unlike DecodeBase58RecoveryKey, this returns ErrBadLength, ErrBadParity or ErrBadPrefix to describe why decoding failed.
+func DecodeRecoveryKey(recoveryKey string) ([]byte, error) {
 	noSpaces := strings.ReplaceAll(recoveryKey, " ", "")
 	decoded := base58.Decode(noSpaces)
 	if len(decoded) != AESCTRKeyLength+3 { // AESCTRKeyLength bytes key and 3 bytes prefix / parity
-		return nil
+		return nil, ErrBadLength
 	}
 	var parity byte
 	for _, b := range decoded[:34] {
 		parity ^= b
 	}
-	if parity != decoded[34] || decoded[0] != 0x8B || decoded[1] != 1 {
-		return nil
+	if parity != decoded[34] {
+		return nil, ErrBadParity
+	} else if decoded[0] != 0x8B || decoded[1] != 1 {
+		return nil, ErrBadPrefix
 	}
-	return decoded[2:34]
+	return decoded[2:34], nil
+}
+
+// ValidateRecoveryKey checks whether the given recovery key is well-formed. It returns the same errors as DecodeRecoveryKey.
+//
+// This does not check that the key is actually correct, see ssss.KeyMetadata.VerifyRecoveryKey for that.
+func ValidateRecoveryKey(recoveryKey string) error {
+	_, err := DecodeRecoveryKey(recoveryKey)
+	return err
+}
+
+// DecodeBase58RecoveryKey recovers the secret storage from a recovery key.
+func DecodeBase58RecoveryKey(recoveryKey string) []byte {
+	key, _ := DecodeRecoveryKey(recoveryKey)
+	return key
 }
 
 // EncodeBase58RecoveryKey recovers the secret storage from a recovery key.
@@ -7,8 +7,17 @@
 package utils
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
 	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/util/base58"
 )
 
 func TestAES256Ctr(t *testing.T) {
@@ -62,6 +71,27 @@ func TestDecodeSSSSKey(t *testing.T) {
 	}
 }
 
+func TestDecodeRecoveryKeyErrors(t *testing.T) {
+	if err := ValidateRecoveryKey("EsTL 2cTx 9Qy1 8TVd qGsn GDrD i5dT EEuX Qz8U P7hi Z7uu U8wZ"); err != nil {
+		t.Errorf("Expected valid recovery key to pass validation, got %v", err)
+	}
+	if _, err := DecodeRecoveryKey("EsTL 2cTx 9Qy1"); !errors.Is(err, ErrBadLength) {
+		t.Errorf("Expected ErrBadLength, got %v", err)
+	}
+
+	var input [35]byte
+	input[0], input[1] = 0x8B, 1
+	input[34] = 0x8B ^ 1 ^ 0xFF
+	if _, err := DecodeRecoveryKey(base58.Encode(input[:])); !errors.Is(err, ErrBadParity) {
+		t.Errorf("Expected ErrBadParity, got %v", err)
+	}
+
+	input[0], input[34] = 0x8C, 0x8C^1
+	if _, err := DecodeRecoveryKey(base58.Encode(input[:])); !errors.Is(err, ErrBadPrefix) {
+		t.Errorf("Expected ErrBadPrefix, got %v", err)
+	}
+}
+
 func TestKeyDerivationAndHMAC(t *testing.T) {
 	recoveryKey := "EsUG Ddi6 e1Cm F4um g38u JN72 d37v Q2ry qCf2 rKgL E2MQ ZQz6"
 	decoded := DecodeBase58RecoveryKey(recoveryKey)
@@ -89,3 +119,224 @@ func TestKeyDerivationAndHMAC(t *testing.T) {
 		t.Errorf("Expected decrypted text to be `%v`, got `%v`", expectedDec, decrypted)
 	}
 }
+
+func TestA256CTRStream(t *testing.T) {
+	key, iv := GenAttachmentA256CTR()
+	plaintext := bytes.Repeat([]byte("Hello world "), 10000)
+
+	var encrypted bytes.Buffer
+	writer := NewA256CTRWriter(&encrypted, key, iv)
+	for i := 0; i < len(plaintext); i += 1000 {
+		end := i + 1000
+		if end > len(plaintext) {
+			end = len(plaintext)
+		}
+		if _, err := writer.Write(plaintext[i:end]); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if !bytes.Equal(encrypted.Bytes(), XorA256CTR(plaintext, key, iv)) {
+		t.Errorf("Streamed ciphertext doesn't match XorA256CTR output")
+	}
+	expectedHash := sha256.Sum256(encrypted.Bytes())
+	if !bytes.Equal(writer.Sum(), expectedHash[:]) {
+		t.Errorf("Expected writer hash to be %x, got %x", expectedHash, writer.Sum())
+	}
+
+	reader := NewA256CTRReader(bytes.NewReader(encrypted.Bytes()), key, iv)
+	decrypted, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Streamed decryption doesn't match original plaintext")
+	}
+	if !bytes.Equal(reader.Sum(), expectedHash[:]) {
+		t.Errorf("Expected reader hash to be %x, got %x", expectedHash, reader.Sum())
+	}
+}
+
+func TestArgon2id(t *testing.T) {
+	salt := []byte("somesalt")
+	key := Argon2idKey([]byte("password"), salt, 2, 64, 1, 256)
+	if len(key) != 32 {
+		t.Errorf("Expected 32 byte key, got %d bytes", len(key))
+	}
+	var kdf KDF = Argon2id{Time: 2, Memory: 64, Threads: 1}
+	if !bytes.Equal(kdf.DeriveKey([]byte("password"), salt, 256), key) {
+		t.Errorf("Expected KDF interface to produce the same key as Argon2idKey")
+	}
+}
+
+func TestRandomSourceInjection(t *testing.T) {
+	original := Random
+	defer func() { Random = original }()
+	Random = bytes.NewReader(bytes.Repeat([]byte{0x42}, 64))
+	key, iv := GenAttachmentA256CTR()
+	if !bytes.Equal(key[:], bytes.Repeat([]byte{0x42}, AESCTRKeyLength)) {
+		t.Errorf("Expected key to be generated from injected random source, got %x", key)
+	}
+	if !bytes.Equal(iv[:8], bytes.Repeat([]byte{0x42}, 8)) || !bytes.Equal(iv[8:], make([]byte, 8)) {
+		t.Errorf("Expected IV to be generated from injected random source, got %x", iv)
+	}
+}
+
+func TestRandomString(t *testing.T) {
+	original := Random
+	defer func() { Random = original }()
+	// 0xff is above the largest multiple of the charset length, so it's skipped
+	Random = bytes.NewReader([]byte{0, 0xff, 61, 62, 0xff, 1, 0xff, 0xff})
+	if str, err := RandomString(4); err != nil || str != "a9ab" {
+		t.Errorf("Expected a9ab, got %q / %v", str, err)
+	}
+	if _, err := RandomString(4); err == nil {
+		t.Error("Expected error when the random source runs out")
+	}
+	Random = original
+	if str, err := RandomString(32); err != nil || len(str) != 32 || strings.Trim(str, randomStringCharset) != "" {
+		t.Errorf("Unexpected random string %q / %v", str, err)
+	}
+}
+
+func TestSecretBytesWipe(t *testing.T) {
+	data := []byte("very secret")
+	secret := NewSecretBytes(data)
+	if secret.Len() != len(data) || !bytes.Equal(secret.Bytes(), []byte("very secret")) {
+		t.Errorf("Expected secret to contain the original data")
+	}
+	if str := fmt.Sprintf("%v %s %#v", secret, secret, secret); strings.Contains(str, "very secret") {
+		t.Errorf("Secret leaked when formatting: %s", str)
+	}
+	secret.Wipe()
+	if secret.Bytes() != nil {
+		t.Errorf("Expected wiped secret to return nil")
+	}
+	if !bytes.Equal(data, make([]byte, len(data))) {
+		t.Errorf("Expected underlying data to be zeroed, got %x", data)
+	}
+	secret.Wipe()
+}
+
+func TestAESGCM(t *testing.T) {
+	key := DeriveAESGCMKey([]byte("pickle key"), "test")
+	encrypted, err := EncryptAESGCM(key, []byte("Hello world"), []byte("ad"))
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	decrypted, err := DecryptAESGCM(key, encrypted, []byte("ad"))
+	if err != nil {
+		t.Fatalf("Failed to decrypt: %v", err)
+	} else if string(decrypted) != "Hello world" {
+		t.Errorf("Expected decrypted data to be `Hello world`, got `%s`", decrypted)
+	}
+	if _, err = DecryptAESGCM(DeriveAESGCMKey([]byte("wrong key"), "test"), encrypted, []byte("ad")); err == nil {
+		t.Errorf("Expected decryption with wrong key to fail")
+	}
+	if _, err = DecryptAESGCM(key, encrypted[:10], nil); !errors.Is(err, ErrAESGCMCiphertextTooShort) {
+		t.Errorf("Expected ErrAESGCMCiphertextTooShort, got %v", err)
+	}
+}
+
+func TestDeriveKeys(t *testing.T) {
+	keys, err := DeriveKeysSHA512([]byte("master secret"), nil, []byte("info"), 32, 64, 16)
+	if err != nil {
+		t.Fatalf("Failed to derive keys: %v", err)
+	}
+	if len(keys) != 3 || len(keys[0]) != 32 || len(keys[1]) != 64 || len(keys[2]) != 16 {
+		t.Fatalf("Unexpected derived key lengths")
+	}
+	combined, _ := DeriveKeysSHA512([]byte("master secret"), nil, []byte("info"), 112)
+	if !bytes.Equal(combined[0], append(append(keys[0], keys[1]...), keys[2]...)) {
+		t.Errorf("Expected keys to be read sequentially from the same HKDF stream")
+	}
+	if _, err = DeriveKeys(sha256.New, []byte("key"), nil, nil, 255*32+1); err == nil {
+		t.Errorf("Expected error when deriving too much key material")
+	}
+}
+
+func TestEstimatePassphraseStrength(t *testing.T) {
+	for passphrase, expectedMax := range map[string]PassphraseScore{
+		"":                             PassphraseTooGuessable,
+		"password":                     PassphraseTooGuessable,
+		"aaaaaaaaaaaaaaaa":             PassphraseTooGuessable,
+		"abcdefghijklmnop":             PassphraseTooGuessable,
+		"Correct Horse Battery Staple": PassphraseVeryUnguessable,
+	} {
+		if score := EstimatePassphraseStrength(passphrase).Score; score > expectedMax {
+			t.Errorf("Expected score of %q to be at most %d, got %d", passphrase, expectedMax, score)
+		}
+	}
+	if score := EstimatePassphraseStrength("tr0ub4dor&3 lamp-shade Quixotic").Score; score < PassphraseSafelyUnguessable {
+		t.Errorf("Expected strong passphrase to have a high score, got %d", score)
+	}
+	if err := CheckPassphraseStrength("123456", PassphraseSomewhatGuessable); !errors.Is(err, ErrWeakPassphrase) {
+		t.Errorf("Expected ErrWeakPassphrase, got %v", err)
+	}
+}
+
+func TestSuggestPBKDF2Iterations(t *testing.T) {
+	if iterations := SuggestPBKDF2Iterations(time.Millisecond); iterations != MinPBKDF2Iterations {
+		t.Errorf("Expected tiny target to return the minimum iteration count, got %d", iterations)
+	}
+}
+
+func TestMnemonicRecoveryKey(t *testing.T) {
+	// BIP-39 test vector for 0x7f repeated 32 times
+	key := bytes.Repeat([]byte{0x7f}, 32)
+	expected := "legal winner thank year wave sausage worth useful legal winner thank year wave sausage worth useful legal winner thank year wave sausage worth title"
+	mnemonic, err := EncodeMnemonicRecoveryKey(key)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	} else if mnemonic != expected {
+		t.Errorf("Expected mnemonic to be `%s`, got `%s`", expected, mnemonic)
+	}
+
+	decoded, err := DecodeMnemonicRecoveryKey("  LEGAL winner\tthank year wave sausage worth useful legal winner thank year\nwave saus worth useful legal winner thank year wave sausage worth title ")
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	} else if !bytes.Equal(decoded, key) {
+		t.Errorf("Expected decoded key to be %x, got %x", key, decoded)
+	}
+
+	if err = ValidateMnemonicRecoveryKey(strings.Replace(expected, "title", "zoo", 1)); !errors.Is(err, ErrBadMnemonicChecksum) {
+		t.Errorf("Expected ErrBadMnemonicChecksum, got %v", err)
+	}
+	if err = ValidateMnemonicRecoveryKey(strings.Replace(expected, "title", "notaword", 1)); !errors.Is(err, ErrBadMnemonicWord) {
+		t.Errorf("Expected ErrBadMnemonicWord, got %v", err)
+	}
+	if err = ValidateMnemonicRecoveryKey("legal winner"); !errors.Is(err, ErrBadLength) {
+		t.Errorf("Expected ErrBadLength, got %v", err)
+	}
+}
+
+func TestCalibratePBKDF2(t *testing.T) {
+	short := CalibratePBKDF2(10 * time.Millisecond)
+	long := CalibratePBKDF2(100 * time.Millisecond)
+	if short < 1 || long <= short {
+		t.Errorf("Expected longer target to give more iterations, got %d and %d", short, long)
+	}
+}
+
+func TestUnpaddedBase64(t *testing.T) {
+	data := []byte{0xfb, 0xff, 0x01}
+	if encoded := EncodeUnpaddedBase64(data[:2]); encoded != "+/8" {
+		t.Errorf("Expected `+/8`, got `%s`", encoded)
+	}
+	if encoded := EncodeUnpaddedURLSafeBase64(data[:2]); encoded != "-_8" {
+		t.Errorf("Expected `-_8`, got `%s`", encoded)
+	}
+	for _, input := range []string{"+/8", "+/8=", "-_8", "-_8="} {
+		decoded, err := DecodeUnpaddedBase64(input)
+		if err != nil || !bytes.Equal(decoded, data[:2]) {
+			t.Errorf("Expected %q to decode to %x, got %x (err: %v)", input, data[:2], decoded, err)
+		}
+	}
+
+	reader := HashAndEncode(bytes.NewReader([]byte("hello world")))
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if hash := reader.EncodedHash(); hash != "uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek" {
+		t.Errorf("Unexpected hash %s", hash)
+	}
+}
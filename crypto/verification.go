@@ -14,9 +14,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -24,6 +22,7 @@ import (
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto/canonicaljson"
 	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/crypto/utils"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
@@ -107,6 +106,9 @@ func (mach *OlmMachine) getPKAndKeysMAC(sas *olm.SAS, sendingUser id.UserID, sen
 type verificationState struct {
 	sas                 *olm.SAS
 	otherDevice         *DeviceIdentity
+	requestedByUs       bool
+	requestedDevices    []id.DeviceID
+	qrCode              *QRCode
 	initiatedByUs       bool
 	verificationStarted bool
 	keyReceived         bool
@@ -159,6 +161,8 @@ func (mach *OlmMachine) handleVerificationStart(userID id.UserID, content *event
 		}
 	}
 	switch {
+	case content.Method == event.VerificationMethodReciprocate:
+		mach.handleReciprocateStart(userID, content, otherDevice, transactionID)
 	case content.Method != event.VerificationMethodSAS:
 		warnAndCancel("is not SAS", "Only SAS method is supported")
 	case !content.SupportsKeyAgreementProtocol(event.KeyAgreementCurve25519HKDFSHA256):
@@ -176,21 +180,9 @@ func (mach *OlmMachine) handleVerificationStart(userID id.UserID, content *event
 }
 
 func (mach *OlmMachine) actuallyStartVerification(userID id.UserID, content *event.VerificationStartEventContent, otherDevice *DeviceIdentity, transactionID string, timeout time.Duration, inRoomID id.RoomID) {
-	if inRoomID != "" && transactionID != "" {
-		verState, err := mach.getTransactionState(transactionID, userID)
-		if err != nil {
-			mach.Log.Error("Failed to get transaction state for in-room verification %s start: %v", transactionID, err)
-			_ = mach.SendInRoomSASVerificationCancel(inRoomID, otherDevice.UserID, transactionID, "Internal state error in gomuks :(", "net.maunium.internal_error")
-			return
-		}
-		mach.timeoutAfter(verState, transactionID, timeout)
-		sasMethods := commonSASMethods(verState.hooks, content.ShortAuthenticationString)
-		err = mach.SendInRoomSASVerificationAccept(inRoomID, userID, content, transactionID, verState.sas.GetPubkey(), sasMethods)
-		if err != nil {
-			mach.Log.Error("Error accepting in-room SAS verification: %v", err)
-		}
-		verState.chosenSASMethod = sasMethods[0]
-		verState.verificationStarted = true
+	if verStateInterface, ok := mach.keyVerificationTransactionState.Load(userID.String() + ":" + transactionID); ok {
+		// The start message is for a request that was already accepted with m.key.verification.ready
+		mach.acceptStartAfterReady(verStateInterface.(*verificationState), content, otherDevice, transactionID)
 		return
 	}
 	resp, hooks := mach.AcceptVerificationFrom(transactionID, otherDevice, inRoomID)
@@ -261,8 +253,8 @@ func (mach *OlmMachine) actuallyStartVerification(userID id.UserID, content *eve
 func (mach *OlmMachine) timeoutAfter(verState *verificationState, transactionID string, timeout time.Duration) {
 	timeoutCtx, timeoutCancel := context.WithTimeout(context.Background(), timeout)
 	verState.extendTimeout = timeoutCancel
+	mapKey := verState.otherDevice.UserID.String() + ":" + transactionID
 	go func() {
-		mapKey := verState.otherDevice.UserID.String() + ":" + transactionID
 		for {
 			<-timeoutCtx.Done()
 			// when timeout context is done
@@ -515,7 +507,7 @@ func (mach *OlmMachine) handleVerificationMAC(userID id.UserID, content *event.V
 			mach.Log.Warn("Failed to put device after verifying: %v", err)
 		}
 
-		if mach.CrossSigningKeys != nil {
+		if _, err = mach.KeyProvider.PublicKey(KeyUsageMaster); err == nil {
 			if device.UserID == mach.Client.UserID {
 				err := mach.SignOwnDevice(device)
 				if err != nil {
@@ -543,6 +535,15 @@ func (mach *OlmMachine) handleVerificationMAC(userID id.UserID, content *event.V
 		mach.Log.Debug("Device %v of user %v verified successfully!", device.DeviceID, device.UserID)
 
 		verState.hooks.OnSuccess()
+
+		if verState.inRoomID == "" {
+			err = mach.SendSASVerificationDone(device.UserID, device.DeviceID, transactionID)
+		} else {
+			err = mach.SendInRoomSASVerificationDone(verState.inRoomID, device.UserID, transactionID)
+		}
+		if err != nil {
+			mach.Log.Warn("Failed to send verification done message for transaction %v: %v", transactionID, err)
+		}
 	}()
 }
 
@@ -578,19 +579,20 @@ func (mach *OlmMachine) handleVerificationRequest(userID id.UserID, content *eve
 		}
 		return
 	}
+	if inRoomID == "" && content.Timestamp != 0 {
+		age := time.Since(time.Unix(0, content.Timestamp*int64(time.Millisecond)))
+		if age > verificationRequestMaxAge || age < -verificationRequestMaxFuture {
+			mach.Log.Debug("Ignoring verification request %v from %v of user %v with timestamp %d", transactionID, otherDevice.DeviceID, otherDevice.UserID, content.Timestamp)
+			return
+		}
+	}
 	resp, hooks := mach.AcceptVerificationFrom(transactionID, otherDevice, inRoomID)
 	if resp == AcceptRequest {
 		mach.Log.Debug("Accepting SAS verification %v from %v of user %v", transactionID, otherDevice.DeviceID, otherDevice.UserID)
 		if inRoomID == "" {
-			_, err = mach.NewSASVerificationWith(otherDevice, hooks, transactionID, mach.DefaultSASTimeout)
+			err = mach.acceptVerificationRequest(otherDevice, hooks, transactionID, mach.DefaultSASTimeout)
 		} else {
-			if err := mach.SendInRoomSASVerificationReady(inRoomID, transactionID); err != nil {
-				mach.Log.Error("Error sending in-room SAS verification ready: %v", err)
-			}
-			if mach.Client.UserID < otherDevice.UserID {
-				// up to us to send the start message
-				_, err = mach.newInRoomSASVerificationWithInner(inRoomID, otherDevice, hooks, transactionID, mach.DefaultSASTimeout)
-			}
+			err = mach.acceptInRoomVerificationRequest(inRoomID, otherDevice, hooks, transactionID, mach.DefaultSASTimeout)
 		}
 		if err != nil {
 			mach.Log.Error("Error accepting SAS verification request: %v", err)
@@ -618,7 +620,10 @@ func (mach *OlmMachine) NewSimpleSASVerificationWith(device *DeviceIdentity, hoo
 // If the transaction ID is empty, a new one is generated.
 func (mach *OlmMachine) NewSASVerificationWith(device *DeviceIdentity, hooks VerificationHooks, transactionID string, timeout time.Duration) (string, error) {
 	if transactionID == "" {
-		transactionID = strconv.Itoa(rand.Int())
+		var err error
+		if transactionID, err = utils.RandomString(32); err != nil {
+			return "", fmt.Errorf("failed to generate transaction ID: %w", err)
+		}
 	}
 	mach.Log.Debug("Starting new verification transaction %v with device %v of user %v", transactionID, device.DeviceID, device.UserID)
 
@@ -738,6 +743,9 @@ func (mach *OlmMachine) SendSASVerificationAccept(fromUser id.UserID, startEvent
 
 func (mach *OlmMachine) callbackAndCancelSASVerification(verState *verificationState, transactionID, reason string, code event.VerificationCancelCode) error {
 	go verState.hooks.OnCancel(true, reason, code)
+	if verState.inRoomID != "" {
+		return mach.SendInRoomSASVerificationCancel(verState.inRoomID, verState.otherDevice.UserID, transactionID, reason, code)
+	}
 	return mach.SendSASVerificationCancel(verState.otherDevice.UserID, verState.otherDevice.DeviceID, transactionID, reason, code)
 }
 
@@ -754,12 +762,11 @@ func (mach *OlmMachine) SendSASVerificationKey(userID id.UserID, deviceID id.Dev
 func (mach *OlmMachine) SendSASVerificationMAC(userID id.UserID, deviceID id.DeviceID, transactionID string, sas *olm.SAS) error {
 	keyID := id.NewKeyID(id.KeyAlgorithmEd25519, mach.Client.DeviceID.String())
 
-	signingKey := mach.account.SigningKey()
+	signingKey := mach.getAccount().SigningKey()
 	keyIDsMap := map[id.KeyID]string{keyID: ""}
 	macMap := make(map[id.KeyID]string)
 
-	if mach.CrossSigningKeys != nil {
-		masterKey := mach.CrossSigningKeys.MasterKey.PublicKey
+	if masterKey, err := mach.KeyProvider.PublicKey(KeyUsageMaster); err == nil {
 		masterKeyID := id.NewKeyID(id.KeyAlgorithmEd25519, masterKey.String())
 		// add master key ID to key map
 		keyIDsMap[masterKeyID] = ""
@@ -9,8 +9,10 @@ package crypto
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto/canonicaljson"
 	"maunium.net/go/mautrix/crypto/olm"
 	"maunium.net/go/mautrix/event"
@@ -33,7 +35,9 @@ func (mach *OlmMachine) ProcessInRoomVerification(evt *event.Event) error {
 		// nothing to do if the message is our own
 		return nil
 	}
-	if relatable, ok := evt.Content.Parsed.(event.Relatable); !ok || relatable.OptionalGetRelatesTo() == nil {
+	if msg, ok := evt.Content.Parsed.(*event.MessageEventContent); ok && msg.MsgType == event.MsgVerificationRequest {
+		// the request is the only in-room verification event that doesn't have a relation
+	} else if relatable, ok := evt.Content.Parsed.(event.Relatable); !ok || relatable.OptionalGetRelatesTo() == nil {
 		return ErrNoRelatesTo
 	}
 
@@ -67,6 +71,8 @@ func (mach *OlmMachine) ProcessInRoomVerification(evt *event.Event) error {
 		mach.handleVerificationMAC(evt.Sender, content, content.RelatesTo.EventID.String())
 	case *event.VerificationCancelEventContent:
 		mach.handleVerificationCancel(evt.Sender, content, content.RelatesTo.EventID.String())
+	case *event.VerificationDoneEventContent:
+		mach.handleVerificationDone(evt.Sender, content.RelatesTo.EventID.String())
 	}
 	return nil
 }
@@ -80,28 +86,42 @@ func (mach *OlmMachine) SendInRoomSASVerificationCancel(roomID id.RoomID, userID
 		To:        userID,
 	}
 
-	encrypted, err := mach.EncryptMegolmEvent(roomID, event.InRoomVerificationCancel, content)
+	_, err := mach.sendInRoomVerificationEvent(roomID, userID, event.InRoomVerificationCancel, content)
+	return err
+}
+
+// sendInRoomVerificationEvent encrypts and sends an in-room verification event. The outbound group session of the
+// room is shared first if necessary, as the room may be a DM that was just created for the verification.
+func (mach *OlmMachine) sendInRoomVerificationEvent(roomID id.RoomID, otherUserID id.UserID, evtType event.Type, content interface{}) (*mautrix.RespSendEvent, error) {
+	encrypted, err := mach.EncryptMegolmEventAutoShare(roomID, evtType, content)
+	if errors.Is(err, NoRoomMemberStore) {
+		// without a member store, share the session with the users we know are taking part in the verification
+		users := []id.UserID{mach.Client.UserID}
+		if otherUserID != "" {
+			users = append(users, otherUserID)
+		}
+		if err = mach.ShareGroupSession(roomID, users); err != nil {
+			return nil, err
+		}
+		encrypted, err = mach.EncryptMegolmEvent(roomID, evtType, content)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = mach.Client.SendMessageEvent(roomID, event.EventEncrypted, encrypted)
-	return err
+	return mach.Client.SendMessageEvent(roomID, event.EventEncrypted, encrypted)
 }
 
 // SendInRoomSASVerificationRequest is used to manually send an in-room SAS verification request message to another user.
 func (mach *OlmMachine) SendInRoomSASVerificationRequest(roomID id.RoomID, toUserID id.UserID, methods []VerificationMethod) (string, error) {
 	content := &event.MessageEventContent{
 		MsgType:    event.MsgVerificationRequest,
+		Body:       fmt.Sprintf("%s is requesting to verify your key, but your client does not support in-chat key verification.", mach.Client.UserID),
 		FromDevice: mach.Client.DeviceID,
 		Methods:    []event.VerificationMethod{event.VerificationMethodSAS},
 		To:         toUserID,
 	}
 
-	encrypted, err := mach.EncryptMegolmEvent(roomID, event.EventMessage, content)
-	if err != nil {
-		return "", err
-	}
-	resp, err := mach.Client.SendMessageEvent(roomID, event.EventEncrypted, encrypted)
+	resp, err := mach.sendInRoomVerificationEvent(roomID, toUserID, event.EventMessage, content)
 	if err != nil {
 		return "", err
 	}
@@ -110,17 +130,17 @@ func (mach *OlmMachine) SendInRoomSASVerificationRequest(roomID id.RoomID, toUse
 
 // SendInRoomSASVerificationReady is used to manually send an in-room SAS verification ready message to another user.
 func (mach *OlmMachine) SendInRoomSASVerificationReady(roomID id.RoomID, transactionID string) error {
+	return mach.sendInRoomVerificationReady(roomID, "", transactionID)
+}
+
+func (mach *OlmMachine) sendInRoomVerificationReady(roomID id.RoomID, userID id.UserID, transactionID string) error {
 	content := &event.VerificationReadyEventContent{
 		FromDevice: mach.Client.DeviceID,
 		Methods:    []event.VerificationMethod{event.VerificationMethodSAS},
 		RelatesTo:  &event.RelatesTo{Type: event.RelReference, EventID: id.EventID(transactionID)},
 	}
 
-	encrypted, err := mach.EncryptMegolmEvent(roomID, event.InRoomVerificationReady, content)
-	if err != nil {
-		return err
-	}
-	_, err = mach.Client.SendMessageEvent(roomID, event.EventEncrypted, encrypted)
+	_, err := mach.sendInRoomVerificationEvent(roomID, userID, event.InRoomVerificationReady, content)
 	return err
 }
 
@@ -141,11 +161,7 @@ func (mach *OlmMachine) SendInRoomSASVerificationStart(roomID id.RoomID, toUserI
 		To:                         toUserID,
 	}
 
-	encrypted, err := mach.EncryptMegolmEvent(roomID, event.InRoomVerificationStart, content)
-	if err != nil {
-		return nil, err
-	}
-	_, err = mach.Client.SendMessageEvent(roomID, event.EventEncrypted, encrypted)
+	_, err := mach.sendInRoomVerificationEvent(roomID, toUserID, event.InRoomVerificationStart, content)
 	return content, err
 }
 
@@ -182,11 +198,7 @@ func (mach *OlmMachine) SendInRoomSASVerificationAccept(roomID id.RoomID, fromUs
 		To:                        fromUser,
 	}
 
-	encrypted, err := mach.EncryptMegolmEvent(roomID, event.InRoomVerificationAccept, content)
-	if err != nil {
-		return err
-	}
-	_, err = mach.Client.SendMessageEvent(roomID, event.EventEncrypted, encrypted)
+	_, err = mach.sendInRoomVerificationEvent(roomID, fromUser, event.InRoomVerificationAccept, content)
 	return err
 }
 
@@ -198,11 +210,7 @@ func (mach *OlmMachine) SendInRoomSASVerificationKey(roomID id.RoomID, userID id
 		To:        userID,
 	}
 
-	encrypted, err := mach.EncryptMegolmEvent(roomID, event.InRoomVerificationKey, content)
-	if err != nil {
-		return err
-	}
-	_, err = mach.Client.SendMessageEvent(roomID, event.EventEncrypted, encrypted)
+	_, err := mach.sendInRoomVerificationEvent(roomID, userID, event.InRoomVerificationKey, content)
 	return err
 }
 
@@ -210,12 +218,11 @@ func (mach *OlmMachine) SendInRoomSASVerificationKey(roomID id.RoomID, userID id
 func (mach *OlmMachine) SendInRoomSASVerificationMAC(roomID id.RoomID, userID id.UserID, deviceID id.DeviceID, transactionID string, sas *olm.SAS) error {
 	keyID := id.NewKeyID(id.KeyAlgorithmEd25519, mach.Client.DeviceID.String())
 
-	signingKey := mach.account.SigningKey()
+	signingKey := mach.getAccount().SigningKey()
 	keyIDsMap := map[id.KeyID]string{keyID: ""}
 	macMap := make(map[id.KeyID]string)
 
-	if mach.CrossSigningKeys != nil {
-		masterKey := mach.CrossSigningKeys.MasterKey.PublicKey
+	if masterKey, err := mach.KeyProvider.PublicKey(KeyUsageMaster); err == nil {
 		masterKeyID := id.NewKeyID(id.KeyAlgorithmEd25519, masterKey.String())
 		// add master key ID to key map
 		keyIDsMap[masterKeyID] = ""
@@ -244,69 +251,100 @@ func (mach *OlmMachine) SendInRoomSASVerificationMAC(roomID id.RoomID, userID id
 		To:        userID,
 	}
 
-	encrypted, err := mach.EncryptMegolmEvent(roomID, event.InRoomVerificationMAC, content)
-	if err != nil {
-		return err
+	_, err = mach.sendInRoomVerificationEvent(roomID, userID, event.InRoomVerificationMAC, content)
+	return err
+}
+
+// SendInRoomSASVerificationDone sends the in-room message that tells the other user that the verification is finished.
+func (mach *OlmMachine) SendInRoomSASVerificationDone(roomID id.RoomID, userID id.UserID, transactionID string) error {
+	content := &event.VerificationDoneEventContent{
+		RelatesTo: &event.RelatesTo{Type: event.RelReference, EventID: id.EventID(transactionID)},
 	}
-	_, err = mach.Client.SendMessageEvent(roomID, event.EventEncrypted, encrypted)
+
+	_, err := mach.sendInRoomVerificationEvent(roomID, userID, event.InRoomVerificationDone, content)
 	return err
 }
 
 // NewInRoomSASVerificationWith starts the in-room SAS verification process with another user in the given room.
 // It returns the generated transaction ID.
+//
+// The other user's device that accepts the request will be verified. Use NewDMSASVerificationWith to send the
+// request in a DM with the user instead of an existing room.
 func (mach *OlmMachine) NewInRoomSASVerificationWith(inRoomID id.RoomID, userID id.UserID, hooks VerificationHooks, timeout time.Duration) (string, error) {
-	return mach.newInRoomSASVerificationWithInner(inRoomID, &DeviceIdentity{UserID: userID}, hooks, "", timeout)
-}
-
-func (mach *OlmMachine) newInRoomSASVerificationWithInner(inRoomID id.RoomID, device *DeviceIdentity, hooks VerificationHooks, transactionID string, timeout time.Duration) (string, error) {
-	mach.Log.Debug("Starting new in-room verification transaction user %v", device.UserID)
-
-	request := transactionID == ""
-	if request {
-		var err error
-		// get new transaction ID from the request message event ID
-		transactionID, err = mach.SendInRoomSASVerificationRequest(inRoomID, device.UserID, hooks.VerificationMethods())
-		if err != nil {
-			return "", err
-		}
+	mach.Log.Debug("Starting new in-room verification transaction with user %v in %v", userID, inRoomID)
+	// get new transaction ID from the request message event ID
+	transactionID, err := mach.SendInRoomSASVerificationRequest(inRoomID, userID, hooks.VerificationMethods())
+	if err != nil {
+		return "", err
 	}
 	verState := &verificationState{
-		sas:                 olm.NewSAS(),
-		otherDevice:         device,
-		initiatedByUs:       true,
-		verificationStarted: false,
-		keyReceived:         false,
-		sasMatched:          make(chan bool, 1),
-		hooks:               hooks,
-		inRoomID:            inRoomID,
+		sas: olm.NewSAS(),
+		// The device is only known after it accepts the request.
+		otherDevice:   &DeviceIdentity{UserID: userID},
+		requestedByUs: true,
+		sasMatched:    make(chan bool, 1),
+		hooks:         hooks,
+		inRoomID:      inRoomID,
 	}
 	verState.lock.Lock()
 	defer verState.lock.Unlock()
 
-	if !request {
-		// start in-room verification
-		startEvent, err := mach.SendInRoomSASVerificationStart(inRoomID, device.UserID, transactionID, hooks.VerificationMethods())
-		if err != nil {
-			return "", err
-		}
+	mach.keyVerificationTransactionState.Store(userID.String()+":"+transactionID, verState)
 
-		payload, err := json.Marshal(startEvent)
-		if err != nil {
-			return "", err
-		}
-		canonical, err := canonicaljson.CanonicalJSON(payload)
-		if err != nil {
-			return "", err
-		}
+	mach.timeoutAfter(verState, transactionID, timeout)
 
-		verState.startEventCanonical = string(canonical)
-	}
+	return transactionID, nil
+}
 
-	mach.keyVerificationTransactionState.Store(device.UserID.String()+":"+transactionID, verState)
+// acceptInRoomVerificationRequest replies to an in-room verification request with m.key.verification.ready and
+// stores the transaction state. If it's up to us to start the verification, the start message is sent too.
+func (mach *OlmMachine) acceptInRoomVerificationRequest(inRoomID id.RoomID, otherDevice *DeviceIdentity, hooks VerificationHooks, transactionID string, timeout time.Duration) error {
+	verState := &verificationState{
+		sas:         olm.NewSAS(),
+		otherDevice: otherDevice,
+		sasMatched:  make(chan bool, 1),
+		hooks:       hooks,
+		inRoomID:    inRoomID,
+	}
+	verState.lock.Lock()
+	defer verState.lock.Unlock()
 
+	mapKey := otherDevice.UserID.String() + ":" + transactionID
+	_, loaded := mach.keyVerificationTransactionState.LoadOrStore(mapKey, verState)
+	if loaded {
+		return ErrTransactionAlreadyExists
+	}
+	err := mach.sendInRoomVerificationReady(inRoomID, otherDevice.UserID, transactionID)
+	if err != nil {
+		mach.keyVerificationTransactionState.Delete(mapKey)
+		return err
+	}
 	mach.timeoutAfter(verState, transactionID, timeout)
+	if mach.Client.UserID < otherDevice.UserID {
+		// up to us to send the start message
+		return mach.sendInRoomVerificationStart(verState, transactionID)
+	}
+	return nil
+}
 
-	return transactionID, nil
+// sendInRoomVerificationStart sends the in-room SAS start message for a request that has been accepted.
+// The verification state must be locked.
+func (mach *OlmMachine) sendInRoomVerificationStart(verState *verificationState, transactionID string) error {
+	startEvent, err := mach.SendInRoomSASVerificationStart(verState.inRoomID, verState.otherDevice.UserID, transactionID, verState.hooks.VerificationMethods())
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(startEvent)
+	if err != nil {
+		return err
+	}
+	canonical, err := canonicaljson.CanonicalJSON(payload)
+	if err != nil {
+		return err
+	}
+	verState.startEventCanonical = string(canonical)
+	verState.initiatedByUs = true
+	return nil
 }
 
 func (mach *OlmMachine) handleInRoomVerificationReady(userID id.UserID, roomID id.RoomID, content *event.VerificationReadyEventContent, transactionID string) {
@@ -321,12 +359,86 @@ func (mach *OlmMachine) handleInRoomVerificationReady(userID id.UserID, roomID i
 		mach.Log.Error("Error getting transaction state: %v", err)
 		return
 	}
-	//mach.keyVerificationTransactionState.Delete(userID.String() + ":" + transactionID)
+	verState.lock.Lock()
+	defer verState.lock.Unlock()
+
+	if !verState.requestedByUs || verState.otherDevice.DeviceID != "" || verState.inRoomID != roomID {
+		mach.Log.Warn("Unexpected in-room verification ready message for transaction %v", transactionID)
+		mach.keyVerificationTransactionState.Delete(userID.String() + ":" + transactionID)
+		_ = mach.callbackAndCancelSASVerification(verState, transactionID, "Unexpected ready message", event.VerificationCancelUnexpectedMessage)
+		return
+	}
+	verState.extendTimeout()
+	verState.otherDevice = device
 
 	if mach.Client.UserID < userID {
 		// up to us to send the start message
-		verState.lock.Lock()
-		mach.newInRoomSASVerificationWithInner(roomID, device, verState.hooks, transactionID, 10*time.Minute)
-		verState.lock.Unlock()
+		err = mach.sendInRoomVerificationStart(verState, transactionID)
+		if err != nil {
+			mach.Log.Error("Error sending in-room SAS verification start: %v", err)
+		}
+	}
+}
+
+// GetOrCreateVerificationDM returns an encrypted DM room with the given user that can be used for in-room
+// verification. Existing DMs are found using the m.direct account data. If there are no joined encrypted DMs with
+// the user, a new one is created, the user is invited and the room is added to m.direct.
+func (mach *OlmMachine) GetOrCreateVerificationDM(userID id.UserID) (id.RoomID, error) {
+	var directChats event.DirectChatsEventContent
+	err := mach.Client.GetAccountData(event.AccountDataDirectChats.Type, &directChats)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return "", fmt.Errorf("failed to get m.direct account data: %w", err)
+	}
+	if len(directChats[userID]) > 0 {
+		joinedRooms, err := mach.Client.JoinedRooms()
+		if err != nil {
+			return "", fmt.Errorf("failed to get joined rooms: %w", err)
+		}
+		joined := make(map[id.RoomID]bool, len(joinedRooms.JoinedRooms))
+		for _, roomID := range joinedRooms.JoinedRooms {
+			joined[roomID] = true
+		}
+		for _, roomID := range directChats[userID] {
+			if joined[roomID] && mach.StateStore.IsEncrypted(roomID) {
+				return roomID, nil
+			}
+		}
+	}
+
+	stateKey := ""
+	resp, err := mach.Client.CreateRoom(&mautrix.ReqCreateRoom{
+		Preset:   "trusted_private_chat",
+		IsDirect: true,
+		Invite:   []id.UserID{userID},
+		InitialState: []*event.Event{{
+			Type:     event.StateEncryption,
+			StateKey: &stateKey,
+			Content:  event.Content{Parsed: &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1}},
+		}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create DM: %w", err)
+	}
+	mach.Log.Debug("Created DM %v with %v for verification", resp.RoomID, userID)
+	if directChats == nil {
+		directChats = make(event.DirectChatsEventContent)
+	}
+	directChats[userID] = append(directChats[userID], resp.RoomID)
+	err = mach.Client.SetAccountData(event.AccountDataDirectChats.Type, directChats)
+	if err != nil {
+		mach.Log.Warn("Failed to add DM %v to m.direct: %v", resp.RoomID, err)
+	}
+	return resp.RoomID, nil
+}
+
+// NewDMSASVerificationWith starts the in-room SAS verification process with another user in an encrypted DM,
+// which is created if there isn't one already (see GetOrCreateVerificationDM).
+// It returns the ID of the room and the generated transaction ID.
+func (mach *OlmMachine) NewDMSASVerificationWith(userID id.UserID, hooks VerificationHooks, timeout time.Duration) (id.RoomID, string, error) {
+	roomID, err := mach.GetOrCreateVerificationDM(userID)
+	if err != nil {
+		return "", "", err
 	}
+	transactionID, err := mach.NewInRoomSASVerificationWith(roomID, userID, hooks, timeout)
+	return roomID, transactionID, err
 }
@@ -0,0 +1,75 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !nosas
+// +build !nosas
+
+package crypto
+
+import (
+	"maunium.net/go/mautrix/id"
+)
+
+// VerificationRequestHandler is called when a verification request or start message is received from another
+// device without an existing transaction. The room ID is empty for to-device verification.
+type VerificationRequestHandler func(transactionID string, device *DeviceIdentity, roomID id.RoomID) (VerificationRequestResponse, VerificationHooks)
+
+// VerificationRejectAll is a VerificationRequestHandler that rejects all verification requests.
+// The other device is notified immediately, so the request doesn't have to time out.
+func VerificationRejectAll(string, *DeviceIdentity, id.RoomID) (VerificationRequestResponse, VerificationHooks) {
+	return RejectRequest, nil
+}
+
+// VerificationPolicy is a declarative policy for incoming verification requests. All requests that aren't
+// explicitly accepted by the policy are rejected (or ignored, if IgnoreRejected is set).
+//
+// For example, a bot that should accept verification from its owner's other logged-in devices could use
+//
+//	mach.AcceptVerificationFrom = crypto.VerificationPolicy{Hooks: hooks, AcceptOwnTrustedDevices: true}.Handler(mach)
+type VerificationPolicy struct {
+	// Hooks are used for the requests that are accepted. If nil, all requests are rejected.
+	Hooks VerificationHooks
+	// AcceptOwnTrustedDevices accepts requests from our own devices that are verified or cross-signed.
+	AcceptOwnTrustedDevices bool
+	// AcceptOwnDevices accepts requests from all of our own devices, including untrusted ones.
+	AcceptOwnDevices bool
+	// AcceptOtherUsers accepts requests from devices of other users.
+	AcceptOtherUsers bool
+	// AcceptDevices accepts requests from specific devices regardless of the other options.
+	AcceptDevices map[id.UserID][]id.DeviceID
+	// IgnoreRejected makes requests that aren't accepted be ignored silently instead of being canceled.
+	IgnoreRejected bool
+}
+
+func (policy VerificationPolicy) accepts(mach *OlmMachine, device *DeviceIdentity) bool {
+	for _, deviceID := range policy.AcceptDevices[device.UserID] {
+		if deviceID == device.DeviceID {
+			return true
+		}
+	}
+	if device.Trust == TrustStateBlacklisted {
+		return false
+	} else if device.UserID != mach.Client.UserID {
+		return policy.AcceptOtherUsers
+	}
+	return policy.AcceptOwnDevices || (policy.AcceptOwnTrustedDevices && mach.IsDeviceTrusted(device))
+}
+
+// Handler returns a VerificationRequestHandler that applies the policy. The returned function can be used as
+// OlmMachine.AcceptVerificationFrom.
+func (policy VerificationPolicy) Handler(mach *OlmMachine) VerificationRequestHandler {
+	return func(transactionID string, device *DeviceIdentity, roomID id.RoomID) (VerificationRequestResponse, VerificationHooks) {
+		if policy.Hooks != nil && policy.accepts(mach, device) {
+			mach.Log.Debug("Verification policy accepted request %v from %v of %v", transactionID, device.DeviceID, device.UserID)
+			return AcceptRequest, policy.Hooks
+		} else if policy.IgnoreRejected {
+			mach.Log.Debug("Verification policy ignored request %v from %v of %v", transactionID, device.DeviceID, device.UserID)
+			return IgnoreRequest, nil
+		}
+		mach.Log.Debug("Verification policy rejected request %v from %v of %v", transactionID, device.DeviceID, device.UserID)
+		return RejectRequest, nil
+	}
+}
@@ -0,0 +1,379 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !nosas
+// +build !nosas
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrInvalidQRCode     = errors.New("invalid verification QR code")
+	ErrQRCodeKeyMismatch = errors.New("key in verification QR code doesn't match")
+	ErrUnexpectedQRCode  = errors.New("unexpected verification QR code")
+)
+
+// QRCodeMode is the mode byte of a verification QR code, which determines what the two keys in the code are.
+type QRCodeMode byte
+
+const (
+	// QRCodeModeCrossSigning is used when verifying another user. The first key is the master key of the user
+	// showing the code and the second key is what they think the master key of the scanning user is.
+	QRCodeModeCrossSigning QRCodeMode = 0x00
+	// QRCodeModeSelfVerifyingMasterKeyTrusted is used when verifying an own device and the device showing the code
+	// trusts the master key. The first key is the master key and the second key is what the device showing the code
+	// thinks the device key of the scanning device is.
+	QRCodeModeSelfVerifyingMasterKeyTrusted QRCodeMode = 0x01
+	// QRCodeModeSelfVerifyingMasterKeyUntrusted is used when verifying an own device and the device showing the code
+	// doesn't trust the master key. The first key is the device key of the device showing the code and the second
+	// key is what it thinks the master key is.
+	QRCodeModeSelfVerifyingMasterKeyUntrusted QRCodeMode = 0x02
+)
+
+const (
+	qrCodeVersion         = 0x02
+	qrCodeKeyLength       = 32
+	qrCodeSecretLength    = 16
+	qrCodeMinSecretLength = 8
+)
+
+var qrCodePrefix = []byte("MATRIX")
+
+// QRCode is the content of a verification QR code.
+// https://spec.matrix.org/v1.2/client-server-api/#qr-code-format
+type QRCode struct {
+	Mode          QRCodeMode
+	TransactionID string
+	FirstKey      id.Ed25519
+	SecondKey     id.Ed25519
+	SharedSecret  []byte
+}
+
+// Bytes returns the binary payload that should be encoded into the QR code.
+func (qr *QRCode) Bytes() ([]byte, error) {
+	firstKey, err := base64.RawStdEncoding.DecodeString(qr.FirstKey.String())
+	if err != nil || len(firstKey) != qrCodeKeyLength {
+		return nil, fmt.Errorf("%w: invalid first key", ErrInvalidQRCode)
+	}
+	secondKey, err := base64.RawStdEncoding.DecodeString(qr.SecondKey.String())
+	if err != nil || len(secondKey) != qrCodeKeyLength {
+		return nil, fmt.Errorf("%w: invalid second key", ErrInvalidQRCode)
+	} else if len(qr.TransactionID) > 0xffff {
+		return nil, fmt.Errorf("%w: transaction ID too long", ErrInvalidQRCode)
+	} else if len(qr.SharedSecret) < qrCodeMinSecretLength {
+		return nil, fmt.Errorf("%w: shared secret too short", ErrInvalidQRCode)
+	}
+	var buf bytes.Buffer
+	buf.Write(qrCodePrefix)
+	buf.WriteByte(qrCodeVersion)
+	buf.WriteByte(byte(qr.Mode))
+	buf.Write([]byte{byte(len(qr.TransactionID) >> 8), byte(len(qr.TransactionID))})
+	buf.WriteString(qr.TransactionID)
+	buf.Write(firstKey)
+	buf.Write(secondKey)
+	buf.Write(qr.SharedSecret)
+	return buf.Bytes(), nil
+}
+
+// ParseQRCode parses the binary payload of a scanned verification QR code.
+func ParseQRCode(data []byte) (*QRCode, error) {
+	headerLength := len(qrCodePrefix) + 4
+	if len(data) < headerLength || !bytes.Equal(data[:len(qrCodePrefix)], qrCodePrefix) {
+		return nil, fmt.Errorf("%w: missing header", ErrInvalidQRCode)
+	} else if data[len(qrCodePrefix)] != qrCodeVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidQRCode, data[len(qrCodePrefix)])
+	}
+	mode := QRCodeMode(data[len(qrCodePrefix)+1])
+	if mode > QRCodeModeSelfVerifyingMasterKeyUntrusted {
+		return nil, fmt.Errorf("%w: unknown mode %d", ErrInvalidQRCode, mode)
+	}
+	txnIDLength := int(data[len(qrCodePrefix)+2])<<8 | int(data[len(qrCodePrefix)+3])
+	data = data[headerLength:]
+	if len(data) < txnIDLength+2*qrCodeKeyLength+qrCodeMinSecretLength {
+		return nil, fmt.Errorf("%w: payload too short", ErrInvalidQRCode)
+	}
+	keys := data[txnIDLength:]
+	return &QRCode{
+		Mode:          mode,
+		TransactionID: string(data[:txnIDLength]),
+		FirstKey:      id.Ed25519(base64.RawStdEncoding.EncodeToString(keys[:qrCodeKeyLength])),
+		SecondKey:     id.Ed25519(base64.RawStdEncoding.EncodeToString(keys[qrCodeKeyLength : 2*qrCodeKeyLength])),
+		SharedSecret:  keys[2*qrCodeKeyLength:],
+	}, nil
+}
+
+// QRCodeVerificationHooks can be implemented in addition to VerificationHooks to support QR code verification.
+// If the hooks passed to NewSASVerificationRequest or returned from AcceptVerificationFrom implement this
+// interface, QR code verification is advertised to the other device in addition to SAS.
+type QRCodeVerificationHooks interface {
+	VerificationHooks
+	// ShowQRCode is called when the other device has accepted our verification request and is able to scan QR codes.
+	// The payload from QRCode.Bytes() should be shown as a QR code until OnSuccess or OnCancel is called.
+	ShowQRCode(otherDevice *DeviceIdentity, qrCode *QRCode)
+	// QRCodeScanned is called when the other device says it has scanned our QR code. It should ask the user to
+	// confirm that the other device actually scanned the code successfully.
+	QRCodeScanned(otherDevice *DeviceIdentity) bool
+}
+
+// GenerateVerificationQRCode generates a QR code for an existing verification transaction with another device,
+// e.g. one started with NewSASVerificationRequest or accepted through AcceptVerificationFrom. The mode of the
+// QR code is chosen based on whether the other device belongs to our own user and whether we trust our master key.
+func (mach *OlmMachine) GenerateVerificationQRCode(userID id.UserID, transactionID string) (*QRCode, error) {
+	verStateInterface, ok := mach.keyVerificationTransactionState.Load(userID.String() + ":" + transactionID)
+	if !ok {
+		return nil, ErrUnknownTransaction
+	}
+	verState := verStateInterface.(*verificationState)
+	verState.lock.Lock()
+	defer verState.lock.Unlock()
+	return mach.newVerificationQRCode(verState, transactionID)
+}
+
+func (mach *OlmMachine) trustsOwnMasterKey() bool {
+	if _, err := mach.KeyProvider.PublicKey(KeyUsageMaster); err == nil {
+		return true
+	}
+	return mach.isDeviceCrossSigned(mach.OwnIdentity())
+}
+
+func (mach *OlmMachine) newVerificationQRCode(verState *verificationState, transactionID string) (*QRCode, error) {
+	device := verState.otherDevice
+	if device.DeviceID == "*" {
+		return nil, fmt.Errorf("%w: no device has accepted the request yet", ErrUnexpectedQRCode)
+	} else if verState.verificationStarted {
+		return nil, fmt.Errorf("%w: verification already started", ErrUnexpectedQRCode)
+	}
+	ownKeys := mach.GetOwnCrossSigningPublicKeys()
+	if ownKeys == nil {
+		return nil, ErrCrossSigningMasterKeyNotFound
+	}
+	qrCode := &QRCode{
+		TransactionID: transactionID,
+		SharedSecret:  make([]byte, qrCodeSecretLength),
+	}
+	_, err := utils.ReadRandom(qrCode.SharedSecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate shared secret: %w", err)
+	}
+	if device.UserID != mach.Client.UserID {
+		theirKeys, err := mach.GetCrossSigningPublicKeys(device.UserID)
+		if err != nil {
+			return nil, err
+		} else if theirKeys == nil {
+			return nil, ErrCrossSigningMasterKeyNotFound
+		}
+		qrCode.Mode = QRCodeModeCrossSigning
+		qrCode.FirstKey = ownKeys.MasterKey
+		qrCode.SecondKey = theirKeys.MasterKey
+	} else if mach.trustsOwnMasterKey() {
+		qrCode.Mode = QRCodeModeSelfVerifyingMasterKeyTrusted
+		qrCode.FirstKey = ownKeys.MasterKey
+		qrCode.SecondKey = device.SigningKey
+	} else {
+		qrCode.Mode = QRCodeModeSelfVerifyingMasterKeyUntrusted
+		qrCode.FirstKey = mach.getAccount().SigningKey()
+		qrCode.SecondKey = ownKeys.MasterKey
+	}
+	verState.qrCode = qrCode
+	return qrCode, nil
+}
+
+// HandleScannedVerificationQRCode validates a QR code that was shown by another device of the given user in an
+// ongoing verification transaction. If the keys in the code match the keys we know, the other device is marked as
+// verified and the other device is notified with a m.reciprocate.v1 start message. If the keys don't match, the
+// verification is canceled and ErrQRCodeKeyMismatch is returned.
+func (mach *OlmMachine) HandleScannedVerificationQRCode(userID id.UserID, data []byte) error {
+	qrCode, err := ParseQRCode(data)
+	if err != nil {
+		return err
+	}
+	mapKey := userID.String() + ":" + qrCode.TransactionID
+	verStateInterface, ok := mach.keyVerificationTransactionState.Load(mapKey)
+	if !ok {
+		return ErrUnknownTransaction
+	}
+	verState := verStateInterface.(*verificationState)
+	verState.lock.Lock()
+	defer verState.lock.Unlock()
+
+	if verState.otherDevice.DeviceID == "*" {
+		return fmt.Errorf("%w: no device has accepted the request yet", ErrUnexpectedQRCode)
+	} else if verState.verificationStarted {
+		return fmt.Errorf("%w: verification already started", ErrUnexpectedQRCode)
+	}
+	verState.extendTimeout()
+
+	masterKey, err := mach.validateScannedQRCode(verState.otherDevice, qrCode)
+	if err != nil {
+		mach.Log.Warn("Canceling verification transaction %v due to invalid QR code: %v", qrCode.TransactionID, err)
+		mach.keyVerificationTransactionState.Delete(mapKey)
+		_ = mach.callbackAndCancelSASVerification(verState, qrCode.TransactionID, "QR code keys don't match", event.VerificationCancelKeyMismatch)
+		return err
+	}
+	verState.verificationStarted = true
+
+	err = mach.sendReciprocateStart(verState, qrCode.TransactionID, qrCode.SharedSecret)
+	if err != nil {
+		return fmt.Errorf("failed to send reciprocate start: %w", err)
+	}
+	mach.finishQRVerification(verState, qrCode.TransactionID, masterKey)
+	return nil
+}
+
+// validateScannedQRCode checks the keys in a scanned QR code against the keys we know. If the code is for verifying
+// another user, their master key is returned so that it can be signed.
+func (mach *OlmMachine) validateScannedQRCode(device *DeviceIdentity, qrCode *QRCode) (id.Ed25519, error) {
+	ownKeys := mach.GetOwnCrossSigningPublicKeys()
+	if ownKeys == nil {
+		return "", ErrCrossSigningMasterKeyNotFound
+	}
+	if (qrCode.Mode == QRCodeModeCrossSigning) != (device.UserID != mach.Client.UserID) {
+		return "", fmt.Errorf("%w: mode %d can't be used to verify %s", ErrInvalidQRCode, qrCode.Mode, device.UserID)
+	}
+	switch qrCode.Mode {
+	case QRCodeModeCrossSigning:
+		theirKeys, err := mach.GetCrossSigningPublicKeys(device.UserID)
+		if err != nil {
+			return "", err
+		} else if theirKeys == nil {
+			return "", ErrCrossSigningMasterKeyNotFound
+		} else if qrCode.FirstKey != theirKeys.MasterKey {
+			return "", fmt.Errorf("%w: master key of %s", ErrQRCodeKeyMismatch, device.UserID)
+		} else if qrCode.SecondKey != ownKeys.MasterKey {
+			return "", fmt.Errorf("%w: our master key", ErrQRCodeKeyMismatch)
+		}
+		return theirKeys.MasterKey, nil
+	case QRCodeModeSelfVerifyingMasterKeyTrusted:
+		if qrCode.FirstKey != ownKeys.MasterKey {
+			return "", fmt.Errorf("%w: our master key", ErrQRCodeKeyMismatch)
+		} else if qrCode.SecondKey != mach.getAccount().SigningKey() {
+			return "", fmt.Errorf("%w: our device key", ErrQRCodeKeyMismatch)
+		}
+	case QRCodeModeSelfVerifyingMasterKeyUntrusted:
+		if qrCode.FirstKey != device.SigningKey {
+			return "", fmt.Errorf("%w: device key of %s", ErrQRCodeKeyMismatch, device.DeviceID)
+		} else if qrCode.SecondKey != ownKeys.MasterKey {
+			return "", fmt.Errorf("%w: our master key", ErrQRCodeKeyMismatch)
+		}
+	}
+	return "", nil
+}
+
+func (mach *OlmMachine) sendReciprocateStart(verState *verificationState, transactionID string, secret []byte) error {
+	content := &event.VerificationStartEventContent{
+		FromDevice: mach.Client.DeviceID,
+		Method:     event.VerificationMethodReciprocate,
+		Secret:     base64.RawStdEncoding.EncodeToString(secret),
+	}
+	if verState.inRoomID == "" {
+		content.TransactionID = transactionID
+		return mach.sendToOneDevice(verState.otherDevice.UserID, verState.otherDevice.DeviceID, event.ToDeviceVerificationStart, content)
+	}
+	content.RelatesTo = &event.RelatesTo{Type: event.RelReference, EventID: id.EventID(transactionID)}
+	content.To = verState.otherDevice.UserID
+	encrypted, err := mach.EncryptMegolmEvent(verState.inRoomID, event.InRoomVerificationStart, content)
+	if err != nil {
+		return err
+	}
+	_, err = mach.Client.SendMessageEvent(verState.inRoomID, event.EventEncrypted, encrypted)
+	return err
+}
+
+// handleReciprocateStart handles an incoming m.key.verification.start message with the m.reciprocate.v1 method,
+// which means the other device scanned the QR code we showed.
+func (mach *OlmMachine) handleReciprocateStart(userID id.UserID, content *event.VerificationStartEventContent, otherDevice *DeviceIdentity, transactionID string) {
+	verState, err := mach.getTransactionState(transactionID, userID)
+	if err != nil {
+		mach.Log.Error("Error getting transaction state: %v", err)
+		return
+	}
+	verState.lock.Lock()
+	defer verState.lock.Unlock()
+	mapKey := userID.String() + ":" + transactionID
+
+	qrHooks, ok := verState.hooks.(QRCodeVerificationHooks)
+	if !ok || verState.qrCode == nil || verState.verificationStarted || verState.otherDevice.DeviceID != otherDevice.DeviceID {
+		mach.Log.Warn("Unexpected reciprocate start message for transaction %v", transactionID)
+		mach.keyVerificationTransactionState.Delete(mapKey)
+		_ = mach.callbackAndCancelSASVerification(verState, transactionID, "Unexpected start message", event.VerificationCancelUnexpectedMessage)
+		return
+	}
+	verState.extendTimeout()
+
+	secret, err := base64.RawStdEncoding.DecodeString(content.Secret)
+	if err != nil || subtle.ConstantTimeCompare(secret, verState.qrCode.SharedSecret) != 1 {
+		mach.Log.Warn("Canceling verification transaction %v due to mismatching QR code secret", transactionID)
+		mach.keyVerificationTransactionState.Delete(mapKey)
+		_ = mach.callbackAndCancelSASVerification(verState, transactionID, "QR code secret mismatch", event.VerificationCancelKeyMismatch)
+		return
+	}
+	verState.verificationStarted = true
+
+	// ask the user in another goroutine as the confirmation might take a long time to arrive
+	go func() {
+		confirmed := qrHooks.QRCodeScanned(otherDevice)
+		verState.lock.Lock()
+		defer verState.lock.Unlock()
+		if _, ok := mach.keyVerificationTransactionState.Load(mapKey); !ok {
+			// the transaction timed out or was canceled while waiting for the user
+			return
+		} else if !confirmed {
+			mach.keyVerificationTransactionState.Delete(mapKey)
+			_ = mach.callbackAndCancelSASVerification(verState, transactionID, "QR code scan not confirmed", event.VerificationCancelByUser)
+			return
+		}
+		var masterKey id.Ed25519
+		if verState.qrCode.Mode == QRCodeModeCrossSigning {
+			masterKey = verState.qrCode.SecondKey
+		}
+		mach.finishQRVerification(verState, transactionID, masterKey)
+	}()
+}
+
+// finishQRVerification marks the other device of a successful QR code verification as verified, cross-signs it
+// (or the other user's master key) if possible and sends the done message.
+func (mach *OlmMachine) finishQRVerification(verState *verificationState, transactionID string, masterKey id.Ed25519) {
+	device := verState.otherDevice
+	mach.keyVerificationTransactionState.Delete(device.UserID.String() + ":" + transactionID)
+
+	device.Trust = TrustStateVerified
+	err := mach.CryptoStore.PutDevice(device.UserID, device)
+	if err != nil {
+		mach.Log.Warn("Failed to put device after verifying: %v", err)
+	}
+	if device.UserID == mach.Client.UserID {
+		if err = mach.SignOwnDevice(device); err != nil {
+			mach.Log.Debug("Not cross-signing own device %s after QR verification: %v", device.DeviceID, err)
+		}
+	} else if masterKey != "" {
+		if err = mach.SignUser(device.UserID, masterKey); err != nil {
+			mach.Log.Debug("Not cross-signing master key of %s after QR verification: %v", device.UserID, err)
+		}
+	}
+	mach.Log.Debug("Device %v of user %v verified successfully with QR code!", device.DeviceID, device.UserID)
+
+	verState.hooks.OnSuccess()
+
+	if verState.inRoomID == "" {
+		err = mach.SendSASVerificationDone(device.UserID, device.DeviceID, transactionID)
+	} else {
+		err = mach.SendInRoomSASVerificationDone(verState.inRoomID, device.UserID, transactionID)
+	}
+	if err != nil {
+		mach.Log.Warn("Failed to send verification done message for transaction %v: %v", transactionID, err)
+	}
+}
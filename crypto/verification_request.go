@@ -0,0 +1,286 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !nosas
+// +build !nosas
+
+package crypto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/canonicaljson"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ErrNoDevicesToVerify is returned by NewSASVerificationRequest if the user doesn't have any devices to send the request to.
+var ErrNoDevicesToVerify = errors.New("no devices to send verification request to")
+
+const (
+	// Incoming to-device verification requests are ignored if their timestamp is too far in the past or future.
+	verificationRequestMaxAge    = 10 * time.Minute
+	verificationRequestMaxFuture = 5 * time.Minute
+)
+
+// NewSASVerificationRequest sends a m.key.verification.request to the given devices of a user. If no device IDs are
+// given, the request is sent to all devices of the user (except our own device).
+//
+// When one of the devices accepts the request with m.key.verification.ready, the SAS verification is started with
+// that device and the request is canceled on the other devices. The rest of the verification proceeds like with
+// NewSASVerificationWith: the SAS is passed to hooks.VerifySASMatch and hooks.OnSuccess or hooks.OnCancel is called
+// when the verification finishes. The returned transaction ID can be passed to CancelSASVerification.
+func (mach *OlmMachine) NewSASVerificationRequest(userID id.UserID, deviceIDs []id.DeviceID, hooks VerificationHooks, timeout time.Duration) (string, error) {
+	if len(deviceIDs) == 0 {
+		devices, err := mach.WaitForDeviceList(userID)
+		if err != nil {
+			return "", fmt.Errorf("failed to get devices of %s: %w", userID, err)
+		}
+		for deviceID := range devices {
+			if userID != mach.Client.UserID || deviceID != mach.Client.DeviceID {
+				deviceIDs = append(deviceIDs, deviceID)
+			}
+		}
+		if len(deviceIDs) == 0 {
+			return "", ErrNoDevicesToVerify
+		}
+	}
+	transactionID, err := utils.RandomString(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate transaction ID: %w", err)
+	}
+	mach.Log.Debug("Sending verification request %v to devices %v of user %v", transactionID, deviceIDs, userID)
+
+	verState := &verificationState{
+		sas: olm.NewSAS(),
+		// The device is only known after one of the devices accepts the request.
+		otherDevice:      &DeviceIdentity{UserID: userID, DeviceID: "*"},
+		requestedByUs:    true,
+		requestedDevices: deviceIDs,
+		sasMatched:       make(chan bool, 1),
+		hooks:            hooks,
+	}
+	verState.lock.Lock()
+	defer verState.lock.Unlock()
+
+	mapKey := userID.String() + ":" + transactionID
+	_, loaded := mach.keyVerificationTransactionState.LoadOrStore(mapKey, verState)
+	if loaded {
+		return "", ErrTransactionAlreadyExists
+	}
+
+	err = mach.SendSASVerificationRequest(userID, deviceIDs, transactionID, supportedVerificationMethods(hooks)...)
+	if err != nil {
+		mach.keyVerificationTransactionState.Delete(mapKey)
+		return "", err
+	}
+
+	mach.timeoutAfter(verState, transactionID, timeout)
+
+	return transactionID, nil
+}
+
+// acceptVerificationRequest replies to an incoming to-device verification request with m.key.verification.ready
+// and stores the transaction state, so that the start message from the other device can be accepted.
+func (mach *OlmMachine) acceptVerificationRequest(otherDevice *DeviceIdentity, hooks VerificationHooks, transactionID string, timeout time.Duration) error {
+	verState := &verificationState{
+		sas:         olm.NewSAS(),
+		otherDevice: otherDevice,
+		sasMatched:  make(chan bool, 1),
+		hooks:       hooks,
+	}
+	verState.lock.Lock()
+	defer verState.lock.Unlock()
+
+	mapKey := otherDevice.UserID.String() + ":" + transactionID
+	_, loaded := mach.keyVerificationTransactionState.LoadOrStore(mapKey, verState)
+	if loaded {
+		return ErrTransactionAlreadyExists
+	}
+
+	err := mach.SendSASVerificationReady(otherDevice.UserID, otherDevice.DeviceID, transactionID, supportedVerificationMethods(hooks)...)
+	if err != nil {
+		mach.keyVerificationTransactionState.Delete(mapKey)
+		return err
+	}
+
+	mach.timeoutAfter(verState, transactionID, timeout)
+	return nil
+}
+
+// handleVerificationReady handles an incoming to-device m.key.verification.ready message.
+// It starts the SAS verification with the device that accepted our request.
+func (mach *OlmMachine) handleVerificationReady(userID id.UserID, content *event.VerificationReadyEventContent, transactionID string) {
+	mach.Log.Debug("Received verification ready for transaction %v from %v", transactionID, content.FromDevice)
+	verState, err := mach.getTransactionState(transactionID, userID)
+	if err != nil {
+		mach.Log.Error("Error getting transaction state: %v", err)
+		return
+	}
+	otherDevice, err := mach.GetOrFetchDevice(userID, content.FromDevice)
+	if err != nil {
+		mach.Log.Error("Could not find device %v of user %v", content.FromDevice, userID)
+		return
+	}
+	verState.lock.Lock()
+	defer verState.lock.Unlock()
+	verState.extendTimeout()
+
+	if !verState.requestedByUs || verState.initiatedByUs {
+		// another device already accepted the request, or the other device sent the request
+		mach.Log.Warn("Unexpected verification ready message for transaction %v from %v", transactionID, content.FromDevice)
+		_ = mach.SendSASVerificationCancel(userID, content.FromDevice, transactionID, "Unexpected ready message", event.VerificationCancelUnexpectedMessage)
+		return
+	}
+
+	verState.otherDevice = otherDevice
+	for _, deviceID := range verState.requestedDevices {
+		if deviceID == otherDevice.DeviceID {
+			continue
+		}
+		err = mach.SendSASVerificationCancel(userID, deviceID, transactionID, "Verification accepted by another device", event.VerificationCancelAccepted)
+		if err != nil {
+			mach.Log.Warn("Failed to cancel verification request %v on device %v: %v", transactionID, deviceID, err)
+		}
+	}
+
+	if qrHooks, ok := verState.hooks.(QRCodeVerificationHooks); ok &&
+		content.SupportsVerificationMethod(event.VerificationMethodQRCodeScan) &&
+		content.SupportsVerificationMethod(event.VerificationMethodReciprocate) {
+		qrCode, err := mach.newVerificationQRCode(verState, transactionID)
+		if err == nil {
+			go qrHooks.ShowQRCode(otherDevice, qrCode)
+			return
+		}
+		mach.Log.Debug("Not showing QR code for verification %v, falling back to SAS: %v", transactionID, err)
+	}
+
+	if !content.SupportsVerificationMethod(event.VerificationMethodSAS) {
+		mach.Log.Warn("Device %v of user %v doesn't support SAS verification", content.FromDevice, userID)
+		mach.keyVerificationTransactionState.Delete(userID.String() + ":" + transactionID)
+		_ = mach.callbackAndCancelSASVerification(verState, transactionID, "Only SAS method is supported", event.VerificationCancelUnknownMethod)
+		return
+	}
+
+	startEvent, err := mach.SendSASVerificationStart(userID, otherDevice.DeviceID, transactionID, verState.hooks.VerificationMethods())
+	if err != nil {
+		mach.Log.Error("Error sending SAS verification start: %v", err)
+		return
+	}
+	payload, err := json.Marshal(startEvent)
+	if err != nil {
+		mach.Log.Error("Error marshaling SAS verification start: %v", err)
+		return
+	}
+	canonical, err := canonicaljson.CanonicalJSON(payload)
+	if err != nil {
+		mach.Log.Error("Error canonicalizing SAS verification start: %v", err)
+		return
+	}
+	verState.startEventCanonical = string(canonical)
+	verState.initiatedByUs = true
+}
+
+// acceptStartAfterReady accepts a m.key.verification.start for a request that was already accepted with
+// m.key.verification.ready, either by us or by the other device.
+func (mach *OlmMachine) acceptStartAfterReady(verState *verificationState, content *event.VerificationStartEventContent, otherDevice *DeviceIdentity, transactionID string) {
+	verState.lock.Lock()
+	defer verState.lock.Unlock()
+	mapKey := otherDevice.UserID.String() + ":" + transactionID
+
+	if verState.initiatedByUs || verState.verificationStarted || verState.otherDevice.DeviceID != otherDevice.DeviceID {
+		mach.Log.Warn("Unexpected verification start message for transaction %v", transactionID)
+		mach.keyVerificationTransactionState.Delete(mapKey)
+		_ = mach.callbackAndCancelSASVerification(verState, transactionID, "Unexpected start message", event.VerificationCancelUnexpectedMessage)
+		return
+	}
+	verState.extendTimeout()
+
+	sasMethods := commonSASMethods(verState.hooks, content.ShortAuthenticationString)
+	if len(sasMethods) == 0 {
+		mach.Log.Error("No common SAS methods: %v", content.ShortAuthenticationString)
+		mach.keyVerificationTransactionState.Delete(mapKey)
+		_ = mach.callbackAndCancelSASVerification(verState, transactionID, "No common SAS methods", event.VerificationCancelUnknownMethod)
+		return
+	}
+	verState.chosenSASMethod = sasMethods[0]
+	verState.verificationStarted = true
+
+	var err error
+	if verState.inRoomID == "" {
+		err = mach.SendSASVerificationAccept(otherDevice.UserID, content, verState.sas.GetPubkey(), sasMethods)
+	} else {
+		err = mach.SendInRoomSASVerificationAccept(verState.inRoomID, otherDevice.UserID, content, transactionID, verState.sas.GetPubkey(), sasMethods)
+	}
+	if err != nil {
+		mach.Log.Error("Error accepting SAS verification: %v", err)
+	}
+}
+
+// handleVerificationDone handles an incoming m.key.verification.done message.
+func (mach *OlmMachine) handleVerificationDone(userID id.UserID, transactionID string) {
+	// The transaction state is already removed after the MAC is received, so there's nothing else to do here.
+	mach.Log.Debug("Verification %v was marked as done by %v", transactionID, userID)
+}
+
+// supportedVerificationMethods returns the verification methods to advertise in requests and ready messages.
+func supportedVerificationMethods(hooks VerificationHooks) []event.VerificationMethod {
+	methods := []event.VerificationMethod{event.VerificationMethodSAS}
+	if _, ok := hooks.(QRCodeVerificationHooks); ok {
+		methods = append(methods, event.VerificationMethodQRCodeShow, event.VerificationMethodQRCodeScan, event.VerificationMethodReciprocate)
+	}
+	return methods
+}
+
+// SendSASVerificationRequest sends a m.key.verification.request to the given devices of a user.
+// If no methods are given, only SAS verification is advertised.
+func (mach *OlmMachine) SendSASVerificationRequest(userID id.UserID, deviceIDs []id.DeviceID, transactionID string, methods ...event.VerificationMethod) error {
+	if len(methods) == 0 {
+		methods = []event.VerificationMethod{event.VerificationMethodSAS}
+	}
+	content := &event.VerificationRequestEventContent{
+		FromDevice:    mach.Client.DeviceID,
+		TransactionID: transactionID,
+		Methods:       methods,
+		Timestamp:     time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	messages := make(map[id.DeviceID]*event.Content, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		messages[deviceID] = &event.Content{Parsed: content}
+	}
+	_, err := mach.Client.SendToDevice(event.ToDeviceVerificationRequest, &mautrix.ReqSendToDevice{
+		Messages: map[id.UserID]map[id.DeviceID]*event.Content{userID: messages},
+	})
+	return err
+}
+
+// SendSASVerificationReady sends a m.key.verification.ready to accept a verification request from another device.
+// If no methods are given, only SAS verification is advertised.
+func (mach *OlmMachine) SendSASVerificationReady(userID id.UserID, deviceID id.DeviceID, transactionID string, methods ...event.VerificationMethod) error {
+	if len(methods) == 0 {
+		methods = []event.VerificationMethod{event.VerificationMethodSAS}
+	}
+	content := &event.VerificationReadyEventContent{
+		FromDevice:    mach.Client.DeviceID,
+		Methods:       methods,
+		TransactionID: transactionID,
+	}
+	return mach.sendToOneDevice(userID, deviceID, event.ToDeviceVerificationReady, content)
+}
+
+// SendSASVerificationDone sends a m.key.verification.done to tell the other device that the verification is finished.
+func (mach *OlmMachine) SendSASVerificationDone(userID id.UserID, deviceID id.DeviceID, transactionID string) error {
+	content := &event.VerificationDoneEventContent{
+		TransactionID: transactionID,
+	}
+	return mach.sendToOneDevice(userID, deviceID, event.ToDeviceVerificationDone, content)
+}
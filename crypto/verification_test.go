@@ -0,0 +1,512 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !nosas
+// +build !nosas
+
+package crypto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type testVerificationHooks struct {
+	sas     chan SASData
+	success chan struct{}
+	cancel  chan string
+}
+
+func newTestVerificationHooks() *testVerificationHooks {
+	return &testVerificationHooks{
+		sas:     make(chan SASData, 1),
+		success: make(chan struct{}, 1),
+		cancel:  make(chan string, 1),
+	}
+}
+
+func (hooks *testVerificationHooks) VerifySASMatch(_ *DeviceIdentity, sas SASData) bool {
+	hooks.sas <- sas
+	return true
+}
+
+func (hooks *testVerificationHooks) VerificationMethods() []VerificationMethod {
+	return []VerificationMethod{VerificationMethodEmoji{}, VerificationMethodDecimal{}}
+}
+
+func (hooks *testVerificationHooks) OnCancel(_ bool, reason string, _ event.VerificationCancelCode) {
+	hooks.cancel <- reason
+}
+
+func (hooks *testVerificationHooks) OnSuccess() {
+	hooks.success <- struct{}{}
+}
+
+// newToDeviceRelay returns a test server that passes all to-device events and room events sent through it to the
+// target machine. Encrypted room events are decrypted and passed to ProcessInRoomVerification.
+func newToDeviceRelay(t *testing.T, sender id.UserID, target *OlmMachine, sentTypes chan<- string) *httptest.Server {
+	events := make(chan *event.Event, 32)
+	go func() {
+		for evt := range events {
+			if evt.RoomID == "" {
+				target.HandleToDeviceEvent(evt)
+				continue
+			}
+			decrypted, err := target.DecryptMegolmEvent(evt)
+			if err != nil {
+				t.Errorf("Failed to decrypt %s: %v", evt.ID, err)
+				continue
+			}
+			_ = target.ProcessInRoomVerification(decrypted)
+		}
+	}()
+	var eventCount int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.URL.Path, "/")
+		switch {
+		case len(parts) >= 3 && parts[len(parts)-3] == "sendToDevice":
+			evtType := event.Type{Type: parts[len(parts)-2], Class: event.ToDeviceEventType}
+			var req mautrix.ReqSendToDevice
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Errorf("Failed to decode to-device request: %v", err)
+			}
+			sentTypes <- evtType.Type
+			for _, content := range req.Messages[target.Client.UserID] {
+				evt := &event.Event{Sender: sender, Type: evtType, Content: event.Content{VeryRaw: content.VeryRaw}}
+				if err := evt.Content.ParseRaw(evtType); err != nil {
+					t.Errorf("Failed to parse %s content: %v", evtType.Type, err)
+					continue
+				}
+				events <- evt
+			}
+			_, _ = w.Write([]byte("{}"))
+		case len(parts) >= 5 && parts[len(parts)-3] == "send" && parts[len(parts)-5] == "rooms":
+			evt := &event.Event{
+				Sender:    sender,
+				Type:      event.Type{Type: parts[len(parts)-2], Class: event.MessageEventType},
+				RoomID:    id.RoomID(parts[len(parts)-4]),
+				ID:        id.EventID(fmt.Sprintf("$%s-%d", sender, atomic.AddInt32(&eventCount, 1))),
+				Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+			}
+			if err := json.NewDecoder(r.Body).Decode(&evt.Content); err != nil {
+				t.Errorf("Failed to decode room event: %v", err)
+			} else if err = evt.Content.ParseRaw(evt.Type); err != nil {
+				t.Errorf("Failed to parse %s content: %v", evt.Type.Type, err)
+			}
+			events <- evt
+			_ = json.NewEncoder(w).Encode(&mautrix.RespSendEvent{EventID: evt.ID})
+		default:
+			_, _ = w.Write([]byte("{}"))
+		}
+	}))
+}
+
+func TestOlmMachineToDeviceSASVerification(t *testing.T) {
+	machineA, storeFileNameA := newMachine(t, "user1")
+	defer os.Remove(storeFileNameA)
+	machineB, storeFileNameB := newMachine(t, "user2")
+	defer os.Remove(storeFileNameB)
+
+	_ = machineA.CryptoStore.PutDevices("user2", map[id.DeviceID]*DeviceIdentity{
+		"device1": machineB.OwnIdentity(),
+	})
+	_ = machineB.CryptoStore.PutDevices("user1", map[id.DeviceID]*DeviceIdentity{
+		"device1": machineA.OwnIdentity(),
+	})
+
+	sentByA := make(chan string, 32)
+	sentByB := make(chan string, 32)
+	serverA := newToDeviceRelay(t, "user1", machineB, sentByA)
+	defer serverA.Close()
+	serverB := newToDeviceRelay(t, "user2", machineA, sentByB)
+	defer serverB.Close()
+	machineA.Client.HomeserverURL, _ = url.Parse(serverA.URL)
+	machineB.Client.HomeserverURL, _ = url.Parse(serverB.URL)
+
+	hooksA := newTestVerificationHooks()
+	hooksB := newTestVerificationHooks()
+	machineB.AcceptVerificationFrom = func(_ string, device *DeviceIdentity, _ id.RoomID) (VerificationRequestResponse, VerificationHooks) {
+		if device.UserID != "user1" {
+			t.Errorf("Unexpected verification request from %s", device.UserID)
+		}
+		return AcceptRequest, hooksB
+	}
+
+	_, err := machineA.NewSASVerificationRequest("user2", nil, hooksA, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to send verification request: %v", err)
+	}
+
+	var sasA, sasB SASData
+	for sasA == nil || sasB == nil {
+		select {
+		case sasA = <-hooksA.sas:
+		case sasB = <-hooksB.sas:
+		case reason := <-hooksA.cancel:
+			t.Fatalf("Verification canceled on A: %s", reason)
+		case reason := <-hooksB.cancel:
+			t.Fatalf("Verification canceled on B: %s", reason)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for SAS")
+		}
+	}
+	if fmt.Sprint(sasA) != fmt.Sprint(sasB) {
+		t.Errorf("SAS mismatch: %v != %v", sasA, sasB)
+	}
+
+	for _, hooks := range []*testVerificationHooks{hooksA, hooksB} {
+		select {
+		case <-hooks.success:
+		case reason := <-hooks.cancel:
+			t.Fatalf("Verification canceled: %s", reason)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for verification to finish")
+		}
+	}
+
+	for _, check := range []struct {
+		machine *OlmMachine
+		userID  id.UserID
+		sent    chan string
+	}{{machineA, "user2", sentByA}, {machineB, "user1", sentByB}} {
+		device, err := check.machine.CryptoStore.GetDevice(check.userID, "device1")
+		if err != nil {
+			t.Fatalf("Failed to get device: %v", err)
+		} else if device.Trust != TrustStateVerified {
+			t.Errorf("Device of %s wasn't marked as verified", check.userID)
+		}
+		sawDone := false
+		for !sawDone {
+			select {
+			case evtType := <-check.sent:
+				sawDone = evtType == event.ToDeviceVerificationDone.Type
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Verification done wasn't sent to %s", check.userID)
+			}
+		}
+	}
+}
+
+type testQRVerificationHooks struct {
+	*testVerificationHooks
+	qrCode chan *QRCode
+}
+
+func (hooks *testQRVerificationHooks) ShowQRCode(_ *DeviceIdentity, qrCode *QRCode) {
+	hooks.qrCode <- qrCode
+}
+
+func (hooks *testQRVerificationHooks) QRCodeScanned(*DeviceIdentity) bool {
+	return true
+}
+
+func TestQRCodeBytes(t *testing.T) {
+	qrCode := &QRCode{
+		Mode:          QRCodeModeSelfVerifyingMasterKeyUntrusted,
+		TransactionID: "txn",
+		FirstKey:      "ndt3bx6NKsqswIpkU7kCVj9ycYkyYVbZ1rbLAxM4Q7o",
+		SecondKey:     "QHPZz+4UdKn86axXbD4MwI2mFiJHEWDtwzrq8y/cTX0",
+		SharedSecret:  []byte("0123456789abcdef"),
+	}
+	data, err := qrCode.Bytes()
+	if err != nil {
+		t.Fatalf("Failed to encode QR code: %v", err)
+	} else if len(data) != 6+1+1+2+3+32+32+16 {
+		t.Errorf("Unexpected QR code length %d", len(data))
+	}
+	parsed, err := ParseQRCode(data)
+	if err != nil {
+		t.Fatalf("Failed to parse QR code: %v", err)
+	} else if fmt.Sprint(parsed) != fmt.Sprint(qrCode) {
+		t.Errorf("Parsed QR code doesn't match: %+v != %+v", parsed, qrCode)
+	}
+
+	_, err = ParseQRCode(data[:len(data)-10])
+	if !errors.Is(err, ErrInvalidQRCode) {
+		t.Errorf("Expected truncated QR code to be invalid, got %v", err)
+	}
+	data[7] = 0x03
+	_, err = ParseQRCode(data)
+	if !errors.Is(err, ErrInvalidQRCode) {
+		t.Errorf("Expected QR code with unknown mode to be invalid, got %v", err)
+	}
+}
+
+func TestOlmMachineQRCodeVerification(t *testing.T) {
+	machineA, storeFileNameA := newMachine(t, "user1")
+	defer os.Remove(storeFileNameA)
+	machineB, storeFileNameB := newMachine(t, "user2")
+	defer os.Remove(storeFileNameB)
+
+	_ = machineA.CryptoStore.PutDevices("user2", map[id.DeviceID]*DeviceIdentity{
+		"device1": machineB.OwnIdentity(),
+	})
+	_ = machineB.CryptoStore.PutDevices("user1", map[id.DeviceID]*DeviceIdentity{
+		"device1": machineA.OwnIdentity(),
+	})
+	for _, machine := range []*OlmMachine{machineA, machineB} {
+		keys, err := machine.GenerateCrossSigningKeys()
+		if err != nil {
+			t.Fatalf("Failed to generate cross-signing keys: %v", err)
+		}
+		machine.CrossSigningKeys = keys
+	}
+	_ = machineA.CryptoStore.PutCrossSigningKey("user2", id.XSUsageMaster, machineB.CrossSigningKeys.MasterKey.PublicKey)
+	_ = machineB.CryptoStore.PutCrossSigningKey("user1", id.XSUsageMaster, machineA.CrossSigningKeys.MasterKey.PublicKey)
+
+	sentByA := make(chan string, 32)
+	sentByB := make(chan string, 32)
+	serverA := newToDeviceRelay(t, "user1", machineB, sentByA)
+	defer serverA.Close()
+	serverB := newToDeviceRelay(t, "user2", machineA, sentByB)
+	defer serverB.Close()
+	machineA.Client.HomeserverURL, _ = url.Parse(serverA.URL)
+	machineB.Client.HomeserverURL, _ = url.Parse(serverB.URL)
+
+	hooksA := &testQRVerificationHooks{newTestVerificationHooks(), make(chan *QRCode, 1)}
+	hooksB := &testQRVerificationHooks{newTestVerificationHooks(), make(chan *QRCode, 1)}
+	machineB.AcceptVerificationFrom = func(string, *DeviceIdentity, id.RoomID) (VerificationRequestResponse, VerificationHooks) {
+		return AcceptRequest, hooksB
+	}
+
+	_, err := machineA.NewSASVerificationRequest("user2", nil, hooksA, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to send verification request: %v", err)
+	}
+
+	var qrCode *QRCode
+	select {
+	case qrCode = <-hooksA.qrCode:
+	case reason := <-hooksA.cancel:
+		t.Fatalf("Verification canceled on A: %s", reason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for QR code")
+	}
+	if qrCode.Mode != QRCodeModeCrossSigning {
+		t.Errorf("Unexpected QR code mode %d", qrCode.Mode)
+	}
+	data, err := qrCode.Bytes()
+	if err != nil {
+		t.Fatalf("Failed to encode QR code: %v", err)
+	}
+	err = machineB.HandleScannedVerificationQRCode("user1", data)
+	if err != nil {
+		t.Fatalf("Failed to handle scanned QR code: %v", err)
+	}
+
+	for _, hooks := range []*testQRVerificationHooks{hooksA, hooksB} {
+		select {
+		case <-hooks.success:
+		case reason := <-hooks.cancel:
+			t.Fatalf("Verification canceled: %s", reason)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for verification to finish")
+		}
+	}
+	for _, check := range []struct {
+		machine *OlmMachine
+		userID  id.UserID
+	}{{machineA, "user2"}, {machineB, "user1"}} {
+		device, err := check.machine.CryptoStore.GetDevice(check.userID, "device1")
+		if err != nil {
+			t.Fatalf("Failed to get device: %v", err)
+		} else if device.Trust != TrustStateVerified {
+			t.Errorf("Device of %s wasn't marked as verified", check.userID)
+		}
+	}
+}
+
+func establishOlmSession(t *testing.T, from, to *OlmMachine) {
+	to.account.Internal.GenOneTimeKeys(1)
+	var otk id.Curve25519
+	for _, otkTmp := range to.account.Internal.OneTimeKeys() {
+		otk = otkTmp
+	}
+	olmSession, err := from.account.Internal.NewOutboundSession(to.account.IdentityKey(), otk)
+	if err != nil {
+		t.Fatalf("Failed to create outbound olm session: %v", err)
+	}
+	_ = from.CryptoStore.AddSession(to.account.IdentityKey(), wrapSession(olmSession))
+}
+
+func TestOlmMachineInRoomSASVerification(t *testing.T) {
+	machineA, storeFileNameA := newMachine(t, "user1")
+	defer os.Remove(storeFileNameA)
+	machineB, storeFileNameB := newMachine(t, "user2")
+	defer os.Remove(storeFileNameB)
+
+	_ = machineA.CryptoStore.PutDevices("user2", map[id.DeviceID]*DeviceIdentity{
+		"device1": machineB.OwnIdentity(),
+	})
+	_ = machineB.CryptoStore.PutDevices("user1", map[id.DeviceID]*DeviceIdentity{
+		"device1": machineA.OwnIdentity(),
+	})
+	establishOlmSession(t, machineA, machineB)
+	establishOlmSession(t, machineB, machineA)
+
+	sentByA := make(chan string, 32)
+	sentByB := make(chan string, 32)
+	serverA := newToDeviceRelay(t, "user1", machineB, sentByA)
+	defer serverA.Close()
+	serverB := newToDeviceRelay(t, "user2", machineA, sentByB)
+	defer serverB.Close()
+	machineA.Client.HomeserverURL, _ = url.Parse(serverA.URL)
+	machineB.Client.HomeserverURL, _ = url.Parse(serverB.URL)
+
+	hooksA := newTestVerificationHooks()
+	hooksB := newTestVerificationHooks()
+	machineB.AcceptVerificationFrom = func(_ string, device *DeviceIdentity, roomID id.RoomID) (VerificationRequestResponse, VerificationHooks) {
+		if roomID != "room1" {
+			t.Errorf("Unexpected verification request room %s", roomID)
+		}
+		return AcceptRequest, hooksB
+	}
+
+	_, err := machineA.NewInRoomSASVerificationWith("room1", "user2", hooksA, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to send in-room verification request: %v", err)
+	}
+
+	var sasA, sasB SASData
+	for sasA == nil || sasB == nil {
+		select {
+		case sasA = <-hooksA.sas:
+		case sasB = <-hooksB.sas:
+		case reason := <-hooksA.cancel:
+			t.Fatalf("Verification canceled on A: %s", reason)
+		case reason := <-hooksB.cancel:
+			t.Fatalf("Verification canceled on B: %s", reason)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for SAS")
+		}
+	}
+	if fmt.Sprint(sasA) != fmt.Sprint(sasB) {
+		t.Errorf("SAS mismatch: %v != %v", sasA, sasB)
+	}
+	for _, hooks := range []*testVerificationHooks{hooksA, hooksB} {
+		select {
+		case <-hooks.success:
+		case reason := <-hooks.cancel:
+			t.Fatalf("Verification canceled: %s", reason)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for verification to finish")
+		}
+	}
+	for _, check := range []struct {
+		machine *OlmMachine
+		userID  id.UserID
+	}{{machineA, "user2"}, {machineB, "user1"}} {
+		device, err := check.machine.CryptoStore.GetDevice(check.userID, "device1")
+		if err != nil {
+			t.Fatalf("Failed to get device: %v", err)
+		} else if device.Trust != TrustStateVerified {
+			t.Errorf("Device of %s wasn't marked as verified", check.userID)
+		}
+	}
+}
+
+func TestOlmMachineGetOrCreateVerificationDM(t *testing.T) {
+	var created int32
+	var directChats event.DirectChatsEventContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/account_data/m.direct") && r.Method == http.MethodGet:
+			if directChats == nil {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "not found"}`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(directChats)
+		case strings.HasSuffix(r.URL.Path, "/account_data/m.direct"):
+			_ = json.NewDecoder(r.Body).Decode(&directChats)
+			_, _ = w.Write([]byte("{}"))
+		case strings.HasSuffix(r.URL.Path, "/createRoom"):
+			var req mautrix.ReqCreateRoom
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			if !req.IsDirect || len(req.Invite) != 1 || len(req.InitialState) != 1 || req.InitialState[0].Type != event.StateEncryption {
+				t.Errorf("Unexpected create room request: %+v", req)
+			}
+			atomic.AddInt32(&created, 1)
+			_, _ = w.Write([]byte(`{"room_id": "!dm:example.com"}`))
+		case strings.HasSuffix(r.URL.Path, "/joined_rooms"):
+			_, _ = w.Write([]byte(`{"joined_rooms": ["!dm:example.com"]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	machine.Client.HomeserverURL, _ = url.Parse(server.URL)
+
+	for i := 0; i < 2; i++ {
+		roomID, err := machine.GetOrCreateVerificationDM("user2")
+		if err != nil {
+			t.Fatalf("Failed to get verification DM: %v", err)
+		} else if roomID != "!dm:example.com" {
+			t.Errorf("Unexpected DM room ID %s", roomID)
+		}
+	}
+	if created != 1 {
+		t.Errorf("Expected DM to be created once, was created %d times", created)
+	}
+	if rooms := directChats["user2"]; len(rooms) != 1 || rooms[0] != "!dm:example.com" {
+		t.Errorf("DM wasn't added to m.direct: %v", directChats)
+	}
+}
+
+func TestVerificationPolicy(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+
+	ownTrusted := &DeviceIdentity{UserID: "user1", DeviceID: "trusted", Trust: TrustStateVerified}
+	ownUntrusted := &DeviceIdentity{UserID: "user1", DeviceID: "untrusted"}
+	ownBlacklisted := &DeviceIdentity{UserID: "user1", DeviceID: "blacklisted", Trust: TrustStateBlacklisted}
+	otherUser := &DeviceIdentity{UserID: "user2", DeviceID: "device"}
+	allowedDevice := &DeviceIdentity{UserID: "user3", DeviceID: "allowed"}
+	hooks := newTestVerificationHooks()
+
+	for _, testCase := range []struct {
+		name     string
+		policy   VerificationPolicy
+		device   *DeviceIdentity
+		expected VerificationRequestResponse
+	}{
+		{"no hooks", VerificationPolicy{AcceptOwnDevices: true}, ownTrusted, RejectRequest},
+		{"own trusted", VerificationPolicy{Hooks: hooks, AcceptOwnTrustedDevices: true}, ownTrusted, AcceptRequest},
+		{"own untrusted", VerificationPolicy{Hooks: hooks, AcceptOwnTrustedDevices: true}, ownUntrusted, RejectRequest},
+		{"own untrusted allowed", VerificationPolicy{Hooks: hooks, AcceptOwnDevices: true}, ownUntrusted, AcceptRequest},
+		{"own blacklisted", VerificationPolicy{Hooks: hooks, AcceptOwnDevices: true}, ownBlacklisted, RejectRequest},
+		{"other user", VerificationPolicy{Hooks: hooks, AcceptOwnDevices: true}, otherUser, RejectRequest},
+		{"other user allowed", VerificationPolicy{Hooks: hooks, AcceptOtherUsers: true}, otherUser, AcceptRequest},
+		{"ignore rejected", VerificationPolicy{Hooks: hooks, IgnoreRejected: true}, otherUser, IgnoreRequest},
+		{"specific device", VerificationPolicy{
+			Hooks:         hooks,
+			AcceptDevices: map[id.UserID][]id.DeviceID{"user3": {"allowed"}},
+		}, allowedDevice, AcceptRequest},
+	} {
+		resp, respHooks := testCase.policy.Handler(machine)("txn", testCase.device, "")
+		if resp != testCase.expected {
+			t.Errorf("%s: expected response %d, got %d", testCase.name, testCase.expected, resp)
+		} else if resp == AcceptRequest && respHooks == nil {
+			t.Errorf("%s: accepted request without hooks", testCase.name)
+		}
+	}
+}
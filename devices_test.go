@@ -0,0 +1,100 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestClient_RenameDevice(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	require.NoError(t, cli.RenameDevice("DEVICE", "My phone"))
+	req := srv.LastRequest(t)
+	assert.Equal(t, http.MethodPut, req.Method)
+	assert.Equal(t, "/_matrix/client/r0/devices/DEVICE", req.Path)
+	assert.JSONEq(t, `{"display_name": "My phone"}`, req.Body)
+}
+
+func TestClient_ClaimDehydratedDevice(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("POST /_matrix/client/unstable/org.matrix.msc2697.v2/dehydrated_device/claim", `{"success": true}`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	resp, err := cli.ClaimDehydratedDevice("DEHYDRATED")
+	require.NoError(t, err)
+	assert.True(t, resp.Success)
+	assert.JSONEq(t, `{"device_id": "DEHYDRATED"}`, srv.LastRequest(t).Body)
+}
+
+func TestClient_LogoutOtherDevices(t *testing.T) {
+	var lock sync.Mutex
+	var deleteRequests []map[string]json.RawMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /_matrix/client/r0/devices":
+			_, _ = w.Write([]byte(`{"devices": [{"device_id": "CURRENT"}, {"device_id": "OTHER1"}, {"device_id": "OTHER2"}]}`))
+		case "POST /_matrix/client/r0/delete_devices":
+			body, _ := ioutil.ReadAll(r.Body)
+			var req map[string]json.RawMessage
+			_ = json.Unmarshal(body, &req)
+			lock.Lock()
+			deleteRequests = append(deleteRequests, req)
+			lock.Unlock()
+			if _, ok := req["auth"]; !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = w.Write([]byte(`{"session": "xyz", "flows": [{"stages": ["m.login.password"]}], "params": {}}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Not found"}`))
+		}
+	}))
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+	cli.DeviceID = "CURRENT"
+
+	deleted, err := cli.LogoutOtherDevices(&mautrix.UIAHandler{Password: "hunter2"})
+	require.NoError(t, err)
+	assert.Equal(t, []id.DeviceID{"OTHER1", "OTHER2"}, deleted)
+	require.Len(t, deleteRequests, 2)
+	for _, req := range deleteRequests {
+		assert.JSONEq(t, `["OTHER1", "OTHER2"]`, string(req["devices"]))
+	}
+	assert.NotContains(t, deleteRequests[0], "auth")
+	assert.Contains(t, string(deleteRequests[1]["auth"]), `"session":"xyz"`)
+}
+
+func TestClient_LogoutOtherDevices_NoOtherDevices(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("GET /_matrix/client/r0/devices", `{"devices": [{"device_id": "CURRENT"}]}`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+	cli.DeviceID = "CURRENT"
+
+	deleted, err := cli.LogoutOtherDevices(nil)
+	require.NoError(t, err)
+	assert.Empty(t, deleted)
+	// Only the device list is fetched
+	assert.Equal(t, "/_matrix/client/r0/devices", srv.LastRequest(t).Path)
+}
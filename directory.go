@@ -0,0 +1,124 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"net/http"
+	"strconv"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// PublicRooms lists a page of the public room directory. The directory of a remote server can be listed by setting
+// req.Server. Requests without a filter or network options are sent as GET, which doesn't require authentication.
+// See https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3publicrooms
+func (cli *Client) PublicRooms(req *ReqPublicRooms) (resp *RespPublicRooms, err error) {
+	query := map[string]string{}
+	if len(req.Server) > 0 {
+		query["server"] = req.Server
+	}
+	if req.Filter == nil && !req.IncludeAllNetworks && len(req.ThirdPartyInstanceID) == 0 {
+		if req.Limit > 0 {
+			query["limit"] = strconv.Itoa(req.Limit)
+		}
+		if len(req.Since) > 0 {
+			query["since"] = req.Since
+		}
+		_, err = cli.MakeRequest(http.MethodGet, cli.BuildURLWithQuery(URLPath{"publicRooms"}, query), nil, &resp)
+	} else {
+		_, err = cli.MakeRequest(http.MethodPost, cli.BuildURLWithQuery(URLPath{"publicRooms"}, query), req, &resp)
+	}
+	return
+}
+
+// GetRoomDirectoryVisibility gets whether the given room is published in the room directory.
+// See https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3directorylistroomroomid
+func (cli *Client) GetRoomDirectoryVisibility(roomID id.RoomID) (resp *RespRoomDirectoryVisibility, err error) {
+	_, err = cli.MakeRequest(http.MethodGet, cli.BuildURL("directory", "list", "room", roomID), nil, &resp)
+	return
+}
+
+// SetRoomDirectoryVisibility publishes or unpublishes the given room in the room directory.
+// See https://spec.matrix.org/v1.3/client-server-api/#put_matrixclientv3directorylistroomroomid
+func (cli *Client) SetRoomDirectoryVisibility(roomID id.RoomID, visibility RoomDirectoryVisibility) error {
+	urlPath := cli.BuildURL("directory", "list", "room", roomID)
+	_, err := cli.MakeRequest(http.MethodPut, urlPath, &ReqRoomDirectoryVisibility{Visibility: visibility}, nil)
+	return err
+}
+
+// SetAppserviceRoomDirectoryVisibility publishes or unpublishes a room in the directory of the given third-party
+// network. This can only be used by appservices.
+// See https://spec.matrix.org/v1.3/application-service-api/#put_matrixclientv3directorylistappservicenetworkidroomid
+func (cli *Client) SetAppserviceRoomDirectoryVisibility(networkID string, roomID id.RoomID, visibility RoomDirectoryVisibility) error {
+	urlPath := cli.BuildURL("directory", "list", "appservice", networkID, roomID)
+	_, err := cli.MakeRequest(http.MethodPut, urlPath, &ReqRoomDirectoryVisibility{Visibility: visibility}, nil)
+	return err
+}
+
+// PublicRoomsIterator goes through the public room directory one room at a time, fetching new pages as needed.
+//
+//	iter := cli.IteratePublicRooms(ReqPublicRooms{Limit: 50})
+//	for iter.Next() {
+//		fmt.Println(iter.Room().RoomID)
+//	}
+//	if iter.Err() != nil {
+//		...
+//	}
+type PublicRoomsIterator struct {
+	cli  *Client
+	req  ReqPublicRooms
+	page []PublicRoom
+	room *PublicRoom
+	done bool
+	err  error
+
+	// TotalRoomCountEstimate is the estimate of the directory size from the latest page, or zero if the server
+	// didn't provide one.
+	TotalRoomCountEstimate int
+}
+
+// IteratePublicRooms returns an iterator over all the rooms in the directory matching the request.
+// The Limit field of the request is used as the page size, and Since can be used to start from a specific page.
+func (cli *Client) IteratePublicRooms(req ReqPublicRooms) *PublicRoomsIterator {
+	return &PublicRoomsIterator{cli: cli, req: req}
+}
+
+// Next advances the iterator to the next room, fetching the next page if necessary. It returns false when there are
+// no more rooms or fetching a page failed, in which case Err returns the error.
+func (iter *PublicRoomsIterator) Next() bool {
+	for len(iter.page) == 0 {
+		if iter.done || iter.err != nil {
+			iter.room = nil
+			return false
+		}
+		resp, err := iter.cli.PublicRooms(&iter.req)
+		if err != nil {
+			iter.err = err
+			continue
+		}
+		iter.page = resp.Chunk
+		iter.TotalRoomCountEstimate = resp.TotalRoomCountEstimate
+		// Stop if there's no next page, or the server returned the same token again to avoid looping forever
+		if len(resp.NextBatch) == 0 || resp.NextBatch == iter.req.Since {
+			iter.done = true
+		}
+		iter.req.Since = resp.NextBatch
+	}
+	iter.room = &iter.page[0]
+	iter.page = iter.page[1:]
+	return true
+}
+
+// Room returns the current room. It must only be called after Next returned true.
+func (iter *PublicRoomsIterator) Room() *PublicRoom {
+	return iter.room
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (iter *PublicRoomsIterator) Err() error {
+	return iter.err
+}
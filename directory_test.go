@@ -0,0 +1,152 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestClient_PublicRooms(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("GET /_matrix/client/r0/publicRooms", `{"chunk": [{"room_id": "!room:example.com", "num_joined_members": 5, "world_readable": true, "guest_can_join": false}], "next_batch": "next"}`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	resp, err := cli.PublicRooms(&mautrix.ReqPublicRooms{Limit: 10, Since: "prev"})
+	require.NoError(t, err)
+	require.Len(t, resp.Chunk, 1)
+	assert.Equal(t, id.RoomID("!room:example.com"), resp.Chunk[0].RoomID)
+	assert.Equal(t, "next", resp.NextBatch)
+	req := srv.LastRequest(t)
+	assert.Equal(t, http.MethodGet, req.Method)
+	assert.Equal(t, "10", req.Query.Get("limit"))
+	assert.Equal(t, "prev", req.Query.Get("since"))
+	assert.NotContains(t, req.Query, "server")
+
+	// Filters are sent in a POST body, and the server is always in the query
+	_, err = cli.PublicRooms(&mautrix.ReqPublicRooms{Server: "remote.example.com", Limit: 10, Filter: &mautrix.PublicRoomsFilter{GenericSearchTerm: "matrix"}})
+	require.NoError(t, err)
+	req = srv.LastRequest(t)
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "remote.example.com", req.Query.Get("server"))
+	assert.NotContains(t, req.Query, "limit")
+	assert.JSONEq(t, `{"limit": 10, "filter": {"generic_search_term": "matrix"}}`, req.Body)
+
+	_, err = cli.PublicRooms(&mautrix.ReqPublicRooms{IncludeAllNetworks: true})
+	require.NoError(t, err)
+	req = srv.LastRequest(t)
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.JSONEq(t, `{"include_all_networks": true}`, req.Body)
+}
+
+func TestClient_RoomDirectoryVisibility(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("GET /_matrix/client/r0/directory/list/room/!room:example.com", `{"visibility": "public"}`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	resp, err := cli.GetRoomDirectoryVisibility("!room:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, mautrix.RoomDirectoryVisibilityPublic, resp.Visibility)
+	srv.Requests()
+
+	require.NoError(t, cli.SetRoomDirectoryVisibility("!room:example.com", mautrix.RoomDirectoryVisibilityPrivate))
+	req := srv.LastRequest(t)
+	assert.Equal(t, http.MethodPut, req.Method)
+	assert.Equal(t, "/_matrix/client/r0/directory/list/room/!room:example.com", req.Path)
+	assert.JSONEq(t, `{"visibility": "private"}`, req.Body)
+
+	require.NoError(t, cli.SetAppserviceRoomDirectoryVisibility("irc", "!room:example.com", mautrix.RoomDirectoryVisibilityPublic))
+	req = srv.LastRequest(t)
+	assert.Equal(t, "/_matrix/client/r0/directory/list/appservice/irc/!room:example.com", req.Path)
+	assert.JSONEq(t, `{"visibility": "public"}`, req.Body)
+}
+
+// newPublicRoomsServer returns a server that responds with the page matching the since token of each request, or an
+// error if there's no page for the token. It also returns the since tokens of all requests.
+func newPublicRoomsServer(pages map[string]string) (*httptest.Server, *[]string) {
+	var lock sync.Mutex
+	var sinces []string
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since := r.URL.Query().Get("since")
+		lock.Lock()
+		sinces = append(sinces, since)
+		lock.Unlock()
+		page, ok := pages[since]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errcode": "M_INVALID_PARAM", "error": "Unknown since token"}`))
+			return
+		}
+		_, _ = w.Write([]byte(page))
+	})), &sinces
+}
+
+func collectPublicRooms(iter *mautrix.PublicRoomsIterator) (rooms []id.RoomID) {
+	for iter.Next() {
+		rooms = append(rooms, iter.Room().RoomID)
+	}
+	return
+}
+
+func TestPublicRoomsIterator(t *testing.T) {
+	server, sinces := newPublicRoomsServer(map[string]string{
+		"":  `{"chunk": [{"room_id": "!a:example.com"}, {"room_id": "!b:example.com"}], "next_batch": "1", "total_room_count_estimate": 5}`,
+		"1": `{"chunk": [], "next_batch": "2"}`,
+		"2": `{"chunk": [{"room_id": "!c:example.com"}], "total_room_count_estimate": 3}`,
+	})
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+
+	iter := cli.IteratePublicRooms(mautrix.ReqPublicRooms{Limit: 2})
+	rooms := collectPublicRooms(iter)
+	require.NoError(t, iter.Err())
+	// Empty pages are skipped
+	assert.Equal(t, []id.RoomID{"!a:example.com", "!b:example.com", "!c:example.com"}, rooms)
+	assert.Equal(t, []string{"", "1", "2"}, *sinces)
+	assert.Equal(t, 3, iter.TotalRoomCountEstimate)
+	assert.Nil(t, iter.Room())
+	assert.False(t, iter.Next())
+	assert.Len(t, *sinces, 3)
+}
+
+func TestPublicRoomsIterator_RepeatedToken(t *testing.T) {
+	server, sinces := newPublicRoomsServer(map[string]string{
+		"1": `{"chunk": [{"room_id": "!a:example.com"}], "next_batch": "1"}`,
+	})
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+
+	iter := cli.IteratePublicRooms(mautrix.ReqPublicRooms{Since: "1"})
+	assert.Equal(t, []id.RoomID{"!a:example.com"}, collectPublicRooms(iter))
+	require.NoError(t, iter.Err())
+	assert.Equal(t, []string{"1"}, *sinces)
+}
+
+func TestPublicRoomsIterator_Error(t *testing.T) {
+	server, sinces := newPublicRoomsServer(map[string]string{
+		"": `{"chunk": [{"room_id": "!a:example.com"}], "next_batch": "fail"}`,
+	})
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+
+	iter := cli.IteratePublicRooms(mautrix.ReqPublicRooms{})
+	assert.Equal(t, []id.RoomID{"!a:example.com"}, collectPublicRooms(iter))
+	assert.ErrorIs(t, iter.Err(), mautrix.MInvalidParam)
+	// The failed page isn't requested again
+	assert.False(t, iter.Next())
+	assert.Equal(t, []string{"", "fail"}, *sinces)
+}
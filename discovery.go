@@ -0,0 +1,425 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	// ErrInvalidWellKnown means that the .well-known file exists, but is invalid (FAIL_PROMPT in the spec).
+	ErrInvalidWellKnown = errors.New("invalid .well-known response")
+	// ErrWellKnownValidation means that the URLs in the .well-known file don't point at a working server
+	// (FAIL_ERROR in the spec).
+	ErrWellKnownValidation = errors.New("failed to validate .well-known response")
+)
+
+// SupportContact is a contact in the .well-known/matrix/support file.
+type SupportContact struct {
+	MatrixID     id.UserID `json:"matrix_id,omitempty"`
+	EmailAddress string    `json:"email_address,omitempty"`
+	Role         string    `json:"role"`
+}
+
+const (
+	SupportRoleAdmin    = "m.role.admin"
+	SupportRoleSecurity = "m.role.security"
+)
+
+// SupportInformation is the content of the .well-known/matrix/support file.
+// See https://spec.matrix.org/v1.3/client-server-api/#getwell-knownmatrixsupport
+type SupportInformation struct {
+	Contacts    []SupportContact `json:"contacts,omitempty"`
+	SupportPage string           `json:"support_page,omitempty"`
+}
+
+type discoveryCacheEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// DiscoveryCache fetches and caches the .well-known files of Matrix servers. Responses are cached for the max-age
+// in their Cache-Control header, or DefaultTTL if they don't have one. Missing files are cached too.
+type DiscoveryCache struct {
+	HTTPClient *http.Client
+	DefaultTTL time.Duration
+	MaxTTL     time.Duration
+
+	lock    sync.Mutex
+	entries map[string]discoveryCacheEntry
+}
+
+// DefaultDiscoveryCache is the cache used by the package-level discovery functions.
+var DefaultDiscoveryCache = NewDiscoveryCache()
+
+// NewDiscoveryCache creates a discovery cache with a one-hour default TTL.
+func NewDiscoveryCache() *DiscoveryCache {
+	return &DiscoveryCache{
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		DefaultTTL: 1 * time.Hour,
+		MaxTTL:     24 * time.Hour,
+		entries:    make(map[string]discoveryCacheEntry),
+	}
+}
+
+func (dc *DiscoveryCache) get(key string) (discoveryCacheEntry, bool) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	entry, ok := dc.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(dc.entries, key)
+		ok = false
+	}
+	return entry, ok
+}
+
+func (dc *DiscoveryCache) put(key string, data []byte, ttl time.Duration) {
+	dc.lock.Lock()
+	dc.entries[key] = discoveryCacheEntry{data: data, expires: time.Now().Add(ttl)}
+	dc.lock.Unlock()
+}
+
+// Clear removes all cached responses.
+func (dc *DiscoveryCache) Clear() {
+	dc.lock.Lock()
+	dc.entries = make(map[string]discoveryCacheEntry)
+	dc.lock.Unlock()
+}
+
+func (dc *DiscoveryCache) cacheTTL(header http.Header) time.Duration {
+	ttl := dc.DefaultTTL
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "no-store" || directive == "no-cache" {
+			return 0
+		} else if strings.HasPrefix(directive, "max-age=") {
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+				ttl = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	if dc.MaxTTL > 0 && ttl > dc.MaxTTL {
+		ttl = dc.MaxTTL
+	}
+	return ttl
+}
+
+// fetch gets the given .well-known file of the server. A nil result with no error means that the file doesn't exist.
+func (dc *DiscoveryCache) fetch(serverName, path string) ([]byte, error) {
+	key := serverName + path
+	if entry, ok := dc.get(key); ok {
+		return entry.data, nil
+	}
+	wellKnownURL := url.URL{
+		Scheme: "https",
+		Host:   serverName,
+		Path:   path,
+	}
+	req, err := http.NewRequest(http.MethodGet, wellKnownURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", DefaultUserAgent+" .well-known fetcher")
+	resp, err := dc.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var data []byte
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		// data stays nil, which is cached to remember that the file doesn't exist
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%w: %s returned HTTP %d", ErrInvalidWellKnown, path, resp.StatusCode)
+	default:
+		data, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ttl := dc.cacheTTL(resp.Header); ttl > 0 {
+		dc.put(key, data, ttl)
+	}
+	return data, nil
+}
+
+// GetClientWellKnown gets the .well-known/matrix/client file of the server without validating it.
+// A nil result with no error means that the server doesn't have the file.
+func (dc *DiscoveryCache) GetClientWellKnown(serverName string) (*ClientWellKnown, error) {
+	data, err := dc.fetch(serverName, "/.well-known/matrix/client")
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var wellKnown ClientWellKnown
+	err = json.Unmarshal(data, &wellKnown)
+	if err != nil {
+		return nil, fmt.Errorf("%w: response is not JSON", ErrInvalidWellKnown)
+	}
+	return &wellKnown, nil
+}
+
+// ServerWellKnown is the content of the .well-known/matrix/server file.
+// See https://spec.matrix.org/v1.3/server-server-api/#getwell-knownmatrixserver
+type ServerWellKnown struct {
+	Server string `json:"m.server"`
+}
+
+// GetServerWellKnown gets the .well-known/matrix/server file of the server.
+// A nil result with no error means that the server doesn't have the file.
+func (dc *DiscoveryCache) GetServerWellKnown(serverName string) (*ServerWellKnown, error) {
+	data, err := dc.fetch(serverName, "/.well-known/matrix/server")
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var wellKnown ServerWellKnown
+	err = json.Unmarshal(data, &wellKnown)
+	if err != nil {
+		return nil, fmt.Errorf("%w: server response is not JSON", ErrInvalidWellKnown)
+	}
+	return &wellKnown, nil
+}
+
+// GetSupportInformation gets the .well-known/matrix/support file of the server.
+// A nil result with no error means that the server doesn't have the file.
+func (dc *DiscoveryCache) GetSupportInformation(serverName string) (*SupportInformation, error) {
+	data, err := dc.fetch(serverName, "/.well-known/matrix/support")
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var support SupportInformation
+	err = json.Unmarshal(data, &support)
+	if err != nil {
+		return nil, fmt.Errorf("%w: support response is not JSON", ErrInvalidWellKnown)
+	}
+	return &support, nil
+}
+
+func parseDiscoveredURL(baseURL string) (*url.URL, error) {
+	parsed, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	} else if (parsed.Scheme != "https" && parsed.Scheme != "http") || len(parsed.Host) == 0 {
+		return nil, fmt.Errorf("%q is not an absolute HTTP(S) URL", baseURL)
+	}
+	return parsed, nil
+}
+
+func (dc *DiscoveryCache) validateHomeserver(hsURL *url.URL) error {
+	req, err := http.NewRequest(http.MethodGet, BuildURL(hsURL, "_matrix", "client", "versions").String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", DefaultUserAgent+" .well-known fetcher")
+	resp, err := dc.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var versions RespVersions
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("versions endpoint returned HTTP %d", resp.StatusCode)
+	} else if err = json.NewDecoder(resp.Body).Decode(&versions); err != nil || len(versions.Versions) == 0 {
+		return fmt.Errorf("versions endpoint didn't return a list of versions")
+	}
+	return nil
+}
+
+// ResolveHomeserver finds the client API URL of the given server name by following the server discovery process in
+// https://spec.matrix.org/v1.3/client-server-api/#server-discovery. If the server doesn't have a .well-known file,
+// the server name itself is used. Successfully resolved URLs are cached like the .well-known file itself.
+func (dc *DiscoveryCache) ResolveHomeserver(serverName string) (*url.URL, error) {
+	resolvedKey := serverName + "#resolved"
+	if entry, ok := dc.get(resolvedKey); ok {
+		return url.Parse(string(entry.data))
+	}
+	wellKnown, err := dc.GetClientWellKnown(serverName)
+	if err != nil {
+		return nil, err
+	} else if wellKnown == nil {
+		return &url.URL{Scheme: "https", Host: serverName}, nil
+	} else if len(wellKnown.Homeserver.BaseURL) == 0 {
+		return nil, fmt.Errorf("%w: m.homeserver base_url is missing", ErrInvalidWellKnown)
+	}
+	hsURL, err := parseDiscoveredURL(wellKnown.Homeserver.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid homeserver URL: %v", ErrWellKnownValidation, err)
+	} else if err = dc.validateHomeserver(hsURL); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrWellKnownValidation, err)
+	}
+	if len(wellKnown.IdentityServer.BaseURL) > 0 {
+		if _, err = parseDiscoveredURL(wellKnown.IdentityServer.BaseURL); err != nil {
+			return nil, fmt.Errorf("%w: invalid identity server URL: %v", ErrWellKnownValidation, err)
+		}
+	}
+	dc.put(resolvedKey, []byte(hsURL.String()), dc.DefaultTTL)
+	return hsURL, nil
+}
+
+// DiscoverClientAPI gets the .well-known/matrix/client file of a Matrix server name using DefaultDiscoveryCache.
+// Use ParseUserID to extract the server name from a user ID. A nil result with no error means that the server
+// doesn't have the file. Use ResolveHomeserver to also validate the response.
+// https://matrix.org/docs/spec/client_server/r0.6.0#server-discovery
+func DiscoverClientAPI(serverName string) (*ClientWellKnown, error) {
+	return DefaultDiscoveryCache.GetClientWellKnown(serverName)
+}
+
+// ResolveHomeserver finds the client API URL of the given server name using DefaultDiscoveryCache.
+func ResolveHomeserver(serverName string) (*url.URL, error) {
+	return DefaultDiscoveryCache.ResolveHomeserver(serverName)
+}
+
+// DiscoverSupportInformation gets the support contacts of the given server name using DefaultDiscoveryCache.
+func DiscoverSupportInformation(serverName string) (*SupportInformation, error) {
+	return DefaultDiscoveryCache.GetSupportInformation(serverName)
+}
+
+// discoverHomeserverForLogin resolves the homeserver URL when the client was only given a server name, or no
+// homeserver at all, in which case the server name is taken from the user ID being logged into.
+func (cli *Client) discoverHomeserverForLogin(req *ReqLogin) error {
+	var serverName string
+	if cli.HomeserverURL != nil {
+		serverName = strings.Trim(cli.HomeserverURL.Path, "/")
+	}
+	if len(serverName) == 0 && req.Identifier.Type == IdentifierTypeUser {
+		_, serverName, _ = id.UserID(req.Identifier.User).Parse()
+	}
+	if len(serverName) == 0 {
+		return fmt.Errorf("no homeserver URL or server name to discover it from")
+	}
+	hsURL, err := ResolveHomeserver(serverName)
+	if err != nil {
+		return fmt.Errorf("failed to discover homeserver URL of %s: %w", serverName, err)
+	}
+	cli.HomeserverURL = hsURL
+	cli.Logger.Debugfln("Discovered homeserver URL %s for %s", hsURL, serverName)
+	return nil
+}
+
+// DefaultFederationPort is the port used for federation when the server name doesn't specify one and there are no
+// SRV records.
+const DefaultFederationPort = 8448
+
+// ResolvedServerName is the result of resolving a server name for server-server API requests.
+type ResolvedServerName struct {
+	ServerName string
+	// Host is the value to use in the Host header. The hostname in it is also the name that the TLS certificate of the
+	// server must be valid for.
+	Host string
+	// Address is the host and port to connect to. It only differs from the host and port of Host if they were found
+	// using SRV records.
+	Address string
+}
+
+// URL returns the https URL of the given server-server API path using the Host and the port from Address.
+func (rsn *ResolvedServerName) URL(path ...interface{}) *url.URL {
+	hostname, _, _ := splitServerName(rsn.Host)
+	_, port, _ := net.SplitHostPort(rsn.Address)
+	return BuildURL(&url.URL{Scheme: "https", Host: net.JoinHostPort(hostname, port)}, path...)
+}
+
+// splitServerName splits a server name into the hostname and port. The port is zero if the server name doesn't
+// contain one. IPv6 literals are returned without brackets.
+func splitServerName(serverName string) (hostname string, port int, err error) {
+	if len(serverName) == 0 || strings.ContainsAny(serverName, "/?#@ ") {
+		return "", 0, fmt.Errorf("invalid server name %q", serverName)
+	}
+	hostname, portStr, splitErr := net.SplitHostPort(serverName)
+	if splitErr != nil {
+		// No port
+		hostname = serverName
+		isBracketed := strings.HasPrefix(hostname, "[") && strings.HasSuffix(hostname, "]")
+		if isBracketed {
+			hostname = hostname[1 : len(hostname)-1]
+		}
+		// IPv6 literals must be in brackets, and brackets are only allowed around IPv6 literals
+		if isBracketed != strings.Contains(hostname, ":") || (isBracketed && net.ParseIP(hostname) == nil) {
+			return "", 0, fmt.Errorf("invalid server name %q", serverName)
+		}
+		return hostname, 0, nil
+	}
+	port, err = strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port in server name %q", serverName)
+	}
+	return hostname, port, nil
+}
+
+func lookupFederationSRV(ctx context.Context, hostname string) (string, bool) {
+	for _, service := range []string{"matrix-fed", "matrix"} {
+		_, addrs, err := net.DefaultResolver.LookupSRV(ctx, service, "tcp", hostname)
+		if err == nil && len(addrs) > 0 {
+			target := strings.TrimSuffix(addrs[0].Target, ".")
+			return net.JoinHostPort(target, strconv.Itoa(int(addrs[0].Port))), true
+		}
+	}
+	return "", false
+}
+
+// resolveHostname resolves a hostname without a port using SRV records or the default federation port.
+func resolveHostname(ctx context.Context, hostname string) string {
+	if net.ParseIP(hostname) == nil {
+		if addr, ok := lookupFederationSRV(ctx, hostname); ok {
+			return addr
+		}
+	}
+	return net.JoinHostPort(hostname, strconv.Itoa(DefaultFederationPort))
+}
+
+// ResolveServerName finds where to send server-server API requests for the given server name by following
+// https://spec.matrix.org/v1.3/server-server-api/#resolving-server-names. IP literals and server names with explicit
+// ports are used as-is, otherwise the .well-known/matrix/server delegation, SRV records and the default port 8448
+// are tried in order.
+func (dc *DiscoveryCache) ResolveServerName(ctx context.Context, serverName string) (*ResolvedServerName, error) {
+	hostname, port, err := splitServerName(serverName)
+	if err != nil {
+		return nil, err
+	}
+	resolved := &ResolvedServerName{ServerName: serverName, Host: serverName}
+	if port != 0 {
+		resolved.Address = net.JoinHostPort(hostname, strconv.Itoa(port))
+		return resolved, nil
+	} else if net.ParseIP(hostname) != nil {
+		resolved.Address = net.JoinHostPort(hostname, strconv.Itoa(DefaultFederationPort))
+		return resolved, nil
+	}
+
+	// Errors fetching the .well-known file are ignored, the spec says to fall back to SRV records in that case
+	wellKnown, _ := dc.GetServerWellKnown(hostname)
+	if wellKnown != nil && len(wellKnown.Server) > 0 {
+		delegatedHostname, delegatedPort, err := splitServerName(wellKnown.Server)
+		if err == nil {
+			resolved.Host = wellKnown.Server
+			if delegatedPort != 0 {
+				resolved.Address = net.JoinHostPort(delegatedHostname, strconv.Itoa(delegatedPort))
+			} else {
+				resolved.Address = resolveHostname(ctx, delegatedHostname)
+			}
+			return resolved, nil
+		}
+	}
+	resolved.Address = resolveHostname(ctx, hostname)
+	return resolved, nil
+}
+
+// ResolveServerName resolves a server name for server-server API requests using DefaultDiscoveryCache.
+func ResolveServerName(ctx context.Context, serverName string) (*ResolvedServerName, error) {
+	return DefaultDiscoveryCache.ResolveServerName(ctx, serverName)
+}
@@ -0,0 +1,337 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+)
+
+// discoveryTestServer is a TLS server that serves .well-known files, as discovery always uses HTTPS.
+type discoveryTestServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	requests []string
+	// files maps paths to response bodies. Paths that aren't in the map return 404 and "error" returns 500.
+	files        map[string]string
+	cacheControl string
+}
+
+func (srv *discoveryTestServer) SetFile(path, body string) {
+	srv.lock.Lock()
+	srv.files[path] = body
+	srv.lock.Unlock()
+}
+
+func (srv *discoveryTestServer) SetCacheControl(value string) {
+	srv.lock.Lock()
+	srv.cacheControl = value
+	srv.lock.Unlock()
+}
+
+func newDiscoveryTestServer() *discoveryTestServer {
+	srv := &discoveryTestServer{files: make(map[string]string)}
+	srv.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.lock.Lock()
+		srv.requests = append(srv.requests, r.URL.Path)
+		body, ok := srv.files[r.URL.Path]
+		cacheControl := srv.cacheControl
+		srv.lock.Unlock()
+		if len(cacheControl) > 0 {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		if body == "error" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	return srv
+}
+
+// ServerName returns the host:port of the server, which is used as the server name.
+func (srv *discoveryTestServer) ServerName() string {
+	return strings.TrimPrefix(srv.URL, "https://")
+}
+
+func (srv *discoveryTestServer) Requests() []string {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	requests := srv.requests
+	srv.requests = nil
+	return requests
+}
+
+func (srv *discoveryTestServer) newCache() *mautrix.DiscoveryCache {
+	cache := mautrix.NewDiscoveryCache()
+	cache.HTTPClient = srv.Client()
+	return cache
+}
+
+func TestDiscoveryCache_ResolveHomeserver(t *testing.T) {
+	srv := newDiscoveryTestServer()
+	defer srv.Close()
+	srv.SetFile("/.well-known/matrix/client", `{"m.homeserver": {"base_url": "`+srv.URL+`/"}}`)
+	srv.SetFile("/_matrix/client/versions", `{"versions": ["v1.1"]}`)
+	cache := srv.newCache()
+
+	hsURL, err := cache.ResolveHomeserver(srv.ServerName())
+	require.NoError(t, err)
+	assert.Equal(t, srv.URL, hsURL.String())
+	assert.Equal(t, []string{"/.well-known/matrix/client", "/_matrix/client/versions"}, srv.Requests())
+
+	// The resolved URL is cached
+	hsURL, err = cache.ResolveHomeserver(srv.ServerName())
+	require.NoError(t, err)
+	assert.Equal(t, srv.URL, hsURL.String())
+	assert.Empty(t, srv.Requests())
+
+	cache.Clear()
+	_, err = cache.ResolveHomeserver(srv.ServerName())
+	require.NoError(t, err)
+	assert.Len(t, srv.Requests(), 2)
+}
+
+func TestDiscoveryCache_ResolveHomeserver_NoWellKnown(t *testing.T) {
+	srv := newDiscoveryTestServer()
+	defer srv.Close()
+	cache := srv.newCache()
+
+	hsURL, err := cache.ResolveHomeserver(srv.ServerName())
+	require.NoError(t, err)
+	assert.Equal(t, &url.URL{Scheme: "https", Host: srv.ServerName()}, hsURL)
+	// The missing file is cached too
+	wellKnown, err := cache.GetClientWellKnown(srv.ServerName())
+	require.NoError(t, err)
+	assert.Nil(t, wellKnown)
+	assert.Equal(t, []string{"/.well-known/matrix/client"}, srv.Requests())
+}
+
+func TestDiscoveryCache_ResolveHomeserver_Invalid(t *testing.T) {
+	srv := newDiscoveryTestServer()
+	defer srv.Close()
+	srv.SetCacheControl("no-store")
+	cache := srv.newCache()
+
+	srv.SetFile("/.well-known/matrix/client", `not json`)
+	_, err := cache.ResolveHomeserver(srv.ServerName())
+	assert.ErrorIs(t, err, mautrix.ErrInvalidWellKnown)
+
+	srv.SetFile("/.well-known/matrix/client", `{"m.homeserver": {}}`)
+	_, err = cache.ResolveHomeserver(srv.ServerName())
+	assert.ErrorIs(t, err, mautrix.ErrInvalidWellKnown)
+
+	srv.SetFile("/.well-known/matrix/client", `{"m.homeserver": {"base_url": "matrix.example.com"}}`)
+	_, err = cache.ResolveHomeserver(srv.ServerName())
+	assert.ErrorIs(t, err, mautrix.ErrWellKnownValidation)
+
+	// The base URL is valid, but there's no /versions endpoint
+	srv.SetFile("/.well-known/matrix/client", `{"m.homeserver": {"base_url": "`+srv.URL+`"}}`)
+	_, err = cache.ResolveHomeserver(srv.ServerName())
+	assert.ErrorIs(t, err, mautrix.ErrWellKnownValidation)
+
+	srv.SetFile("/_matrix/client/versions", `{"versions": ["v1.1"]}`)
+	srv.SetFile("/.well-known/matrix/client", `{"m.homeserver": {"base_url": "`+srv.URL+`"}, "m.identity_server": {"base_url": "/relative"}}`)
+	_, err = cache.ResolveHomeserver(srv.ServerName())
+	assert.ErrorIs(t, err, mautrix.ErrWellKnownValidation)
+
+	// Nothing was cached, as the server told not to store the responses
+	srv.SetFile("/.well-known/matrix/client", `{"m.homeserver": {"base_url": "`+srv.URL+`"}}`)
+	_, err = cache.ResolveHomeserver(srv.ServerName())
+	require.NoError(t, err)
+}
+
+func TestDiscoveryCache_CacheControl(t *testing.T) {
+	srv := newDiscoveryTestServer()
+	defer srv.Close()
+	srv.SetFile("/.well-known/matrix/client", `{"m.homeserver": {"base_url": "https://matrix.example.com"}}`)
+	cache := srv.newCache()
+
+	srv.SetCacheControl("no-cache")
+	for i := 0; i < 2; i++ {
+		wellKnown, err := cache.GetClientWellKnown(srv.ServerName())
+		require.NoError(t, err)
+		assert.Equal(t, "https://matrix.example.com", wellKnown.Homeserver.BaseURL)
+	}
+	assert.Len(t, srv.Requests(), 2)
+
+	srv.SetCacheControl("public, max-age=600")
+	for i := 0; i < 2; i++ {
+		_, err := cache.GetClientWellKnown(srv.ServerName())
+		require.NoError(t, err)
+	}
+	assert.Len(t, srv.Requests(), 1)
+
+	// Errors aren't cached
+	srv.SetFile("/.well-known/matrix/support", "error")
+	_, err := cache.GetSupportInformation(srv.ServerName())
+	assert.ErrorIs(t, err, mautrix.ErrInvalidWellKnown)
+	srv.SetFile("/.well-known/matrix/support", `{"support_page": "https://example.com"}`)
+	support, err := cache.GetSupportInformation(srv.ServerName())
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com", support.SupportPage)
+}
+
+func TestDiscoveryCache_GetSupportInformation(t *testing.T) {
+	srv := newDiscoveryTestServer()
+	defer srv.Close()
+	srv.SetFile("/.well-known/matrix/support", `{
+		"contacts": [
+			{"matrix_id": "@admin:example.com", "role": "m.role.admin"},
+			{"email_address": "security@example.com", "role": "m.role.security"}
+		],
+		"support_page": "https://example.com/support"
+	}`)
+	cache := srv.newCache()
+
+	support, err := cache.GetSupportInformation(srv.ServerName())
+	require.NoError(t, err)
+	assert.Equal(t, &mautrix.SupportInformation{
+		Contacts: []mautrix.SupportContact{
+			{MatrixID: "@admin:example.com", Role: mautrix.SupportRoleAdmin},
+			{EmailAddress: "security@example.com", Role: mautrix.SupportRoleSecurity},
+		},
+		SupportPage: "https://example.com/support",
+	}, support)
+	assert.Equal(t, []string{"/.well-known/matrix/support"}, srv.Requests())
+
+	srv.SetFile("/.well-known/matrix/support", `[]`)
+	cache.Clear()
+	_, err = cache.GetSupportInformation(srv.ServerName())
+	assert.ErrorIs(t, err, mautrix.ErrInvalidWellKnown)
+}
+
+func TestClient_LoginDiscoversHomeserver(t *testing.T) {
+	srv := newDiscoveryTestServer()
+	defer srv.Close()
+	srv.SetFile("/.well-known/matrix/client", `{"m.homeserver": {"base_url": "`+srv.URL+`"}}`)
+	srv.SetFile("/_matrix/client/versions", `{"versions": ["v1.1"]}`)
+	srv.SetFile("/_matrix/client/r0/login", `{"user_id": "@user:example.com", "access_token": "token", "device_id": "DEVICE"}`)
+	defaultCache := mautrix.DefaultDiscoveryCache
+	mautrix.DefaultDiscoveryCache = srv.newCache()
+	defer func() {
+		mautrix.DefaultDiscoveryCache = defaultCache
+	}()
+
+	cli, err := mautrix.NewClient("", "", "")
+	require.NoError(t, err)
+	cli.Client = srv.Client()
+	resp, err := cli.Login(&mautrix.ReqLogin{
+		Type:       mautrix.AuthTypePassword,
+		Identifier: mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: "@user:" + srv.ServerName()},
+		Password:   "hunter2",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "token", resp.AccessToken)
+	assert.Equal(t, srv.URL, cli.HomeserverURL.String())
+	assert.Equal(t, []string{"/.well-known/matrix/client", "/_matrix/client/versions", "/_matrix/client/r0/login"}, srv.Requests())
+
+	cli, err = mautrix.NewClient("", "", "")
+	require.NoError(t, err)
+	_, err = cli.Login(&mautrix.ReqLogin{Type: mautrix.AuthTypeToken, Token: "abc"})
+	assert.Error(t, err, "login without a server name should fail")
+}
+
+// newRedirectingCache returns a discovery cache that connects to the test server regardless of the hostname, so that
+// server names without ports can be tested. The certificate of the test server is valid for example.com.
+func (srv *discoveryTestServer) newRedirectingCache() *mautrix.DiscoveryCache {
+	cache := srv.newCache()
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	cache.HTTPClient = &http.Client{Transport: transport}
+	return cache
+}
+
+func TestDiscoveryCache_ResolveServerName(t *testing.T) {
+	cache := mautrix.NewDiscoveryCache()
+	for serverName, expectedAddress := range map[string]string{
+		"example.com:1234": "example.com:1234",
+		"1.2.3.4":          "1.2.3.4:8448",
+		"1.2.3.4:5678":     "1.2.3.4:5678",
+		"[::1]":            "[::1]:8448",
+		"[::1]:5678":       "[::1]:5678",
+	} {
+		resolved, err := cache.ResolveServerName(context.Background(), serverName)
+		require.NoError(t, err, serverName)
+		assert.Equal(t, serverName, resolved.ServerName)
+		assert.Equal(t, serverName, resolved.Host)
+		assert.Equal(t, expectedAddress, resolved.Address, serverName)
+	}
+	for _, serverName := range []string{"", "example.com/path", "user@example.com", "::1", "[example.com]", "example.com:0", "example.com:99999", "example.com:port"} {
+		_, err := cache.ResolveServerName(context.Background(), serverName)
+		assert.Error(t, err, serverName)
+	}
+
+	resolved := &mautrix.ResolvedServerName{ServerName: "example.com", Host: "matrix.example.com", Address: "server.example.net:8443"}
+	assert.Equal(t, "https://matrix.example.com:8443/_matrix/federation/v1/version", resolved.URL("_matrix", "federation", "v1", "version").String())
+}
+
+func TestDiscoveryCache_ResolveServerName_WellKnown(t *testing.T) {
+	srv := newDiscoveryTestServer()
+	defer srv.Close()
+	cache := srv.newRedirectingCache()
+
+	srv.SetFile("/.well-known/matrix/server", `{"m.server": "matrix.example.com:8443"}`)
+	resolved, err := cache.ResolveServerName(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, &mautrix.ResolvedServerName{ServerName: "example.com", Host: "matrix.example.com:8443", Address: "matrix.example.com:8443"}, resolved)
+	assert.Equal(t, []string{"/.well-known/matrix/server"}, srv.Requests())
+
+	wellKnown, err := cache.GetServerWellKnown("example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "matrix.example.com:8443", wellKnown.Server)
+	// The file is cached
+	assert.Empty(t, srv.Requests())
+
+	// Delegated IP literals without a port use the default port
+	cache.Clear()
+	srv.SetFile("/.well-known/matrix/server", `{"m.server": "10.0.0.1"}`)
+	resolved, err = cache.ResolveServerName(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", resolved.Host)
+	assert.Equal(t, "10.0.0.1:8448", resolved.Address)
+
+	cache.Clear()
+	srv.SetFile("/.well-known/matrix/server", `not json`)
+	_, err = cache.GetServerWellKnown("example.com")
+	assert.ErrorIs(t, err, mautrix.ErrInvalidWellKnown)
+}
+
+func TestDiscoveryCache_ResolveServerName_Fallback(t *testing.T) {
+	srv := newDiscoveryTestServer()
+	defer srv.Close()
+	cache := srv.newRedirectingCache()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Invalid delegations and missing files fall back to the server name itself. example.com doesn't have SRV
+	// records, so the default port is used.
+	for _, file := range []string{`{"m.server": "invalid/server"}`, "error"} {
+		cache.Clear()
+		srv.SetFile("/.well-known/matrix/server", file)
+		resolved, err := cache.ResolveServerName(ctx, "example.com")
+		require.NoError(t, err)
+		assert.Equal(t, &mautrix.ResolvedServerName{ServerName: "example.com", Host: "example.com", Address: "example.com:8448"}, resolved)
+	}
+}
@@ -11,8 +11,12 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 )
 
+// ErrNoRefreshToken is returned by Client.RefreshAccessToken if the client doesn't have a refresh token.
+var ErrNoRefreshToken = errors.New("client doesn't have a refresh token")
+
 // Common error codes from https://matrix.org/docs/spec/client_server/latest#api-standards
 //
 // Can be used with errors.Is() to check the response code without casting the error:
@@ -55,6 +59,62 @@ var (
 	// The client attempted to join a room that has a version the server does not support.
 	// Inspect the room_version property of the error response for the room's version.
 	MIncompatibleRoomVersion = RespError{ErrCode: "M_INCOMPATIBLE_ROOM_VERSION"}
+	// The key backup version in the request is not the current backup version.
+	MWrongRoomKeysVersion = RespError{ErrCode: "M_WRONG_ROOM_KEYS_VERSION"}
+	// The request was not correctly authorized. Usually due to login failures.
+	MUnauthorized = RespError{ErrCode: "M_UNAUTHORIZED"}
+	// An unknown error has occurred.
+	MUnknown = RespError{ErrCode: "M_UNKNOWN"}
+	// The server did not understand the request.
+	MUnrecognized = RespError{ErrCode: "M_UNRECOGNIZED"}
+	// Sent when the initial state given to the createRoom API is invalid.
+	MInvalidRoomState = RespError{ErrCode: "M_INVALID_ROOM_STATE"}
+	// Sent when a threepid given to an API cannot be used because the same threepid is already in use.
+	MThreePIDInUse = RespError{ErrCode: "M_THREEPID_IN_USE"}
+	// Sent when a threepid given to an API cannot be used because no record matching the threepid was found.
+	MThreePIDNotFound = RespError{ErrCode: "M_THREEPID_NOT_FOUND"}
+	// Authentication could not be performed on the third party identifier.
+	MThreePIDAuthFailed = RespError{ErrCode: "M_THREEPID_AUTH_FAILED"}
+	// The server does not permit this third party identifier.
+	MThreePIDDenied = RespError{ErrCode: "M_THREEPID_DENIED"}
+	// The homeserver does not support adding a third party identifier of the given medium.
+	MThreePIDMediumNotSupported = RespError{ErrCode: "M_THREEPID_MEDIUM_NOT_SUPPORTED"}
+	// The client's request used a third party server, e.g. identity server, that this server does not trust.
+	MServerNotTrusted = RespError{ErrCode: "M_SERVER_NOT_TRUSTED"}
+	// The room or resource does not permit guests to access it.
+	MGuestAccessForbidden = RespError{ErrCode: "M_GUEST_ACCESS_FORBIDDEN"}
+	// A Captcha is required to complete the request.
+	MCaptchaNeeded = RespError{ErrCode: "M_CAPTCHA_NEEDED"}
+	// The Captcha provided did not match what was expected.
+	MCaptchaInvalid = RespError{ErrCode: "M_CAPTCHA_INVALID"}
+	// A required parameter was missing from the request.
+	MMissingParam = RespError{ErrCode: "M_MISSING_PARAM"}
+	// A parameter that was specified has the wrong value.
+	MInvalidParam = RespError{ErrCode: "M_INVALID_PARAM"}
+	// The request cannot be completed because the homeserver has reached a resource limit imposed on it.
+	// Inspect the admin_contact and limit_type properties of the error response.
+	MResourceLimitExceeded = RespError{ErrCode: "M_RESOURCE_LIMIT_EXCEEDED"}
+	// The user is unable to reject an invite to join the server notices room.
+	MCannotLeaveServerNoticeRoom = RespError{ErrCode: "M_CANNOT_LEAVE_SERVER_NOTICE_ROOM"}
+	// The password was rejected by the server for being too weak.
+	MWeakPassword = RespError{ErrCode: "M_WEAK_PASSWORD"}
+	// The room is restricted and none of the conditions can be validated by the homeserver.
+	MUnableToAuthoriseJoin = RespError{ErrCode: "M_UNABLE_TO_AUTHORISE_JOIN"}
+	// A different server should be attempted for the join, because the resident server can't issue an invite.
+	MUnableToGrantJoin = RespError{ErrCode: "M_UNABLE_TO_GRANT_JOIN"}
+	// The room alias specified is not valid or doesn't point to the given room.
+	MBadAlias = RespError{ErrCode: "M_BAD_ALIAS"}
+	// The account has been locked and can't be used at this time.
+	MUserLocked = RespError{ErrCode: "M_USER_LOCKED"}
+	// The media has not been uploaded yet (MSC2246 asynchronous uploads).
+	MNotYetUploaded = RespError{ErrCode: "M_NOT_YET_UPLOADED"}
+	// The media has already been uploaded and can't be overwritten (MSC2246 asynchronous uploads).
+	MCannotOverwriteMedia = RespError{ErrCode: "M_CANNOT_OVERWRITE_MEDIA"}
+	// The sliding sync position has expired, the sync connection must be restarted without a position (MSC4186).
+	MUnknownPos = RespError{ErrCode: "M_UNKNOWN_POS"}
+	// The user must agree to the server's terms before using it. Inspect the consent_uri property of the error response.
+	// This is not in the spec, but is used by Synapse.
+	MConsentNotGiven = RespError{ErrCode: "M_CONSENT_NOT_GIVEN"}
 )
 
 // HTTPError An HTTP Error response, which may wrap an underlying native Go Error.
@@ -91,6 +151,21 @@ func (e HTTPError) Error() string {
 	}
 }
 
+// As allows extracting a UIARequiredError from the error with errors.As if the server requires
+// user-interactive authentication for the request.
+func (e HTTPError) As(target interface{}) bool {
+	uiaErr, ok := target.(*UIARequiredError)
+	if !ok || !e.IsStatus(http.StatusUnauthorized) || len(e.ResponseBody) == 0 {
+		return false
+	}
+	var uia RespUserInteractive
+	if json.Unmarshal([]byte(e.ResponseBody), &uia) != nil || len(uia.Flows) == 0 {
+		return false
+	}
+	*uiaErr = UIARequiredError{Response: &uia}
+	return true
+}
+
 func (e HTTPError) Unwrap() error {
 	if e.WrappedError != nil {
 		return e.WrappedError
@@ -127,6 +202,55 @@ func (e *RespError) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&e.ExtraData)
 }
 
+// IsSoftLogout returns whether the error has the soft_logout flag set, which means that the client should refresh its
+// access token or log in again without discarding its local data.
+// See https://spec.matrix.org/v1.3/client-server-api/#soft-logout
+func (e RespError) IsSoftLogout() bool {
+	softLogout, _ := e.ExtraData["soft_logout"].(bool)
+	return softLogout
+}
+
+func (e RespError) extraString(key string) string {
+	val, _ := e.ExtraData[key].(string)
+	return val
+}
+
+// As allows extracting the typed errors with structured fields (e.g. LimitExceededError) from the error
+// with errors.As, if the error code matches.
+func (e RespError) As(target interface{}) bool {
+	switch typed := target.(type) {
+	case *LimitExceededError:
+		if e.ErrCode != MLimitExceeded.ErrCode {
+			return false
+		}
+		retryAfterMS, _ := e.ExtraData["retry_after_ms"].(float64)
+		*typed = LimitExceededError{RespError: e, RetryAfter: time.Duration(retryAfterMS) * time.Millisecond}
+	case *ResourceLimitExceededError:
+		if e.ErrCode != MResourceLimitExceeded.ErrCode {
+			return false
+		}
+		*typed = ResourceLimitExceededError{RespError: e, AdminContact: e.extraString("admin_contact"), LimitType: e.extraString("limit_type")}
+	case *ConsentNotGivenError:
+		if e.ErrCode != MConsentNotGiven.ErrCode {
+			return false
+		}
+		*typed = ConsentNotGivenError{RespError: e, ConsentURI: e.extraString("consent_uri")}
+	case *IncompatibleRoomVersionError:
+		if e.ErrCode != MIncompatibleRoomVersion.ErrCode {
+			return false
+		}
+		*typed = IncompatibleRoomVersionError{RespError: e, RoomVersion: e.extraString("room_version")}
+	case *WrongRoomKeysVersionError:
+		if e.ErrCode != MWrongRoomKeysVersion.ErrCode {
+			return false
+		}
+		*typed = WrongRoomKeysVersionError{RespError: e, CurrentVersion: e.extraString("current_version")}
+	default:
+		return false
+	}
+	return true
+}
+
 // Error returns the errcode and error message.
 func (e RespError) Error() string {
 	return e.ErrCode + ": " + e.Err
@@ -142,3 +266,48 @@ func (e RespError) Is(err error) bool {
 	}
 	return e2.ErrCode == e.ErrCode
 }
+
+// LimitExceededError is an M_LIMIT_EXCEEDED error. RetryAfter is zero if the server didn't say how long to wait.
+type LimitExceededError struct {
+	RespError
+	RetryAfter time.Duration
+}
+
+// ResourceLimitExceededError is an M_RESOURCE_LIMIT_EXCEEDED error, which includes a contact URI for the server
+// administrator and the type of the limit that was exceeded.
+type ResourceLimitExceededError struct {
+	RespError
+	AdminContact string
+	LimitType    string
+}
+
+// ConsentNotGivenError is an M_CONSENT_NOT_GIVEN error, which includes the URI where the user can agree to the terms.
+type ConsentNotGivenError struct {
+	RespError
+	ConsentURI string
+}
+
+// IncompatibleRoomVersionError is an M_INCOMPATIBLE_ROOM_VERSION error, which includes the version of the room.
+type IncompatibleRoomVersionError struct {
+	RespError
+	RoomVersion string
+}
+
+// WrongRoomKeysVersionError is an M_WRONG_ROOM_KEYS_VERSION error, which includes the current key backup version.
+type WrongRoomKeysVersionError struct {
+	RespError
+	CurrentVersion string
+}
+
+// UIARequiredError can be extracted from request errors with errors.As when the server responded with
+// user-interactive auth flows. See MakeUIARequest for completing the flows automatically.
+type UIARequiredError struct {
+	Response *RespUserInteractive
+}
+
+func (e UIARequiredError) Error() string {
+	if len(e.Response.ErrCode) > 0 {
+		return fmt.Sprintf("user-interactive auth required: %s: %s", e.Response.ErrCode, e.Response.Error)
+	}
+	return "user-interactive auth required"
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+)
+
+// requestError makes a request to a server that always responds with the given status and body.
+func requestError(t *testing.T, status int, body string) error {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+	_, err := cli.MakeRequest(http.MethodPut, server.URL+"/test", struct{}{}, nil)
+	require.Error(t, err)
+	return err
+}
+
+func TestHTTPError_TypedErrors(t *testing.T) {
+	err := requestError(t, http.StatusTooManyRequests, `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 2500}`)
+	assert.ErrorIs(t, err, mautrix.MLimitExceeded)
+	var limitErr mautrix.LimitExceededError
+	require.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, 2500*time.Millisecond, limitErr.RetryAfter)
+	assert.Equal(t, "Too many requests", limitErr.Err)
+	var resourceErr mautrix.ResourceLimitExceededError
+	assert.False(t, errors.As(err, &resourceErr))
+
+	err = requestError(t, http.StatusForbidden, `{"errcode": "M_RESOURCE_LIMIT_EXCEEDED", "error": "MAU limit", "admin_contact": "mailto:admin@example.com", "limit_type": "monthly_active_user"}`)
+	require.True(t, errors.As(err, &resourceErr))
+	assert.Equal(t, "mailto:admin@example.com", resourceErr.AdminContact)
+	assert.Equal(t, "monthly_active_user", resourceErr.LimitType)
+	assert.False(t, errors.As(err, &limitErr))
+
+	err = requestError(t, http.StatusForbidden, `{"errcode": "M_CONSENT_NOT_GIVEN", "error": "Accept the terms", "consent_uri": "https://example.com/terms"}`)
+	var consentErr mautrix.ConsentNotGivenError
+	require.True(t, errors.As(err, &consentErr))
+	assert.Equal(t, "https://example.com/terms", consentErr.ConsentURI)
+
+	err = requestError(t, http.StatusBadRequest, `{"errcode": "M_INCOMPATIBLE_ROOM_VERSION", "error": "Unsupported", "room_version": "42"}`)
+	var versionErr mautrix.IncompatibleRoomVersionError
+	require.True(t, errors.As(err, &versionErr))
+	assert.Equal(t, "42", versionErr.RoomVersion)
+	assert.ErrorIs(t, err, mautrix.MIncompatibleRoomVersion)
+
+	err = requestError(t, http.StatusForbidden, `{"errcode": "M_WRONG_ROOM_KEYS_VERSION", "error": "Wrong version", "current_version": "5"}`)
+	var keysVersionErr mautrix.WrongRoomKeysVersionError
+	require.True(t, errors.As(err, &keysVersionErr))
+	assert.Equal(t, "5", keysVersionErr.CurrentVersion)
+}
+
+func TestHTTPError_ErrorCodes(t *testing.T) {
+	for _, expected := range []mautrix.RespError{
+		mautrix.MForbidden, mautrix.MUserLocked, mautrix.MBadAlias, mautrix.MNotYetUploaded, mautrix.MCannotOverwriteMedia,
+		mautrix.MUnknownPos, mautrix.MWeakPassword, mautrix.MThreePIDInUse, mautrix.MUnableToAuthoriseJoin,
+	} {
+		err := requestError(t, http.StatusBadRequest, `{"errcode": "`+expected.ErrCode+`", "error": "Something"}`)
+		assert.ErrorIs(t, err, expected)
+		assert.NotErrorIs(t, err, mautrix.MUnknown)
+		var httpErr mautrix.HTTPError
+		require.ErrorAs(t, err, &httpErr)
+		assert.Contains(t, httpErr.Error(), expected.ErrCode)
+		assert.Contains(t, httpErr.ResponseBody, expected.ErrCode)
+	}
+	// M_UNKNOWN errors are only equal if the messages match too
+	err := requestError(t, http.StatusBadRequest, `{"errcode": "M_UNKNOWN", "error": "Something"}`)
+	assert.ErrorIs(t, err, mautrix.RespError{ErrCode: "M_UNKNOWN", Err: "Something"})
+	assert.NotErrorIs(t, err, mautrix.MUnknown)
+}
+
+func TestHTTPError_UIARequired(t *testing.T) {
+	err := requestError(t, http.StatusUnauthorized, `{"session": "xyz", "flows": [{"stages": ["m.login.password"]}], "params": {}}`)
+	var uiaErr mautrix.UIARequiredError
+	require.True(t, errors.As(err, &uiaErr))
+	assert.Equal(t, "xyz", uiaErr.Response.Session)
+	assert.Equal(t, "user-interactive auth required", uiaErr.Error())
+
+	// Normal 401 errors don't have flows
+	err = requestError(t, http.StatusUnauthorized, `{"errcode": "M_UNKNOWN_TOKEN", "error": "Invalid token"}`)
+	assert.False(t, errors.As(err, &uiaErr))
+	assert.ErrorIs(t, err, mautrix.MUnknownToken)
+
+	// Non-JSON responses are kept in the error
+	err = requestError(t, http.StatusBadGateway, `<html>Bad Gateway</html>`)
+	var httpErr mautrix.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.Nil(t, httpErr.RespError)
+	assert.True(t, httpErr.IsStatus(http.StatusBadGateway))
+	assert.Contains(t, httpErr.Error(), "<html>Bad Gateway</html>")
+}
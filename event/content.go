@@ -34,6 +34,7 @@ var TypeMap = map[Type]reflect.Type{
 	StatePolicyServer:      reflect.TypeOf(ModPolicyContent{}),
 	StatePolicyUser:        reflect.TypeOf(ModPolicyContent{}),
 	StateEncryption:        reflect.TypeOf(EncryptionEventContent{}),
+	StateEncrypted:         reflect.TypeOf(EncryptedEventContent{}),
 	StateBridge:            reflect.TypeOf(BridgeEventContent{}),
 	StateHalfShotBridge:    reflect.TypeOf(BridgeEventContent{}),
 	StateSpaceParent:       reflect.TypeOf(SpaceParentEventContent{}),
@@ -60,6 +61,7 @@ var TypeMap = map[Type]reflect.Type{
 	InRoomVerificationKey:    reflect.TypeOf(VerificationKeyEventContent{}),
 	InRoomVerificationMAC:    reflect.TypeOf(VerificationMacEventContent{}),
 	InRoomVerificationCancel: reflect.TypeOf(VerificationCancelEventContent{}),
+	InRoomVerificationDone:   reflect.TypeOf(VerificationDoneEventContent{}),
 
 	ToDeviceRoomKey:          reflect.TypeOf(RoomKeyEventContent{}),
 	ToDeviceForwardedRoomKey: reflect.TypeOf(ForwardedRoomKeyEventContent{}),
@@ -74,6 +76,10 @@ var TypeMap = map[Type]reflect.Type{
 	ToDeviceVerificationMAC:     reflect.TypeOf(VerificationMacEventContent{}),
 	ToDeviceVerificationCancel:  reflect.TypeOf(VerificationCancelEventContent{}),
 	ToDeviceVerificationRequest: reflect.TypeOf(VerificationRequestEventContent{}),
+	ToDeviceVerificationReady:   reflect.TypeOf(VerificationReadyEventContent{}),
+	ToDeviceVerificationDone:    reflect.TypeOf(VerificationDoneEventContent{}),
+	ToDeviceSecretRequest:       reflect.TypeOf(SecretRequestEventContent{}),
+	ToDeviceSecretSend:          reflect.TypeOf(SecretSendEventContent{}),
 
 	ToDeviceOrgMatrixRoomKeyWithheld: reflect.TypeOf(RoomKeyWithheldEventContent{}),
 
@@ -21,6 +21,8 @@ type EncryptionEventContent struct {
 	RotationPeriodMillis int64 `json:"rotation_period_ms,omitempty"`
 	// How many messages should be sent before changing the session. 100 is the recommended default.
 	RotationPeriodMessages int `json:"rotation_period_msgs,omitempty"`
+	// Whether state events can be encrypted in this room (MSC3414).
+	EncryptStateEvents bool `json:"io.element.msc3414.encrypt_state_events,omitempty"`
 }
 
 // EncryptedEventContent represents the content of a m.room.encrypted message event.
@@ -140,4 +142,27 @@ type RoomKeyWithheldEventContent struct {
 	Reason    string              `json:"reason,omitempty"`
 }
 
+type SecretRequestAction string
+
+const (
+	SecretRequestRequest      SecretRequestAction = "request"
+	SecretRequestCancellation SecretRequestAction = "request_cancellation"
+)
+
+// SecretRequestEventContent represents the content of a m.secret.request to_device event.
+// https://spec.matrix.org/v1.2/client-server-api/#msecretrequest
+type SecretRequestEventContent struct {
+	Name               id.Secret           `json:"name,omitempty"`
+	Action             SecretRequestAction `json:"action"`
+	RequestingDeviceID id.DeviceID         `json:"requesting_device_id"`
+	RequestID          string              `json:"request_id"`
+}
+
+// SecretSendEventContent represents the content of a m.secret.send to_device event.
+// https://spec.matrix.org/v1.2/client-server-api/#msecretsend
+type SecretSendEventContent struct {
+	RequestID string `json:"request_id"`
+	Secret    string `json:"secret"`
+}
+
 type DummyEventContent struct{}
@@ -24,10 +24,26 @@ type ReceiptEventContent map[id.EventID]Receipts
 
 type Receipts struct {
 	Read map[id.UserID]ReadReceipt `json:"m.read"`
+	// Private read receipts are only sent to the user who sent them.
+	ReadPrivate map[id.UserID]ReadReceipt `json:"m.read.private,omitempty"`
 }
 
+// ReceiptType is the type of a receipt, see https://spec.matrix.org/v1.4/client-server-api/#receipts
+type ReceiptType string
+
+const (
+	ReceiptTypeRead        ReceiptType = "m.read"
+	ReceiptTypeReadPrivate ReceiptType = "m.read.private"
+)
+
+// ReadReceiptThreadMain is the thread ID of receipts for the main timeline of a room, i.e. events that aren't in
+// a thread. Receipts without a thread ID apply to both the main timeline and all threads.
+const ReadReceiptThreadMain = "main"
+
 type ReadReceipt struct {
 	Timestamp int64 `json:"ts"`
+	// The thread the receipt applies to, if it's a threaded receipt.
+	ThreadID string `json:"thread_id,omitempty"`
 
 	// Extra contains any unknown fields in the read receipt event.
 	// Most servers don't allow clients to set them, so this will be empty in most cases.
@@ -53,8 +69,11 @@ func (rr *ReadReceipt) UnmarshalJSON(data []byte) error {
 	}
 	ts, _ := parsed["ts"].(float64)
 	delete(parsed, "ts")
+	threadID, _ := parsed["thread_id"].(string)
+	delete(parsed, "thread_id")
 	*rr = ReadReceipt{
 		Timestamp: int64(ts),
+		ThreadID:  threadID,
 		Extra:     parsed,
 	}
 	return nil
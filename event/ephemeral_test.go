@@ -0,0 +1,40 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+)
+
+const receiptContent = `{
+	"$event1": {
+		"m.read": {
+			"@alice:example.com": {"ts": 1661384801651, "thread_id": "$thread"},
+			"@bob:example.com": "{\"ts\": 1661384801652}"
+		},
+		"m.read.private": {
+			"@me:example.com": {"ts": 1661384801653, "thread_id": "main"}
+		}
+	}
+}`
+
+func TestReceiptEventContent_Unmarshal(t *testing.T) {
+	var content event.ReceiptEventContent
+	err := json.Unmarshal([]byte(receiptContent), &content)
+	require.NoError(t, err)
+	receipts := content["$event1"]
+	assert.Equal(t, event.ReadReceipt{Timestamp: 1661384801651, ThreadID: "$thread", Extra: map[string]interface{}{}}, receipts.Read["@alice:example.com"])
+	assert.Equal(t, int64(1661384801652), receipts.Read["@bob:example.com"].Timestamp)
+	assert.Empty(t, receipts.Read["@bob:example.com"].ThreadID)
+	assert.Equal(t, event.ReadReceiptThreadMain, receipts.ReadPrivate["@me:example.com"].ThreadID)
+}
@@ -105,6 +105,41 @@ func (evt *Event) MarshalJSON() ([]byte, error) {
 
 type MautrixInfo struct {
 	Verified bool
+
+	// TrustState contains details about the keys used to decrypt the event. Only set for decrypted events.
+	TrustState *TrustState
+}
+
+// KeySource describes how the megolm session used to decrypt an event was received.
+type KeySource string
+
+const (
+	// KeySourceUnknown is used for sessions stored before the source was tracked.
+	KeySourceUnknown KeySource = ""
+	// KeySourceDirect means the session was received directly from the sender in a m.room_key event.
+	KeySourceDirect KeySource = "direct"
+	// KeySourceForwarded means the session was forwarded by another device in a m.forwarded_room_key event.
+	KeySourceForwarded KeySource = "forwarded"
+	// KeySourceImport means the session was imported from a key export file.
+	KeySourceImport KeySource = "import"
+	// KeySourceBackup means the session was restored from server-side key backup.
+	KeySourceBackup KeySource = "backup"
+)
+
+// TrustState contains trust metadata about a decrypted event, which clients can use to decorate events
+// (e.g. "encrypted by an unverified device") without querying the crypto store again.
+type TrustState struct {
+	// Whether the device that sent the event has been verified directly (e.g. with emoji verification).
+	DeviceVerified bool
+	// Whether the device that sent the event is signed by its owner's self-signing key.
+	CrossSigned bool
+	// Whether the owner of the device is trusted through our user-signing key (always true for our own user
+	// if our cross-signing keys are available).
+	UserTrusted bool
+	// The number of devices the megolm session was forwarded through before we received it.
+	ForwardingChainLength int
+	// How the megolm session was received.
+	KeySource KeySource
 }
 
 func (evt *Event) GetStateKey() string {
@@ -7,6 +7,10 @@
 package event
 
 import (
+	"net"
+	"regexp"
+	"strings"
+
 	"maunium.net/go/mautrix/id"
 )
 
@@ -37,6 +41,44 @@ type ServerACLEventContent struct {
 	Deny            []string `json:"deny,omitempty"`
 }
 
+func matchACLGlob(pattern, serverName string) bool {
+	// ACL globs only support * and ?, so everything else is quoted
+	regex := regexp.QuoteMeta(pattern)
+	regex = strings.ReplaceAll(regex, `\*`, ".*")
+	regex = strings.ReplaceAll(regex, `\?`, ".")
+	matched, _ := regexp.MatchString("^"+regex+"$", serverName)
+	return matched
+}
+
+// IsAllowed checks whether the given server is allowed to participate in the room according to the ACL.
+// The server name may include a port, which is ignored.
+func (acl *ServerACLEventContent) IsAllowed(serverName string) bool {
+	host := serverName
+	if h, _, err := net.SplitHostPort(serverName); err == nil {
+		host = h
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	if !acl.AllowIPLiterals && net.ParseIP(host) != nil {
+		return false
+	}
+	if strings.Contains(host, ":") {
+		// Bring IPv6 literals back to the bracketed form used in server names
+		host = "[" + host + "]"
+	}
+	for _, pattern := range acl.Deny {
+		if matchACLGlob(pattern, host) {
+			return false
+		}
+	}
+	for _, pattern := range acl.Allow {
+		if matchACLGlob(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
 // TopicEventContent represents the content of a m.room.topic state event.
 // https://matrix.org/docs/spec/client_server/r0.6.0#m-room-topic
 type TopicEventContent struct {
@@ -68,16 +110,49 @@ type CreateEventContent struct {
 type JoinRule string
 
 const (
-	JoinRulePublic  JoinRule = "public"
-	JoinRuleKnock   JoinRule = "knock"
-	JoinRuleInvite  JoinRule = "invite"
-	JoinRulePrivate JoinRule = "private"
+	JoinRulePublic          JoinRule = "public"
+	JoinRuleKnock           JoinRule = "knock"
+	JoinRuleInvite          JoinRule = "invite"
+	JoinRulePrivate         JoinRule = "private"
+	JoinRuleRestricted      JoinRule = "restricted"
+	JoinRuleKnockRestricted JoinRule = "knock_restricted"
+)
+
+// JoinRuleAllowType is the type of a condition in the allow list of restricted join rules.
+type JoinRuleAllowType string
+
+const (
+	// JoinRuleAllowRoomMembership allows users who are joined to the given room.
+	JoinRuleAllowRoomMembership JoinRuleAllowType = "m.room_membership"
 )
 
+// JoinRuleAllow is a condition in the allow list of restricted join rules.
+type JoinRuleAllow struct {
+	Type   JoinRuleAllowType `json:"type"`
+	RoomID id.RoomID         `json:"room_id,omitempty"`
+}
+
 // JoinRulesEventContent represents the content of a m.room.join_rules state event.
-// https://matrix.org/docs/spec/client_server/r0.6.0#m-room-join-rules
+// https://spec.matrix.org/v1.3/client-server-api/#mroomjoin_rules
 type JoinRulesEventContent struct {
-	JoinRule JoinRule `json:"join_rule"`
+	JoinRule JoinRule        `json:"join_rule"`
+	Allow    []JoinRuleAllow `json:"allow,omitempty"`
+}
+
+// IsRestricted returns whether the join rule allows joining based on membership in other rooms.
+func (jr *JoinRulesEventContent) IsRestricted() bool {
+	return jr.JoinRule == JoinRuleRestricted || jr.JoinRule == JoinRuleKnockRestricted
+}
+
+// AllowedRooms returns the rooms whose members are allowed to join by restricted join rules.
+func (jr *JoinRulesEventContent) AllowedRooms() []id.RoomID {
+	var rooms []id.RoomID
+	for _, allow := range jr.Allow {
+		if allow.Type == JoinRuleAllowRoomMembership && len(allow.RoomID) > 0 {
+			rooms = append(rooms, allow.RoomID)
+		}
+	}
+	return rooms
 }
 
 // PinnedEventsEventContent represents the content of a m.room.pinned_events state event.
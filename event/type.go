@@ -83,7 +83,8 @@ func (et *Type) IsToDevice() bool {
 func (et *Type) IsInRoomVerification() bool {
 	switch et.Type {
 	case InRoomVerificationStart.Type, InRoomVerificationReady.Type, InRoomVerificationAccept.Type,
-		InRoomVerificationKey.Type, InRoomVerificationMAC.Type, InRoomVerificationCancel.Type:
+		InRoomVerificationKey.Type, InRoomVerificationMAC.Type, InRoomVerificationCancel.Type,
+		InRoomVerificationDone.Type:
 		return true
 	default:
 		return false
@@ -115,15 +116,17 @@ func (et *Type) GuessClass() TypeClass {
 		return EphemeralEventType
 	case AccountDataDirectChats.Type, AccountDataPushRules.Type, AccountDataRoomTags.Type,
 		AccountDataSecretStorageKey.Type, AccountDataSecretStorageDefaultKey.Type,
-		AccountDataCrossSigningMaster.Type, AccountDataCrossSigningSelf.Type, AccountDataCrossSigningUser.Type:
+		AccountDataCrossSigningMaster.Type, AccountDataCrossSigningSelf.Type, AccountDataCrossSigningUser.Type,
+		AccountDataMegolmBackupKey.Type:
 		return AccountDataEventType
 	case EventRedaction.Type, EventMessage.Type, EventEncrypted.Type, EventReaction.Type, EventSticker.Type,
 		InRoomVerificationStart.Type, InRoomVerificationReady.Type, InRoomVerificationAccept.Type,
 		InRoomVerificationKey.Type, InRoomVerificationMAC.Type, InRoomVerificationCancel.Type,
-		CallInvite.Type, CallCandidates.Type, CallAnswer.Type, CallReject.Type, CallSelectAnswer.Type,
+		InRoomVerificationDone.Type, CallInvite.Type, CallCandidates.Type, CallAnswer.Type, CallReject.Type, CallSelectAnswer.Type,
 		CallNegotiate.Type, CallHangup.Type:
 		return MessageEventType
-	case ToDeviceRoomKey.Type, ToDeviceRoomKeyRequest.Type, ToDeviceForwardedRoomKey.Type, ToDeviceRoomKeyWithheld.Type:
+	case ToDeviceRoomKey.Type, ToDeviceRoomKeyRequest.Type, ToDeviceForwardedRoomKey.Type, ToDeviceRoomKeyWithheld.Type,
+		ToDeviceSecretRequest.Type, ToDeviceSecretSend.Type:
 		return ToDeviceEventType
 	default:
 		return UnknownEventType
@@ -181,6 +184,7 @@ var (
 	StatePolicyServer      = Type{"m.policy.rule.server", StateEventType}
 	StatePolicyUser        = Type{"m.policy.rule.user", StateEventType}
 	StateEncryption        = Type{"m.room.encryption", StateEventType}
+	StateEncrypted         = Type{"m.room.encrypted", StateEventType}
 	StateBridge            = Type{"m.bridge", StateEventType}
 	StateHalfShotBridge    = Type{"uk.half-shot.bridge", StateEventType}
 	StateSpaceChild        = Type{"m.space.child", StateEventType}
@@ -201,6 +205,7 @@ var (
 	InRoomVerificationKey    = Type{"m.key.verification.key", MessageEventType}
 	InRoomVerificationMAC    = Type{"m.key.verification.mac", MessageEventType}
 	InRoomVerificationCancel = Type{"m.key.verification.cancel", MessageEventType}
+	InRoomVerificationDone   = Type{"m.key.verification.done", MessageEventType}
 
 	CallInvite       = Type{"m.call.invite", MessageEventType}
 	CallCandidates   = Type{"m.call.candidates", MessageEventType}
@@ -231,6 +236,7 @@ var (
 	AccountDataCrossSigningMaster      = Type{"m.cross_signing.master", AccountDataEventType}
 	AccountDataCrossSigningUser        = Type{"m.cross_signing.user_signing", AccountDataEventType}
 	AccountDataCrossSigningSelf        = Type{"m.cross_signing.self_signing", AccountDataEventType}
+	AccountDataMegolmBackupKey         = Type{"m.megolm_backup.v1", AccountDataEventType}
 )
 
 // Device-to-device events
@@ -242,11 +248,15 @@ var (
 	ToDeviceRoomKeyWithheld     = Type{"m.room_key.withheld", ToDeviceEventType}
 	ToDeviceDummy               = Type{"m.dummy", ToDeviceEventType}
 	ToDeviceVerificationRequest = Type{"m.key.verification.request", ToDeviceEventType}
+	ToDeviceVerificationReady   = Type{"m.key.verification.ready", ToDeviceEventType}
 	ToDeviceVerificationStart   = Type{"m.key.verification.start", ToDeviceEventType}
 	ToDeviceVerificationAccept  = Type{"m.key.verification.accept", ToDeviceEventType}
 	ToDeviceVerificationKey     = Type{"m.key.verification.key", ToDeviceEventType}
 	ToDeviceVerificationMAC     = Type{"m.key.verification.mac", ToDeviceEventType}
 	ToDeviceVerificationCancel  = Type{"m.key.verification.cancel", ToDeviceEventType}
+	ToDeviceVerificationDone    = Type{"m.key.verification.done", ToDeviceEventType}
+	ToDeviceSecretRequest       = Type{"m.secret.request", ToDeviceEventType}
+	ToDeviceSecretSend          = Type{"m.secret.send", ToDeviceEventType}
 
 	ToDeviceOrgMatrixRoomKeyWithheld = Type{"org.matrix.room_key.withheld", ToDeviceEventType}
 )
@@ -12,7 +12,13 @@ import (
 
 type VerificationMethod string
 
-const VerificationMethodSAS VerificationMethod = "m.sas.v1"
+const (
+	VerificationMethodSAS VerificationMethod = "m.sas.v1"
+
+	VerificationMethodQRCodeShow  VerificationMethod = "m.qr_code.show.v1"
+	VerificationMethodQRCodeScan  VerificationMethod = "m.qr_code.scan.v1"
+	VerificationMethodReciprocate VerificationMethod = "m.reciprocate.v1"
+)
 
 // VerificationRequestEventContent represents the content of a m.key.verification.request to_device event.
 // https://matrix.org/docs/spec/client_server/r0.6.0#m-key-verification-request
@@ -72,13 +78,15 @@ type VerificationStartEventContent struct {
 	// The verification method to use.
 	Method VerificationMethod `json:"method"`
 	// The key agreement protocols the sending device understands.
-	KeyAgreementProtocols []KeyAgreementProtocol `json:"key_agreement_protocols"`
+	KeyAgreementProtocols []KeyAgreementProtocol `json:"key_agreement_protocols,omitempty"`
 	// The hash methods the sending device understands.
-	Hashes []VerificationHashMethod `json:"hashes"`
+	Hashes []VerificationHashMethod `json:"hashes,omitempty"`
 	// The message authentication codes that the sending device understands.
-	MessageAuthenticationCodes []MACMethod `json:"message_authentication_codes"`
+	MessageAuthenticationCodes []MACMethod `json:"message_authentication_codes,omitempty"`
 	// The SAS methods the sending device (and the sending device's user) understands.
-	ShortAuthenticationString []SASMethod `json:"short_authentication_string"`
+	ShortAuthenticationString []SASMethod `json:"short_authentication_string,omitempty"`
+	// The shared secret from the scanned QR code when the method is m.reciprocate.v1.
+	Secret string `json:"secret,omitempty"`
 	// The user that the event is sent to for in-room verification.
 	To id.UserID `json:"to,omitempty"`
 	// Original event ID for in-room verification.
@@ -140,6 +148,8 @@ func (vsec *VerificationStartEventContent) SetRelatesTo(rel *RelatesTo) {
 type VerificationReadyEventContent struct {
 	// The device ID which accepted the process.
 	FromDevice id.DeviceID `json:"from_device"`
+	// The transaction ID of the verification request, only used for to-device verification.
+	TransactionID string `json:"transaction_id,omitempty"`
 	// The verification methods supported by the sender.
 	Methods []VerificationMethod `json:"methods"`
 	// Original event ID for in-room verification.
@@ -148,6 +158,15 @@ type VerificationReadyEventContent struct {
 
 var _ Relatable = (*VerificationReadyEventContent)(nil)
 
+func (vrec *VerificationReadyEventContent) SupportsVerificationMethod(meth VerificationMethod) bool {
+	for _, supportedMeth := range vrec.Methods {
+		if supportedMeth == meth {
+			return true
+		}
+	}
+	return false
+}
+
 func (vrec *VerificationReadyEventContent) GetRelatesTo() *RelatesTo {
 	if vrec.RelatesTo == nil {
 		vrec.RelatesTo = &RelatesTo{}
@@ -304,3 +323,28 @@ func (vcec *VerificationCancelEventContent) OptionalGetRelatesTo() *RelatesTo {
 func (vcec *VerificationCancelEventContent) SetRelatesTo(rel *RelatesTo) {
 	vcec.RelatesTo = rel
 }
+
+// VerificationDoneEventContent represents the content of a m.key.verification.done event.
+type VerificationDoneEventContent struct {
+	// The opaque identifier for the verification process, only used for to-device verification.
+	TransactionID string `json:"transaction_id,omitempty"`
+	// Original event ID for in-room verification.
+	RelatesTo *RelatesTo `json:"m.relates_to,omitempty"`
+}
+
+var _ Relatable = (*VerificationDoneEventContent)(nil)
+
+func (vdec *VerificationDoneEventContent) GetRelatesTo() *RelatesTo {
+	if vdec.RelatesTo == nil {
+		vdec.RelatesTo = &RelatesTo{}
+	}
+	return vdec.RelatesTo
+}
+
+func (vdec *VerificationDoneEventContent) OptionalGetRelatesTo() *RelatesTo {
+	return vdec.RelatesTo
+}
+
+func (vdec *VerificationDoneEventContent) SetRelatesTo(rel *RelatesTo) {
+	vdec.RelatesTo = rel
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// allTypes is used in NotTypes to filter out all events of a category.
+var allTypes = []event.Type{{Type: "*"}}
+
+// FilterBuilder builds sync filters with chainable methods, e.g.
+//
+//	filter := mautrix.NewFilterBuilder().
+//		LazyLoadMembers().
+//		TimelineLimit(50).
+//		NotTimelineTypes(event.EventReaction).
+//		NoPresence().
+//		Build()
+type FilterBuilder struct {
+	filter Filter
+}
+
+// NewFilterBuilder creates a builder for an empty filter, which doesn't filter anything.
+func NewFilterBuilder() *FilterBuilder {
+	return &FilterBuilder{}
+}
+
+// LazyLoadMembers makes the server only send the member events that are needed to display the returned timeline
+// events, which makes syncing large rooms much faster.
+func (fb *FilterBuilder) LazyLoadMembers() *FilterBuilder {
+	fb.filter.Room.State.LazyLoadMembers = true
+	fb.filter.Room.Timeline.LazyLoadMembers = true
+	return fb
+}
+
+// TimelineLimit sets the maximum number of timeline events to return per room.
+func (fb *FilterBuilder) TimelineLimit(limit int) *FilterBuilder {
+	fb.filter.Room.Timeline.Limit = limit
+	return fb
+}
+
+// TimelineTypes only includes timeline events of the given types. Types may end with * to match prefixes.
+func (fb *FilterBuilder) TimelineTypes(types ...event.Type) *FilterBuilder {
+	fb.filter.Room.Timeline.Types = append(fb.filter.Room.Timeline.Types, types...)
+	return fb
+}
+
+// NotTimelineTypes excludes timeline events of the given types. Types may end with * to match prefixes.
+func (fb *FilterBuilder) NotTimelineTypes(types ...event.Type) *FilterBuilder {
+	fb.filter.Room.Timeline.NotTypes = append(fb.filter.Room.Timeline.NotTypes, types...)
+	return fb
+}
+
+// StateTypes only includes state events of the given types.
+func (fb *FilterBuilder) StateTypes(types ...event.Type) *FilterBuilder {
+	fb.filter.Room.State.Types = append(fb.filter.Room.State.Types, types...)
+	return fb
+}
+
+// NotStateTypes excludes state events of the given types.
+func (fb *FilterBuilder) NotStateTypes(types ...event.Type) *FilterBuilder {
+	fb.filter.Room.State.NotTypes = append(fb.filter.Room.State.NotTypes, types...)
+	return fb
+}
+
+// NotSenders excludes timeline events sent by the given users.
+func (fb *FilterBuilder) NotSenders(userIDs ...id.UserID) *FilterBuilder {
+	fb.filter.Room.Timeline.NotSenders = append(fb.filter.Room.Timeline.NotSenders, userIDs...)
+	return fb
+}
+
+// Rooms only includes the given rooms in the sync.
+func (fb *FilterBuilder) Rooms(roomIDs ...id.RoomID) *FilterBuilder {
+	fb.filter.Room.Rooms = append(fb.filter.Room.Rooms, roomIDs...)
+	return fb
+}
+
+// NotRooms excludes the given rooms from the sync.
+func (fb *FilterBuilder) NotRooms(roomIDs ...id.RoomID) *FilterBuilder {
+	fb.filter.Room.NotRooms = append(fb.filter.Room.NotRooms, roomIDs...)
+	return fb
+}
+
+// IncludeLeave includes rooms that the user has left in the sync.
+func (fb *FilterBuilder) IncludeLeave() *FilterBuilder {
+	fb.filter.Room.IncludeLeave = true
+	return fb
+}
+
+// NoPresence excludes all presence events.
+func (fb *FilterBuilder) NoPresence() *FilterBuilder {
+	fb.filter.Presence.NotTypes = allTypes
+	return fb
+}
+
+// NoAccountData excludes all global and room account data events.
+func (fb *FilterBuilder) NoAccountData() *FilterBuilder {
+	fb.filter.AccountData.NotTypes = allTypes
+	fb.filter.Room.AccountData.NotTypes = allTypes
+	return fb
+}
+
+// NoEphemeral excludes all ephemeral room events, i.e. typing notifications and read receipts.
+func (fb *FilterBuilder) NoEphemeral() *FilterBuilder {
+	fb.filter.Room.Ephemeral.NotTypes = allTypes
+	return fb
+}
+
+// EventFields only includes the given fields in events, e.g. "type" or "content.body".
+func (fb *FilterBuilder) EventFields(fields ...string) *FilterBuilder {
+	fb.filter.EventFields = append(fb.filter.EventFields, fields...)
+	return fb
+}
+
+// Build returns a copy of the built filter. The builder can be used to build more filters afterwards.
+func (fb *FilterBuilder) Build() *Filter {
+	data, err := json.Marshal(&fb.filter)
+	if err != nil {
+		panic(fmt.Errorf("failed to marshal filter: %w", err))
+	}
+	var filter Filter
+	err = json.Unmarshal(data, &filter)
+	if err != nil {
+		panic(fmt.Errorf("failed to unmarshal filter: %w", err))
+	}
+	return &filter
+}
+
+// GetOrCreateFilter uploads the given filter to the server and returns the filter ID. The filter IDs are cached per
+// user and filter content, so uploading the same filter again doesn't make a new request.
+func (cli *Client) GetOrCreateFilter(filter *Filter) (string, error) {
+	filterJSON, err := json.Marshal(filter)
+	if err != nil {
+		return "", err
+	}
+	cacheKey := cli.UserID.String() + "|" + string(filterJSON)
+	cli.filterLock.Lock()
+	filterID, ok := cli.filterCache[cacheKey]
+	cli.filterLock.Unlock()
+	if ok {
+		return filterID, nil
+	}
+	resp, err := cli.CreateFilter(filter)
+	if err != nil {
+		return "", err
+	}
+	cli.filterLock.Lock()
+	if cli.filterCache == nil {
+		cli.filterCache = make(map[string]string)
+	}
+	cli.filterCache[cacheKey] = resp.FilterID
+	cli.filterLock.Unlock()
+	return resp.FilterID, nil
+}
+
+// SetSyncFilter uploads the given filter and makes Sync use it from the next sync request onwards, without having to
+// restart syncing. The filter ID is also saved in the store, so it's used after restarts too.
+func (cli *Client) SetSyncFilter(filter *Filter) error {
+	filterID, err := cli.GetOrCreateFilter(cli.applySyncFilterOptions(filter))
+	if err != nil {
+		return fmt.Errorf("failed to upload filter: %w", err)
+	}
+	if err = cli.saveFilterID(filterID); err != nil {
+		return fmt.Errorf("failed to save filter ID: %w", err)
+	}
+	cli.filterLock.Lock()
+	cli.nextSyncFilterID = filterID
+	cli.filterLock.Unlock()
+	return nil
+}
+
+// takeSyncFilterChange returns the filter ID set with SetSyncFilter since the last call, or an empty string.
+func (cli *Client) takeSyncFilterChange() string {
+	cli.filterLock.Lock()
+	defer cli.filterLock.Unlock()
+	filterID := cli.nextSyncFilterID
+	cli.nextSyncFilterID = ""
+	return filterID
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestFilterBuilder_Build(t *testing.T) {
+	builder := mautrix.NewFilterBuilder().
+		LazyLoadMembers().
+		TimelineLimit(50).
+		TimelineTypes(event.EventMessage).
+		NotTimelineTypes(event.EventReaction).
+		StateTypes(event.StateMember).
+		NotStateTypes(event.StateTopic).
+		NotSenders("@bot:example.com").
+		Rooms("!a:example.com").
+		NotRooms("!b:example.com").
+		IncludeLeave().
+		NoPresence().
+		NoAccountData().
+		NoEphemeral().
+		EventFields("type", "content.body")
+	data, err := json.Marshal(builder.Build())
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"account_data": {"not_types": ["*"]},
+		"event_fields": ["type", "content.body"],
+		"presence": {"not_types": ["*"]},
+		"room": {
+			"account_data": {"not_types": ["*"]},
+			"ephemeral": {"not_types": ["*"]},
+			"include_leave": true,
+			"not_rooms": ["!b:example.com"],
+			"rooms": ["!a:example.com"],
+			"state": {"lazy_load_members": true, "types": ["m.room.member"], "not_types": ["m.room.topic"]},
+			"timeline": {
+				"lazy_load_members": true,
+				"limit": 50,
+				"types": ["m.room.message"],
+				"not_types": ["m.reaction"],
+				"not_senders": ["@bot:example.com"]
+			}
+		}
+	}`, string(data))
+
+	empty, err := json.Marshal(mautrix.NewFilterBuilder().Build())
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"account_data": {}, "presence": {}, "room": {"account_data": {}, "ephemeral": {}, "state": {}, "timeline": {}}}`, string(empty))
+}
+
+func TestFilterBuilder_BuildCopies(t *testing.T) {
+	builder := mautrix.NewFilterBuilder().NotTimelineTypes(event.EventReaction)
+	first := builder.Build()
+	first.Room.Timeline.NotTypes[0] = event.EventRedaction
+
+	// Further changes to the builder don't affect filters that were already built
+	second := builder.NotTimelineTypes(event.EventSticker).Build()
+	assert.Equal(t, []event.Type{event.EventRedaction}, first.Room.Timeline.NotTypes)
+	assert.Equal(t, []event.Type{event.EventReaction, event.EventSticker}, second.Room.Timeline.NotTypes)
+}
+
+func TestClient_GetOrCreateFilter(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("POST /_matrix/client/r0/user/@user:example.com/filter", `{"filter_id": "1"}`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	filterID, err := cli.GetOrCreateFilter(mautrix.NewFilterBuilder().TimelineLimit(10).Build())
+	require.NoError(t, err)
+	assert.Equal(t, "1", filterID)
+	req := srv.LastRequest(t)
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.JSONEq(t, `{"account_data": {}, "presence": {}, "room": {"account_data": {}, "ephemeral": {}, "state": {}, "timeline": {"limit": 10}}}`, req.Body)
+
+	// The same filter isn't uploaded again
+	filterID, err = cli.GetOrCreateFilter(mautrix.NewFilterBuilder().TimelineLimit(10).Build())
+	require.NoError(t, err)
+	assert.Equal(t, "1", filterID)
+	assert.Empty(t, srv.Requests())
+
+	srv.Respond("POST /_matrix/client/r0/user/@user:example.com/filter", `{"filter_id": "2"}`)
+	filterID, err = cli.GetOrCreateFilter(mautrix.NewFilterBuilder().TimelineLimit(20).Build())
+	require.NoError(t, err)
+	assert.Equal(t, "2", filterID)
+	srv.LastRequest(t)
+
+	// Filters are cached per user
+	cli.UserID = "@other:example.com"
+	srv.Respond("POST /_matrix/client/r0/user/@other:example.com/filter", `{"filter_id": "3"}`)
+	filterID, err = cli.GetOrCreateFilter(mautrix.NewFilterBuilder().TimelineLimit(10).Build())
+	require.NoError(t, err)
+	assert.Equal(t, "3", filterID)
+	assert.Equal(t, "/_matrix/client/r0/user/@other:example.com/filter", srv.LastRequest(t).Path)
+
+	// Errors aren't cached
+	srv.RespondStatus("POST /_matrix/client/r0/user/@other:example.com/filter", http.StatusBadRequest, `{"errcode": "M_BAD_JSON", "error": "Invalid filter"}`)
+	_, err = cli.GetOrCreateFilter(mautrix.NewFilterBuilder().TimelineLimit(30).Build())
+	assert.ErrorIs(t, err, mautrix.MBadJSON)
+	srv.Respond("POST /_matrix/client/r0/user/@other:example.com/filter", `{"filter_id": "4"}`)
+	filterID, err = cli.GetOrCreateFilter(mautrix.NewFilterBuilder().TimelineLimit(30).Build())
+	require.NoError(t, err)
+	assert.Equal(t, "4", filterID)
+}
+
+func TestClient_SetSyncFilter(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("POST /_matrix/client/r0/user/@user:example.com/filter", `{"filter_id": "1"}`)
+	srv.Respond("GET /_matrix/client/r0/sync", `{"next_batch": "n"}`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	syncer := mautrix.NewDefaultSyncer()
+	syncs := 0
+	var setErr error
+	syncer.OnSync(func(resp *mautrix.RespSync, since string) bool {
+		syncs++
+		if syncs == 1 {
+			// The new filter is used from the next request onwards without restarting the sync loop
+			srv.Respond("POST /_matrix/client/r0/user/@user:example.com/filter", `{"filter_id": "2"}`)
+			setErr = cli.SetSyncFilter(mautrix.NewFilterBuilder().NoPresence().Build())
+		} else {
+			cli.StopSync()
+		}
+		return true
+	})
+	cli.Syncer = syncer
+	require.NoError(t, cli.Sync())
+	require.NoError(t, setErr)
+
+	var syncFilters []string
+	for _, req := range srv.Requests() {
+		if req.Method == http.MethodGet {
+			syncFilters = append(syncFilters, req.Query.Get("filter"))
+		} else {
+			assert.Equal(t, "/_matrix/client/r0/user/@user:example.com/filter", req.Path)
+		}
+	}
+	assert.Equal(t, []string{"1", "2", "2"}, syncFilters)
+	// The filter ID is saved, so it's used after restarts too
+	assert.Equal(t, "2", cli.Store.LoadFilterID(cli.UserID))
+
+	srv.RespondStatus("POST /_matrix/client/r0/user/@user:example.com/filter", http.StatusBadRequest, `{"errcode": "M_BAD_JSON", "error": "Invalid filter"}`)
+	err := cli.SetSyncFilter(mautrix.NewFilterBuilder().NoEphemeral().Build())
+	assert.ErrorIs(t, err, mautrix.MBadJSON)
+	assert.Equal(t, "2", cli.Store.LoadFilterID(cli.UserID))
+}
+
+func TestClient_SetSyncFilter_DisableSyncPresence(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("POST /_matrix/client/r0/user/@user:example.com/filter", `{"filter_id": "1"}`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+	cli.DisableSyncPresence = true
+
+	filter := mautrix.NewFilterBuilder().TimelineLimit(10).Build()
+	require.NoError(t, cli.SetSyncFilter(filter))
+	var uploaded mautrix.Filter
+	require.NoError(t, json.Unmarshal([]byte(srv.LastRequest(t).Body), &uploaded))
+	assert.Equal(t, []event.Type{{Type: "*"}}, uploaded.Presence.NotTypes)
+	assert.Equal(t, 10, uploaded.Room.Timeline.Limit)
+	// The given filter isn't modified
+	assert.Empty(t, filter.Presence.NotTypes)
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// TimelineGapFiller fetches the events that are missing from limited (gappy) timelines in /sync responses and adds
+// them to the beginning of the timeline, so that handlers receive every message in order even if the server skipped
+// some, e.g. after the bot was offline for a while.
+//
+// The gap is filled by paginating backwards from the prev_batch token of the timeline up to the since token of the
+// sync request, so nothing is filled in the first sync after startup. Only joined rooms are filled.
+type TimelineGapFiller struct {
+	Client *Client
+	// MaxEvents is the maximum number of events to fetch for a single gap. If the gap is bigger, only the most recent
+	// events are added and the timeline stays marked as limited.
+	MaxEvents int
+	// PageSize is the number of events to request per /messages call.
+	PageSize int
+	// Filter is an optional filter for the fetched events, which should usually match the timeline filter of the sync.
+	Filter *FilterPart
+	// OnGap is called after a gap has been filled with the number of events that were added and whether the whole
+	// gap was filled.
+	OnGap func(roomID id.RoomID, added int, complete bool)
+}
+
+// NewTimelineGapFiller creates a gap filler that fetches up to 500 events per gap.
+func NewTimelineGapFiller(cli *Client) *TimelineGapFiller {
+	return &TimelineGapFiller{
+		Client:    cli,
+		MaxEvents: 500,
+		PageSize:  100,
+	}
+}
+
+// Register adds the gap filler to the given syncer. It's registered with the state store priority, so that it runs
+// before normal sync handlers and all event handlers.
+func (gf *TimelineGapFiller) Register(syncer *DefaultSyncer) {
+	syncer.OnSyncWithPriority(PriorityStateStore, gf.ProcessSync)
+}
+
+// ProcessSync fills the gaps in the limited timelines of the given sync response. It always returns true, failing
+// to fetch a gap only means that the events are missing like they would be without the gap filler.
+func (gf *TimelineGapFiller) ProcessSync(resp *RespSync, since string) bool {
+	if len(since) == 0 {
+		return true
+	}
+	for roomID, room := range resp.Rooms.Join {
+		if !room.Timeline.Limited || len(room.Timeline.PrevBatch) == 0 {
+			continue
+		}
+		missed, prevBatch, complete := gf.fetchGap(roomID, room.Timeline.PrevBatch, since, room.Timeline.Events)
+		if len(missed) > 0 {
+			room.Timeline.Events = append(missed, room.Timeline.Events...)
+		}
+		room.Timeline.Limited = !complete
+		room.Timeline.PrevBatch = prevBatch
+		resp.Rooms.Join[roomID] = room
+		if gf.OnGap != nil {
+			gf.OnGap(roomID, len(missed), complete)
+		}
+	}
+	return true
+}
+
+// fetchGap paginates backwards from the given token to the since token and returns the missed events in
+// chronological order, the token to continue paginating from and whether the whole gap was fetched.
+func (gf *TimelineGapFiller) fetchGap(roomID id.RoomID, from, since string, timeline []*event.Event) ([]*event.Event, string, bool) {
+	seen := make(map[id.EventID]struct{}, len(timeline))
+	for _, evt := range timeline {
+		seen[evt.ID] = struct{}{}
+	}
+	var missed []*event.Event
+	for len(missed) < gf.MaxEvents {
+		limit := gf.PageSize
+		if remaining := gf.MaxEvents - len(missed); limit <= 0 || limit > remaining {
+			limit = remaining
+		}
+		resp, err := gf.Client.Messages(roomID, from, since, 'b', gf.Filter, limit)
+		if err != nil {
+			gf.Client.logWarning("Failed to fetch missed events in %s: %v", roomID, err)
+			break
+		}
+		for _, evt := range resp.Chunk {
+			if _, ok := seen[evt.ID]; !ok {
+				seen[evt.ID] = struct{}{}
+				missed = append(missed, evt)
+			}
+		}
+		if len(resp.Chunk) == 0 || len(resp.End) == 0 || resp.End == from {
+			reverseEvents(missed)
+			return missed, from, true
+		}
+		from = resp.End
+	}
+	reverseEvents(missed)
+	return missed, from, false
+}
+
+func reverseEvents(evts []*event.Event) {
+	for i, j := 0, len(evts)-1; i < j; i, j = i+1, j-1 {
+		evts[i], evts[j] = evts[j], evts[i]
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// gapTestServer serves /messages for a room with the events $1 to $10. The pagination token tN points to the
+// position after the Nth event, so paginating backwards from t10 returns $10 first.
+type gapTestServer struct {
+	*httptest.Server
+	lock    sync.Mutex
+	queries []url.Values
+}
+
+func newGapTestServer() *gapTestServer {
+	srv := &gapTestServer{}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		srv.lock.Lock()
+		srv.queries = append(srv.queries, query)
+		srv.lock.Unlock()
+		if r.URL.Path != "/_matrix/client/r0/rooms/!room:example.com/messages" {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN", "error": "Internal error"}`))
+			return
+		}
+		from, _ := strconv.Atoi(strings.TrimPrefix(query.Get("from"), "t"))
+		to, _ := strconv.Atoi(strings.TrimPrefix(query.Get("to"), "t"))
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		var chunk []string
+		pos := from
+		for ; pos > to && len(chunk) < limit; pos-- {
+			chunk = append(chunk, fmt.Sprintf(`{"type": "m.room.message", "event_id": "$%d", "content": {"msgtype": "m.text", "body": "%d"}}`, pos, pos))
+		}
+		end := ""
+		if pos > to {
+			end = fmt.Sprintf(`, "end": "t%d"`, pos)
+		}
+		_, _ = fmt.Fprintf(w, `{"start": "t%d", "chunk": [%s]%s}`, from, strings.Join(chunk, ","), end)
+	}))
+	return srv
+}
+
+// Queries returns and clears the queries of the /messages requests the server received.
+func (srv *gapTestServer) Queries() []url.Values {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	queries := srv.queries
+	srv.queries = nil
+	return queries
+}
+
+// newGapSyncResponse returns a sync response with a limited timeline containing $9 and $10, which starts from t10.
+func newGapSyncResponse(t *testing.T, roomID id.RoomID) *mautrix.RespSync {
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(`{"next_batch": "t10", "rooms": {"join": {"`+roomID+`": {"timeline": {
+		"limited": true,
+		"prev_batch": "t10",
+		"events": [
+			{"type": "m.room.message", "event_id": "$9", "content": {"msgtype": "m.text", "body": "9"}},
+			{"type": "m.room.message", "event_id": "$10", "content": {"msgtype": "m.text", "body": "10"}}
+		]
+	}}}}}`), &resp))
+	return &resp
+}
+
+func timelineEventIDs(resp *mautrix.RespSync, roomID id.RoomID) []id.EventID {
+	var ids []id.EventID
+	for _, evt := range resp.Rooms.Join[roomID].Timeline.Events {
+		ids = append(ids, evt.ID)
+	}
+	return ids
+}
+
+func newGapFiller(t *testing.T, srv *gapTestServer) *mautrix.TimelineGapFiller {
+	cli := mautrix.NewTestClient(t, srv.URL)
+	filler := mautrix.NewTimelineGapFiller(cli)
+	filler.PageSize = 3
+	return filler
+}
+
+type gapResult struct {
+	RoomID   id.RoomID
+	Added    int
+	Complete bool
+}
+
+func TestTimelineGapFiller(t *testing.T) {
+	srv := newGapTestServer()
+	defer srv.Close()
+	filler := newGapFiller(t, srv)
+	var gaps []gapResult
+	filler.OnGap = func(roomID id.RoomID, added int, complete bool) {
+		gaps = append(gaps, gapResult{roomID, added, complete})
+	}
+
+	// The previous sync ended after $3
+	resp := newGapSyncResponse(t, "!room:example.com")
+	assert.True(t, filler.ProcessSync(resp, "t3"))
+	// The missed events are added in order without duplicating the events that were already in the timeline
+	assert.Equal(t, []id.EventID{"$4", "$5", "$6", "$7", "$8", "$9", "$10"}, timelineEventIDs(resp, "!room:example.com"))
+	assert.False(t, resp.Rooms.Join["!room:example.com"].Timeline.Limited)
+	assert.Equal(t, []gapResult{{"!room:example.com", 5, true}}, gaps)
+
+	queries := srv.Queries()
+	require.Len(t, queries, 3)
+	assert.Equal(t, url.Values{"from": {"t10"}, "to": {"t3"}, "dir": {"b"}, "limit": {"3"}}, queries[0])
+	assert.Equal(t, "t7", queries[1].Get("from"))
+	assert.Equal(t, "t4", queries[2].Get("from"))
+}
+
+func TestTimelineGapFiller_MaxEvents(t *testing.T) {
+	srv := newGapTestServer()
+	defer srv.Close()
+	filler := newGapFiller(t, srv)
+	filler.MaxEvents = 5
+	var gaps []gapResult
+	filler.OnGap = func(roomID id.RoomID, added int, complete bool) {
+		gaps = append(gaps, gapResult{roomID, added, complete})
+	}
+
+	resp := newGapSyncResponse(t, "!room:example.com")
+	filler.ProcessSync(resp, "t1")
+	// Only the most recent events are added, and the timeline stays limited
+	assert.Equal(t, []id.EventID{"$4", "$5", "$6", "$7", "$8", "$9", "$10"}, timelineEventIDs(resp, "!room:example.com"))
+	timeline := resp.Rooms.Join["!room:example.com"].Timeline
+	assert.True(t, timeline.Limited)
+	assert.Equal(t, "t3", timeline.PrevBatch)
+	assert.Equal(t, []gapResult{{"!room:example.com", 5, false}}, gaps)
+
+	// The last page is limited to the remaining number of events
+	queries := srv.Queries()
+	require.Len(t, queries, 3)
+	assert.Equal(t, "3", queries[0].Get("limit"))
+	assert.Equal(t, "3", queries[1].Get("limit"))
+	assert.Equal(t, "1", queries[2].Get("limit"))
+}
+
+func TestTimelineGapFiller_Skip(t *testing.T) {
+	srv := newGapTestServer()
+	defer srv.Close()
+	filler := newGapFiller(t, srv)
+
+	// Nothing is filled in the first sync after startup
+	resp := newGapSyncResponse(t, "!room:example.com")
+	assert.True(t, filler.ProcessSync(resp, ""))
+	assert.Equal(t, []id.EventID{"$9", "$10"}, timelineEventIDs(resp, "!room:example.com"))
+	assert.True(t, resp.Rooms.Join["!room:example.com"].Timeline.Limited)
+
+	// Timelines that aren't limited don't have gaps
+	room := resp.Rooms.Join["!room:example.com"]
+	room.Timeline.Limited = false
+	resp.Rooms.Join["!room:example.com"] = room
+	filler.ProcessSync(resp, "t3")
+	assert.Equal(t, []id.EventID{"$9", "$10"}, timelineEventIDs(resp, "!room:example.com"))
+	assert.Empty(t, srv.Queries())
+}
+
+func TestTimelineGapFiller_Error(t *testing.T) {
+	srv := newGapTestServer()
+	defer srv.Close()
+	filler := newGapFiller(t, srv)
+	var gaps []gapResult
+	filler.OnGap = func(roomID id.RoomID, added int, complete bool) {
+		gaps = append(gaps, gapResult{roomID, added, complete})
+	}
+
+	// Failing to fetch the gap leaves the timeline as it was
+	resp := newGapSyncResponse(t, "!broken:example.com")
+	assert.True(t, filler.ProcessSync(resp, "t3"))
+	assert.Equal(t, []id.EventID{"$9", "$10"}, timelineEventIDs(resp, "!broken:example.com"))
+	timeline := resp.Rooms.Join["!broken:example.com"].Timeline
+	assert.True(t, timeline.Limited)
+	assert.Equal(t, "t10", timeline.PrevBatch)
+	assert.Equal(t, []gapResult{{"!broken:example.com", 0, false}}, gaps)
+	assert.Len(t, srv.Queries(), 1)
+}
+
+func TestTimelineGapFiller_Register(t *testing.T) {
+	srv := newGapTestServer()
+	defer srv.Close()
+	filler := newGapFiller(t, srv)
+	syncer := mautrix.NewDefaultSyncer()
+	var delivered []id.EventID
+	syncer.OnEventType(event.EventMessage, func(source mautrix.EventSource, evt *event.Event) {
+		delivered = append(delivered, evt.ID)
+	})
+	// Sync handlers registered before the gap filler still see the filled timeline
+	var seenBySyncHandler int
+	syncer.OnSync(func(resp *mautrix.RespSync, since string) bool {
+		seenBySyncHandler = len(resp.Rooms.Join["!room:example.com"].Timeline.Events)
+		return true
+	})
+	filler.Register(syncer)
+
+	require.NoError(t, syncer.ProcessResponse(newGapSyncResponse(t, "!room:example.com"), "t6"))
+	assert.Equal(t, []id.EventID{"$7", "$8", "$9", "$10"}, delivered)
+	assert.Equal(t, 4, seenBySyncHandler)
+}
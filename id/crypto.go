@@ -28,6 +28,15 @@ const (
 	AlgorithmMegolmV1 Algorithm = "m.megolm.v1.aes-sha2"
 )
 
+// KeyBackupAlgorithm is the algorithm of a server-side key backup version.
+type KeyBackupAlgorithm string
+
+const (
+	KeyBackupAlgorithmMegolmBackupV1 KeyBackupAlgorithm = "m.megolm_backup.v1.curve25519-aes-sha2"
+	// KeyBackupAlgorithmMegolmBackupAESHMAC is the symmetric backup algorithm from MSC3270.
+	KeyBackupAlgorithmMegolmBackupAESHMAC KeyBackupAlgorithm = "org.matrix.msc3270.v1.aes-hmac-sha2"
+)
+
 type KeyAlgorithm string
 
 const (
@@ -44,6 +53,16 @@ const (
 	XSUsageUserSigning CrossSigningUsage = "user_signing"
 )
 
+// Secret is the name of a secret that can be stored in SSSS or shared between devices with m.secret.request.
+type Secret string
+
+const (
+	SecretXSMaster       Secret = "m.cross_signing.master"
+	SecretXSSelfSigning  Secret = "m.cross_signing.self_signing"
+	SecretXSUserSigning  Secret = "m.cross_signing.user_signing"
+	SecretMegolmBackupV1 Secret = "m.megolm_backup.v1"
+)
+
 // A SessionID is an arbitrary string that identifies an Olm or Megolm session.
 type SessionID string
 
@@ -0,0 +1,207 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package identityserver implements a client for the Matrix identity service API (e.g. Sydent), which can be used
+// to look up the Matrix IDs bound to email addresses and phone numbers.
+// See https://spec.matrix.org/v1.3/identity-service-api/
+package identityserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// Client is a client for the identity service API of a single identity server.
+type Client struct {
+	BaseURL    *url.URL
+	HTTPClient *http.Client
+	UserAgent  string
+	// AccessToken is the identity server access token, which is obtained by calling Register with an OpenID token
+	// from the homeserver. Most endpoints require it.
+	AccessToken string
+}
+
+// NewClient creates a new identity server client. The base URL is the root of the identity server,
+// e.g. https://vector.im, which can also be found in the m.identity_server section of the .well-known file.
+func NewClient(baseURL string) (*Client, error) {
+	parsed, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	} else if parsed.Scheme != "https" && parsed.Scheme != "http" {
+		return nil, fmt.Errorf("%q is not an HTTP(S) URL", baseURL)
+	}
+	return &Client{
+		BaseURL:    parsed,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		UserAgent:  mautrix.DefaultUserAgent + " identity server client",
+	}, nil
+}
+
+// BuildURL builds an identity service API v2 URL with the given path parts.
+func (cli *Client) BuildURL(path ...interface{}) string {
+	return mautrix.BuildURL(cli.BaseURL, append([]interface{}{"_matrix", "identity", "v2"}, path...)...).String()
+}
+
+// MakeRequest sends a request to the identity server. Errors are returned as mautrix.HTTPError, so they can be
+// compared with the mautrix.RespError variables using errors.Is.
+func (cli *Client) MakeRequest(ctx context.Context, method, httpURL string, reqJSON, respJSON interface{}) error {
+	var body io.Reader
+	if reqJSON != nil {
+		data, err := json.Marshal(reqJSON)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, httpURL, body)
+	if err != nil {
+		return err
+	}
+	if reqJSON != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(cli.AccessToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+cli.AccessToken)
+	}
+	req.Header.Set("User-Agent", cli.UserAgent)
+	resp, err := cli.HTTPClient.Do(req)
+	if err != nil {
+		return mautrix.HTTPError{Request: req, WrappedError: err, Message: "request error"}
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return mautrix.HTTPError{Request: req, Response: resp, WrappedError: err, Message: "failed to read response body"}
+	}
+	if resp.StatusCode >= 300 {
+		httpErr := mautrix.HTTPError{Request: req, Response: resp, ResponseBody: string(data)}
+		var respErr mautrix.RespError
+		if json.Unmarshal(data, &respErr) == nil && len(respErr.ErrCode) > 0 {
+			httpErr.RespError = &respErr
+		}
+		return httpErr
+	}
+	if respJSON != nil {
+		err = json.Unmarshal(data, respJSON)
+		if err != nil {
+			return mautrix.HTTPError{Request: req, Response: resp, ResponseBody: string(data), WrappedError: err, Message: "failed to unmarshal response body"}
+		}
+	}
+	return nil
+}
+
+// Status checks that the server is an identity server that supports the v2 API.
+// See https://spec.matrix.org/v1.3/identity-service-api/#get_matrixidentityv2
+func (cli *Client) Status(ctx context.Context) error {
+	return cli.MakeRequest(ctx, http.MethodGet, cli.BuildURL(), nil, nil)
+}
+
+type respRegister struct {
+	Token string `json:"token"`
+}
+
+// Register exchanges an OpenID token from the homeserver for an identity server access token, which is stored in
+// the client and returned.
+// See https://spec.matrix.org/v1.3/identity-service-api/#post_matrixidentityv2accountregister
+func (cli *Client) Register(ctx context.Context, openIDToken *mautrix.RespOpenIDToken) (string, error) {
+	var resp respRegister
+	err := cli.MakeRequest(ctx, http.MethodPost, cli.BuildURL("account", "register"), openIDToken, &resp)
+	if err != nil {
+		return "", err
+	}
+	cli.AccessToken = resp.Token
+	return resp.Token, nil
+}
+
+type respAccount struct {
+	UserID id.UserID `json:"user_id"`
+}
+
+// Account gets the user ID that the access token belongs to.
+// See https://spec.matrix.org/v1.3/identity-service-api/#get_matrixidentityv2account
+func (cli *Client) Account(ctx context.Context) (id.UserID, error) {
+	var resp respAccount
+	err := cli.MakeRequest(ctx, http.MethodGet, cli.BuildURL("account"), nil, &resp)
+	return resp.UserID, err
+}
+
+// Logout invalidates the access token of the client.
+// See https://spec.matrix.org/v1.3/identity-service-api/#post_matrixidentityv2accountlogout
+func (cli *Client) Logout(ctx context.Context) error {
+	err := cli.MakeRequest(ctx, http.MethodPost, cli.BuildURL("account", "logout"), struct{}{}, nil)
+	if err == nil {
+		cli.AccessToken = ""
+	}
+	return err
+}
+
+// PolicyTranslation is a single language version of a policy document.
+type PolicyTranslation struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// Policy is a policy document that users must accept, with translations keyed by language code.
+type Policy struct {
+	Version      string                       `json:"version"`
+	Translations map[string]PolicyTranslation `json:"-"`
+}
+
+func (policy *Policy) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	policy.Translations = make(map[string]PolicyTranslation, len(raw))
+	for key, value := range raw {
+		if key == "version" {
+			err = json.Unmarshal(value, &policy.Version)
+		} else {
+			var translation PolicyTranslation
+			if err = json.Unmarshal(value, &translation); err == nil {
+				policy.Translations[key] = translation
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// RespTerms is the response for GetTerms.
+type RespTerms struct {
+	Policies map[string]Policy `json:"policies"`
+}
+
+type reqAcceptTerms struct {
+	UserAccepts []string `json:"user_accepts"`
+}
+
+// GetTerms gets the policies that users must accept to use the identity server.
+// See https://spec.matrix.org/v1.3/identity-service-api/#get_matrixidentityv2terms
+func (cli *Client) GetTerms(ctx context.Context) (resp *RespTerms, err error) {
+	err = cli.MakeRequest(ctx, http.MethodGet, cli.BuildURL("terms"), nil, &resp)
+	return
+}
+
+// AcceptTerms accepts the policies with the given URLs on behalf of the user.
+// See https://spec.matrix.org/v1.3/identity-service-api/#post_matrixidentityv2terms
+func (cli *Client) AcceptTerms(ctx context.Context, urls []string) error {
+	return cli.MakeRequest(ctx, http.MethodPost, cli.BuildURL("terms"), &reqAcceptTerms{UserAccepts: urls}, nil)
+}
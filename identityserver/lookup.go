@@ -0,0 +1,149 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package identityserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// HashAlgorithm is an algorithm for hashing 3PIDs before looking them up.
+type HashAlgorithm string
+
+const (
+	HashAlgorithmSHA256 HashAlgorithm = "sha256"
+	HashAlgorithmNone   HashAlgorithm = "none"
+)
+
+var (
+	// ErrNoSupportedAlgorithm is returned by Lookup if the server doesn't support any of the known hash algorithms.
+	ErrNoSupportedAlgorithm = errors.New("identity server doesn't support any known lookup algorithm")
+	// MInvalidPepper is returned by the server if the pepper of a lookup doesn't match the current pepper.
+	MInvalidPepper = mautrix.RespError{ErrCode: "M_INVALID_PEPPER"}
+)
+
+// ThreePID is a third-party identifier to look up.
+type ThreePID struct {
+	Medium  string
+	Address string
+}
+
+// RespHashDetails is the response for GetHashDetails.
+type RespHashDetails struct {
+	Algorithms   []HashAlgorithm `json:"algorithms"`
+	LookupPepper string          `json:"lookup_pepper"`
+}
+
+// Supports returns whether the server supports the given algorithm.
+func (hd *RespHashDetails) Supports(algorithm HashAlgorithm) bool {
+	for _, alg := range hd.Algorithms {
+		if alg == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// GetHashDetails gets the supported hash algorithms and the pepper used for lookups.
+// See https://spec.matrix.org/v1.3/identity-service-api/#get_matrixidentityv2hash_details
+func (cli *Client) GetHashDetails(ctx context.Context) (resp *RespHashDetails, err error) {
+	err = cli.MakeRequest(ctx, http.MethodGet, cli.BuildURL("hash_details"), nil, &resp)
+	return
+}
+
+// HashThreePID hashes the 3PID for a lookup using the given algorithm and pepper.
+//
+// With sha256, the hash is the unpadded URL-safe base64 of the SHA-256 hash of "<address> <medium> <pepper>".
+// With none, the value is "<address> <medium>" as-is. Email addresses should be lowercased by the caller.
+// See https://spec.matrix.org/v1.3/identity-service-api/#client-behaviour
+func HashThreePID(algorithm HashAlgorithm, pepper string, threePID ThreePID) (string, error) {
+	switch algorithm {
+	case HashAlgorithmSHA256:
+		hash := sha256.Sum256([]byte(fmt.Sprintf("%s %s %s", threePID.Address, threePID.Medium, pepper)))
+		return base64.RawURLEncoding.EncodeToString(hash[:]), nil
+	case HashAlgorithmNone:
+		return fmt.Sprintf("%s %s", threePID.Address, threePID.Medium), nil
+	default:
+		return "", fmt.Errorf("unsupported hash algorithm %q", algorithm)
+	}
+}
+
+type reqLookup struct {
+	Addresses []string      `json:"addresses"`
+	Algorithm HashAlgorithm `json:"algorithm"`
+	Pepper    string        `json:"pepper"`
+}
+
+type respLookup struct {
+	Mappings map[string]id.UserID `json:"mappings"`
+}
+
+// LookupHashed looks up pre-hashed 3PIDs and returns the mappings from hashes to Matrix IDs.
+// Hashes that aren't bound to a Matrix ID are not included in the result.
+// See https://spec.matrix.org/v1.3/identity-service-api/#post_matrixidentityv2lookup
+func (cli *Client) LookupHashed(ctx context.Context, algorithm HashAlgorithm, pepper string, hashes []string) (map[string]id.UserID, error) {
+	var resp respLookup
+	err := cli.MakeRequest(ctx, http.MethodPost, cli.BuildURL("lookup"), &reqLookup{
+		Addresses: hashes,
+		Algorithm: algorithm,
+		Pepper:    pepper,
+	}, &resp)
+	return resp.Mappings, err
+}
+
+// Lookup finds the Matrix IDs bound to the given 3PIDs. It fetches the hash details, hashes the 3PIDs with sha256
+// (or the none algorithm if that's the only one the server supports) and maps the results back to the 3PIDs.
+//
+// If the server rejects the pepper because it was rotated in the meantime, the lookup is retried once.
+func (cli *Client) Lookup(ctx context.Context, threePIDs []ThreePID) (map[ThreePID]id.UserID, error) {
+	result, err := cli.lookup(ctx, threePIDs)
+	if errors.Is(err, MInvalidPepper) {
+		result, err = cli.lookup(ctx, threePIDs)
+	}
+	return result, err
+}
+
+func (cli *Client) lookup(ctx context.Context, threePIDs []ThreePID) (map[ThreePID]id.UserID, error) {
+	details, err := cli.GetHashDetails(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hash details: %w", err)
+	}
+	algorithm := HashAlgorithmSHA256
+	if !details.Supports(HashAlgorithmSHA256) {
+		if !details.Supports(HashAlgorithmNone) {
+			return nil, ErrNoSupportedAlgorithm
+		}
+		algorithm = HashAlgorithmNone
+	}
+	hashes := make([]string, len(threePIDs))
+	hashToThreePID := make(map[string]ThreePID, len(threePIDs))
+	for i, threePID := range threePIDs {
+		hashes[i], err = HashThreePID(algorithm, details.LookupPepper, threePID)
+		if err != nil {
+			return nil, err
+		}
+		hashToThreePID[hashes[i]] = threePID
+	}
+	mappings, err := cli.LookupHashed(ctx, algorithm, details.LookupPepper, hashes)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[ThreePID]id.UserID, len(mappings))
+	for hash, userID := range mappings {
+		if threePID, ok := hashToThreePID[hash]; ok {
+			result[threePID] = userID
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package identityserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/identityserver"
+)
+
+func TestHashThreePID(t *testing.T) {
+	// Example from https://spec.matrix.org/v1.3/identity-service-api/#client-behaviour
+	hash, err := identityserver.HashThreePID(identityserver.HashAlgorithmSHA256, "matrixrocks", identityserver.ThreePID{
+		Medium:  "email",
+		Address: "alice@example.com",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "4kenr7N9drpCJ4AfalmlGQVsOn3o2RHjkADUpXJWZUc", hash)
+
+	plain, err := identityserver.HashThreePID(identityserver.HashAlgorithmNone, "matrixrocks", identityserver.ThreePID{
+		Medium:  "msisdn",
+		Address: "12345678910",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "12345678910 msisdn", plain)
+}
+
+func TestClient_Lookup(t *testing.T) {
+	alice := identityserver.ThreePID{Medium: "email", Address: "alice@example.com"}
+	bob := identityserver.ThreePID{Medium: "email", Address: "bob@example.com"}
+	pepper := "old"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer is_token", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/_matrix/identity/v2/hash_details":
+			_ = json.NewEncoder(w).Encode(&identityserver.RespHashDetails{
+				Algorithms:   []identityserver.HashAlgorithm{identityserver.HashAlgorithmNone, identityserver.HashAlgorithmSHA256},
+				LookupPepper: pepper,
+			})
+		case "/_matrix/identity/v2/lookup":
+			var req map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			assert.Equal(t, "sha256", req["algorithm"])
+			if req["pepper"] == "old" {
+				// Rotate the pepper to check that the lookup is retried
+				pepper = "new"
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"errcode": "M_INVALID_PEPPER", "algorithm": "sha256", "lookup_pepper": "new"}`))
+				return
+			}
+			aliceHash, _ := identityserver.HashThreePID(identityserver.HashAlgorithmSHA256, "new", alice)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"mappings": map[string]id.UserID{aliceHash: "@alice:example.com"},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	cli, err := identityserver.NewClient(server.URL)
+	require.NoError(t, err)
+	cli.AccessToken = "is_token"
+	result, err := cli.Lookup(context.Background(), []identityserver.ThreePID{alice, bob})
+	require.NoError(t, err)
+	assert.Equal(t, map[identityserver.ThreePID]id.UserID{alice: "@alice:example.com"}, result)
+}
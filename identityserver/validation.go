@@ -0,0 +1,138 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package identityserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// NewClientSecret generates a random client secret for a validation session.
+func NewClientSecret() string {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(secret)
+}
+
+// ReqEmailRequestToken is the request for RequestEmailToken.
+type ReqEmailRequestToken struct {
+	ClientSecret string `json:"client_secret"`
+	Email        string `json:"email"`
+	SendAttempt  int    `json:"send_attempt"`
+	NextLink     string `json:"next_link,omitempty"`
+}
+
+// ReqMSISDNRequestToken is the request for RequestMSISDNToken.
+type ReqMSISDNRequestToken struct {
+	ClientSecret string `json:"client_secret"`
+	Country      string `json:"country"`
+	PhoneNumber  string `json:"phone_number"`
+	SendAttempt  int    `json:"send_attempt"`
+	NextLink     string `json:"next_link,omitempty"`
+}
+
+// RespRequestToken is the response for the requestToken endpoints.
+type RespRequestToken struct {
+	SessionID string `json:"sid"`
+	// MSISDN and IntlFormat are only set for phone number validation.
+	MSISDN     string `json:"msisdn,omitempty"`
+	IntlFormat string `json:"intl_fmt,omitempty"`
+}
+
+// ReqSubmitToken is the request for SubmitEmailToken and SubmitMSISDNToken.
+type ReqSubmitToken struct {
+	SessionID    string `json:"sid"`
+	ClientSecret string `json:"client_secret"`
+	Token        string `json:"token"`
+}
+
+type respSuccess struct {
+	Success bool `json:"success"`
+}
+
+// RequestEmailToken starts a validation session by sending a validation email to the given address.
+// See https://spec.matrix.org/v1.3/identity-service-api/#post_matrixidentityv2validateemailrequesttoken
+func (cli *Client) RequestEmailToken(ctx context.Context, req *ReqEmailRequestToken) (resp *RespRequestToken, err error) {
+	err = cli.MakeRequest(ctx, http.MethodPost, cli.BuildURL("validate", "email", "requestToken"), req, &resp)
+	return
+}
+
+// SubmitEmailToken validates the session with the token from the validation email.
+// See https://spec.matrix.org/v1.3/identity-service-api/#post_matrixidentityv2validateemailsubmittoken
+func (cli *Client) SubmitEmailToken(ctx context.Context, req *ReqSubmitToken) (bool, error) {
+	var resp respSuccess
+	err := cli.MakeRequest(ctx, http.MethodPost, cli.BuildURL("validate", "email", "submitToken"), req, &resp)
+	return resp.Success, err
+}
+
+// RequestMSISDNToken starts a validation session by sending a validation SMS to the given phone number.
+// See https://spec.matrix.org/v1.3/identity-service-api/#post_matrixidentityv2validatemsisdnrequesttoken
+func (cli *Client) RequestMSISDNToken(ctx context.Context, req *ReqMSISDNRequestToken) (resp *RespRequestToken, err error) {
+	err = cli.MakeRequest(ctx, http.MethodPost, cli.BuildURL("validate", "msisdn", "requestToken"), req, &resp)
+	return
+}
+
+// SubmitMSISDNToken validates the session with the token from the validation SMS.
+// See https://spec.matrix.org/v1.3/identity-service-api/#post_matrixidentityv2validatemsisdnsubmittoken
+func (cli *Client) SubmitMSISDNToken(ctx context.Context, req *ReqSubmitToken) (bool, error) {
+	var resp respSuccess
+	err := cli.MakeRequest(ctx, http.MethodPost, cli.BuildURL("validate", "msisdn", "submitToken"), req, &resp)
+	return resp.Success, err
+}
+
+// RespValidated3PID is the response for GetValidated3PID.
+type RespValidated3PID struct {
+	Medium      string `json:"medium"`
+	Address     string `json:"address"`
+	ValidatedAt int64  `json:"validated_at"`
+}
+
+// GetValidated3PID gets the 3PID of a validation session that has been successfully validated.
+// See https://spec.matrix.org/v1.3/identity-service-api/#get_matrixidentityv23pidgetvalidated3pid
+func (cli *Client) GetValidated3PID(ctx context.Context, sessionID, clientSecret string) (resp *RespValidated3PID, err error) {
+	query := url.Values{"sid": {sessionID}, "client_secret": {clientSecret}}
+	urlPath := cli.BuildURL("3pid", "getValidated3pid") + "?" + query.Encode()
+	err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+type reqBind struct {
+	SessionID    string    `json:"sid"`
+	ClientSecret string    `json:"client_secret"`
+	MXID         id.UserID `json:"mxid"`
+}
+
+// RespBind is the response for Bind.
+type RespBind struct {
+	Medium  string    `json:"medium"`
+	Address string    `json:"address"`
+	MXID    id.UserID `json:"mxid"`
+
+	NotBefore int64 `json:"not_before"`
+	NotAfter  int64 `json:"not_after"`
+	Timestamp int64 `json:"ts"`
+}
+
+// Bind binds the 3PID of a validated session to the given Matrix ID. Usually the homeserver does this with
+// mautrix.Client.Bind3PID instead.
+// See https://spec.matrix.org/v1.3/identity-service-api/#post_matrixidentityv23pidbind
+func (cli *Client) Bind(ctx context.Context, sessionID, clientSecret string, userID id.UserID) (resp *RespBind, err error) {
+	err = cli.MakeRequest(ctx, http.MethodPost, cli.BuildURL("3pid", "bind"), &reqBind{
+		SessionID:    sessionID,
+		ClientSecret: clientSecret,
+		MXID:         userID,
+	}, &resp)
+	return
+}
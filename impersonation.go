@@ -0,0 +1,85 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+const impersonateUserContextKey = "fi.mau.mautrix.impersonate_user"
+const massageTimestampContextKey = "fi.mau.mautrix.massage_timestamp"
+
+// WithImpersonation returns a context that makes requests act as the given user by setting the user_id query
+// parameter, overriding Client.AppServiceUserID. This only works if the client's access token is an appservice
+// as_token and the user is in the namespace of the appservice.
+// See https://spec.matrix.org/v1.3/application-service-api/#identity-assertion
+//
+// The context must be passed to requests using FullRequest.Context. To impersonate a user in the other methods of
+// the client, use AsUser instead.
+func WithImpersonation(ctx context.Context, userID id.UserID) context.Context {
+	return context.WithValue(ctx, impersonateUserContextKey, userID)
+}
+
+// WithMassagedTimestamp returns a context that makes event sending requests set the timestamp of the event using the
+// ts query parameter. Like impersonation, this only works with an appservice as_token.
+// See https://spec.matrix.org/v1.3/application-service-api/#timestamp-massaging
+func WithMassagedTimestamp(ctx context.Context, ts time.Time) context.Context {
+	return context.WithValue(ctx, massageTimestampContextKey, ts.UnixNano()/int64(time.Millisecond))
+}
+
+// applyRequestContext adds the query parameters requested with WithImpersonation and WithMassagedTimestamp.
+func applyRequestContext(req *http.Request) {
+	userID, _ := req.Context().Value(impersonateUserContextKey).(id.UserID)
+	ts, _ := req.Context().Value(massageTimestampContextKey).(int64)
+	massageTS := ts > 0 && ClassifyEndpoint(req.URL.Path) == EndpointClassSend
+	if len(userID) == 0 && !massageTS {
+		return
+	}
+	query := req.URL.Query()
+	if len(userID) > 0 {
+		query.Set("user_id", string(userID))
+	}
+	if massageTS {
+		query.Set("ts", strconv.FormatInt(ts, 10))
+	}
+	req.URL.RawQuery = query.Encode()
+}
+
+// AsUser returns a new client that acts as the given user using the appservice user_id query parameter. The new client
+// shares the access token, HTTP client and request settings of this client, but has no syncer or store.
+//
+// Like WithImpersonation, this only works if the client's access token is an appservice as_token.
+func (cli *Client) AsUser(userID id.UserID) *Client {
+	cli.serverInfoLock.Lock()
+	versions, capabilities := cli.versions, cli.capabilities
+	cli.serverInfoLock.Unlock()
+	return &Client{
+		HomeserverURL:      cli.HomeserverURL,
+		Prefix:             cli.Prefix,
+		UserID:             userID,
+		AccessToken:        cli.AccessToken,
+		UserAgent:          cli.UserAgent,
+		Client:             cli.Client,
+		Logger:             cli.Logger,
+		DefaultHTTPRetries: cli.DefaultHTTPRetries,
+		RetryPolicy:        cli.RetryPolicy,
+		RateLimiter:        cli.RateLimiter,
+		Middlewares:        cli.Middlewares,
+		EndpointTimeouts:   cli.EndpointTimeouts,
+		TxnIDStore:         cli.TxnIDStore,
+		RequestLogger:      cli.RequestLogger,
+		AppServiceUserID:   userID,
+
+		versions:     versions,
+		capabilities: capabilities,
+	}
+}
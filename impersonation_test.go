@@ -0,0 +1,187 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type recordedRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Body   string
+}
+
+// recordingServer is a homeserver that records all requests and responds with preset responses.
+type recordingServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	requests []recordedRequest
+	// responses maps "METHOD /path" to response bodies. Requests without a response get an empty JSON object.
+	responses map[string]string
+	// statuses maps "METHOD /path" to the status code of the response. The default is 200.
+	statuses map[string]int
+	// uia contains the "METHOD /path" endpoints that require user-interactive auth with a password.
+	uia map[string]bool
+}
+
+func newRecordingServer() *recordingServer {
+	srv := &recordingServer{responses: make(map[string]string), statuses: make(map[string]int), uia: make(map[string]bool)}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		key := r.Method + " " + r.URL.Path
+		srv.lock.Lock()
+		srv.requests = append(srv.requests, recordedRequest{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Query:  r.URL.Query(),
+			Body:   string(body),
+		})
+		resp, ok := srv.responses[key]
+		status := srv.statuses[key]
+		requireAuth := srv.uia[key] && !bytes.Contains(body, []byte(`"auth"`))
+		srv.lock.Unlock()
+		if requireAuth {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"session": "xyz", "flows": [{"stages": ["m.login.password"]}], "params": {}}`))
+			return
+		} else if !ok {
+			resp = `{}`
+		}
+		if status != 0 {
+			w.WriteHeader(status)
+		}
+		_, _ = w.Write([]byte(resp))
+	}))
+	return srv
+}
+
+// Respond sets the response of the given endpoint, e.g. Respond("GET /_matrix/client/r0/account/whoami", `{}`).
+func (srv *recordingServer) Respond(endpoint, body string) {
+	srv.RespondStatus(endpoint, 0, body)
+}
+
+// RespondStatus sets the status code and response of the given endpoint.
+func (srv *recordingServer) RespondStatus(endpoint string, status int, body string) {
+	srv.lock.Lock()
+	srv.responses[endpoint] = body
+	srv.statuses[endpoint] = status
+	srv.lock.Unlock()
+}
+
+// RequireUIA makes the given endpoint respond with a password UIA flow to requests that don't have auth data.
+func (srv *recordingServer) RequireUIA(endpoint string) {
+	srv.lock.Lock()
+	srv.uia[endpoint] = true
+	srv.lock.Unlock()
+}
+
+// Requests returns the requests made since the previous call.
+func (srv *recordingServer) Requests() []recordedRequest {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	requests := srv.requests
+	srv.requests = nil
+	return requests
+}
+
+// LastRequest returns the only request made since the previous call, failing the test if there were more or fewer.
+func (srv *recordingServer) LastRequest(t *testing.T) recordedRequest {
+	requests := srv.Requests()
+	require.Len(t, requests, 1)
+	return requests[0]
+}
+
+func TestWithImpersonation(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	cli := mautrix.NewTestClient(t, srv.URL)
+	cli.AppServiceUserID = "@bot:example.com"
+
+	_, err := cli.MakeFullRequest(mautrix.FullRequest{
+		Method:  http.MethodGet,
+		URL:     cli.BuildURL("account", "whoami"),
+		Context: mautrix.WithImpersonation(context.Background(), "@ghost:example.com"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "@ghost:example.com", srv.LastRequest(t).Query.Get("user_id"))
+
+	_, err = cli.Whoami()
+	require.NoError(t, err)
+	assert.Equal(t, "@bot:example.com", srv.LastRequest(t).Query.Get("user_id"))
+}
+
+func TestWithMassagedTimestamp(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	cli := mautrix.NewTestClient(t, srv.URL)
+	ts := time.Unix(1600000000, 123000000)
+	ctx := mautrix.WithMassagedTimestamp(context.Background(), ts)
+
+	_, err := cli.MakeFullRequest(mautrix.FullRequest{
+		Method:      http.MethodPut,
+		URL:         cli.BuildURL("rooms", "!room:example.com", "send", "m.room.message", "txn1"),
+		RequestJSON: map[string]string{"body": "hi"},
+		Context:     ctx,
+	})
+	require.NoError(t, err)
+	req := srv.LastRequest(t)
+	assert.Equal(t, "1600000000123", req.Query.Get("ts"))
+	assert.Empty(t, req.Query.Get("user_id"))
+	assert.JSONEq(t, `{"body": "hi"}`, req.Body)
+
+	// Timestamps are only added to requests that send events
+	_, err = cli.MakeFullRequest(mautrix.FullRequest{
+		Method:  http.MethodGet,
+		URL:     cli.BuildURL("account", "whoami"),
+		Context: ctx,
+	})
+	require.NoError(t, err)
+	assert.NotContains(t, srv.LastRequest(t).Query, "ts")
+}
+
+func TestClient_AsUser(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	cli := mautrix.NewTestClient(t, srv.URL)
+	cli.EndpointTimeouts = map[mautrix.EndpointClass]time.Duration{mautrix.EndpointClassSend: time.Minute}
+
+	ghost := cli.AsUser("@ghost:example.com")
+	assert.Equal(t, id.UserID("@ghost:example.com"), ghost.UserID)
+	assert.Equal(t, cli.AccessToken, ghost.AccessToken)
+	assert.Equal(t, cli.Client, ghost.Client)
+	assert.Equal(t, cli.EndpointTimeouts, ghost.EndpointTimeouts)
+
+	_, err := ghost.SendMessageEvent("!room:example.com", event.EventMessage, map[string]string{"body": "hi"})
+	require.NoError(t, err)
+	req := srv.LastRequest(t)
+	assert.Equal(t, http.MethodPut, req.Method)
+	assert.True(t, strings.HasPrefix(req.Path, "/_matrix/client/r0/rooms/!room:example.com/send/m.room.message/"), req.Path)
+	assert.Equal(t, "@ghost:example.com", req.Query.Get("user_id"))
+
+	// The original client isn't affected
+	_, err = cli.Whoami()
+	require.NoError(t, err)
+	assert.NotContains(t, srv.LastRequest(t).Query, "user_id")
+}
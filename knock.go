@@ -0,0 +1,122 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ErrNotInAllowedRooms is returned by JoinRestrictedRoom if the user isn't joined to any of the rooms whose members
+// are allowed to join.
+var ErrNotInAllowedRooms = errors.New("not joined to any of the rooms allowed by the join rules")
+
+func (cli *Client) buildJoinURL(urlPath URLPath, via []string) string {
+	joinURL := cli.BuildBaseURL(urlPath...)
+	if len(via) > 0 {
+		joinURL += "?" + url.Values{"server_name": via}.Encode()
+	}
+	return joinURL
+}
+
+// KnockRoom asks to join a room that has the knock join rule. Users in the room who can invite will see the knock and
+// can accept it by inviting the user. The Via servers are used to find the room if this server isn't in it.
+// See https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3knockroomidoralias
+func (cli *Client) KnockRoom(roomIDOrAlias string, req *ReqKnockRoom) (resp *RespKnockRoom, err error) {
+	prefix := URLPath{"_matrix", "client", "v3"}
+	if versions, _ := cli.CachedVersions(); versions != nil && !versions.ContainsGreaterOrEqual(FeatureKnocking.SpecVersion) &&
+		versions.UnstableFeatures[FeatureKnocking.UnstableFlag] {
+		prefix = URLPath{"_matrix", "client", "unstable", FeatureKnocking.UnstableFlag}
+	}
+	urlPath := cli.buildJoinURL(append(prefix, "knock", roomIDOrAlias), req.Via)
+	_, err = cli.MakeRequest(http.MethodPost, urlPath, req, &resp)
+	return
+}
+
+// JoinRoomVia joins a room ID or alias using any of the given servers to find the room. Unlike JoinRoom, this allows
+// specifying multiple servers, which is usually necessary for joining rooms by ID.
+func (cli *Client) JoinRoomVia(roomIDOrAlias string, via []string, reason string) (resp *RespJoinRoom, err error) {
+	urlPath := cli.buildJoinURL(append(cli.Prefix, "join", roomIDOrAlias), via)
+	_, err = cli.MakeRequest(http.MethodPost, urlPath, &ReqJoinRoom{Reason: reason}, &resp)
+	return
+}
+
+// RestrictedJoinError is returned by JoinRestrictedRoom when joining a restricted room fails.
+type RestrictedJoinError struct {
+	RoomID id.RoomID
+	// AllowedRooms are the rooms whose members are allowed to join.
+	AllowedRooms []id.RoomID
+	// JoinedAllowedRooms are the allowed rooms that the user is joined to.
+	JoinedAllowedRooms []id.RoomID
+	// Reason is a human-readable explanation of why joining failed.
+	Reason string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *RestrictedJoinError) Error() string {
+	return fmt.Sprintf("failed to join restricted room %s: %s", e.RoomID, e.Reason)
+}
+
+func (e *RestrictedJoinError) Unwrap() error {
+	return e.Err
+}
+
+func restrictedJoinFailureReason(err error) string {
+	switch {
+	case errors.Is(err, MUnableToAuthoriseJoin):
+		return "the server handling the join couldn't check membership in the allowed rooms"
+	case errors.Is(err, MUnableToGrantJoin):
+		return "no server in the room has a user who can invite, so the join couldn't be authorized"
+	case errors.Is(err, MForbidden):
+		return "the join was rejected, the user may not be in any of the allowed rooms"
+	default:
+		return err.Error()
+	}
+}
+
+// JoinRestrictedRoom joins a room that has restricted join rules (room version 8+), which allow joining if the user is
+// a member of one of the allowed rooms. The join rules can come from e.g. the space hierarchy or stripped state.
+//
+// Before joining, this checks that the user is joined to one of the allowed rooms, and returns ErrNotInAllowedRooms
+// wrapped in a RestrictedJoinError without trying to join if not. Join failures are also returned as
+// RestrictedJoinErrors with a Reason explaining the failure.
+func (cli *Client) JoinRestrictedRoom(roomID id.RoomID, joinRules *event.JoinRulesEventContent, via []string) (*RespJoinRoom, error) {
+	joinErr := &RestrictedJoinError{RoomID: roomID, AllowedRooms: joinRules.AllowedRooms()}
+	if joinRules.IsRestricted() {
+		joined, err := cli.JoinedRooms()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get joined rooms: %w", err)
+		}
+		joinedMap := make(map[id.RoomID]struct{}, len(joined.JoinedRooms))
+		for _, joinedRoomID := range joined.JoinedRooms {
+			joinedMap[joinedRoomID] = struct{}{}
+		}
+		for _, allowedRoomID := range joinErr.AllowedRooms {
+			if _, ok := joinedMap[allowedRoomID]; ok {
+				joinErr.JoinedAllowedRooms = append(joinErr.JoinedAllowedRooms, allowedRoomID)
+			}
+		}
+		if len(joinErr.JoinedAllowedRooms) == 0 {
+			joinErr.Err = ErrNotInAllowedRooms
+			joinErr.Reason = ErrNotInAllowedRooms.Error()
+			return nil, joinErr
+		}
+	}
+	resp, err := cli.JoinRoomVia(roomID.String(), via, "")
+	if err != nil {
+		joinErr.Err = err
+		joinErr.Reason = restrictedJoinFailureReason(err)
+		return nil, joinErr
+	}
+	return resp, nil
+}
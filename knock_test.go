@@ -0,0 +1,139 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestClient_KnockRoom(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("GET /_matrix/client/versions", `{"versions": ["v1.1"]}`)
+	srv.Respond("POST /_matrix/client/v3/knock/#room:example.com", `{"room_id": "!room:example.com"}`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	resp, err := cli.KnockRoom("#room:example.com", &mautrix.ReqKnockRoom{Via: []string{"example.com", "other.example.com"}, Reason: "let me in"})
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!room:example.com"), resp.RoomID)
+	requests := srv.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, http.MethodPost, requests[1].Method)
+	assert.Equal(t, []string{"example.com", "other.example.com"}, requests[1].Query["server_name"])
+	assert.JSONEq(t, `{"reason": "let me in"}`, requests[1].Body)
+
+	// Servers that only support knocking as an unstable feature use the unstable prefix
+	srv.Respond("GET /_matrix/client/versions", `{"versions": ["v1.0"], "unstable_features": {"xyz.amorgan.knock": true}}`)
+	cli.ClearServerInfoCache()
+	_, err = cli.KnockRoom("!room:example.com", &mautrix.ReqKnockRoom{})
+	require.NoError(t, err)
+	requests = srv.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, "/_matrix/client/unstable/xyz.amorgan.knock/knock/!room:example.com", requests[1].Path)
+	assert.NotContains(t, requests[1].Query, "server_name")
+}
+
+func TestClient_JoinRoomVia(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("POST /_matrix/client/r0/join/!room:example.com", `{"room_id": "!room:example.com"}`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	resp, err := cli.JoinRoomVia("!room:example.com", []string{"a.example.com", "b.example.com"}, "hi")
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!room:example.com"), resp.RoomID)
+	req := srv.LastRequest(t)
+	assert.Equal(t, []string{"a.example.com", "b.example.com"}, req.Query["server_name"])
+	assert.JSONEq(t, `{"reason": "hi"}`, req.Body)
+}
+
+var testRestrictedJoinRules = &event.JoinRulesEventContent{
+	JoinRule: event.JoinRuleRestricted,
+	Allow: []event.JoinRuleAllow{
+		{Type: event.JoinRuleAllowRoomMembership, RoomID: "!space:example.com"},
+		{Type: event.JoinRuleAllowRoomMembership, RoomID: "!other:example.com"},
+		{Type: "org.example.unknown"},
+	},
+}
+
+func TestClient_JoinRestrictedRoom(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("GET /_matrix/client/r0/joined_rooms", `{"joined_rooms": ["!unrelated:example.com"]}`)
+	srv.Respond("POST /_matrix/client/r0/join/!room:example.com", `{"room_id": "!room:example.com"}`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	_, err := cli.JoinRestrictedRoom("!room:example.com", testRestrictedJoinRules, []string{"example.com"})
+	assert.ErrorIs(t, err, mautrix.ErrNotInAllowedRooms)
+	var joinErr *mautrix.RestrictedJoinError
+	require.True(t, errors.As(err, &joinErr))
+	assert.Equal(t, []id.RoomID{"!space:example.com", "!other:example.com"}, joinErr.AllowedRooms)
+	assert.Empty(t, joinErr.JoinedAllowedRooms)
+	// The join isn't attempted
+	assert.Len(t, srv.Requests(), 1)
+
+	srv.Respond("GET /_matrix/client/r0/joined_rooms", `{"joined_rooms": ["!unrelated:example.com", "!other:example.com"]}`)
+	resp, err := cli.JoinRestrictedRoom("!room:example.com", testRestrictedJoinRules, []string{"example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!room:example.com"), resp.RoomID)
+	requests := srv.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, "/_matrix/client/r0/join/!room:example.com", requests[1].Path)
+	assert.Equal(t, "example.com", requests[1].Query.Get("server_name"))
+
+	srv.RespondStatus("POST /_matrix/client/r0/join/!room:example.com", http.StatusBadRequest, `{"errcode": "M_UNABLE_TO_GRANT_JOIN", "error": "No server can grant the join"}`)
+	_, err = cli.JoinRestrictedRoom("!room:example.com", testRestrictedJoinRules, nil)
+	require.True(t, errors.As(err, &joinErr))
+	assert.ErrorIs(t, err, mautrix.MUnableToGrantJoin)
+	assert.Equal(t, []id.RoomID{"!other:example.com"}, joinErr.JoinedAllowedRooms)
+	assert.Contains(t, joinErr.Reason, "who can invite")
+	assert.Contains(t, err.Error(), "!room:example.com")
+
+	// Non-restricted rooms are joined without checking the allowed rooms
+	srv.Requests()
+	srv.RespondStatus("POST /_matrix/client/r0/join/!room:example.com", http.StatusForbidden, `{"errcode": "M_FORBIDDEN", "error": "You are not invited"}`)
+	_, err = cli.JoinRestrictedRoom("!room:example.com", &event.JoinRulesEventContent{JoinRule: event.JoinRuleInvite}, nil)
+	require.True(t, errors.As(err, &joinErr))
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+	assert.Contains(t, joinErr.Reason, "rejected")
+	assert.Equal(t, "/_matrix/client/r0/join/!room:example.com", srv.LastRequest(t).Path)
+}
+
+func TestDefaultSyncer_KnockedRooms(t *testing.T) {
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"next_batch": "1",
+		"rooms": {"knock": {"!room:example.com": {"knock_state": {"events": [
+			{"type": "m.room.name", "state_key": "", "sender": "@admin:example.com", "content": {"name": "Room"}},
+			{"type": "m.room.member", "state_key": "@user:example.com", "sender": "@user:example.com", "content": {"membership": "knock"}}
+		]}}}}
+	}`), &resp))
+
+	syncer := mautrix.NewDefaultSyncer()
+	var sources []mautrix.EventSource
+	var members []*event.Event
+	syncer.OnEventType(event.StateMember, func(source mautrix.EventSource, evt *event.Event) {
+		sources = append(sources, source)
+		members = append(members, evt)
+	})
+	require.NoError(t, syncer.ProcessResponse(&resp, ""))
+	require.Len(t, members, 1)
+	assert.Equal(t, mautrix.EventSourceKnock|mautrix.EventSourceState, sources[0])
+	assert.Equal(t, "knocked state", sources[0].String())
+	assert.Equal(t, id.RoomID("!room:example.com"), members[0].RoomID)
+	assert.Equal(t, event.MembershipKnock, members[0].Content.AsMember().Membership)
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RoundTripFunc sends a single HTTP request and returns the response.
+type RoundTripFunc func(req *http.Request) (*http.Response, error)
+
+// Middleware wraps the function that sends HTTP requests. Middlewares can modify the request before calling next,
+// inspect or replace the response after it, or skip calling next entirely (e.g. to serve a cached response).
+type Middleware func(next RoundTripFunc) RoundTripFunc
+
+// Use adds middlewares to the client. The first middleware added is the outermost one, i.e. it sees the request first
+// and the response last. Middlewares are called once per attempt, so retried requests go through them again.
+//
+// This must be called before the client is used.
+func (cli *Client) Use(middlewares ...Middleware) {
+	cli.Middlewares = append(cli.Middlewares, middlewares...)
+}
+
+func (cli *Client) roundTrip(req *http.Request) (*http.Response, error) {
+	next := RoundTripFunc(cli.Client.Do)
+	for i := len(cli.Middlewares) - 1; i >= 0; i-- {
+		next = cli.Middlewares[i](next)
+	}
+	return next(req)
+}
+
+// LoggingMiddleware logs the status code and duration of every request.
+func LoggingMiddleware(log Logger) Middleware {
+	return func(next RoundTripFunc) RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			reqID, _ := req.Context().Value(logRequestIDContextKey).(int)
+			start := time.Now()
+			resp, err := next(req)
+			duration := time.Since(start)
+			if err != nil {
+				log.Debugfln("req #%d: %s %s failed after %s: %v", reqID, req.Method, req.URL.Path, duration, err)
+			} else {
+				log.Debugfln("req #%d: %s %s returned HTTP %d in %s", reqID, req.Method, req.URL.Path, resp.StatusCode, duration)
+			}
+			return resp, err
+		}
+	}
+}
+
+// EndpointMetrics contains the request metrics of a single endpoint class.
+type EndpointMetrics struct {
+	Requests    uint64
+	Errors      uint64
+	StatusCodes map[int]uint64
+
+	TotalDuration time.Duration
+	MaxDuration   time.Duration
+}
+
+// RequestMetrics collects request counts and durations by endpoint class. Add RequestMetrics.Middleware to a client
+// with Client.Use to start collecting.
+type RequestMetrics struct {
+	lock      sync.Mutex
+	endpoints map[EndpointClass]*EndpointMetrics
+}
+
+// NewRequestMetrics creates an empty metrics collector.
+func NewRequestMetrics() *RequestMetrics {
+	return &RequestMetrics{endpoints: make(map[EndpointClass]*EndpointMetrics)}
+}
+
+func (rm *RequestMetrics) record(class EndpointClass, statusCode int, failed bool, duration time.Duration) {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	metrics, ok := rm.endpoints[class]
+	if !ok {
+		metrics = &EndpointMetrics{StatusCodes: make(map[int]uint64)}
+		rm.endpoints[class] = metrics
+	}
+	metrics.Requests++
+	if failed {
+		metrics.Errors++
+	} else {
+		metrics.StatusCodes[statusCode]++
+	}
+	metrics.TotalDuration += duration
+	if duration > metrics.MaxDuration {
+		metrics.MaxDuration = duration
+	}
+}
+
+// Middleware records the metrics of each request.
+func (rm *RequestMetrics) Middleware(next RoundTripFunc) RoundTripFunc {
+	return func(req *http.Request) (*http.Response, error) {
+		start := time.Now()
+		resp, err := next(req)
+		var statusCode int
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		rm.record(ClassifyEndpoint(req.URL.Path), statusCode, err != nil, time.Since(start))
+		return resp, err
+	}
+}
+
+// Snapshot returns a copy of the current metrics.
+func (rm *RequestMetrics) Snapshot() map[EndpointClass]EndpointMetrics {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	snapshot := make(map[EndpointClass]EndpointMetrics, len(rm.endpoints))
+	for class, metrics := range rm.endpoints {
+		copied := *metrics
+		copied.StatusCodes = make(map[int]uint64, len(metrics.StatusCodes))
+		for code, count := range metrics.StatusCodes {
+			copied.StatusCodes[code] = count
+		}
+		snapshot[class] = copied
+	}
+	return snapshot
+}
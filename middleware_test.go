@@ -0,0 +1,146 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+)
+
+type recordingLogger struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (log *recordingLogger) Debugfln(message string, args ...interface{}) {
+	log.lock.Lock()
+	log.lines = append(log.lines, fmt.Sprintf(message, args...))
+	log.lock.Unlock()
+}
+
+func newMiddlewareTestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/r0/sync":
+			_, _ = w.Write([]byte(`{"next_batch": "1"}`))
+		case "/_matrix/client/r0/account/whoami":
+			_, _ = w.Write([]byte(`{"user_id": "@user:example.com"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Not found"}`))
+		}
+	}))
+}
+
+func TestClient_MiddlewareOrder(t *testing.T) {
+	server := newMiddlewareTestServer()
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+
+	var calls []string
+	named := func(name string) mautrix.Middleware {
+		return func(next mautrix.RoundTripFunc) mautrix.RoundTripFunc {
+			return func(req *http.Request) (*http.Response, error) {
+				calls = append(calls, name+" before")
+				resp, err := next(req)
+				calls = append(calls, name+" after")
+				return resp, err
+			}
+		}
+	}
+	cli.Use(named("outer"), named("inner"))
+	resp, err := cli.Whoami()
+	require.NoError(t, err)
+	assert.Equal(t, "@user:example.com", resp.UserID.String())
+	assert.Equal(t, []string{"outer before", "inner before", "inner after", "outer after"}, calls)
+}
+
+func TestClient_MiddlewareShortCircuit(t *testing.T) {
+	server := newMiddlewareTestServer()
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+
+	// A middleware can answer requests without sending them
+	cli.Use(func(next mautrix.RoundTripFunc) mautrix.RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			if strings.HasSuffix(req.URL.Path, "/whoami") {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     make(http.Header),
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"user_id": "@cached:example.com"}`))),
+					Request:    req,
+				}, nil
+			}
+			return nil, errors.New("blocked by middleware")
+		}
+	})
+	resp, err := cli.Whoami()
+	require.NoError(t, err)
+	assert.Equal(t, "@cached:example.com", resp.UserID.String())
+
+	_, err = cli.GetDisplayName("@user:example.com")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "blocked by middleware")
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	server := newMiddlewareTestServer()
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+	log := &recordingLogger{}
+	cli.Use(mautrix.LoggingMiddleware(log))
+
+	_, _ = cli.Whoami()
+	_, _ = cli.GetDisplayName("@user:example.com")
+	require.Len(t, log.lines, 2)
+	assert.Contains(t, log.lines[0], "GET /_matrix/client/r0/account/whoami returned HTTP 200")
+	assert.Contains(t, log.lines[1], "GET /_matrix/client/r0/profile/@user:example.com/displayname returned HTTP 404")
+}
+
+func TestRequestMetrics(t *testing.T) {
+	server := newMiddlewareTestServer()
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+	metrics := mautrix.NewRequestMetrics()
+	cli.Use(metrics.Middleware)
+
+	_, err := cli.SyncRequest(0, "", "", false, "", nil)
+	require.NoError(t, err)
+	_, _ = cli.Whoami()
+	_, _ = cli.GetDisplayName("@user:example.com")
+
+	snapshot := metrics.Snapshot()
+	require.Contains(t, snapshot, mautrix.EndpointClassSync)
+	assert.Equal(t, uint64(1), snapshot[mautrix.EndpointClassSync].Requests)
+	assert.Equal(t, map[int]uint64{200: 1}, snapshot[mautrix.EndpointClassSync].StatusCodes)
+	other := snapshot[mautrix.EndpointClassOther]
+	assert.Equal(t, uint64(2), other.Requests)
+	assert.Equal(t, uint64(0), other.Errors)
+	assert.Equal(t, map[int]uint64{200: 1, 404: 1}, other.StatusCodes)
+	assert.True(t, other.MaxDuration > 0 && other.TotalDuration >= other.MaxDuration)
+
+	// The snapshot is a copy
+	other.StatusCodes[500] = 1
+	assert.NotContains(t, metrics.Snapshot()[mautrix.EndpointClassOther].StatusCodes, 500)
+
+	server.Close()
+	_, err = cli.Whoami()
+	require.Error(t, err)
+	assert.Equal(t, uint64(1), metrics.Snapshot()[mautrix.EndpointClassOther].Errors)
+}
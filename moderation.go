@@ -0,0 +1,135 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ErrACLDeniesOwnServer is returned by SetServerACL if the new ACL would ban the user's own server from the room.
+var ErrACLDeniesOwnServer = errors.New("server ACL would deny the user's own server")
+
+// ReportEvent reports an event to the homeserver admins.
+// See https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3roomsroomidreporteventid
+func (cli *Client) ReportEvent(roomID id.RoomID, eventID id.EventID, req *ReqReport) error {
+	urlPath := cli.BuildURL("rooms", roomID, "report", eventID)
+	_, err := cli.MakeRequest(http.MethodPost, urlPath, req, nil)
+	return err
+}
+
+// ReportRoom reports a whole room to the homeserver admins (MSC4151).
+func (cli *Client) ReportRoom(roomID id.RoomID, reason string) error {
+	urlPath := cli.BuildBaseURL("_matrix", "client", "v3", "rooms", roomID, "report")
+	_, err := cli.MakeRequest(http.MethodPost, urlPath, &ReqReport{Reason: reason}, nil)
+	return err
+}
+
+// ReportUser reports a user to the homeserver admins.
+func (cli *Client) ReportUser(userID id.UserID, reason string) error {
+	urlPath := cli.BuildBaseURL("_matrix", "client", "v3", "users", userID, "report")
+	_, err := cli.MakeRequest(http.MethodPost, urlPath, &ReqReport{Reason: reason}, nil)
+	return err
+}
+
+// GetServerACL gets the server ACL of the given room. If the room doesn't have an ACL, an empty ACL and no error
+// is returned. Note that an empty ACL would deny all servers if it was sent to the room.
+func (cli *Client) GetServerACL(roomID id.RoomID) (acl *event.ServerACLEventContent, err error) {
+	acl = &event.ServerACLEventContent{}
+	err = cli.StateEvent(roomID, event.StateServerACL, "", acl)
+	if errors.Is(err, MNotFound) {
+		err = nil
+	}
+	return
+}
+
+// SetServerACL replaces the server ACL of the given room. To avoid accidentally banning every server including the
+// local one, this returns an error without sending anything if the ACL wouldn't allow the user's own server.
+func (cli *Client) SetServerACL(roomID id.RoomID, acl *event.ServerACLEventContent) (*RespSendEvent, error) {
+	_, ownServer, err := cli.UserID.Parse()
+	if err != nil {
+		return nil, err
+	} else if !acl.IsAllowed(ownServer) {
+		return nil, ErrACLDeniesOwnServer
+	}
+	return cli.SendStateEvent(roomID, event.StateServerACL, "", acl)
+}
+
+// GetIgnoredUsers gets the list of users that the user has ignored.
+func (cli *Client) GetIgnoredUsers() ([]id.UserID, error) {
+	var content event.IgnoredUserListEventContent
+	err := cli.GetAccountData(event.AccountDataIgnoredUserList.Type, &content)
+	if err != nil && !errors.Is(err, MNotFound) {
+		return nil, err
+	}
+	userIDs := make([]id.UserID, 0, len(content.IgnoredUsers))
+	for userID := range content.IgnoredUsers {
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, nil
+}
+
+// updateIgnoredUsers fetches the current ignore list, applies the update and saves it if it changed.
+// Unknown fields in the account data content and the values in the ignored_users map are preserved as-is.
+func (cli *Client) updateIgnoredUsers(update func(ignored map[id.UserID]json.RawMessage) bool) error {
+	var content map[string]json.RawMessage
+	err := cli.GetAccountData(event.AccountDataIgnoredUserList.Type, &content)
+	if err != nil && !errors.Is(err, MNotFound) {
+		return err
+	}
+	if content == nil {
+		content = make(map[string]json.RawMessage)
+	}
+	var ignored map[id.UserID]json.RawMessage
+	if rawIgnored, ok := content["ignored_users"]; ok {
+		err = json.Unmarshal(rawIgnored, &ignored)
+		if err != nil {
+			return err
+		}
+	}
+	if ignored == nil {
+		ignored = make(map[id.UserID]json.RawMessage)
+	}
+	if !update(ignored) {
+		return nil
+	}
+	content["ignored_users"], err = json.Marshal(ignored)
+	if err != nil {
+		return err
+	}
+	return cli.SetAccountData(event.AccountDataIgnoredUserList.Type, content)
+}
+
+// AddIgnoredUsers adds the given users to the ignore list, keeping the users that were already ignored.
+func (cli *Client) AddIgnoredUsers(userIDs ...id.UserID) error {
+	return cli.updateIgnoredUsers(func(ignored map[id.UserID]json.RawMessage) (changed bool) {
+		for _, userID := range userIDs {
+			if _, ok := ignored[userID]; !ok {
+				ignored[userID] = json.RawMessage("{}")
+				changed = true
+			}
+		}
+		return
+	})
+}
+
+// RemoveIgnoredUsers removes the given users from the ignore list.
+func (cli *Client) RemoveIgnoredUsers(userIDs ...id.UserID) error {
+	return cli.updateIgnoredUsers(func(ignored map[id.UserID]json.RawMessage) (changed bool) {
+		for _, userID := range userIDs {
+			if _, ok := ignored[userID]; ok {
+				delete(ignored, userID)
+				changed = true
+			}
+		}
+		return
+	})
+}
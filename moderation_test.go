@@ -0,0 +1,123 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestClient_Report(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	score := -100
+	require.NoError(t, cli.ReportEvent("!room:example.com", "$event", &mautrix.ReqReport{Reason: "spam", Score: &score}))
+	req := srv.LastRequest(t)
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "/_matrix/client/r0/rooms/!room:example.com/report/$event", req.Path)
+	assert.JSONEq(t, `{"reason": "spam", "score": -100}`, req.Body)
+
+	require.NoError(t, cli.ReportRoom("!room:example.com", "abuse"))
+	req = srv.LastRequest(t)
+	assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/report", req.Path)
+	assert.JSONEq(t, `{"reason": "abuse"}`, req.Body)
+
+	require.NoError(t, cli.ReportUser("@spammer:example.com", ""))
+	req = srv.LastRequest(t)
+	assert.Equal(t, "/_matrix/client/v3/users/@spammer:example.com/report", req.Path)
+	assert.JSONEq(t, `{}`, req.Body)
+}
+
+func TestClient_ServerACL(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	cli := mautrix.NewTestClient(t, srv.URL)
+	const aclPath = "/_matrix/client/r0/rooms/!room:example.com/state/m.room.server_acl/"
+
+	srv.RespondStatus("GET "+aclPath, http.StatusNotFound, `{"errcode": "M_NOT_FOUND", "error": "Event not found"}`)
+	acl, err := cli.GetServerACL("!room:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, &event.ServerACLEventContent{}, acl)
+
+	srv.Respond("GET "+aclPath, `{"allow": ["*"], "deny": ["evil.com"], "allow_ip_literals": false}`)
+	acl, err = cli.GetServerACL("!room:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"evil.com"}, acl.Deny)
+	srv.Requests()
+
+	// ACLs that would ban the own server aren't sent
+	_, err = cli.SetServerACL("!room:example.com", &event.ServerACLEventContent{Allow: []string{"*"}, Deny: []string{"*.com"}})
+	assert.ErrorIs(t, err, mautrix.ErrACLDeniesOwnServer)
+	_, err = cli.SetServerACL("!room:example.com", &event.ServerACLEventContent{})
+	assert.ErrorIs(t, err, mautrix.ErrACLDeniesOwnServer)
+	assert.Empty(t, srv.Requests())
+
+	srv.Respond("PUT "+aclPath, `{"event_id": "$acl"}`)
+	resp, err := cli.SetServerACL("!room:example.com", &event.ServerACLEventContent{Allow: []string{"*"}, Deny: []string{"evil.com"}})
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$acl"), resp.EventID)
+	req := srv.LastRequest(t)
+	assert.Equal(t, http.MethodPut, req.Method)
+	assert.JSONEq(t, `{"allow": ["*"], "deny": ["evil.com"], "allow_ip_literals": false}`, req.Body)
+}
+
+func TestClient_IgnoredUsers(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	cli := mautrix.NewTestClient(t, srv.URL)
+	const ignorePath = "/_matrix/client/r0/user/@user:example.com/account_data/m.ignored_user_list"
+
+	srv.RespondStatus("GET "+ignorePath, http.StatusNotFound, `{"errcode": "M_NOT_FOUND", "error": "Account data not found"}`)
+	ignored, err := cli.GetIgnoredUsers()
+	require.NoError(t, err)
+	assert.Empty(t, ignored)
+	srv.Requests()
+
+	require.NoError(t, cli.AddIgnoredUsers("@a:example.com"))
+	requests := srv.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, http.MethodPut, requests[1].Method)
+	assert.JSONEq(t, `{"ignored_users": {"@a:example.com": {}}}`, requests[1].Body)
+
+	// Existing entries and unknown fields are preserved
+	srv.Respond("GET "+ignorePath, `{"ignored_users": {"@a:example.com": {"extra": true}}, "other": 1}`)
+	require.NoError(t, cli.AddIgnoredUsers("@a:example.com", "@b:example.com"))
+	requests = srv.Requests()
+	require.Len(t, requests, 2)
+	assert.JSONEq(t, `{"ignored_users": {"@a:example.com": {"extra": true}, "@b:example.com": {}}, "other": 1}`, requests[1].Body)
+
+	ignored, err = cli.GetIgnoredUsers()
+	require.NoError(t, err)
+	assert.Equal(t, []id.UserID{"@a:example.com"}, ignored)
+	srv.Requests()
+
+	require.NoError(t, cli.RemoveIgnoredUsers("@a:example.com"))
+	requests = srv.Requests()
+	require.Len(t, requests, 2)
+	assert.JSONEq(t, `{"ignored_users": {}, "other": 1}`, requests[1].Body)
+
+	// Nothing is saved if the list doesn't change
+	require.NoError(t, cli.AddIgnoredUsers("@a:example.com"))
+	require.NoError(t, cli.RemoveIgnoredUsers("@c:example.com"))
+	for _, req := range srv.Requests() {
+		assert.Equal(t, http.MethodGet, req.Method)
+	}
+
+	srv.RespondStatus("GET "+ignorePath, http.StatusForbidden, `{"errcode": "M_FORBIDDEN", "error": "No"}`)
+	_, err = cli.GetIgnoredUsers()
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+	assert.ErrorIs(t, cli.AddIgnoredUsers("@c:example.com"), mautrix.MForbidden)
+}
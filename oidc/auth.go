@@ -0,0 +1,254 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oidc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// ScopeOpenID is the standard OpenID Connect scope.
+	ScopeOpenID = "openid"
+	// ScopeMatrixAPI grants full access to the client-server API (MSC2967).
+	ScopeMatrixAPI = "urn:matrix:org.matrix.msc2967.client:api:*"
+	// ScopeMatrixDevicePrefix is followed by the device ID to bind the token to a device (MSC2967).
+	ScopeMatrixDevicePrefix = "urn:matrix:org.matrix.msc2967.client:device:"
+)
+
+// AuthorizationHandler sends the user to the authorization URL, e.g. by opening it in a browser, and returns the
+// redirect URL that the provider sent the user back to after they approved or denied the request.
+type AuthorizationHandler interface {
+	Authorize(ctx context.Context, authURL string) (*url.URL, error)
+}
+
+// AuthorizationHandlerFunc is a function that implements AuthorizationHandler.
+type AuthorizationHandlerFunc func(ctx context.Context, authURL string) (*url.URL, error)
+
+func (fn AuthorizationHandlerFunc) Authorize(ctx context.Context, authURL string) (*url.URL, error) {
+	return fn(ctx, authURL)
+}
+
+// ClientMetadata is the metadata used to register the client dynamically if it doesn't have a client ID.
+// See https://tools.ietf.org/html/rfc7591#section-2
+type ClientMetadata struct {
+	ClientName              string   `json:"client_name,omitempty"`
+	ClientURI               string   `json:"client_uri,omitempty"`
+	LogoURI                 string   `json:"logo_uri,omitempty"`
+	PolicyURI               string   `json:"policy_uri,omitempty"`
+	TOSURI                  string   `json:"tos_uri,omitempty"`
+	ApplicationType         string   `json:"application_type,omitempty"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+}
+
+type respRegisterClient struct {
+	ClientID string `json:"client_id"`
+}
+
+// Authenticator logs a mautrix.Client in using the OpenID Connect provider of its homeserver.
+type Authenticator struct {
+	// The client to log in. It must have the homeserver URL set.
+	Client *mautrix.Client
+	// The HTTP client used for requests to the provider. Defaults to the HTTP client of Client.
+	HTTPClient *http.Client
+	// The handler that sends the user to the provider to authorize the login.
+	Handler AuthorizationHandler
+
+	// The client ID registered at the provider. If empty, the client is registered dynamically using ClientMetadata.
+	ClientID       string
+	ClientMetadata ClientMetadata
+	// The redirect URI the provider should send the user back to.
+	RedirectURI string
+	// Scopes to request in addition to the OpenID and Matrix scopes.
+	ExtraScopes []string
+
+	// The issuer and its metadata. They're discovered from the homeserver if not set.
+	Issuer   string
+	Provider *ProviderMetadata
+}
+
+func (auth *Authenticator) httpClient() *http.Client {
+	if auth.HTTPClient != nil {
+		return auth.HTTPClient
+	} else if auth.Client.Client != nil {
+		return auth.Client.Client
+	}
+	return http.DefaultClient
+}
+
+// Discover finds the issuer of the homeserver and fetches its metadata, unless they've already been set.
+func (auth *Authenticator) Discover(ctx context.Context) error {
+	if auth.Provider != nil {
+		return nil
+	}
+	if len(auth.Issuer) == 0 {
+		issuer, err := DiscoverIssuer(auth.Client)
+		if err != nil {
+			return err
+		}
+		auth.Issuer = issuer
+	}
+	provider, err := DiscoverProvider(ctx, auth.httpClient(), auth.Issuer)
+	if err != nil {
+		return err
+	}
+	auth.Provider = provider
+	return nil
+}
+
+// RegisterClient registers the client at the provider using ClientMetadata and stores the returned client ID.
+// See https://github.com/matrix-org/matrix-spec-proposals/pull/2966
+func (auth *Authenticator) RegisterClient(ctx context.Context) error {
+	if len(auth.Provider.RegistrationEndpoint) == 0 {
+		return ErrNoRegistration
+	}
+	meta := auth.ClientMetadata
+	if len(meta.RedirectURIs) == 0 {
+		meta.RedirectURIs = []string{auth.RedirectURI}
+	}
+	if len(meta.GrantTypes) == 0 {
+		meta.GrantTypes = []string{"authorization_code", "refresh_token"}
+	}
+	if len(meta.ResponseTypes) == 0 {
+		meta.ResponseTypes = []string{"code"}
+	}
+	if len(meta.TokenEndpointAuthMethod) == 0 {
+		meta.TokenEndpointAuthMethod = "none"
+	}
+	body, err := json.Marshal(&meta)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, auth.Provider.RegistrationEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", auth.Client.UserAgent)
+	resp, err := auth.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var regResp respRegisterClient
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		oidcErr := &Error{StatusCode: resp.StatusCode}
+		if json.Unmarshal(data, oidcErr) != nil || len(oidcErr.Code) == 0 {
+			return fmt.Errorf("%w: client registration returned HTTP %d", ErrUnexpectedResponse, resp.StatusCode)
+		}
+		return oidcErr
+	} else if err = json.Unmarshal(data, &regResp); err != nil || len(regResp.ClientID) == 0 {
+		return fmt.Errorf("%w: client registration didn't return a client ID", ErrUnexpectedResponse)
+	}
+	auth.ClientID = regResp.ClientID
+	return nil
+}
+
+// Scopes returns the scopes requested when authorizing the given device.
+func (auth *Authenticator) Scopes(deviceID id.DeviceID) []string {
+	scopes := []string{ScopeOpenID, ScopeMatrixAPI, ScopeMatrixDevicePrefix + string(deviceID)}
+	return append(scopes, auth.ExtraScopes...)
+}
+
+// AuthorizationURL builds the URL that the user is sent to in order to authorize the login.
+func (auth *Authenticator) AuthorizationURL(deviceID id.DeviceID, state, verifier string) (string, error) {
+	authURL, err := url.Parse(auth.Provider.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to parse authorization endpoint: %v", ErrInvalidMetadata, err)
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("response_mode", "query")
+	query.Set("client_id", auth.ClientID)
+	query.Set("redirect_uri", auth.RedirectURI)
+	query.Set("scope", strings.Join(auth.Scopes(deviceID), " "))
+	query.Set("state", state)
+	query.Set("code_challenge", CodeChallenge(verifier))
+	query.Set("code_challenge_method", CodeChallengeMethodS256)
+	authURL.RawQuery = query.Encode()
+	return authURL.String(), nil
+}
+
+// parseRedirect extracts the authorization code from the redirect URL after checking the state.
+func parseRedirect(redirect *url.URL, state string) (string, error) {
+	query := redirect.Query()
+	if errCode := query.Get("error"); len(errCode) > 0 {
+		return "", &Error{Code: errCode, Description: query.Get("error_description")}
+	} else if query.Get("state") != state {
+		return "", ErrStateMismatch
+	} else if code := query.Get("code"); len(code) > 0 {
+		return code, nil
+	}
+	return "", ErrNoAuthCode
+}
+
+// Login authorizes a new device using the authorization code flow with PKCE and stores the resulting credentials in
+// the client. If deviceID is empty, a random device ID is generated. The client's Refresher is set so that the
+// access token is refreshed using the provider when it expires.
+func (auth *Authenticator) Login(ctx context.Context, deviceID id.DeviceID) (*TokenResponse, error) {
+	if auth.Handler == nil {
+		return nil, ErrNoHandler
+	}
+	err := auth.Discover(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover OpenID Connect provider: %w", err)
+	}
+	if len(auth.ClientID) == 0 {
+		err = auth.RegisterClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to register client: %w", err)
+		}
+	}
+	if len(deviceID) == 0 {
+		deviceID = id.DeviceID(NewDeviceID())
+	}
+	state := newState()
+	verifier := NewCodeVerifier()
+	authURL, err := auth.AuthorizationURL(deviceID, state, verifier)
+	if err != nil {
+		return nil, err
+	}
+	redirect, err := auth.Handler.Authorize(ctx, authURL)
+	if err != nil {
+		return nil, fmt.Errorf("authorization failed: %w", err)
+	}
+	code, err := parseRedirect(redirect, state)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := auth.ExchangeCode(ctx, code, verifier)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange authorization code: %w", err)
+	}
+	auth.Client.AccessToken = resp.AccessToken
+	auth.Client.RefreshToken = resp.RefreshToken
+	auth.Client.DeviceID = deviceID
+	auth.Client.Refresher = auth.Refresh
+	whoami, err := auth.Client.Whoami()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user ID with new access token: %w", err)
+	}
+	auth.Client.UserID = whoami.UserID
+	return resp, nil
+}
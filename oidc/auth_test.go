@@ -0,0 +1,184 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oidc_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/oidc"
+)
+
+type mockProvider struct {
+	t         *testing.T
+	server    *httptest.Server
+	challenge string
+	scope     string
+	tokens    int
+}
+
+func (mp *mockProvider) writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func (mp *mockProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/_matrix/client/unstable/org.matrix.msc2965/auth_issuer":
+		mp.writeJSON(w, http.StatusOK, map[string]string{"issuer": mp.server.URL + "/"})
+	case "/.well-known/openid-configuration":
+		mp.writeJSON(w, http.StatusOK, &oidc.ProviderMetadata{
+			Issuer:                        mp.server.URL + "/",
+			AuthorizationEndpoint:         mp.server.URL + "/authorize",
+			TokenEndpoint:                 mp.server.URL + "/token",
+			RegistrationEndpoint:          mp.server.URL + "/register",
+			CodeChallengeMethodsSupported: []string{"plain", oidc.CodeChallengeMethodS256},
+		})
+	case "/register":
+		var meta oidc.ClientMetadata
+		require.NoError(mp.t, json.NewDecoder(r.Body).Decode(&meta))
+		assert.Equal(mp.t, []string{"http://localhost/callback"}, meta.RedirectURIs)
+		assert.Equal(mp.t, "none", meta.TokenEndpointAuthMethod)
+		mp.writeJSON(w, http.StatusCreated, map[string]string{"client_id": "test-client"})
+	case "/token":
+		require.NoError(mp.t, r.ParseForm())
+		assert.Equal(mp.t, "test-client", r.PostForm.Get("client_id"))
+		switch r.PostForm.Get("grant_type") {
+		case "authorization_code":
+			if r.PostForm.Get("code") != "auth-code" || oidc.CodeChallenge(r.PostForm.Get("code_verifier")) != mp.challenge {
+				mp.writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+				return
+			}
+		case "refresh_token":
+			if r.PostForm.Get("refresh_token") != "refresh-1" {
+				mp.writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+				return
+			}
+		}
+		mp.tokens++
+		mp.writeJSON(w, http.StatusOK, &oidc.TokenResponse{
+			AccessToken:  "access-" + string(rune('0'+mp.tokens)),
+			RefreshToken: "refresh-" + string(rune('0'+mp.tokens)),
+			TokenType:    "Bearer",
+			ExpiresIn:    300,
+		})
+	case "/_matrix/client/r0/account/whoami":
+		if r.Header.Get("Authorization") != "Bearer access-"+string(rune('0'+mp.tokens)) {
+			mp.writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+				"errcode":     "M_UNKNOWN_TOKEN",
+				"error":       "Token expired",
+				"soft_logout": true,
+			})
+			return
+		}
+		mp.writeJSON(w, http.StatusOK, &mautrix.RespWhoami{UserID: "@user:example.com"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (mp *mockProvider) Authorize(_ context.Context, authURL string) (*url.URL, error) {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		return nil, err
+	}
+	query := parsed.Query()
+	assert.Equal(mp.t, "/authorize", parsed.Path)
+	assert.Equal(mp.t, oidc.CodeChallengeMethodS256, query.Get("code_challenge_method"))
+	mp.challenge = query.Get("code_challenge")
+	mp.scope = query.Get("scope")
+	redirect, _ := url.Parse(query.Get("redirect_uri"))
+	redirectQuery := redirect.Query()
+	redirectQuery.Set("code", "auth-code")
+	redirectQuery.Set("state", query.Get("state"))
+	redirect.RawQuery = redirectQuery.Encode()
+	return redirect, nil
+}
+
+func newMockProvider(t *testing.T) (*mockProvider, *oidc.Authenticator) {
+	mp := &mockProvider{t: t}
+	mp.server = httptest.NewServer(mp)
+	t.Cleanup(mp.server.Close)
+	cli, err := mautrix.NewClient(mp.server.URL, "", "")
+	require.NoError(t, err)
+	return mp, &oidc.Authenticator{
+		Client:      cli,
+		Handler:     mp,
+		RedirectURI: "http://localhost/callback",
+	}
+}
+
+func TestAuthenticator_Login(t *testing.T) {
+	mp, auth := newMockProvider(t)
+	resp, err := auth.Login(context.Background(), "DEVICE")
+	require.NoError(t, err)
+	assert.Equal(t, "access-1", resp.AccessToken)
+	assert.Equal(t, "test-client", auth.ClientID)
+	assert.Equal(t, "access-1", auth.Client.AccessToken)
+	assert.Equal(t, "refresh-1", auth.Client.RefreshToken)
+	assert.Equal(t, id.DeviceID("DEVICE"), auth.Client.DeviceID)
+	assert.Equal(t, id.UserID("@user:example.com"), auth.Client.UserID)
+	assert.Contains(t, strings.Fields(mp.scope), oidc.ScopeMatrixAPI)
+	assert.Contains(t, strings.Fields(mp.scope), oidc.ScopeMatrixDevicePrefix+"DEVICE")
+}
+
+func TestAuthenticator_Login_StateMismatch(t *testing.T) {
+	mp, auth := newMockProvider(t)
+	auth.Handler = oidc.AuthorizationHandlerFunc(func(ctx context.Context, authURL string) (*url.URL, error) {
+		redirect, err := mp.Authorize(ctx, authURL)
+		if err == nil {
+			redirect.RawQuery = url.Values{"code": {"auth-code"}, "state": {"wrong"}}.Encode()
+		}
+		return redirect, err
+	})
+	_, err := auth.Login(context.Background(), "")
+	assert.True(t, errors.Is(err, oidc.ErrStateMismatch))
+	assert.Empty(t, auth.Client.AccessToken)
+}
+
+func TestAuthenticator_Login_Denied(t *testing.T) {
+	_, auth := newMockProvider(t)
+	auth.Handler = oidc.AuthorizationHandlerFunc(func(ctx context.Context, authURL string) (*url.URL, error) {
+		return url.Parse("http://localhost/callback?error=access_denied&error_description=nope")
+	})
+	_, err := auth.Login(context.Background(), "")
+	var oidcErr *oidc.Error
+	require.True(t, errors.As(err, &oidcErr))
+	assert.Equal(t, "access_denied", oidcErr.Code)
+}
+
+func TestAuthenticator_RefreshAfterSoftLogout(t *testing.T) {
+	_, auth := newMockProvider(t)
+	_, err := auth.Login(context.Background(), "DEVICE")
+	require.NoError(t, err)
+	var refreshed *mautrix.RespRefresh
+	auth.Client.OnTokenRefresh = func(resp *mautrix.RespRefresh) {
+		refreshed = resp
+	}
+	// The homeserver rejects unknown tokens with a soft logout, which should make the client refresh the token
+	// using the provider and retry the request.
+	auth.Client.AccessToken = "access-expired"
+	whoami, err := auth.Client.Whoami()
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@user:example.com"), whoami.UserID)
+	require.NotNil(t, refreshed)
+	assert.Equal(t, "access-2", auth.Client.AccessToken)
+	assert.Equal(t, "refresh-2", auth.Client.RefreshToken)
+	assert.Equal(t, int64(300000), refreshed.ExpiresInMS)
+}
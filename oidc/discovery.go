@@ -0,0 +1,121 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package oidc implements logging in to homeservers that delegate authentication to an OpenID Connect provider,
+// as specified in MSC3861 (https://github.com/matrix-org/matrix-spec-proposals/pull/3861) and its sub-proposals.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"maunium.net/go/mautrix"
+)
+
+var (
+	ErrNoIssuer           = errors.New("homeserver doesn't delegate authentication to an OpenID Connect provider")
+	ErrInvalidMetadata    = errors.New("invalid OpenID Connect provider metadata")
+	ErrPKCEUnsupported    = errors.New("OpenID Connect provider doesn't support the S256 code challenge method")
+	ErrNoRegistration     = errors.New("OpenID Connect provider doesn't support dynamic client registration")
+	ErrStateMismatch      = errors.New("state in authorization response doesn't match the request")
+	ErrNoAuthCode         = errors.New("authorization response didn't contain a code")
+	ErrNoHandler          = errors.New("no authorization handler configured")
+	ErrUnexpectedResponse = errors.New("unexpected response from OpenID Connect provider")
+)
+
+// ProviderMetadata is the OpenID Connect discovery document of an issuer.
+// See https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+type ProviderMetadata struct {
+	Issuer                        string   `json:"issuer"`
+	AuthorizationEndpoint         string   `json:"authorization_endpoint"`
+	TokenEndpoint                 string   `json:"token_endpoint"`
+	RegistrationEndpoint          string   `json:"registration_endpoint,omitempty"`
+	RevocationEndpoint            string   `json:"revocation_endpoint,omitempty"`
+	ScopesSupported               []string `json:"scopes_supported,omitempty"`
+	ResponseTypesSupported        []string `json:"response_types_supported,omitempty"`
+	GrantTypesSupported           []string `json:"grant_types_supported,omitempty"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported,omitempty"`
+	AccountManagementURI          string   `json:"account_management_uri,omitempty"`
+}
+
+func contains(list []string, item string) bool {
+	for _, listItem := range list {
+		if listItem == item {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that the metadata belongs to the given issuer and supports the authorization code flow with PKCE.
+func (meta *ProviderMetadata) Validate(issuer string) error {
+	if strings.TrimSuffix(meta.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return fmt.Errorf("%w: issuer %q doesn't match expected %q", ErrInvalidMetadata, meta.Issuer, issuer)
+	} else if len(meta.AuthorizationEndpoint) == 0 || len(meta.TokenEndpoint) == 0 {
+		return fmt.Errorf("%w: missing authorization or token endpoint", ErrInvalidMetadata)
+	} else if len(meta.CodeChallengeMethodsSupported) > 0 && !contains(meta.CodeChallengeMethodsSupported, CodeChallengeMethodS256) {
+		return ErrPKCEUnsupported
+	}
+	return nil
+}
+
+// DiscoverIssuer finds the OpenID Connect issuer of the homeserver the client is connected to. The MSC2965
+// auth_issuer endpoint is tried first, and the .well-known file of the server is used as a fallback.
+func DiscoverIssuer(cli *mautrix.Client) (string, error) {
+	resp, err := cli.GetAuthIssuer()
+	if err == nil && len(resp.Issuer) > 0 {
+		return resp.Issuer, nil
+	}
+	wellKnown, wellKnownErr := mautrix.DiscoverClientAPI(cli.HomeserverURL.Host)
+	if wellKnownErr == nil && wellKnown != nil && wellKnown.Authentication != nil && len(wellKnown.Authentication.Issuer) > 0 {
+		return wellKnown.Authentication.Issuer, nil
+	}
+	if err != nil {
+		var httpErr mautrix.HTTPError
+		if errors.As(err, &httpErr) && httpErr.IsStatus(http.StatusNotFound) {
+			return "", ErrNoIssuer
+		}
+		return "", err
+	}
+	return "", ErrNoIssuer
+}
+
+// DiscoverProvider fetches and validates the OpenID Connect discovery document of the given issuer.
+func DiscoverProvider(ctx context.Context, client *http.Client, issuer string) (*ProviderMetadata, error) {
+	discoveryURL := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", mautrix.DefaultUserAgent+" OIDC discovery")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: discovery document returned HTTP %d", ErrUnexpectedResponse, resp.StatusCode)
+	}
+	var meta ProviderMetadata
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+	}
+	err = meta.Validate(issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
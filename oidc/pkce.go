@@ -0,0 +1,52 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// CodeChallengeMethodS256 is the only PKCE code challenge method supported by this package.
+const CodeChallengeMethodS256 = "S256"
+
+const deviceIDAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+func randomBytes(length int) []byte {
+	data := make([]byte, length)
+	_, err := rand.Read(data)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// NewCodeVerifier generates a random PKCE code verifier as specified in https://tools.ietf.org/html/rfc7636#section-4.1
+func NewCodeVerifier() string {
+	// 32 random bytes are encoded as 43 characters, which is the minimum length allowed by the RFC.
+	return base64.RawURLEncoding.EncodeToString(randomBytes(32))
+}
+
+// CodeChallenge returns the S256 code challenge for the given code verifier.
+func CodeChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func newState() string {
+	return base64.RawURLEncoding.EncodeToString(randomBytes(16))
+}
+
+// NewDeviceID generates a random device ID, which is used in the device scope when authorizing a new device.
+func NewDeviceID() string {
+	data := randomBytes(10)
+	for i, b := range data {
+		data[i] = deviceIDAlphabet[int(b)%len(deviceIDAlphabet)]
+	}
+	return string(data)
+}
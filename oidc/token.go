@@ -0,0 +1,146 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"maunium.net/go/mautrix"
+)
+
+// TokenResponse is the response of the token endpoint. See https://tools.ietf.org/html/rfc6749#section-5.1
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// RespRefresh converts the token response into the format used by mautrix.Client.
+func (resp *TokenResponse) RespRefresh() *mautrix.RespRefresh {
+	return &mautrix.RespRefresh{
+		AccessToken:  resp.AccessToken,
+		RefreshToken: resp.RefreshToken,
+		ExpiresInMS:  resp.ExpiresIn * 1000,
+	}
+}
+
+// Error is an error response from the authorization or token endpoint.
+// See https://tools.ietf.org/html/rfc6749#section-5.2
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+	StatusCode  int    `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if len(e.Description) > 0 {
+		return fmt.Sprintf("OpenID Connect error %s: %s", e.Code, e.Description)
+	}
+	return fmt.Sprintf("OpenID Connect error %s", e.Code)
+}
+
+// postForm sends a form-encoded POST request to the given OAuth 2.0 endpoint and parses the JSON response into respJSON,
+// unless it's nil.
+func (auth *Authenticator) postForm(ctx context.Context, endpoint string, form url.Values, respJSON interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", auth.Client.UserAgent)
+	resp, err := auth.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		oidcErr := &Error{StatusCode: resp.StatusCode}
+		if json.Unmarshal(data, oidcErr) != nil || len(oidcErr.Code) == 0 {
+			return fmt.Errorf("%w: HTTP %d from %s", ErrUnexpectedResponse, resp.StatusCode, endpoint)
+		}
+		return oidcErr
+	}
+	if respJSON == nil {
+		return nil
+	}
+	err = json.Unmarshal(data, respJSON)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnexpectedResponse, err)
+	}
+	return nil
+}
+
+// ExchangeCode exchanges an authorization code for tokens at the token endpoint.
+func (auth *Authenticator) ExchangeCode(ctx context.Context, code, verifier string) (*TokenResponse, error) {
+	var resp TokenResponse
+	err := auth.postForm(ctx, auth.Provider.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {auth.RedirectURI},
+		"client_id":     {auth.ClientID},
+		"code_verifier": {verifier},
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RefreshWithContext gets a new access token from the token endpoint using the given refresh token.
+func (auth *Authenticator) RefreshWithContext(ctx context.Context, refreshToken string) (*TokenResponse, error) {
+	var resp TokenResponse
+	err := auth.postForm(ctx, auth.Provider.TokenEndpoint, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {auth.ClientID},
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Refresh gets a new access token using the given refresh token. It's used as the mautrix.Client Refresher
+// after logging in, so tokens are refreshed transparently when the homeserver reports a soft logout.
+func (auth *Authenticator) Refresh(refreshToken string) (*mautrix.RespRefresh, error) {
+	resp, err := auth.RefreshWithContext(context.Background(), refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	return resp.RespRefresh(), nil
+}
+
+// RevokeToken revokes an access or refresh token at the provider's revocation endpoint, if it has one.
+// See https://tools.ietf.org/html/rfc7009
+func (auth *Authenticator) RevokeToken(ctx context.Context, token, tokenTypeHint string) error {
+	if len(auth.Provider.RevocationEndpoint) == 0 {
+		return nil
+	}
+	form := url.Values{
+		"token":     {token},
+		"client_id": {auth.ClientID},
+	}
+	if len(tokenTypeHint) > 0 {
+		form.Set("token_type_hint", tokenTypeHint)
+	}
+	// The response body of the revocation endpoint is empty, so it's not parsed.
+	return auth.postForm(ctx, auth.Provider.RevocationEndpoint, form, nil)
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// RequestOpenIDToken gets an OpenID token that third parties like widgets, integration managers and identity servers
+// can use to verify the identity of the user. The token can be verified with OpenIDVerifier.
+// See https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3useruseridopenidrequest_token
+func (cli *Client) RequestOpenIDToken() (resp *RespOpenIDToken, err error) {
+	urlPath := cli.BuildURL("user", cli.UserID, "openid", "request_token")
+	_, err = cli.MakeRequest(http.MethodPost, urlPath, struct{}{}, &resp)
+	return
+}
+
+var (
+	// ErrOpenIDTokenInvalid means that the homeserver didn't accept the OpenID token, e.g. because it expired.
+	ErrOpenIDTokenInvalid = errors.New("OpenID token is invalid")
+	// ErrOpenIDServerMismatch means that the homeserver returned a user ID on a different server than the one the
+	// token claimed to be from.
+	ErrOpenIDServerMismatch = errors.New("OpenID token user is not on the token's server")
+	// ErrOpenIDServerNotAllowed means that the token's server name is an IP address or resolves to a loopback,
+	// private or link-local address, see OpenIDVerifier.AllowPrivateAddresses.
+	ErrOpenIDServerNotAllowed = errors.New("OpenID token server is not allowed")
+)
+
+// privateIPNets are the address ranges that aren't reachable on the public internet, in addition to the ones
+// that have their own methods in net.IP (loopback, link-local, multicast and unspecified addresses).
+var privateIPNets = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"fc00::/7",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, nets[i], _ = net.ParseCIDR(cidr)
+	}
+	return nets
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return false
+	}
+	for _, ipNet := range privateIPNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+type resolvedAddressContextKey struct{}
+
+// OpenIDVerifier verifies OpenID tokens created with RequestOpenIDToken by asking the homeserver that issued them
+// through the federation API. This is how widgets and integration managers authenticate Matrix users.
+type OpenIDVerifier struct {
+	// HTTPClient is used for the userinfo requests. The default client from NewOpenIDVerifier connects to the
+	// addresses found from SRV records. Custom clients will always connect to the hostname in the Host header.
+	HTTPClient *http.Client
+	// Discovery is used to resolve server names using .well-known/matrix/server files.
+	Discovery *DiscoveryCache
+	UserAgent string
+
+	// AllowPrivateAddresses allows tokens from servers whose name is an IP address, and makes the default clients
+	// from NewOpenIDVerifier connect to loopback, private and link-local addresses. The server name comes from
+	// whoever provided the token, so those are rejected by default to prevent making requests to internal services.
+	// Custom HTTP clients must do their own address filtering.
+	AllowPrivateAddresses bool
+}
+
+// NewOpenIDVerifier creates an OpenID token verifier. The verifier has its own DiscoveryCache for resolving server
+// names, as its HTTP client refuses to connect to private addresses (see AllowPrivateAddresses).
+func NewOpenIDVerifier() *OpenIDVerifier {
+	verifier := &OpenIDVerifier{UserAgent: DefaultUserAgent + " OpenID verifier"}
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			return verifier.checkDialAddress(address)
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// The address check must see the real destination rather than a proxy.
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if resolvedAddr, ok := ctx.Value(resolvedAddressContextKey{}).(string); ok {
+			addr = resolvedAddr
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	verifier.HTTPClient = &http.Client{Timeout: 30 * time.Second, Transport: transport}
+	verifier.Discovery = NewDiscoveryCache()
+	verifier.Discovery.HTTPClient = verifier.HTTPClient
+	return verifier
+}
+
+// checkDialAddress is called with the resolved IP address before connecting to it.
+func (v *OpenIDVerifier) checkDialAddress(address string) error {
+	if v.AllowPrivateAddresses {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("%w: %s is not a public address", ErrOpenIDServerNotAllowed, host)
+	}
+	return nil
+}
+
+type respOpenIDUserInfo struct {
+	Sub id.UserID `json:"sub"`
+}
+
+// Verify checks the given OpenID token with the server in its MatrixServerName field and returns the user ID that the
+// token belongs to. The server name comes from whoever provided the token, so the returned user ID is checked to be on
+// that server, but callers should still restrict which server names are acceptable if needed.
+// See https://spec.matrix.org/v1.3/server-server-api/#get_matrixfederationv1openiduserinfo
+func (v *OpenIDVerifier) Verify(ctx context.Context, token *RespOpenIDToken) (id.UserID, error) {
+	if len(token.AccessToken) == 0 {
+		return "", fmt.Errorf("%w: access token is empty", ErrOpenIDTokenInvalid)
+	} else if !v.AllowPrivateAddresses && isIPLiteralServerName(token.MatrixServerName) {
+		return "", fmt.Errorf("%w: %s is an IP address", ErrOpenIDServerNotAllowed, token.MatrixServerName)
+	}
+	resolved, err := v.Discovery.ResolveServerName(ctx, token.MatrixServerName)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve server name: %w", err)
+	}
+	userInfoURL := resolved.URL("_matrix", "federation", "v1", "openid", "userinfo")
+	query := userInfoURL.Query()
+	query.Set("access_token", token.AccessToken)
+	userInfoURL.RawQuery = query.Encode()
+
+	ctx = context.WithValue(ctx, resolvedAddressContextKey{}, resolved.Address)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, userInfoURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Host = resolved.Host
+	req.Header.Set("User-Agent", v.UserAgent)
+	resp, err := v.HTTPClient.Do(req)
+	if err != nil {
+		// The URL contains the access token, so don't include it in the error
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return "", fmt.Errorf("failed to request user info: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read user info response: %w", err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", ErrOpenIDTokenInvalid
+	} else if resp.StatusCode != http.StatusOK {
+		respErr := HTTPError{
+			Request:      req,
+			Response:     resp,
+			ResponseBody: string(body),
+			Message:      "user info request failed",
+		}
+		var matrixErr RespError
+		if json.Unmarshal(body, &matrixErr) == nil && len(matrixErr.ErrCode) > 0 {
+			respErr.RespError = &matrixErr
+		}
+		return "", respErr
+	}
+	var userInfo respOpenIDUserInfo
+	err = json.Unmarshal(body, &userInfo)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse user info response: %w", err)
+	}
+	_, serverName, err := userInfo.Sub.Parse()
+	if err != nil {
+		return "", fmt.Errorf("invalid user ID in user info response: %w", err)
+	} else if serverName != token.MatrixServerName {
+		return "", fmt.Errorf("%w: got %s from %s", ErrOpenIDServerMismatch, userInfo.Sub, token.MatrixServerName)
+	}
+	return userInfo.Sub, nil
+}
+
+func isIPLiteralServerName(serverName string) bool {
+	host := serverName
+	if splitHost, _, err := net.SplitHostPort(serverName); err == nil {
+		host = splitHost
+	}
+	return net.ParseIP(strings.Trim(host, "[]")) != nil
+}
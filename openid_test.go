@@ -0,0 +1,125 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestClient_RequestOpenIDToken(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("POST /_matrix/client/r0/user/@user:example.com/openid/request_token", `{"access_token": "openid", "token_type": "Bearer", "matrix_server_name": "example.com", "expires_in": 3600}`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	resp, err := cli.RequestOpenIDToken()
+	require.NoError(t, err)
+	assert.Equal(t, &mautrix.RespOpenIDToken{AccessToken: "openid", TokenType: "Bearer", MatrixServerName: "example.com", ExpiresIn: 3600}, resp)
+	req := srv.LastRequest(t)
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.JSONEq(t, `{}`, req.Body)
+}
+
+func newOpenIDTestVerifier(srv *discoveryTestServer) *mautrix.OpenIDVerifier {
+	verifier := mautrix.NewOpenIDVerifier()
+	verifier.HTTPClient = srv.Client()
+	verifier.Discovery = srv.newCache()
+	verifier.AllowPrivateAddresses = true
+	return verifier
+}
+
+func TestOpenIDVerifier_Verify(t *testing.T) {
+	srv := newDiscoveryTestServer()
+	defer srv.Close()
+	var query []string
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = append(query, r.URL.RawQuery)
+		if r.URL.Path != "/_matrix/federation/v1/openid/userinfo" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.URL.Query().Get("access_token") {
+		case "valid":
+			_, _ = w.Write([]byte(`{"sub": "@user:` + srv.ServerName() + `"}`))
+		case "foreign":
+			_, _ = w.Write([]byte(`{"sub": "@user:example.com"}`))
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN", "error": "Internal error"}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "Invalid token"}`))
+		}
+	})
+	verifier := newOpenIDTestVerifier(srv)
+	token := func(accessToken string) *mautrix.RespOpenIDToken {
+		return &mautrix.RespOpenIDToken{AccessToken: accessToken, MatrixServerName: srv.ServerName()}
+	}
+
+	userID, err := verifier.Verify(context.Background(), token("valid"))
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@user:"+srv.ServerName()), userID)
+	assert.Equal(t, []string{"access_token=valid"}, query)
+
+	_, err = verifier.Verify(context.Background(), token("expired"))
+	assert.ErrorIs(t, err, mautrix.ErrOpenIDTokenInvalid)
+
+	// The user must be on the server that the token claims to be from
+	_, err = verifier.Verify(context.Background(), token("foreign"))
+	assert.ErrorIs(t, err, mautrix.ErrOpenIDServerMismatch)
+
+	_, err = verifier.Verify(context.Background(), token("broken"))
+	var httpErr mautrix.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.True(t, httpErr.IsStatus(http.StatusInternalServerError))
+	assert.Equal(t, "M_UNKNOWN", httpErr.RespError.ErrCode)
+
+	query = nil
+	_, err = verifier.Verify(context.Background(), token(""))
+	assert.ErrorIs(t, err, mautrix.ErrOpenIDTokenInvalid)
+	assert.Empty(t, query)
+
+	_, err = verifier.Verify(context.Background(), &mautrix.RespOpenIDToken{AccessToken: "valid", MatrixServerName: "invalid/server"})
+	assert.Error(t, err)
+	assert.Empty(t, query)
+
+	// Connection errors don't leak the access token
+	srv.Close()
+	_, err = verifier.Verify(context.Background(), token("secret-token"))
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "secret-token")
+}
+
+func TestOpenIDVerifier_VerifyPrivateAddress(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte(`{"sub": "@user:localhost"}`))
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	verifier := mautrix.NewOpenIDVerifier()
+
+	for _, serverName := range []string{srvURL.Host, "127.0.0.1", "[::1]:8448", "::1"} {
+		_, err := verifier.Verify(context.Background(), &mautrix.RespOpenIDToken{AccessToken: "valid", MatrixServerName: serverName})
+		assert.ErrorIs(t, err, mautrix.ErrOpenIDServerNotAllowed, serverName)
+	}
+	// Host names are checked after they're resolved
+	_, err := verifier.Verify(context.Background(), &mautrix.RespOpenIDToken{AccessToken: "valid", MatrixServerName: "localhost:" + srvURL.Port()})
+	assert.ErrorIs(t, err, mautrix.ErrOpenIDServerNotAllowed)
+	assert.Equal(t, 0, requests)
+}
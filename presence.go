@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// UserPresence is the last known presence of a user.
+type UserPresence struct {
+	event.PresenceEventContent
+	// The time when the presence was received.
+	UpdatedAt time.Time
+}
+
+// LastActive returns the time when the user was last active based on the last_active_ago field, or a zero time if
+// the server didn't send it.
+func (up *UserPresence) LastActive() time.Time {
+	if up.LastActiveAgo == 0 {
+		return time.Time{}
+	}
+	return up.UpdatedAt.Add(-time.Duration(up.LastActiveAgo) * time.Millisecond)
+}
+
+// PresenceChangeHandler is called when the presence of a user changes. The old presence is nil if the user's presence
+// wasn't known before.
+type PresenceChangeHandler func(userID id.UserID, old, new *UserPresence)
+
+// PresenceCache keeps track of the presence of users based on the m.presence events received in /sync.
+// Create one with NewPresenceCache and call Register with your DefaultSyncer to start receiving presence.
+type PresenceCache struct {
+	presence map[id.UserID]*UserPresence
+	handlers []PresenceChangeHandler
+	lock     sync.RWMutex
+}
+
+// NewPresenceCache creates an empty presence cache.
+func NewPresenceCache() *PresenceCache {
+	return &PresenceCache{
+		presence: make(map[id.UserID]*UserPresence),
+	}
+}
+
+// Register adds the presence event handler to the given syncer.
+func (pc *PresenceCache) Register(syncer *DefaultSyncer) {
+	syncer.OnEventType(event.EphemeralEventPresence, pc.handlePresence)
+}
+
+// OnChange adds a handler that is called whenever the presence, status message or active state of a user changes.
+func (pc *PresenceCache) OnChange(handler PresenceChangeHandler) {
+	pc.lock.Lock()
+	pc.handlers = append(pc.handlers, handler)
+	pc.lock.Unlock()
+}
+
+// Get returns the last known presence of the given user, or nil if no presence has been received for the user.
+func (pc *PresenceCache) Get(userID id.UserID) *UserPresence {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+	presence, ok := pc.presence[userID]
+	if !ok {
+		return nil
+	}
+	presenceCopy := *presence
+	return &presenceCopy
+}
+
+// Update stores the given presence for a user, e.g. from a GetPresence call, and calls the change handlers if the
+// presence changed.
+func (pc *PresenceCache) Update(userID id.UserID, content *event.PresenceEventContent) {
+	newPresence := &UserPresence{PresenceEventContent: *content, UpdatedAt: time.Now()}
+	pc.lock.Lock()
+	oldPresence := pc.presence[userID]
+	pc.presence[userID] = newPresence
+	handlers := pc.handlers
+	pc.lock.Unlock()
+	if oldPresence != nil && !presenceChanged(&oldPresence.PresenceEventContent, content) {
+		return
+	}
+	for _, handler := range handlers {
+		handler(userID, oldPresence, newPresence)
+	}
+}
+
+func presenceChanged(old, new *event.PresenceEventContent) bool {
+	return old.Presence != new.Presence || old.StatusMessage != new.StatusMessage || old.CurrentlyActive != new.CurrentlyActive
+}
+
+func (pc *PresenceCache) handlePresence(_ EventSource, evt *event.Event) {
+	// The content isn't parsed if ParseEventContent is disabled in the syncer
+	if evt.Content.Parsed == nil && evt.Content.ParseRaw(evt.Type) != nil {
+		return
+	}
+	pc.Update(evt.Sender, evt.Content.AsPresence())
+}
+
+// applySyncFilterOptions returns a copy of the given filter with the filtering options of the client applied.
+func (cli *Client) applySyncFilterOptions(filter *Filter) *Filter {
+	if !cli.DisableSyncPresence || filter == nil {
+		return filter
+	}
+	filterCopy := *filter
+	filterCopy.Presence.NotTypes = allTypes
+	return &filterCopy
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func newPresenceSyncResponse(t *testing.T, events string) *mautrix.RespSync {
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(`{"next_batch": "1", "presence": {"events": [`+events+`]}}`), &resp))
+	return &resp
+}
+
+type presenceChange struct {
+	UserID id.UserID
+	Old    *mautrix.UserPresence
+	New    *mautrix.UserPresence
+}
+
+func TestPresenceCache(t *testing.T) {
+	syncer := mautrix.NewDefaultSyncer()
+	cache := mautrix.NewPresenceCache()
+	cache.Register(syncer)
+	var changes []presenceChange
+	cache.OnChange(func(userID id.UserID, old, new *mautrix.UserPresence) {
+		changes = append(changes, presenceChange{userID, old, new})
+	})
+	assert.Nil(t, cache.Get("@alice:example.com"))
+
+	require.NoError(t, syncer.ProcessResponse(newPresenceSyncResponse(t, `
+		{"type": "m.presence", "sender": "@alice:example.com", "content": {"presence": "online", "currently_active": true, "status_msg": "Working"}},
+		{"type": "m.presence", "sender": "@bob:example.com", "content": {"presence": "unavailable", "last_active_ago": 60000}}
+	`), "s1"))
+	alice := cache.Get("@alice:example.com")
+	require.NotNil(t, alice)
+	assert.Equal(t, event.PresenceOnline, alice.Presence)
+	assert.Equal(t, "Working", alice.StatusMessage)
+	assert.True(t, alice.CurrentlyActive)
+	assert.WithinDuration(t, time.Now(), alice.UpdatedAt, time.Minute)
+	assert.True(t, alice.LastActive().IsZero())
+	bob := cache.Get("@bob:example.com")
+	require.NotNil(t, bob)
+	assert.Equal(t, bob.UpdatedAt.Add(-time.Minute), bob.LastActive())
+	require.Len(t, changes, 2)
+	assert.Equal(t, id.UserID("@alice:example.com"), changes[0].UserID)
+	assert.Nil(t, changes[0].Old)
+	assert.Equal(t, "Working", changes[0].New.StatusMessage)
+
+	// Changes to only last_active_ago update the cache without calling the change handlers
+	changes = nil
+	require.NoError(t, syncer.ProcessResponse(newPresenceSyncResponse(t, `
+		{"type": "m.presence", "sender": "@bob:example.com", "content": {"presence": "unavailable", "last_active_ago": 120000}}
+	`), "s2"))
+	assert.Empty(t, changes)
+	assert.EqualValues(t, 120000, cache.Get("@bob:example.com").LastActiveAgo)
+
+	require.NoError(t, syncer.ProcessResponse(newPresenceSyncResponse(t, `
+		{"type": "m.presence", "sender": "@alice:example.com", "content": {"presence": "online", "status_msg": "Lunch"}}
+	`), "s3"))
+	require.Len(t, changes, 1)
+	assert.Equal(t, "Working", changes[0].Old.StatusMessage)
+	assert.True(t, changes[0].Old.CurrentlyActive)
+	assert.Equal(t, "Lunch", changes[0].New.StatusMessage)
+	assert.False(t, changes[0].New.CurrentlyActive)
+}
+
+func TestPresenceCache_GetCopies(t *testing.T) {
+	cache := mautrix.NewPresenceCache()
+	cache.Update("@alice:example.com", &event.PresenceEventContent{Presence: event.PresenceOnline})
+	presence := cache.Get("@alice:example.com")
+	presence.Presence = event.PresenceOffline
+	assert.Equal(t, event.PresenceOnline, cache.Get("@alice:example.com").Presence)
+}
+
+func TestPresenceCache_UnparsedContent(t *testing.T) {
+	syncer := mautrix.NewDefaultSyncer()
+	syncer.ParseEventContent = false
+	cache := mautrix.NewPresenceCache()
+	cache.Register(syncer)
+
+	require.NoError(t, syncer.ProcessResponse(newPresenceSyncResponse(t, `
+		{"type": "m.presence", "sender": "@alice:example.com", "content": {"presence": "offline"}},
+		{"type": "m.presence", "sender": "@bob:example.com", "content": {"presence": 5}}
+	`), "s1"))
+	require.NotNil(t, cache.Get("@alice:example.com"))
+	assert.Equal(t, event.PresenceOffline, cache.Get("@alice:example.com").Presence)
+	// Invalid content is ignored
+	assert.Nil(t, cache.Get("@bob:example.com"))
+}
+
+func TestClient_SetPresenceWithStatus(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	require.NoError(t, cli.SetPresenceWithStatus(event.PresenceUnavailable, "Away"))
+	req := srv.LastRequest(t)
+	assert.Equal(t, http.MethodPut, req.Method)
+	assert.Equal(t, "/_matrix/client/r0/presence/@user:example.com/status", req.Path)
+	assert.JSONEq(t, `{"presence": "unavailable", "status_msg": "Away"}`, req.Body)
+
+	require.NoError(t, cli.SetPresence(event.PresenceOnline))
+	assert.JSONEq(t, `{"presence": "online"}`, srv.LastRequest(t).Body)
+}
+
+func TestClient_DisableSyncPresence(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("POST /_matrix/client/r0/user/@user:example.com/filter", `{"filter_id": "1"}`)
+	srv.Respond("GET /_matrix/client/r0/sync", `{"next_batch": "n"}`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+	cli.DisableSyncPresence = true
+	syncer := mautrix.NewDefaultSyncer()
+	syncer.OnSync(func(resp *mautrix.RespSync, since string) bool {
+		cli.StopSync()
+		return true
+	})
+	cli.Syncer = syncer
+
+	require.NoError(t, cli.Sync())
+	requests := srv.Requests()
+	require.NotEmpty(t, requests)
+	assert.Equal(t, "/_matrix/client/r0/user/@user:example.com/filter", requests[0].Path)
+	// Presence is excluded from the filter of the syncer without changing anything else
+	assert.JSONEq(t, `{
+		"account_data": {},
+		"presence": {"not_types": ["*"]},
+		"room": {"account_data": {}, "ephemeral": {}, "state": {}, "timeline": {"limit": 50}}
+	}`, requests[0].Body)
+	assert.Equal(t, &mautrix.Filter{Room: mautrix.RoomFilter{Timeline: mautrix.FilterPart{Limit: 50}}}, syncer.GetFilterJSON(cli.UserID))
+}
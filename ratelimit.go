@@ -0,0 +1,217 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EndpointClass is a group of endpoints that share a client-side rate limit.
+type EndpointClass string
+
+const (
+	EndpointClassSend  EndpointClass = "send"
+	EndpointClassSync  EndpointClass = "sync"
+	EndpointClassMedia EndpointClass = "media"
+	EndpointClassKeys  EndpointClass = "keys"
+	EndpointClassOther EndpointClass = "other"
+)
+
+// ClassifyEndpoint returns the rate limit class of the given request path.
+func ClassifyEndpoint(path string) EndpointClass {
+	switch {
+	case strings.HasPrefix(path, "/_matrix/media/"):
+		return EndpointClassMedia
+	case strings.HasSuffix(path, "/sync"):
+		return EndpointClassSync
+	case strings.Contains(path, "/keys/"), strings.Contains(path, "/room_keys/"):
+		return EndpointClassKeys
+	case strings.Contains(path, "/send/"), strings.Contains(path, "/state/"),
+		strings.Contains(path, "/redact/"), strings.Contains(path, "/sendToDevice/"):
+		return EndpointClassSend
+	default:
+		return EndpointClassOther
+	}
+}
+
+// RateLimit is the configuration of a token bucket. Requests are allowed at Rate requests per second on average,
+// with bursts of up to Burst requests. A zero rate means that requests are not limited.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitStats contains metrics about the requests that went through a rate limit.
+type RateLimitStats struct {
+	// The number of requests currently waiting for the rate limit.
+	Waiting int
+	// The total number of requests, and how many of them had to wait.
+	Requests uint64
+	Delayed  uint64
+	// The total and longest time requests have waited.
+	TotalWait time.Duration
+	MaxWait   time.Duration
+}
+
+// RateLimiterStats contains the metrics of the global rate limit and each endpoint class.
+type RateLimiterStats struct {
+	Global    RateLimitStats
+	Endpoints map[EndpointClass]RateLimitStats
+}
+
+type tokenBucket struct {
+	lock   sync.Mutex
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+	stats  RateLimitStats
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &tokenBucket{
+		limit:  limit,
+		tokens: float64(limit.Burst),
+		last:   now,
+	}
+}
+
+// reserve takes a token from the bucket and returns how long the caller must wait before using it.
+// The token count may go negative, which makes later callers wait until the earlier reservations have been used.
+func (tb *tokenBucket) reserve(now time.Time) time.Duration {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.limit.Rate
+	if tb.tokens > float64(tb.limit.Burst) {
+		tb.tokens = float64(tb.limit.Burst)
+	}
+	tb.last = now
+	tb.tokens--
+	tb.stats.Requests++
+	if tb.tokens >= 0 {
+		return 0
+	}
+	tb.stats.Delayed++
+	tb.stats.Waiting++
+	return time.Duration(-tb.tokens / tb.limit.Rate * float64(time.Second))
+}
+
+// finish records that a delayed reservation is done waiting. If it was cancelled, the token is given back.
+func (tb *tokenBucket) finish(waited time.Duration, cancelled bool) {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	tb.stats.Waiting--
+	tb.stats.TotalWait += waited
+	if waited > tb.stats.MaxWait {
+		tb.stats.MaxWait = waited
+	}
+	if cancelled {
+		tb.tokens++
+	}
+}
+
+func (tb *tokenBucket) getStats() RateLimitStats {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	return tb.stats
+}
+
+// RateLimiter proactively delays requests to stay under the rate limits of the homeserver, instead of sending requests
+// until the server responds with M_LIMIT_EXCEEDED. Each request must pass both the global limit and the limit of its
+// endpoint class.
+type RateLimiter struct {
+	global    *tokenBucket
+	endpoints map[EndpointClass]*tokenBucket
+
+	// The clock used by the rate limiter, which can be replaced in tests.
+	now   func() time.Time
+	sleep func(ctx context.Context, duration time.Duration) error
+}
+
+// NewRateLimiter creates a rate limiter with the given global limit and per-endpoint class limits.
+// Endpoint classes that aren't in the map are only limited by the global limit.
+func NewRateLimiter(global RateLimit, endpoints map[EndpointClass]RateLimit) *RateLimiter {
+	rl := &RateLimiter{
+		endpoints: make(map[EndpointClass]*tokenBucket, len(endpoints)),
+		now:       time.Now,
+		sleep:     sleepContext,
+	}
+	rl.init(global, endpoints)
+	return rl
+}
+
+func (rl *RateLimiter) init(global RateLimit, endpoints map[EndpointClass]RateLimit) {
+	now := rl.now()
+	if global.Rate > 0 {
+		rl.global = newTokenBucket(global, now)
+	}
+	for class, limit := range endpoints {
+		if limit.Rate > 0 {
+			rl.endpoints[class] = newTokenBucket(limit, now)
+		}
+	}
+}
+
+// sleepContext waits for the given duration or until the context is done.
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		timer.Stop()
+		return ctx.Err()
+	}
+}
+
+// Wait blocks until a request of the given endpoint class is allowed by the rate limits, or until the context is done.
+func (rl *RateLimiter) Wait(ctx context.Context, class EndpointClass) error {
+	buckets := make([]*tokenBucket, 0, 2)
+	if rl.global != nil {
+		buckets = append(buckets, rl.global)
+	}
+	if bucket, ok := rl.endpoints[class]; ok {
+		buckets = append(buckets, bucket)
+	}
+	now := rl.now()
+	var wait time.Duration
+	delayed := make([]*tokenBucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		if bucketWait := bucket.reserve(now); bucketWait > 0 {
+			delayed = append(delayed, bucket)
+			if bucketWait > wait {
+				wait = bucketWait
+			}
+		}
+	}
+	if wait <= 0 {
+		return nil
+	}
+	err := rl.sleep(ctx, wait)
+	waited := rl.now().Sub(now)
+	for _, bucket := range delayed {
+		bucket.finish(waited, err != nil)
+	}
+	return err
+}
+
+// Stats returns the current metrics of the rate limiter.
+func (rl *RateLimiter) Stats() RateLimiterStats {
+	stats := RateLimiterStats{Endpoints: make(map[EndpointClass]RateLimitStats, len(rl.endpoints))}
+	if rl.global != nil {
+		stats.Global = rl.global.getStats()
+	}
+	for class, bucket := range rl.endpoints {
+		stats.Endpoints[class] = bucket.getStats()
+	}
+	return stats
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock where sleeping advances the time immediately instead of blocking.
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) Advance(duration time.Duration) {
+	clock.lock.Lock()
+	clock.now = clock.now.Add(duration)
+	clock.lock.Unlock()
+}
+
+func (clock *fakeClock) Sleep(ctx context.Context, duration time.Duration) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	clock.lock.Lock()
+	clock.sleeps = append(clock.sleeps, duration)
+	clock.now = clock.now.Add(duration)
+	clock.lock.Unlock()
+	return nil
+}
+
+// Sleeps returns the durations slept since the previous call.
+func (clock *fakeClock) Sleeps() []time.Duration {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	sleeps := clock.sleeps
+	clock.sleeps = nil
+	return sleeps
+}
+
+func newTestRateLimiter(global RateLimit, endpoints map[EndpointClass]RateLimit) (*RateLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	rl := &RateLimiter{
+		endpoints: make(map[EndpointClass]*tokenBucket, len(endpoints)),
+		now:       clock.Now,
+		sleep:     clock.Sleep,
+	}
+	rl.init(global, endpoints)
+	return rl, clock
+}
+
+func TestRateLimiter_Burst(t *testing.T) {
+	rl, clock := newTestRateLimiter(RateLimit{Rate: 1, Burst: 3}, nil)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, rl.Wait(ctx, EndpointClassOther))
+	}
+	assert.Empty(t, clock.Sleeps())
+	// The bucket is empty, so each request has to wait for one token to be refilled
+	require.NoError(t, rl.Wait(ctx, EndpointClassOther))
+	require.NoError(t, rl.Wait(ctx, EndpointClassOther))
+	assert.Equal(t, []time.Duration{time.Second, time.Second}, clock.Sleeps())
+}
+
+func TestRateLimiter_Refill(t *testing.T) {
+	rl, clock := newTestRateLimiter(RateLimit{Rate: 2, Burst: 2}, nil)
+	ctx := context.Background()
+	require.NoError(t, rl.Wait(ctx, EndpointClassOther))
+	require.NoError(t, rl.Wait(ctx, EndpointClassOther))
+	clock.Advance(500 * time.Millisecond)
+	require.NoError(t, rl.Wait(ctx, EndpointClassOther))
+	assert.Empty(t, clock.Sleeps())
+	require.NoError(t, rl.Wait(ctx, EndpointClassOther))
+	assert.Equal(t, []time.Duration{500 * time.Millisecond}, clock.Sleeps())
+
+	// Refilling is capped at the burst size
+	clock.Advance(10 * time.Second)
+	require.NoError(t, rl.Wait(ctx, EndpointClassOther))
+	require.NoError(t, rl.Wait(ctx, EndpointClassOther))
+	assert.Empty(t, clock.Sleeps())
+	require.NoError(t, rl.Wait(ctx, EndpointClassOther))
+	assert.Equal(t, []time.Duration{500 * time.Millisecond}, clock.Sleeps())
+}
+
+func TestRateLimiter_EndpointClasses(t *testing.T) {
+	rl, clock := newTestRateLimiter(RateLimit{Rate: 10, Burst: 1}, map[EndpointClass]RateLimit{
+		EndpointClassSend:  {Rate: 1, Burst: 1},
+		EndpointClassMedia: {Rate: 0, Burst: 1},
+	})
+	ctx := context.Background()
+	require.NoError(t, rl.Wait(ctx, EndpointClassSend))
+	assert.Empty(t, clock.Sleeps())
+	// Both limits apply, so the request waits for the longer one
+	require.NoError(t, rl.Wait(ctx, EndpointClassSend))
+	assert.Equal(t, []time.Duration{time.Second}, clock.Sleeps())
+	// Other classes and classes with a zero rate are only limited by the global limit
+	require.NoError(t, rl.Wait(ctx, EndpointClassOther))
+	assert.Empty(t, clock.Sleeps())
+	require.NoError(t, rl.Wait(ctx, EndpointClassMedia))
+	assert.Equal(t, []time.Duration{100 * time.Millisecond}, clock.Sleeps())
+
+	stats := rl.Stats()
+	assert.Equal(t, uint64(4), stats.Global.Requests)
+	assert.Equal(t, uint64(2), stats.Global.Delayed)
+	assert.Equal(t, uint64(2), stats.Endpoints[EndpointClassSend].Requests)
+	assert.Equal(t, uint64(1), stats.Endpoints[EndpointClassSend].Delayed)
+	assert.Equal(t, time.Second, stats.Endpoints[EndpointClassSend].MaxWait)
+	assert.NotContains(t, stats.Endpoints, EndpointClassMedia)
+}
+
+func TestRateLimiter_Unlimited(t *testing.T) {
+	rl, clock := newTestRateLimiter(RateLimit{}, nil)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, rl.Wait(context.Background(), EndpointClassSend))
+	}
+	assert.Empty(t, clock.Sleeps())
+	assert.Equal(t, RateLimitStats{}, rl.Stats().Global)
+}
+
+func TestRateLimiter_ContextCancel(t *testing.T) {
+	rl, clock := newTestRateLimiter(RateLimit{Rate: 1, Burst: 1}, nil)
+	require.NoError(t, rl.Wait(context.Background(), EndpointClassOther))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, rl.Wait(ctx, EndpointClassOther), context.Canceled)
+	stats := rl.Stats().Global
+	assert.Equal(t, 0, stats.Waiting)
+	assert.Equal(t, uint64(1), stats.Delayed)
+	assert.Equal(t, time.Duration(0), stats.TotalWait)
+
+	// The cancelled request gave its token back, so it doesn't delay later requests
+	clock.Advance(time.Second)
+	require.NoError(t, rl.Wait(context.Background(), EndpointClassOther))
+	assert.Empty(t, clock.Sleeps())
+}
+
+func TestRateLimiter_WaitStats(t *testing.T) {
+	rl, _ := newTestRateLimiter(RateLimit{Rate: 4, Burst: 1}, nil)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, rl.Wait(ctx, EndpointClassOther))
+	}
+	stats := rl.Stats().Global
+	assert.Equal(t, RateLimitStats{
+		Requests:  3,
+		Delayed:   2,
+		TotalWait: 500 * time.Millisecond,
+		MaxWait:   250 * time.Millisecond,
+	}, stats)
+}
+
+func TestClassifyEndpoint(t *testing.T) {
+	for path, class := range map[string]EndpointClass{
+		"/_matrix/media/r0/upload":                                 EndpointClassMedia,
+		"/_matrix/client/r0/sync":                                  EndpointClassSync,
+		"/_matrix/client/r0/keys/upload":                           EndpointClassKeys,
+		"/_matrix/client/r0/room_keys/keys":                        EndpointClassKeys,
+		"/_matrix/client/r0/rooms/!a:example.com/send/m.room/1":    EndpointClassSend,
+		"/_matrix/client/r0/rooms/!a:example.com/state/m.room/":    EndpointClassSend,
+		"/_matrix/client/r0/rooms/!a:example.com/redact/$a/1":      EndpointClassSend,
+		"/_matrix/client/r0/sendToDevice/m.room.encrypted/1":       EndpointClassSend,
+		"/_matrix/client/r0/profile/@user:example.com/displayname": EndpointClassOther,
+	} {
+		assert.Equal(t, class, ClassifyEndpoint(path), path)
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultReceiptDebounce is the default delay for sending queued receipts in ReceiptManager.
+const DefaultReceiptDebounce = 2 * time.Second
+
+// receiptKey identifies one receipt of a user in a room. Private receipts are tracked separately so that they don't
+// replace the public receipt of the same thread.
+type receiptKey struct {
+	threadID string
+	private  bool
+}
+
+type threadReceipt struct {
+	eventID     id.EventID
+	receiptType event.ReceiptType
+}
+
+type pendingReceipts struct {
+	markers ReqSetReadMarkers
+	threads map[string]threadReceipt
+	timer   *time.Timer
+}
+
+// ReceiptManager keeps track of the read receipts of other users based on the m.receipt events received in /sync,
+// and sends the user's own receipts and read markers in batches.
+//
+// Create one with NewReceiptManager and call Register with your DefaultSyncer to start tracking receipts.
+type ReceiptManager struct {
+	Client *Client
+	// Debounce is how long to wait after the first receipt is queued for a room before sending. Receipts queued for
+	// the same room during the wait replace the previous ones, so only the latest receipt of each type is sent. The
+	// wait isn't extended by new receipts, so receipts are still sent regularly in busy rooms.
+	Debounce time.Duration
+
+	receipts  map[id.RoomID]map[id.UserID]map[receiptKey]id.EventID
+	readers   map[id.EventID]map[id.UserID]struct{}
+	pending   map[id.RoomID]*pendingReceipts
+	stateLock sync.RWMutex
+	sendLock  sync.Mutex
+}
+
+// NewReceiptManager creates a receipt manager with the default debounce delay.
+func NewReceiptManager(cli *Client) *ReceiptManager {
+	return &ReceiptManager{
+		Client:   cli,
+		Debounce: DefaultReceiptDebounce,
+		receipts: make(map[id.RoomID]map[id.UserID]map[receiptKey]id.EventID),
+		readers:  make(map[id.EventID]map[id.UserID]struct{}),
+		pending:  make(map[id.RoomID]*pendingReceipts),
+	}
+}
+
+// Register adds the receipt event handler to the given syncer.
+func (rm *ReceiptManager) Register(syncer *DefaultSyncer) {
+	syncer.OnEventType(event.EphemeralEventReceipt, rm.handleReceipts)
+}
+
+func (rm *ReceiptManager) handleReceipts(_ EventSource, evt *event.Event) {
+	// The content isn't parsed if ParseEventContent is disabled in the syncer
+	if evt.Content.Parsed == nil && evt.Content.ParseRaw(evt.Type) != nil {
+		return
+	}
+	content, ok := evt.Content.Parsed.(*event.ReceiptEventContent)
+	if !ok {
+		return
+	}
+	rm.stateLock.Lock()
+	defer rm.stateLock.Unlock()
+	for eventID, receipts := range *content {
+		for userID, receipt := range receipts.Read {
+			rm.setReceipt(evt.RoomID, userID, receiptKey{receipt.ThreadID, false}, eventID)
+		}
+		for userID, receipt := range receipts.ReadPrivate {
+			rm.setReceipt(evt.RoomID, userID, receiptKey{receipt.ThreadID, true}, eventID)
+		}
+	}
+}
+
+func (rm *ReceiptManager) setReceipt(roomID id.RoomID, userID id.UserID, key receiptKey, eventID id.EventID) {
+	roomReceipts, ok := rm.receipts[roomID]
+	if !ok {
+		roomReceipts = make(map[id.UserID]map[receiptKey]id.EventID)
+		rm.receipts[roomID] = roomReceipts
+	}
+	userReceipts, ok := roomReceipts[userID]
+	if !ok {
+		userReceipts = make(map[receiptKey]id.EventID)
+		roomReceipts[userID] = userReceipts
+	}
+	oldEventID, ok := userReceipts[key]
+	if ok && oldEventID == eventID {
+		return
+	}
+	userReceipts[key] = eventID
+	if ok && !hasReceiptAt(userReceipts, oldEventID) {
+		rm.removeReader(oldEventID, userID)
+	}
+	users, ok := rm.readers[eventID]
+	if !ok {
+		users = make(map[id.UserID]struct{})
+		rm.readers[eventID] = users
+	}
+	users[userID] = struct{}{}
+}
+
+func (rm *ReceiptManager) removeReader(eventID id.EventID, userID id.UserID) {
+	delete(rm.readers[eventID], userID)
+	if len(rm.readers[eventID]) == 0 {
+		delete(rm.readers, eventID)
+	}
+}
+
+// hasReceiptAt checks if the user still has a receipt in another thread pointing at the given event.
+func hasReceiptAt(userReceipts map[receiptKey]id.EventID, eventID id.EventID) bool {
+	for _, receiptEventID := range userReceipts {
+		if receiptEventID == eventID {
+			return true
+		}
+	}
+	return false
+}
+
+// ForgetRoom removes all tracked receipts in the given room, e.g. after leaving it.
+func (rm *ReceiptManager) ForgetRoom(roomID id.RoomID) {
+	rm.stateLock.Lock()
+	defer rm.stateLock.Unlock()
+	for userID, userReceipts := range rm.receipts[roomID] {
+		for _, eventID := range userReceipts {
+			rm.removeReader(eventID, userID)
+		}
+	}
+	delete(rm.receipts, roomID)
+}
+
+// UsersWhoRead returns the users whose latest read receipt (in any thread) is at the given event.
+//
+// Receipts only say which event a user read last, so users who have read past the event aren't included.
+func (rm *ReceiptManager) UsersWhoRead(eventID id.EventID) []id.UserID {
+	rm.stateLock.RLock()
+	defer rm.stateLock.RUnlock()
+	users := make([]id.UserID, 0, len(rm.readers[eventID]))
+	for userID := range rm.readers[eventID] {
+		users = append(users, userID)
+	}
+	return users
+}
+
+// LastRead returns the event ID of the latest public read receipt of the given user in the given thread. The thread
+// ID should be empty for unthreaded receipts or event.ReadReceiptThreadMain for the main timeline.
+func (rm *ReceiptManager) LastRead(roomID id.RoomID, userID id.UserID, threadID string) id.EventID {
+	rm.stateLock.RLock()
+	defer rm.stateLock.RUnlock()
+	return rm.receipts[roomID][userID][receiptKey{threadID, false}]
+}
+
+// LastReadPrivate is like LastRead, but returns the latest private read receipt. Servers only send private receipts
+// of the user's own account.
+func (rm *ReceiptManager) LastReadPrivate(roomID id.RoomID, userID id.UserID, threadID string) id.EventID {
+	rm.stateLock.RLock()
+	defer rm.stateLock.RUnlock()
+	return rm.receipts[roomID][userID][receiptKey{threadID, true}]
+}
+
+// MarkRead queues a public read receipt for the given event.
+func (rm *ReceiptManager) MarkRead(roomID id.RoomID, eventID id.EventID) {
+	rm.queue(roomID, func(pending *pendingReceipts) {
+		pending.markers.Read = eventID
+	})
+}
+
+// MarkReadPrivate queues a private read receipt for the given event.
+func (rm *ReceiptManager) MarkReadPrivate(roomID id.RoomID, eventID id.EventID) {
+	rm.queue(roomID, func(pending *pendingReceipts) {
+		pending.markers.ReadPrivate = eventID
+	})
+}
+
+// MarkFullyRead queues moving the fully read marker of the room to the given event.
+func (rm *ReceiptManager) MarkFullyRead(roomID id.RoomID, eventID id.EventID) {
+	rm.queue(roomID, func(pending *pendingReceipts) {
+		pending.markers.FullyRead = eventID
+	})
+}
+
+// MarkReadInThread queues a threaded receipt of the given type. Use event.ReadReceiptThreadMain as the thread ID
+// for the main timeline.
+func (rm *ReceiptManager) MarkReadInThread(roomID id.RoomID, eventID id.EventID, receiptType event.ReceiptType, threadID string) {
+	rm.queue(roomID, func(pending *pendingReceipts) {
+		if pending.threads == nil {
+			pending.threads = make(map[string]threadReceipt)
+		}
+		pending.threads[threadID] = threadReceipt{eventID, receiptType}
+	})
+}
+
+func (rm *ReceiptManager) queue(roomID id.RoomID, update func(pending *pendingReceipts)) {
+	rm.stateLock.Lock()
+	defer rm.stateLock.Unlock()
+	pending, ok := rm.pending[roomID]
+	if !ok {
+		pending = &pendingReceipts{}
+		rm.pending[roomID] = pending
+	}
+	update(pending)
+	if pending.timer == nil {
+		pending.timer = time.AfterFunc(rm.Debounce, func() {
+			rm.flushRoom(roomID)
+		})
+	}
+}
+
+// Flush sends all queued receipts immediately, e.g. before shutting down.
+func (rm *ReceiptManager) Flush() {
+	rm.stateLock.Lock()
+	roomIDs := make([]id.RoomID, 0, len(rm.pending))
+	for roomID := range rm.pending {
+		roomIDs = append(roomIDs, roomID)
+	}
+	rm.stateLock.Unlock()
+	for _, roomID := range roomIDs {
+		rm.flushRoom(roomID)
+	}
+}
+
+func (rm *ReceiptManager) flushRoom(roomID id.RoomID) {
+	// Only one flush sends at a time, so receipts for the same room are sent in order
+	rm.sendLock.Lock()
+	defer rm.sendLock.Unlock()
+	rm.stateLock.Lock()
+	pending, ok := rm.pending[roomID]
+	if ok {
+		delete(rm.pending, roomID)
+		pending.timer.Stop()
+	}
+	rm.stateLock.Unlock()
+	if !ok {
+		return
+	}
+	if pending.markers != (ReqSetReadMarkers{}) {
+		err := rm.Client.SetReadMarkers(roomID, &pending.markers)
+		if err != nil {
+			rm.Client.logWarning("Failed to send read markers to %s: %v", roomID, err)
+		}
+	}
+	for threadID, receipt := range pending.threads {
+		err := rm.Client.SendReceipt(roomID, receipt.eventID, receipt.receiptType, threadID)
+		if err != nil {
+			rm.Client.logWarning("Failed to send %s receipt for thread %s to %s: %v", receipt.receiptType, threadID, roomID, err)
+		}
+	}
+}
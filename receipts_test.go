@@ -0,0 +1,136 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const receiptTestRoom = id.RoomID("!room:example.com")
+
+func newReceiptTestManager(t *testing.T, srv *recordingServer) (*mautrix.ReceiptManager, *mautrix.DefaultSyncer) {
+	rm := mautrix.NewReceiptManager(mautrix.NewTestClient(t, srv.URL))
+	syncer := mautrix.NewDefaultSyncer()
+	rm.Register(syncer)
+	return rm, syncer
+}
+
+func processReceipts(t *testing.T, syncer *mautrix.DefaultSyncer, content string) {
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(`{"next_batch": "2", "rooms": {"join": {"`+string(receiptTestRoom)+`": {
+		"ephemeral": {"events": [{"type": "m.receipt", "content": `+content+`}]}
+	}}}}`), &resp))
+	require.NoError(t, syncer.ProcessResponse(&resp, "1"))
+}
+
+func TestReceiptManager_UsersWhoRead_Threaded(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	rm, syncer := newReceiptTestManager(t, srv)
+
+	processReceipts(t, syncer, `{"$a": {"m.read": {
+		"@alice:example.com": {"ts": 1, "thread_id": "main"},
+		"@bob:example.com": {"ts": 1}
+	}}, "$t": {"m.read": {"@alice:example.com": {"ts": 1, "thread_id": "$thread"}}}}`)
+	assert.ElementsMatch(t, []id.UserID{"@alice:example.com", "@bob:example.com"}, rm.UsersWhoRead("$a"))
+	assert.Equal(t, []id.UserID{"@alice:example.com"}, rm.UsersWhoRead("$t"))
+	assert.Equal(t, id.EventID("$a"), rm.LastRead(receiptTestRoom, "@alice:example.com", "main"))
+	assert.Equal(t, id.EventID("$t"), rm.LastRead(receiptTestRoom, "@alice:example.com", "$thread"))
+	assert.Equal(t, id.EventID("$a"), rm.LastRead(receiptTestRoom, "@bob:example.com", ""))
+
+	// Moving the thread receipt onto $a keeps alice there and removes her from $t
+	processReceipts(t, syncer, `{"$a": {"m.read": {"@alice:example.com": {"ts": 2, "thread_id": "$thread"}}}}`)
+	assert.ElementsMatch(t, []id.UserID{"@alice:example.com", "@bob:example.com"}, rm.UsersWhoRead("$a"))
+	assert.Empty(t, rm.UsersWhoRead("$t"))
+
+	// Moving only the main receipt away still leaves the thread receipt at $a
+	processReceipts(t, syncer, `{"$b": {"m.read": {"@alice:example.com": {"ts": 3, "thread_id": "main"}}}}`)
+	assert.ElementsMatch(t, []id.UserID{"@alice:example.com", "@bob:example.com"}, rm.UsersWhoRead("$a"))
+	assert.Equal(t, []id.UserID{"@alice:example.com"}, rm.UsersWhoRead("$b"))
+
+	processReceipts(t, syncer, `{"$b": {"m.read": {"@alice:example.com": {"ts": 4, "thread_id": "$thread"}}}}`)
+	assert.Equal(t, []id.UserID{"@bob:example.com"}, rm.UsersWhoRead("$a"))
+	assert.Equal(t, []id.UserID{"@alice:example.com"}, rm.UsersWhoRead("$b"))
+
+	rm.ForgetRoom(receiptTestRoom)
+	assert.Empty(t, rm.UsersWhoRead("$a"))
+	assert.Empty(t, rm.UsersWhoRead("$b"))
+	assert.Empty(t, rm.LastRead(receiptTestRoom, "@bob:example.com", ""))
+}
+
+func TestReceiptManager_PrivateReceipt(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	rm, syncer := newReceiptTestManager(t, srv)
+
+	processReceipts(t, syncer, `{
+		"$a": {"m.read": {"@me:example.com": {"ts": 1}}},
+		"$b": {"m.read.private": {"@me:example.com": {"ts": 2}}}
+	}`)
+	assert.Equal(t, id.EventID("$a"), rm.LastRead(receiptTestRoom, "@me:example.com", ""))
+	assert.Equal(t, id.EventID("$b"), rm.LastReadPrivate(receiptTestRoom, "@me:example.com", ""))
+	assert.Equal(t, []id.UserID{"@me:example.com"}, rm.UsersWhoRead("$a"))
+	assert.Equal(t, []id.UserID{"@me:example.com"}, rm.UsersWhoRead("$b"))
+}
+
+func TestReceiptManager_Debounce(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	rm, _ := newReceiptTestManager(t, srv)
+	rm.Debounce = 50 * time.Millisecond
+
+	rm.MarkRead(receiptTestRoom, "$a")
+	rm.MarkRead(receiptTestRoom, "$b")
+	rm.MarkFullyRead(receiptTestRoom, "$b")
+	rm.MarkReadInThread(receiptTestRoom, "$t1", "m.read", "$thread")
+	rm.MarkReadInThread(receiptTestRoom, "$t2", "m.read", "$thread")
+	assert.Empty(t, srv.Requests())
+
+	var reqs []recordedRequest
+	require.Eventually(t, func() bool {
+		reqs = append(reqs, srv.Requests()...)
+		return len(reqs) >= 2
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(2 * rm.Debounce)
+	reqs = append(reqs, srv.Requests()...)
+	require.Len(t, reqs, 2)
+
+	assert.Equal(t, "POST /_matrix/client/r0/rooms/"+string(receiptTestRoom)+"/read_markers", reqs[0].Method+" "+reqs[0].Path)
+	assert.JSONEq(t, `{"m.read": "$b", "m.fully_read": "$b"}`, reqs[0].Body)
+	assert.Equal(t, "POST /_matrix/client/r0/rooms/"+string(receiptTestRoom)+"/receipt/m.read/$t2", reqs[1].Method+" "+reqs[1].Path)
+	assert.JSONEq(t, `{"thread_id": "$thread"}`, reqs[1].Body)
+}
+
+func TestReceiptManager_Flush(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	rm, _ := newReceiptTestManager(t, srv)
+	rm.Debounce = time.Hour
+
+	rm.MarkReadPrivate(receiptTestRoom, "$a")
+	rm.MarkReadPrivate("!other:example.com", "$b")
+	rm.Flush()
+	reqs := srv.Requests()
+	require.Len(t, reqs, 2)
+	var bodies []string
+	for _, req := range reqs {
+		bodies = append(bodies, req.Body)
+	}
+	assert.ElementsMatch(t, []string{`{"m.read.private":"$a"}`, `{"m.read.private":"$b"}`}, bodies)
+
+	// Flushing again doesn't resend anything
+	rm.Flush()
+	assert.Empty(t, srv.Requests())
+}
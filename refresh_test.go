@@ -0,0 +1,237 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+)
+
+const softLogoutResponse = `{"errcode": "M_UNKNOWN_TOKEN", "error": "Access token has expired", "soft_logout": true}`
+
+// refreshTestServer is a homeserver that accepts one access token at a time and rotates it on /refresh.
+type refreshTestServer struct {
+	*httptest.Server
+	lock         sync.Mutex
+	accessToken  string
+	refreshToken string
+	refreshes    int32
+	// The bodies of the requests to /test that were accepted.
+	accepted []string
+	// If set, /test requests with an expired token wait on this before responding.
+	expiredBarrier *sync.WaitGroup
+	softLogout     bool
+}
+
+func newRefreshTestServer() *refreshTestServer {
+	srv := &refreshTestServer{accessToken: "token1", refreshToken: "refresh1", softLogout: true}
+	srv.Server = httptest.NewServer(http.HandlerFunc(srv.handle))
+	return srv
+}
+
+func (srv *refreshTestServer) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	switch r.URL.Path {
+	case "/_matrix/client/v3/refresh":
+		var req mautrix.ReqRefresh
+		_ = json.Unmarshal(body, &req)
+		srv.lock.Lock()
+		defer srv.lock.Unlock()
+		if len(r.Header.Get("Authorization")) > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN", "error": "Refresh must not be authenticated"}`))
+			return
+		} else if req.RefreshToken != srv.refreshToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "Unknown refresh token", "soft_logout": false}`))
+			return
+		}
+		n := atomic.AddInt32(&srv.refreshes, 1)
+		srv.accessToken = "token" + string(rune('1'+n))
+		srv.refreshToken = "refresh" + string(rune('1'+n))
+		_ = json.NewEncoder(w).Encode(&mautrix.RespRefresh{AccessToken: srv.accessToken, RefreshToken: srv.refreshToken})
+	case "/test":
+		srv.lock.Lock()
+		valid := r.Header.Get("Authorization") == "Bearer "+srv.accessToken
+		if valid {
+			srv.accepted = append(srv.accepted, string(body))
+		}
+		barrier := srv.expiredBarrier
+		srv.lock.Unlock()
+		if valid {
+			_, _ = w.Write([]byte(`{"ok": true}`))
+			return
+		}
+		if barrier != nil {
+			barrier.Done()
+			barrier.Wait()
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		if srv.softLogout {
+			_, _ = w.Write([]byte(softLogoutResponse))
+		} else {
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "Logged out", "soft_logout": false}`))
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// expireToken rotates the server's access token without telling the client.
+func (srv *refreshTestServer) expireToken() {
+	srv.lock.Lock()
+	srv.accessToken = "expired"
+	srv.lock.Unlock()
+}
+
+func newRefreshTestClient(t *testing.T, srv *refreshTestServer) *mautrix.Client {
+	cli := mautrix.NewTestClient(t, srv.URL)
+	cli.AccessToken = "token1"
+	cli.RefreshToken = "refresh1"
+	return cli
+}
+
+func TestClient_RefreshAfterSoftLogout(t *testing.T) {
+	srv := newRefreshTestServer()
+	defer srv.Close()
+	cli := newRefreshTestClient(t, srv)
+	var refreshed []*mautrix.RespRefresh
+	cli.OnTokenRefresh = func(resp *mautrix.RespRefresh) {
+		refreshed = append(refreshed, resp)
+	}
+
+	var resp struct {
+		OK bool `json:"ok"`
+	}
+	_, err := cli.MakeRequest(http.MethodPost, srv.URL+"/test", map[string]string{"hello": "world"}, &resp)
+	require.NoError(t, err)
+	assert.True(t, resp.OK)
+	assert.EqualValues(t, 0, atomic.LoadInt32(&srv.refreshes))
+
+	srv.expireToken()
+	resp.OK = false
+	_, err = cli.MakeRequest(http.MethodPost, srv.URL+"/test", map[string]string{"hello": "again"}, &resp)
+	require.NoError(t, err)
+	assert.True(t, resp.OK)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&srv.refreshes))
+	assert.Equal(t, "token2", cli.AccessToken)
+	assert.Equal(t, "refresh2", cli.RefreshToken)
+	require.Len(t, refreshed, 1)
+	assert.Equal(t, "token2", refreshed[0].AccessToken)
+	// The retried request has the same body as the original one
+	assert.Equal(t, []string{`{"hello":"world"}`, `{"hello":"again"}`}, srv.accepted)
+}
+
+func TestClient_RefreshSingleFlight(t *testing.T) {
+	const requests = 5
+	srv := newRefreshTestServer()
+	defer srv.Close()
+	cli := newRefreshTestClient(t, srv)
+	srv.expireToken()
+	// Make sure all the requests fail with the old token before any of them refreshes it
+	var barrier sync.WaitGroup
+	barrier.Add(requests)
+	srv.expiredBarrier = &barrier
+
+	var wg sync.WaitGroup
+	errs := make([]error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = cli.MakeRequest(http.MethodGet, srv.URL+"/test", nil, nil)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&srv.refreshes))
+	assert.Len(t, srv.accepted, requests)
+	assert.Equal(t, "token2", cli.AccessToken)
+}
+
+func TestClient_RefreshHardLogout(t *testing.T) {
+	srv := newRefreshTestServer()
+	defer srv.Close()
+	cli := newRefreshTestClient(t, srv)
+	srv.expireToken()
+	srv.softLogout = false
+	_, err := cli.MakeRequest(http.MethodGet, srv.URL+"/test", nil, nil)
+	assert.ErrorIs(t, err, mautrix.MUnknownToken)
+	assert.EqualValues(t, 0, atomic.LoadInt32(&srv.refreshes))
+	assert.Equal(t, "token1", cli.AccessToken)
+}
+
+func TestClient_RefreshFailed(t *testing.T) {
+	srv := newRefreshTestServer()
+	defer srv.Close()
+	cli := newRefreshTestClient(t, srv)
+	cli.RefreshToken = "invalid"
+	srv.expireToken()
+	_, err := cli.MakeRequest(http.MethodGet, srv.URL+"/test", nil, nil)
+	// The original soft logout error is returned rather than the refresh error
+	var httpErr mautrix.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	require.NotNil(t, httpErr.RespError)
+	assert.True(t, httpErr.RespError.IsSoftLogout())
+	assert.Equal(t, "token1", cli.AccessToken)
+}
+
+func TestClient_RefreshWithoutRefreshToken(t *testing.T) {
+	srv := newRefreshTestServer()
+	defer srv.Close()
+	cli := newRefreshTestClient(t, srv)
+	cli.RefreshToken = ""
+	srv.expireToken()
+	_, err := cli.MakeRequest(http.MethodGet, srv.URL+"/test", nil, nil)
+	assert.ErrorIs(t, err, mautrix.MUnknownToken)
+	_, err = cli.RefreshAccessToken()
+	assert.ErrorIs(t, err, mautrix.ErrNoRefreshToken)
+	assert.EqualValues(t, 0, atomic.LoadInt32(&srv.refreshes))
+}
+
+func TestClient_Refresher(t *testing.T) {
+	srv := newRefreshTestServer()
+	defer srv.Close()
+	cli := newRefreshTestClient(t, srv)
+	srv.expireToken()
+	var calls int
+	cli.Refresher = func(refreshToken string) (*mautrix.RespRefresh, error) {
+		calls++
+		assert.Equal(t, "refresh1", refreshToken)
+		srv.lock.Lock()
+		defer srv.lock.Unlock()
+		srv.accessToken = "external"
+		return &mautrix.RespRefresh{AccessToken: "external"}, nil
+	}
+	_, err := cli.MakeRequest(http.MethodGet, srv.URL+"/test", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	assert.EqualValues(t, 0, atomic.LoadInt32(&srv.refreshes))
+	assert.Equal(t, "external", cli.AccessToken)
+	// The refresh token is kept if the response doesn't include a new one
+	assert.Equal(t, "refresh1", cli.RefreshToken)
+
+	cli.Refresher = func(refreshToken string) (*mautrix.RespRefresh, error) {
+		return nil, errors.New("refresh failed")
+	}
+	srv.expireToken()
+	_, err = cli.MakeRequest(http.MethodGet, srv.URL+"/test", nil, nil)
+	assert.ErrorIs(t, err, mautrix.MUnknownToken)
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// RequestLogEntry contains the details of a single HTTP request attempt made by the client.
+type RequestLogEntry struct {
+	// Context is the context of the request, which can be used to find trace IDs or other request-scoped values.
+	Context context.Context
+	// RequestID is the same number as in the debug logs of the client.
+	RequestID int
+	Method    string
+	// Path is the path and query of the request URL with access tokens redacted.
+	Path  string
+	Class EndpointClass
+	// Retry is the number of the attempt, starting from zero.
+	Retry    int
+	Duration time.Duration
+	// StatusCode is zero if the request failed without a response.
+	StatusCode int
+	// ErrCode is the Matrix error code of an error response, if any.
+	ErrCode string
+	// Error is the transport error if the request failed without a response.
+	Error error
+}
+
+// Fields returns the entry as a flat map, which is convenient for structured logging libraries, e.g.
+//
+//	cli.RequestLogger = mautrix.RequestLoggerFunc(func(entry *mautrix.RequestLogEntry) {
+//		log.Debug().Fields(entry.Fields()).Msg("Matrix request")
+//	})
+func (entry *RequestLogEntry) Fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"req_id":      entry.RequestID,
+		"method":      entry.Method,
+		"path":        entry.Path,
+		"class":       string(entry.Class),
+		"retry":       entry.Retry,
+		"duration_ms": entry.Duration.Milliseconds(),
+	}
+	if entry.StatusCode != 0 {
+		fields["status_code"] = entry.StatusCode
+	}
+	if len(entry.ErrCode) > 0 {
+		fields["errcode"] = entry.ErrCode
+	}
+	if entry.Error != nil {
+		fields["error"] = entry.Error.Error()
+	}
+	return fields
+}
+
+// RequestLogger receives an entry for every HTTP request attempt made by the client. It's called synchronously
+// after the response headers have been received, so implementations should not block.
+type RequestLogger interface {
+	LogRequest(entry *RequestLogEntry)
+}
+
+// RequestLoggerFunc is a function that implements RequestLogger.
+type RequestLoggerFunc func(entry *RequestLogEntry)
+
+func (fn RequestLoggerFunc) LogRequest(entry *RequestLogEntry) {
+	fn(entry)
+}
+
+// redactedPath returns the path and query of the URL with the access_token query parameter redacted.
+func redactedPath(reqURL *url.URL) string {
+	if len(reqURL.RawQuery) == 0 {
+		return reqURL.EscapedPath()
+	}
+	query := reqURL.Query()
+	if _, ok := query["access_token"]; ok {
+		query.Set("access_token", "REDACTED")
+	}
+	return reqURL.EscapedPath() + "?" + query.Encode()
+}
+
+// readErrCode reads the Matrix error code from an error response and restores the body so it can be read again.
+func readErrCode(res *http.Response) string {
+	contents, err := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(contents))
+	if err != nil {
+		return ""
+	}
+	var respErr RespError
+	_ = json.Unmarshal(contents, &respErr)
+	return respErr.ErrCode
+}
+
+// logRequestAttempt sends the details of a finished request attempt to the RequestLogger, if one is set.
+func (cli *Client) logRequestAttempt(req *http.Request, res *http.Response, err error, retry int, duration time.Duration) {
+	if cli.RequestLogger == nil {
+		return
+	}
+	reqID, _ := req.Context().Value(logRequestIDContextKey).(int)
+	entry := &RequestLogEntry{
+		Context:   req.Context(),
+		RequestID: reqID,
+		Method:    req.Method,
+		Path:      redactedPath(req.URL),
+		Class:     ClassifyEndpoint(req.URL.Path),
+		Retry:     retry,
+		Duration:  duration,
+		Error:     err,
+	}
+	if res != nil {
+		entry.StatusCode = res.StatusCode
+		if res.StatusCode >= 400 {
+			entry.ErrCode = readErrCode(res)
+		}
+	}
+	cli.RequestLogger.LogRequest(entry)
+}
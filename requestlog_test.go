@@ -0,0 +1,107 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+)
+
+func TestClient_RequestLogger(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("GET /_matrix/client/r0/sync", `{"next_batch": "1"}`)
+	srv.RespondStatus("GET /_matrix/client/r0/profile/@user:example.com/displayname", http.StatusBadGateway, `{"errcode": "M_UNKNOWN", "error": "Try again"}`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+	cli.RetryPolicy = &mautrix.RetryPolicy{
+		MaxAttempts:    2,
+		InitialBackoff: time.Millisecond,
+		Multiplier:     2,
+		StatusCodes:    mautrix.DefaultRetryPolicy.StatusCodes,
+	}
+	var lock sync.Mutex
+	var entries []*mautrix.RequestLogEntry
+	cli.RequestLogger = mautrix.RequestLoggerFunc(func(entry *mautrix.RequestLogEntry) {
+		lock.Lock()
+		entries = append(entries, entry)
+		lock.Unlock()
+	})
+
+	_, err := cli.SyncRequest(0, "", "", false, "", nil)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, http.MethodGet, entries[0].Method)
+	assert.Equal(t, "/_matrix/client/r0/sync?timeout=0", entries[0].Path)
+	assert.Equal(t, mautrix.EndpointClassSync, entries[0].Class)
+	assert.Equal(t, http.StatusOK, entries[0].StatusCode)
+	assert.Empty(t, entries[0].ErrCode)
+	assert.NotNil(t, entries[0].Context)
+
+	// Every attempt is logged, and the error body can still be read after the error code was parsed
+	entries = nil
+	_, err = cli.GetDisplayName("@user:example.com")
+	var httpErr mautrix.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, "M_UNKNOWN", httpErr.RespError.ErrCode)
+	require.Len(t, entries, 2)
+	for i, entry := range entries {
+		assert.Equal(t, i, entry.Retry)
+		assert.Equal(t, http.StatusBadGateway, entry.StatusCode)
+		assert.Equal(t, "M_UNKNOWN", entry.ErrCode)
+		assert.Equal(t, entries[0].RequestID, entry.RequestID)
+	}
+
+	// Access tokens in the query are redacted
+	entries = nil
+	_, err = cli.MakeRequest(http.MethodGet, srv.URL+"/test?access_token=secret&foo=bar", nil, nil)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "/test?access_token=REDACTED&foo=bar", entries[0].Path)
+
+	srv.Close()
+	entries = nil
+	_, err = cli.Whoami()
+	require.Error(t, err)
+	require.NotEmpty(t, entries)
+	assert.Zero(t, entries[0].StatusCode)
+	assert.Error(t, entries[0].Error)
+}
+
+func TestRequestLogEntry_Fields(t *testing.T) {
+	entry := &mautrix.RequestLogEntry{
+		RequestID: 5,
+		Method:    http.MethodPut,
+		Path:      "/_matrix/client/r0/rooms/!room:example.com/send/m.room.message/1",
+		Class:     mautrix.EndpointClassSend,
+		Retry:     1,
+		Duration:  1500 * time.Millisecond,
+	}
+	assert.Equal(t, map[string]interface{}{
+		"req_id":      5,
+		"method":      http.MethodPut,
+		"path":        "/_matrix/client/r0/rooms/!room:example.com/send/m.room.message/1",
+		"class":       string(mautrix.EndpointClassSend),
+		"retry":       1,
+		"duration_ms": int64(1500),
+	}, entry.Fields())
+
+	entry.StatusCode = http.StatusForbidden
+	entry.ErrCode = "M_FORBIDDEN"
+	entry.Error = errors.New("failed")
+	fields := entry.Fields()
+	assert.Equal(t, http.StatusForbidden, fields["status_code"])
+	assert.Equal(t, "M_FORBIDDEN", fields["errcode"])
+	assert.Equal(t, "failed", fields["error"])
+}
@@ -20,6 +20,8 @@ const (
 	AuthTypeToken     AuthType = "m.login.token"
 	AuthTypeDummy     AuthType = "m.login.dummy"
 
+	AuthTypeRegistrationToken AuthType = "m.login.registration_token"
+
 	AuthTypeAppservice      AuthType = "m.login.application_service"
 	AuthTypeHalfyAppservice AuthType = "uk.half-shot.msc2778.login.application_service"
 )
@@ -39,6 +41,7 @@ type ReqRegister struct {
 	DeviceID                 id.DeviceID `json:"device_id,omitempty"`
 	InitialDeviceDisplayName string      `json:"initial_device_display_name,omitempty"`
 	InhibitLogin             bool        `json:"inhibit_login,omitempty"`
+	RefreshToken             bool        `json:"refresh_token,omitempty"`
 	Auth                     interface{} `json:"auth,omitempty"`
 
 	// Type for registration, only used for appservice user registrations
@@ -71,6 +74,8 @@ type ReqLogin struct {
 	Token                    string         `json:"token,omitempty"`
 	DeviceID                 id.DeviceID    `json:"device_id,omitempty"`
 	InitialDeviceDisplayName string         `json:"initial_device_display_name,omitempty"`
+	// RefreshToken asks the server to return a refresh token along with an expiring access token.
+	RefreshToken bool `json:"refresh_token,omitempty"`
 
 	// Whether or not the returned credentials should be stored in the Client
 	StoreCredentials bool `json:"-"`
@@ -78,6 +83,11 @@ type ReqLogin struct {
 	StoreHomeserverURL bool `json:"-"`
 }
 
+// ReqRefresh is the JSON request for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3refresh
+type ReqRefresh struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
 type ReqUIAuthFallback struct {
 	Session string `json:"session"`
 	User    string `json:"user"`
@@ -110,6 +120,8 @@ type ReqRedact struct {
 	Reason string
 	TxnID  string
 	Extra  map[string]interface{}
+	// IdempotencyKey works like ReqSendEvent.IdempotencyKey.
+	IdempotencyKey string
 }
 
 type ReqMembers struct {
@@ -161,7 +173,8 @@ type ReqTyping struct {
 }
 
 type ReqPresence struct {
-	Presence event.Presence `json:"presence"`
+	Presence  event.Presence `json:"presence"`
+	StatusMsg string         `json:"status_msg,omitempty"`
 }
 
 type ReqAliasCreate struct {
@@ -171,6 +184,7 @@ type ReqAliasCreate struct {
 type OneTimeKey struct {
 	Key        id.Curve25519          `json:"key"`
 	IsSigned   bool                   `json:"-"`
+	IsFallback bool                   `json:"fallback,omitempty"`
 	Signatures Signatures             `json:"signatures,omitempty"`
 	Unsigned   map[string]interface{} `json:"unsigned,omitempty"`
 }
@@ -201,6 +215,8 @@ func (otk *OneTimeKey) MarshalJSON() ([]byte, error) {
 type ReqUploadKeys struct {
 	DeviceKeys  *DeviceKeys             `json:"device_keys,omitempty"`
 	OneTimeKeys map[id.KeyID]OneTimeKey `json:"one_time_keys"`
+
+	FallbackKeys map[id.KeyID]OneTimeKey `json:"fallback_keys,omitempty"`
 }
 
 type ReqKeysSignatures struct {
@@ -287,6 +303,57 @@ type ReqSendToDevice struct {
 	Messages map[id.UserID]map[id.DeviceID]*event.Content `json:"messages"`
 }
 
+// DehydratedDeviceData is the opaque device data stored on the server for a dehydrated device.
+type DehydratedDeviceData struct {
+	Algorithm    string `json:"algorithm"`
+	DevicePickle string `json:"device_pickle"`
+}
+
+// ReqRoomKeysVersionCreate is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3room_keysversion
+// and https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3room_keysversionversion
+type ReqRoomKeysVersionCreate struct {
+	Algorithm id.KeyBackupAlgorithm `json:"algorithm"`
+	AuthData  json.RawMessage       `json:"auth_data"`
+}
+
+// KeyBackupData is the data of a single megolm session stored in server-side key backup.
+type KeyBackupData struct {
+	FirstMessageIndex int             `json:"first_message_index"`
+	ForwardedCount    int             `json:"forwarded_count"`
+	IsVerified        bool            `json:"is_verified"`
+	SessionData       json.RawMessage `json:"session_data"`
+}
+
+// ReqRoomKeysRoom contains the backed up sessions of a single room.
+type ReqRoomKeysRoom struct {
+	Sessions map[id.SessionID]KeyBackupData `json:"sessions"`
+}
+
+// ReqRoomKeysUpdate is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3room_keyskeys
+type ReqRoomKeysUpdate struct {
+	Rooms map[id.RoomID]ReqRoomKeysRoom `json:"rooms"`
+}
+
+// ReqPutDehydratedDevice is the JSON request for PUT /_matrix/client/unstable/org.matrix.msc3814.v1/dehydrated_device
+type ReqPutDehydratedDevice struct {
+	DeviceID           id.DeviceID             `json:"device_id"`
+	DeviceData         DehydratedDeviceData    `json:"device_data"`
+	InitialDisplayName string                  `json:"initial_device_display_name,omitempty"`
+	DeviceKeys         *DeviceKeys             `json:"device_keys"`
+	OneTimeKeys        map[id.KeyID]OneTimeKey `json:"one_time_keys,omitempty"`
+	FallbackKeys       map[id.KeyID]OneTimeKey `json:"fallback_keys,omitempty"`
+}
+
+// ReqClaimDehydratedDevice is the JSON request for POST /_matrix/client/unstable/org.matrix.msc2697.v2/dehydrated_device/claim
+type ReqClaimDehydratedDevice struct {
+	DeviceID id.DeviceID `json:"device_id"`
+}
+
+// ReqDehydratedDeviceEvents is the JSON request for POST /_matrix/client/unstable/org.matrix.msc3814.v1/dehydrated_device/{deviceID}/events
+type ReqDehydratedDeviceEvents struct {
+	NextBatch string `json:"next_batch,omitempty"`
+}
+
 // ReqDeviceInfo is the JSON request for https://matrix.org/docs/spec/client_server/r0.6.1#put-matrix-client-r0-devices-deviceid
 type ReqDeviceInfo struct {
 	DisplayName string `json:"display_name,omitempty"`
@@ -303,6 +370,126 @@ type ReqDeleteDevices struct {
 	Auth    interface{}   `json:"auth,omitempty"`
 }
 
+// ReqJoinRoom is the JSON request for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3joinroomidoralias
+type ReqJoinRoom struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// ReqKnockRoom is the JSON request for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3knockroomidoralias
+type ReqKnockRoom struct {
+	// Via is sent as the server_name query parameter.
+	Via    []string `json:"-"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+// ReqReport is the JSON request for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3roomsroomidreporteventid
+// and the room and user reporting endpoints.
+type ReqReport struct {
+	Reason string `json:"reason,omitempty"`
+	// Score is the offensiveness of an event from -100 (most offensive) to 0. It's only used when reporting events.
+	Score *int `json:"score,omitempty"`
+}
+
+// RoomDirectoryVisibility is the visibility of a room in the public room directory.
+type RoomDirectoryVisibility string
+
+const (
+	RoomDirectoryVisibilityPublic  RoomDirectoryVisibility = "public"
+	RoomDirectoryVisibilityPrivate RoomDirectoryVisibility = "private"
+)
+
+// PublicRoomsFilter is the filter of a public room directory query.
+type PublicRoomsFilter struct {
+	GenericSearchTerm string `json:"generic_search_term,omitempty"`
+}
+
+// ReqPublicRooms is the request for https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3publicrooms
+// and https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3publicrooms
+type ReqPublicRooms struct {
+	// Server is the server whose room directory should be listed. If empty, the local homeserver's directory is used.
+	Server string `json:"-"`
+
+	Limit int    `json:"limit,omitempty"`
+	Since string `json:"since,omitempty"`
+
+	Filter               *PublicRoomsFilter `json:"filter,omitempty"`
+	IncludeAllNetworks   bool               `json:"include_all_networks,omitempty"`
+	ThirdPartyInstanceID string             `json:"third_party_instance_id,omitempty"`
+}
+
+// ReqRoomDirectoryVisibility is the JSON request for https://spec.matrix.org/v1.3/client-server-api/#put_matrixclientv3directorylistroomroomid
+type ReqRoomDirectoryVisibility struct {
+	Visibility RoomDirectoryVisibility `json:"visibility"`
+}
+
+// ThreePID mediums supported by the spec.
+const (
+	ThreePIDMediumEmail  = "email"
+	ThreePIDMediumMSISDN = "msisdn"
+)
+
+// ReqRequestEmailToken is the JSON request for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3account3pidemailrequesttoken
+type ReqRequestEmailToken struct {
+	ClientSecret  string `json:"client_secret"`
+	Email         string `json:"email"`
+	SendAttempt   int    `json:"send_attempt"`
+	NextLink      string `json:"next_link,omitempty"`
+	IDServer      string `json:"id_server,omitempty"`
+	IDAccessToken string `json:"id_access_token,omitempty"`
+}
+
+// ReqRequestMSISDNToken is the JSON request for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3account3pidmsisdnrequesttoken
+type ReqRequestMSISDNToken struct {
+	ClientSecret  string `json:"client_secret"`
+	Country       string `json:"country"`
+	PhoneNumber   string `json:"phone_number"`
+	SendAttempt   int    `json:"send_attempt"`
+	NextLink      string `json:"next_link,omitempty"`
+	IDServer      string `json:"id_server,omitempty"`
+	IDAccessToken string `json:"id_access_token,omitempty"`
+}
+
+// ReqAdd3PID is the JSON request for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3account3pidadd
+type ReqAdd3PID struct {
+	ClientSecret string      `json:"client_secret"`
+	SessionID    string      `json:"sid"`
+	Auth         interface{} `json:"auth,omitempty"`
+}
+
+// ReqBind3PID is the JSON request for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3account3pidbind
+type ReqBind3PID struct {
+	ClientSecret  string `json:"client_secret"`
+	SessionID     string `json:"sid"`
+	IDServer      string `json:"id_server"`
+	IDAccessToken string `json:"id_access_token"`
+}
+
+// ReqUnbind3PID is the JSON request for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3account3pidunbind
+// and https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3account3piddelete
+//
+// If IDServer is empty, the homeserver uses the identity server that the 3PID was bound with.
+type ReqUnbind3PID struct {
+	Medium   string `json:"medium"`
+	Address  string `json:"address"`
+	IDServer string `json:"id_server,omitempty"`
+}
+
+// ReqDeactivateAccount is the JSON request for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3accountdeactivate
+type ReqDeactivateAccount struct {
+	// Erase asks the server to also forget the messages sent by the user, so they aren't shown to new room members.
+	Erase    bool        `json:"erase,omitempty"`
+	IDServer string      `json:"id_server,omitempty"`
+	Auth     interface{} `json:"auth,omitempty"`
+}
+
+// ReqChangePassword is the JSON request for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3accountpassword
+type ReqChangePassword struct {
+	NewPassword string `json:"new_password"`
+	// LogoutDevices defaults to true on the server, so it's a pointer to allow explicitly keeping other devices.
+	LogoutDevices *bool       `json:"logout_devices,omitempty"`
+	Auth          interface{} `json:"auth,omitempty"`
+}
+
 type ReqPutPushRule struct {
 	Before string `json:"-"`
 	After  string `json:"-"`
@@ -321,6 +508,11 @@ type ReqBatchSend struct {
 }
 
 type ReqSetReadMarkers struct {
-	Read      id.EventID `json:"m.read"`
-	FullyRead id.EventID `json:"m.fully_read"`
+	Read        id.EventID `json:"m.read,omitempty"`
+	ReadPrivate id.EventID `json:"m.read.private,omitempty"`
+	FullyRead   id.EventID `json:"m.fully_read,omitempty"`
+}
+
+type ReqSendReceipt struct {
+	ThreadID string `json:"thread_id,omitempty"`
 }
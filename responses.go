@@ -1,6 +1,8 @@
 package mautrix
 
 import (
+	"encoding/json"
+
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
@@ -28,6 +30,11 @@ type RespJoinRoom struct {
 	RoomID id.RoomID `json:"room_id"`
 }
 
+// RespKnockRoom is the JSON response for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3knockroomidoralias
+type RespKnockRoom struct {
+	RoomID id.RoomID `json:"room_id"`
+}
+
 // RespLeaveRoom is the JSON response for http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-leave
 type RespLeaveRoom struct{}
 
@@ -147,6 +154,7 @@ type RespRegister struct {
 	DeviceID     id.DeviceID `json:"device_id"`
 	HomeServer   string      `json:"home_server"`
 	RefreshToken string      `json:"refresh_token"`
+	ExpiresInMS  int64       `json:"expires_in_ms,omitempty"`
 	UserID       id.UserID   `json:"user_id"`
 }
 
@@ -154,6 +162,11 @@ type LoginFlow struct {
 	Type AuthType `json:"type"`
 }
 
+// RespAuthIssuer is the JSON response for https://github.com/matrix-org/matrix-spec-proposals/pull/2965
+type RespAuthIssuer struct {
+	Issuer string `json:"issuer"`
+}
+
 type RespLoginFlows struct {
 	Flows []LoginFlow `json:"flows"`
 }
@@ -175,10 +188,19 @@ func (rlf *RespLoginFlows) HasFlow(flowType ...AuthType) bool {
 
 // RespLogin is the JSON response for https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-login
 type RespLogin struct {
-	AccessToken string           `json:"access_token"`
-	DeviceID    id.DeviceID      `json:"device_id"`
-	UserID      id.UserID        `json:"user_id"`
-	WellKnown   *ClientWellKnown `json:"well_known"`
+	AccessToken  string           `json:"access_token"`
+	RefreshToken string           `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64            `json:"expires_in_ms,omitempty"`
+	DeviceID     id.DeviceID      `json:"device_id"`
+	UserID       id.UserID        `json:"user_id"`
+	WellKnown    *ClientWellKnown `json:"well_known"`
+}
+
+// RespRefresh is the JSON response for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3refresh
+type RespRefresh struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
 }
 
 // RespLogout is the JSON response for http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-logout
@@ -215,11 +237,14 @@ type RespSync struct {
 
 	DeviceLists    DeviceLists `json:"device_lists"`
 	DeviceOTKCount OTKCount    `json:"device_one_time_keys_count"`
+	// The key algorithms for which the server has an unused fallback key. This is nil if the server doesn't support fallback keys.
+	DeviceUnusedFallbackKeyTypes []id.KeyAlgorithm `json:"device_unused_fallback_key_types"`
 
 	Rooms struct {
 		Leave  map[id.RoomID]SyncLeftRoom    `json:"leave"`
 		Join   map[id.RoomID]SyncJoinedRoom  `json:"join"`
 		Invite map[id.RoomID]SyncInvitedRoom `json:"invite"`
+		Knock  map[id.RoomID]SyncKnockedRoom `json:"knock"`
 	} `json:"rooms"`
 }
 
@@ -274,6 +299,14 @@ type SyncInvitedRoom struct {
 	} `json:"invite_state"`
 }
 
+// SyncKnockedRoom is a room that the user has knocked on. The state contains the stripped state of the room
+// and the knock membership event of the user.
+type SyncKnockedRoom struct {
+	State struct {
+		Events []*event.Event `json:"events"`
+	} `json:"knock_state"`
+}
+
 type RespTurnServer struct {
 	Username string   `json:"username"`
 	Password string   `json:"password"`
@@ -316,6 +349,51 @@ type RespKeyChanges struct {
 
 type RespSendToDevice struct{}
 
+// RespPutDehydratedDevice is the JSON response for PUT /_matrix/client/unstable/org.matrix.msc3814.v1/dehydrated_device
+type RespPutDehydratedDevice struct {
+	DeviceID id.DeviceID `json:"device_id"`
+}
+
+// RespGetDehydratedDevice is the JSON response for GET /_matrix/client/unstable/org.matrix.msc3814.v1/dehydrated_device
+type RespGetDehydratedDevice struct {
+	DeviceID   id.DeviceID          `json:"device_id"`
+	DeviceData DehydratedDeviceData `json:"device_data"`
+}
+
+// RespClaimDehydratedDevice is the JSON response for POST /_matrix/client/unstable/org.matrix.msc2697.v2/dehydrated_device/claim
+type RespClaimDehydratedDevice struct {
+	Success bool `json:"success"`
+}
+
+// RespDehydratedDeviceEvents is the JSON response for POST /_matrix/client/unstable/org.matrix.msc3814.v1/dehydrated_device/{deviceID}/events
+type RespDehydratedDeviceEvents struct {
+	Events    []*event.Event `json:"events"`
+	NextBatch string         `json:"next_batch"`
+}
+
+// RespRoomKeysVersionCreate is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3room_keysversion
+type RespRoomKeysVersionCreate struct {
+	Version string `json:"version"`
+}
+
+// RespRoomKeysVersion is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3room_keysversion
+type RespRoomKeysVersion struct {
+	Algorithm id.KeyBackupAlgorithm `json:"algorithm"`
+	AuthData  json.RawMessage       `json:"auth_data"`
+	Count     int                   `json:"count"`
+	ETag      string                `json:"etag"`
+	Version   string                `json:"version"`
+}
+
+// RespRoomKeys is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3room_keyskeys
+type RespRoomKeys = ReqRoomKeysUpdate
+
+// RespRoomKeysUpdate is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3room_keyskeys
+type RespRoomKeysUpdate struct {
+	Count int    `json:"count"`
+	ETag  string `json:"etag"`
+}
+
 // RespDevicesInfo is the JSON response for https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-devices
 type RespDevicesInfo struct {
 	Devices []RespDeviceInfo `json:"devices"`
@@ -339,3 +417,103 @@ type RespBatchSend struct {
 
 	NextBatchID id.BatchID `json:"next_batch_id"`
 }
+
+// ThirdPartyIdentifier is a 3PID bound to an account.
+type ThirdPartyIdentifier struct {
+	Medium      string `json:"medium"`
+	Address     string `json:"address"`
+	ValidatedAt int64  `json:"validated_at"`
+	AddedAt     int64  `json:"added_at"`
+}
+
+// Resp3PIDs is the JSON response for https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3account3pid
+type Resp3PIDs struct {
+	ThreePIDs []ThirdPartyIdentifier `json:"threepids"`
+}
+
+// RespRequestToken is the JSON response for the 3PID requestToken endpoints.
+type RespRequestToken struct {
+	SessionID string `json:"sid"`
+	SubmitURL string `json:"submit_url,omitempty"`
+}
+
+// RespIDServerUnbind is the JSON response for endpoints that unbind 3PIDs from the identity server, such as 3PID
+// deletion and account deactivation. The result is either "success" or "no-support".
+type RespIDServerUnbind struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
+// PublicRoom is a room in the public room directory.
+type PublicRoom struct {
+	RoomID           id.RoomID           `json:"room_id"`
+	Name             string              `json:"name,omitempty"`
+	Topic            string              `json:"topic,omitempty"`
+	CanonicalAlias   id.RoomAlias        `json:"canonical_alias,omitempty"`
+	AvatarURL        id.ContentURIString `json:"avatar_url,omitempty"`
+	NumJoinedMembers int                 `json:"num_joined_members"`
+	WorldReadable    bool                `json:"world_readable"`
+	GuestCanJoin     bool                `json:"guest_can_join"`
+	JoinRule         event.JoinRule      `json:"join_rule,omitempty"`
+	RoomType         event.RoomType      `json:"room_type,omitempty"`
+}
+
+// RespPublicRooms is the JSON response for https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3publicrooms
+type RespPublicRooms struct {
+	Chunk                  []PublicRoom `json:"chunk"`
+	NextBatch              string       `json:"next_batch,omitempty"`
+	PrevBatch              string       `json:"prev_batch,omitempty"`
+	TotalRoomCountEstimate int          `json:"total_room_count_estimate,omitempty"`
+}
+
+// RespRoomDirectoryVisibility is the JSON response for https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3directorylistroomroomid
+type RespRoomDirectoryVisibility struct {
+	Visibility RoomDirectoryVisibility `json:"visibility"`
+}
+
+// RespOpenIDToken is the JSON response for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3useruseridopenidrequest_token
+// The token can be used to prove the user's identity to third parties such as identity servers.
+type RespOpenIDToken struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	MatrixServerName string `json:"matrix_server_name"`
+	ExpiresIn        int    `json:"expires_in"`
+}
+
+// ThirdPartyFieldType describes a field that is used to look up third-party users or locations.
+type ThirdPartyFieldType struct {
+	Regexp      string `json:"regexp"`
+	Placeholder string `json:"placeholder"`
+}
+
+// ThirdPartyProtocolInstance is a single network (e.g. an IRC network) of a third-party protocol.
+type ThirdPartyProtocolInstance struct {
+	Description string            `json:"desc"`
+	Icon        string            `json:"icon,omitempty"`
+	Fields      map[string]string `json:"fields"`
+	NetworkID   string            `json:"network_id"`
+	// InstanceID is set by the homeserver, and can be used to filter the public room directory by network.
+	InstanceID string `json:"instance_id,omitempty"`
+}
+
+// ThirdPartyProtocol is the JSON response for https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3thirdpartyprotocolprotocol
+type ThirdPartyProtocol struct {
+	UserFields     []string                       `json:"user_fields"`
+	LocationFields []string                       `json:"location_fields"`
+	Icon           string                         `json:"icon"`
+	FieldTypes     map[string]ThirdPartyFieldType `json:"field_types"`
+	Instances      []ThirdPartyProtocolInstance   `json:"instances"`
+}
+
+// ThirdPartyLocation is a Matrix room that represents a third-party location (e.g. an IRC channel).
+type ThirdPartyLocation struct {
+	Alias    id.RoomAlias      `json:"alias"`
+	Protocol string            `json:"protocol"`
+	Fields   map[string]string `json:"fields"`
+}
+
+// ThirdPartyUser is a Matrix user that represents a third-party user.
+type ThirdPartyUser struct {
+	UserID   id.UserID         `json:"userid"`
+	Protocol string            `json:"protocol"`
+	Fields   map[string]string `json:"fields"`
+}
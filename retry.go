@@ -0,0 +1,132 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const retryIdempotentContextKey = "fi.mau.mautrix.retry_idempotent"
+
+// RetryPolicy decides which failed requests are retried and how long to wait before retrying them.
+//
+// Requests using idempotent methods (GET, HEAD, PUT, DELETE and OPTIONS) are retried after network errors and any of
+// the status codes in StatusCodes. This includes PUT requests with a transaction ID, like sending events, because the
+// transaction ID stays the same when retrying, so the server will deduplicate the request if the original one went
+// through. Other requests (i.e. POST) are only retried if the server explicitly rate limited them, because they were
+// definitely not processed in that case, unless RetryNonIdempotent is set or the request is marked as idempotent
+// with FullRequest.Idempotent.
+type RetryPolicy struct {
+	// The maximum number of attempts for each request, including the first one.
+	// If zero, Client.DefaultHTTPRetries+1 is used.
+	MaxAttempts int
+
+	// The delay before the first retry, which is multiplied by Multiplier after each attempt up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// The fraction of the backoff that is randomized, e.g. 0.2 means the delay is between 80% and 120% of the backoff.
+	Jitter float64
+
+	// The HTTP status codes that are retried.
+	StatusCodes []int
+	// Requests are not retried if the server asks to wait longer than this using retry_after_ms or Retry-After.
+	// If zero, the delay requested by the server is always respected.
+	MaxRetryAfter time.Duration
+
+	RetryNonIdempotent bool
+}
+
+// DefaultRetryPolicy is the retry policy used by clients that don't have one set.
+var DefaultRetryPolicy = RetryPolicy{
+	InitialBackoff: 4 * time.Second,
+	MaxBackoff:     2 * time.Minute,
+	Multiplier:     2,
+	Jitter:         0.1,
+	StatusCodes: []int{
+		http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	},
+	MaxRetryAfter: 5 * time.Minute,
+}
+
+func (cli *Client) retryPolicy() *RetryPolicy {
+	if cli.RetryPolicy != nil {
+		return cli.RetryPolicy
+	}
+	return &DefaultRetryPolicy
+}
+
+func (cli *Client) maxAttempts() int {
+	if policy := cli.retryPolicy(); policy.MaxAttempts > 0 {
+		return policy.MaxAttempts
+	}
+	return 1 + cli.DefaultHTTPRetries
+}
+
+func (policy *RetryPolicy) isIdempotent(req *http.Request) bool {
+	if policy.RetryNonIdempotent {
+		return true
+	} else if markedIdempotent, _ := req.Context().Value(retryIdempotentContextKey).(bool); markedIdempotent {
+		return true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+func (policy *RetryPolicy) retryStatus(req *http.Request, statusCode int) bool {
+	for _, code := range policy.StatusCodes {
+		if code == statusCode {
+			return statusCode == http.StatusTooManyRequests || policy.isIdempotent(req)
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the given retry, counting from zero.
+func (policy *RetryPolicy) backoff(retry int) time.Duration {
+	backoff := float64(policy.InitialBackoff) * math.Pow(policy.Multiplier, float64(retry))
+	if policy.Jitter > 0 {
+		backoff += backoff * policy.Jitter * (rand.Float64()*2 - 1)
+	}
+	if policy.MaxBackoff > 0 && backoff > float64(policy.MaxBackoff) {
+		backoff = float64(policy.MaxBackoff)
+	}
+	return time.Duration(backoff)
+}
+
+// parseRetryAfter returns how long the server asked the client to wait before retrying, or zero if it didn't say.
+// The retry_after_ms field of M_LIMIT_EXCEEDED errors takes precedence over the Retry-After header.
+func parseRetryAfter(res *http.Response, body []byte) time.Duration {
+	var respErr RespError
+	var limitErr LimitExceededError
+	if len(body) > 0 && json.Unmarshal(body, &respErr) == nil && respErr.As(&limitErr) && limitErr.RetryAfter > 0 {
+		return limitErr.RetryAfter
+	}
+	header := res.Header.Get("Retry-After")
+	if len(header) == 0 {
+		return 0
+	} else if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	header := func(value string) *http.Response {
+		res := &http.Response{Header: make(http.Header)}
+		if len(value) > 0 {
+			res.Header.Set("Retry-After", value)
+		}
+		return res
+	}
+	limitExceeded := []byte(`{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 1500}`)
+
+	assert.Equal(t, time.Duration(0), parseRetryAfter(header(""), nil))
+	assert.Equal(t, 120*time.Second, parseRetryAfter(header("120"), nil))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(header("0"), nil))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(header("-5"), nil))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(header("soon"), nil))
+	assert.Equal(t, 1500*time.Millisecond, parseRetryAfter(header(""), limitExceeded))
+	// retry_after_ms takes precedence over the header
+	assert.Equal(t, 1500*time.Millisecond, parseRetryAfter(header("120"), limitExceeded))
+	// Other errors and invalid bodies fall back to the header
+	assert.Equal(t, 3*time.Second, parseRetryAfter(header("3"), []byte(`{"errcode": "M_UNKNOWN", "retry_after_ms": 1500}`)))
+	assert.Equal(t, 3*time.Second, parseRetryAfter(header("3"), []byte(`<html>Bad Gateway</html>`)))
+	assert.Equal(t, 3*time.Second, parseRetryAfter(header("3"), []byte(`{"errcode": "M_LIMIT_EXCEEDED"}`)))
+
+	future := parseRetryAfter(header(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)), nil)
+	assert.True(t, future > 58*time.Second && future <= time.Minute, "unexpected delay %s", future)
+	assert.Equal(t, time.Duration(0), parseRetryAfter(header(time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)), nil))
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     10 * time.Second,
+		Multiplier:     2,
+	}
+	assert.Equal(t, time.Second, policy.backoff(0))
+	assert.Equal(t, 2*time.Second, policy.backoff(1))
+	assert.Equal(t, 8*time.Second, policy.backoff(3))
+	assert.Equal(t, 10*time.Second, policy.backoff(4))
+	assert.Equal(t, 10*time.Second, policy.backoff(50))
+
+	policy.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		backoff := policy.backoff(2)
+		assert.True(t, backoff >= 3200*time.Millisecond && backoff <= 4800*time.Millisecond, "unexpected backoff %s", backoff)
+		// Jitter never exceeds the maximum
+		assert.True(t, policy.backoff(4) <= 10*time.Second)
+	}
+}
+
+func TestRetryPolicy_RetryStatus(t *testing.T) {
+	policy := DefaultRetryPolicy
+	get, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	put, _ := http.NewRequest(http.MethodPut, "https://example.com", nil)
+	post, _ := http.NewRequest(http.MethodPost, "https://example.com", nil)
+	markedPost := post.WithContext(context.WithValue(context.Background(), retryIdempotentContextKey, true))
+
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		assert.True(t, policy.retryStatus(get, status), status)
+		assert.True(t, policy.retryStatus(put, status), status)
+		assert.True(t, policy.retryStatus(markedPost, status), status)
+	}
+	for _, status := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusInternalServerError} {
+		assert.False(t, policy.retryStatus(get, status), status)
+	}
+	// Non-idempotent requests are only retried if they were rate limited
+	assert.True(t, policy.retryStatus(post, http.StatusTooManyRequests))
+	assert.False(t, policy.retryStatus(post, http.StatusBadGateway))
+	policy.RetryNonIdempotent = true
+	assert.True(t, policy.retryStatus(post, http.StatusBadGateway))
+}
+
+func newRetryTestServer(statuses ...int) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := atomic.AddInt32(&requests, 1)
+		if int(count) <= len(statuses) {
+			w.WriteHeader(statuses[count-1])
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN", "error": "Try again"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	return server, &requests
+}
+
+func newRetryTestClient(t *testing.T, serverURL string) *Client {
+	cli := NewTestClient(t, serverURL)
+	cli.RetryPolicy = &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		Multiplier:     2,
+		StatusCodes:    DefaultRetryPolicy.StatusCodes,
+		MaxRetryAfter:  time.Second,
+	}
+	return cli
+}
+
+func TestClient_RetryIdempotent(t *testing.T) {
+	server, requests := newRetryTestServer(http.StatusBadGateway, http.StatusServiceUnavailable)
+	defer server.Close()
+	cli := newRetryTestClient(t, server.URL)
+	_, err := cli.MakeRequest(http.MethodPut, server.URL+"/test", struct{}{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(requests))
+}
+
+func TestClient_RetryMaxAttempts(t *testing.T) {
+	server, requests := newRetryTestServer(http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+	defer server.Close()
+	cli := newRetryTestClient(t, server.URL)
+	_, err := cli.MakeRequest(http.MethodGet, server.URL+"/test", nil, nil)
+	var httpErr HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusBadGateway, httpErr.Response.StatusCode)
+	assert.Equal(t, int32(3), atomic.LoadInt32(requests))
+}
+
+func TestClient_RetryNotRetriedStatus(t *testing.T) {
+	server, requests := newRetryTestServer(http.StatusInternalServerError)
+	defer server.Close()
+	cli := newRetryTestClient(t, server.URL)
+	_, err := cli.MakeRequest(http.MethodGet, server.URL+"/test", nil, nil)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+}
+
+func TestClient_RetryPost(t *testing.T) {
+	server, requests := newRetryTestServer(http.StatusBadGateway)
+	defer server.Close()
+	cli := newRetryTestClient(t, server.URL)
+	_, err := cli.MakeRequest(http.MethodPost, server.URL+"/test", struct{}{}, nil)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+
+	// The Idempotent flag allows retrying POST requests
+	server2, requests2 := newRetryTestServer(http.StatusBadGateway)
+	defer server2.Close()
+	_, err = cli.MakeFullRequest(FullRequest{
+		Method:      http.MethodPost,
+		URL:         server2.URL + "/test",
+		RequestJSON: struct{}{},
+		Idempotent:  true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(requests2))
+}
+
+func TestClient_RetryRateLimited(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 50}`))
+		case 2:
+			// Longer than MaxRetryAfter, so the error is returned
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests"}`))
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+	cli := newRetryTestClient(t, server.URL)
+	start := time.Now()
+	_, err := cli.MakeRequest(http.MethodPost, server.URL+"/test", struct{}{}, nil)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond, "retry_after_ms wasn't respected")
+	assert.ErrorIs(t, err, MLimitExceeded)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	// ErrSessionInvalidated means that the access token is no longer valid and couldn't be recovered.
+	ErrSessionInvalidated = errors.New("access token is no longer valid")
+	// ErrSessionUserMismatch means that the access token belongs to a different user than the client's user ID.
+	ErrSessionUserMismatch = errors.New("access token belongs to a different user")
+	// ErrSessionDeviceMismatch means that the access token belongs to a different device than the client's device ID,
+	// and the device change wasn't allowed by SessionRecovery.AllowDeviceChange.
+	ErrSessionDeviceMismatch = errors.New("access token belongs to a different device")
+)
+
+// SessionRecovery configures how ValidateSession recovers from problems with the session.
+type SessionRecovery struct {
+	// Relogin is called when the access token has been invalidated. It should log in again (e.g. using Login with
+	// StoreCredentials) and return nil if it succeeded, in which case the new session is validated again.
+	Relogin func(ctx context.Context, cli *Client) error
+	// AllowDeviceChange is called when the access token belongs to a different device than the client's DeviceID,
+	// e.g. because the token was replaced with one from another login. End-to-end encryption keys are bound to
+	// the device ID, so the crypto store must be reset before switching devices. If this returns true, the device
+	// ID of the client is changed. If it's nil or returns false, ValidateSession returns ErrSessionDeviceMismatch.
+	AllowDeviceChange func(oldDeviceID, newDeviceID id.DeviceID) bool
+}
+
+func (cli *Client) whoamiWithContext(ctx context.Context) (resp *RespWhoami, err error) {
+	_, err = cli.MakeFullRequest(FullRequest{
+		Method:       http.MethodGet,
+		URL:          cli.BuildURL("account", "whoami"),
+		ResponseJSON: &resp,
+		Context:      ctx,
+	})
+	return
+}
+
+// ValidateSession checks that the access token of the client is still valid and belongs to the client's user and
+// device using /account/whoami. Bridges and bots should call this on startup before using the crypto store, so that
+// a foreign or replaced access token doesn't end up corrupting the end-to-end encryption identity of the device.
+//
+// If the client doesn't have a user ID or device ID yet, they're filled from the whoami response.
+// Problems are recovered from using the client's SessionRecovery if possible.
+func (cli *Client) ValidateSession(ctx context.Context) (*RespWhoami, error) {
+	resp, err := cli.whoamiWithContext(ctx)
+	if errors.Is(err, MUnknownToken) {
+		if cli.SessionRecovery == nil || cli.SessionRecovery.Relogin == nil {
+			return nil, fmt.Errorf("%w: %v", ErrSessionInvalidated, err)
+		}
+		cli.Logger.Debugfln("Access token was invalidated, trying to log in again")
+		err = cli.SessionRecovery.Relogin(ctx, cli)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to log in again: %v", ErrSessionInvalidated, err)
+		}
+		resp, err = cli.whoamiWithContext(ctx)
+		if errors.Is(err, MUnknownToken) {
+			return nil, fmt.Errorf("%w: %v", ErrSessionInvalidated, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cli.UserID) == 0 {
+		cli.UserID = resp.UserID
+	} else if resp.UserID != cli.UserID {
+		return resp, fmt.Errorf("%w: expected %s, got %s", ErrSessionUserMismatch, cli.UserID, resp.UserID)
+	}
+
+	if len(resp.DeviceID) == 0 {
+		// Old servers and appservice tokens don't return a device ID
+	} else if len(cli.DeviceID) == 0 {
+		cli.DeviceID = resp.DeviceID
+	} else if resp.DeviceID != cli.DeviceID {
+		if cli.SessionRecovery == nil || cli.SessionRecovery.AllowDeviceChange == nil ||
+			!cli.SessionRecovery.AllowDeviceChange(cli.DeviceID, resp.DeviceID) {
+			return resp, fmt.Errorf("%w: expected %s, got %s", ErrSessionDeviceMismatch, cli.DeviceID, resp.DeviceID)
+		}
+		cli.logWarning("Device ID changed from %s to %s", cli.DeviceID, resp.DeviceID)
+		cli.DeviceID = resp.DeviceID
+	}
+	return resp, nil
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// newWhoamiServer returns a server that responds to /account/whoami based on the access token.
+func newWhoamiServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer token":
+			_, _ = w.Write([]byte(`{"user_id": "@user:example.com", "device_id": "DEVICE"}`))
+		case "Bearer newdevice":
+			_, _ = w.Write([]byte(`{"user_id": "@user:example.com", "device_id": "NEWDEVICE"}`))
+		case "Bearer appservice":
+			_, _ = w.Write([]byte(`{"user_id": "@user:example.com"}`))
+		case "Bearer foreign":
+			_, _ = w.Write([]byte(`{"user_id": "@other:example.com", "device_id": "OTHER"}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "Invalid access token"}`))
+		}
+	}))
+}
+
+func newSessionTestClient(t *testing.T, serverURL string, userID id.UserID, deviceID id.DeviceID, token string) *mautrix.Client {
+	cli := mautrix.NewTestClient(t, serverURL)
+	cli.UserID = userID
+	cli.DeviceID = deviceID
+	cli.AccessToken = token
+	return cli
+}
+
+func TestClient_ValidateSession(t *testing.T) {
+	server := newWhoamiServer()
+	defer server.Close()
+
+	cli := newSessionTestClient(t, server.URL, "@user:example.com", "DEVICE", "token")
+	resp, err := cli.ValidateSession(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, id.DeviceID("DEVICE"), resp.DeviceID)
+
+	// Missing IDs are filled from the response
+	cli = newSessionTestClient(t, server.URL, "", "", "token")
+	_, err = cli.ValidateSession(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@user:example.com"), cli.UserID)
+	assert.Equal(t, id.DeviceID("DEVICE"), cli.DeviceID)
+
+	// Responses without a device ID are accepted
+	cli = newSessionTestClient(t, server.URL, "@user:example.com", "DEVICE", "appservice")
+	_, err = cli.ValidateSession(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, id.DeviceID("DEVICE"), cli.DeviceID)
+
+	cli = newSessionTestClient(t, server.URL, "@user:example.com", "DEVICE", "foreign")
+	_, err = cli.ValidateSession(context.Background())
+	assert.ErrorIs(t, err, mautrix.ErrSessionUserMismatch)
+	assert.Equal(t, id.UserID("@user:example.com"), cli.UserID)
+
+	cli = newSessionTestClient(t, server.URL, "@user:example.com", "DEVICE", "invalid")
+	_, err = cli.ValidateSession(context.Background())
+	assert.ErrorIs(t, err, mautrix.ErrSessionInvalidated)
+}
+
+func TestClient_ValidateSession_DeviceChange(t *testing.T) {
+	server := newWhoamiServer()
+	defer server.Close()
+
+	cli := newSessionTestClient(t, server.URL, "@user:example.com", "DEVICE", "newdevice")
+	_, err := cli.ValidateSession(context.Background())
+	assert.ErrorIs(t, err, mautrix.ErrSessionDeviceMismatch)
+	assert.Equal(t, id.DeviceID("DEVICE"), cli.DeviceID)
+
+	var oldDevice, newDevice id.DeviceID
+	allow := false
+	cli.SessionRecovery = &mautrix.SessionRecovery{
+		AllowDeviceChange: func(oldDeviceID, newDeviceID id.DeviceID) bool {
+			oldDevice, newDevice = oldDeviceID, newDeviceID
+			return allow
+		},
+	}
+	_, err = cli.ValidateSession(context.Background())
+	assert.ErrorIs(t, err, mautrix.ErrSessionDeviceMismatch)
+	assert.Equal(t, id.DeviceID("DEVICE"), oldDevice)
+	assert.Equal(t, id.DeviceID("NEWDEVICE"), newDevice)
+
+	allow = true
+	_, err = cli.ValidateSession(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, id.DeviceID("NEWDEVICE"), cli.DeviceID)
+}
+
+func TestClient_ValidateSession_Relogin(t *testing.T) {
+	server := newWhoamiServer()
+	defer server.Close()
+
+	cli := newSessionTestClient(t, server.URL, "@user:example.com", "DEVICE", "invalid")
+	relogins := 0
+	cli.SessionRecovery = &mautrix.SessionRecovery{
+		Relogin: func(ctx context.Context, cli *mautrix.Client) error {
+			relogins++
+			cli.AccessToken = "token"
+			return nil
+		},
+	}
+	_, err := cli.ValidateSession(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, relogins)
+	assert.Equal(t, "token", cli.AccessToken)
+
+	// Tokens that are still invalid after logging in again aren't retried forever
+	cli.AccessToken = "invalid"
+	cli.SessionRecovery.Relogin = func(ctx context.Context, cli *mautrix.Client) error {
+		relogins++
+		return nil
+	}
+	_, err = cli.ValidateSession(context.Background())
+	assert.ErrorIs(t, err, mautrix.ErrSessionInvalidated)
+	assert.Equal(t, 2, relogins)
+
+	cli.SessionRecovery.Relogin = func(ctx context.Context, cli *mautrix.Client) error {
+		return errors.New("wrong password")
+	}
+	_, err = cli.ValidateSession(context.Background())
+	assert.ErrorIs(t, err, mautrix.ErrSessionInvalidated)
+	assert.Contains(t, err.Error(), "wrong password")
+
+	// The device is still checked after logging in again
+	cli.SessionRecovery.Relogin = func(ctx context.Context, cli *mautrix.Client) error {
+		cli.AccessToken = "newdevice"
+		return nil
+	}
+	_, err = cli.ValidateSession(context.Background())
+	assert.ErrorIs(t, err, mautrix.ErrSessionDeviceMismatch)
+}
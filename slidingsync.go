@@ -0,0 +1,522 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// SlidingSyncURLPath is the path of the simplified sliding sync endpoint (MSC4186).
+var SlidingSyncURLPath = URLPath{"_matrix", "client", "unstable", "org.matrix.simplified_msc3575", "sync"}
+
+// RequiredStateLazyMembers can be used as the state key of m.room.member in RequiredState to only get the members
+// that are relevant to the returned timeline events.
+const RequiredStateLazyMembers = "$LAZY"
+
+// SlidingSyncListFilters filters which rooms are included in a sliding sync list.
+type SlidingSyncListFilters struct {
+	IsDM         *bool            `json:"is_dm,omitempty"`
+	IsEncrypted  *bool            `json:"is_encrypted,omitempty"`
+	IsInvite     *bool            `json:"is_invite,omitempty"`
+	RoomTypes    []event.RoomType `json:"room_types,omitempty"`
+	NotRoomTypes []event.RoomType `json:"not_room_types,omitempty"`
+	Spaces       []id.RoomID      `json:"spaces,omitempty"`
+	Tags         []string         `json:"tags,omitempty"`
+	NotTags      []string         `json:"not_tags,omitempty"`
+}
+
+// SlidingSyncList is a list of rooms sorted by recent activity, of which the rooms in the given ranges are returned.
+type SlidingSyncList struct {
+	// Ranges are the inclusive index ranges of the sorted room list to return, e.g. [[0, 19]] for the first 20 rooms.
+	Ranges [][2]int `json:"ranges,omitempty"`
+	// RequiredState is the list of [event type, state key] pairs to return for each room.
+	// Both may be "*" to match everything.
+	RequiredState [][2]string             `json:"required_state"`
+	TimelineLimit int                     `json:"timeline_limit"`
+	Filters       *SlidingSyncListFilters `json:"filters,omitempty"`
+}
+
+// SlidingSyncRoomSubscription requests a specific room regardless of whether it's in the ranges of any list.
+type SlidingSyncRoomSubscription struct {
+	RequiredState [][2]string `json:"required_state"`
+	TimelineLimit int         `json:"timeline_limit"`
+}
+
+type marshalableSlidingSyncList SlidingSyncList
+
+func (list *SlidingSyncList) MarshalJSON() ([]byte, error) {
+	if list.RequiredState == nil {
+		// The server requires the field, so send an empty list instead of null
+		listCopy := *list
+		listCopy.RequiredState = [][2]string{}
+		list = &listCopy
+	}
+	return json.Marshal((*marshalableSlidingSyncList)(list))
+}
+
+type marshalableSlidingSyncRoomSubscription SlidingSyncRoomSubscription
+
+func (sub *SlidingSyncRoomSubscription) MarshalJSON() ([]byte, error) {
+	if sub.RequiredState == nil {
+		subCopy := *sub
+		subCopy.RequiredState = [][2]string{}
+		sub = &subCopy
+	}
+	return json.Marshal((*marshalableSlidingSyncRoomSubscription)(sub))
+}
+
+// SlidingSyncExtensionToggle enables a sliding sync extension that has no other options.
+type SlidingSyncExtensionToggle struct {
+	Enabled bool `json:"enabled"`
+}
+
+// SlidingSyncExtensionScope enables a sliding sync extension for the rooms in the given lists and room subscriptions.
+// If Lists and Rooms are both empty, the extension applies to all returned rooms.
+type SlidingSyncExtensionScope struct {
+	Enabled bool        `json:"enabled"`
+	Lists   []string    `json:"lists,omitempty"`
+	Rooms   []id.RoomID `json:"rooms,omitempty"`
+}
+
+// ReqSlidingSyncToDevice enables the to-device extension. Since is filled automatically by SlidingSyncer.
+type ReqSlidingSyncToDevice struct {
+	Enabled bool   `json:"enabled"`
+	Since   string `json:"since,omitempty"`
+	Limit   int    `json:"limit,omitempty"`
+}
+
+// ReqSlidingSyncExtensions contains the extensions to enable in a sliding sync request.
+type ReqSlidingSyncExtensions struct {
+	E2EE        *SlidingSyncExtensionToggle `json:"e2ee,omitempty"`
+	ToDevice    *ReqSlidingSyncToDevice     `json:"to_device,omitempty"`
+	AccountData *SlidingSyncExtensionScope  `json:"account_data,omitempty"`
+	Receipts    *SlidingSyncExtensionScope  `json:"receipts,omitempty"`
+	Typing      *SlidingSyncExtensionScope  `json:"typing,omitempty"`
+}
+
+// ReqSlidingSync is the JSON request for the simplified sliding sync endpoint (MSC4186).
+type ReqSlidingSync struct {
+	ConnID            string                                     `json:"conn_id,omitempty"`
+	Lists             map[string]*SlidingSyncList                `json:"lists,omitempty"`
+	RoomSubscriptions map[id.RoomID]*SlidingSyncRoomSubscription `json:"room_subscriptions,omitempty"`
+	Extensions        ReqSlidingSyncExtensions                   `json:"extensions"`
+
+	// Pos is the position from the previous response, or empty to start a new connection.
+	Pos string `json:"-"`
+	// Timeout is how long the server should wait for new data, in milliseconds.
+	Timeout int             `json:"-"`
+	Context context.Context `json:"-"`
+}
+
+// SlidingSyncListResponse contains the details of a list in a sliding sync response.
+type SlidingSyncListResponse struct {
+	// Count is the total number of rooms that match the filters of the list.
+	Count int `json:"count"`
+}
+
+// SlidingSyncHero is a room member that can be used to calculate the name of a room without a name.
+type SlidingSyncHero struct {
+	UserID      id.UserID           `json:"user_id"`
+	Displayname string              `json:"displayname,omitempty"`
+	AvatarURL   id.ContentURIString `json:"avatar_url,omitempty"`
+}
+
+// SlidingSyncRoom is a single room in a sliding sync response.
+type SlidingSyncRoom struct {
+	Name   string              `json:"name,omitempty"`
+	Avatar id.ContentURIString `json:"avatar,omitempty"`
+	Heroes []SlidingSyncHero   `json:"heroes,omitempty"`
+	// Initial is true if this is the first time the room is sent on this connection.
+	Initial bool `json:"initial,omitempty"`
+	IsDM    bool `json:"is_dm,omitempty"`
+
+	InviteState   []*event.Event `json:"invite_state,omitempty"`
+	KnockState    []*event.Event `json:"knock_state,omitempty"`
+	RequiredState []*event.Event `json:"required_state,omitempty"`
+	Timeline      []*event.Event `json:"timeline,omitempty"`
+	PrevBatch     string         `json:"prev_batch,omitempty"`
+	Limited       bool           `json:"limited,omitempty"`
+	// NumLive is the number of events at the end of the timeline that are new since the previous response.
+	NumLive          int   `json:"num_live,omitempty"`
+	ExpandedTimeline bool  `json:"expanded_timeline,omitempty"`
+	BumpStamp        int64 `json:"bump_stamp,omitempty"`
+
+	JoinedCount       *int `json:"joined_count,omitempty"`
+	InvitedCount      *int `json:"invited_count,omitempty"`
+	NotificationCount int  `json:"notification_count"`
+	HighlightCount    int  `json:"highlight_count"`
+}
+
+// RespSlidingSyncExtensions contains the extension data in a sliding sync response.
+type RespSlidingSyncExtensions struct {
+	ToDevice *struct {
+		NextBatch string         `json:"next_batch"`
+		Events    []*event.Event `json:"events"`
+	} `json:"to_device,omitempty"`
+	E2EE *struct {
+		DeviceLists                  DeviceLists       `json:"device_lists"`
+		DeviceOTKCount               OTKCount          `json:"device_one_time_keys_count"`
+		DeviceUnusedFallbackKeyTypes []id.KeyAlgorithm `json:"device_unused_fallback_key_types"`
+	} `json:"e2ee,omitempty"`
+	AccountData *struct {
+		Global []*event.Event               `json:"global"`
+		Rooms  map[id.RoomID][]*event.Event `json:"rooms"`
+	} `json:"account_data,omitempty"`
+	Receipts *struct {
+		Rooms map[id.RoomID]*event.Event `json:"rooms"`
+	} `json:"receipts,omitempty"`
+	Typing *struct {
+		Rooms map[id.RoomID]*event.Event `json:"rooms"`
+	} `json:"typing,omitempty"`
+}
+
+// RespSlidingSync is the JSON response for the simplified sliding sync endpoint (MSC4186).
+type RespSlidingSync struct {
+	Pos        string                             `json:"pos"`
+	Lists      map[string]SlidingSyncListResponse `json:"lists"`
+	Rooms      map[id.RoomID]*SlidingSyncRoom     `json:"rooms"`
+	Extensions RespSlidingSyncExtensions          `json:"extensions"`
+}
+
+// ToSyncResponse converts the sliding sync response into a /sync response, so that it can be processed by existing
+// Syncer implementations. Rooms with invite or knock state are treated as invited or knocked rooms and all other
+// rooms as joined rooms, as sliding sync doesn't return left rooms separately.
+func (resp *RespSlidingSync) ToSyncResponse() *RespSync {
+	var out RespSync
+	out.NextBatch = resp.Pos
+	out.Rooms.Join = make(map[id.RoomID]SyncJoinedRoom)
+	out.Rooms.Invite = make(map[id.RoomID]SyncInvitedRoom)
+	out.Rooms.Knock = make(map[id.RoomID]SyncKnockedRoom)
+	out.Rooms.Leave = make(map[id.RoomID]SyncLeftRoom)
+	for roomID, room := range resp.Rooms {
+		switch {
+		case room.InviteState != nil:
+			var invited SyncInvitedRoom
+			invited.State.Events = room.InviteState
+			out.Rooms.Invite[roomID] = invited
+		case room.KnockState != nil:
+			var knocked SyncKnockedRoom
+			knocked.State.Events = room.KnockState
+			out.Rooms.Knock[roomID] = knocked
+		default:
+			var joined SyncJoinedRoom
+			joined.State.Events = room.RequiredState
+			joined.Timeline.Events = room.Timeline
+			joined.Timeline.Limited = room.Limited
+			joined.Timeline.PrevBatch = room.PrevBatch
+			joined.Summary.JoinedMemberCount = room.JoinedCount
+			joined.Summary.InvitedMemberCount = room.InvitedCount
+			for _, hero := range room.Heroes {
+				joined.Summary.Heroes = append(joined.Summary.Heroes, hero.UserID)
+			}
+			out.Rooms.Join[roomID] = joined
+		}
+	}
+
+	ext := resp.Extensions
+	if ext.ToDevice != nil {
+		out.ToDevice.Events = ext.ToDevice.Events
+	}
+	if ext.E2EE != nil {
+		out.DeviceLists = ext.E2EE.DeviceLists
+		out.DeviceOTKCount = ext.E2EE.DeviceOTKCount
+		out.DeviceUnusedFallbackKeyTypes = ext.E2EE.DeviceUnusedFallbackKeyTypes
+	}
+	if ext.AccountData != nil {
+		out.AccountData.Events = ext.AccountData.Global
+		for roomID, evts := range ext.AccountData.Rooms {
+			joined := out.Rooms.Join[roomID]
+			joined.AccountData.Events = evts
+			out.Rooms.Join[roomID] = joined
+		}
+	}
+	if ext.Receipts != nil {
+		for roomID, evt := range ext.Receipts.Rooms {
+			joined := out.Rooms.Join[roomID]
+			joined.Ephemeral.Events = append(joined.Ephemeral.Events, evt)
+			out.Rooms.Join[roomID] = joined
+		}
+	}
+	if ext.Typing != nil {
+		for roomID, evt := range ext.Typing.Rooms {
+			joined := out.Rooms.Join[roomID]
+			joined.Ephemeral.Events = append(joined.Ephemeral.Events, evt)
+			out.Rooms.Join[roomID] = joined
+		}
+	}
+	return &out
+}
+
+// SlidingSync makes a single simplified sliding sync request (MSC4186). Most users should use SlidingSyncer instead.
+func (cli *Client) SlidingSync(req *ReqSlidingSync) (resp *RespSlidingSync, err error) {
+	query := map[string]string{}
+	if len(req.Pos) > 0 {
+		query["pos"] = req.Pos
+		query["timeout"] = strconv.Itoa(req.Timeout)
+	}
+	_, err = cli.MakeFullRequest(FullRequest{
+		Method:       http.MethodPost,
+		URL:          cli.BuildBaseURLWithQuery(SlidingSyncURLPath, query),
+		RequestJSON:  req,
+		ResponseJSON: &resp,
+		Context:      req.Context,
+		// The SlidingSyncer handles retries like the normal sync loop
+		MaxAttempts: 1,
+	})
+	return
+}
+
+// SlidingSyncPosition is the state of a sliding sync connection that can be persisted to resume syncing later.
+type SlidingSyncPosition struct {
+	Pos           string `json:"pos"`
+	ToDeviceSince string `json:"to_device_since"`
+}
+
+// SlidingSyncHandler handles a whole sliding sync response before it's passed to the Syncer. The pos parameter is
+// the position that was used to produce the response, which is empty for the first response of a connection.
+// If the return value is false, the response won't be passed to the Syncer.
+type SlidingSyncHandler func(resp *RespSlidingSync, pos string) bool
+
+// SlidingSyncer syncs using simplified sliding sync (MSC4186), which is an alternative to the /sync loop in
+// Client.Sync that only returns the rooms that are requested by lists or room subscriptions. This makes the initial
+// sync of large accounts much faster.
+//
+// Responses are converted into /sync responses with RespSlidingSync.ToSyncResponse and passed to a Syncer, so the
+// event handlers of DefaultSyncer and e.g. the crypto machine work without changes. Lists and room subscriptions can
+// be changed while syncing, which interrupts the current request to send the new configuration immediately.
+type SlidingSyncer struct {
+	Client *Client
+	// Syncer receives the converted responses. If nil, the syncer of the client is used.
+	Syncer Syncer
+	// ConnID identifies the connection, which allows using multiple connections with the same access token.
+	ConnID string
+	// Timeout is how long the server should wait for new data before responding.
+	Timeout time.Duration
+	// Extensions are the extensions to enable. The to-device since token is filled automatically.
+	// This must be set before calling Sync.
+	Extensions ReqSlidingSyncExtensions
+
+	lock              sync.Mutex
+	lists             map[string]*SlidingSyncList
+	roomSubscriptions map[id.RoomID]*SlidingSyncRoomSubscription
+	listCounts        map[string]int
+	position          SlidingSyncPosition
+	cancelRequest     context.CancelFunc
+	handlers          []SlidingSyncHandler
+	resetHandlers     []func()
+}
+
+// NewSlidingSyncer creates a sliding syncer for the given client with a 30 second timeout.
+func NewSlidingSyncer(cli *Client) *SlidingSyncer {
+	return &SlidingSyncer{
+		Client:            cli,
+		Timeout:           30 * time.Second,
+		lists:             make(map[string]*SlidingSyncList),
+		roomSubscriptions: make(map[id.RoomID]*SlidingSyncRoomSubscription),
+		listCounts:        make(map[string]int),
+	}
+}
+
+// interrupt cancels the in-flight request so that the next one is sent with the new configuration.
+// The lock must be held when calling this.
+func (ss *SlidingSyncer) interrupt() {
+	if ss.cancelRequest != nil {
+		ss.cancelRequest()
+		ss.cancelRequest = nil
+	}
+}
+
+// SetList adds or replaces a list. The list must not be modified after passing it here, call SetList again with a
+// new list instead, e.g. to expand the ranges when the user scrolls.
+func (ss *SlidingSyncer) SetList(name string, list *SlidingSyncList) {
+	ss.lock.Lock()
+	ss.lists[name] = list
+	ss.interrupt()
+	ss.lock.Unlock()
+}
+
+// RemoveList removes a list.
+func (ss *SlidingSyncer) RemoveList(name string) {
+	ss.lock.Lock()
+	delete(ss.lists, name)
+	delete(ss.listCounts, name)
+	ss.interrupt()
+	ss.lock.Unlock()
+}
+
+// Subscribe adds or replaces a room subscription, e.g. when the room is opened in the UI.
+func (ss *SlidingSyncer) Subscribe(roomID id.RoomID, sub *SlidingSyncRoomSubscription) {
+	ss.lock.Lock()
+	ss.roomSubscriptions[roomID] = sub
+	ss.interrupt()
+	ss.lock.Unlock()
+}
+
+// Unsubscribe removes a room subscription.
+func (ss *SlidingSyncer) Unsubscribe(roomID id.RoomID) {
+	ss.lock.Lock()
+	delete(ss.roomSubscriptions, roomID)
+	ss.interrupt()
+	ss.lock.Unlock()
+}
+
+// ListCount returns the total number of rooms in the given list according to the latest response.
+func (ss *SlidingSyncer) ListCount(name string) int {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return ss.listCounts[name]
+}
+
+// Position returns the current position of the connection.
+func (ss *SlidingSyncer) Position() SlidingSyncPosition {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return ss.position
+}
+
+// RestorePosition sets the position of the connection, e.g. to resume syncing after a restart. Persisting the
+// to-device since token is important, as the server deletes to-device events once they've been acknowledged.
+func (ss *SlidingSyncer) RestorePosition(pos SlidingSyncPosition) {
+	ss.lock.Lock()
+	ss.position = pos
+	ss.lock.Unlock()
+}
+
+// OnResponse adds a handler that receives the raw sliding sync responses.
+func (ss *SlidingSyncer) OnResponse(handler SlidingSyncHandler) {
+	ss.lock.Lock()
+	ss.handlers = append(ss.handlers, handler)
+	ss.lock.Unlock()
+}
+
+// OnReset adds a handler that is called when the server has expired the position of the connection. The next
+// response will contain all rooms in the lists again, so any data that was only received once (e.g. the initial
+// required state) should be refreshed from the new responses.
+func (ss *SlidingSyncer) OnReset(handler func()) {
+	ss.lock.Lock()
+	ss.resetHandlers = append(ss.resetHandlers, handler)
+	ss.lock.Unlock()
+}
+
+func (ss *SlidingSyncer) buildRequest(ctx context.Context) *ReqSlidingSync {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	req := &ReqSlidingSync{
+		ConnID:            ss.ConnID,
+		Lists:             make(map[string]*SlidingSyncList, len(ss.lists)),
+		RoomSubscriptions: make(map[id.RoomID]*SlidingSyncRoomSubscription, len(ss.roomSubscriptions)),
+		Extensions:        ss.Extensions,
+		Pos:               ss.position.Pos,
+		Timeout:           int(ss.Timeout.Milliseconds()),
+	}
+	for name, list := range ss.lists {
+		req.Lists[name] = list
+	}
+	for roomID, sub := range ss.roomSubscriptions {
+		req.RoomSubscriptions[roomID] = sub
+	}
+	if req.Extensions.ToDevice != nil {
+		toDevice := *req.Extensions.ToDevice
+		toDevice.Since = ss.position.ToDeviceSince
+		req.Extensions.ToDevice = &toDevice
+	}
+	req.Context, ss.cancelRequest = context.WithCancel(ctx)
+	return req
+}
+
+func (ss *SlidingSyncer) reset() {
+	ss.lock.Lock()
+	ss.position.Pos = ""
+	ss.listCounts = make(map[string]int)
+	handlers := ss.resetHandlers
+	ss.lock.Unlock()
+	for _, handler := range handlers {
+		handler()
+	}
+}
+
+func (ss *SlidingSyncer) update(resp *RespSlidingSync) []SlidingSyncHandler {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.position.Pos = resp.Pos
+	if resp.Extensions.ToDevice != nil && len(resp.Extensions.ToDevice.NextBatch) > 0 {
+		ss.position.ToDeviceSince = resp.Extensions.ToDevice.NextBatch
+	}
+	for name, list := range resp.Lists {
+		ss.listCounts[name] = list.Count
+	}
+	return ss.handlers
+}
+
+func (ss *SlidingSyncer) processResponse(resp *RespSlidingSync, pos string, syncer Syncer) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("sliding sync handler panicked! pos=%s panic=%s\n%s", pos, r, debug.Stack())
+		}
+	}()
+	for _, handler := range ss.update(resp) {
+		if !handler(resp, pos) {
+			return nil
+		}
+	}
+	return syncer.ProcessResponse(resp.ToSyncResponse(), pos)
+}
+
+// Sync starts syncing using sliding sync and blocks until the context is canceled, Client.StopSync is called or
+// the Syncer returns an error. Like Client.Sync, only one sync loop can be active per client at a time.
+//
+// Expired positions are handled automatically by starting a new connection (see OnReset). Other errors are passed
+// to the OnFailedSync method of the Syncer to decide whether to retry.
+func (ss *SlidingSyncer) Sync(ctx context.Context) error {
+	cli := ss.Client
+	syncer := ss.Syncer
+	if syncer == nil {
+		syncer = cli.Syncer
+	}
+	syncingID := cli.incrementSyncingID()
+	for {
+		req := ss.buildRequest(ctx)
+		resp, err := cli.SlidingSync(req)
+		interrupted := req.Context.Err() != nil
+		ss.lock.Lock()
+		ss.interrupt()
+		ss.lock.Unlock()
+		if cli.getSyncingID() != syncingID {
+			return nil
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			} else if interrupted {
+				continue
+			} else if errors.Is(err, MUnknownPos) {
+				cli.Logger.Debugfln("Sliding sync position %s expired, starting new connection", req.Pos)
+				ss.reset()
+				continue
+			}
+			duration, err2 := syncer.OnFailedSync(nil, err)
+			if err2 != nil {
+				return err2
+			}
+			time.Sleep(duration)
+			continue
+		}
+		if err = ss.processResponse(resp, req.Pos, syncer); err != nil {
+			return err
+		}
+	}
+}
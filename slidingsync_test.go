@@ -0,0 +1,296 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const slidingSyncPath = "/_matrix/client/unstable/org.matrix.simplified_msc3575/sync"
+
+func TestClient_SlidingSync(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("POST "+slidingSyncPath, `{"pos": "2", "lists": {"all": {"count": 5}}}`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	resp, err := cli.SlidingSync(&mautrix.ReqSlidingSync{
+		ConnID: "main",
+		Lists: map[string]*mautrix.SlidingSyncList{
+			"all": {Ranges: [][2]int{{0, 9}}, TimelineLimit: 1},
+		},
+		RoomSubscriptions: map[id.RoomID]*mautrix.SlidingSyncRoomSubscription{
+			"!room:example.com": {RequiredState: [][2]string{{"m.room.member", mautrix.RequiredStateLazyMembers}}, TimelineLimit: 20},
+		},
+		Extensions: mautrix.ReqSlidingSyncExtensions{
+			E2EE:     &mautrix.SlidingSyncExtensionToggle{Enabled: true},
+			ToDevice: &mautrix.ReqSlidingSyncToDevice{Enabled: true, Since: "td"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "2", resp.Pos)
+	assert.Equal(t, 5, resp.Lists["all"].Count)
+	req := srv.LastRequest(t)
+	assert.Equal(t, http.MethodPost, req.Method)
+	// The first request of a connection has no position or timeout
+	assert.Empty(t, req.Query)
+	// Missing required state is sent as an empty list
+	assert.JSONEq(t, `{
+		"conn_id": "main",
+		"lists": {"all": {"ranges": [[0, 9]], "required_state": [], "timeline_limit": 1}},
+		"room_subscriptions": {"!room:example.com": {"required_state": [["m.room.member", "$LAZY"]], "timeline_limit": 20}},
+		"extensions": {"e2ee": {"enabled": true}, "to_device": {"enabled": true, "since": "td"}}
+	}`, req.Body)
+
+	_, err = cli.SlidingSync(&mautrix.ReqSlidingSync{Pos: "2", Timeout: 30000})
+	require.NoError(t, err)
+	req = srv.LastRequest(t)
+	assert.Equal(t, "2", req.Query.Get("pos"))
+	assert.Equal(t, "30000", req.Query.Get("timeout"))
+	assert.JSONEq(t, `{"extensions": {}}`, req.Body)
+
+	// Errors aren't retried, the sliding syncer handles them
+	cli.RetryPolicy = &mautrix.RetryPolicy{MaxAttempts: 3, StatusCodes: []int{http.StatusBadGateway}}
+	srv.RespondStatus("POST "+slidingSyncPath, http.StatusBadGateway, `{"errcode": "M_UNKNOWN", "error": "Bad gateway"}`)
+	_, err = cli.SlidingSync(&mautrix.ReqSlidingSync{})
+	require.Error(t, err)
+	assert.Len(t, srv.Requests(), 1)
+}
+
+func TestRespSlidingSync_ToSyncResponse(t *testing.T) {
+	var resp mautrix.RespSlidingSync
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"pos": "5",
+		"rooms": {
+			"!joined:example.com": {
+				"required_state": [{"type": "m.room.name", "state_key": "", "content": {"name": "Room"}}],
+				"timeline": [{"type": "m.room.message", "event_id": "$msg", "content": {"msgtype": "m.text", "body": "hi"}}],
+				"prev_batch": "prev", "limited": true, "joined_count": 3, "heroes": [{"user_id": "@hero:example.com"}]
+			},
+			"!invited:example.com": {"invite_state": [{"type": "m.room.member", "state_key": "@user:example.com", "content": {"membership": "invite"}}]},
+			"!knocked:example.com": {"knock_state": [{"type": "m.room.member", "state_key": "@user:example.com", "content": {"membership": "knock"}}]}
+		},
+		"extensions": {
+			"to_device": {"next_batch": "td2", "events": [{"type": "m.room_key_request", "content": {}}]},
+			"e2ee": {"device_one_time_keys_count": {"signed_curve25519": 50}, "device_lists": {"changed": ["@changed:example.com"]}},
+			"account_data": {"global": [{"type": "m.direct", "content": {}}], "rooms": {"!joined:example.com": [{"type": "m.tag", "content": {}}]}},
+			"receipts": {"rooms": {"!joined:example.com": {"type": "m.receipt", "content": {}}}},
+			"typing": {"rooms": {"!joined:example.com": {"type": "m.typing", "content": {"user_ids": []}}}}
+		}
+	}`), &resp))
+
+	out := resp.ToSyncResponse()
+	assert.Equal(t, "5", out.NextBatch)
+	require.Len(t, out.Rooms.Join, 1)
+	joined := out.Rooms.Join["!joined:example.com"]
+	require.Len(t, joined.State.Events, 1)
+	require.Len(t, joined.Timeline.Events, 1)
+	assert.Equal(t, id.EventID("$msg"), joined.Timeline.Events[0].ID)
+	assert.True(t, joined.Timeline.Limited)
+	assert.Equal(t, "prev", joined.Timeline.PrevBatch)
+	assert.Equal(t, 3, *joined.Summary.JoinedMemberCount)
+	assert.Equal(t, []id.UserID{"@hero:example.com"}, joined.Summary.Heroes)
+	assert.Len(t, joined.AccountData.Events, 1)
+	assert.Len(t, joined.Ephemeral.Events, 2)
+	assert.Contains(t, out.Rooms.Invite, id.RoomID("!invited:example.com"))
+	assert.Contains(t, out.Rooms.Knock, id.RoomID("!knocked:example.com"))
+	assert.Len(t, out.ToDevice.Events, 1)
+	assert.Len(t, out.AccountData.Events, 1)
+	assert.Equal(t, 50, out.DeviceOTKCount.SignedCurve25519)
+	assert.Equal(t, []id.UserID{"@changed:example.com"}, out.DeviceLists.Changed)
+}
+
+type slidingSyncRequest struct {
+	Pos           string
+	ToDeviceSince string
+	Lists         []string
+}
+
+// newSlidingSyncTestServer returns a server that responds to sliding sync requests using the respond function. If it returns an empty
+// string, the request is held until the client cancels it.
+func newSlidingSyncTestServer(respond func(req slidingSyncRequest) (int, string)) (*httptest.Server, func() []slidingSyncRequest) {
+	var lock sync.Mutex
+	var requests []slidingSyncRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Lists      map[string]json.RawMessage `json:"lists"`
+			Extensions struct {
+				ToDevice *struct {
+					Since string `json:"since"`
+				} `json:"to_device"`
+			} `json:"extensions"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		req := slidingSyncRequest{Pos: r.URL.Query().Get("pos")}
+		if body.Extensions.ToDevice != nil {
+			req.ToDeviceSince = body.Extensions.ToDevice.Since
+		}
+		for name := range body.Lists {
+			req.Lists = append(req.Lists, name)
+		}
+		lock.Lock()
+		requests = append(requests, req)
+		lock.Unlock()
+		status, resp := respond(req)
+		if len(resp) == 0 {
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(resp))
+	}))
+	return server, func() []slidingSyncRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]slidingSyncRequest{}, requests...)
+	}
+}
+
+func TestSlidingSyncer_Sync(t *testing.T) {
+	expired := false
+	server, getRequests := newSlidingSyncTestServer(func(req slidingSyncRequest) (int, string) {
+		switch {
+		case req.Pos == "1":
+			expired = true
+			return http.StatusBadRequest, `{"errcode": "M_UNKNOWN_POS", "error": "Unknown position"}`
+		case expired:
+			return http.StatusOK, `{"pos": "3", "lists": {"all": {"count": 3}}}`
+		default:
+			return http.StatusOK, `{"pos": "1", "lists": {"all": {"count": 2}}, "rooms": {"!room:example.com": {"timeline": [{"type": "m.room.message", "event_id": "$1", "content": {}}]}}, "extensions": {"to_device": {"next_batch": "td1", "events": []}}}`
+		}
+	})
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+	syncer := mautrix.NewDefaultSyncer()
+	var messages []id.EventID
+	syncer.OnEventType(event.EventMessage, func(source mautrix.EventSource, evt *event.Event) {
+		assert.Equal(t, id.RoomID("!room:example.com"), evt.RoomID)
+		messages = append(messages, evt.ID)
+	})
+	ss := mautrix.NewSlidingSyncer(cli)
+	ss.Syncer = syncer
+	ss.Extensions.ToDevice = &mautrix.ReqSlidingSyncToDevice{Enabled: true}
+	ss.SetList("all", &mautrix.SlidingSyncList{Ranges: [][2]int{{0, 19}}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resets := 0
+	ss.OnReset(func() {
+		resets++
+	})
+	var positions []string
+	ss.OnResponse(func(resp *mautrix.RespSlidingSync, pos string) bool {
+		positions = append(positions, pos)
+		if resp.Pos == "3" {
+			cancel()
+		}
+		return true
+	})
+	err := ss.Sync(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, []string{"", ""}, positions)
+	assert.Equal(t, 1, resets)
+	assert.Equal(t, []id.EventID{"$1"}, messages)
+	assert.Equal(t, 3, ss.ListCount("all"))
+	// The to-device token survives the connection reset
+	assert.Equal(t, mautrix.SlidingSyncPosition{Pos: "3", ToDeviceSince: "td1"}, ss.Position())
+
+	requests := getRequests()
+	require.True(t, len(requests) >= 3)
+	assert.Equal(t, slidingSyncRequest{Pos: "", ToDeviceSince: "", Lists: []string{"all"}}, requests[0])
+	assert.Equal(t, slidingSyncRequest{Pos: "1", ToDeviceSince: "td1", Lists: []string{"all"}}, requests[1])
+	assert.Equal(t, slidingSyncRequest{Pos: "", ToDeviceSince: "td1", Lists: []string{"all"}}, requests[2])
+}
+
+func TestSlidingSyncer_Interrupt(t *testing.T) {
+	server, getRequests := newSlidingSyncTestServer(func(req slidingSyncRequest) (int, string) {
+		if req.Pos == "" {
+			return http.StatusOK, `{"pos": "1"}`
+		} else if len(req.Lists) == 1 && req.Lists[0] == "new" {
+			return http.StatusOK, `{"pos": "2", "lists": {"new": {"count": 1}}}`
+		}
+		// Hold the long poll until the list changes
+		return 0, ""
+	})
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+	ss := mautrix.NewSlidingSyncer(cli)
+	ss.Syncer = mautrix.NewDefaultSyncer()
+	ss.RestorePosition(mautrix.SlidingSyncPosition{ToDeviceSince: "restored"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ss.OnResponse(func(resp *mautrix.RespSlidingSync, pos string) bool {
+		if resp.Pos == "2" {
+			cancel()
+		}
+		return true
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- ss.Sync(ctx)
+	}()
+	require.Eventually(t, func() bool {
+		return len(getRequests()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	ss.SetList("new", &mautrix.SlidingSyncList{})
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("sliding sync wasn't interrupted")
+	}
+	assert.Equal(t, 1, ss.ListCount("new"))
+
+	requests := getRequests()
+	require.Len(t, requests, 3)
+	assert.Equal(t, "1", requests[1].Pos)
+	assert.Empty(t, requests[1].Lists)
+	assert.Equal(t, []string{"new"}, requests[2].Lists)
+	assert.Equal(t, "1", requests[2].Pos)
+}
+
+func TestSlidingSyncer_HandlerFilter(t *testing.T) {
+	server, _ := newSlidingSyncTestServer(func(req slidingSyncRequest) (int, string) {
+		return http.StatusOK, `{"pos": "1", "rooms": {"!room:example.com": {"timeline": [{"type": "m.room.message", "event_id": "$1", "content": {}}]}}}`
+	})
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+	syncer := mautrix.NewDefaultSyncer()
+	syncer.OnEventType(event.EventMessage, func(source mautrix.EventSource, evt *event.Event) {
+		t.Error("filtered response was passed to the syncer")
+	})
+	ss := mautrix.NewSlidingSyncer(cli)
+	ss.Syncer = syncer
+
+	// Handlers can stop responses from reaching the syncer, and panics are returned as errors
+	calls := 0
+	ss.OnResponse(func(resp *mautrix.RespSlidingSync, pos string) bool {
+		calls++
+		if calls == 2 {
+			panic("handler failed")
+		}
+		return false
+	})
+	err := ss.Sync(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "handler failed")
+	assert.Equal(t, 2, calls)
+}
@@ -61,6 +61,12 @@ func (s *InMemoryStore) LoadRoom(roomID id.RoomID) *Room {
 }
 
 // UpdateState stores a state event. This can be passed to DefaultSyncer.OnEvent to keep all room state cached.
+// To make sure the state is updated before other handlers see the event, register it with a higher priority:
+//
+//	syncer.OnEventWithOptions(mautrix.HandlerOptions{Priority: mautrix.PriorityStateStore}, func(source mautrix.EventSource, evt *event.Event) bool {
+//		store.UpdateState(source, evt)
+//		return false
+//	})
 func (s *InMemoryStore) UpdateState(_ EventSource, evt *event.Event) {
 	if !evt.Type.IsState() {
 		return
@@ -0,0 +1,173 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package synapseadmin contains typed wrappers for the most commonly used parts of the Synapse admin API.
+// See https://matrix-org.github.io/synapse/latest/usage/administration/admin_api/
+package synapseadmin
+
+import (
+	"net/http"
+	"strconv"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// Client is a wrapper for the mautrix.Client that adds methods for the Synapse admin API.
+// Requests go through the normal request pipeline of the wrapped client, so the access token, retries, rate limiting
+// and middlewares all apply. The access token must belong to a server admin.
+type Client struct {
+	*mautrix.Client
+}
+
+// NewClient wraps the given client.
+func NewClient(cli *mautrix.Client) *Client {
+	return &Client{Client: cli}
+}
+
+// BuildAdminURL builds a URL for the given admin API path, e.g. BuildAdminURL("v2", "users", userID).
+func (cli *Client) BuildAdminURL(path ...interface{}) string {
+	return cli.BuildBaseURL(append([]interface{}{"_synapse", "admin"}, path...)...)
+}
+
+// BuildAdminURLWithQuery builds an admin API URL with the given query parameters.
+func (cli *Client) BuildAdminURLWithQuery(path mautrix.URLPath, query map[string]string) string {
+	return cli.BuildBaseURLWithQuery(append(mautrix.URLPath{"_synapse", "admin"}, path...), query)
+}
+
+// ReqListUsers is the request for ListUsers.
+type ReqListUsers struct {
+	From  string
+	Limit int
+	// Name filters users by a part of their user ID or display name.
+	Name        string
+	Guests      *bool
+	Deactivated bool
+	OrderBy     string
+}
+
+func (req *ReqListUsers) query() map[string]string {
+	query := map[string]string{}
+	if len(req.From) > 0 {
+		query["from"] = req.From
+	}
+	if req.Limit > 0 {
+		query["limit"] = strconv.Itoa(req.Limit)
+	}
+	if len(req.Name) > 0 {
+		query["name"] = req.Name
+	}
+	if req.Guests != nil {
+		query["guests"] = strconv.FormatBool(*req.Guests)
+	}
+	if req.Deactivated {
+		query["deactivated"] = "true"
+	}
+	if len(req.OrderBy) > 0 {
+		query["order_by"] = req.OrderBy
+	}
+	return query
+}
+
+// UserInfo is a user returned by ListUsers.
+type UserInfo struct {
+	UserID       id.UserID           `json:"name"`
+	DisplayName  string              `json:"displayname"`
+	AvatarURL    id.ContentURIString `json:"avatar_url"`
+	IsGuest      bool                `json:"is_guest"`
+	Admin        bool                `json:"admin"`
+	Deactivated  bool                `json:"deactivated"`
+	ShadowBanned bool                `json:"shadow_banned"`
+	CreationTS   int64               `json:"creation_ts"`
+	UserType     string              `json:"user_type,omitempty"`
+}
+
+// RespListUsers is the response for ListUsers.
+type RespListUsers struct {
+	Users     []UserInfo `json:"users"`
+	NextToken string     `json:"next_token,omitempty"`
+	Total     int        `json:"total"`
+}
+
+// ListUsers lists a page of the users on the server. The next page can be fetched by setting From to NextToken.
+// See https://matrix-org.github.io/synapse/latest/admin_api/user_admin_api.html#list-accounts
+func (cli *Client) ListUsers(req ReqListUsers) (resp *RespListUsers, err error) {
+	_, err = cli.MakeRequest(http.MethodGet, cli.BuildAdminURLWithQuery(mautrix.URLPath{"v2", "users"}, req.query()), nil, &resp)
+	return
+}
+
+// ThreePID is a third-party identifier of a user in the admin API.
+type ThreePID struct {
+	Medium      string `json:"medium"`
+	Address     string `json:"address"`
+	AddedAt     int64  `json:"added_at"`
+	ValidatedAt int64  `json:"validated_at"`
+}
+
+// RespUserDetails is the response for GetUser.
+type RespUserDetails struct {
+	UserID       id.UserID           `json:"name"`
+	DisplayName  string              `json:"displayname"`
+	AvatarURL    id.ContentURIString `json:"avatar_url"`
+	ThreePIDs    []ThreePID          `json:"threepids"`
+	IsGuest      bool                `json:"is_guest"`
+	Admin        bool                `json:"admin"`
+	Deactivated  bool                `json:"deactivated"`
+	Erased       bool                `json:"erased"`
+	ShadowBanned bool                `json:"shadow_banned"`
+	CreationTS   int64               `json:"creation_ts"`
+	UserType     string              `json:"user_type,omitempty"`
+}
+
+// GetUser gets the details of the given user.
+// See https://matrix-org.github.io/synapse/latest/admin_api/user_admin_api.html#query-user-account
+func (cli *Client) GetUser(userID id.UserID) (resp *RespUserDetails, err error) {
+	_, err = cli.MakeRequest(http.MethodGet, cli.BuildAdminURL("v2", "users", userID), nil, &resp)
+	return
+}
+
+// ReqDeactivateUser is the request for DeactivateUser.
+type ReqDeactivateUser struct {
+	Erase bool `json:"erase"`
+}
+
+// DeactivateUser deactivates the given user. If erase is set, the user's messages are also hidden from new members
+// of rooms.
+// See https://matrix-org.github.io/synapse/latest/admin_api/user_admin_api.html#deactivate-account
+func (cli *Client) DeactivateUser(userID id.UserID, req ReqDeactivateUser) error {
+	_, err := cli.MakeRequest(http.MethodPost, cli.BuildAdminURL("v1", "deactivate", userID), &req, nil)
+	return err
+}
+
+// ReqResetPassword is the request for ResetPassword.
+type ReqResetPassword struct {
+	NewPassword   string `json:"new_password"`
+	LogoutDevices bool   `json:"logout_devices"`
+}
+
+// ResetPassword changes the password of the given user.
+// See https://matrix-org.github.io/synapse/latest/admin_api/user_admin_api.html#reset-password
+func (cli *Client) ResetPassword(userID id.UserID, req ReqResetPassword) error {
+	_, err := cli.MakeFullRequest(mautrix.FullRequest{
+		Method:           http.MethodPost,
+		URL:              cli.BuildAdminURL("v1", "reset_password", userID),
+		RequestJSON:      &req,
+		SensitiveContent: true,
+	})
+	return err
+}
+
+// SetShadowBanned shadow-bans or unbans the given user. Shadow-banned users get successful responses to most
+// requests, but their messages aren't sent to anyone else.
+// See https://matrix-org.github.io/synapse/latest/admin_api/user_admin_api.html#controlling-whether-a-user-is-shadow-banned
+func (cli *Client) SetShadowBanned(userID id.UserID, banned bool) error {
+	method := http.MethodPost
+	if !banned {
+		method = http.MethodDelete
+	}
+	_, err := cli.MakeRequest(method, cli.BuildAdminURL("v1", "users", userID, "shadow_ban"), struct{}{}, nil)
+	return err
+}
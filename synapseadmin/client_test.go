@@ -0,0 +1,76 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package synapseadmin_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/synapseadmin"
+)
+
+type recordedRequest struct {
+	Method string
+	Path   string
+	Query  string
+	Body   map[string]interface{}
+}
+
+func newTestClient(t *testing.T, response string) (*synapseadmin.Client, *[]recordedRequest) {
+	var requests []recordedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := recordedRequest{Method: r.Method, Path: r.URL.EscapedPath(), Query: r.URL.RawQuery}
+		_ = json.NewDecoder(r.Body).Decode(&req.Body)
+		requests = append(requests, req)
+		assert.Equal(t, "Bearer admin_token", r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@admin:example.com", "admin_token")
+	require.NoError(t, err)
+	return synapseadmin.NewClient(cli), &requests
+}
+
+func TestClient_ListUsers(t *testing.T) {
+	cli, requests := newTestClient(t, `{"users": [{"name": "@user:example.com", "admin": true}], "next_token": "100", "total": 150}`)
+	guests := false
+	resp, err := cli.ListUsers(synapseadmin.ReqListUsers{From: "50", Limit: 50, Guests: &guests})
+	require.NoError(t, err)
+	assert.Equal(t, "100", resp.NextToken)
+	require.Len(t, resp.Users, 1)
+	assert.EqualValues(t, "@user:example.com", resp.Users[0].UserID)
+	assert.True(t, resp.Users[0].Admin)
+	require.Len(t, *requests, 1)
+	assert.Equal(t, "/_synapse/admin/v2/users", (*requests)[0].Path)
+	assert.Equal(t, "from=50&guests=false&limit=50", (*requests)[0].Query)
+}
+
+func TestClient_PurgeHistory(t *testing.T) {
+	cli, requests := newTestClient(t, `{"purge_id": "abc"}`)
+	resp, err := cli.PurgeHistory("!room:example.com", synapseadmin.ReqPurgeHistory{UpToEventID: "$event", DeleteLocalEvents: true})
+	require.NoError(t, err)
+	assert.Equal(t, "abc", resp.PurgeID)
+	require.Len(t, *requests, 1)
+	assert.Equal(t, "/_synapse/admin/v1/purge_history/%21room:example.com/$event", (*requests)[0].Path)
+	assert.Equal(t, map[string]interface{}{"delete_local_events": true}, (*requests)[0].Body)
+}
+
+func TestClient_SetShadowBanned(t *testing.T) {
+	cli, requests := newTestClient(t, `{}`)
+	require.NoError(t, cli.SetShadowBanned("@spammer:example.com", true))
+	require.NoError(t, cli.SetShadowBanned("@spammer:example.com", false))
+	require.Len(t, *requests, 2)
+	assert.Equal(t, http.MethodPost, (*requests)[0].Method)
+	assert.Equal(t, http.MethodDelete, (*requests)[1].Method)
+	assert.Equal(t, "/_synapse/admin/v1/users/@spammer:example.com/shadow_ban", (*requests)[1].Path)
+}
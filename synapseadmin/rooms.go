@@ -0,0 +1,143 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package synapseadmin
+
+import (
+	"net/http"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// ReqForceJoin is the request for ForceJoin.
+type ReqForceJoin struct {
+	UserID id.UserID `json:"user_id"`
+}
+
+// RespForceJoin is the response for ForceJoin.
+type RespForceJoin struct {
+	RoomID id.RoomID `json:"room_id"`
+}
+
+// ForceJoin joins a local user to the given room ID or alias without an invite. The admin must be in the room and
+// have permission to invite users.
+// See https://matrix-org.github.io/synapse/latest/admin_api/room_membership.html
+func (cli *Client) ForceJoin(roomIDOrAlias string, userID id.UserID) (resp *RespForceJoin, err error) {
+	_, err = cli.MakeRequest(http.MethodPost, cli.BuildAdminURL("v1", "join", roomIDOrAlias), &ReqForceJoin{UserID: userID}, &resp)
+	return
+}
+
+// RespRoomMembers is the response for RoomMembers.
+type RespRoomMembers struct {
+	Members []id.UserID `json:"members"`
+	Total   int         `json:"total"`
+}
+
+// RoomMembers lists the members of the given room.
+// See https://matrix-org.github.io/synapse/latest/admin_api/rooms.html#room-members-api
+func (cli *Client) RoomMembers(roomID id.RoomID) (resp *RespRoomMembers, err error) {
+	_, err = cli.MakeRequest(http.MethodGet, cli.BuildAdminURL("v1", "rooms", roomID, "members"), nil, &resp)
+	return
+}
+
+// ReqDeleteRoom is the request for DeleteRoom.
+type ReqDeleteRoom struct {
+	// If NewRoomUserID is set, local users are moved to a new room created by that user,
+	// which contains the given RoomName and Message.
+	NewRoomUserID id.UserID `json:"new_room_user_id,omitempty"`
+	RoomName      string    `json:"room_name,omitempty"`
+	Message       string    `json:"message,omitempty"`
+	// Block prevents joining the room in the future.
+	Block bool `json:"block"`
+	// Purge removes the room from the database entirely.
+	Purge      bool `json:"purge"`
+	ForcePurge bool `json:"force_purge,omitempty"`
+}
+
+// RespDeleteRoom is the response for DeleteRoom.
+type RespDeleteRoom struct {
+	DeleteID string `json:"delete_id"`
+}
+
+// DeleteRoom starts a background task that kicks all local users out of the given room and optionally purges it.
+// The progress can be checked with DeleteRoomStatus.
+// See https://matrix-org.github.io/synapse/latest/admin_api/rooms.html#version-2-new-version
+func (cli *Client) DeleteRoom(roomID id.RoomID, req ReqDeleteRoom) (resp *RespDeleteRoom, err error) {
+	_, err = cli.MakeRequest(http.MethodDelete, cli.BuildAdminURL("v2", "rooms", roomID), &req, &resp)
+	return
+}
+
+// Status values of background tasks.
+const (
+	StatusShuttingDown = "shutting_down"
+	StatusPurging      = "purging"
+	StatusActive       = "active"
+	StatusComplete     = "complete"
+	StatusFailed       = "failed"
+)
+
+// ShutdownRoomResult contains the results of the shutdown part of a room deletion.
+type ShutdownRoomResult struct {
+	KickedUsers       []id.UserID    `json:"kicked_users"`
+	FailedToKickUsers []id.UserID    `json:"failed_to_kick_users"`
+	LocalAliases      []id.RoomAlias `json:"local_aliases"`
+	NewRoomID         id.RoomID      `json:"new_room_id,omitempty"`
+}
+
+// RespDeleteRoomStatus is the response for DeleteRoomStatus.
+type RespDeleteRoomStatus struct {
+	DeleteID     string             `json:"delete_id"`
+	RoomID       id.RoomID          `json:"room_id"`
+	Status       string             `json:"status"`
+	Error        string             `json:"error,omitempty"`
+	ShutdownRoom ShutdownRoomResult `json:"shutdown_room"`
+}
+
+// DeleteRoomStatus gets the status of a room deletion started with DeleteRoom.
+// See https://matrix-org.github.io/synapse/latest/admin_api/rooms.html#query-by-delete_id
+func (cli *Client) DeleteRoomStatus(deleteID string) (resp *RespDeleteRoomStatus, err error) {
+	_, err = cli.MakeRequest(http.MethodGet, cli.BuildAdminURL("v2", "rooms", "delete_status", deleteID), nil, &resp)
+	return
+}
+
+// ReqPurgeHistory is the request for PurgeHistory.
+type ReqPurgeHistory struct {
+	// UpToEventID purges history up to the given event. If empty, UpToTS is used instead.
+	UpToEventID id.EventID `json:"-"`
+	UpToTS      int64      `json:"purge_up_to_ts,omitempty"`
+	// DeleteLocalEvents also purges events sent by local users. By default, only remote events are purged.
+	DeleteLocalEvents bool `json:"delete_local_events"`
+}
+
+// RespPurgeHistory is the response for PurgeHistory.
+type RespPurgeHistory struct {
+	PurgeID string `json:"purge_id"`
+}
+
+// PurgeHistory starts a background task that removes old events of the given room from the database.
+// The progress can be checked with PurgeHistoryStatus.
+// See https://matrix-org.github.io/synapse/latest/admin_api/purge_history_api.html
+func (cli *Client) PurgeHistory(roomID id.RoomID, req ReqPurgeHistory) (resp *RespPurgeHistory, err error) {
+	path := []interface{}{"v1", "purge_history", roomID}
+	if len(req.UpToEventID) > 0 {
+		path = append(path, req.UpToEventID)
+	}
+	_, err = cli.MakeRequest(http.MethodPost, cli.BuildAdminURL(path...), &req, &resp)
+	return
+}
+
+// RespPurgeHistoryStatus is the response for PurgeHistoryStatus.
+type RespPurgeHistoryStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// PurgeHistoryStatus gets the status of a history purge started with PurgeHistory.
+// See https://matrix-org.github.io/synapse/latest/admin_api/purge_history_api.html#purge-status-query
+func (cli *Client) PurgeHistoryStatus(purgeID string) (resp *RespPurgeHistoryStatus, err error) {
+	_, err = cli.MakeRequest(http.MethodGet, cli.BuildAdminURL("v1", "purge_history_status", purgeID), nil, &resp)
+	return
+}
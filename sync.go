@@ -7,8 +7,11 @@
 package mautrix
 
 import (
+	"errors"
 	"fmt"
 	"runtime/debug"
+	"sort"
+	"sync"
 	"time"
 
 	"maunium.net/go/mautrix/event"
@@ -28,6 +31,7 @@ const (
 	EventSourceState
 	EventSourceEphemeral
 	EventSourceToDevice
+	EventSourceKnock
 )
 
 func (es EventSource) String() string {
@@ -56,6 +60,12 @@ func (es EventSource) String() string {
 		case EventSourceState:
 			return "invited state"
 		}
+	case es&EventSourceKnock != 0:
+		es -= EventSourceKnock
+		switch es {
+		case EventSourceState:
+			return "knocked state"
+		}
 	case es&EventSourceLeave != 0:
 		es -= EventSourceLeave
 		switch es {
@@ -96,17 +106,117 @@ type ExtensibleSyncer interface {
 // replace parts of this default syncer (e.g. the ProcessResponse method). The default syncer uses the observer
 // pattern to notify callers about incoming events. See DefaultSyncer.OnEventType for more information.
 type DefaultSyncer struct {
-	// syncListeners want the whole sync response, e.g. the crypto machine
-	syncListeners []SyncHandler
-	// globalListeners want all events
-	globalListeners []EventHandler
-	// listeners want a specific event type
-	listeners map[event.Type][]EventHandler
+	// syncHandlers want the whole sync response, e.g. the crypto machine
+	syncHandlers []*registeredSyncHandler
+	// eventHandlers want individual events, sorted in the order they should be called
+	eventHandlers []*registeredEventHandler
+	handlerCount  int
+	handlerLock   sync.RWMutex
 	// ParseEventContent determines whether or not event content should be parsed before passing to handlers.
 	ParseEventContent bool
 	// ParseErrorHandler is called when event.Content.ParseRaw returns an error.
 	// If it returns false, the event will not be forwarded to listeners.
 	ParseErrorHandler func(evt *event.Event, err error) bool
+	// ConcurrentRoomWorkers is the number of goroutines to use for handling room events. If it's more than 1,
+	// different rooms are handled in parallel, while events in the same room are still handled in order.
+	// All rooms in a sync response are handled before the next response is processed. Event handlers must be safe
+	// for concurrent use when this is enabled.
+	ConcurrentRoomWorkers int
+	// InitialSyncWorkers overrides ConcurrentRoomWorkers for the initial sync (since=""), which usually has far more
+	// rooms than later syncs.
+	InitialSyncWorkers int
+	// If IgnoreOldEvents is true, the initial sync (since="") is only used to build state: sync handlers like the
+	// state store and crypto machine receive the whole response, but message events in room timelines aren't passed
+	// to event handlers. In later syncs, timeline message events sent before IgnoreEventsBefore are dropped too, e.g.
+	// the history of newly joined rooms. State events are always passed to event handlers.
+	IgnoreOldEvents bool
+	// The time before which timeline message events are ignored if IgnoreOldEvents is true. NewDefaultSyncer sets it
+	// to the time when the syncer is created. Bots should usually set it to the time of the login. It must not be
+	// changed while syncing.
+	IgnoreEventsBefore time.Time
+	// OnInitialSyncProgress is called while the rooms of the initial sync are being handled: once before the first
+	// room and after each room. Calls are never concurrent, even with multiple workers.
+	OnInitialSyncProgress func(progress InitialSyncProgress)
+
+	initialSyncDone     chan struct{}
+	initialSyncFinished bool
+	initialSyncLock     sync.Mutex
+}
+
+// InitialSyncProgress describes how much of the initial sync has been handled.
+type InitialSyncProgress struct {
+	RoomsProcessed int
+	TotalRooms     int
+	// The number of state events in the processed rooms, including state events in the timeline.
+	StateEventsApplied int
+}
+
+type initialSyncProgressTracker struct {
+	progress InitialSyncProgress
+	callback func(progress InitialSyncProgress)
+	lock     sync.Mutex
+}
+
+func (ist *initialSyncProgressTracker) roomDone(stateEvents int) {
+	ist.lock.Lock()
+	defer ist.lock.Unlock()
+	ist.progress.RoomsProcessed++
+	ist.progress.StateEventsApplied += stateEvents
+	ist.callback(ist.progress)
+}
+
+func countStateEvents(res *RespSync, roomID id.RoomID) (count int) {
+	countIn := func(evts []*event.Event) {
+		for _, evt := range evts {
+			if evt.StateKey != nil {
+				count++
+			}
+		}
+	}
+	if roomData, ok := res.Rooms.Join[roomID]; ok {
+		count += len(roomData.State.Events)
+		countIn(roomData.Timeline.Events)
+	}
+	if roomData, ok := res.Rooms.Invite[roomID]; ok {
+		count += len(roomData.State.Events)
+	}
+	if roomData, ok := res.Rooms.Knock[roomID]; ok {
+		count += len(roomData.State.Events)
+	}
+	if roomData, ok := res.Rooms.Leave[roomID]; ok {
+		count += len(roomData.State.Events)
+		countIn(roomData.Timeline.Events)
+	}
+	return
+}
+
+// InitialSyncDone returns a channel that is closed once the first initial sync response (since="") has been handled,
+// including all rooms. It can be used to wait for the initial sync from other goroutines, e.g.
+//
+//	select {
+//	case <-syncer.InitialSyncDone():
+//	case <-ctx.Done():
+//	}
+func (s *DefaultSyncer) InitialSyncDone() <-chan struct{} {
+	s.initialSyncLock.Lock()
+	defer s.initialSyncLock.Unlock()
+	if s.initialSyncDone == nil {
+		s.initialSyncDone = make(chan struct{})
+	}
+	return s.initialSyncDone
+}
+
+func (s *DefaultSyncer) finishInitialSync() {
+	s.initialSyncLock.Lock()
+	defer s.initialSyncLock.Unlock()
+	if s.initialSyncFinished {
+		return
+	}
+	s.initialSyncFinished = true
+	if s.initialSyncDone == nil {
+		s.initialSyncDone = make(chan struct{})
+	}
+	close(s.initialSyncDone)
 }
 
 var _ Syncer = (*DefaultSyncer)(nil)
@@ -115,10 +225,8 @@ var _ ExtensibleSyncer = (*DefaultSyncer)(nil)
 // NewDefaultSyncer returns an instantiated DefaultSyncer
 func NewDefaultSyncer() *DefaultSyncer {
 	return &DefaultSyncer{
-		listeners:         make(map[event.Type][]EventHandler),
-		syncListeners:     []SyncHandler{},
-		globalListeners:   []EventHandler{},
-		ParseEventContent: true,
+		ParseEventContent:  true,
+		IgnoreEventsBefore: time.Now(),
 		ParseErrorHandler: func(evt *event.Event, err error) bool {
 			return false
 		},
@@ -133,16 +241,40 @@ func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) (err error)
 			err = fmt.Errorf("ProcessResponse panicked! since=%s panic=%s\n%s", since, r, debug.Stack())
 		}
 	}()
+	if since == "" {
+		defer s.finishInitialSync()
+	}
 
-	for _, listener := range s.syncListeners {
-		if !listener(res, since) {
+	s.handlerLock.RLock()
+	syncHandlers := s.syncHandlers
+	s.handlerLock.RUnlock()
+	for _, listener := range syncHandlers {
+		if !listener.handler(res, since) {
 			return
 		}
 	}
 
+	if s.IgnoreOldEvents {
+		s.dropOldTimelineEvents(res, since)
+	}
+
+	s.processSyncEvents("", res.ToDevice.Events, EventSourceToDevice)
 	s.processSyncEvents("", res.Presence.Events, EventSourcePresence)
 	s.processSyncEvents("", res.AccountData.Events, EventSourceAccountData)
 
+	workers := s.ConcurrentRoomWorkers
+	var progress *initialSyncProgressTracker
+	if since == "" {
+		if s.InitialSyncWorkers > 0 {
+			workers = s.InitialSyncWorkers
+		}
+		if s.OnInitialSyncProgress != nil {
+			progress = &initialSyncProgressTracker{callback: s.OnInitialSyncProgress}
+		}
+	}
+	if workers > 1 || progress != nil {
+		return s.processRoomsConcurrently(res, since, workers, progress)
+	}
 	for roomID, roomData := range res.Rooms.Join {
 		s.processSyncEvents(roomID, roomData.State.Events, EventSourceJoin|EventSourceState)
 		s.processSyncEvents(roomID, roomData.Timeline.Events, EventSourceJoin|EventSourceTimeline)
@@ -152,6 +284,9 @@ func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) (err error)
 	for roomID, roomData := range res.Rooms.Invite {
 		s.processSyncEvents(roomID, roomData.State.Events, EventSourceInvite|EventSourceState)
 	}
+	for roomID, roomData := range res.Rooms.Knock {
+		s.processSyncEvents(roomID, roomData.State.Events, EventSourceKnock|EventSourceState)
+	}
 	for roomID, roomData := range res.Rooms.Leave {
 		s.processSyncEvents(roomID, roomData.State.Events, EventSourceLeave|EventSourceState)
 		s.processSyncEvents(roomID, roomData.Timeline.Events, EventSourceLeave|EventSourceTimeline)
@@ -159,6 +294,109 @@ func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) (err error)
 	return
 }
 
+// dropOldTimelineEvents removes the message events that should be ignored from the room timelines of the response.
+func (s *DefaultSyncer) dropOldTimelineEvents(res *RespSync, since string) {
+	threshold := s.IgnoreEventsBefore.UnixNano() / int64(time.Millisecond)
+	filter := func(evts []*event.Event) []*event.Event {
+		filtered := evts[:0]
+		for _, evt := range evts {
+			// In the initial sync, all timeline message events are old regardless of the timestamp
+			if evt.StateKey != nil || (since != "" && evt.Timestamp >= threshold) {
+				filtered = append(filtered, evt)
+			}
+		}
+		return filtered
+	}
+	for roomID, roomData := range res.Rooms.Join {
+		roomData.Timeline.Events = filter(roomData.Timeline.Events)
+		res.Rooms.Join[roomID] = roomData
+	}
+	for roomID, roomData := range res.Rooms.Leave {
+		roomData.Timeline.Events = filter(roomData.Timeline.Events)
+		res.Rooms.Leave[roomID] = roomData
+	}
+}
+
+// processRoom handles all events of a single room in the sync response.
+func (s *DefaultSyncer) processRoom(res *RespSync, roomID id.RoomID) {
+	if roomData, ok := res.Rooms.Join[roomID]; ok {
+		s.processSyncEvents(roomID, roomData.State.Events, EventSourceJoin|EventSourceState)
+		s.processSyncEvents(roomID, roomData.Timeline.Events, EventSourceJoin|EventSourceTimeline)
+		s.processSyncEvents(roomID, roomData.Ephemeral.Events, EventSourceJoin|EventSourceEphemeral)
+		s.processSyncEvents(roomID, roomData.AccountData.Events, EventSourceJoin|EventSourceAccountData)
+	}
+	if roomData, ok := res.Rooms.Invite[roomID]; ok {
+		s.processSyncEvents(roomID, roomData.State.Events, EventSourceInvite|EventSourceState)
+	}
+	if roomData, ok := res.Rooms.Knock[roomID]; ok {
+		s.processSyncEvents(roomID, roomData.State.Events, EventSourceKnock|EventSourceState)
+	}
+	if roomData, ok := res.Rooms.Leave[roomID]; ok {
+		s.processSyncEvents(roomID, roomData.State.Events, EventSourceLeave|EventSourceState)
+		s.processSyncEvents(roomID, roomData.Timeline.Events, EventSourceLeave|EventSourceTimeline)
+	}
+}
+
+// processRoomsConcurrently handles the rooms in the sync response on the given number of goroutines and waits
+// for all of them to finish. A panic in a handler is returned as an error after the other rooms have been handled.
+func (s *DefaultSyncer) processRoomsConcurrently(res *RespSync, since string, workers int, progress *initialSyncProgressTracker) error {
+	roomIDs := make(map[id.RoomID]struct{}, len(res.Rooms.Join))
+	for roomID := range res.Rooms.Join {
+		roomIDs[roomID] = struct{}{}
+	}
+	for roomID := range res.Rooms.Invite {
+		roomIDs[roomID] = struct{}{}
+	}
+	for roomID := range res.Rooms.Knock {
+		roomIDs[roomID] = struct{}{}
+	}
+	for roomID := range res.Rooms.Leave {
+		roomIDs[roomID] = struct{}{}
+	}
+	if len(roomIDs) < workers {
+		workers = len(roomIDs)
+	} else if workers < 1 {
+		workers = 1
+	}
+	if progress != nil {
+		progress.progress.TotalRooms = len(roomIDs)
+		progress.callback(progress.progress)
+	}
+
+	queue := make(chan id.RoomID)
+	var wg sync.WaitGroup
+	var panicErr error
+	var panicOnce sync.Once
+	processRoom := func(roomID id.RoomID) {
+		defer func() {
+			if r := recover(); r != nil {
+				panicOnce.Do(func() {
+					panicErr = fmt.Errorf("ProcessResponse panicked in %s! since=%s panic=%s\n%s", roomID, since, r, debug.Stack())
+				})
+			}
+			if progress != nil {
+				progress.roomDone(countStateEvents(res, roomID))
+			}
+		}()
+		s.processRoom(res, roomID)
+	}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for roomID := range queue {
+				processRoom(roomID)
+			}
+		}()
+	}
+	for roomID := range roomIDs {
+		queue <- roomID
+	}
+	close(queue)
+	wg.Wait()
+	return panicErr
+}
+
 func (s *DefaultSyncer) processSyncEvents(roomID id.RoomID, events []*event.Event, source EventSource) {
 	for _, evt := range events {
 		s.processSyncEvent(roomID, evt, source)
@@ -185,7 +423,8 @@ func (s *DefaultSyncer) processSyncEvent(roomID id.RoomID, evt *event.Event, sou
 
 	if s.ParseEventContent {
 		err := evt.Content.ParseRaw(evt.Type)
-		if err != nil && !s.ParseErrorHandler(evt, err) {
+		// Sync handlers like the crypto machine may have already parsed the content
+		if err != nil && !errors.Is(err, event.ContentAlreadyParsed) && !s.ParseErrorHandler(evt, err) {
 			return
 		}
 	}
@@ -194,33 +433,127 @@ func (s *DefaultSyncer) processSyncEvent(roomID id.RoomID, evt *event.Event, sou
 }
 
 func (s *DefaultSyncer) notifyListeners(source EventSource, evt *event.Event) {
-	for _, fn := range s.globalListeners {
-		fn(source, evt)
+	s.handlerLock.RLock()
+	handlers := s.eventHandlers
+	s.handlerLock.RUnlock()
+	for _, handler := range handlers {
+		if handler.matches(source, evt.Type) && handler.handler(source, evt) {
+			return
+		}
+	}
+}
+
+// Suggested priorities for event and sync handlers. Handlers with a higher priority are called first.
+const (
+	// PriorityCrypto is for handlers that other handlers depend on, like the crypto machine, which must see to-device
+	// events and device list changes before encrypted room events are handled.
+	PriorityCrypto = 1000
+	// PriorityStateStore is for handlers that cache room state, so that normal handlers see up-to-date state.
+	PriorityStateStore = 500
+	// PriorityDefault is the priority of handlers registered with OnEvent, OnEventType and OnSync.
+	PriorityDefault = 0
+)
+
+// PriorityEventHandler handles a single event from a sync response. If it returns true, the event is consumed and
+// won't be passed to any lower priority handlers.
+type PriorityEventHandler func(source EventSource, evt *event.Event) (consumed bool)
+
+// HandlerOptions specifies which events a handler registered with OnEventWithOptions receives.
+type HandlerOptions struct {
+	// Priority determines the order handlers are called in, higher priorities first.
+	Priority int
+	// Sources limits the handler to events whose source contains any of the bits, e.g. EventSourceToDevice,
+	// EventSourceEphemeral or EventSourceJoin|EventSourceInvite. Zero means events from all sources.
+	Sources EventSource
+	// Types limits the handler to the given event types. Empty means events of all types.
+	Types []event.Type
+}
+
+type registeredEventHandler struct {
+	HandlerOptions
+	handler PriorityEventHandler
+	order   int
+}
+
+func (reh *registeredEventHandler) matches(source EventSource, evtType event.Type) bool {
+	if reh.Sources != 0 && reh.Sources&source == 0 {
+		return false
+	} else if len(reh.Types) == 0 {
+		return true
 	}
-	listeners, exists := s.listeners[evt.Type]
-	if exists {
-		for _, fn := range listeners {
-			fn(source, evt)
+	for _, allowedType := range reh.Types {
+		if allowedType == evtType {
+			return true
 		}
 	}
+	return false
+}
+
+type registeredSyncHandler struct {
+	priority int
+	handler  SyncHandler
+	order    int
+}
+
+// OnEventWithOptions registers an event handler with a priority and filters. Handlers are called in order of
+// priority, and handlers with the same priority are called in the order they were registered, except that handlers
+// without type filters are called before ones with type filters (like OnEvent and OnEventType have always worked).
+func (s *DefaultSyncer) OnEventWithOptions(opts HandlerOptions, handler PriorityEventHandler) {
+	s.handlerLock.Lock()
+	defer s.handlerLock.Unlock()
+	s.handlerCount++
+	// Copy on write, so that events being dispatched don't see a half-updated list
+	handlers := make([]*registeredEventHandler, len(s.eventHandlers), len(s.eventHandlers)+1)
+	copy(handlers, s.eventHandlers)
+	handlers = append(handlers, &registeredEventHandler{HandlerOptions: opts, handler: handler, order: s.handlerCount})
+	sort.SliceStable(handlers, func(i, j int) bool {
+		a, b := handlers[i], handlers[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		} else if (len(a.Types) == 0) != (len(b.Types) == 0) {
+			return len(a.Types) == 0
+		}
+		return a.order < b.order
+	})
+	s.eventHandlers = handlers
 }
 
 // OnEventType allows callers to be notified when there are new events for the given event type.
 // There are no duplicate checks.
 func (s *DefaultSyncer) OnEventType(eventType event.Type, callback EventHandler) {
-	_, exists := s.listeners[eventType]
-	if !exists {
-		s.listeners[eventType] = []EventHandler{}
-	}
-	s.listeners[eventType] = append(s.listeners[eventType], callback)
+	s.OnEventWithOptions(HandlerOptions{Types: []event.Type{eventType}}, func(source EventSource, evt *event.Event) bool {
+		callback(source, evt)
+		return false
+	})
+}
+
+// OnSyncWithPriority registers a handler for whole sync responses. Sync handlers are called in order of priority
+// before any event handlers. If a sync handler returns false, the rest of the response isn't handled at all.
+func (s *DefaultSyncer) OnSyncWithPriority(priority int, callback SyncHandler) {
+	s.handlerLock.Lock()
+	defer s.handlerLock.Unlock()
+	s.handlerCount++
+	handlers := make([]*registeredSyncHandler, len(s.syncHandlers), len(s.syncHandlers)+1)
+	copy(handlers, s.syncHandlers)
+	handlers = append(handlers, &registeredSyncHandler{priority: priority, handler: callback, order: s.handlerCount})
+	sort.SliceStable(handlers, func(i, j int) bool {
+		if handlers[i].priority != handlers[j].priority {
+			return handlers[i].priority > handlers[j].priority
+		}
+		return handlers[i].order < handlers[j].order
+	})
+	s.syncHandlers = handlers
 }
 
 func (s *DefaultSyncer) OnSync(callback SyncHandler) {
-	s.syncListeners = append(s.syncListeners, callback)
+	s.OnSyncWithPriority(PriorityDefault, callback)
 }
 
 func (s *DefaultSyncer) OnEvent(callback EventHandler) {
-	s.globalListeners = append(s.globalListeners, callback)
+	s.OnEventWithOptions(HandlerOptions{}, func(source EventSource, evt *event.Event) bool {
+		callback(source, evt)
+		return false
+	})
 }
 
 // OnFailedSync always returns a 10 second wait period between failed /syncs, never a fatal error.
@@ -241,6 +574,8 @@ func (s *DefaultSyncer) GetFilterJSON(userID id.UserID) *Filter {
 
 // OldEventIgnorer is an utility struct for bots to ignore events from before the bot joined the room.
 // Create a struct and call Register with your DefaultSyncer to register the sync handler.
+//
+// DefaultSyncer.IgnoreOldEvents is a simpler alternative that ignores old messages based on their timestamps.
 type OldEventIgnorer struct {
 	UserID id.UserID
 }
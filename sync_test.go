@@ -0,0 +1,431 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// newTestSyncResponse returns a sync response with the given number of joined rooms, each of which has the given
+// number of timeline messages with the event IDs $<room number>-<message number>.
+func newTestSyncResponse(t *testing.T, rooms, messages int) *mautrix.RespSync {
+	joined := make([]string, rooms)
+	for i := range joined {
+		evts := make([]string, messages)
+		for j := range evts {
+			evts[j] = fmt.Sprintf(`{"type": "m.room.message", "event_id": "$%d-%d", "content": {"msgtype": "m.text", "body": "hi"}}`, i, j)
+		}
+		joined[i] = fmt.Sprintf(`"!room%d:example.com": {"timeline": {"events": [%s]}}`, i, strings.Join(evts, ","))
+	}
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(`{"next_batch": "1", "rooms": {"join": {`+strings.Join(joined, ",")+`}}}`), &resp))
+	return &resp
+}
+
+// roomEventRecorder records the IDs of handled events per room.
+type roomEventRecorder struct {
+	lock   sync.Mutex
+	events map[id.RoomID][]id.EventID
+}
+
+func (rec *roomEventRecorder) record(roomID id.RoomID, eventID id.EventID) {
+	rec.lock.Lock()
+	if rec.events == nil {
+		rec.events = make(map[id.RoomID][]id.EventID)
+	}
+	rec.events[roomID] = append(rec.events[roomID], eventID)
+	rec.lock.Unlock()
+}
+
+func (rec *roomEventRecorder) assertInOrder(t *testing.T, rooms, messages int) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	require.Len(t, rec.events, rooms)
+	for i := 0; i < rooms; i++ {
+		expected := make([]id.EventID, messages)
+		for j := range expected {
+			expected[j] = id.EventID(fmt.Sprintf("$%d-%d", i, j))
+		}
+		assert.Equal(t, expected, rec.events[id.RoomID(fmt.Sprintf("!room%d:example.com", i))])
+	}
+}
+
+func TestDefaultSyncer_ConcurrentRoomWorkers(t *testing.T) {
+	const rooms, messages, workers = 8, 20, 4
+	syncer := mautrix.NewDefaultSyncer()
+	syncer.ConcurrentRoomWorkers = workers
+
+	var rec roomEventRecorder
+	var inFlight, maxInFlight int32
+	// The first event of the first rooms waits until all workers are busy, so the test only passes if
+	// rooms are really handled in parallel.
+	var started int32
+	allStarted := make(chan struct{})
+	var timedOut int32
+	syncer.OnEventType(event.EventMessage, func(source mautrix.EventSource, evt *event.Event) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			prev := atomic.LoadInt32(&maxInFlight)
+			if current <= prev || atomic.CompareAndSwapInt32(&maxInFlight, prev, current) {
+				break
+			}
+		}
+		if strings.HasSuffix(evt.ID.String(), "-0") {
+			if count := atomic.AddInt32(&started, 1); count == workers {
+				close(allStarted)
+			} else if count < workers {
+				select {
+				case <-allStarted:
+				case <-time.After(5 * time.Second):
+					atomic.StoreInt32(&timedOut, 1)
+				}
+			}
+		}
+		rec.record(evt.RoomID, evt.ID)
+	})
+
+	require.NoError(t, syncer.ProcessResponse(newTestSyncResponse(t, rooms, messages), "s1"))
+	assert.Zero(t, atomic.LoadInt32(&timedOut), "rooms weren't handled in parallel")
+	assert.EqualValues(t, workers, atomic.LoadInt32(&maxInFlight))
+	// Events in the same room are still handled in order
+	rec.assertInOrder(t, rooms, messages)
+}
+
+func TestDefaultSyncer_SerialByDefault(t *testing.T) {
+	syncer := mautrix.NewDefaultSyncer()
+	var rec roomEventRecorder
+	var inFlight, maxInFlight int32
+	syncer.OnEvent(func(source mautrix.EventSource, evt *event.Event) {
+		if current := atomic.AddInt32(&inFlight, 1); current > atomic.LoadInt32(&maxInFlight) {
+			atomic.StoreInt32(&maxInFlight, current)
+		}
+		rec.record(evt.RoomID, evt.ID)
+		atomic.AddInt32(&inFlight, -1)
+	})
+	require.NoError(t, syncer.ProcessResponse(newTestSyncResponse(t, 4, 5), "s1"))
+	assert.EqualValues(t, 1, maxInFlight)
+	rec.assertInOrder(t, 4, 5)
+}
+
+func TestDefaultSyncer_ConcurrentRoomWorkers_Panic(t *testing.T) {
+	syncer := mautrix.NewDefaultSyncer()
+	syncer.ConcurrentRoomWorkers = 4
+	var rec roomEventRecorder
+	syncer.OnEvent(func(source mautrix.EventSource, evt *event.Event) {
+		if evt.RoomID == "!room2:example.com" {
+			panic("oh no")
+		}
+		rec.record(evt.RoomID, evt.ID)
+	})
+
+	err := syncer.ProcessResponse(newTestSyncResponse(t, 6, 3), "s1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "!room2:example.com")
+	assert.Contains(t, err.Error(), "oh no")
+	// The other rooms are still handled completely
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	assert.Len(t, rec.events, 5)
+	assert.NotContains(t, rec.events, id.RoomID("!room2:example.com"))
+	assert.Len(t, rec.events["!room5:example.com"], 3)
+}
+
+func TestDefaultSyncer_HandlerPriority(t *testing.T) {
+	syncer := mautrix.NewDefaultSyncer()
+	var calls []string
+	record := func(name string) mautrix.EventHandler {
+		return func(source mautrix.EventSource, evt *event.Event) {
+			calls = append(calls, name)
+		}
+	}
+	syncer.OnEventType(event.EventMessage, record("type"))
+	syncer.OnEvent(record("event"))
+	syncer.OnEventWithOptions(mautrix.HandlerOptions{Priority: mautrix.PriorityStateStore}, func(source mautrix.EventSource, evt *event.Event) bool {
+		calls = append(calls, "state store")
+		return false
+	})
+	syncer.OnEventWithOptions(mautrix.HandlerOptions{Priority: mautrix.PriorityCrypto}, func(source mautrix.EventSource, evt *event.Event) bool {
+		calls = append(calls, "crypto")
+		return false
+	})
+	syncer.OnEvent(record("event 2"))
+	syncer.OnEventWithOptions(mautrix.HandlerOptions{Priority: -1}, func(source mautrix.EventSource, evt *event.Event) bool {
+		calls = append(calls, "low")
+		return false
+	})
+
+	require.NoError(t, syncer.ProcessResponse(newTestSyncResponse(t, 1, 1), "s1"))
+	// Handlers without type filters are called before ones with type filters of the same priority
+	assert.Equal(t, []string{"crypto", "state store", "event", "event 2", "type", "low"}, calls)
+}
+
+func TestDefaultSyncer_HandlerConsume(t *testing.T) {
+	syncer := mautrix.NewDefaultSyncer()
+	var calls []id.EventID
+	syncer.OnEventWithOptions(mautrix.HandlerOptions{Priority: 10}, func(source mautrix.EventSource, evt *event.Event) bool {
+		// Consume every other event
+		return strings.HasSuffix(evt.ID.String(), "-1")
+	})
+	syncer.OnEvent(func(source mautrix.EventSource, evt *event.Event) {
+		calls = append(calls, evt.ID)
+	})
+
+	require.NoError(t, syncer.ProcessResponse(newTestSyncResponse(t, 1, 3), "s1"))
+	assert.Equal(t, []id.EventID{"$0-0", "$0-2"}, calls)
+}
+
+func TestDefaultSyncer_HandlerFilters(t *testing.T) {
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"next_batch": "1",
+		"to_device": {"events": [{"type": "m.room_key_request", "sender": "@user:example.com", "content": {}}]},
+		"presence": {"events": [{"type": "m.presence", "sender": "@user:example.com", "content": {"presence": "online"}}]},
+		"rooms": {"join": {"!room:example.com": {
+			"state": {"events": [{"type": "m.room.name", "state_key": "", "event_id": "$name", "content": {"name": "Room"}}]},
+			"timeline": {"events": [{"type": "m.room.message", "event_id": "$msg", "content": {"msgtype": "m.text", "body": "hi"}}]},
+			"ephemeral": {"events": [{"type": "m.typing", "content": {"user_ids": []}}]}
+		}}}
+	}`), &resp))
+
+	syncer := mautrix.NewDefaultSyncer()
+	var toDevice, ephemeral, joinedNames []event.Type
+	syncer.OnEventWithOptions(mautrix.HandlerOptions{Sources: mautrix.EventSourceToDevice}, func(source mautrix.EventSource, evt *event.Event) bool {
+		toDevice = append(toDevice, evt.Type)
+		return false
+	})
+	syncer.OnEventWithOptions(mautrix.HandlerOptions{Sources: mautrix.EventSourcePresence | mautrix.EventSourceEphemeral}, func(source mautrix.EventSource, evt *event.Event) bool {
+		ephemeral = append(ephemeral, evt.Type)
+		return false
+	})
+	syncer.OnEventWithOptions(mautrix.HandlerOptions{
+		Sources: mautrix.EventSourceJoin,
+		Types:   []event.Type{event.StateRoomName, event.EventMessage},
+	}, func(source mautrix.EventSource, evt *event.Event) bool {
+		joinedNames = append(joinedNames, evt.Type)
+		return false
+	})
+
+	require.NoError(t, syncer.ProcessResponse(&resp, "s1"))
+	assert.Equal(t, []event.Type{event.ToDeviceRoomKeyRequest}, toDevice)
+	assert.Equal(t, []event.Type{event.EphemeralEventPresence, event.EphemeralEventTyping}, ephemeral)
+	assert.Equal(t, []event.Type{event.StateRoomName, event.EventMessage}, joinedNames)
+}
+
+func TestDefaultSyncer_SyncHandlerPriority(t *testing.T) {
+	syncer := mautrix.NewDefaultSyncer()
+	var calls []string
+	syncer.OnSync(func(resp *mautrix.RespSync, since string) bool {
+		calls = append(calls, "default")
+		return true
+	})
+	syncer.OnSyncWithPriority(mautrix.PriorityCrypto, func(resp *mautrix.RespSync, since string) bool {
+		calls = append(calls, "crypto")
+		return true
+	})
+	stop := false
+	syncer.OnSyncWithPriority(mautrix.PriorityStateStore, func(resp *mautrix.RespSync, since string) bool {
+		calls = append(calls, "state store")
+		return !stop
+	})
+	syncer.OnEvent(func(source mautrix.EventSource, evt *event.Event) {
+		calls = append(calls, "event")
+	})
+
+	require.NoError(t, syncer.ProcessResponse(newTestSyncResponse(t, 1, 1), "s1"))
+	assert.Equal(t, []string{"crypto", "state store", "default", "event"}, calls)
+
+	// Sync handlers returning false stop handling the response completely
+	calls = nil
+	stop = true
+	require.NoError(t, syncer.ProcessResponse(newTestSyncResponse(t, 1, 1), "s1"))
+	assert.Equal(t, []string{"crypto", "state store"}, calls)
+}
+
+func TestDefaultSyncer_RegisterDuringDispatch(t *testing.T) {
+	syncer := mautrix.NewDefaultSyncer()
+	var calls []id.EventID
+	syncer.OnEvent(func(source mautrix.EventSource, evt *event.Event) {
+		calls = append(calls, evt.ID)
+		if evt.ID == "$0-0" {
+			// Handlers registered while dispatching only receive later events
+			syncer.OnEventWithOptions(mautrix.HandlerOptions{Priority: 1}, func(source mautrix.EventSource, evt *event.Event) bool {
+				calls = append(calls, "new "+evt.ID)
+				return false
+			})
+		}
+	})
+
+	require.NoError(t, syncer.ProcessResponse(newTestSyncResponse(t, 1, 2), "s1"))
+	assert.Equal(t, []id.EventID{"$0-0", "new $0-1", "$0-1"}, calls)
+}
+
+// newTestInitialSyncResponse returns a sync response with the given number of joined rooms, each of which has two
+// state events in the state section and one state event and one message in the timeline.
+func newTestInitialSyncResponse(t *testing.T, rooms int) *mautrix.RespSync {
+	joined := make([]string, rooms)
+	for i := range joined {
+		joined[i] = fmt.Sprintf(`"!room%d:example.com": {
+			"state": {"events": [
+				{"type": "m.room.create", "state_key": "", "event_id": "$%[1]d-create", "content": {}},
+				{"type": "m.room.member", "state_key": "@user:example.com", "event_id": "$%[1]d-member", "content": {"membership": "join"}}
+			]},
+			"timeline": {"events": [
+				{"type": "m.room.name", "state_key": "", "event_id": "$%[1]d-name", "origin_server_ts": 1, "content": {"name": "Room"}},
+				{"type": "m.room.message", "event_id": "$%[1]d-msg", "origin_server_ts": 1, "content": {"msgtype": "m.text", "body": "hi"}}
+			]}
+		}`, i)
+	}
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(`{"next_batch": "1", "rooms": {
+		"join": {`+strings.Join(joined, ",")+`},
+		"invite": {"!invite:example.com": {"invite_state": {"events": [
+			{"type": "m.room.member", "state_key": "@user:example.com", "content": {"membership": "invite"}}
+		]}}}
+	}}`), &resp))
+	return &resp
+}
+
+func TestDefaultSyncer_InitialSyncProgress(t *testing.T) {
+	const rooms, workers = 8, 4
+	syncer := mautrix.NewDefaultSyncer()
+	syncer.InitialSyncWorkers = workers
+	done := syncer.InitialSyncDone()
+
+	var roomsHandled int32
+	var doneEarly int32
+	syncer.OnEventType(event.EventMessage, func(source mautrix.EventSource, evt *event.Event) {
+		select {
+		case <-done:
+			atomic.StoreInt32(&doneEarly, 1)
+		default:
+		}
+		// Make the workers overlap so that the progress callback would be called concurrently if it wasn't serialised
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&roomsHandled, 1)
+	})
+	var inCallback, concurrentCallbacks int32
+	var progress []mautrix.InitialSyncProgress
+	syncer.OnInitialSyncProgress = func(p mautrix.InitialSyncProgress) {
+		if !atomic.CompareAndSwapInt32(&inCallback, 0, 1) {
+			atomic.StoreInt32(&concurrentCallbacks, 1)
+			return
+		}
+		progress = append(progress, p)
+		time.Sleep(time.Millisecond)
+		atomic.StoreInt32(&inCallback, 0)
+	}
+
+	require.NoError(t, syncer.ProcessResponse(newTestInitialSyncResponse(t, rooms), ""))
+	select {
+	case <-done:
+	default:
+		t.Fatal("InitialSyncDone wasn't closed after the initial sync")
+	}
+	assert.Zero(t, atomic.LoadInt32(&doneEarly), "InitialSyncDone was closed before all rooms were handled")
+	assert.EqualValues(t, rooms, atomic.LoadInt32(&roomsHandled))
+	assert.Zero(t, atomic.LoadInt32(&concurrentCallbacks), "progress callback was called concurrently")
+
+	// The invite room is counted too
+	const totalRooms = rooms + 1
+	require.Len(t, progress, totalRooms+1)
+	assert.Equal(t, mautrix.InitialSyncProgress{TotalRooms: totalRooms}, progress[0])
+	for i := 1; i < len(progress); i++ {
+		assert.Equal(t, i, progress[i].RoomsProcessed)
+		assert.Equal(t, totalRooms, progress[i].TotalRooms)
+		assert.GreaterOrEqual(t, progress[i].StateEventsApplied, progress[i-1].StateEventsApplied)
+	}
+	assert.Equal(t, mautrix.InitialSyncProgress{
+		RoomsProcessed:     totalRooms,
+		TotalRooms:         totalRooms,
+		StateEventsApplied: rooms*3 + 1,
+	}, progress[totalRooms])
+
+	// Later syncs don't report progress
+	require.NoError(t, syncer.ProcessResponse(newTestInitialSyncResponse(t, rooms), "1"))
+	assert.Len(t, progress, totalRooms+1)
+}
+
+func TestDefaultSyncer_IgnoreOldEvents_InitialSync(t *testing.T) {
+	const rooms = 3
+	syncer := mautrix.NewDefaultSyncer()
+	syncer.IgnoreOldEvents = true
+	syncer.IgnoreEventsBefore = time.Unix(0, 0)
+
+	var syncHandlerMessages int
+	syncer.OnSync(func(resp *mautrix.RespSync, since string) bool {
+		for _, roomData := range resp.Rooms.Join {
+			for _, evt := range roomData.Timeline.Events {
+				if evt.StateKey == nil {
+					syncHandlerMessages++
+				}
+			}
+		}
+		return true
+	})
+	var messages, stateEvents []id.EventID
+	syncer.OnEvent(func(source mautrix.EventSource, evt *event.Event) {
+		if evt.StateKey != nil {
+			stateEvents = append(stateEvents, evt.ID)
+		} else {
+			messages = append(messages, evt.ID)
+		}
+	})
+
+	// Initial sync messages are dropped even if they're newer than IgnoreEventsBefore
+	require.NoError(t, syncer.ProcessResponse(newTestInitialSyncResponse(t, rooms), ""))
+	assert.Equal(t, rooms, syncHandlerMessages)
+	assert.Empty(t, messages)
+	// create, member and the name event in the timeline of each room, plus the invite
+	assert.Len(t, stateEvents, rooms*3+1)
+	assert.Contains(t, stateEvents, id.EventID("$0-name"))
+}
+
+func TestDefaultSyncer_IgnoreOldEvents_Threshold(t *testing.T) {
+	syncer := mautrix.NewDefaultSyncer()
+	syncer.IgnoreOldEvents = true
+	syncer.IgnoreEventsBefore = time.Unix(1000, 0)
+	var handled []id.EventID
+	syncer.OnEvent(func(source mautrix.EventSource, evt *event.Event) {
+		handled = append(handled, evt.ID)
+	})
+
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(`{"next_batch": "3", "rooms": {
+		"join": {"!room:example.com": {"timeline": {"events": [
+			{"type": "m.room.message", "event_id": "$old", "origin_server_ts": 999999, "content": {"msgtype": "m.text", "body": "hi"}},
+			{"type": "m.room.name", "state_key": "", "event_id": "$oldstate", "origin_server_ts": 1, "content": {"name": "Room"}},
+			{"type": "m.room.message", "event_id": "$new", "origin_server_ts": 1000000, "content": {"msgtype": "m.text", "body": "hi"}}
+		]}}},
+		"leave": {"!left:example.com": {"timeline": {"events": [
+			{"type": "m.room.message", "event_id": "$leftold", "origin_server_ts": 5, "content": {"msgtype": "m.text", "body": "hi"}},
+			{"type": "m.room.message", "event_id": "$leftnew", "origin_server_ts": 1000001, "content": {"msgtype": "m.text", "body": "hi"}}
+		]}}}
+	}}`), &resp))
+	require.NoError(t, syncer.ProcessResponse(&resp, "2"))
+	assert.ElementsMatch(t, []id.EventID{"$oldstate", "$new", "$leftnew"}, handled)
+}
+
+func TestNewDefaultSyncer_IgnoreEventsBefore(t *testing.T) {
+	before := time.Now()
+	syncer := mautrix.NewDefaultSyncer()
+	assert.False(t, syncer.IgnoreEventsBefore.Before(before))
+	assert.False(t, syncer.IgnoreEventsBefore.After(time.Now()))
+}
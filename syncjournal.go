@@ -0,0 +1,327 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// The room categories of SyncJournalEntry, matching the keys in the rooms object of /sync responses.
+const (
+	SyncJournalJoin   = "join"
+	SyncJournalInvite = "invite"
+	SyncJournalKnock  = "knock"
+	SyncJournalLeave  = "leave"
+)
+
+// SyncJournalEntry is the raw data of a single room in a sync response.
+type SyncJournalEntry struct {
+	// The ID of the entry, assigned by the journal. IDs are increasing in the order the entries were appended.
+	ID       int64
+	RoomID   id.RoomID
+	Category string
+	// The since token of the sync request and the next_batch token of the response the room was in.
+	Since     string
+	NextBatch string
+	Data      json.RawMessage
+}
+
+// SyncJournal persists the rooms of sync responses before they're processed, so that rooms which weren't processed
+// because of a crash can be replayed after a restart. If Client.SyncJournal is set, Sync appends all rooms of each
+// response to the journal before saving the next_batch token and marks them as processed after the Syncer has
+// handled the response successfully, which gives at-least-once processing for room events.
+//
+// Only room data is journaled, top-level data like to-device events isn't.
+type SyncJournal interface {
+	// AppendEntries stores the given entries and sets their IDs.
+	AppendEntries(userID id.UserID, entries []*SyncJournalEntry) error
+	// MarkProcessed removes the entries with the given IDs from the journal.
+	MarkProcessed(userID id.UserID, entryIDs []int64) error
+	// LoadUnprocessed returns all entries that haven't been marked as processed, ordered by ID.
+	LoadUnprocessed(userID id.UserID) ([]*SyncJournalEntry, error)
+}
+
+// MemorySyncJournal is a SyncJournal that keeps entries in memory. It doesn't survive restarts, so it's mostly
+// useful for testing.
+type MemorySyncJournal struct {
+	entries map[id.UserID][]*SyncJournalEntry
+	nextID  int64
+	lock    sync.Mutex
+}
+
+// NewMemorySyncJournal creates an empty in-memory sync journal.
+func NewMemorySyncJournal() *MemorySyncJournal {
+	return &MemorySyncJournal{entries: make(map[id.UserID][]*SyncJournalEntry)}
+}
+
+func (journal *MemorySyncJournal) AppendEntries(userID id.UserID, entries []*SyncJournalEntry) error {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	for _, entry := range entries {
+		journal.nextID++
+		entry.ID = journal.nextID
+		entryCopy := *entry
+		journal.entries[userID] = append(journal.entries[userID], &entryCopy)
+	}
+	return nil
+}
+
+func (journal *MemorySyncJournal) MarkProcessed(userID id.UserID, entryIDs []int64) error {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	processed := make(map[int64]struct{}, len(entryIDs))
+	for _, entryID := range entryIDs {
+		processed[entryID] = struct{}{}
+	}
+	remaining := journal.entries[userID][:0]
+	for _, entry := range journal.entries[userID] {
+		if _, ok := processed[entry.ID]; !ok {
+			remaining = append(remaining, entry)
+		}
+	}
+	journal.entries[userID] = remaining
+	return nil
+}
+
+func (journal *MemorySyncJournal) LoadUnprocessed(userID id.UserID) ([]*SyncJournalEntry, error) {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	entries := make([]*SyncJournalEntry, len(journal.entries[userID]))
+	for i, entry := range journal.entries[userID] {
+		entryCopy := *entry
+		entries[i] = &entryCopy
+	}
+	return entries, nil
+}
+
+// SQLSyncJournal is a SyncJournal that uses a SQLite or Postgres database. Call CreateTable before using it.
+type SQLSyncJournal struct {
+	DB *sql.DB
+}
+
+// NewSQLSyncJournal creates a sync journal that uses the given database.
+func NewSQLSyncJournal(db *sql.DB) *SQLSyncJournal {
+	return &SQLSyncJournal{DB: db}
+}
+
+// CreateTable creates the mx_sync_journal table if it doesn't exist yet.
+func (journal *SQLSyncJournal) CreateTable() error {
+	_, err := journal.DB.Exec(`CREATE TABLE IF NOT EXISTS mx_sync_journal (
+		user_id    TEXT   NOT NULL,
+		id         BIGINT NOT NULL,
+		room_id    TEXT   NOT NULL,
+		category   TEXT   NOT NULL,
+		since      TEXT   NOT NULL,
+		next_batch TEXT   NOT NULL,
+		data       TEXT   NOT NULL,
+		PRIMARY KEY (user_id, id)
+	)`)
+	return err
+}
+
+func (journal *SQLSyncJournal) AppendEntries(userID id.UserID, entries []*SyncJournalEntry) error {
+	tx, err := journal.DB.Begin()
+	if err != nil {
+		return err
+	}
+	var lastID int64
+	err = tx.QueryRow("SELECT COALESCE(MAX(id), 0) FROM mx_sync_journal WHERE user_id=$1", userID).Scan(&lastID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for _, entry := range entries {
+		lastID++
+		_, err = tx.Exec(`
+			INSERT INTO mx_sync_journal (user_id, id, room_id, category, since, next_batch, data)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, userID, lastID, entry.RoomID, entry.Category, entry.Since, entry.NextBatch, string(entry.Data))
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		entry.ID = lastID
+	}
+	return tx.Commit()
+}
+
+func (journal *SQLSyncJournal) MarkProcessed(userID id.UserID, entryIDs []int64) error {
+	tx, err := journal.DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, entryID := range entryIDs {
+		_, err = tx.Exec("DELETE FROM mx_sync_journal WHERE user_id=$1 AND id=$2", userID, entryID)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (journal *SQLSyncJournal) LoadUnprocessed(userID id.UserID) ([]*SyncJournalEntry, error) {
+	rows, err := journal.DB.Query(`
+		SELECT id, room_id, category, since, next_batch, data FROM mx_sync_journal WHERE user_id=$1 ORDER BY id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []*SyncJournalEntry
+	for rows.Next() {
+		var entry SyncJournalEntry
+		var data string
+		err = rows.Scan(&entry.ID, &entry.RoomID, &entry.Category, &entry.Since, &entry.NextBatch, &data)
+		if err != nil {
+			return nil, err
+		}
+		entry.Data = json.RawMessage(data)
+		entries = append(entries, &entry)
+	}
+	return entries, rows.Err()
+}
+
+// journalSyncResponse appends the rooms of the given sync response to the SyncJournal and returns the entry IDs.
+func (cli *Client) journalSyncResponse(resp *RespSync, since string) ([]int64, error) {
+	var entries []*SyncJournalEntry
+	var categoryStart int
+	add := func(category string, roomID id.RoomID, room interface{}) error {
+		data, err := json.Marshal(room)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s: %w", roomID, err)
+		}
+		entries = append(entries, &SyncJournalEntry{
+			RoomID:    roomID,
+			Category:  category,
+			Since:     since,
+			NextBatch: resp.NextBatch,
+			Data:      data,
+		})
+		return nil
+	}
+	// Sort the rooms in each category so that the journal order is deterministic
+	endCategory := func() {
+		categoryEntries := entries[categoryStart:]
+		sort.Slice(categoryEntries, func(i, j int) bool {
+			return categoryEntries[i].RoomID < categoryEntries[j].RoomID
+		})
+		categoryStart = len(entries)
+	}
+	for roomID, room := range resp.Rooms.Join {
+		if err := add(SyncJournalJoin, roomID, room); err != nil {
+			return nil, err
+		}
+	}
+	endCategory()
+	for roomID, room := range resp.Rooms.Invite {
+		if err := add(SyncJournalInvite, roomID, room); err != nil {
+			return nil, err
+		}
+	}
+	endCategory()
+	for roomID, room := range resp.Rooms.Knock {
+		if err := add(SyncJournalKnock, roomID, room); err != nil {
+			return nil, err
+		}
+	}
+	endCategory()
+	for roomID, room := range resp.Rooms.Leave {
+		if err := add(SyncJournalLeave, roomID, room); err != nil {
+			return nil, err
+		}
+	}
+	endCategory()
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	if err := cli.SyncJournal.AppendEntries(cli.UserID, entries); err != nil {
+		return nil, err
+	}
+	entryIDs := make([]int64, len(entries))
+	for i, entry := range entries {
+		entryIDs[i] = entry.ID
+	}
+	return entryIDs, nil
+}
+
+// replaySyncJournal passes the unprocessed entries in the SyncJournal to the Syncer, grouped into the sync responses
+// they came from.
+func (cli *Client) replaySyncJournal() error {
+	entries, err := cli.SyncJournal.LoadUnprocessed(cli.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to load sync journal: %w", err)
+	}
+	for len(entries) > 0 {
+		var resp RespSync
+		resp.NextBatch = entries[0].NextBatch
+		since := entries[0].Since
+		var entryIDs []int64
+		for len(entries) > 0 && entries[0].NextBatch == resp.NextBatch && entries[0].Since == since {
+			entry := entries[0]
+			entries = entries[1:]
+			entryIDs = append(entryIDs, entry.ID)
+			if err = addJournalEntryToResponse(&resp, entry); err != nil {
+				return fmt.Errorf("failed to parse sync journal entry %d: %w", entry.ID, err)
+			}
+		}
+		cli.Logger.Debugfln("Replaying %d rooms from sync journal (since %s)", len(entryIDs), since)
+		if err = cli.Syncer.ProcessResponse(&resp, since); err != nil {
+			return err
+		}
+		if err = cli.SyncJournal.MarkProcessed(cli.UserID, entryIDs); err != nil {
+			return fmt.Errorf("failed to mark sync journal entries as processed: %w", err)
+		}
+	}
+	return nil
+}
+
+func addJournalEntryToResponse(resp *RespSync, entry *SyncJournalEntry) error {
+	switch entry.Category {
+	case SyncJournalJoin:
+		var room SyncJoinedRoom
+		if err := json.Unmarshal(entry.Data, &room); err != nil {
+			return err
+		} else if resp.Rooms.Join == nil {
+			resp.Rooms.Join = make(map[id.RoomID]SyncJoinedRoom)
+		}
+		resp.Rooms.Join[entry.RoomID] = room
+	case SyncJournalInvite:
+		var room SyncInvitedRoom
+		if err := json.Unmarshal(entry.Data, &room); err != nil {
+			return err
+		} else if resp.Rooms.Invite == nil {
+			resp.Rooms.Invite = make(map[id.RoomID]SyncInvitedRoom)
+		}
+		resp.Rooms.Invite[entry.RoomID] = room
+	case SyncJournalKnock:
+		var room SyncKnockedRoom
+		if err := json.Unmarshal(entry.Data, &room); err != nil {
+			return err
+		} else if resp.Rooms.Knock == nil {
+			resp.Rooms.Knock = make(map[id.RoomID]SyncKnockedRoom)
+		}
+		resp.Rooms.Knock[entry.RoomID] = room
+	case SyncJournalLeave:
+		var room SyncLeftRoom
+		if err := json.Unmarshal(entry.Data, &room); err != nil {
+			return err
+		} else if resp.Rooms.Leave == nil {
+			resp.Rooms.Leave = make(map[id.RoomID]SyncLeftRoom)
+		}
+		resp.Rooms.Leave[entry.RoomID] = room
+	default:
+		return fmt.Errorf("unknown room category %q", entry.Category)
+	}
+	return nil
+}
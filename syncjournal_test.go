@@ -0,0 +1,165 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var errSimulatedCrash = errors.New("simulated crash")
+
+// crashingSyncer fails to process responses while crash is true, like a consumer that crashes mid-response.
+type crashingSyncer struct {
+	*mautrix.DefaultSyncer
+	crash bool
+}
+
+func (s *crashingSyncer) ProcessResponse(resp *mautrix.RespSync, since string) error {
+	if s.crash {
+		return errSimulatedCrash
+	}
+	return s.DefaultSyncer.ProcessResponse(resp, since)
+}
+
+func newJournalTestServer(t *testing.T) (*httptest.Server, *[]string) {
+	var syncCount int32
+	var sinces []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/r0/sync" {
+			_, _ = w.Write([]byte(`{"filter_id": "1"}`))
+			return
+		}
+		sinces = append(sinces, r.URL.Query().Get("since"))
+		count := atomic.AddInt32(&syncCount, 1)
+		_, _ = fmt.Fprintf(w, `{
+			"next_batch": "s%[1]d",
+			"rooms": {
+				"join": {
+					"!b:example.com": {"timeline": {"events": [{"type": "m.room.message", "event_id": "$b%[1]d", "content": {"body": "hi"}}]}},
+					"!a:example.com": {"timeline": {"events": [{"type": "m.room.message", "event_id": "$a%[1]d", "content": {"body": "hi"}}]}}
+				},
+				"invite": {
+					"!c:example.com": {"invite_state": {"events": [{"type": "m.room.member", "state_key": "@user:example.com", "event_id": "$c%[1]d", "content": {"membership": "invite"}}]}}
+				}
+			}
+		}`, count)
+	}))
+	return server, &sinces
+}
+
+func testSyncJournalReplay(t *testing.T, journal mautrix.SyncJournal) {
+	server, sinces := newJournalTestServer(t)
+	defer server.Close()
+
+	store := mautrix.NewInMemoryStore()
+	delivered := make(map[id.EventID]int)
+	syncer := &crashingSyncer{DefaultSyncer: mautrix.NewDefaultSyncer(), crash: true}
+	syncer.OnEvent(func(source mautrix.EventSource, evt *event.Event) {
+		delivered[evt.ID]++
+	})
+
+	cli := mautrix.NewTestClient(t, server.URL)
+	cli.Store = store
+	cli.Syncer = syncer
+	cli.SyncJournal = journal
+	// The first response is saved in the journal, but processing it "crashes"
+	require.ErrorIs(t, cli.Sync(), errSimulatedCrash)
+	pending, err := journal.LoadUnprocessed(cli.UserID)
+	require.NoError(t, err)
+	require.Len(t, pending, 3)
+	assert.Equal(t, id.RoomID("!a:example.com"), pending[0].RoomID)
+	assert.Equal(t, mautrix.SyncJournalJoin, pending[0].Category)
+	assert.Equal(t, id.RoomID("!b:example.com"), pending[1].RoomID)
+	assert.Equal(t, id.RoomID("!c:example.com"), pending[2].RoomID)
+	assert.Equal(t, mautrix.SyncJournalInvite, pending[2].Category)
+	assert.Equal(t, "s1", pending[0].NextBatch)
+	assert.Empty(t, delivered)
+
+	// After a restart, the journaled rooms are replayed before syncing continues from the saved token
+	syncer.crash = false
+	syncer.OnSync(func(resp *mautrix.RespSync, since string) bool {
+		if resp.NextBatch == "s2" {
+			cli.StopSync()
+		}
+		return true
+	})
+	cli = mautrix.NewTestClient(t, server.URL)
+	cli.Store = store
+	cli.Syncer = syncer
+	cli.SyncJournal = journal
+	require.NoError(t, cli.Sync())
+	assert.Equal(t, map[id.EventID]int{
+		"$a1": 1, "$b1": 1, "$c1": 1,
+		"$a2": 1, "$b2": 1, "$c2": 1,
+	}, delivered)
+	assert.Equal(t, []string{"", "s1", "s2"}, *sinces)
+	pending, err = journal.LoadUnprocessed(cli.UserID)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	// Another restart doesn't replay anything
+	syncer.crash = true
+	require.ErrorIs(t, cli.Sync(), errSimulatedCrash)
+	assert.Equal(t, 1, delivered["$a1"])
+	assert.Equal(t, 1, delivered["$a2"])
+}
+
+func TestMemorySyncJournal_Replay(t *testing.T) {
+	testSyncJournalReplay(t, mautrix.NewMemorySyncJournal())
+}
+
+func TestSQLSyncJournal_Replay(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	journal := mautrix.NewSQLSyncJournal(db)
+	require.NoError(t, journal.CreateTable())
+	testSyncJournalReplay(t, journal)
+}
+
+func TestSQLSyncJournal_MarkProcessed(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	journal := mautrix.NewSQLSyncJournal(db)
+	require.NoError(t, journal.CreateTable())
+
+	entries := []*mautrix.SyncJournalEntry{
+		{RoomID: "!a:example.com", Category: mautrix.SyncJournalJoin, NextBatch: "s1", Data: []byte(`{}`)},
+		{RoomID: "!b:example.com", Category: mautrix.SyncJournalLeave, NextBatch: "s1", Data: []byte(`{}`)},
+	}
+	require.NoError(t, journal.AppendEntries("@user:example.com", entries))
+	assert.Equal(t, int64(1), entries[0].ID)
+	assert.Equal(t, int64(2), entries[1].ID)
+	other := []*mautrix.SyncJournalEntry{{RoomID: "!a:example.com", Category: mautrix.SyncJournalJoin, Data: []byte(`{}`)}}
+	require.NoError(t, journal.AppendEntries("@other:example.com", other))
+	assert.Equal(t, int64(1), other[0].ID)
+
+	require.NoError(t, journal.MarkProcessed("@user:example.com", []int64{1}))
+	pending, err := journal.LoadUnprocessed("@user:example.com")
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, id.RoomID("!b:example.com"), pending[0].RoomID)
+	assert.JSONEq(t, `{}`, string(pending[0].Data))
+	pending, err = journal.LoadUnprocessed("@other:example.com")
+	require.NoError(t, err)
+	assert.Len(t, pending, 1)
+}
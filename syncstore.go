@@ -0,0 +1,338 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// SyncStore persists the filter ID and next_batch token of the sync loop, so that syncing can be resumed from the
+// same point after a restart. If Client.SyncStore is set, it's used instead of the Store of the client.
+type SyncStore interface {
+	SaveFilterID(userID id.UserID, filterID string) error
+	LoadFilterID(userID id.UserID) (string, error)
+	// SaveNextBatch saves the next_batch token and the time when it was received.
+	SaveNextBatch(userID id.UserID, nextBatch string, savedAt time.Time) error
+	// LoadNextBatch loads the next_batch token. An empty token means that there's no saved token.
+	LoadNextBatch(userID id.UserID) (nextBatch string, savedAt time.Time, err error)
+}
+
+var _ SyncStore = (*MemorySyncStore)(nil)
+var _ SyncStore = (*FileSyncStore)(nil)
+var _ SyncStore = (*SQLSyncStore)(nil)
+var _ SyncStore = (*RedisSyncStore)(nil)
+
+// SyncState is the sync state of a single user in MemorySyncStore and FileSyncStore.
+type SyncState struct {
+	FilterID  string    `json:"filter_id,omitempty"`
+	NextBatch string    `json:"next_batch,omitempty"`
+	SavedAt   time.Time `json:"saved_at,omitempty"`
+}
+
+// MemorySyncStore is a SyncStore that keeps everything in memory, which means syncing isn't resumed after restarts.
+type MemorySyncStore struct {
+	lock  sync.Mutex
+	Users map[id.UserID]*SyncState `json:"users"`
+}
+
+// NewMemorySyncStore creates an empty in-memory sync store.
+func NewMemorySyncStore() *MemorySyncStore {
+	return &MemorySyncStore{Users: make(map[id.UserID]*SyncState)}
+}
+
+func (store *MemorySyncStore) getState(userID id.UserID) *SyncState {
+	state, ok := store.Users[userID]
+	if !ok {
+		state = &SyncState{}
+		store.Users[userID] = state
+	}
+	return state
+}
+
+func (store *MemorySyncStore) SaveFilterID(userID id.UserID, filterID string) error {
+	store.lock.Lock()
+	store.getState(userID).FilterID = filterID
+	store.lock.Unlock()
+	return nil
+}
+
+func (store *MemorySyncStore) LoadFilterID(userID id.UserID) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if state, ok := store.Users[userID]; ok {
+		return state.FilterID, nil
+	}
+	return "", nil
+}
+
+func (store *MemorySyncStore) SaveNextBatch(userID id.UserID, nextBatch string, savedAt time.Time) error {
+	store.lock.Lock()
+	state := store.getState(userID)
+	state.NextBatch = nextBatch
+	state.SavedAt = savedAt
+	store.lock.Unlock()
+	return nil
+}
+
+func (store *MemorySyncStore) LoadNextBatch(userID id.UserID) (string, time.Time, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if state, ok := store.Users[userID]; ok {
+		return state.NextBatch, state.SavedAt, nil
+	}
+	return "", time.Time{}, nil
+}
+
+// FileSyncStore is a SyncStore that saves its state in a JSON file after every change.
+type FileSyncStore struct {
+	MemorySyncStore
+	path      string
+	writeLock sync.Mutex
+}
+
+// NewFileSyncStore creates a sync store backed by the JSON file at the given path,
+// loading the existing state if the file exists.
+func NewFileSyncStore(path string) (*FileSyncStore, error) {
+	store := &FileSyncStore{path: path}
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// the map is initialized below
+	} else if err != nil {
+		return nil, err
+	} else if err = json.Unmarshal(data, &store.MemorySyncStore); err != nil {
+		return nil, fmt.Errorf("failed to parse sync store: %w", err)
+	}
+	if store.Users == nil {
+		store.Users = make(map[id.UserID]*SyncState)
+	}
+	return store, nil
+}
+
+// save writes the state to a temporary file and renames it over the store file, so a crash can't corrupt the file.
+func (store *FileSyncStore) save() error {
+	store.writeLock.Lock()
+	defer store.writeLock.Unlock()
+	store.lock.Lock()
+	data, err := json.Marshal(&store.MemorySyncStore)
+	store.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(store.path), filepath.Base(store.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+		return err
+	}
+	return os.Rename(tempFile.Name(), store.path)
+}
+
+func (store *FileSyncStore) SaveFilterID(userID id.UserID, filterID string) error {
+	_ = store.MemorySyncStore.SaveFilterID(userID, filterID)
+	return store.save()
+}
+
+func (store *FileSyncStore) SaveNextBatch(userID id.UserID, nextBatch string, savedAt time.Time) error {
+	_ = store.MemorySyncStore.SaveNextBatch(userID, nextBatch, savedAt)
+	return store.save()
+}
+
+// SQLSyncStore is a SyncStore that uses a SQLite or Postgres database. Call CreateTable before using it.
+type SQLSyncStore struct {
+	DB *sql.DB
+}
+
+// NewSQLSyncStore creates a sync store that uses the given database.
+func NewSQLSyncStore(db *sql.DB) *SQLSyncStore {
+	return &SQLSyncStore{DB: db}
+}
+
+// CreateTable creates the mx_sync_store table if it doesn't exist yet.
+func (store *SQLSyncStore) CreateTable() error {
+	_, err := store.DB.Exec(`CREATE TABLE IF NOT EXISTS mx_sync_store (
+		user_id    TEXT   PRIMARY KEY,
+		filter_id  TEXT   NOT NULL DEFAULT '',
+		next_batch TEXT   NOT NULL DEFAULT '',
+		saved_at   BIGINT NOT NULL DEFAULT 0
+	)`)
+	return err
+}
+
+func (store *SQLSyncStore) SaveFilterID(userID id.UserID, filterID string) error {
+	_, err := store.DB.Exec(`
+		INSERT INTO mx_sync_store (user_id, filter_id) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET filter_id=excluded.filter_id
+	`, userID, filterID)
+	return err
+}
+
+func (store *SQLSyncStore) LoadFilterID(userID id.UserID) (filterID string, err error) {
+	err = store.DB.QueryRow("SELECT filter_id FROM mx_sync_store WHERE user_id=$1", userID).Scan(&filterID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+func (store *SQLSyncStore) SaveNextBatch(userID id.UserID, nextBatch string, savedAt time.Time) error {
+	_, err := store.DB.Exec(`
+		INSERT INTO mx_sync_store (user_id, next_batch, saved_at) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET next_batch=excluded.next_batch, saved_at=excluded.saved_at
+	`, userID, nextBatch, savedAt.UnixNano()/int64(time.Millisecond))
+	return err
+}
+
+func (store *SQLSyncStore) LoadNextBatch(userID id.UserID) (nextBatch string, savedAt time.Time, err error) {
+	var savedAtMillis int64
+	err = store.DB.QueryRow("SELECT next_batch, saved_at FROM mx_sync_store WHERE user_id=$1", userID).
+		Scan(&nextBatch, &savedAtMillis)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", time.Time{}, nil
+	} else if err == nil && savedAtMillis > 0 {
+		savedAt = time.Unix(0, savedAtMillis*int64(time.Millisecond))
+	}
+	return
+}
+
+// RedisClient is the subset of Redis commands used by RedisSyncStore. To avoid depending on a specific Redis
+// library, the client must be wrapped in a small adapter, e.g. for go-redis:
+//
+//	type redisAdapter struct{ *redis.Client }
+//
+//	func (ra redisAdapter) Get(ctx context.Context, key string) (string, error) {
+//		val, err := ra.Client.Get(ctx, key).Result()
+//		if errors.Is(err, redis.Nil) {
+//			return "", nil
+//		}
+//		return val, err
+//	}
+//
+//	func (ra redisAdapter) Set(ctx context.Context, key, value string) error {
+//		return ra.Client.Set(ctx, key, value, 0).Err()
+//	}
+type RedisClient interface {
+	// Get returns the value of the key, or an empty string and no error if the key doesn't exist.
+	Get(ctx context.Context, key string) (string, error)
+	Set(ctx context.Context, key, value string) error
+}
+
+// RedisSyncStore is a SyncStore that saves the sync state in Redis under keys starting with KeyPrefix.
+type RedisSyncStore struct {
+	Client    RedisClient
+	KeyPrefix string
+}
+
+// NewRedisSyncStore creates a sync store that uses the given Redis client with the key prefix "mautrix:sync:".
+func NewRedisSyncStore(client RedisClient) *RedisSyncStore {
+	return &RedisSyncStore{Client: client, KeyPrefix: "mautrix:sync:"}
+}
+
+type redisNextBatch struct {
+	NextBatch string `json:"next_batch"`
+	SavedAt   int64  `json:"saved_at"`
+}
+
+func (store *RedisSyncStore) SaveFilterID(userID id.UserID, filterID string) error {
+	return store.Client.Set(context.Background(), store.KeyPrefix+userID.String()+":filter_id", filterID)
+}
+
+func (store *RedisSyncStore) LoadFilterID(userID id.UserID) (string, error) {
+	return store.Client.Get(context.Background(), store.KeyPrefix+userID.String()+":filter_id")
+}
+
+func (store *RedisSyncStore) SaveNextBatch(userID id.UserID, nextBatch string, savedAt time.Time) error {
+	data, err := json.Marshal(&redisNextBatch{NextBatch: nextBatch, SavedAt: savedAt.UnixNano() / int64(time.Millisecond)})
+	if err != nil {
+		return err
+	}
+	return store.Client.Set(context.Background(), store.KeyPrefix+userID.String()+":next_batch", string(data))
+}
+
+func (store *RedisSyncStore) LoadNextBatch(userID id.UserID) (string, time.Time, error) {
+	data, err := store.Client.Get(context.Background(), store.KeyPrefix+userID.String()+":next_batch")
+	if err != nil || len(data) == 0 {
+		return "", time.Time{}, err
+	}
+	var parsed redisNextBatch
+	err = json.Unmarshal([]byte(data), &parsed)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to parse stored next batch: %w", err)
+	}
+	var savedAt time.Time
+	if parsed.SavedAt > 0 {
+		savedAt = time.Unix(0, parsed.SavedAt*int64(time.Millisecond))
+	}
+	return parsed.NextBatch, savedAt, nil
+}
+
+// loadSyncTokens loads the next_batch token and filter ID from the SyncStore of the client, or the Store if there's
+// no SyncStore. If the next_batch token is older than MaxSyncTokenAge, it's discarded and the StaleSyncFilter is
+// returned as the filter to use for the initial sync.
+func (cli *Client) loadSyncTokens() (nextBatch, filterID, initialFilter string, err error) {
+	if cli.SyncStore == nil {
+		return cli.Store.LoadNextBatch(cli.UserID), cli.Store.LoadFilterID(cli.UserID), "", nil
+	}
+	filterID, err = cli.SyncStore.LoadFilterID(cli.UserID)
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to load filter ID: %w", err)
+	}
+	var savedAt time.Time
+	nextBatch, savedAt, err = cli.SyncStore.LoadNextBatch(cli.UserID)
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to load next batch token: %w", err)
+	}
+	if len(nextBatch) > 0 && cli.MaxSyncTokenAge > 0 && !savedAt.IsZero() && time.Since(savedAt) > cli.MaxSyncTokenAge {
+		cli.Logger.Debugfln("Next batch token from %s is too old, starting with an initial sync", savedAt)
+		nextBatch = ""
+		if cli.StaleSyncFilter != nil {
+			var filterJSON []byte
+			filterJSON, err = json.Marshal(cli.applySyncFilterOptions(cli.StaleSyncFilter))
+			if err != nil {
+				return "", "", "", fmt.Errorf("failed to marshal stale sync filter: %w", err)
+			}
+			initialFilter = string(filterJSON)
+		}
+	}
+	return
+}
+
+func (cli *Client) saveFilterID(filterID string) error {
+	if cli.SyncStore == nil {
+		cli.Store.SaveFilterID(cli.UserID, filterID)
+		return nil
+	}
+	return cli.SyncStore.SaveFilterID(cli.UserID, filterID)
+}
+
+func (cli *Client) saveNextBatch(nextBatch string) error {
+	if cli.SyncStore == nil {
+		cli.Store.SaveNextBatch(cli.UserID, nextBatch)
+		return nil
+	}
+	return cli.SyncStore.SaveNextBatch(cli.UserID, nextBatch, time.Now())
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+)
+
+func testSyncStore(t *testing.T, store mautrix.SyncStore) {
+	filterID, err := store.LoadFilterID("@user:example.com")
+	require.NoError(t, err)
+	assert.Empty(t, filterID)
+	nextBatch, savedAt, err := store.LoadNextBatch("@user:example.com")
+	require.NoError(t, err)
+	assert.Empty(t, nextBatch)
+	assert.True(t, savedAt.IsZero())
+
+	now := time.Unix(1650000000, 123000000)
+	require.NoError(t, store.SaveNextBatch("@user:example.com", "s1", now))
+	require.NoError(t, store.SaveFilterID("@user:example.com", "1"))
+	require.NoError(t, store.SaveFilterID("@other:example.com", "2"))
+
+	filterID, err = store.LoadFilterID("@user:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "1", filterID)
+	// Saving the filter ID doesn't overwrite the token
+	nextBatch, savedAt, err = store.LoadNextBatch("@user:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "s1", nextBatch)
+	assert.True(t, now.Equal(savedAt), "expected %s, got %s", now, savedAt)
+
+	require.NoError(t, store.SaveNextBatch("@user:example.com", "s2", now.Add(time.Minute)))
+	nextBatch, savedAt, err = store.LoadNextBatch("@user:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "s2", nextBatch)
+	assert.True(t, now.Add(time.Minute).Equal(savedAt))
+	filterID, err = store.LoadFilterID("@user:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "1", filterID)
+
+	// Users are stored separately
+	filterID, err = store.LoadFilterID("@other:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "2", filterID)
+	nextBatch, _, err = store.LoadNextBatch("@other:example.com")
+	require.NoError(t, err)
+	assert.Empty(t, nextBatch)
+}
+
+func TestMemorySyncStore(t *testing.T) {
+	testSyncStore(t, mautrix.NewMemorySyncStore())
+}
+
+func TestFileSyncStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mautrix-syncstore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sync.json")
+
+	store, err := mautrix.NewFileSyncStore(path)
+	require.NoError(t, err)
+	testSyncStore(t, store)
+
+	// The state is loaded again after a restart
+	store, err = mautrix.NewFileSyncStore(path)
+	require.NoError(t, err)
+	filterID, err := store.LoadFilterID("@user:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "1", filterID)
+	nextBatch, savedAt, err := store.LoadNextBatch("@user:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "s2", nextBatch)
+	assert.False(t, savedAt.IsZero())
+
+	// No temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "sync.json", files[0].Name())
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	_, err = mautrix.NewFileSyncStore(path)
+	assert.Error(t, err)
+}
+
+func TestSQLSyncStore(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	store := mautrix.NewSQLSyncStore(db)
+	require.NoError(t, store.CreateTable())
+	// Creating the table again is a no-op
+	require.NoError(t, store.CreateTable())
+	testSyncStore(t, store)
+}
+
+// memoryRedis is a RedisClient that keeps the values in a map.
+type memoryRedis struct {
+	lock   sync.Mutex
+	values map[string]string
+	err    error
+}
+
+func (mr *memoryRedis) Get(ctx context.Context, key string) (string, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	return mr.values[key], mr.err
+}
+
+func (mr *memoryRedis) Set(ctx context.Context, key, value string) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	if mr.err != nil {
+		return mr.err
+	}
+	mr.values[key] = value
+	return nil
+}
+
+func TestRedisSyncStore(t *testing.T) {
+	redis := &memoryRedis{values: make(map[string]string)}
+	store := mautrix.NewRedisSyncStore(redis)
+	testSyncStore(t, store)
+	assert.Equal(t, "1", redis.values["mautrix:sync:@user:example.com:filter_id"])
+	assert.JSONEq(t, fmt.Sprintf(`{"next_batch": "s2", "saved_at": %d}`, 1650000060123), redis.values["mautrix:sync:@user:example.com:next_batch"])
+
+	redis.values["mautrix:sync:@user:example.com:next_batch"] = "not json"
+	_, _, err := store.LoadNextBatch("@user:example.com")
+	assert.Error(t, err)
+
+	redis.err = errors.New("connection refused")
+	_, _, err = store.LoadNextBatch("@user:example.com")
+	assert.Equal(t, redis.err, err)
+	assert.Equal(t, redis.err, store.SaveFilterID("@user:example.com", "3"))
+}
+
+type syncStoreTestRequest struct {
+	Since  string
+	Filter string
+}
+
+// newSyncStoreTestServer returns a sync server and a function that returns and clears the sync requests it received.
+func newSyncStoreTestServer() (*httptest.Server, func() []syncStoreTestRequest) {
+	var lock sync.Mutex
+	var requests []syncStoreTestRequest
+	count := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/r0/sync" {
+			_, _ = w.Write([]byte(`{"filter_id": "new"}`))
+			return
+		}
+		lock.Lock()
+		requests = append(requests, syncStoreTestRequest{Since: r.URL.Query().Get("since"), Filter: r.URL.Query().Get("filter")})
+		count++
+		nextBatch := count
+		lock.Unlock()
+		_, _ = fmt.Fprintf(w, `{"next_batch": "n%d"}`, nextBatch)
+	}))
+	return server, func() []syncStoreTestRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		reqs := requests
+		requests = nil
+		return reqs
+	}
+}
+
+func newSyncStoreTestClient(t *testing.T, serverURL string, store mautrix.SyncStore) *mautrix.Client {
+	cli := mautrix.NewTestClient(t, serverURL)
+	cli.SyncStore = store
+	syncer := mautrix.NewDefaultSyncer()
+	syncer.OnSync(func(resp *mautrix.RespSync, since string) bool {
+		cli.StopSync()
+		return true
+	})
+	cli.Syncer = syncer
+	return cli
+}
+
+// syncOnce runs the sync loop until the first response has been processed and returns the request for it.
+// The loop always sends one more request after being stopped, but the response to that request is discarded.
+func syncOnce(t *testing.T, cli *mautrix.Client, requests func() []syncStoreTestRequest) syncStoreTestRequest {
+	require.NoError(t, cli.Sync())
+	reqs := requests()
+	require.Len(t, reqs, 2)
+	return reqs[0]
+}
+
+func TestClient_Sync_SyncStore(t *testing.T) {
+	server, requests := newSyncStoreTestServer()
+	defer server.Close()
+	store := mautrix.NewMemorySyncStore()
+
+	// The filter is created and saved on the first sync
+	cli := newSyncStoreTestClient(t, server.URL, store)
+	assert.Equal(t, syncStoreTestRequest{"", "new"}, syncOnce(t, cli, requests))
+	filterID, _ := store.LoadFilterID(cli.UserID)
+	assert.Equal(t, "new", filterID)
+	nextBatch, savedAt, _ := store.LoadNextBatch(cli.UserID)
+	assert.Equal(t, "n1", nextBatch)
+	assert.WithinDuration(t, time.Now(), savedAt, time.Minute)
+	// The client store isn't used when there's a sync store
+	assert.Empty(t, cli.Store.LoadNextBatch(cli.UserID))
+	assert.Empty(t, cli.Store.LoadFilterID(cli.UserID))
+
+	// Syncing is resumed from the saved token
+	require.NoError(t, store.SaveFilterID(cli.UserID, "saved"))
+	cli = newSyncStoreTestClient(t, server.URL, store)
+	assert.Equal(t, syncStoreTestRequest{"n1", "saved"}, syncOnce(t, cli, requests))
+	nextBatch, _, _ = store.LoadNextBatch(cli.UserID)
+	assert.Equal(t, "n3", nextBatch)
+}
+
+func TestClient_Sync_MaxSyncTokenAge(t *testing.T) {
+	server, requests := newSyncStoreTestServer()
+	defer server.Close()
+	store := mautrix.NewMemorySyncStore()
+	require.NoError(t, store.SaveFilterID("@user:example.com", "saved"))
+	require.NoError(t, store.SaveNextBatch("@user:example.com", "old", time.Now().Add(-2*time.Hour)))
+
+	cli := newSyncStoreTestClient(t, server.URL, store)
+	cli.MaxSyncTokenAge = time.Hour
+	cli.StaleSyncFilter = &mautrix.Filter{Room: mautrix.RoomFilter{Timeline: mautrix.FilterPart{Limit: 1}}}
+	require.NoError(t, cli.Sync())
+	reqs := requests()
+	require.Len(t, reqs, 2)
+	assert.Empty(t, reqs[0].Since)
+	assert.JSONEq(t, `{"account_data": {}, "presence": {}, "room": {"account_data": {}, "ephemeral": {}, "state": {}, "timeline": {"limit": 1}}}`, reqs[0].Filter)
+	// The stale filter is only used for the initial sync
+	assert.Equal(t, syncStoreTestRequest{"n1", "saved"}, reqs[1])
+
+	// Without a stale sync filter, the saved filter is used for the initial sync too
+	require.NoError(t, store.SaveNextBatch("@user:example.com", "old", time.Now().Add(-2*time.Hour)))
+	cli.StaleSyncFilter = nil
+	assert.Equal(t, syncStoreTestRequest{"", "saved"}, syncOnce(t, cli, requests))
+
+	// Recent tokens are kept
+	require.NoError(t, store.SaveNextBatch("@user:example.com", "recent", time.Now().Add(-time.Minute)))
+	assert.Equal(t, syncStoreTestRequest{"recent", "saved"}, syncOnce(t, cli, requests))
+}
+
+func TestClient_Sync_SyncStoreError(t *testing.T) {
+	server, requests := newSyncStoreTestServer()
+	defer server.Close()
+	redis := &memoryRedis{values: make(map[string]string), err: errors.New("connection refused")}
+	cli := newSyncStoreTestClient(t, server.URL, mautrix.NewRedisSyncStore(redis))
+	err := cli.Sync()
+	assert.ErrorIs(t, err, redis.err)
+	assert.Contains(t, err.Error(), "failed to load filter ID")
+	assert.Empty(t, requests())
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// SyncStreamHandler contains callbacks that are called for each room while a /sync response is being parsed with
+// ParseSyncStream. Rooms that are passed to a callback aren't stored in the returned response, which means only one
+// room needs to be in memory at a time. If the callback for a room category is nil, the rooms are stored in the
+// response like normal.
+//
+// The callbacks are called in the order the rooms appear in the response, which means they may be called before
+// the top-level fields like to-device events have been parsed. When used with Client.Sync, the rooms are never seen
+// by the Syncer, so anything that processes rooms there (e.g. the state store, crypto and event handlers of
+// DefaultSyncer, or the SyncJournal) would silently miss them. Sync therefore refuses to use room callbacks with
+// DefaultSyncer or a SyncJournal, see ErrSyncStreamRoomCallbacks. If parsing fails after some callbacks have been
+// called, the same sync is requested again, so the callbacks must be able to handle the same rooms more than once.
+type SyncStreamHandler struct {
+	OnJoinedRoom  func(roomID id.RoomID, room *SyncJoinedRoom) error
+	OnInvitedRoom func(roomID id.RoomID, room *SyncInvitedRoom) error
+	OnKnockedRoom func(roomID id.RoomID, room *SyncKnockedRoom) error
+	OnLeftRoom    func(roomID id.RoomID, room *SyncLeftRoom) error
+}
+
+// ErrSyncStreamRoomCallbacks is returned by Client.Sync if the SyncStreamHandler has room callbacks and the client
+// uses DefaultSyncer or a SyncJournal, which would never see the rooms passed to the callbacks.
+var ErrSyncStreamRoomCallbacks = errors.New("sync stream room callbacks can't be used with DefaultSyncer or a sync journal")
+
+func (handler *SyncStreamHandler) hasRoomCallbacks() bool {
+	return handler != nil && (handler.OnJoinedRoom != nil || handler.OnInvitedRoom != nil ||
+		handler.OnKnockedRoom != nil || handler.OnLeftRoom != nil)
+}
+
+// checkSyncStreamHandler returns ErrSyncStreamRoomCallbacks if the room callbacks of the SyncStreamHandler would
+// hide rooms from parts of the client that need to process them.
+func (cli *Client) checkSyncStreamHandler() error {
+	if !cli.SyncStreamHandler.hasRoomCallbacks() {
+		return nil
+	} else if _, isDefault := cli.Syncer.(*DefaultSyncer); isDefault || cli.SyncJournal != nil {
+		return ErrSyncStreamRoomCallbacks
+	}
+	return nil
+}
+
+// ParseSyncStream parses a /sync response incrementally from the given reader. Unlike json.Unmarshal and
+// json.Decoder.Decode, this never holds the whole response body in memory, only one room at a time, which avoids
+// huge memory spikes with large initial syncs.
+//
+// If a callback returns an error, parsing is stopped and the error is returned.
+func ParseSyncStream(reader io.Reader, handler *SyncStreamHandler) (*RespSync, error) {
+	if handler == nil {
+		handler = &SyncStreamHandler{}
+	}
+	dec := json.NewDecoder(reader)
+	err := expectDelim(dec, '{')
+	if err != nil {
+		return nil, err
+	}
+	var resp RespSync
+	// The fields other than rooms are small, so they're collected and unmarshaled normally at the end. The object is
+	// built by hand rather than with json.Marshal to keep the raw values as-is, e.g. for event.Content.VeryRaw.
+	var others bytes.Buffer
+	others.WriteByte('{')
+	for dec.More() {
+		key, err := readKey(dec)
+		if err != nil {
+			return nil, err
+		}
+		if key == "rooms" {
+			err = parseSyncRooms(dec, &resp, handler)
+		} else {
+			var value json.RawMessage
+			if err = dec.Decode(&value); err == nil {
+				if others.Len() > 1 {
+					others.WriteByte(',')
+				}
+				keyJSON, _ := json.Marshal(key)
+				others.Write(keyJSON)
+				others.WriteByte(':')
+				others.Write(value)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", key, err)
+		}
+	}
+	if err = expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	others.WriteByte('}')
+	// The rooms aren't in the data, so the maps filled by parseSyncRooms are kept
+	if err = json.Unmarshal(others.Bytes(), &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	} else if token == nil {
+		// null is accepted in place of an object
+		if delim == '{' {
+			return errNullObject
+		}
+		return fmt.Errorf("unexpected null, expected %s", delim)
+	} else if token != delim {
+		return fmt.Errorf("unexpected %v, expected %s", token, delim)
+	}
+	return nil
+}
+
+var errNullObject = errors.New("unexpected null object")
+
+func readKey(dec *json.Decoder) (string, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+	key, ok := token.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected %v, expected object key", token)
+	}
+	return key, nil
+}
+
+// parseRoomMap parses an object of room IDs to rooms, calling parseRoom for each room.
+func parseRoomMap(dec *json.Decoder, parseRoom func(roomID id.RoomID) error) error {
+	err := expectDelim(dec, '{')
+	if err == errNullObject {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for dec.More() {
+		roomID, err := readKey(dec)
+		if err != nil {
+			return err
+		}
+		if err = parseRoom(id.RoomID(roomID)); err != nil {
+			return fmt.Errorf("%s: %w", roomID, err)
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// decodeRoom decodes the next room in the stream. The room is first copied out of the decoder's buffer, because
+// event.Content keeps a reference to the raw data it's unmarshaled from and the decoder reuses its buffer.
+func decodeRoom(dec *json.Decoder, room interface{}) error {
+	var data json.RawMessage
+	if err := dec.Decode(&data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, room)
+}
+
+func parseSyncRooms(dec *json.Decoder, resp *RespSync, handler *SyncStreamHandler) error {
+	err := expectDelim(dec, '{')
+	if err == errNullObject {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for dec.More() {
+		category, err := readKey(dec)
+		if err != nil {
+			return err
+		}
+		switch category {
+		case "join":
+			err = parseRoomMap(dec, func(roomID id.RoomID) error {
+				var room SyncJoinedRoom
+				if err := decodeRoom(dec, &room); err != nil {
+					return err
+				} else if handler.OnJoinedRoom != nil {
+					return handler.OnJoinedRoom(roomID, &room)
+				} else if resp.Rooms.Join == nil {
+					resp.Rooms.Join = make(map[id.RoomID]SyncJoinedRoom)
+				}
+				resp.Rooms.Join[roomID] = room
+				return nil
+			})
+		case "invite":
+			err = parseRoomMap(dec, func(roomID id.RoomID) error {
+				var room SyncInvitedRoom
+				if err := decodeRoom(dec, &room); err != nil {
+					return err
+				} else if handler.OnInvitedRoom != nil {
+					return handler.OnInvitedRoom(roomID, &room)
+				} else if resp.Rooms.Invite == nil {
+					resp.Rooms.Invite = make(map[id.RoomID]SyncInvitedRoom)
+				}
+				resp.Rooms.Invite[roomID] = room
+				return nil
+			})
+		case "knock":
+			err = parseRoomMap(dec, func(roomID id.RoomID) error {
+				var room SyncKnockedRoom
+				if err := decodeRoom(dec, &room); err != nil {
+					return err
+				} else if handler.OnKnockedRoom != nil {
+					return handler.OnKnockedRoom(roomID, &room)
+				} else if resp.Rooms.Knock == nil {
+					resp.Rooms.Knock = make(map[id.RoomID]SyncKnockedRoom)
+				}
+				resp.Rooms.Knock[roomID] = room
+				return nil
+			})
+		case "leave":
+			err = parseRoomMap(dec, func(roomID id.RoomID) error {
+				var room SyncLeftRoom
+				if err := decodeRoom(dec, &room); err != nil {
+					return err
+				} else if handler.OnLeftRoom != nil {
+					return handler.OnLeftRoom(roomID, &room)
+				} else if resp.Rooms.Leave == nil {
+					resp.Rooms.Leave = make(map[id.RoomID]SyncLeftRoom)
+				}
+				resp.Rooms.Leave[roomID] = room
+				return nil
+			})
+		default:
+			var ignored json.RawMessage
+			err = dec.Decode(&ignored)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", category, err)
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// streamSyncResponse is a ClientResponseHandler that parses /sync responses with ParseSyncStream.
+func (cli *Client) streamSyncResponse(handler *SyncStreamHandler) ClientResponseHandler {
+	return func(req *http.Request, res *http.Response, responseJSON interface{}) ([]byte, error) {
+		resp, err := ParseSyncStream(res.Body, handler)
+		if err != nil {
+			return nil, HTTPError{
+				Request:      req,
+				Response:     res,
+				Message:      "failed to parse sync response",
+				WrappedError: err,
+			}
+		}
+		*responseJSON.(**RespSync) = resp
+		return nil, nil
+	}
+}
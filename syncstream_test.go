@@ -0,0 +1,185 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const syncStreamTestResponse = `{
+	"next_batch": "s72595_4483_1934",
+	"unknown_top_level_key": {"nested": [1, 2, {"three": null}]},
+	"rooms": {
+		"join": {
+			"!a:example.com": {
+				"summary": {"m.heroes": ["@alice:example.com"], "m.joined_member_count": 2},
+				"state": {"events": [{"type": "m.room.name", "state_key": "", "event_id": "$name", "sender": "@alice:example.com", "content": {"name": "Room {with} \"braces\""}}]},
+				"timeline": {
+					"events": [
+						{"type": "m.room.message", "event_id": "$msg", "sender": "@alice:example.com", "content": {"body": "hi", "msgtype": "m.text", "nested": {"rooms": {"join": {}}}}},
+						{"type": "m.room.member", "state_key": "@bob:example.com", "event_id": "$member", "sender": "@bob:example.com", "content": {"membership": "join"}}
+					],
+					"limited": true,
+					"prev_batch": "t34-23535_0_0"
+				},
+				"ephemeral": {"events": [{"type": "m.typing", "content": {"user_ids": ["@alice:example.com"]}}]},
+				"account_data": {"events": [{"type": "m.tag", "content": {"tags": {"u.work": {"order": 0.9}}}}]},
+				"unread_notifications": {"highlight_count": 1, "notification_count": 5},
+				"unknown_room_key": "ignored"
+			},
+			"!b:example.com": {"timeline": {"events": []}}
+		},
+		"invite": {
+			"!c:example.com": {"invite_state": {"events": [{"type": "m.room.member", "state_key": "@user:example.com", "sender": "@alice:example.com", "content": {"membership": "invite"}}]}}
+		},
+		"knock": {
+			"!d:example.com": {"knock_state": {"events": [{"type": "m.room.join_rules", "state_key": "", "sender": "@alice:example.com", "content": {"join_rule": "knock"}}]}}
+		},
+		"leave": {
+			"!e:example.com": {"timeline": {"events": [{"type": "m.room.member", "state_key": "@user:example.com", "event_id": "$leave", "sender": "@user:example.com", "content": {"membership": "leave"}}]}}
+		},
+		"unknown_category": {"!f:example.com": {"timeline": {"events": []}}}
+	},
+	"presence": {"events": [{"type": "m.presence", "sender": "@alice:example.com", "content": {"presence": "online"}}]},
+	"account_data": {"events": [{"type": "m.push_rules", "content": {}}]},
+	"to_device": {"events": [{"type": "m.room_key_request", "sender": "@alice:example.com", "content": {"action": "request_cancellation", "request_id": "1", "requesting_device_id": "ABC"}}]},
+	"device_lists": {"changed": ["@alice:example.com"], "left": ["@bob:example.com"]},
+	"device_one_time_keys_count": {"signed_curve25519": 50}
+}`
+
+func TestParseSyncStream_MatchesUnmarshal(t *testing.T) {
+	var expected mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(syncStreamTestResponse), &expected))
+	resp, err := mautrix.ParseSyncStream(strings.NewReader(syncStreamTestResponse), nil)
+	require.NoError(t, err)
+	assert.Equal(t, &expected, resp)
+	assert.Len(t, resp.Rooms.Join, 2)
+	assert.Len(t, resp.Rooms.Join["!a:example.com"].Timeline.Events, 2)
+	assert.Equal(t, "s72595_4483_1934", resp.NextBatch)
+	assert.Equal(t, 50, resp.DeviceOTKCount.SignedCurve25519)
+}
+
+func TestParseSyncStream_Callbacks(t *testing.T) {
+	var expected mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(syncStreamTestResponse), &expected))
+	joined := make(map[id.RoomID]mautrix.SyncJoinedRoom)
+	var order []id.RoomID
+	resp, err := mautrix.ParseSyncStream(strings.NewReader(syncStreamTestResponse), &mautrix.SyncStreamHandler{
+		OnJoinedRoom: func(roomID id.RoomID, room *mautrix.SyncJoinedRoom) error {
+			joined[roomID] = *room
+			order = append(order, roomID)
+			return nil
+		},
+		OnLeftRoom: func(roomID id.RoomID, room *mautrix.SyncLeftRoom) error {
+			assert.Equal(t, expected.Rooms.Leave[roomID], *room)
+			order = append(order, roomID)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, expected.Rooms.Join, joined)
+	assert.Equal(t, []id.RoomID{"!a:example.com", "!b:example.com", "!e:example.com"}, order)
+	// Rooms passed to callbacks aren't stored, the other categories are
+	assert.Nil(t, resp.Rooms.Join)
+	assert.Nil(t, resp.Rooms.Leave)
+	assert.Equal(t, expected.Rooms.Invite, resp.Rooms.Invite)
+	assert.Equal(t, expected.Rooms.Knock, resp.Rooms.Knock)
+	assert.Equal(t, expected.ToDevice, resp.ToDevice)
+}
+
+func TestParseSyncStream_CallbackError(t *testing.T) {
+	errStop := errors.New("stop")
+	var calls int
+	_, err := mautrix.ParseSyncStream(strings.NewReader(syncStreamTestResponse), &mautrix.SyncStreamHandler{
+		OnJoinedRoom: func(roomID id.RoomID, room *mautrix.SyncJoinedRoom) error {
+			calls++
+			return errStop
+		},
+	})
+	assert.ErrorIs(t, err, errStop)
+	assert.Equal(t, 1, calls)
+}
+
+func TestParseSyncStream_NullRooms(t *testing.T) {
+	input := `{"next_batch": "s1", "rooms": null}`
+	var expected mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(input), &expected))
+	resp, err := mautrix.ParseSyncStream(strings.NewReader(input), nil)
+	require.NoError(t, err)
+	assert.Equal(t, &expected, resp)
+
+	input = `{"next_batch": "s1", "rooms": {"join": null, "leave": {}}}`
+	resp, err = mautrix.ParseSyncStream(strings.NewReader(input), nil)
+	require.NoError(t, err)
+	assert.Nil(t, resp.Rooms.Join)
+	assert.Equal(t, "s1", resp.NextBatch)
+}
+
+func TestParseSyncStream_Truncated(t *testing.T) {
+	for _, length := range []int{0, 1, 20, len(syncStreamTestResponse) / 2, len(syncStreamTestResponse) - 1} {
+		truncated := syncStreamTestResponse[:length]
+		var expected mautrix.RespSync
+		require.Error(t, json.Unmarshal([]byte(truncated), &expected), "json.Unmarshal accepted %d bytes", length)
+		_, err := mautrix.ParseSyncStream(strings.NewReader(truncated), nil)
+		assert.Error(t, err, "ParseSyncStream accepted %d bytes", length)
+	}
+}
+
+func TestParseSyncStream_Invalid(t *testing.T) {
+	for _, input := range []string{
+		`[]`,
+		`null`,
+		`{"rooms": []}`,
+		`{"rooms": {"join": []}}`,
+		`{"rooms": {"join": {"!a:example.com": []}}}`,
+		`{"next_batch": 5}`,
+	} {
+		_, err := mautrix.ParseSyncStream(strings.NewReader(input), nil)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestClient_Sync_StreamRoomCallbacks(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("POST /_matrix/client/r0/user/@user:example.com/filter", `{"filter_id": "1"}`)
+	srv.Respond("GET /_matrix/client/r0/sync", syncStreamTestResponse)
+	cli := mautrix.NewTestClient(t, srv.URL)
+	var joined []id.RoomID
+	cli.SyncStreamHandler = &mautrix.SyncStreamHandler{
+		OnJoinedRoom: func(roomID id.RoomID, room *mautrix.SyncJoinedRoom) error {
+			joined = append(joined, roomID)
+			return nil
+		},
+	}
+
+	// DefaultSyncer and the sync journal process rooms, so they'd miss the ones passed to the callbacks
+	assert.ErrorIs(t, cli.Sync(), mautrix.ErrSyncStreamRoomCallbacks)
+	cli.Syncer = mautrix.NewToDeviceSyncer()
+	cli.SyncJournal = mautrix.NewMemorySyncJournal()
+	assert.ErrorIs(t, cli.Sync(), mautrix.ErrSyncStreamRoomCallbacks)
+	assert.Empty(t, srv.Requests())
+
+	cli.SyncJournal = nil
+	syncer := cli.Syncer.(*mautrix.ToDeviceSyncer)
+	syncer.OnOTKCount = func(mautrix.OTKCount, []id.KeyAlgorithm) {
+		cli.StopSync()
+	}
+	require.NoError(t, cli.Sync())
+	// Sync makes one more request after being stopped, so the rooms are seen twice
+	require.Len(t, joined, 4)
+	assert.Equal(t, []id.RoomID{"!a:example.com", "!b:example.com"}, joined[:2])
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// SyncErrorReason is the category of a failed sync request.
+type SyncErrorReason string
+
+const (
+	// The server couldn't be reached, e.g. because of a DNS or connection error.
+	SyncErrorNetwork SyncErrorReason = "network"
+	// The access token is no longer valid (M_UNKNOWN_TOKEN).
+	SyncErrorUnknownToken SyncErrorReason = "unknown_token"
+	// The request timed out.
+	SyncErrorTimeout SyncErrorReason = "timeout"
+	// The server returned an error response other than M_UNKNOWN_TOKEN, e.g. a 502 from a reverse proxy.
+	SyncErrorHTTP SyncErrorReason = "http"
+	// Any other error, e.g. a malformed response.
+	SyncErrorUnknown SyncErrorReason = "unknown"
+)
+
+// ClassifySyncError returns the category of the given sync error.
+func ClassifySyncError(err error) SyncErrorReason {
+	var netErr net.Error
+	var httpErr HTTPError
+	switch {
+	case errors.Is(err, MUnknownToken):
+		return SyncErrorUnknownToken
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return SyncErrorTimeout
+	case netErr != nil:
+		return SyncErrorNetwork
+	case errors.As(err, &httpErr) && httpErr.Response != nil:
+		return SyncErrorHTTP
+	default:
+		return SyncErrorUnknown
+	}
+}
+
+// SyncWatchdog keeps track of the health of the sync loop, e.g. for readiness probes. Set it as Client.SyncWatchdog
+// and it'll be started automatically by Sync.
+type SyncWatchdog struct {
+	// Interval is the expected maximum time between successful syncs. It should be somewhat longer than the sync
+	// timeout, as long polling requests only return after the timeout if there are no new events.
+	Interval time.Duration
+	// MaxMissedIntervals is the number of intervals without a successful sync after which the sync is considered
+	// stalled.
+	MaxMissedIntervals int
+
+	// OnSyncError is called whenever a sync request fails.
+	OnSyncError func(reason SyncErrorReason, err error)
+	// OnSyncStalled is called once when there hasn't been a successful sync for MaxMissedIntervals intervals.
+	OnSyncStalled func(lastSuccess time.Time)
+	// OnSyncRecovered is called when a sync succeeds after the sync stalled or failed. The downtime is the time
+	// since the previous successful sync, or since syncing was started if no sync had succeeded yet.
+	OnSyncRecovered func(downtime time.Duration)
+
+	lastSuccess time.Time
+	started     time.Time
+	failing     bool
+	stalled     bool
+	lock        sync.Mutex
+}
+
+// The defaults for SyncWatchdog.Interval and SyncWatchdog.MaxMissedIntervals, which are used if the fields are zero.
+const (
+	DefaultSyncWatchdogInterval           = 40 * time.Second
+	DefaultSyncWatchdogMaxMissedIntervals = 3
+)
+
+// NewSyncWatchdog creates a watchdog that considers the sync stalled after 3 intervals of 40 seconds.
+func NewSyncWatchdog() *SyncWatchdog {
+	return &SyncWatchdog{
+		Interval:           DefaultSyncWatchdogInterval,
+		MaxMissedIntervals: DefaultSyncWatchdogMaxMissedIntervals,
+	}
+}
+
+func (wd *SyncWatchdog) threshold() time.Duration {
+	return wd.Interval * time.Duration(wd.MaxMissedIntervals)
+}
+
+// LastSuccess returns the time when the last sync request succeeded.
+func (wd *SyncWatchdog) LastSuccess() time.Time {
+	wd.lock.Lock()
+	defer wd.lock.Unlock()
+	return wd.lastSuccess
+}
+
+// Healthy returns true if a sync request has succeeded within the last MaxMissedIntervals intervals.
+func (wd *SyncWatchdog) Healthy() bool {
+	wd.lock.Lock()
+	defer wd.lock.Unlock()
+	return !wd.lastSuccess.IsZero() && time.Since(wd.lastSuccess) <= wd.threshold()
+}
+
+// start applies the defaults to zero fields, resets the stall detection and starts checking for stalled syncs once
+// per interval in the background until the context is canceled.
+func (wd *SyncWatchdog) start(ctx context.Context) {
+	wd.lock.Lock()
+	if wd.Interval <= 0 {
+		wd.Interval = DefaultSyncWatchdogInterval
+	}
+	if wd.MaxMissedIntervals <= 0 {
+		wd.MaxMissedIntervals = DefaultSyncWatchdogMaxMissedIntervals
+	}
+	wd.started = time.Now()
+	wd.stalled = false
+	interval := wd.Interval
+	wd.lock.Unlock()
+	go wd.run(ctx, interval)
+}
+
+func (wd *SyncWatchdog) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			wd.checkStalled()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (wd *SyncWatchdog) checkStalled() {
+	wd.lock.Lock()
+	reference := wd.lastSuccess
+	if reference.Before(wd.started) {
+		reference = wd.started
+	}
+	stalled := !wd.stalled && time.Since(reference) > wd.threshold()
+	if stalled {
+		wd.stalled = true
+	}
+	lastSuccess := wd.lastSuccess
+	wd.lock.Unlock()
+	if stalled && wd.OnSyncStalled != nil {
+		wd.OnSyncStalled(lastSuccess)
+	}
+}
+
+func (wd *SyncWatchdog) reportSuccess() {
+	wd.lock.Lock()
+	recovered := wd.failing || wd.stalled
+	downtime := time.Since(wd.lastSuccess)
+	if wd.lastSuccess.Before(wd.started) {
+		downtime = time.Since(wd.started)
+	}
+	wd.lastSuccess = time.Now()
+	wd.failing = false
+	wd.stalled = false
+	wd.lock.Unlock()
+	if recovered && wd.OnSyncRecovered != nil {
+		wd.OnSyncRecovered(downtime)
+	}
+}
+
+func (wd *SyncWatchdog) reportFailure(err error) {
+	wd.lock.Lock()
+	wd.failing = true
+	wd.lock.Unlock()
+	if wd.OnSyncError != nil {
+		wd.OnSyncError(ClassifySyncError(err), err)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+)
+
+// failingSyncer retries failed syncs immediately instead of after 10 seconds.
+type failingSyncer struct {
+	*mautrix.DefaultSyncer
+}
+
+func (s failingSyncer) OnFailedSync(_ *mautrix.RespSync, _ error) (time.Duration, error) {
+	return 5 * time.Millisecond, nil
+}
+
+func TestClassifySyncError(t *testing.T) {
+	assert.Equal(t, mautrix.SyncErrorUnknownToken, mautrix.ClassifySyncError(mautrix.HTTPError{
+		RespError: &mautrix.RespError{ErrCode: "M_UNKNOWN_TOKEN"},
+	}))
+	assert.Equal(t, mautrix.SyncErrorTimeout, mautrix.ClassifySyncError(mautrix.HTTPError{WrappedError: context.DeadlineExceeded}))
+	_, err := http.Get("http://127.0.0.1:1")
+	require.Error(t, err)
+	assert.Equal(t, mautrix.SyncErrorNetwork, mautrix.ClassifySyncError(mautrix.HTTPError{WrappedError: err}))
+	assert.Equal(t, mautrix.SyncErrorHTTP, mautrix.ClassifySyncError(mautrix.HTTPError{
+		Response: &http.Response{StatusCode: http.StatusBadGateway},
+	}))
+	assert.Equal(t, mautrix.SyncErrorUnknown, mautrix.ClassifySyncError(errors.New("malformed response")))
+}
+
+func TestSyncWatchdog(t *testing.T) {
+	var syncCount int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/r0/sync" {
+			_, _ = w.Write([]byte(`{"filter_id": "1"}`))
+			return
+		}
+		switch count := atomic.AddInt32(&syncCount, 1); {
+		case count == 1:
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "Unknown token"}`))
+		case count <= 15:
+			// Keep failing until the watchdog has noticed that the sync is stalled
+			time.Sleep(5 * time.Millisecond)
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			_, _ = w.Write([]byte(`{"next_batch": "s1"}`))
+		}
+	}))
+	defer server.Close()
+
+	cli := mautrix.NewTestClient(t, server.URL)
+	syncer := failingSyncer{mautrix.NewDefaultSyncer()}
+	cli.Syncer = syncer
+	wd := mautrix.NewSyncWatchdog()
+	wd.Interval = 10 * time.Millisecond
+	wd.MaxMissedIntervals = 2
+	var lock sync.Mutex
+	var reasons []mautrix.SyncErrorReason
+	var stalled, recovered int
+	wd.OnSyncError = func(reason mautrix.SyncErrorReason, err error) {
+		lock.Lock()
+		reasons = append(reasons, reason)
+		lock.Unlock()
+	}
+	wd.OnSyncStalled = func(lastSuccess time.Time) {
+		assert.True(t, lastSuccess.IsZero())
+		lock.Lock()
+		stalled++
+		lock.Unlock()
+	}
+	wd.OnSyncRecovered = func(downtime time.Duration) {
+		assert.True(t, downtime > 0)
+		lock.Lock()
+		recovered++
+		lock.Unlock()
+	}
+	cli.SyncWatchdog = wd
+	assert.False(t, wd.Healthy())
+	syncer.OnSync(func(resp *mautrix.RespSync, since string) bool {
+		cli.StopSync()
+		return true
+	})
+	require.NoError(t, cli.Sync())
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, reasons, 15)
+	assert.Equal(t, mautrix.SyncErrorUnknownToken, reasons[0])
+	assert.Equal(t, mautrix.SyncErrorHTTP, reasons[1])
+	assert.Equal(t, 1, stalled)
+	assert.Equal(t, 1, recovered)
+	assert.True(t, wd.Healthy())
+	assert.False(t, wd.LastSuccess().IsZero())
+}
+
+func TestSyncWatchdog_ZeroValue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/r0/sync" {
+			_, _ = w.Write([]byte(`{"filter_id": "1"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"next_batch": "s1"}`))
+	}))
+	defer server.Close()
+
+	cli := mautrix.NewTestClient(t, server.URL)
+	syncer := mautrix.NewDefaultSyncer()
+	syncer.OnSync(func(resp *mautrix.RespSync, since string) bool {
+		cli.StopSync()
+		return true
+	})
+	cli.Syncer = syncer
+	wd := &mautrix.SyncWatchdog{}
+	cli.SyncWatchdog = wd
+	require.NoError(t, cli.Sync())
+	assert.Equal(t, mautrix.DefaultSyncWatchdogInterval, wd.Interval)
+	assert.Equal(t, mautrix.DefaultSyncWatchdogMaxMissedIntervals, wd.MaxMissedIntervals)
+	assert.True(t, wd.Healthy())
+}
@@ -0,0 +1,22 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// NewTestClient creates a client for the given test server that is logged in as @user:example.com with the access
+// token "token". It's in the package itself rather than mautrix_test, so that both internal and external tests can
+// use it.
+func NewTestClient(t *testing.T, serverURL string) *Client {
+	cli, err := NewClient(serverURL, "@user:example.com", "token")
+	require.NoError(t, err)
+	return cli
+}
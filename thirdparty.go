@@ -0,0 +1,61 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"net/http"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// GetThirdPartyProtocols gets the third-party protocols provided by the bridges on the homeserver.
+// See https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3thirdpartyprotocols
+func (cli *Client) GetThirdPartyProtocols() (resp map[string]*ThirdPartyProtocol, err error) {
+	_, err = cli.MakeRequest(http.MethodGet, cli.BuildURL("thirdparty", "protocols"), nil, &resp)
+	return
+}
+
+// GetThirdPartyProtocol gets the metadata of a single third-party protocol.
+// See https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3thirdpartyprotocolprotocol
+func (cli *Client) GetThirdPartyProtocol(protocol string) (resp *ThirdPartyProtocol, err error) {
+	_, err = cli.MakeRequest(http.MethodGet, cli.BuildURL("thirdparty", "protocol", protocol), nil, &resp)
+	return
+}
+
+// QueryThirdPartyLocations finds the Matrix rooms of third-party locations matching the given fields. The possible
+// fields are listed in the LocationFields of the protocol.
+// See https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3thirdpartylocationprotocol
+func (cli *Client) QueryThirdPartyLocations(protocol string, fields map[string]string) (resp []ThirdPartyLocation, err error) {
+	urlPath := cli.BuildURLWithQuery(URLPath{"thirdparty", "location", protocol}, fields)
+	_, err = cli.MakeRequest(http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// QueryThirdPartyUsers finds the Matrix users of third-party users matching the given fields. The possible
+// fields are listed in the UserFields of the protocol.
+// See https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3thirdpartyuserprotocol
+func (cli *Client) QueryThirdPartyUsers(protocol string, fields map[string]string) (resp []ThirdPartyUser, err error) {
+	urlPath := cli.BuildURLWithQuery(URLPath{"thirdparty", "user", protocol}, fields)
+	_, err = cli.MakeRequest(http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// GetThirdPartyLocationsByAlias gets the third-party locations that the given room alias is bridged to.
+// See https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3thirdpartylocation
+func (cli *Client) GetThirdPartyLocationsByAlias(alias id.RoomAlias) (resp []ThirdPartyLocation, err error) {
+	urlPath := cli.BuildURLWithQuery(URLPath{"thirdparty", "location"}, map[string]string{"alias": alias.String()})
+	_, err = cli.MakeRequest(http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// GetThirdPartyUsersByUserID gets the third-party users that the given Matrix user ID represents.
+// See https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3thirdpartyuser
+func (cli *Client) GetThirdPartyUsersByUserID(userID id.UserID) (resp []ThirdPartyUser, err error) {
+	urlPath := cli.BuildURLWithQuery(URLPath{"thirdparty", "user"}, map[string]string{"userid": userID.String()})
+	_, err = cli.MakeRequest(http.MethodGet, urlPath, nil, &resp)
+	return
+}
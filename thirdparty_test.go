@@ -0,0 +1,93 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const testIRCProtocol = `{
+	"user_fields": ["network", "nickname"],
+	"location_fields": ["network", "channel"],
+	"icon": "mxc://example.com/irc",
+	"field_types": {"channel": {"regexp": "#[^\\s]+", "placeholder": "#foo"}},
+	"instances": [{"desc": "Libera", "fields": {"network": "libera"}, "network_id": "libera", "instance_id": "irc|libera"}]
+}`
+
+func TestClient_ThirdPartyProtocols(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("GET /_matrix/client/r0/thirdparty/protocols", `{"irc": `+testIRCProtocol+`}`)
+	srv.Respond("GET /_matrix/client/r0/thirdparty/protocol/irc", testIRCProtocol)
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	protocols, err := cli.GetThirdPartyProtocols()
+	require.NoError(t, err)
+	require.Contains(t, protocols, "irc")
+	assert.Equal(t, []string{"network", "channel"}, protocols["irc"].LocationFields)
+	srv.Requests()
+
+	protocol, err := cli.GetThirdPartyProtocol("irc")
+	require.NoError(t, err)
+	assert.Equal(t, "#[^\\s]+", protocol.FieldTypes["channel"].Regexp)
+	require.Len(t, protocol.Instances, 1)
+	assert.Equal(t, mautrix.ThirdPartyProtocolInstance{
+		Description: "Libera",
+		Fields:      map[string]string{"network": "libera"},
+		NetworkID:   "libera",
+		InstanceID:  "irc|libera",
+	}, protocol.Instances[0])
+	assert.Equal(t, "/_matrix/client/r0/thirdparty/protocol/irc", srv.LastRequest(t).Path)
+}
+
+func TestClient_QueryThirdParty(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("GET /_matrix/client/r0/thirdparty/location/irc", `[{"alias": "#irc_#foo:example.com", "protocol": "irc", "fields": {"network": "libera", "channel": "#foo"}}]`)
+	srv.Respond("GET /_matrix/client/r0/thirdparty/user/irc", `[{"userid": "@irc_alice:example.com", "protocol": "irc", "fields": {"network": "libera", "nickname": "alice"}}]`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	locations, err := cli.QueryThirdPartyLocations("irc", map[string]string{"network": "libera", "channel": "#foo"})
+	require.NoError(t, err)
+	require.Len(t, locations, 1)
+	assert.Equal(t, id.RoomAlias("#irc_#foo:example.com"), locations[0].Alias)
+	assert.Equal(t, url.Values{"network": {"libera"}, "channel": {"#foo"}}, srv.LastRequest(t).Query)
+
+	users, err := cli.QueryThirdPartyUsers("irc", map[string]string{"nickname": "alice"})
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, id.UserID("@irc_alice:example.com"), users[0].UserID)
+	assert.Equal(t, "alice", users[0].Fields["nickname"])
+	assert.Equal(t, url.Values{"nickname": {"alice"}}, srv.LastRequest(t).Query)
+}
+
+func TestClient_ThirdPartyReverseLookup(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.Respond("GET /_matrix/client/r0/thirdparty/location", `[{"alias": "#irc_#foo:example.com", "protocol": "irc", "fields": {"channel": "#foo"}}]`)
+	srv.Respond("GET /_matrix/client/r0/thirdparty/user", `[{"userid": "@irc_alice:example.com", "protocol": "irc", "fields": {"nickname": "alice"}}]`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	locations, err := cli.GetThirdPartyLocationsByAlias("#irc_#foo:example.com")
+	require.NoError(t, err)
+	require.Len(t, locations, 1)
+	assert.Equal(t, "#foo", locations[0].Fields["channel"])
+	assert.Equal(t, "#irc_#foo:example.com", srv.LastRequest(t).Query.Get("alias"))
+
+	users, err := cli.GetThirdPartyUsersByUserID("@irc_alice:example.com")
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, "irc", users[0].Protocol)
+	assert.Equal(t, "@irc_alice:example.com", srv.LastRequest(t).Query.Get("userid"))
+}
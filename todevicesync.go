@@ -0,0 +1,77 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"maunium.net/go/mautrix/id"
+)
+
+// ToDeviceOnlyFilter returns a sync filter that excludes all room data, presence and account data, so that sync
+// responses only contain to-device events, device list changes and one-time key counts.
+func ToDeviceOnlyFilter() *Filter {
+	return &Filter{
+		AccountData: FilterPart{NotTypes: allTypes},
+		Presence:    FilterPart{NotTypes: allTypes},
+		Room: RoomFilter{
+			AccountData: FilterPart{NotTypes: allTypes},
+			Ephemeral:   FilterPart{NotTypes: allTypes},
+			State:       FilterPart{NotTypes: allTypes},
+			Timeline:    FilterPart{NotTypes: allTypes},
+		},
+	}
+}
+
+// ToDeviceSyncer is a syncer for processes that only handle end-to-end encryption, e.g. a crypto helper that
+// handles E2EE for another process over IPC. It uses ToDeviceOnlyFilter, so the server doesn't send any room data,
+// and only dispatches to-device events to the event handlers. Sync handlers like the crypto machine still receive
+// the device lists and one-time key counts.
+//
+// The helper usually shouldn't affect the user's presence, so Client.SyncPresence should be set to
+// event.PresenceOffline when using this syncer.
+type ToDeviceSyncer struct {
+	*DefaultSyncer
+	// OnDeviceLists is called after the response is processed if any users' device lists changed.
+	OnDeviceLists func(changed, left []id.UserID)
+	// OnOTKCount is called after each response is processed with the one-time key counts and the key algorithms
+	// that have an unused fallback key.
+	OnOTKCount func(count OTKCount, unusedFallbackKeyTypes []id.KeyAlgorithm)
+}
+
+var _ Syncer = (*ToDeviceSyncer)(nil)
+var _ ExtensibleSyncer = (*ToDeviceSyncer)(nil)
+
+// NewToDeviceSyncer returns an instantiated ToDeviceSyncer.
+func NewToDeviceSyncer() *ToDeviceSyncer {
+	return &ToDeviceSyncer{DefaultSyncer: NewDefaultSyncer()}
+}
+
+// GetFilterJSON returns ToDeviceOnlyFilter.
+func (s *ToDeviceSyncer) GetFilterJSON(_ id.UserID) *Filter {
+	return ToDeviceOnlyFilter()
+}
+
+// ProcessResponse drops any room data, presence and account data that the server sent despite the filter, then
+// handles the response like the DefaultSyncer and calls the device list and one-time key callbacks.
+func (s *ToDeviceSyncer) ProcessResponse(res *RespSync, since string) error {
+	res.Rooms.Join = nil
+	res.Rooms.Invite = nil
+	res.Rooms.Knock = nil
+	res.Rooms.Leave = nil
+	res.Presence.Events = nil
+	res.AccountData.Events = nil
+	err := s.DefaultSyncer.ProcessResponse(res, since)
+	if err != nil {
+		return err
+	}
+	if s.OnDeviceLists != nil && (len(res.DeviceLists.Changed) > 0 || len(res.DeviceLists.Left) > 0) {
+		s.OnDeviceLists(res.DeviceLists.Changed, res.DeviceLists.Left)
+	}
+	if s.OnOTKCount != nil {
+		s.OnOTKCount(res.DeviceOTKCount, res.DeviceUnusedFallbackKeyTypes)
+	}
+	return nil
+}
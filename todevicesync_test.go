@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestToDeviceOnlyFilter(t *testing.T) {
+	data, err := json.Marshal(mautrix.ToDeviceOnlyFilter())
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"account_data": {"not_types": ["*"]},
+		"presence": {"not_types": ["*"]},
+		"room": {
+			"account_data": {"not_types": ["*"]},
+			"ephemeral": {"not_types": ["*"]},
+			"state": {"not_types": ["*"]},
+			"timeline": {"not_types": ["*"]}
+		}
+	}`, string(data))
+	assert.Equal(t, mautrix.ToDeviceOnlyFilter(), mautrix.NewToDeviceSyncer().GetFilterJSON("@user:example.com"))
+}
+
+func TestToDeviceSyncer_ProcessResponse(t *testing.T) {
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"next_batch": "2",
+		"to_device": {"events": [{"type": "m.room_key_request", "sender": "@user:example.com", "content": {}}]},
+		"presence": {"events": [{"type": "m.presence", "sender": "@user:example.com", "content": {"presence": "online"}}]},
+		"account_data": {"events": [{"type": "m.direct", "content": {}}]},
+		"rooms": {
+			"join": {"!room:example.com": {
+				"timeline": {"events": [{"type": "m.room.message", "event_id": "$msg", "content": {"msgtype": "m.text", "body": "hi"}}]}
+			}},
+			"invite": {"!invite:example.com": {"invite_state": {"events": []}}},
+			"leave": {"!left:example.com": {}}
+		},
+		"device_lists": {"changed": ["@alice:example.com"], "left": ["@bob:example.com"]},
+		"device_one_time_keys_count": {"signed_curve25519": 42},
+		"device_unused_fallback_key_types": ["signed_curve25519"]
+	}`), &resp))
+
+	syncer := mautrix.NewToDeviceSyncer()
+	var events []event.Type
+	syncer.OnEvent(func(source mautrix.EventSource, evt *event.Event) {
+		events = append(events, evt.Type)
+	})
+	var syncRooms int
+	syncer.OnSync(func(resp *mautrix.RespSync, since string) bool {
+		syncRooms = len(resp.Rooms.Join) + len(resp.Rooms.Invite) + len(resp.Rooms.Leave)
+		return true
+	})
+	var changed, left []id.UserID
+	syncer.OnDeviceLists = func(c, l []id.UserID) {
+		changed, left = c, l
+	}
+	var otkCount mautrix.OTKCount
+	var fallbackKeyTypes []id.KeyAlgorithm
+	syncer.OnOTKCount = func(count mautrix.OTKCount, unusedFallbackKeyTypes []id.KeyAlgorithm) {
+		otkCount, fallbackKeyTypes = count, unusedFallbackKeyTypes
+	}
+
+	require.NoError(t, syncer.ProcessResponse(&resp, "1"))
+	assert.Equal(t, []event.Type{event.ToDeviceRoomKeyRequest}, events)
+	assert.Zero(t, syncRooms)
+	assert.Equal(t, []id.UserID{"@alice:example.com"}, changed)
+	assert.Equal(t, []id.UserID{"@bob:example.com"}, left)
+	assert.Equal(t, 42, otkCount.SignedCurve25519)
+	assert.Equal(t, []id.KeyAlgorithm{id.KeyAlgorithmSignedCurve25519}, fallbackKeyTypes)
+}
+
+func TestToDeviceSyncer_ProcessResponse_NoDeviceListChanges(t *testing.T) {
+	syncer := mautrix.NewToDeviceSyncer()
+	deviceListsCalled := false
+	syncer.OnDeviceLists = func(_, _ []id.UserID) {
+		deviceListsCalled = true
+	}
+	otkCountCalled := false
+	syncer.OnOTKCount = func(_ mautrix.OTKCount, _ []id.KeyAlgorithm) {
+		otkCountCalled = true
+	}
+	require.NoError(t, syncer.ProcessResponse(&mautrix.RespSync{NextBatch: "2"}, "1"))
+	assert.False(t, deviceListsCalled)
+	assert.True(t, otkCountCalled)
+}
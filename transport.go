@@ -0,0 +1,107 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// TransportOptions are the connection settings used to build the HTTP transport of a client.
+type TransportOptions struct {
+	// Connection pool limits. Zero means no limit, except for MaxIdleConnsPerHost,
+	// where zero means http.DefaultMaxIdleConnsPerHost.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+
+	// DisableHTTP2 makes the transport only use HTTP/1.1.
+	DisableHTTP2 bool
+
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	TLSConfig             *tls.Config
+	Proxy                 func(*http.Request) (*url.URL, error)
+
+	// RequestTimeout is the timeout of the whole HTTP client, which applies to every request including long-polling
+	// /sync requests. Set it to zero and use Client.EndpointTimeouts when different endpoints need different timeouts.
+	RequestTimeout time.Duration
+}
+
+// DefaultTransportOptions returns the transport options that match the default settings of net/http
+// and the 180 second request timeout of NewClient.
+func DefaultTransportOptions() TransportOptions {
+	return TransportOptions{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+		DialTimeout:         30 * time.Second,
+		KeepAlive:           30 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		Proxy:               http.ProxyFromEnvironment,
+		RequestTimeout:      180 * time.Second,
+	}
+}
+
+// NewTransport creates a HTTP transport with the options.
+func (opts TransportOptions) NewTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: opts.KeepAlive,
+	}
+	transport := &http.Transport{
+		Proxy:                 opts.Proxy,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       opts.MaxConnsPerHost,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		TLSHandshakeTimeout:   opts.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: opts.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       opts.TLSConfig,
+		ForceAttemptHTTP2:     !opts.DisableHTTP2,
+	}
+	if opts.DisableHTTP2 {
+		// A non-nil empty map disables the automatic HTTP/2 upgrade
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return transport
+}
+
+// ConfigureTransport replaces the HTTP client of the client with one using the given transport options.
+// The cookie jar of the previous HTTP client is kept.
+func (cli *Client) ConfigureTransport(opts TransportOptions) {
+	var jar http.CookieJar
+	if cli.Client != nil {
+		jar = cli.Client.Jar
+	}
+	cli.Client = &http.Client{
+		Transport: opts.NewTransport(),
+		Timeout:   opts.RequestTimeout,
+		Jar:       jar,
+	}
+}
+
+// withEndpointTimeout applies the timeout of the request's endpoint class from EndpointTimeouts to the request.
+// The timeout applies to each attempt separately. Deadlines already in the request context are kept if they're
+// earlier, so per-request deadlines can be set using FullRequest.Context.
+func (cli *Client) withEndpointTimeout(req *http.Request) (*http.Request, context.CancelFunc) {
+	timeout, ok := cli.EndpointTimeouts[ClassifyEndpoint(req.URL.Path)]
+	if !ok || timeout <= 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	return req.WithContext(ctx), cancel
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+)
+
+func TestTransportOptions_NewTransport(t *testing.T) {
+	opts := mautrix.DefaultTransportOptions()
+	opts.MaxConnsPerHost = 5
+	opts.ResponseHeaderTimeout = 10 * time.Second
+	transport := opts.NewTransport()
+	assert.Equal(t, 100, transport.MaxIdleConns)
+	assert.Equal(t, 10, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 5, transport.MaxConnsPerHost)
+	assert.Equal(t, 90*time.Second, transport.IdleConnTimeout)
+	assert.Equal(t, 10*time.Second, transport.ResponseHeaderTimeout)
+	assert.True(t, transport.ForceAttemptHTTP2)
+	assert.Nil(t, transport.TLSNextProto)
+
+	opts.DisableHTTP2 = true
+	transport = opts.NewTransport()
+	assert.False(t, transport.ForceAttemptHTTP2)
+	assert.NotNil(t, transport.TLSNextProto)
+	assert.Empty(t, transport.TLSNextProto)
+}
+
+func TestClient_ConfigureTransport(t *testing.T) {
+	cli := mautrix.NewTestClient(t, "https://example.com")
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	cli.Client.Jar = jar
+
+	opts := mautrix.DefaultTransportOptions()
+	opts.RequestTimeout = time.Minute
+	cli.ConfigureTransport(opts)
+	assert.Equal(t, time.Minute, cli.Client.Timeout)
+	assert.Equal(t, jar, cli.Client.Jar)
+	assert.IsType(t, &http.Transport{}, cli.Client.Transport)
+}
+
+func TestClient_EndpointTimeouts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		if r.URL.Path == "/_matrix/client/r0/sync" {
+			_, _ = w.Write([]byte(`{"next_batch": "1"}`))
+		} else {
+			_, _ = w.Write([]byte(`{"user_id": "@user:example.com"}`))
+		}
+	}))
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+	cli.EndpointTimeouts = map[mautrix.EndpointClass]time.Duration{
+		mautrix.EndpointClassOther: 50 * time.Millisecond,
+		mautrix.EndpointClassSync:  5 * time.Second,
+	}
+
+	_, err := cli.Whoami()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	// The slow /sync request is within its own timeout
+	resp, err := cli.SyncRequest(0, "", "", false, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "1", resp.NextBatch)
+
+	// An earlier deadline in the request context is kept
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = cli.SyncRequest(0, "", "", false, "", ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	delete(cli.EndpointTimeouts, mautrix.EndpointClassOther)
+	_, err = cli.Whoami()
+	require.NoError(t, err)
+}
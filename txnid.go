@@ -0,0 +1,190 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// TxnIDStore persists transaction IDs, so that transaction IDs stay unique across restarts and requests that are
+// retried with the same idempotency key reuse the same transaction ID even after the process crashes.
+type TxnIDStore interface {
+	// NextTxnCounter increments and returns the persistent transaction counter of the given device.
+	NextTxnCounter(userID id.UserID, deviceID id.DeviceID) (uint64, error)
+	// GetPendingTxnID returns the transaction ID reserved for the given idempotency key, or an empty string.
+	GetPendingTxnID(key string) (string, error)
+	// PutPendingTxnID reserves a transaction ID for the given idempotency key.
+	PutPendingTxnID(key, txnID string) error
+	// DeletePendingTxnID removes the reservation after the request has been completed.
+	DeletePendingTxnID(key string) error
+}
+
+// MemoryTxnIDStore is a TxnIDStore that keeps everything in memory. It's mostly useful for testing,
+// as it doesn't protect against duplicates after restarts.
+type MemoryTxnIDStore struct {
+	lock     sync.Mutex
+	Counters map[string]uint64 `json:"counters"`
+	Pending  map[string]string `json:"pending"`
+}
+
+var _ TxnIDStore = (*MemoryTxnIDStore)(nil)
+var _ TxnIDStore = (*FileTxnIDStore)(nil)
+
+// NewMemoryTxnIDStore creates an empty in-memory transaction ID store.
+func NewMemoryTxnIDStore() *MemoryTxnIDStore {
+	return &MemoryTxnIDStore{
+		Counters: make(map[string]uint64),
+		Pending:  make(map[string]string),
+	}
+}
+
+func (store *MemoryTxnIDStore) NextTxnCounter(userID id.UserID, deviceID id.DeviceID) (uint64, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	key := fmt.Sprintf("%s/%s", userID, deviceID)
+	store.Counters[key]++
+	return store.Counters[key], nil
+}
+
+func (store *MemoryTxnIDStore) GetPendingTxnID(key string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.Pending[key], nil
+}
+
+func (store *MemoryTxnIDStore) PutPendingTxnID(key, txnID string) error {
+	store.lock.Lock()
+	store.Pending[key] = txnID
+	store.lock.Unlock()
+	return nil
+}
+
+func (store *MemoryTxnIDStore) DeletePendingTxnID(key string) error {
+	store.lock.Lock()
+	delete(store.Pending, key)
+	store.lock.Unlock()
+	return nil
+}
+
+// FileTxnIDStore is a TxnIDStore that saves its state in a JSON file after every change.
+type FileTxnIDStore struct {
+	MemoryTxnIDStore
+	path      string
+	writeLock sync.Mutex
+}
+
+// NewFileTxnIDStore creates a transaction ID store backed by the JSON file at the given path,
+// loading the existing state if the file exists.
+func NewFileTxnIDStore(path string) (*FileTxnIDStore, error) {
+	store := &FileTxnIDStore{path: path}
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// the maps are initialized below
+	} else if err != nil {
+		return nil, err
+	} else if err = json.Unmarshal(data, &store.MemoryTxnIDStore); err != nil {
+		return nil, fmt.Errorf("failed to parse transaction ID store: %w", err)
+	}
+	if store.Counters == nil {
+		store.Counters = make(map[string]uint64)
+	}
+	if store.Pending == nil {
+		store.Pending = make(map[string]string)
+	}
+	return store, nil
+}
+
+// save writes the state to a temporary file and renames it over the store file, so a crash can't corrupt the file.
+func (store *FileTxnIDStore) save() error {
+	store.writeLock.Lock()
+	defer store.writeLock.Unlock()
+	store.lock.Lock()
+	data, err := json.Marshal(&store.MemoryTxnIDStore)
+	store.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(store.path), filepath.Base(store.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+		return err
+	}
+	return os.Rename(tempFile.Name(), store.path)
+}
+
+func (store *FileTxnIDStore) NextTxnCounter(userID id.UserID, deviceID id.DeviceID) (uint64, error) {
+	counter, _ := store.MemoryTxnIDStore.NextTxnCounter(userID, deviceID)
+	return counter, store.save()
+}
+
+func (store *FileTxnIDStore) PutPendingTxnID(key, txnID string) error {
+	_ = store.MemoryTxnIDStore.PutPendingTxnID(key, txnID)
+	return store.save()
+}
+
+func (store *FileTxnIDStore) DeletePendingTxnID(key string) error {
+	_ = store.MemoryTxnIDStore.DeletePendingTxnID(key)
+	return store.save()
+}
+
+// reserveTxnID returns the transaction ID to use for a request. If the idempotency key has a pending transaction ID
+// from an earlier attempt, it's reused. Otherwise, a new one is generated and saved for the key before the request
+// is sent. If there's no idempotency key or transaction ID store, a new transaction ID is returned.
+func (cli *Client) reserveTxnID(idempotencyKey string) (string, error) {
+	if len(idempotencyKey) == 0 || cli.TxnIDStore == nil {
+		return cli.TxnID(), nil
+	}
+	txnID, err := cli.TxnIDStore.GetPendingTxnID(idempotencyKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to get pending transaction ID: %w", err)
+	} else if len(txnID) > 0 {
+		cli.Logger.Debugfln("Reusing transaction ID %s for %s", txnID, idempotencyKey)
+		return txnID, nil
+	}
+	txnID = cli.TxnID()
+	err = cli.TxnIDStore.PutPendingTxnID(idempotencyKey, txnID)
+	if err != nil {
+		return "", fmt.Errorf("failed to save pending transaction ID: %w", err)
+	}
+	return txnID, nil
+}
+
+// finishTxnID removes the pending transaction ID of the idempotency key after the request was completed. If the
+// request failed without a response from the server, the transaction ID is kept, so that retrying the request with
+// the same idempotency key reuses it and the server can deduplicate it in case the original request went through.
+func (cli *Client) finishTxnID(idempotencyKey string, reqErr error) {
+	if len(idempotencyKey) == 0 || cli.TxnIDStore == nil {
+		return
+	}
+	var httpErr HTTPError
+	if reqErr != nil && (!errors.As(reqErr, &httpErr) || httpErr.Response == nil) {
+		return
+	}
+	err := cli.TxnIDStore.DeletePendingTxnID(idempotencyKey)
+	if err != nil {
+		cli.logWarning("Failed to delete pending transaction ID of %s: %v", idempotencyKey, err)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestFileTxnIDStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mautrix-txnid-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "txnid.json")
+
+	store, err := mautrix.NewFileTxnIDStore(path)
+	require.NoError(t, err)
+	for i := uint64(1); i <= 3; i++ {
+		counter, err := store.NextTxnCounter("@user:example.com", "DEVICE")
+		require.NoError(t, err)
+		assert.Equal(t, i, counter)
+	}
+	counter, err := store.NextTxnCounter("@user:example.com", "OTHER")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), counter)
+	require.NoError(t, store.PutPendingTxnID("key1", "txn1"))
+	require.NoError(t, store.PutPendingTxnID("key2", "txn2"))
+	require.NoError(t, store.DeletePendingTxnID("key2"))
+
+	// The state is kept after reopening the store
+	store, err = mautrix.NewFileTxnIDStore(path)
+	require.NoError(t, err)
+	counter, err = store.NextTxnCounter("@user:example.com", "DEVICE")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), counter)
+	txnID, err := store.GetPendingTxnID("key1")
+	require.NoError(t, err)
+	assert.Equal(t, "txn1", txnID)
+	txnID, err = store.GetPendingTxnID("key2")
+	require.NoError(t, err)
+	assert.Empty(t, txnID)
+
+	// No temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("not json"), 0600))
+	_, err = mautrix.NewFileTxnIDStore(path)
+	assert.Error(t, err)
+}
+
+// newTxnIDTestServer returns a server that drops the connection of the first request without responding and
+// rejects requests to !forbidden:example.com.
+func newTxnIDTestServer(t *testing.T) (*httptest.Server, *[]string) {
+	var lock sync.Mutex
+	var txnIDs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		txnIDs = append(txnIDs, r.URL.Path[strings.LastIndexByte(r.URL.Path, '/')+1:])
+		first := len(txnIDs) == 1
+		lock.Unlock()
+		if first {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			_ = conn.Close()
+			return
+		} else if strings.Contains(r.URL.Path, "!forbidden:example.com") {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "Not allowed"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"event_id": "$event"}`))
+	}))
+	return server, &txnIDs
+}
+
+func TestClient_SendMessageEventIdempotent(t *testing.T) {
+	server, txnIDs := newTxnIDTestServer(t)
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+	cli.DeviceID = "DEVICE"
+	store := mautrix.NewMemoryTxnIDStore()
+	cli.TxnIDStore = store
+	content := map[string]string{"body": "hello"}
+
+	_, err := cli.SendMessageEvent("!room:example.com", event.EventMessage, content, mautrix.ReqSendEvent{IdempotencyKey: "msg1"})
+	require.Error(t, err)
+	// The request failed without a response, so the transaction ID is kept for retrying
+	pending, _ := store.GetPendingTxnID("msg1")
+	assert.Equal(t, "mautrix-go_DEVICE_1", pending)
+
+	resp, err := cli.SendMessageEvent("!room:example.com", event.EventMessage, content, mautrix.ReqSendEvent{IdempotencyKey: "msg1"})
+	require.NoError(t, err)
+	assert.Equal(t, "$event", resp.EventID.String())
+	pending, _ = store.GetPendingTxnID("msg1")
+	assert.Empty(t, pending)
+
+	// Without an idempotency key, the persistent counter is still used
+	_, err = cli.SendMessageEvent("!room:example.com", event.EventMessage, content)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"mautrix-go_DEVICE_1", "mautrix-go_DEVICE_1", "mautrix-go_DEVICE_2"}, *txnIDs)
+}
+
+func TestClient_RedactEventIdempotent(t *testing.T) {
+	server, txnIDs := newTxnIDTestServer(t)
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+	cli.DeviceID = "DEVICE"
+	store := mautrix.NewMemoryTxnIDStore()
+	cli.TxnIDStore = store
+
+	_, err := cli.RedactEvent("!room:example.com", "$event", mautrix.ReqRedact{IdempotencyKey: "redact1"})
+	require.Error(t, err)
+	_, err = cli.RedactEvent("!room:example.com", "$event", mautrix.ReqRedact{IdempotencyKey: "redact1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"mautrix-go_DEVICE_1", "mautrix-go_DEVICE_1"}, *txnIDs)
+
+	// Errors from the server complete the transaction, as the server has seen the request
+	_, err = cli.SendMessageEvent("!forbidden:example.com", event.EventMessage, struct{}{}, mautrix.ReqSendEvent{IdempotencyKey: "msg1"})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+	pending, _ := store.GetPendingTxnID("msg1")
+	assert.Empty(t, pending)
+	_, err = cli.RedactEvent("!forbidden:example.com", "$event", mautrix.ReqRedact{IdempotencyKey: "redact2"})
+	require.Error(t, err)
+	pending, _ = store.GetPendingTxnID("redact2")
+	assert.Empty(t, pending)
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// TypingTimeout is the timeout sent to the server by StartTyping.
+	TypingTimeout = 30 * time.Second
+	// TypingRefreshInterval is how often StartTyping refreshes the typing notification. It's shorter than the timeout
+	// so that the notification doesn't flicker off between refreshes.
+	TypingRefreshInterval = 20 * time.Second
+)
+
+type typingRefresher struct {
+	cancel context.CancelFunc
+}
+
+// StartTyping marks the user as typing in the given room until StopTyping is called.
+func (cli *Client) StartTyping(roomID id.RoomID) error {
+	return cli.StartTypingWithContext(context.Background(), roomID)
+}
+
+// StartTypingWithContext marks the user as typing in the given room and keeps refreshing the typing notification in
+// the background until StopTyping is called or the context is canceled. Calling it again for the same room replaces
+// the previous refresher.
+func (cli *Client) StartTypingWithContext(ctx context.Context, roomID id.RoomID) error {
+	_, err := cli.UserTyping(roomID, true, TypingTimeout.Milliseconds())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	refresher := &typingRefresher{cancel: cancel}
+	cli.typingLock.Lock()
+	if cli.typingRefreshers == nil {
+		cli.typingRefreshers = make(map[id.RoomID]*typingRefresher)
+	}
+	if prev, ok := cli.typingRefreshers[roomID]; ok {
+		prev.cancel()
+	}
+	cli.typingRefreshers[roomID] = refresher
+	cli.typingLock.Unlock()
+	go cli.refreshTyping(ctx, roomID, refresher)
+	return nil
+}
+
+// StopTyping stops refreshing the typing notification in the given room and tells the server that the user stopped
+// typing.
+func (cli *Client) StopTyping(roomID id.RoomID) error {
+	cli.typingLock.Lock()
+	if refresher, ok := cli.typingRefreshers[roomID]; ok {
+		refresher.cancel()
+		delete(cli.typingRefreshers, roomID)
+	}
+	cli.typingLock.Unlock()
+	_, err := cli.UserTyping(roomID, false, 0)
+	return err
+}
+
+func (cli *Client) refreshTyping(ctx context.Context, roomID id.RoomID, refresher *typingRefresher) {
+	ticker := time.NewTicker(TypingRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_, err := cli.UserTyping(roomID, true, TypingTimeout.Milliseconds())
+			if err != nil {
+				cli.logWarning("Failed to refresh typing notification in %s: %v", roomID, err)
+			}
+		case <-ctx.Done():
+			cli.typingLock.Lock()
+			// If the refresher is still registered, the parent context was canceled rather than StopTyping being
+			// called or the refresher being replaced, so the typing notification needs to be cleared here.
+			stillActive := cli.typingRefreshers[roomID] == refresher
+			if stillActive {
+				delete(cli.typingRefreshers, roomID)
+			}
+			cli.typingLock.Unlock()
+			if stillActive {
+				_, err := cli.UserTyping(roomID, false, 0)
+				if err != nil {
+					cli.logWarning("Failed to stop typing in %s: %v", roomID, err)
+				}
+			}
+			return
+		}
+	}
+}
+
+// TypingChangeHandler is called when the list of users typing in a room changes.
+type TypingChangeHandler func(roomID id.RoomID, typing, started, stopped []id.UserID)
+
+// TypingTracker keeps track of which users are typing in each room based on the m.typing events received in /sync.
+// Create one with NewTypingTracker and call Register with your DefaultSyncer to start tracking.
+type TypingTracker struct {
+	typing   map[id.RoomID][]id.UserID
+	handlers []TypingChangeHandler
+	lock     sync.RWMutex
+}
+
+// NewTypingTracker creates an empty typing tracker.
+func NewTypingTracker() *TypingTracker {
+	return &TypingTracker{
+		typing: make(map[id.RoomID][]id.UserID),
+	}
+}
+
+// Register adds the typing event handler to the given syncer.
+func (tt *TypingTracker) Register(syncer *DefaultSyncer) {
+	syncer.OnEventType(event.EphemeralEventTyping, tt.handleTyping)
+}
+
+// OnChange adds a handler that is called with the users who are typing, started typing and stopped typing whenever
+// the typing users in a room change.
+func (tt *TypingTracker) OnChange(handler TypingChangeHandler) {
+	tt.lock.Lock()
+	tt.handlers = append(tt.handlers, handler)
+	tt.lock.Unlock()
+}
+
+// Get returns the users who are currently typing in the given room.
+func (tt *TypingTracker) Get(roomID id.RoomID) []id.UserID {
+	tt.lock.RLock()
+	defer tt.lock.RUnlock()
+	typing := make([]id.UserID, len(tt.typing[roomID]))
+	copy(typing, tt.typing[roomID])
+	return typing
+}
+
+func (tt *TypingTracker) handleTyping(_ EventSource, evt *event.Event) {
+	// The content isn't parsed if ParseEventContent is disabled in the syncer
+	if evt.Content.Parsed == nil && evt.Content.ParseRaw(evt.Type) != nil {
+		return
+	}
+	content, ok := evt.Content.Parsed.(*event.TypingEventContent)
+	if !ok {
+		return
+	}
+	typing := make([]id.UserID, len(content.UserIDs))
+	copy(typing, content.UserIDs)
+	tt.lock.Lock()
+	started := userIDDifference(typing, tt.typing[evt.RoomID])
+	stopped := userIDDifference(tt.typing[evt.RoomID], typing)
+	if len(typing) > 0 {
+		tt.typing[evt.RoomID] = typing
+	} else {
+		delete(tt.typing, evt.RoomID)
+	}
+	handlers := tt.handlers
+	tt.lock.Unlock()
+	if len(started) == 0 && len(stopped) == 0 {
+		return
+	}
+	for _, handler := range handlers {
+		handler(evt.RoomID, typing, started, stopped)
+	}
+}
+
+// userIDDifference returns the user IDs in a that aren't in b.
+func userIDDifference(a, b []id.UserID) (diff []id.UserID) {
+	inB := make(map[id.UserID]struct{}, len(b))
+	for _, userID := range b {
+		inB[userID] = struct{}{}
+	}
+	for _, userID := range a {
+		if _, ok := inB[userID]; !ok {
+			diff = append(diff, userID)
+		}
+	}
+	return
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const typingTestPath = "/_matrix/client/r0/rooms/!room:example.com/typing/@user:example.com"
+
+// typingRequests returns the typing flags of the typing requests made since the previous call.
+func typingRequests(t *testing.T, srv *recordingServer) (typing []bool) {
+	for _, req := range srv.Requests() {
+		require.Equal(t, "PUT "+typingTestPath, req.Method+" "+req.Path)
+		var body mautrix.ReqTyping
+		require.NoError(t, json.Unmarshal([]byte(req.Body), &body))
+		if body.Typing {
+			assert.Equal(t, mautrix.TypingTimeout.Milliseconds(), body.Timeout)
+		}
+		typing = append(typing, body.Typing)
+	}
+	return
+}
+
+func TestClient_StartTypingWithContext(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	require.NoError(t, cli.StartTypingWithContext(context.Background(), "!room:example.com"))
+	assert.Equal(t, []bool{true}, typingRequests(t, srv))
+	require.NoError(t, cli.StopTyping("!room:example.com"))
+	assert.Equal(t, []bool{false}, typingRequests(t, srv))
+
+	// The stopped refresher doesn't send anything more
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, typingRequests(t, srv))
+}
+
+func TestClient_StartTypingWithContext_Replace(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	defer cancel1()
+	require.NoError(t, cli.StartTypingWithContext(ctx1, "!room:example.com"))
+	require.NoError(t, cli.StartTyping("!room:example.com"))
+	assert.Equal(t, []bool{true, true}, typingRequests(t, srv))
+
+	// Canceling the context of the replaced refresher mustn't stop typing for the new one
+	cancel1()
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, typingRequests(t, srv))
+
+	require.NoError(t, cli.StopTyping("!room:example.com"))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []bool{false}, typingRequests(t, srv))
+}
+
+func TestClient_StartTypingWithContext_Cancel(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, cli.StartTypingWithContext(ctx, "!room:example.com"))
+	assert.Equal(t, []bool{true}, typingRequests(t, srv))
+
+	cancel()
+	var typing []bool
+	require.Eventually(t, func() bool {
+		typing = append(typing, typingRequests(t, srv)...)
+		return len(typing) > 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []bool{false}, typing)
+
+	// The refresher was removed, so stopping only sends the stop request itself
+	require.NoError(t, cli.StopTyping("!room:example.com"))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []bool{false}, typingRequests(t, srv))
+}
+
+func TestClient_StartTypingWithContext_Error(t *testing.T) {
+	srv := newRecordingServer()
+	defer srv.Close()
+	srv.RespondStatus("PUT "+typingTestPath, 403, `{"errcode": "M_FORBIDDEN", "error": "Not in room"}`)
+	cli := mautrix.NewTestClient(t, srv.URL)
+
+	assert.Error(t, cli.StartTypingWithContext(context.Background(), "!room:example.com"))
+	assert.Equal(t, []bool{true}, typingRequests(t, srv))
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, typingRequests(t, srv))
+}
+
+type typingChange struct {
+	RoomID  id.RoomID
+	Typing  []id.UserID
+	Started []id.UserID
+	Stopped []id.UserID
+}
+
+func TestTypingTracker(t *testing.T) {
+	syncer := mautrix.NewDefaultSyncer()
+	tracker := mautrix.NewTypingTracker()
+	tracker.Register(syncer)
+	var changes []typingChange
+	tracker.OnChange(func(roomID id.RoomID, typing, started, stopped []id.UserID) {
+		changes = append(changes, typingChange{roomID, typing, started, stopped})
+	})
+	sendTyping := func(userIDs string) {
+		var resp mautrix.RespSync
+		require.NoError(t, json.Unmarshal([]byte(`{"next_batch": "2", "rooms": {"join": {"!room:example.com": {
+			"ephemeral": {"events": [{"type": "m.typing", "content": {"user_ids": [`+userIDs+`]}}]}
+		}}}}`), &resp))
+		require.NoError(t, syncer.ProcessResponse(&resp, "1"))
+	}
+
+	sendTyping(`"@alice:example.com", "@bob:example.com"`)
+	sendTyping(`"@bob:example.com", "@alice:example.com"`)
+	sendTyping(`"@bob:example.com", "@carol:example.com"`)
+	assert.Equal(t, []id.UserID{"@bob:example.com", "@carol:example.com"}, tracker.Get("!room:example.com"))
+	sendTyping(``)
+	assert.Empty(t, tracker.Get("!room:example.com"))
+
+	assert.Equal(t, []typingChange{{
+		RoomID:  "!room:example.com",
+		Typing:  []id.UserID{"@alice:example.com", "@bob:example.com"},
+		Started: []id.UserID{"@alice:example.com", "@bob:example.com"},
+	}, {
+		// Reordering the same users isn't a change
+		RoomID:  "!room:example.com",
+		Typing:  []id.UserID{"@bob:example.com", "@carol:example.com"},
+		Started: []id.UserID{"@carol:example.com"},
+		Stopped: []id.UserID{"@alice:example.com"},
+	}, {
+		RoomID:  "!room:example.com",
+		Typing:  []id.UserID{},
+		Stopped: []id.UserID{"@bob:example.com", "@carol:example.com"},
+	}}, changes)
+}
@@ -0,0 +1,322 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrNoSupportedUIAFlow = errors.New("none of the user-interactive auth flows are supported")
+	ErrTooManyUIAStages   = errors.New("user-interactive auth didn't complete after too many stages")
+)
+
+// maxUIAStages is the maximum number of times a request is retried with new auth data before giving up.
+const maxUIAStages = 10
+
+// UIAStageFunc produces the auth data for a single user-interactive auth stage.
+// The returned value must include the type and session fields.
+type UIAStageFunc func(cli *Client, uia *RespUserInteractive, stage AuthType) (interface{}, error)
+
+// UIAHandler completes user-interactive authentication flows. The built-in stages are only used if the fields they
+// need are set, except for m.login.dummy, which is always supported. Flows are tried in the order the server lists
+// them, and the first flow whose stages are all supported is used.
+//
+// See https://spec.matrix.org/v1.3/client-server-api/#user-interactive-authentication-api
+type UIAHandler struct {
+	// The user and password for m.login.password. If User is empty, the client's user ID is used.
+	User     string
+	Password string
+	// The registration token for m.login.registration_token.
+	RegistrationToken string
+	// ReCAPTCHA is called with the public key of the site for m.login.recaptcha and must return the response token.
+	ReCAPTCHA func(publicKey string) (string, error)
+	// Fallback is called with the fallback URL of stages that require the user to complete them in a browser,
+	// like m.login.sso. It must return after the user has completed the stage.
+	Fallback func(stage AuthType, fallbackURL string) error
+	// FallbackStages are the stages that are completed through the fallback URL. Defaults to m.login.sso.
+	FallbackStages []AuthType
+
+	// Stages can be used to override the built-in stages or to support other stages.
+	Stages map[AuthType]UIAStageFunc
+	// Callback is used if none of the flows are supported by the stages above. It receives the whole UIA response
+	// and must return the complete auth data, or nil to give up.
+	Callback UIACallback
+}
+
+// ReqUIAuthPassword is the auth data for the m.login.password stage.
+type ReqUIAuthPassword struct {
+	BaseAuthData
+	Identifier UserIdentifier `json:"identifier"`
+	Password   string         `json:"password"`
+}
+
+// ReqUIAuthReCAPTCHA is the auth data for the m.login.recaptcha stage.
+type ReqUIAuthReCAPTCHA struct {
+	BaseAuthData
+	Response string `json:"response"`
+}
+
+// ReqUIAuthRegistrationToken is the auth data for the m.login.registration_token stage.
+type ReqUIAuthRegistrationToken struct {
+	BaseAuthData
+	Token string `json:"token"`
+}
+
+func (handler *UIAHandler) isFallbackStage(stage AuthType) bool {
+	if len(handler.FallbackStages) == 0 {
+		return stage == AuthTypeSSO
+	}
+	for _, fallbackStage := range handler.FallbackStages {
+		if fallbackStage == stage {
+			return true
+		}
+	}
+	return false
+}
+
+func (handler *UIAHandler) getStage(stage AuthType) UIAStageFunc {
+	if fn, ok := handler.Stages[stage]; ok {
+		return fn
+	} else if handler.Fallback != nil && handler.isFallbackStage(stage) {
+		return handler.fallbackStage
+	}
+	switch stage {
+	case AuthTypeDummy:
+		return dummyStage
+	case AuthTypePassword:
+		if len(handler.Password) > 0 {
+			return handler.passwordStage
+		}
+	case AuthTypeReCAPTCHA:
+		if handler.ReCAPTCHA != nil {
+			return handler.reCAPTCHAStage
+		}
+	case AuthTypeRegistrationToken:
+		if len(handler.RegistrationToken) > 0 {
+			return handler.registrationTokenStage
+		}
+	}
+	return nil
+}
+
+func dummyStage(_ *Client, uia *RespUserInteractive, stage AuthType) (interface{}, error) {
+	return &BaseAuthData{Type: stage, Session: uia.Session}, nil
+}
+
+func (handler *UIAHandler) passwordStage(cli *Client, uia *RespUserInteractive, stage AuthType) (interface{}, error) {
+	user := handler.User
+	if len(user) == 0 {
+		user = string(cli.UserID)
+	}
+	return &ReqUIAuthPassword{
+		BaseAuthData: BaseAuthData{Type: stage, Session: uia.Session},
+		Identifier:   UserIdentifier{Type: IdentifierTypeUser, User: user},
+		Password:     handler.Password,
+	}, nil
+}
+
+func (handler *UIAHandler) reCAPTCHAStage(_ *Client, uia *RespUserInteractive, stage AuthType) (interface{}, error) {
+	var publicKey string
+	if params, ok := uia.Params[stage].(map[string]interface{}); ok {
+		publicKey, _ = params["public_key"].(string)
+	}
+	response, err := handler.ReCAPTCHA(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &ReqUIAuthReCAPTCHA{
+		BaseAuthData: BaseAuthData{Type: stage, Session: uia.Session},
+		Response:     response,
+	}, nil
+}
+
+func (handler *UIAHandler) registrationTokenStage(_ *Client, uia *RespUserInteractive, stage AuthType) (interface{}, error) {
+	return &ReqUIAuthRegistrationToken{
+		BaseAuthData: BaseAuthData{Type: stage, Session: uia.Session},
+		Token:        handler.RegistrationToken,
+	}, nil
+}
+
+func (handler *UIAHandler) fallbackStage(cli *Client, uia *RespUserInteractive, stage AuthType) (interface{}, error) {
+	err := handler.Fallback(stage, cli.UIAFallbackURL(stage, uia.Session))
+	if err != nil {
+		return nil, err
+	}
+	return &BaseAuthData{Type: stage, Session: uia.Session}, nil
+}
+
+func (r *RespUserInteractive) isCompleted(stage AuthType) bool {
+	for _, completed := range r.Completed {
+		if AuthType(completed) == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// nextStage finds the first flow whose remaining stages are all supported and returns its next stage.
+func (handler *UIAHandler) nextStage(uia *RespUserInteractive) (AuthType, UIAStageFunc) {
+Flows:
+	for _, flow := range uia.Flows {
+		var next AuthType
+		var nextFn UIAStageFunc
+		for _, stage := range flow.Stages {
+			if uia.isCompleted(stage) {
+				continue
+			}
+			fn := handler.getStage(stage)
+			if fn == nil {
+				continue Flows
+			} else if nextFn == nil {
+				next, nextFn = stage, fn
+			}
+		}
+		if nextFn != nil {
+			return next, nextFn
+		}
+	}
+	return "", nil
+}
+
+// parseUIAResponse returns the user-interactive auth response if the request failed because it requires more auth.
+func parseUIAResponse(err error) *RespUserInteractive {
+	var uiaErr UIARequiredError
+	if err == nil || !errors.As(err, &uiaErr) {
+		return nil
+	}
+	return uiaErr.Response
+}
+
+// withAuth adds the auth field to the given request body.
+func withAuth(body interface{}, auth interface{}) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		} else if err = json.Unmarshal(data, &fields); err != nil {
+			return nil, fmt.Errorf("request body must be a JSON object to add user-interactive auth: %w", err)
+		}
+	}
+	authData, err := json.Marshal(auth)
+	if err != nil {
+		return nil, err
+	}
+	fields["auth"] = authData
+	return fields, nil
+}
+
+// MakeUIARequest makes a request to an endpoint that may require user-interactive authentication. If the server
+// responds with a list of auth flows, the handler is used to complete the stages one by one, and the request is
+// retried with the auth data of each stage until it succeeds. The auth field is added to the JSON body automatically.
+//
+// If the server rejects the auth data of a stage (e.g. because of a wrong password), the error is returned as-is.
+func (cli *Client) MakeUIARequest(params FullRequest, handler *UIAHandler) ([]byte, error) {
+	if handler == nil {
+		handler = &UIAHandler{}
+	}
+	origBody := params.RequestJSON
+	for i := 0; ; i++ {
+		data, err := cli.MakeFullRequest(params)
+		uia := parseUIAResponse(err)
+		if uia == nil {
+			return data, err
+		} else if len(uia.ErrCode) > 0 && i > 0 {
+			// The previous stage failed, retrying it with the same data won't help
+			return data, err
+		} else if i >= maxUIAStages {
+			return data, ErrTooManyUIAStages
+		}
+		var auth interface{}
+		stage, stageFn := handler.nextStage(uia)
+		if stageFn != nil {
+			auth, err = stageFn(cli, uia, stage)
+			if err != nil {
+				return nil, fmt.Errorf("failed to complete %s stage: %w", stage, err)
+			}
+		} else if handler.Callback != nil {
+			auth = handler.Callback(uia)
+		} else {
+			return data, ErrNoSupportedUIAFlow
+		}
+		if auth == nil {
+			return data, err
+		}
+		params.RequestJSON, err = withAuth(origBody, auth)
+		if err != nil {
+			return nil, err
+		}
+		params.SensitiveContent = true
+	}
+}
+
+// UIAFallbackURL returns the URL of the fallback web page for the given auth stage.
+// See https://spec.matrix.org/v1.3/client-server-api/#fallback
+func (cli *Client) UIAFallbackURL(stage AuthType, session string) string {
+	return cli.BuildBaseURLWithQuery(URLPath{"_matrix", "client", "v3", "auth", stage, "fallback", "web"}, map[string]string{
+		"session": session,
+	})
+}
+
+// RegisterWithUIA registers a new account, using the handler to complete the user-interactive auth flow.
+//
+// This does not set credentials on the client instance. See SetCredentials() instead.
+func (cli *Client) RegisterWithUIA(req *ReqRegister, handler *UIAHandler) (resp *RespRegister, err error) {
+	_, err = cli.MakeUIARequest(FullRequest{
+		Method:           http.MethodPost,
+		URL:              cli.BuildURL("register"),
+		RequestJSON:      req,
+		ResponseJSON:     &resp,
+		SensitiveContent: len(req.Password) > 0,
+	}, handler)
+	return
+}
+
+// DeleteDeviceWithUIA deletes the given device, using the handler to complete the user-interactive auth flow.
+func (cli *Client) DeleteDeviceWithUIA(deviceID id.DeviceID, handler *UIAHandler) error {
+	_, err := cli.MakeUIARequest(FullRequest{
+		Method:      http.MethodDelete,
+		URL:         cli.BuildURL("devices", deviceID),
+		RequestJSON: &ReqDeleteDevice{},
+	}, handler)
+	return err
+}
+
+// DeleteDevicesWithUIA deletes the given devices, using the handler to complete the user-interactive auth flow.
+func (cli *Client) DeleteDevicesWithUIA(deviceIDs []id.DeviceID, handler *UIAHandler) error {
+	_, err := cli.MakeUIARequest(FullRequest{
+		Method:      http.MethodPost,
+		URL:         cli.BuildURL("delete_devices"),
+		RequestJSON: &ReqDeleteDevices{Devices: deviceIDs},
+	}, handler)
+	return err
+}
+
+// LogoutOtherDevices deletes all devices of the user except the current one, which logs out all other sessions.
+// The handler is used to complete the user-interactive auth flow. The IDs of the deleted devices are returned.
+func (cli *Client) LogoutOtherDevices(handler *UIAHandler) ([]id.DeviceID, error) {
+	devices, err := cli.GetDevicesInfo()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device list: %w", err)
+	}
+	deviceIDs := make([]id.DeviceID, 0, len(devices.Devices))
+	for _, device := range devices.Devices {
+		if device.DeviceID != cli.DeviceID {
+			deviceIDs = append(deviceIDs, device.DeviceID)
+		}
+	}
+	if len(deviceIDs) == 0 {
+		return deviceIDs, nil
+	}
+	return deviceIDs, cli.DeleteDevicesWithUIA(deviceIDs, handler)
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func newCrossSigningUploadServer(t *testing.T, requests *[]map[string]json.RawMessage) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/_matrix/client/unstable/keys/device_signing/upload", r.URL.Path)
+		var req map[string]json.RawMessage
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		*requests = append(*requests, req)
+		if _, ok := req["auth"]; !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"session": "xyz", "flows": [{"stages": ["m.login.sso"]}, {"stages": ["m.login.password"]}], "params": {}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+}
+
+var testCrossSigningKeys = &mautrix.UploadCrossSigningKeysReq{
+	Master: mautrix.CrossSigningKeys{
+		UserID: "@user:example.com",
+		Usage:  []id.CrossSigningUsage{id.XSUsageMaster},
+		Keys:   map[id.KeyID]id.Ed25519{"ed25519:master": "master"},
+	},
+	SelfSigning: mautrix.CrossSigningKeys{
+		UserID: "@user:example.com",
+		Usage:  []id.CrossSigningUsage{id.XSUsageSelfSigning},
+		Keys:   map[id.KeyID]id.Ed25519{"ed25519:self": "self"},
+	},
+	UserSigning: mautrix.CrossSigningKeys{
+		UserID: "@user:example.com",
+		Usage:  []id.CrossSigningUsage{id.XSUsageUserSigning},
+		Keys:   map[id.KeyID]id.Ed25519{"ed25519:user": "user"},
+	},
+}
+
+func TestClient_UploadCrossSigningKeysWithUIA(t *testing.T) {
+	var requests []map[string]json.RawMessage
+	server := newCrossSigningUploadServer(t, &requests)
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+
+	err := cli.UploadCrossSigningKeysWithUIA(testCrossSigningKeys, &mautrix.UIAHandler{Password: "hunter2"})
+	require.NoError(t, err)
+	require.Len(t, requests, 2)
+	assert.NotContains(t, requests[0], "auth")
+	for _, req := range requests {
+		assert.JSONEq(t, `{"user_id": "@user:example.com", "usage": ["master"], "keys": {"ed25519:master": "master"}}`, string(req["master_key"]))
+		assert.Contains(t, req, "self_signing_key")
+		assert.Contains(t, req, "user_signing_key")
+	}
+	assert.JSONEq(t, `{
+		"type": "m.login.password",
+		"session": "xyz",
+		"identifier": {"type": "m.id.user", "user": "@user:example.com"},
+		"password": "hunter2"
+	}`, string(requests[1]["auth"]))
+	// The auth data isn't added to the caller's request
+	assert.Nil(t, testCrossSigningKeys.Auth)
+}
+
+func TestClient_UploadCrossSigningKeysWithUIA_Unsupported(t *testing.T) {
+	var requests []map[string]json.RawMessage
+	server := newCrossSigningUploadServer(t, &requests)
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+
+	// Without a password, neither flow is supported
+	err := cli.UploadCrossSigningKeysWithUIA(testCrossSigningKeys, nil)
+	assert.ErrorIs(t, err, mautrix.ErrNoSupportedUIAFlow)
+	assert.Len(t, requests, 1)
+}
+
+func TestClient_UploadCrossSigningKeys_Callback(t *testing.T) {
+	var requests []map[string]json.RawMessage
+	server := newCrossSigningUploadServer(t, &requests)
+	defer server.Close()
+	cli := mautrix.NewTestClient(t, server.URL)
+
+	err := cli.UploadCrossSigningKeys(testCrossSigningKeys, func(uia *mautrix.RespUserInteractive) interface{} {
+		return &mautrix.BaseAuthData{Type: "m.login.custom", Session: uia.Session}
+	})
+	require.NoError(t, err)
+	require.Len(t, requests, 2)
+	assert.JSONEq(t, `{"type": "m.login.custom", "session": "xyz"}`, string(requests[1]["auth"]))
+}